@@ -2,4 +2,13 @@ module gome-assistant
 
 go 1.23
 
-require github.com/joho/godotenv v1.5.1
+require (
+	github.com/eclipse/paho.mqtt.golang v1.5.0
+	github.com/joho/godotenv v1.5.1
+	github.com/teambition/rrule-go v1.8.2
+	golang.org/x/net v0.27.0
+	golang.org/x/sync v0.7.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require github.com/gorilla/websocket v1.5.3 // indirect
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"gome-assistant/internal/audit"
+	"gome-assistant/internal/config"
+)
+
+// runHistory is the history subcommand, listing the audit log with the configuration of the daemon
+func runHistory(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	since := fs.String("since", "", "List records since a duration ago like 7d or 12h, a date or an RFC 3339 time (default: all)")
+	outcome := fs.String("outcome", "", "List only records of an outcome, e.g. TURN_OFF, TURN_ON, ACTION_FAILED or CONTROL")
+	asJSON := fs.Bool("json", false, "Print JSON lines instead of a table")
+	stats := fs.Bool("stats", false, "Print the number of records per day and outcome")
+	cfg := config.LoadFlags(fs, args)
+
+	if cfg.AuditFile == "" {
+		fatal(exitConfig, "AUDIT_FILE is not set")
+	}
+	q := audit.Query{Outcome: *outcome, Location: cfg.ReportLocation()}
+	if *since != "" {
+		t, err := audit.ParseSince(*since, time.Now(), q.Location)
+		if err != nil {
+			fatal(exitConfig, "Invalid -since", "error", err)
+		}
+		q.Since = t
+	}
+
+	var err error
+	switch {
+	case *stats:
+		err = printStats(cfg.AuditFile, q, *asJSON)
+	case *asJSON:
+		err = audit.PrintHistoryJSON(os.Stdout, cfg.AuditFile, q)
+	default:
+		err = audit.PrintHistory(os.Stdout, cfg.AuditFile, q)
+	}
+	if err != nil {
+		fatal(exitRuntime, "Reading audit log failed", "error", err)
+	}
+}
+
+// printStats prints the counts per day and outcome as a table or JSON lines
+func printStats(path string, q audit.Query, asJSON bool) error {
+	stats, err := audit.HistoryStats(path, q)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, s := range stats {
+			if err := enc.Encode(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "DAY\tOUTCOME\tCOUNT")
+	for _, s := range stats {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\n", s.Day, s.Outcome, s.Count)
+	}
+	return tw.Flush()
+}
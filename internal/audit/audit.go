@@ -0,0 +1,124 @@
+// Package audit appends every relay action and control command to a JSON lines file
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"gome-assistant/internal/controller"
+)
+
+// Record is one line of the audit log
+type Record struct {
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance,omitempty"`
+	Type     string    `json:"type"`
+	Source   string    `json:"source"`
+	Device   string    `json:"device,omitempty"`
+	Action   string    `json:"action,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	Watts    float64   `json:"watts,omitempty"`
+	DryRun   bool      `json:"dry_run,omitempty"`
+
+	StandbySeconds int     `json:"standby_seconds,omitempty"` // Of an automatic action
+	Price          float64 `json:"price,omitempty"`           // Electricity price per kWh at an automatic action
+	Stack          string  `json:"stack,omitempty"`           // Of a panicked check
+}
+
+// Log appends every action and control command to a JSON lines file
+type Log struct {
+	file     *os.File
+	instance string // Recorded in every record
+}
+
+func New(path, instance string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{file: file, instance: instance}, nil
+}
+
+// Handle is the event bus subscriber of the audit log
+func (a *Log) Handle(be controller.BusEvent) error {
+	var record Record
+	switch e := be.(type) {
+	case controller.ActionExecuted:
+		record = Record{Time: e.Time, Type: "action", Source: e.Source, Device: e.Device, Action: e.Action, Watts: e.Watts, DryRun: e.DryRun}
+		if e.Source == controller.SourceAuto {
+			record.Detail = fmt.Sprintf("standby for %s", e.StandbyDuration.Round(time.Second))
+			record.StandbySeconds = int(e.StandbyDuration.Seconds())
+			record.Price = e.Price
+		}
+	case controller.ActionFailed:
+		record = Record{Time: e.Time, Type: "action_failed", Source: e.Source, Device: e.Device, Action: e.Action, Detail: e.Err.Error(), Watts: e.Watts}
+	case controller.ActionVetoed:
+		record = Record{Time: e.Time, Type: "action_vetoed", Source: e.Source, Device: e.Device, Action: e.Action, Detail: e.Reason, Watts: e.Watts}
+	case controller.ControlApplied:
+		record = Record{Time: e.Time, Type: "control", Source: e.Source, Device: e.Device, Action: e.Command, Detail: e.Detail}
+	case controller.PowerOnDetected:
+		record = Record{Time: e.Time, Type: "power_on", Source: controller.SourceAuto, Device: e.Device, Watts: e.Watts}
+	case controller.LockoutEngaged:
+		record = Record{Time: e.Time, Type: "lockout", Source: controller.SourceAuto, Device: e.Device, Detail: e.Reason, Watts: e.Watts}
+	case controller.CyclePanicked:
+		record = Record{Time: e.Time, Type: "panic", Source: controller.SourceAuto, Device: e.Device, Detail: e.Value, Stack: e.Stack}
+	case controller.LeadershipChanged:
+		record = Record{Time: e.Time, Type: "leadership", Source: e.Identity, Detail: "follower"}
+		if e.Leader {
+			record.Detail = "leader"
+		}
+	default:
+		return nil
+	}
+
+	record.Instance = a.instance
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// ReadFile reads the records of an audit log. Lines that aren't valid records, like one cut off by a
+// crash, are skipped.
+func ReadFile(path string) ([]Record, error) {
+	var records []Record
+	err := Each(path, func(record Record) error {
+		records = append(records, record)
+		return nil
+	})
+	return records, err
+}
+
+// Each calls fn for the records of an audit log in file order, one line at a time instead of reading
+// the whole file. Lines that aren't valid records are skipped with a warning. An error of fn stops it.
+func Each(path string, fn func(Record) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			slog.Warn("Skipping an invalid audit record", "path", path, "line", line, "error", err)
+			continue
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Close closes the audit file
+func (a *Log) Close() {
+	_ = a.file.Close()
+}
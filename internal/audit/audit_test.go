@@ -0,0 +1,35 @@
+package audit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/controller"
+)
+
+func TestPanicRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := New(path, "printer-room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC)
+	stack := "goroutine 7 [running]:\ngome-assistant/internal/relay.(*Shelly).Off(...)"
+	if err := log.Handle(controller.CyclePanicked{Time: at, Device: "bambu-plug", Value: "assignment to entry in nil map", Stack: stack}); err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+
+	records, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Record{Time: at, Instance: "printer-room", Type: "panic", Source: controller.SourceAuto, Device: "bambu-plug", Detail: "assignment to entry in nil map", Stack: stack}
+	if len(records) != 1 || records[0] != want {
+		t.Fatalf("records = %+v, want %+v", records, want)
+	}
+	if Outcome(records[0]) != "PANIC" {
+		t.Errorf("outcome = %q, want PANIC", Outcome(records[0]))
+	}
+}
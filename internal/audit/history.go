@@ -0,0 +1,153 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gome-assistant/internal/controller"
+)
+
+// historyFlushRows is how many table rows are aligned together before they are written out
+const historyFlushRows = 100
+
+// Query selects the records of a history listing
+type Query struct {
+	Since    time.Time      // Zero lists all records
+	Outcome  string         // Empty lists all outcomes, compared case-insensitively
+	Location *time.Location // Of the printed times and the days of stats
+}
+
+// Outcome names what a record stands for: TURN_OFF or TURN_ON for actions, the upper-case type otherwise
+func Outcome(r Record) string {
+	if r.Type == "action" {
+		if r.Action == controller.ActionOn {
+			return "TURN_ON"
+		}
+		return controller.OutcomeTurnOff
+	}
+	return strings.ToUpper(r.Type)
+}
+
+// result sums up how an action ended
+func result(r Record) string {
+	switch r.Type {
+	case "action":
+		if r.DryRun {
+			return "dry run"
+		}
+		return "done"
+	case "action_failed":
+		return "failed"
+	case "action_vetoed":
+		return "vetoed"
+	}
+	return ""
+}
+
+func (q Query) matches(r Record) bool {
+	return !r.Time.Before(q.Since) && (q.Outcome == "" || strings.EqualFold(q.Outcome, Outcome(r)))
+}
+
+// PrintHistory writes the matching records of the audit log at path as a table
+func PrintHistory(w io.Writer, path string, q Query) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	row := func(cells ...string) {
+		_, _ = fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	row("TIME", "INSTANCE", "DEVICE", "OUTCOME", "SOURCE", "WATTS", "RESULT", "DETAIL")
+	rows := 0
+	err := Each(path, func(r Record) error {
+		if !q.matches(r) {
+			return nil
+		}
+		watts := ""
+		if r.Watts != 0 {
+			watts = strconv.FormatFloat(r.Watts, 'f', 1, 64)
+		}
+		row(r.Time.In(q.Location).Format("2006-01-02 15:04:05"), r.Instance, r.Device, Outcome(r), r.Source, watts, result(r), r.Detail)
+		// Rows go out in blocks, so a long log isn't held in memory just to align the columns
+		if rows++; rows%historyFlushRows == 0 {
+			return tw.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+// PrintHistoryJSON writes the matching records of the audit log at path as JSON lines with their outcome
+func PrintHistoryJSON(w io.Writer, path string, q Query) error {
+	enc := json.NewEncoder(w)
+	return Each(path, func(r Record) error {
+		if !q.matches(r) {
+			return nil
+		}
+		return enc.Encode(struct {
+			Record
+			Outcome string `json:"outcome"`
+		}{r, Outcome(r)})
+	})
+}
+
+// DayCount is the number of records of an outcome on a day
+type DayCount struct {
+	Day     string `json:"day"`
+	Outcome string `json:"outcome"`
+	Count   int    `json:"count"`
+}
+
+// HistoryStats counts the matching records of the audit log at path per day and outcome, sorted by
+// day and outcome
+func HistoryStats(path string, q Query) ([]DayCount, error) {
+	counts := map[DayCount]int{}
+	err := Each(path, func(r Record) error {
+		if q.matches(r) {
+			counts[DayCount{Day: r.Time.In(q.Location).Format("2006-01-02"), Outcome: Outcome(r)}]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]DayCount, 0, len(counts))
+	for key, count := range counts {
+		key.Count = count
+		stats = append(stats, key)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Day != stats[j].Day {
+			return stats[i].Day < stats[j].Day
+		}
+		return stats[i].Outcome < stats[j].Outcome
+	})
+	return stats, nil
+}
+
+// ParseSince reads the start of a history listing: a duration back from now, which may count days
+// like 7d, or an RFC 3339 time or a date in loc
+func ParseSince(s string, now time.Time, loc *time.Location) (time.Time, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, loc); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid since %q, expected a duration like 7d or 12h, a date or an RFC 3339 time", s)
+}
@@ -0,0 +1,255 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixture is an audit log of three days in October 2026 with a non-JSON, a cut off, an empty and a
+// record with an invalid time among the records
+var fixture = filepath.Join("testdata", "history.jsonl")
+
+// berlin is the report time zone of the tests, two hours ahead of UTC in October
+var berlin = mustLoadLocation("Europe/Berlin")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// captureWarnings sends the default logger to a buffer until the test ends
+func captureWarnings(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// trimLines removes the padding tabwriter leaves at the end of the lines
+func trimLines(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestEachSkipsMalformedLines(t *testing.T) {
+	warnings := captureWarnings(t)
+	var times []string
+	err := Each(fixture, func(r Record) error {
+		times = append(times, r.Time.Format(time.RFC3339))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 8 || times[0] != "2026-10-19T21:30:00Z" || times[7] != "2026-10-21T14:00:00Z" {
+		t.Errorf("records = %v, want the 8 valid ones in file order", times)
+	}
+
+	var skipped []string
+	for _, line := range strings.Split(strings.TrimSpace(warnings.String()), "\n") {
+		if !strings.Contains(line, "Skipping an invalid audit record") {
+			t.Errorf("unexpected log line %q", line)
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			if n, ok := strings.CutPrefix(field, "line="); ok {
+				skipped = append(skipped, n)
+			}
+		}
+	}
+	if got := strings.Join(skipped, ","); got != "3,6,7,11" {
+		t.Errorf("warnings for lines %s, want 3,6,7,11", got)
+	}
+}
+
+func TestEachStops(t *testing.T) {
+	captureWarnings(t)
+	stop := errors.New("stop")
+	calls := 0
+	err := Each(fixture, func(Record) error {
+		if calls++; calls == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || calls != 2 {
+		t.Errorf("Each = %v after %d records, want the error of the second", err, calls)
+	}
+
+	if err := Each(filepath.Join(t.TempDir(), "missing.jsonl"), func(Record) error { return nil }); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestPrintHistory(t *testing.T) {
+	captureWarnings(t)
+	tests := []struct {
+		name string
+		q    Query
+		want string
+	}{
+		{"all in UTC", Query{Location: time.UTC}, `TIME                 INSTANCE      DEVICE      OUTCOME        SOURCE    WATTS  RESULT   DETAIL
+2026-10-19 21:30:00  printer-room  bambu-plug  TURN_OFF       auto      8.2    done     standby for 15m0s
+2026-10-19 22:30:00  printer-room  bambu-plug  POWER_ON       auto      120.0
+2026-10-20 07:00:00  printer-room  bambu-plug  TURN_ON        api              done
+2026-10-20 09:00:00  printer-room  bambu-plug  TURN_OFF       auto      7.9    dry run  standby for 15m0s
+2026-10-20 11:00:00  printer-room  bambu-plug  ACTION_FAILED  auto      8.0    failed   shelly: connection refused
+2026-10-21 12:00:00  printer-room  bambu-plug  ACTION_VETOED  auto      8.0    vetoed   pre-action hook denied
+2026-10-21 13:00:00  printer-room  bambu-plug  CONTROL        telegram                  for 1h0m0s
+2026-10-21 14:00:00  printer-room  bambu-plug  TURN_OFF       auto      8.1    done     standby for 20m0s
+`},
+		// The outcome is compared case-insensitively, the times are printed in the time zone
+		{"auto-offs since in Berlin", Query{Since: time.Date(2026, 10, 20, 0, 0, 0, 0, berlin), Outcome: "turn_off", Location: berlin}, `TIME                 INSTANCE      DEVICE      OUTCOME   SOURCE  WATTS  RESULT   DETAIL
+2026-10-20 11:00:00  printer-room  bambu-plug  TURN_OFF  auto    7.9    dry run  standby for 15m0s
+2026-10-21 16:00:00  printer-room  bambu-plug  TURN_OFF  auto    8.1    done     standby for 20m0s
+`},
+		{"since is inclusive", Query{Since: time.Date(2026, 10, 21, 14, 0, 0, 0, time.UTC), Location: time.UTC}, `TIME                 INSTANCE      DEVICE      OUTCOME   SOURCE  WATTS  RESULT  DETAIL
+2026-10-21 14:00:00  printer-room  bambu-plug  TURN_OFF  auto    8.1    done    standby for 20m0s
+`},
+		{"nothing matches", Query{Outcome: "PANIC", Location: time.UTC}, "TIME  INSTANCE  DEVICE  OUTCOME  SOURCE  WATTS  RESULT  DETAIL\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := PrintHistory(&out, fixture, tt.q); err != nil {
+				t.Fatal(err)
+			}
+			if got := trimLines(out.String()); got != tt.want {
+				t.Errorf("table:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintHistoryLongLog(t *testing.T) {
+	captureWarnings(t)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	var log bytes.Buffer
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 250 {
+		fmt.Fprintf(&log, `{"time":%q,"type":"action","source":"auto","device":"plug-%d","action":"off","watts":8}`+"\n", start.Add(time.Duration(i)*time.Minute).Format(time.RFC3339), i)
+	}
+	if err := os.WriteFile(path, log.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := PrintHistory(&out, path, Query{Location: time.UTC}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 251 || !strings.HasPrefix(lines[250], "2026-10-01 04:09:00") {
+		t.Fatalf("%d lines ending with %q, want the header and 250 records", len(lines), lines[len(lines)-1])
+	}
+	// Columns are aligned within a block of rows, the longer device names of the last block only widen it
+	if !strings.Contains(lines[1], "plug-0   TURN_OFF") || !strings.Contains(lines[250], "plug-249  TURN_OFF") {
+		t.Errorf("rows %q and %q not aligned by block", lines[1], lines[250])
+	}
+}
+
+func TestPrintHistoryJSON(t *testing.T) {
+	captureWarnings(t)
+	var out bytes.Buffer
+	q := Query{Since: time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC), Location: time.UTC}
+	if err := PrintHistoryJSON(&out, fixture, q); err != nil {
+		t.Fatal(err)
+	}
+
+	var outcomes []string
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var line struct {
+			Record
+			Outcome string `json:"outcome"`
+		}
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		if line.Time.Before(q.Since) || line.Device != "bambu-plug" || line.Instance != "printer-room" {
+			t.Errorf("record %+v", line.Record)
+		}
+		outcomes = append(outcomes, line.Outcome)
+	}
+	if got := strings.Join(outcomes, ","); got != "TURN_ON,TURN_OFF,ACTION_FAILED,ACTION_VETOED,CONTROL,TURN_OFF" {
+		t.Errorf("outcomes = %s", got)
+	}
+}
+
+func TestHistoryStats(t *testing.T) {
+	captureWarnings(t)
+	tests := []struct {
+		name string
+		q    Query
+		want []DayCount
+	}{
+		{"UTC", Query{Location: time.UTC}, []DayCount{
+			{"2026-10-19", "POWER_ON", 1}, {"2026-10-19", "TURN_OFF", 1},
+			{"2026-10-20", "ACTION_FAILED", 1}, {"2026-10-20", "TURN_OFF", 1}, {"2026-10-20", "TURN_ON", 1},
+			{"2026-10-21", "ACTION_VETOED", 1}, {"2026-10-21", "CONTROL", 1}, {"2026-10-21", "TURN_OFF", 1},
+		}},
+		// The power-on at 22:30 UTC is past midnight in Berlin
+		{"Berlin", Query{Location: berlin}, []DayCount{
+			{"2026-10-19", "TURN_OFF", 1},
+			{"2026-10-20", "ACTION_FAILED", 1}, {"2026-10-20", "POWER_ON", 1}, {"2026-10-20", "TURN_OFF", 1}, {"2026-10-20", "TURN_ON", 1},
+			{"2026-10-21", "ACTION_VETOED", 1}, {"2026-10-21", "CONTROL", 1}, {"2026-10-21", "TURN_OFF", 1},
+		}},
+		{"auto-offs", Query{Outcome: "TURN_OFF", Location: time.UTC}, []DayCount{
+			{"2026-10-19", "TURN_OFF", 1}, {"2026-10-20", "TURN_OFF", 1}, {"2026-10-21", "TURN_OFF", 1},
+		}},
+		{"nothing", Query{Since: time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), Location: time.UTC}, []DayCount{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats, err := HistoryStats(fixture, tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(stats) != fmt.Sprint(tt.want) {
+				t.Errorf("stats = %v, want %v", stats, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2026, 10, 21, 15, 0, 0, 0, time.UTC)
+	tests := []struct {
+		since string
+		want  time.Time
+		err   bool
+	}{
+		{"7d", time.Date(2026, 10, 14, 15, 0, 0, 0, time.UTC), false},
+		{"0d", now, false},
+		{"12h", now.Add(-12 * time.Hour), false},
+		{"90m", now.Add(-90 * time.Minute), false},
+		{"2026-10-20", time.Date(2026, 10, 20, 0, 0, 0, 0, berlin), false},
+		{"2026-10-20T08:00:00Z", time.Date(2026, 10, 20, 8, 0, 0, 0, time.UTC), false},
+		{"-7d", time.Time{}, true},
+		{"-1h", time.Time{}, true},
+		{"1w", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+		{"", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSince(tt.since, now, berlin)
+		if (err != nil) != tt.err || !got.Equal(tt.want) {
+			t.Errorf("ParseSince(%q) = %s, %v, want %s", tt.since, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+// Package calendar suspends automation during matching events of an iCal feed
+package calendar
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+
+	"github.com/teambition/rrule-go"
+)
+
+// Hold is a calendar event that suspends automatic switching
+type Hold struct {
+	Summary string    `json:"summary"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+}
+
+// Holds fetches an iCal feed periodically and turns matching events into holds
+type Holds struct {
+	url     string
+	pattern *regexp.Regexp
+	refresh time.Duration
+	horizon time.Duration
+	client  *http.Client
+
+	mu          sync.Mutex
+	holds       []Hold // Occurrences of matching events within the horizon, sorted by start
+	lastSuccess time.Time
+}
+
+func New(cfg *config.Config) (*Holds, error) {
+	pattern, err := regexp.Compile(cfg.ICalHoldPattern)
+	if err != nil {
+		return nil, fmt.Errorf("ICAL_HOLD_PATTERN: %w", err)
+	}
+	return &Holds{
+		url:     cfg.ICalURL,
+		pattern: pattern,
+		refresh: cfg.ICalRefresh,
+		horizon: cfg.ICalHorizon,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Run fetches the calendar immediately and then every refresh interval until ctx is done
+func (c *Holds) Run(ctx context.Context) {
+	for {
+		c.Update()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.refresh):
+		}
+	}
+}
+
+// Update replaces the holds with a fresh parse. On failure the last successful parse is kept.
+func (c *Holds) Update() {
+	holds, err := c.fetch(time.Now())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		if c.lastSuccess.IsZero() {
+			slog.Error("Fetching the calendar failed, no calendar holds available", "error", err)
+		} else {
+			slog.Warn("Fetching the calendar failed, using the last holds", "age", time.Since(c.lastSuccess).Round(time.Second), "error", err)
+		}
+		return
+	}
+
+	c.holds = holds
+	c.lastSuccess = time.Now()
+}
+
+// Active returns the calendar hold covering t, if any
+func (c *Holds) Active(t time.Time) *Hold {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var active *Hold
+	for _, h := range c.holds {
+		if h.Start.After(t) {
+			break
+		}
+		// Prefer the overlapping hold lasting longest
+		if t.Before(h.End) && (active == nil || h.End.After(active.End)) {
+			hold := h
+			active = &hold
+		}
+	}
+	return active
+}
+
+func (c *Holds) fetch(now time.Time) ([]Hold, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("calendar request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	events, err := parseICal(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var holds []Hold
+	for _, ev := range events {
+		if !c.pattern.MatchString(ev.Summary) {
+			continue
+		}
+		occurrences, err := ev.occurrences(now, now.Add(c.horizon))
+		if err != nil {
+			slog.Warn("Skipping a calendar event", "event", ev.Summary, "error", err)
+			continue
+		}
+		holds = append(holds, occurrences...)
+	}
+	sort.Slice(holds, func(i, j int) bool { return holds[i].Start.Before(holds[j].Start) })
+	return holds, nil
+}
+
+// icalEvent is the subset of a VEVENT needed to compute its occurrences
+type icalEvent struct {
+	Summary string
+	Start   time.Time
+	End     time.Time
+	RRule   string
+	ExDates []time.Time
+}
+
+// occurrences expands the event into the holds overlapping [from, to)
+func (ev icalEvent) occurrences(from, to time.Time) ([]Hold, error) {
+	if ev.Start.IsZero() {
+		return nil, fmt.Errorf("no DTSTART")
+	}
+	duration := ev.End.Sub(ev.Start)
+	if ev.End.IsZero() || duration <= 0 {
+		return nil, fmt.Errorf("no positive duration")
+	}
+
+	if ev.RRule == "" {
+		if ev.End.After(from) && ev.Start.Before(to) {
+			return []Hold{{Summary: ev.Summary, Start: ev.Start, End: ev.End}}, nil
+		}
+		return nil, nil
+	}
+
+	opt, err := rrule.StrToROptionInLocation(ev.RRule, ev.Start.Location())
+	if err != nil {
+		return nil, fmt.Errorf("invalid RRULE: %w", err)
+	}
+	opt.Dtstart = ev.Start
+	rule, err := rrule.NewRRule(*opt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RRULE: %w", err)
+	}
+	set := &rrule.Set{}
+	set.RRule(rule)
+	for _, ex := range ev.ExDates {
+		set.ExDate(ex)
+	}
+
+	var holds []Hold
+	// Occurrences starting before from may still be running
+	for _, start := range set.Between(from.Add(-duration), to, true) {
+		holds = append(holds, Hold{Summary: ev.Summary, Start: start, End: start.Add(duration)})
+	}
+	return holds, nil
+}
+
+// parseICal reads the VEVENTs of an iCalendar stream (RFC 5545)
+func parseICal(r io.Reader) ([]icalEvent, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		// Folded lines continue with a leading space or tab
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var events []icalEvent
+	var ev *icalEvent
+	var duration time.Duration
+	var allDay bool
+	for _, line := range lines {
+		name, params, value := splitICalLine(line)
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			ev = &icalEvent{}
+			duration = 0
+			allDay = false
+		case name == "END" && value == "VEVENT" && ev != nil:
+			if ev.End.IsZero() && duration > 0 {
+				ev.End = ev.Start.Add(duration)
+			}
+			// All-day events without end last one day
+			if ev.End.IsZero() && allDay {
+				ev.End = ev.Start.AddDate(0, 0, 1)
+			}
+			events = append(events, *ev)
+			ev = nil
+		case ev == nil:
+		case name == "SUMMARY":
+			ev.Summary = unescapeICalText(value)
+		case name == "DTSTART":
+			ev.Start, _ = parseICalTime(value, params)
+			allDay = params["VALUE"] == "DATE" || len(value) == 8
+		case name == "DTEND":
+			ev.End, _ = parseICalTime(value, params)
+		case name == "DURATION":
+			duration, _ = parseICalDuration(value)
+		case name == "RRULE":
+			ev.RRule = value
+		case name == "EXDATE":
+			for _, v := range strings.Split(value, ",") {
+				if t, err := parseICalTime(v, params); err == nil {
+					ev.ExDates = append(ev.ExDates, t)
+				}
+			}
+		}
+	}
+	if len(events) == 0 && !strings.Contains(strings.Join(lines, "\n"), "BEGIN:VCALENDAR") {
+		return nil, fmt.Errorf("response is not an iCalendar feed")
+	}
+	return events, nil
+}
+
+// splitICalLine splits "NAME;PARAM=x:value" into its parts
+func splitICalLine(line string) (string, map[string]string, string) {
+	head, value, _ := strings.Cut(line, ":")
+	parts := strings.Split(head, ";")
+	params := map[string]string{}
+	for _, p := range parts[1:] {
+		if k, v, ok := strings.Cut(p, "="); ok {
+			params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), params, value
+}
+
+// parseICalTime parses DATE and DATE-TIME values in UTC, floating or TZID local time
+func parseICalTime(value string, params map[string]string) (time.Time, error) {
+	loc := time.Local
+	if tzid := params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	if params["VALUE"] == "DATE" || len(value) == 8 {
+		return time.ParseInLocation("20060102", value, loc)
+	}
+	if strings.HasSuffix(value, "Z") {
+		return time.Parse("20060102T150405Z", value)
+	}
+	return time.ParseInLocation("20060102T150405", value, loc)
+}
+
+// icalDurationPattern matches durations such as P1D, PT2H30M or P1W
+var icalDurationPattern = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseICalDuration parses DURATION values
+func parseICalDuration(value string) (time.Duration, error) {
+	m := icalDurationPattern.FindStringSubmatch(value)
+	if m == nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, unit := range units {
+		if m[i+2] != "" {
+			n, _ := strconv.Atoi(m[i+2])
+			d += time.Duration(n) * unit
+		}
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+// unescapeICalText resolves the backslash escapes of TEXT values
+func unescapeICalText(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
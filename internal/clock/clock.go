@@ -0,0 +1,34 @@
+// Package clock abstracts the passage of time so timing logic does not depend on the wall clock
+package clock
+
+import "time"
+
+// Clock tells the time and creates timers
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker delivers ticks at intervals like time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the wall clock
+type Real struct{}
+
+// Now returns the current local time
+func (Real) Now() time.Time { return time.Now() }
+
+// NewTicker returns a ticker backed by time.Ticker
+func (Real) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+// After waits for the duration to elapse like time.After
+func (Real) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type realTicker struct{ t *time.Ticker }
+
+func (r realTicker) C() <-chan time.Time { return r.t.C }
+func (r realTicker) Stop()               { r.t.Stop() }
@@ -0,0 +1,126 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is a clock for tests that only moves when advanced. Timers and tickers fire during Advance once
+// the simulated time reaches them.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is a pending timer of After, or a ticker when period is set
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	ch     chan time.Time
+}
+
+// NewFake returns a fake clock starting at now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the simulated time
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After returns a channel receiving the simulated time once d has been advanced
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := &fakeWaiter{at: f.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.ch <- f.now
+		return w.ch
+	}
+	f.waiters = append(f.waiters, w)
+	return w.ch
+}
+
+// NewTicker returns a ticker firing every d of simulated time. Like time.Ticker it drops ticks
+// for slow receivers, and it panics if d is not positive.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for clock.Fake.NewTicker")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := &fakeWaiter{at: f.now.Add(d), period: d, ch: make(chan time.Time, 1)}
+	f.waiters = append(f.waiters, w)
+	return &fakeTicker{clock: f, w: w}
+}
+
+// Advance moves the simulated time forward by d, firing the timers and ticks due on the way in order
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setLocked(f.now.Add(d))
+}
+
+// Set moves the simulated time to t, which must not be before the current one
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t.Before(f.now) {
+		panic("clock.Fake.Set moves the time backwards")
+	}
+	f.setLocked(t)
+}
+
+// Waiters returns the number of pending timers and tickers, so a test can wait for a goroutine to block
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// setLocked fires everything due up to end and sets the time to it. The caller holds f.mu.
+func (f *Fake) setLocked(end time.Time) {
+	for {
+		sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].at.Before(f.waiters[j].at) })
+		if len(f.waiters) == 0 || f.waiters[0].at.After(end) {
+			break
+		}
+		w := f.waiters[0]
+		f.now = w.at
+		select {
+		case w.ch <- w.at:
+		default: // A tick the receiver hasn't taken yet, dropped
+		}
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			f.waiters = f.waiters[1:]
+		}
+	}
+	f.now = end
+}
+
+// remove drops a stopped ticker
+func (f *Fake) remove(w *fakeWaiter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, candidate := range f.waiters {
+		if candidate == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock *Fake
+	w     *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.w.ch }
+func (t *fakeTicker) Stop()               { t.clock.remove(t.w) }
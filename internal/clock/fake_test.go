@@ -0,0 +1,119 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC)
+
+// fired reports whether ch has a value, and which
+func fired(ch <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-ch:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeAfter(t *testing.T) {
+	f := NewFake(start)
+	ch := f.After(time.Minute)
+	if f.Waiters() != 1 {
+		t.Errorf("waiters = %d, want 1", f.Waiters())
+	}
+
+	f.Advance(59 * time.Second)
+	if _, ok := fired(ch); ok {
+		t.Fatal("fired before its time")
+	}
+	f.Advance(2 * time.Second)
+	if at, ok := fired(ch); !ok || !at.Equal(start.Add(time.Minute)) {
+		t.Fatalf("fired = %v at %s, want at %s", ok, at, start.Add(time.Minute))
+	}
+	if now := f.Now(); !now.Equal(start.Add(61 * time.Second)) {
+		t.Errorf("now = %s", now)
+	}
+	if f.Waiters() != 0 {
+		t.Errorf("waiters = %d after firing", f.Waiters())
+	}
+
+	if _, ok := fired(f.After(0)); !ok {
+		t.Error("After(0) did not fire right away")
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(start)
+	ticker := f.NewTicker(10 * time.Second)
+
+	f.Advance(10 * time.Second)
+	if at, ok := fired(ticker.C()); !ok || !at.Equal(start.Add(10*time.Second)) {
+		t.Fatalf("first tick = %v at %s", ok, at)
+	}
+	// Ticks the receiver misses are dropped, the next one stays on the grid
+	f.Advance(35 * time.Second)
+	if at, ok := fired(ticker.C()); !ok || !at.Equal(start.Add(20*time.Second)) {
+		t.Errorf("after missing ticks = %v at %s, want the first missed one", ok, at)
+	}
+	if _, ok := fired(ticker.C()); ok {
+		t.Error("more than one tick queued")
+	}
+	f.Advance(5 * time.Second)
+	if at, ok := fired(ticker.C()); !ok || !at.Equal(start.Add(50*time.Second)) {
+		t.Errorf("tick = %v at %s, want at 50s", ok, at)
+	}
+
+	ticker.Stop()
+	f.Advance(time.Minute)
+	if _, ok := fired(ticker.C()); ok {
+		t.Error("stopped ticker fired")
+	}
+	if f.Waiters() != 0 {
+		t.Errorf("waiters = %d after Stop", f.Waiters())
+	}
+}
+
+func TestFakeFiresInOrder(t *testing.T) {
+	f := NewFake(start)
+	late, early := f.After(2*time.Minute), f.After(time.Minute)
+	ticker := f.NewTicker(90 * time.Second)
+
+	var order []time.Duration
+	f.Advance(3 * time.Minute)
+	for _, ch := range []<-chan time.Time{early, late, ticker.C()} {
+		at, _ := fired(ch)
+		order = append(order, at.Sub(start))
+	}
+	if order[0] != time.Minute || order[1] != 2*time.Minute || order[2] != 90*time.Second {
+		t.Errorf("fired at %v", order)
+	}
+}
+
+func TestFakeUnblocksWaitingGoroutine(t *testing.T) {
+	f := NewFake(start)
+	done := make(chan time.Time)
+	go func() { done <- <-f.After(time.Hour) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Waiters() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the goroutine never waited")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	f.Set(start.Add(2 * time.Hour))
+	if at := <-done; !at.Equal(start.Add(time.Hour)) {
+		t.Errorf("woke at %s", at)
+	}
+}
+
+func TestFakeSetBackwardsPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic")
+		}
+	}()
+	NewFake(start).Set(start.Add(-time.Second))
+}
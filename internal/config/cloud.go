@@ -0,0 +1,37 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// ShellyCloudEnabled reports whether relay commands can go through the Shelly Cloud
+func (cfg *Config) ShellyCloudEnabled() bool {
+	return cfg.ShellyCloudServer != "" && cfg.ShellyCloudKey != ""
+}
+
+func (cfg *Config) validateShellyCloud() error {
+	if cfg.ShellyControl != ShellyControlLAN && cfg.ShellyControl != ShellyControlCloud && cfg.ShellyControl != ShellyControlMQTT {
+		return fmt.Errorf("invalid SHELLY_CONTROL %q (expected lan, cloud or mqtt)", cfg.ShellyControl)
+	}
+	if (cfg.ShellyCloudServer == "") != (cfg.ShellyCloudKey == "") {
+		return errors.New("SHELLY_CLOUD_SERVER and SHELLY_CLOUD_KEY are required together")
+	}
+	if !cfg.ShellyCloudEnabled() {
+		if cfg.ShellyControl == ShellyControlCloud {
+			return errors.New("SHELLY_CLOUD_SERVER and SHELLY_CLOUD_KEY are required when SHELLY_CONTROL=cloud")
+		}
+		return nil
+	}
+	if u, err := url.Parse(cfg.ShellyCloudServer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("SHELLY_CLOUD_SERVER %q must be an http or https URL", cfg.ShellyCloudServer)
+	}
+	if cfg.ShellyDeviceID == "" && cfg.ShellyIDLabel == "" {
+		return errors.New("SHELLY_DEVICE_ID or SHELLY_ID_LABEL is required with SHELLY_CLOUD_SERVER")
+	}
+	if cfg.ShellyIDLabel != "" && !labelName.MatchString(cfg.ShellyIDLabel) {
+		return fmt.Errorf("SHELLY_ID_LABEL %q is not a valid label name", cfg.ShellyIDLabel)
+	}
+	return nil
+}
@@ -0,0 +1,1135 @@
+// Package config loads the settings of gome-assistant from flags, the environment, .env and the config file
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Heartbeat modes
+const (
+	HeartbeatOff  = "off"
+	HeartbeatVM   = "vm"
+	HeartbeatHTTP = "http"
+)
+
+// Pre-action hook failure policies
+const (
+	PreActionAllow = "allow" // Fail open: actuate when the hook gives no valid answer
+	PreActionDeny  = "deny"  // Fail closed: skip the actuation when the hook gives no valid answer
+)
+
+// Leader election modes
+const (
+	LeaderOff        = "off"
+	LeaderAuto       = "auto" // Kubernetes lease in a cluster, lock file otherwise
+	LeaderFile       = "file"
+	LeaderKubernetes = "kubernetes"
+)
+
+// Shelly device generations
+const (
+	ShellyGenAuto = "auto" // Ask the device via /shelly
+	ShellyGen1    = "1"    // HTTP API of Gen1 devices
+	ShellyGen2    = "2"    // RPC API of Gen2 devices, like Plus, Pro and Gen3
+)
+
+// Relay backends
+const (
+	RelayShelly        = "shelly"        // Shelly plugs, Gen1 or Gen2
+	RelayTasmota       = "tasmota"       // Plugs flashed with Tasmota
+	RelayKasa          = "kasa"          // TP-Link Kasa plugs, local protocol on port 9999
+	RelayTapo          = "tapo"          // TP-Link Tapo plugs, local KLAP protocol
+	RelayHomeAssistant = "homeassistant" // A switch entity of Home Assistant, via its REST API
+)
+
+// Paths of relay commands
+const (
+	ShellyControlLAN   = "lan"   // HTTP to the device, falling back to the Shelly Cloud if it is configured
+	ShellyControlCloud = "cloud" // Shelly Cloud only
+	ShellyControlMQTT  = "mqtt"  // Commands to the topics of the device on SHELLY_MQTT_BROKER
+)
+
+// Log formats
+const (
+	LogFormatText = "text" // Lines of the standard logger with the attributes as key=value
+	LogFormatJSON = "json" // A JSON object per line
+)
+
+// Handling of check cycles running longer than the check interval
+const (
+	CycleOverrunSkip  = "skip"  // Drop the checks that fell due meanwhile and wait the whole interval
+	CycleOverrunQueue = "queue" // Run one check right away for the checks that fell due meanwhile
+)
+
+// Standby detection modes
+const (
+	StandbyModeRaw      = "raw"      // Scan the power samples for a streak in the standby range
+	StandbyModeQuantile = "quantile" // 5th and 95th percentile over STANDBY_DURATION in the standby range
+)
+
+// Printer state sources
+const (
+	PrinterSourceBambu      = "bambulab"   // bambulab_gcode_state metric
+	PrinterSourceMetric     = "metric"     // PRINTER_STATE_METRIC with PRINTER_BUSY_VALUES
+	PrinterSourceMoonraker  = "moonraker"  // Moonraker API of a Klipper printer
+	PrinterSourcePrusaLink  = "prusalink"  // PrusaLink API of a Prusa printer
+	PrinterSourceBambuCloud = "bambucloud" // Bambu Cloud API
+)
+
+// Electricity price sources
+const (
+	PriceSourceOff     = ""
+	PriceSourceTibber  = "tibber"  // Tibber GraphQL API
+	PriceSourceAwattar = "awattar" // aWATTar market data API
+)
+
+// SMTP transport security modes
+const (
+	SMTPStartTLS = "starttls"
+	SMTPTLS      = "tls"
+	SMTPPlain    = "none"
+)
+
+// Config holds the configuration for the assistant
+type Config struct {
+	ConfigFile               string
+	LogLevel                 slog.Level
+	LogFormat                string
+	effective                []string     // Settings not at their default, for Effective
+	secretFiles              []secretFile // Secrets read from their _FILE variants, for ReloadSecrets
+	VictoriaMetricsURL       string
+	VictoriaMetricsUser      string
+	VictoriaMetricsPassword  string
+	VMHeaders                string
+	ShellyDevicePattern      string
+	ShellyNameLabel          string
+	ShellyAddressLabel       string
+	ShellyRelayChannel       int
+	ShellyChannelLabel       string
+	ShellyHeaders            string
+	ShellyGen                string
+	RelayVerifyRetries       int
+	RelayAttempts            int
+	RelayRetryDelay          time.Duration
+	AutoOn                   bool
+	AutoOnQuery              string
+	ShellyUser               string
+	ShellyPassword           string
+	ShellyHosts              string
+	ShellyIP                 string
+	ShellyMDNS               bool
+	RelayType                string
+	TasmotaUser              string
+	TasmotaPassword          string
+	TapoUser                 string
+	TapoPassword             string
+	HASwitchEntity           string
+	ShellyControl            string
+	ShellyCloudServer        string
+	ShellyCloudKey           string
+	ShellyDeviceID           string
+	ShellyIDLabel            string
+	ShellyMQTTBroker         string
+	ShellyMQTTUser           string
+	ShellyMQTTPassword       string
+	ShellyMQTTTopic          string
+	ShellyMQTTID             string
+	ShellyMQTTTimeout        time.Duration
+	ShellyDNSCacheTTL        time.Duration
+	ShellyInfoMetric         string
+	ShellyInfoRefresh        time.Duration
+	ShellyDevices            string
+	shellyPatternSet         bool // SHELLY_DEVICE_PATTERN was given explicitly
+	Devices                  string
+	CheckInterval            time.Duration
+	CycleOverrun             string
+	CycleTimeout             time.Duration
+	RetryDelay               time.Duration
+	RetryMax                 int
+	OutageBackoffAfter       time.Duration
+	OutageMaxInterval        time.Duration
+	MetricsMaxAge            time.Duration
+	QueryConcurrency         int
+	QueryTimeout             time.Duration
+	MaxRangePoints           int
+	BreakerThreshold         int
+	BreakerCooldown          time.Duration
+	MinWatts                 float64
+	MaxWatts                 float64
+	StandbyDuration          time.Duration
+	StandbyMode              string
+	StandbyRequireIdle       bool
+	StandbyMaxSpread         float64
+	StandbyMaxStddev         float64
+	BootGracePeriod          time.Duration
+	OffCooldown              time.Duration
+	DryRun                   bool
+	Once                     bool
+	DryRunWatch              time.Duration
+	HistoryRequired          bool
+	HeartbeatMode            string
+	HeartbeatURL             string
+	NtfyURL                  string
+	NtfyTopic                string
+	NtfyToken                string
+	NtfyEvents               string
+	TelegramAPIURL           string
+	TelegramBotToken         string
+	TelegramChatID           string
+	TelegramEvents           string
+	TelegramMaxPerHour       int
+	FailureNotifyThreshold   int
+	ActuationMinSpacing      time.Duration
+	ActuationMaxPerHour      int
+	NotifyTest               bool
+	ShowVersion              bool
+	TelegramCommands         bool
+	TelegramAllowedChatIDs   string
+	VetoWindow               time.Duration
+	OffRecheck               bool
+	OffRecheckDelay          time.Duration
+	PushoverAPIURL           string
+	PushoverToken            string
+	PushoverUser             string
+	PushoverEvents           string
+	PushoverRetry            time.Duration
+	PushoverExpire           time.Duration
+	GotifyURL                string
+	GotifyToken              string
+	GotifyEvents             string
+	SMTPHost                 string
+	SMTPPort                 string
+	SMTPSecurity             string
+	SMTPUser                 string
+	SMTPPassword             string
+	SMTPFrom                 string
+	SMTPTo                   string
+	SMTPSubjectPrefix        string
+	SMTPEvents               string
+	WebhookURLs              string
+	WebhookSecret            string
+	WebhookRetries           int
+	NotifyMinIntervals       string
+	NotifyMaxPerHour         int
+	NotifyDedupSize          int
+	NotifyQuietHours         string
+	NotifyTemplatesFile      string
+	RenderNotification       string
+	MQTTBroker               string
+	MQTTClientID             string
+	MQTTUser                 string
+	MQTTPassword             string
+	MQTTTLSCAFile            string
+	MQTTTLSInsecure          bool
+	MQTTBaseTopic            string
+	HADiscovery              bool
+	HADiscoveryPrefix        string
+	HADiscoveryCleanup       bool
+	HAURL                    string
+	HAToken                  string
+	HTTPAddr                 string
+	MetricsAddr              string
+	DecisionHistorySize      int
+	ActionHistorySize        int
+	AlertmanagerToken        string
+	AlertmanagerPauseAlerts  string
+	AlertmanagerPauseTimeout time.Duration
+	MatrixHomeserver         string
+	MatrixAccessToken        string
+	MatrixRoomID             string
+	MatrixEvents             string
+	SignalAPIURL             string
+	SignalNumber             string
+	SignalRecipients         string
+	SignalEvents             string
+	PreActionHookURL         string
+	PreActionHookTimeout     time.Duration
+	PreActionHookFailure     string
+	ICalURL                  string
+	ICalHoldPattern          string
+	ICalRefresh              time.Duration
+	ICalHorizon              time.Duration
+	APIToken                 string
+	APITokens                string
+	APIReadPublic            bool
+	APIAuthProbes            bool
+	AuditFile                string
+	EnergyPrice              float64
+	EnergyCurrency           string
+	ReportTimezone           string
+	PriceSource              string
+	TibberToken              string
+	AwattarURL               string
+	PriceRefresh             time.Duration
+	PeakPrice                float64
+	PeakStandbyDuration      time.Duration
+	SurplusQuery             string
+	SurplusMinWatts          float64
+	SurplusWindow            time.Duration
+	StatusFile               string
+	StateFile                string
+	CORSAllowedOrigins       string
+	CORSAllowCredentials     bool
+	LeaderElection           string
+	LeaderIdentity           string
+	Instance                 string
+	LeaderLockFile           string
+	LeaderLeaseName          string
+	LeaderLeaseNamespace     string
+	LeaderLeaseDuration      time.Duration
+	LeaderRenewInterval      time.Duration
+	PrintPowerWatts          float64
+	PrintPowerDuration       time.Duration
+	PrintPowerCooldown       time.Duration
+	MaintenanceMetrics       string
+	MaintenanceMaxHold       time.Duration
+	MaintenanceNotifyAfter   time.Duration
+	CalibrationStageMetric   string
+	CalibrationStages        string
+	CalibrationPowerWatts    float64
+	CalibrationPowerDuration time.Duration
+	VoltageMetric            string
+	PowerFactorMetric        string
+	VoltageMin               float64
+	VoltageMax               float64
+	TempMetric               string
+	TempWarning              float64
+	TempCritical             float64
+	DuplicateGuard           bool
+	DuplicateGuardWindow     time.Duration
+	PrinterSource            string
+	PrinterStateMetric       string
+	PrinterBusyValues        string
+	MoonrakerURL             string
+	MoonrakerAPIKey          string
+	PrusaLinkURL             string
+	PrusaLinkAPIKey          string
+	PrusaLinkCacheTTL        time.Duration
+	BambuMQTTHost            string
+	BambuAccessCode          string
+	BambuSerial              string
+	BambuMQTTCAFile          string
+	BambuCloudToken          string
+	BambuCloudURL            string
+	BambuCloudInterval       time.Duration
+	BambuQueuePowerOn        bool
+	BambuQueueInterval       time.Duration
+	BambuQueueBuffer         time.Duration
+}
+
+// Load reads the configuration from the command line flags, the environment and an optional .env file
+func Load() Config {
+	return LoadFlags(flag.CommandLine, os.Args[1:])
+}
+
+// LoadFlags reads the configuration like Load, registering the flags on fs and parsing args. fs may
+// define further flags of a subcommand beforehand.
+func LoadFlags(fs *flag.FlagSet, args []string) Config {
+	// Load .env file if it exists, logged once the log level is known
+	dotenvErr := godotenv.Load()
+
+	cfg := Config{}
+	fileSettings, knownKeys, effective, invalidSettings, secretFiles = nil, map[string]bool{}, nil, nil, nil
+	configFile := configFilePath(args)
+	if configFile != "" {
+		var err error
+		if fileSettings, err = loadConfigFile(configFile); err != nil {
+			// Exits like an invalid flag
+			_, _ = fmt.Fprintf(fs.Output(), "Invalid config file: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	fs.StringVar(&cfg.ConfigFile, "config", configFile, "YAML config file, overridden by the environment and the flags")
+	fs.TextVar(&cfg.LogLevel, "log-level", envLevel("LOG_LEVEL", "info"), "Lowest level logged: debug, info, warn or error")
+	fs.StringVar(&cfg.LogFormat, "log-format", getEnv("LOG_FORMAT", LogFormatText), "Log format: text or json")
+
+	fs.StringVar(&cfg.VictoriaMetricsURL, "vm-url", getEnv("VM_URL", "https://vm.r4b2.de"), "VictoriaMetrics URL")
+	fs.StringVar(&cfg.VictoriaMetricsUser, "vm-user", getEnv("VM_USER", "admin"), "VictoriaMetrics basic auth user")
+	fs.StringVar(&cfg.VictoriaMetricsPassword, "vm-password", getSecret("VM_PASSWORD"), "VictoriaMetrics basic auth password")
+	fs.StringVar(&cfg.VMHeaders, "vm-headers", getEnv("VM_HEADERS", ""), "Extra headers of VictoriaMetrics requests, as Name: value separated by semicolons")
+	fs.StringVar(&cfg.ShellyDevicePattern, "shelly-pattern", getEnv("SHELLY_DEVICE_PATTERN", ".*[Bb]ambu.*"), "Regex pattern to match Shelly device name")
+	fs.StringVar(&cfg.ShellyDevices, "shelly-devices", getEnv("SHELLY_DEVICES", ""), "Comma-separated exact Shelly device names, instead of -shelly-pattern")
+	fs.StringVar(&cfg.ShellyNameLabel, "shelly-name-label", getEnv("SHELLY_NAME_LABEL", "device_name"), "Label of the Shelly series holding the device name")
+	fs.StringVar(&cfg.ShellyAddressLabel, "shelly-address-label", getEnv("SHELLY_ADDRESS_LABEL", "ip_address"), "Label of the Shelly series holding the IP address")
+	fs.IntVar(&cfg.ShellyRelayChannel, "shelly-relay-channel", envInt("SHELLY_RELAY_CHANNEL", "0"), "Relay channel of the Shelly device the printer is plugged into")
+	fs.StringVar(&cfg.Devices, "devices", getEnv("DEVICES", ""), "Printer/Shelly pairs controlled by this process, as name:key=value,... separated by semicolons")
+	fs.StringVar(&cfg.ShellyChannelLabel, "shelly-channel-label", getEnv("SHELLY_CHANNEL_LABEL", ""), "Label of the relay channel of shelly_watts, to read the power of SHELLY_RELAY_CHANNEL only (empty matches any)")
+	fs.StringVar(&cfg.ShellyHeaders, "shelly-headers", getEnv("SHELLY_HEADERS", ""), "Extra headers of requests to the Shelly device, as Name: value separated by semicolons")
+	fs.StringVar(&cfg.ShellyGen, "shelly-gen", getEnv("SHELLY_GEN", ShellyGenAuto), "API generation of the Shelly device: 1, 2 or auto to detect it")
+	fs.BoolVar(&cfg.AutoOn, "auto-on", envBool("AUTO_ON", false), "Switch the relay on when a print job shows up while the printer is off")
+	fs.StringVar(&cfg.AutoOnQuery, "auto-on-query", getEnv("AUTO_ON_QUERY", ""), "PromQL query waking the printer once a series turns non-zero (empty uses the printer state source)")
+	fs.IntVar(&cfg.RelayVerifyRetries, "relay-verify-retries", envInt("RELAY_VERIFY_RETRIES", "2"), "How often a relay command is repeated while reading the relay back shows it didn't switch")
+	fs.IntVar(&cfg.RelayAttempts, "relay-attempts", envInt("RELAY_ATTEMPTS", "3"), "Attempts of an auto-off relay command before the check fails")
+	fs.DurationVar(&cfg.RelayRetryDelay, "relay-retry-delay", envDuration("RELAY_RETRY_DELAY", "10s"), "Delay before the second attempt of a relay command, doubled for every further one")
+	fs.StringVar(&cfg.ShellyUser, "shelly-user", getEnv("SHELLY_USER", ""), "User of the Shelly login (Gen2 devices always use admin)")
+	fs.StringVar(&cfg.ShellyPassword, "shelly-password", getSecret("SHELLY_PASSWORD"), "Password of the Shelly login, empty if the login is disabled")
+	fs.StringVar(&cfg.ShellyHosts, "shelly-hosts", getEnv("SHELLY_HOSTS", ""), "Static addresses of Shelly host names, as name=ip separated by commas, bypassing DNS")
+	fs.StringVar(&cfg.ShellyIP, "shelly-ip", getEnv("SHELLY_IP", ""), "Address of the Shelly for relay control instead of the address label of the metrics")
+	fs.BoolVar(&cfg.ShellyMDNS, "shelly-mdns", envBool("SHELLY_MDNS", false), "Discover the Shelly via mDNS when the metrics have no address")
+	fs.StringVar(&cfg.RelayType, "relay-type", getEnv("RELAY_TYPE", RelayShelly), "Backend switching the plug: shelly, tasmota, kasa, tapo or homeassistant")
+	fs.StringVar(&cfg.TasmotaUser, "tasmota-user", getEnv("TASMOTA_USER", "admin"), "User of the Tasmota web password")
+	fs.StringVar(&cfg.TasmotaPassword, "tasmota-password", getSecret("TASMOTA_PASSWORD"), "Web password of the Tasmota plug, if one is set")
+	fs.StringVar(&cfg.TapoUser, "tapo-user", getEnv("TAPO_USER", ""), "E-mail address of the TP-Link account of the Tapo plug")
+	fs.StringVar(&cfg.TapoPassword, "tapo-password", getSecret("TAPO_PASSWORD"), "Password of the TP-Link account of the Tapo plug")
+	fs.StringVar(&cfg.HASwitchEntity, "ha-switch-entity", getEnv("HA_SWITCH_ENTITY", ""), "Switch entity of Home Assistant turning the printer on and off, with RELAY_TYPE=homeassistant")
+	fs.StringVar(&cfg.ShellyControl, "shelly-control", getEnv("SHELLY_CONTROL", ShellyControlLAN), "Path of relay commands: lan, falling back to the cloud if configured, cloud or mqtt")
+	fs.StringVar(&cfg.ShellyCloudServer, "shelly-cloud-server", getEnv("SHELLY_CLOUD_SERVER", ""), "Shelly Cloud server of the account, e.g. https://shelly-49-eu.shelly.cloud")
+	fs.StringVar(&cfg.ShellyCloudKey, "shelly-cloud-key", getSecret("SHELLY_CLOUD_KEY"), "Authorization cloud key of the Shelly account")
+	fs.StringVar(&cfg.ShellyDeviceID, "shelly-device-id", getEnv("SHELLY_DEVICE_ID", ""), "Shelly Cloud ID of the device")
+	fs.StringVar(&cfg.ShellyIDLabel, "shelly-id-label", getEnv("SHELLY_ID_LABEL", ""), "Label of the power series with the Shelly Cloud ID, instead of SHELLY_DEVICE_ID")
+	fs.StringVar(&cfg.ShellyMQTTBroker, "shelly-mqtt-broker", getEnv("SHELLY_MQTT_BROKER", ""), "MQTT broker of the Shelly for SHELLY_CONTROL=mqtt, e.g. tcp://host:1883")
+	fs.StringVar(&cfg.ShellyMQTTUser, "shelly-mqtt-user", getEnv("SHELLY_MQTT_USER", ""), "Username at SHELLY_MQTT_BROKER")
+	fs.StringVar(&cfg.ShellyMQTTPassword, "shelly-mqtt-password", getSecret("SHELLY_MQTT_PASSWORD"), "Password at SHELLY_MQTT_BROKER")
+	fs.StringVar(&cfg.ShellyMQTTTopic, "shelly-mqtt-topic", getEnv("SHELLY_MQTT_TOPIC", "shellies/<id>/relay/0/command"), "Command topic of the relay with <id> for SHELLY_MQTT_ID, the state is read from the topic without /command")
+	fs.StringVar(&cfg.ShellyMQTTID, "shelly-mqtt-id", getEnv("SHELLY_MQTT_ID", ""), "ID of the Shelly in its MQTT topics, like shellyplug-s-C8C9A3 (empty uses the device name of the power series)")
+	fs.DurationVar(&cfg.ShellyMQTTTimeout, "shelly-mqtt-timeout", envDuration("SHELLY_MQTT_TIMEOUT", "10s"), "How long the state topic may take to confirm a relay command")
+	fs.DurationVar(&cfg.ShellyDNSCacheTTL, "shelly-dns-cache-ttl", envDuration("SHELLY_DNS_CACHE_TTL", "0"), "How long resolved Shelly host names are reused (0 disables)")
+	fs.StringVar(&cfg.ShellyInfoMetric, "shelly-info-metric", getEnv("SHELLY_INFO_METRIC", ""), "Info metric holding the IP address when the power series has none (empty disables)")
+	fs.DurationVar(&cfg.ShellyInfoRefresh, "shelly-info-refresh", envDuration("SHELLY_INFO_REFRESH", "10m"), "How long an IP address from the info metric is cached")
+	fs.DurationVar(&cfg.CheckInterval, "interval", envDuration("CHECK_INTERVAL", "60s"), "Check interval")
+	fs.StringVar(&cfg.CycleOverrun, "cycle-overrun", getEnv("CYCLE_OVERRUN", CycleOverrunSkip), "What a check cycle longer than the check interval does to the checks that fell due: skip or queue one")
+	fs.DurationVar(&cfg.CycleTimeout, "cycle-timeout", envDuration("CYCLE_TIMEOUT", "2m"), "Timeout of a check cycle of a device, with its queries and relay commands")
+	fs.DurationVar(&cfg.RetryDelay, "retry-delay", envDuration("RETRY_DELAY", "10s"), "Delay before the next check after a failed one (0s = wait CHECK_INTERVAL)")
+	fs.IntVar(&cfg.RetryMax, "retry-max", envInt("RETRY_MAX", "5"), "Consecutive fast retries before falling back to CHECK_INTERVAL")
+	fs.DurationVar(&cfg.OutageBackoffAfter, "outage-backoff-after", envDuration("OUTAGE_BACKOFF_AFTER", "10m"), "How long checks fail before the check interval is stretched")
+	fs.DurationVar(&cfg.OutageMaxInterval, "outage-max-interval", envDuration("OUTAGE_MAX_INTERVAL", "10m"), "Longest stretched check interval during an outage (0 or at most CHECK_INTERVAL = never stretch)")
+	fs.DurationVar(&cfg.MetricsMaxAge, "metrics-max-age", envDuration("METRICS_MAX_AGE", "0s"), "Oldest power sample that still counts as current (0 means twice CHECK_INTERVAL)")
+	fs.IntVar(&cfg.QueryConcurrency, "query-concurrency", envInt("QUERY_CONCURRENCY", "4"), "Maximum number of metric queries running at the same time, over all devices")
+	fs.DurationVar(&cfg.QueryTimeout, "query-timeout", envDuration("QUERY_TIMEOUT", "10s"), "Timeout of a single metric query")
+	fs.IntVar(&cfg.MaxRangePoints, "max-range-points", envInt("MAX_RANGE_POINTS", "2000"), "Most points a range query may return, the step is coarsened to stay below")
+	fs.IntVar(&cfg.BreakerThreshold, "vm-breaker-threshold", envInt("VM_BREAKER_THRESHOLD", "3"), "Consecutive failed metric queries that open the circuit breaker (0 = disabled)")
+	fs.DurationVar(&cfg.BreakerCooldown, "vm-breaker-cooldown", envDuration("VM_BREAKER_COOLDOWN", "5m"), "How long an open circuit breaker fails metric queries before probing again")
+	fs.Float64Var(&cfg.MinWatts, "min-watts", envFloat("MIN_WATTS", "7"), "Minimum watts threshold")
+	fs.Float64Var(&cfg.MaxWatts, "max-watts", envFloat("MAX_WATTS", "9"), "Maximum watts threshold")
+	fs.DurationVar(&cfg.StandbyDuration, "standby-duration", envDuration("STANDBY_DURATION", "15m"), "Duration printer must be in standby before turning off")
+	fs.StringVar(&cfg.StandbyMode, "standby-mode", getEnv("STANDBY_MODE", StandbyModeRaw), "How standby is detected: raw or quantile")
+	fs.BoolVar(&cfg.StandbyRequireIdle, "standby-require-idle", envBool("STANDBY_REQUIRE_IDLE", false), "Count standby only while the printer state was idle too, not just the power in the standby range")
+	fs.Float64Var(&cfg.StandbyMaxSpread, "standby-max-spread", envFloat("STANDBY_MAX_SPREAD", "40"), "Largest difference in watts between the highest and lowest power in the standby window that still counts as standby (0 disables)")
+	fs.Float64Var(&cfg.StandbyMaxStddev, "standby-max-stddev", envFloat("STANDBY_MAX_STDDEV", "10"), "Largest standard deviation in watts of the power in the standby window that still counts as standby (0 disables)")
+	fs.Float64Var(&cfg.PrintPowerWatts, "print-power-watts", envFloat("PRINT_POWER_WATTS", "60"), "Power above which the printer counts as printing once sustained, whatever the printer state (0 disables)")
+	fs.DurationVar(&cfg.PrintPowerDuration, "print-power-duration", envDuration("PRINT_POWER_DURATION", "3m"), "How long power must stay above PRINT_POWER_WATTS to count as printing")
+	fs.DurationVar(&cfg.PrintPowerCooldown, "print-power-cooldown", envDuration("PRINT_POWER_COOLDOWN", "10m"), "How long power must stay below PRINT_POWER_WATTS before standby counting starts")
+	fs.StringVar(&cfg.MaintenanceMetrics, "maintenance-metrics", getEnv("MAINTENANCE_METRICS", ""), "Semicolon-separated metrics or selectors whose non-zero value means an update or processing is in progress (empty disables)")
+	fs.DurationVar(&cfg.MaintenanceMaxHold, "maintenance-max-hold", envDuration("MAINTENANCE_MAX_HOLD", "2h"), "Longest an update or processing state holds the auto-off, so a stuck metric can't block forever")
+	fs.DurationVar(&cfg.MaintenanceNotifyAfter, "maintenance-notify-after", envDuration("MAINTENANCE_NOTIFY_AFTER", "30m"), "Notify when an update or processing state holds the auto-off for longer than this")
+	fs.StringVar(&cfg.CalibrationStageMetric, "calibration-stage-metric", getEnvAllowEmpty("CALIBRATION_STAGE_METRIC", "bambulab_current_stage"), "Stage metric of the printer, whose calibration stages hold the auto-off (empty disables)")
+	fs.StringVar(&cfg.CalibrationStages, "calibration-stages", getEnv("CALIBRATION_STAGES", "1,3,8,12,18,19,25"), "Comma-separated values of CALIBRATION_STAGE_METRIC meaning a calibration")
+	fs.Float64Var(&cfg.CalibrationPowerWatts, "calibration-power-watts", envFloat("CALIBRATION_POWER_WATTS", "0"), "Without a stage metric, power above which the printer counts as calibrating once sustained (0 disables)")
+	fs.DurationVar(&cfg.CalibrationPowerDuration, "calibration-power-duration", envDuration("CALIBRATION_POWER_DURATION", "1m"), "How long power must stay above CALIBRATION_POWER_WATTS to count as calibrating")
+	fs.StringVar(&cfg.VoltageMetric, "voltage-metric", getEnvAllowEmpty("VOLTAGE_METRIC", "shelly_voltage"), "Voltage metric of the Shelly device, checked before trusting the power reading (empty disables)")
+	fs.StringVar(&cfg.PowerFactorMetric, "power-factor-metric", getEnvAllowEmpty("POWER_FACTOR_METRIC", "shelly_power_factor"), "Power factor metric of the Shelly device, checked before trusting the power reading (empty disables)")
+	fs.Float64Var(&cfg.VoltageMin, "voltage-min", envFloat("VOLTAGE_MIN", "180"), "Lowest plausible voltage, lower readings are not trusted")
+	fs.Float64Var(&cfg.VoltageMax, "voltage-max", envFloat("VOLTAGE_MAX", "260"), "Highest plausible voltage, higher readings are not trusted")
+	fs.StringVar(&cfg.TempMetric, "temp-metric", getEnvAllowEmpty("SHELLY_TEMP_METRIC", "shelly_temperature"), "Internal temperature metric of the Shelly device, the status API is asked when it is missing (empty disables)")
+	fs.Float64Var(&cfg.TempWarning, "temp-warning", envFloat("SHELLY_TEMP_WARNING", "70"), "Shelly temperature in °C above which a warning is sent")
+	fs.Float64Var(&cfg.TempCritical, "temp-critical", envFloat("SHELLY_TEMP_CRITICAL", "85"), "Shelly temperature in °C above which the relay is switched off whatever the printer does")
+	fs.DurationVar(&cfg.BootGracePeriod, "boot-grace", envDuration("BOOT_GRACE_PERIOD", "20m"), "Grace period after printer is turned on before checking standby")
+	fs.DurationVar(&cfg.OffCooldown, "off-cooldown", envDuration("OFF_COOLDOWN", "10m"), "How long after turning the relay off no further auto-off is sent")
+	fs.BoolVar(&cfg.DryRun, "dry-run", envBool("DRY_RUN", false), "Dry run mode (don't actually switch relay)")
+	fs.BoolVar(&cfg.Once, "once", envBool("RUN_ONCE", false), "Run a single check and exit, nonzero if it failed")
+	fs.BoolVar(&cfg.HistoryRequired, "history-required", envBool("HISTORY_REQUIRED", false), "Hold the auto-off until the power history covers the longest lookback")
+	fs.DurationVar(&cfg.DryRunWatch, "dry-run-watch", envDuration("DRY_RUN_WATCH", "10m"), "How long after a would-be auto-off of the dry run the relay is watched for going off")
+	fs.StringVar(&cfg.HeartbeatMode, "heartbeat-mode", getEnv("HEARTBEAT_MODE", "off"), "Heartbeat publisher: off, vm or http")
+	fs.StringVar(&cfg.HeartbeatURL, "heartbeat-url", getEnv("HEARTBEAT_URL", ""), "URL to ping every cycle in http heartbeat mode (/fail is appended on error cycles)")
+	fs.StringVar(&cfg.NtfyURL, "ntfy-url", getEnv("NTFY_URL", "https://ntfy.sh"), "ntfy server URL")
+	fs.StringVar(&cfg.NtfyTopic, "ntfy-topic", getEnv("NTFY_TOPIC", ""), "ntfy topic (enables ntfy notifications)")
+	fs.StringVar(&cfg.NtfyToken, "ntfy-token", getSecret("NTFY_TOKEN"), "ntfy access token")
+	fs.StringVar(&cfg.NtfyEvents, "ntfy-events", getEnv("NTFY_EVENTS", "all"), "Comma-separated event types to send to ntfy")
+	fs.StringVar(&cfg.TelegramAPIURL, "telegram-api-url", getEnv("TELEGRAM_API_URL", "https://api.telegram.org"), "Telegram Bot API URL")
+	fs.StringVar(&cfg.TelegramBotToken, "telegram-bot-token", getSecret("TELEGRAM_BOT_TOKEN"), "Telegram bot token (enables Telegram notifications)")
+	fs.StringVar(&cfg.TelegramChatID, "telegram-chat-id", getEnv("TELEGRAM_CHAT_ID", ""), "Telegram chat ID to send notifications to")
+	fs.StringVar(&cfg.TelegramEvents, "telegram-events", getEnv("TELEGRAM_EVENTS", "relay_off,actuation_failed,safety_lockout"), "Comma-separated event types to send to Telegram")
+	fs.IntVar(&cfg.TelegramMaxPerHour, "telegram-max-per-hour", envInt("TELEGRAM_MAX_PER_HOUR", "20"), "Maximum Telegram messages per hour (0 = unlimited)")
+	fs.IntVar(&cfg.FailureNotifyThreshold, "failure-notify-threshold", envInt("FAILURE_NOTIFY_THRESHOLD", "3"), "Consecutive relay failures before an actuation_failed notification is sent")
+	fs.DurationVar(&cfg.ActuationMinSpacing, "actuation-min-spacing", envDuration("ACTUATION_MIN_SPACING", "60s"), "Minimum time between two relay commands (0 = no limit)")
+	fs.IntVar(&cfg.ActuationMaxPerHour, "actuation-max-per-hour", envInt("ACTUATION_MAX_PER_HOUR", "10"), "Maximum relay commands per hour (0 = no limit)")
+	fs.BoolVar(&cfg.TelegramCommands, "telegram-commands", envBool("TELEGRAM_COMMANDS", false), "Accept commands sent to the Telegram bot")
+	fs.StringVar(&cfg.TelegramAllowedChatIDs, "telegram-allowed-chat-ids", getEnv("TELEGRAM_ALLOWED_CHAT_IDS", ""), "Comma-separated chat IDs allowed to send commands (default: TELEGRAM_CHAT_ID)")
+	fs.DurationVar(&cfg.VetoWindow, "veto-window", envDuration("VETO_WINDOW", "0s"), "Delay between announcing and executing an auto-off during which it can be cancelled")
+	fs.BoolVar(&cfg.OffRecheck, "off-recheck", envBool("OFF_RECHECK", false), "Arm and warn before an auto-off, and switch off only once a later cycle passes every gate again")
+	fs.DurationVar(&cfg.OffRecheckDelay, "off-recheck-delay", envDuration("OFF_RECHECK_DELAY", "0s"), "Least time between arming an auto-off and its re-verification (0s = the next cycle)")
+	fs.StringVar(&cfg.PushoverAPIURL, "pushover-api-url", getEnv("PUSHOVER_API_URL", "https://api.pushover.net"), "Pushover API URL")
+	fs.StringVar(&cfg.PushoverToken, "pushover-token", getSecret("PUSHOVER_TOKEN"), "Pushover application token (enables Pushover notifications)")
+	fs.StringVar(&cfg.PushoverUser, "pushover-user", getEnv("PUSHOVER_USER", ""), "Pushover user or group key")
+	fs.StringVar(&cfg.PushoverEvents, "pushover-events", getEnv("PUSHOVER_EVENTS", "all"), "Comma-separated event types to send to Pushover")
+	fs.DurationVar(&cfg.PushoverRetry, "pushover-retry", envDuration("PUSHOVER_RETRY", "60s"), "How often Pushover repeats emergency alerts until acknowledged")
+	fs.DurationVar(&cfg.PushoverExpire, "pushover-expire", envDuration("PUSHOVER_EXPIRE", "1h"), "How long Pushover keeps repeating emergency alerts")
+	fs.StringVar(&cfg.GotifyURL, "gotify-url", getEnv("GOTIFY_URL", ""), "Gotify server URL")
+	fs.StringVar(&cfg.GotifyToken, "gotify-token", getSecret("GOTIFY_TOKEN"), "Gotify application token (enables Gotify notifications)")
+	fs.StringVar(&cfg.GotifyEvents, "gotify-events", getEnv("GOTIFY_EVENTS", "all"), "Comma-separated event types to send to Gotify")
+	fs.StringVar(&cfg.SMTPHost, "smtp-host", getEnv("SMTP_HOST", ""), "SMTP server host (enables email notifications)")
+	fs.StringVar(&cfg.SMTPPort, "smtp-port", getEnv("SMTP_PORT", "587"), "SMTP server port")
+	fs.StringVar(&cfg.SMTPSecurity, "smtp-security", getEnv("SMTP_SECURITY", SMTPStartTLS), "SMTP transport security: starttls, tls or none")
+	fs.StringVar(&cfg.SMTPUser, "smtp-user", getEnv("SMTP_USER", ""), "SMTP auth user")
+	fs.StringVar(&cfg.SMTPPassword, "smtp-password", getSecret("SMTP_PASSWORD"), "SMTP auth password")
+	fs.StringVar(&cfg.SMTPFrom, "smtp-from", getEnv("SMTP_FROM", ""), "Sender address of notification emails")
+	fs.StringVar(&cfg.SMTPTo, "smtp-to", getEnv("SMTP_TO", ""), "Comma-separated recipient addresses")
+	fs.StringVar(&cfg.SMTPSubjectPrefix, "smtp-subject-prefix", getEnv("SMTP_SUBJECT_PREFIX", "[gome-assistant]"), "Prefix of notification email subjects")
+	fs.StringVar(&cfg.SMTPEvents, "smtp-events", getEnv("SMTP_EVENTS", "daily_summary,actuation_failed"), "Comma-separated event types to send by email")
+	fs.StringVar(&cfg.MatrixHomeserver, "matrix-homeserver", getEnv("MATRIX_HOMESERVER", ""), "Matrix homeserver URL")
+	fs.StringVar(&cfg.MatrixAccessToken, "matrix-access-token", getSecret("MATRIX_ACCESS_TOKEN"), "Matrix access token (enables Matrix notifications)")
+	fs.StringVar(&cfg.MatrixRoomID, "matrix-room-id", getEnv("MATRIX_ROOM_ID", ""), "Matrix room ID to post notifications to")
+	fs.StringVar(&cfg.MatrixEvents, "matrix-events", getEnv("MATRIX_EVENTS", "all"), "Comma-separated event types to send to Matrix")
+	fs.StringVar(&cfg.SignalAPIURL, "signal-api-url", getEnv("SIGNAL_API_URL", ""), "signal-cli-rest-api base URL (enables Signal notifications)")
+	fs.StringVar(&cfg.SignalNumber, "signal-number", getEnv("SIGNAL_NUMBER", ""), "Registered Signal number to send from")
+	fs.StringVar(&cfg.SignalRecipients, "signal-recipients", getEnv("SIGNAL_RECIPIENTS", ""), "Comma-separated Signal recipients (numbers or group IDs)")
+	fs.StringVar(&cfg.SignalEvents, "signal-events", getEnv("SIGNAL_EVENTS", "actuation_failed,safety_lockout,daily_summary"), "Comma-separated event types to send to Signal")
+	fs.StringVar(&cfg.WebhookURLs, "webhook-urls", getEnv("WEBHOOK_URLS", ""), "Semicolon-separated webhook URLs, each optionally followed by |event,event")
+	fs.StringVar(&cfg.WebhookSecret, "webhook-secret", getSecret("WEBHOOK_SECRET"), "Shared secret for the X-Gome-Signature HMAC-SHA256 header")
+	fs.IntVar(&cfg.WebhookRetries, "webhook-retries", envInt("WEBHOOK_RETRIES", "3"), "Retries per webhook delivery")
+	fs.StringVar(&cfg.NotifyMinIntervals, "notify-min-intervals", getEnv("NOTIFY_MIN_INTERVALS", "actuation_failed=30m,safety_lockout=30m,check_panic=30m"), "Minimum interval between identical notifications per event type (event=duration,...)")
+	fs.IntVar(&cfg.NotifyMaxPerHour, "notify-max-per-hour", envInt("NOTIFY_MAX_PER_HOUR", "30"), "Maximum non-critical notifications per hour (0 = unlimited)")
+	fs.IntVar(&cfg.NotifyDedupSize, "notify-dedup-size", envInt("NOTIFY_DEDUP_SIZE", "256"), "Most events remembered for NOTIFY_MIN_INTERVALS, the one delivered longest ago is forgotten first")
+	fs.StringVar(&cfg.NotifyQuietHours, "notify-quiet-hours", getEnv("NOTIFY_QUIET_HOURS", ""), "Daily window (HH:MM-HH:MM) in which only critical notifications are sent")
+	fs.StringVar(&cfg.NotifyTemplatesFile, "notify-templates", getEnv("NOTIFY_TEMPLATES_FILE", ""), "YAML file with notification message templates")
+	fs.StringVar(&cfg.RenderNotification, "render-notification", "", "Print a sample rendering of the message for the given event type and exit")
+	fs.StringVar(&cfg.MQTTBroker, "mqtt-broker", getEnv("MQTT_BROKER", ""), "MQTT broker URL, e.g. tcp://host:1883 or ssl://host:8883 (enables MQTT publishing)")
+	fs.StringVar(&cfg.MQTTClientID, "mqtt-client-id", getEnv("MQTT_CLIENT_ID", "gome-assistant"), "MQTT client ID")
+	fs.StringVar(&cfg.MQTTUser, "mqtt-user", getEnv("MQTT_USER", ""), "MQTT username")
+	fs.StringVar(&cfg.MQTTPassword, "mqtt-password", getSecret("MQTT_PASSWORD"), "MQTT password")
+	fs.StringVar(&cfg.MQTTTLSCAFile, "mqtt-tls-ca-file", getEnv("MQTT_TLS_CA_FILE", ""), "PEM file with the CA certificate of the MQTT broker")
+	fs.BoolVar(&cfg.MQTTTLSInsecure, "mqtt-tls-insecure", envBool("MQTT_TLS_INSECURE", false), "Skip verification of the MQTT broker certificate")
+	fs.StringVar(&cfg.MQTTBaseTopic, "mqtt-base-topic", getEnv("MQTT_BASE_TOPIC", "gome-assistant"), "Base topic of published MQTT messages")
+	fs.BoolVar(&cfg.HADiscovery, "ha-discovery", envBool("HA_DISCOVERY", false), "Publish Home Assistant MQTT discovery configs and accept commands of the switch entity")
+	fs.StringVar(&cfg.HADiscoveryPrefix, "ha-discovery-prefix", getEnv("HA_DISCOVERY_PREFIX", "homeassistant"), "Home Assistant MQTT discovery prefix")
+	fs.BoolVar(&cfg.HADiscoveryCleanup, "ha-discovery-cleanup", envBool("HA_DISCOVERY_CLEANUP", false), "Remove the Home Assistant entities on clean shutdown")
+	fs.StringVar(&cfg.HAURL, "ha-url", getEnv("HA_URL", ""), "Home Assistant URL for state reporting via the REST API")
+	fs.StringVar(&cfg.HAToken, "ha-token", getSecret("HA_TOKEN"), "Home Assistant long-lived access token (enables REST state reporting)")
+	fs.StringVar(&cfg.PreActionHookURL, "pre-action-hook-url", getEnv("PRE_ACTION_HOOK_URL", ""), "URL asked before every auto-off, may veto it with {\"allow\": false}")
+	fs.DurationVar(&cfg.PreActionHookTimeout, "pre-action-hook-timeout", envDuration("PRE_ACTION_HOOK_TIMEOUT", "5s"), "How long to wait for the pre-action hook")
+	fs.StringVar(&cfg.PreActionHookFailure, "pre-action-hook-failure", getEnv("PRE_ACTION_HOOK_FAILURE", PreActionAllow), "Action when the pre-action hook fails or times out: allow or deny")
+	fs.StringVar(&cfg.ICalURL, "ical-url", getEnv("ICAL_URL", ""), "iCal feed whose matching events suspend automatic switching")
+	fs.StringVar(&cfg.ICalHoldPattern, "ical-hold-pattern", getEnv("ICAL_HOLD_PATTERN", "printer-hold"), "Regex matched against event summaries to select holds")
+	fs.DurationVar(&cfg.ICalRefresh, "ical-refresh", envDuration("ICAL_REFRESH", "15m"), "How often the iCal feed is fetched")
+	fs.DurationVar(&cfg.ICalHorizon, "ical-horizon", envDuration("ICAL_HORIZON", "744h"), "How far ahead recurring events are expanded")
+	fs.StringVar(&cfg.HTTPAddr, "http-addr", getEnv("HTTP_ADDR", ""), "Listen address of the internal HTTP listener, e.g. :9108 (empty = disabled)")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", getEnvAllowEmpty("METRICS_ADDR", ":9090"), "Listen address of the Prometheus metrics of gome-assistant itself (empty = disabled)")
+	fs.IntVar(&cfg.DecisionHistorySize, "decision-history-size", envInt("DECISION_HISTORY_SIZE", "720"), "Most recent decisions kept in memory for the API and dashboard")
+	fs.IntVar(&cfg.ActionHistorySize, "action-history-size", envInt("ACTION_HISTORY_SIZE", "100"), "Most recent relay actions kept in memory for the API and dashboard")
+	fs.StringVar(&cfg.APIToken, "api-token", getSecret("API_TOKEN"), "Unlabeled API token with full access")
+	fs.StringVar(&cfg.APITokens, "api-tokens", getSecret("API_TOKENS"), "Comma-separated labeled API tokens (label:token or label:token:read for read-only)")
+	fs.BoolVar(&cfg.APIReadPublic, "api-read-public", envBool("API_READ_PUBLIC", false), "Serve read-only API routes without a token")
+	fs.BoolVar(&cfg.APIAuthProbes, "api-auth-probes", envBool("API_AUTH_PROBES", false), "Require a token for metrics and health endpoints")
+	fs.StringVar(&cfg.AuditFile, "audit-file", getEnv("AUDIT_FILE", ""), "JSON lines file recording every action and control command")
+	fs.Float64Var(&cfg.EnergyPrice, "energy-price", envFloat("ENERGY_PRICE", "0"), "Price per kWh for the cost saved in reports (0 = no cost)")
+	fs.StringVar(&cfg.EnergyCurrency, "energy-currency", getEnv("ENERGY_CURRENCY", "EUR"), "Currency of ENERGY_PRICE")
+	fs.StringVar(&cfg.ReportTimezone, "report-timezone", getEnv("REPORT_TIMEZONE", ""), "IANA time zone the months of reports follow (empty = local time)")
+	fs.StringVar(&cfg.PriceSource, "price-source", getEnv("PRICE_SOURCE", PriceSourceOff), "Source of hourly electricity prices: tibber or awattar (empty = off)")
+	fs.StringVar(&cfg.TibberToken, "tibber-token", getSecret("TIBBER_TOKEN"), "Tibber API access token")
+	fs.StringVar(&cfg.AwattarURL, "awattar-url", getEnv("AWATTAR_URL", "https://api.awattar.de/v1/marketdata"), "aWATTar market data URL (api.awattar.at for Austria)")
+	fs.DurationVar(&cfg.PriceRefresh, "price-refresh", envDuration("PRICE_REFRESH", "6h"), "How often the electricity prices are fetched")
+	fs.Float64Var(&cfg.PeakPrice, "peak-price", envFloat("PEAK_PRICE", "0"), "Price per kWh above which PEAK_STANDBY_DURATION applies (0 = off)")
+	fs.DurationVar(&cfg.PeakStandbyDuration, "peak-standby-duration", envDuration("PEAK_STANDBY_DURATION", "5m"), "Standby duration before off while the price is above PEAK_PRICE")
+	fs.StringVar(&cfg.SurplusQuery, "surplus-query", getEnv("SURPLUS_QUERY", ""), "PromQL query of the solar surplus in watts that keeps the printer on (empty = off)")
+	fs.Float64Var(&cfg.SurplusMinWatts, "surplus-min-watts", envFloat("SURPLUS_MIN_WATTS", "100"), "Surplus that SURPLUS_QUERY must stay above to suppress the auto-off")
+	fs.DurationVar(&cfg.SurplusWindow, "surplus-window", envDuration("SURPLUS_WINDOW", "10m"), "How long the surplus must have stayed above SURPLUS_MIN_WATTS")
+	fs.StringVar(&cfg.StatusFile, "status-file", getEnv("STATUS_FILE", ""), "JSON file rewritten with the current status after every cycle")
+	fs.StringVar(&cfg.StateFile, "state-file", getEnv("STATE_FILE", ""), "JSON file keeping the standby streak and pending auto-off across restarts")
+	fs.StringVar(&cfg.CORSAllowedOrigins, "cors-allowed-origins", getEnv("CORS_ALLOWED_ORIGINS", ""), "Comma-separated origins allowed to call the HTTP API from a browser, e.g. https://*.example.com (empty = no CORS)")
+	fs.BoolVar(&cfg.CORSAllowCredentials, "cors-allow-credentials", envBool("CORS_ALLOW_CREDENTIALS", false), "Allow credentialed cross-origin requests")
+	fs.StringVar(&cfg.AlertmanagerToken, "alertmanager-token", getSecret("ALERTMANAGER_TOKEN"), "Shared secret of the Alertmanager webhook receiver (enables POST /alertmanager)")
+	fs.StringVar(&cfg.AlertmanagerPauseAlerts, "alertmanager-pause-alerts", getEnv("ALERTMANAGER_PAUSE_ALERTS", ""), "Comma-separated alert names that pause automation while firing")
+	fs.DurationVar(&cfg.AlertmanagerPauseTimeout, "alertmanager-pause-timeout", envDuration("ALERTMANAGER_PAUSE_TIMEOUT", "6h"), "Resume automation if a pausing alert is not repeated or resolved within this time")
+	fs.StringVar(&cfg.LeaderElection, "leader-election", getEnv("LEADER_ELECTION", "off"), "Leader election among redundant instances: off, auto, file or kubernetes")
+	fs.StringVar(&cfg.Instance, "instance-name", getEnv("INSTANCE_NAME", ""), "Name of this instance in metrics, MQTT topics, audit records and notifications (default: hostname)")
+	fs.StringVar(&cfg.LeaderIdentity, "leader-identity", getEnv("LEADER_IDENTITY", ""), "Name of this instance in leader election (default: hostname)")
+	fs.StringVar(&cfg.LeaderLockFile, "leader-lock-file", getEnv("LEADER_LOCK_FILE", ""), "Lock file on storage shared by all instances for file leader election")
+	fs.StringVar(&cfg.LeaderLeaseName, "leader-lease-name", getEnv("LEADER_LEASE_NAME", "gome-assistant"), "Name of the Kubernetes lease")
+	fs.StringVar(&cfg.LeaderLeaseNamespace, "leader-lease-namespace", getEnv("LEADER_LEASE_NAMESPACE", ""), "Namespace of the Kubernetes lease (default: namespace of the pod)")
+	fs.DurationVar(&cfg.LeaderLeaseDuration, "leader-lease-duration", envDuration("LEADER_LEASE_DURATION", "30s"), "How long a lease stays valid without renewal")
+	fs.DurationVar(&cfg.LeaderRenewInterval, "leader-renew-interval", envDuration("LEADER_RENEW_INTERVAL", "10s"), "How often the lease is renewed or tried to acquire")
+	fs.BoolVar(&cfg.DuplicateGuard, "duplicate-guard", envBool("DUPLICATE_GUARD", false), "Push a controller heartbeat to VictoriaMetrics and refuse to actuate while another instance controls the same device")
+	fs.DurationVar(&cfg.DuplicateGuardWindow, "duplicate-guard-window", envDuration("DUPLICATE_GUARD_WINDOW", "3m"), "How recent a heartbeat of another instance must be to count as a conflict")
+	fs.StringVar(&cfg.PrinterSource, "printer-source", getEnv("PRINTER_SOURCE", "bambulab"), "Source of the printer state: bambulab, metric, moonraker, prusalink or bambucloud")
+	fs.StringVar(&cfg.PrinterStateMetric, "printer-state-metric", getEnv("PRINTER_STATE_METRIC", ""), "Metric or selector with the printer state for the metric source, e.g. klipper_print_state")
+	fs.StringVar(&cfg.PrinterBusyValues, "printer-busy-values", getEnv("PRINTER_BUSY_VALUES", "1"), "Comma-separated values of PRINTER_STATE_METRIC meaning printing or paused")
+	fs.StringVar(&cfg.MoonrakerURL, "moonraker-url", getEnv("MOONRAKER_URL", ""), "Moonraker API URL for the moonraker source, e.g. http://voron.lan:7125")
+	fs.StringVar(&cfg.MoonrakerAPIKey, "moonraker-api-key", getSecret("MOONRAKER_API_KEY"), "Moonraker API key, if the API requires one")
+	fs.StringVar(&cfg.PrusaLinkURL, "prusalink-url", getEnv("PRUSALINK_URL", ""), "PrusaLink URL for the prusalink source, e.g. http://mk4.lan")
+	fs.StringVar(&cfg.PrusaLinkAPIKey, "prusalink-api-key", getSecret("PRUSALINK_API_KEY"), "PrusaLink API key")
+	fs.DurationVar(&cfg.PrusaLinkCacheTTL, "prusalink-cache-ttl", envDuration("PRUSALINK_CACHE_TTL", "15s"), "How long a PrusaLink reading is reused before polling again")
+	fs.StringVar(&cfg.BambuMQTTHost, "bambu-mqtt-host", getEnv("BAMBU_MQTT_HOST", ""), "Address of a Bambu Lab printer in LAN mode to read the print state from directly")
+	fs.StringVar(&cfg.BambuAccessCode, "bambu-access-code", getSecret("BAMBU_ACCESS_CODE"), "LAN access code of the Bambu Lab printer")
+	fs.StringVar(&cfg.BambuSerial, "bambu-serial", getEnv("BAMBU_SERIAL", ""), "Serial number of the Bambu Lab printer")
+	fs.StringVar(&cfg.BambuMQTTCAFile, "bambu-mqtt-ca-file", getEnv("BAMBU_MQTT_CA_FILE", ""), "PEM file with the Bambu Lab CA to verify the printer certificate against")
+	fs.StringVar(&cfg.BambuCloudToken, "bambu-cloud-token", getSecret("BAMBU_CLOUD_TOKEN"), "Access token of the Bambu Cloud account for the bambucloud source")
+	fs.StringVar(&cfg.BambuCloudURL, "bambu-cloud-url", getEnv("BAMBU_CLOUD_URL", "https://api.bambulab.com"), "Bambu Cloud API URL")
+	fs.DurationVar(&cfg.BambuCloudInterval, "bambu-cloud-interval", envDuration("BAMBU_CLOUD_INTERVAL", "5m"), "Minimum interval between Bambu Cloud requests")
+	fs.BoolVar(&cfg.BambuQueuePowerOn, "bambu-queue-power-on", envBool("BAMBU_QUEUE_POWER_ON", false), "Switch the printer on when a job is queued for it in Bambu Cloud")
+	fs.DurationVar(&cfg.BambuQueueInterval, "bambu-queue-interval", envDuration("BAMBU_QUEUE_INTERVAL", "2m"), "How often the Bambu Cloud queue is polled")
+	fs.DurationVar(&cfg.BambuQueueBuffer, "bambu-queue-buffer", envDuration("BAMBU_QUEUE_BUFFER", "10m"), "How long the hold after powering on for a queued job outlasts BOOT_GRACE_PERIOD")
+	fs.BoolVar(&cfg.NotifyTest, "notify-test", false, "Send a test message through all configured notifiers and exit")
+	fs.BoolVar(&cfg.ShowVersion, "version", false, "Print the version and build information and exit")
+	_ = fs.Parse(args) // Exits on errors like flag.Parse
+	invalidSettings = append(invalidSettings, secretFlagConflicts(fs, secretFiles)...)
+	if len(invalidSettings) > 0 {
+		_, _ = fmt.Fprintf(fs.Output(), "Invalid settings: %s\n", strings.Join(invalidSettings, ", "))
+		os.Exit(2)
+	}
+	setupLogging(&cfg)
+	if dotenvErr != nil {
+		slog.Debug("No .env file found or error loading it", "error", dotenvErr)
+	}
+	if unknown := unknownFileSettings(); len(unknown) > 0 {
+		slog.Warn("Ignoring unknown settings in the config file", "path", configFile, "settings", strings.Join(unknown, ", "))
+	}
+	fs.Visit(func(f *flag.Flag) {
+		recordSetting("-"+f.Name, f.Value.String(), sourceFlag)
+	})
+	cfg.effective = effective
+	cfg.secretFiles = secretFiles
+
+	// The exact names replace the pattern everywhere, as an anchored regex of the quoted names
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "shelly-pattern" {
+			cfg.shellyPatternSet = true
+		}
+	})
+	if _, _, ok := lookupSetting("SHELLY_DEVICE_PATTERN", false); ok {
+		cfg.shellyPatternSet = true
+	}
+	if cfg.ShellyDevices != "" {
+		names := parseShellyDevices(cfg.ShellyDevices)
+		for i, name := range names {
+			names[i] = regexp.QuoteMeta(name)
+		}
+		cfg.ShellyDevicePattern = "^(" + strings.Join(names, "|") + ")$"
+	}
+
+	return cfg
+}
+
+// labelName matches valid Prometheus label names
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// instanceName matches names that are safe as label values and as a single MQTT topic level
+var instanceName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$`)
+
+// Validate checks the settings required to run the controller
+func (cfg *Config) Validate() error {
+	if cfg.VictoriaMetricsPassword == "" {
+		return errors.New("VM_PASSWORD is required")
+	}
+	if err := validateVMURL(cfg.VictoriaMetricsURL); err != nil {
+		return err
+	}
+	if cfg.LogFormat != LogFormatText && cfg.LogFormat != LogFormatJSON {
+		return fmt.Errorf("invalid LOG_FORMAT %q (expected text or json)", cfg.LogFormat)
+	}
+	if cfg.MinWatts >= cfg.MaxWatts {
+		return fmt.Errorf("MIN_WATTS (%.1f) must be below MAX_WATTS (%.1f)", cfg.MinWatts, cfg.MaxWatts)
+	}
+	if cfg.CheckInterval <= 0 {
+		return fmt.Errorf("CHECK_INTERVAL must be positive, got %s", cfg.CheckInterval)
+	}
+	if cfg.StandbyDuration < cfg.CheckInterval {
+		return fmt.Errorf("STANDBY_DURATION (%s) must not be shorter than CHECK_INTERVAL (%s)", cfg.StandbyDuration, cfg.CheckInterval)
+	}
+	if cfg.BootGracePeriod <= 0 {
+		return fmt.Errorf("BOOT_GRACE_PERIOD must be positive, got %s", cfg.BootGracePeriod)
+	}
+	if _, err := regexp.Compile(cfg.ShellyDevicePattern); err != nil {
+		return fmt.Errorf("SHELLY_DEVICE_PATTERN %q is not a valid regex: %w", cfg.ShellyDevicePattern, err)
+	}
+
+	if cfg.ShellyDevices != "" {
+		if cfg.shellyPatternSet {
+			return errors.New("SHELLY_DEVICES and SHELLY_DEVICE_PATTERN are mutually exclusive")
+		}
+		seen := map[string]bool{}
+		for _, name := range parseShellyDevices(cfg.ShellyDevices) {
+			if name == "" {
+				return fmt.Errorf("SHELLY_DEVICES %q contains an empty device name", cfg.ShellyDevices)
+			}
+			if seen[name] {
+				return fmt.Errorf("SHELLY_DEVICES lists %q twice", name)
+			}
+			seen[name] = true
+		}
+	}
+	for name, label := range map[string]string{"SHELLY_NAME_LABEL": cfg.ShellyNameLabel, "SHELLY_ADDRESS_LABEL": cfg.ShellyAddressLabel} {
+		if !labelName.MatchString(label) {
+			return fmt.Errorf("%s %q is not a valid label name", name, label)
+		}
+	}
+	if cfg.ShellyChannelLabel != "" && !labelName.MatchString(cfg.ShellyChannelLabel) {
+		return fmt.Errorf("SHELLY_CHANNEL_LABEL %q is not a valid label name", cfg.ShellyChannelLabel)
+	}
+	if cfg.Devices != "" {
+		if err := cfg.validateDevices(); err != nil {
+			return fmt.Errorf("DEVICES: %w", err)
+		}
+	}
+	if cfg.AutoOnQuery != "" && !cfg.AutoOn {
+		return errors.New("AUTO_ON_QUERY requires AUTO_ON=true")
+	}
+	if cfg.RelayVerifyRetries < 0 {
+		return fmt.Errorf("RELAY_VERIFY_RETRIES must not be negative, got %d", cfg.RelayVerifyRetries)
+	}
+	if cfg.RelayAttempts < 1 {
+		return fmt.Errorf("RELAY_ATTEMPTS must be at least 1, got %d", cfg.RelayAttempts)
+	}
+	if cfg.RelayRetryDelay < 0 {
+		return fmt.Errorf("RELAY_RETRY_DELAY must not be negative, got %s", cfg.RelayRetryDelay)
+	}
+	if cfg.ShellyRelayChannel < 0 {
+		return fmt.Errorf("SHELLY_RELAY_CHANNEL must not be negative, got %d", cfg.ShellyRelayChannel)
+	}
+	if cfg.Instance != "" && !instanceName.MatchString(cfg.Instance) {
+		return fmt.Errorf("INSTANCE_NAME %q must be at most 63 letters, digits, '_', '.' or '-', starting with a letter or digit", cfg.Instance)
+	}
+	if cfg.ShellyInfoMetric != "" && cfg.ShellyInfoRefresh < time.Minute {
+		return fmt.Errorf("SHELLY_INFO_REFRESH must be at least 1m, got %s", cfg.ShellyInfoRefresh)
+	}
+
+	if _, err := parseHeaders(cfg.VMHeaders); err != nil {
+		return fmt.Errorf("VM_HEADERS: %w", err)
+	}
+	if _, err := parseHeaders(cfg.ShellyHeaders); err != nil {
+		return fmt.Errorf("SHELLY_HEADERS: %w", err)
+	}
+	if cfg.ShellyGen != ShellyGenAuto && cfg.ShellyGen != ShellyGen1 && cfg.ShellyGen != ShellyGen2 {
+		return fmt.Errorf("invalid SHELLY_GEN %q (expected 1, 2 or auto)", cfg.ShellyGen)
+	}
+	switch cfg.RelayType {
+	case RelayShelly, RelayTasmota:
+	case RelayKasa, RelayTapo:
+		if cfg.ShellyRelayChannel != 0 {
+			return fmt.Errorf("RELAY_TYPE=%s switches single plugs, SHELLY_RELAY_CHANNEL must be 0", cfg.RelayType)
+		}
+		if cfg.RelayType == RelayTapo && (cfg.TapoUser == "" || cfg.TapoPassword == "") {
+			return errors.New("TAPO_USER and TAPO_PASSWORD are required when RELAY_TYPE=tapo")
+		}
+	case RelayHomeAssistant:
+		if cfg.HAURL == "" || cfg.HAToken == "" {
+			return errors.New("HA_URL and HA_TOKEN are required when RELAY_TYPE=homeassistant")
+		}
+		if !strings.HasPrefix(cfg.HASwitchEntity, "switch.") {
+			return fmt.Errorf("HA_SWITCH_ENTITY must be a switch entity like switch.printer_plug, got %q", cfg.HASwitchEntity)
+		}
+		if cfg.ShellyRelayChannel != 0 {
+			return errors.New("RELAY_TYPE=homeassistant switches a single entity, SHELLY_RELAY_CHANNEL must be 0")
+		}
+	default:
+		return fmt.Errorf("invalid RELAY_TYPE %q (expected shelly, tasmota, kasa, tapo or homeassistant)", cfg.RelayType)
+	}
+	if cfg.RelayType != RelayShelly && (cfg.ShellyMDNS || cfg.ShellyCloudServer != "" || cfg.ShellyControl == ShellyControlMQTT) {
+		return errors.New("SHELLY_MDNS, SHELLY_CLOUD_SERVER and SHELLY_CONTROL=mqtt need RELAY_TYPE=shelly")
+	}
+	if err := cfg.validateShellyCloud(); err != nil {
+		return err
+	}
+	if err := cfg.validateShellyMQTT(); err != nil {
+		return err
+	}
+	if _, err := parseHostOverrides(cfg.ShellyHosts); err != nil {
+		return fmt.Errorf("SHELLY_HOSTS: %w", err)
+	}
+	if cfg.ShellyIP != "" && cfg.ShellyMDNS {
+		return errors.New("SHELLY_IP and SHELLY_MDNS are mutually exclusive")
+	}
+	if cfg.ShellyIP != "" {
+		if err := cfg.validateShellyIP(); err != nil {
+			return err
+		}
+	}
+	if cfg.ShellyDNSCacheTTL < 0 {
+		return fmt.Errorf("SHELLY_DNS_CACHE_TTL must not be negative, got %s", cfg.ShellyDNSCacheTTL)
+	}
+	if cfg.QueryConcurrency < 1 {
+		return fmt.Errorf("QUERY_CONCURRENCY must be at least 1, got %d", cfg.QueryConcurrency)
+	}
+	if cfg.DecisionHistorySize < 1 {
+		return fmt.Errorf("DECISION_HISTORY_SIZE must be at least 1, got %d", cfg.DecisionHistorySize)
+	}
+	if cfg.ActionHistorySize < 1 {
+		return fmt.Errorf("ACTION_HISTORY_SIZE must be at least 1, got %d", cfg.ActionHistorySize)
+	}
+	if cfg.NotifyDedupSize < 1 {
+		return fmt.Errorf("NOTIFY_DEDUP_SIZE must be at least 1, got %d", cfg.NotifyDedupSize)
+	}
+
+	if cfg.CycleOverrun != CycleOverrunSkip && cfg.CycleOverrun != CycleOverrunQueue {
+		return fmt.Errorf("invalid CYCLE_OVERRUN %q (expected skip or queue)", cfg.CycleOverrun)
+	}
+	if cfg.CycleTimeout <= 0 {
+		return fmt.Errorf("CYCLE_TIMEOUT must be positive, got %s", cfg.CycleTimeout)
+	}
+	if cfg.OffCooldown < 0 {
+		return fmt.Errorf("OFF_COOLDOWN must not be negative, got %s", cfg.OffCooldown)
+	}
+	if cfg.RetryDelay < 0 {
+		return fmt.Errorf("RETRY_DELAY must not be negative, got %s", cfg.RetryDelay)
+	}
+	if cfg.RetryMax < 0 {
+		return fmt.Errorf("RETRY_MAX must not be negative, got %d", cfg.RetryMax)
+	}
+
+	if cfg.OutageBackoffAfter < 0 {
+		return fmt.Errorf("OUTAGE_BACKOFF_AFTER must not be negative, got %s", cfg.OutageBackoffAfter)
+	}
+
+	if cfg.EnergyPrice < 0 {
+		return fmt.Errorf("ENERGY_PRICE must not be negative, got %g", cfg.EnergyPrice)
+	}
+	if _, err := time.LoadLocation(cfg.ReportTimezone); err != nil {
+		return fmt.Errorf("invalid REPORT_TIMEZONE %q: %w", cfg.ReportTimezone, err)
+	}
+
+	switch cfg.PriceSource {
+	case PriceSourceOff:
+	case PriceSourceTibber:
+		if cfg.TibberToken == "" {
+			return errors.New("TIBBER_TOKEN is required when PRICE_SOURCE=tibber")
+		}
+	case PriceSourceAwattar:
+		if cfg.AwattarURL == "" {
+			return errors.New("AWATTAR_URL is required when PRICE_SOURCE=awattar")
+		}
+	default:
+		return fmt.Errorf("invalid PRICE_SOURCE %q (expected tibber, awattar or empty)", cfg.PriceSource)
+	}
+	if cfg.PriceSource != PriceSourceOff && cfg.PriceRefresh < time.Minute {
+		return fmt.Errorf("PRICE_REFRESH must be at least 1m, got %s", cfg.PriceRefresh)
+	}
+	if cfg.PeakPrice < 0 {
+		return fmt.Errorf("PEAK_PRICE must not be negative, got %g", cfg.PeakPrice)
+	}
+	if cfg.PeakPrice > 0 && (cfg.PeakStandbyDuration <= 0 || cfg.PeakStandbyDuration > cfg.StandbyDuration) {
+		return fmt.Errorf("PEAK_STANDBY_DURATION (%s) must be positive and at most STANDBY_DURATION (%s)", cfg.PeakStandbyDuration, cfg.StandbyDuration)
+	}
+	if cfg.SurplusQuery != "" && cfg.SurplusWindow < time.Minute {
+		return fmt.Errorf("SURPLUS_WINDOW must be at least 1m, got %s", cfg.SurplusWindow)
+	}
+
+	if cfg.ActuationMinSpacing < 0 {
+		return fmt.Errorf("ACTUATION_MIN_SPACING must not be negative, got %s", cfg.ActuationMinSpacing)
+	}
+	if cfg.ActuationMaxPerHour < 0 {
+		return fmt.Errorf("ACTUATION_MAX_PER_HOUR must not be negative, got %d", cfg.ActuationMaxPerHour)
+	}
+
+	if cfg.OffRecheckDelay < 0 {
+		return fmt.Errorf("OFF_RECHECK_DELAY must not be negative, got %s", cfg.OffRecheckDelay)
+	}
+
+	if cfg.MaxRangePoints < 10 {
+		return fmt.Errorf("MAX_RANGE_POINTS must be at least 10, got %d", cfg.MaxRangePoints)
+	}
+
+	if cfg.MetricsMaxAge < 0 {
+		return fmt.Errorf("METRICS_MAX_AGE must not be negative, got %s", cfg.MetricsMaxAge)
+	}
+
+	switch cfg.HeartbeatMode {
+	case HeartbeatOff, HeartbeatVM:
+	case HeartbeatHTTP:
+		if cfg.HeartbeatURL == "" {
+			return errors.New("HEARTBEAT_URL is required when HEARTBEAT_MODE=http")
+		}
+	default:
+		return fmt.Errorf("invalid HEARTBEAT_MODE %q (expected off, vm or http)", cfg.HeartbeatMode)
+	}
+
+	switch cfg.PreActionHookFailure {
+	case PreActionAllow, PreActionDeny:
+	default:
+		return fmt.Errorf("invalid PRE_ACTION_HOOK_FAILURE %q (expected allow or deny)", cfg.PreActionHookFailure)
+	}
+
+	switch cfg.LeaderElection {
+	case LeaderOff:
+	case LeaderAuto, LeaderFile, LeaderKubernetes:
+		if cfg.LeaderElection == LeaderFile && cfg.LeaderLockFile == "" {
+			return errors.New("LEADER_LOCK_FILE is required when LEADER_ELECTION=file")
+		}
+		if cfg.LeaderRenewInterval <= 0 || 2*cfg.LeaderRenewInterval >= cfg.LeaderLeaseDuration {
+			return fmt.Errorf("LEADER_RENEW_INTERVAL (%s) must be positive and less than half of LEADER_LEASE_DURATION (%s)", cfg.LeaderRenewInterval, cfg.LeaderLeaseDuration)
+		}
+	default:
+		return fmt.Errorf("invalid LEADER_ELECTION %q (expected off, auto, file or kubernetes)", cfg.LeaderElection)
+	}
+
+	if cfg.DryRunWatch <= 0 {
+		return fmt.Errorf("DRY_RUN_WATCH must be positive, got %s", cfg.DryRunWatch)
+	}
+
+	if cfg.MaintenanceMaxHold <= 0 {
+		return fmt.Errorf("MAINTENANCE_MAX_HOLD must be positive, got %s", cfg.MaintenanceMaxHold)
+	}
+
+	for _, stage := range strings.Split(cfg.CalibrationStages, ",") {
+		if stage = strings.TrimSpace(stage); stage == "" {
+			continue
+		}
+		if _, err := strconv.ParseFloat(stage, 64); err != nil {
+			return fmt.Errorf("invalid CALIBRATION_STAGES value %q", stage)
+		}
+	}
+	if cfg.CalibrationPowerWatts != 0 && cfg.CalibrationPowerWatts <= cfg.MaxWatts {
+		return fmt.Errorf("CALIBRATION_POWER_WATTS (%.1f) must be above MAX_WATTS (%.1f) or 0 to disable", cfg.CalibrationPowerWatts, cfg.MaxWatts)
+	}
+	if cfg.CalibrationPowerDuration < time.Minute {
+		return fmt.Errorf("CALIBRATION_POWER_DURATION must be at least 1m, got %s", cfg.CalibrationPowerDuration)
+	}
+
+	if cfg.VoltageMin >= cfg.VoltageMax {
+		return fmt.Errorf("VOLTAGE_MIN (%.1f) must be less than VOLTAGE_MAX (%.1f)", cfg.VoltageMin, cfg.VoltageMax)
+	}
+
+	if cfg.StandbyMode != StandbyModeRaw && cfg.StandbyMode != StandbyModeQuantile {
+		return fmt.Errorf("invalid STANDBY_MODE %q (expected raw or quantile)", cfg.StandbyMode)
+	}
+
+	if cfg.StandbyRequireIdle {
+		if cfg.StandbyMode != StandbyModeRaw {
+			return errors.New("STANDBY_REQUIRE_IDLE requires STANDBY_MODE=raw")
+		}
+		if cfg.PrinterSource != PrinterSourceBambu && cfg.PrinterSource != PrinterSourceMetric {
+			return fmt.Errorf("STANDBY_REQUIRE_IDLE needs the state history of PRINTER_SOURCE=bambulab or metric, got %s", cfg.PrinterSource)
+		}
+	}
+
+	if cfg.StandbyMaxSpread < 0 || cfg.StandbyMaxStddev < 0 {
+		return fmt.Errorf("STANDBY_MAX_SPREAD (%.1f) and STANDBY_MAX_STDDEV (%.1f) must not be negative", cfg.StandbyMaxSpread, cfg.StandbyMaxStddev)
+	}
+
+	if cfg.TempWarning >= cfg.TempCritical {
+		return fmt.Errorf("SHELLY_TEMP_WARNING (%.1f) must be less than SHELLY_TEMP_CRITICAL (%.1f)", cfg.TempWarning, cfg.TempCritical)
+	}
+
+	if cfg.PrintPowerWatts != 0 && cfg.PrintPowerWatts <= cfg.MaxWatts {
+		return fmt.Errorf("PRINT_POWER_WATTS (%.1f) must be above MAX_WATTS (%.1f) or 0 to disable", cfg.PrintPowerWatts, cfg.MaxWatts)
+	}
+
+	switch cfg.PrinterSource {
+	case PrinterSourceBambu:
+	case PrinterSourceMetric:
+		if cfg.PrinterStateMetric == "" {
+			return errors.New("PRINTER_STATE_METRIC is required when PRINTER_SOURCE=metric")
+		}
+	case PrinterSourceMoonraker:
+		if cfg.MoonrakerURL == "" {
+			return errors.New("MOONRAKER_URL is required when PRINTER_SOURCE=moonraker")
+		}
+	case PrinterSourcePrusaLink:
+		if cfg.PrusaLinkURL == "" || cfg.PrusaLinkAPIKey == "" {
+			return errors.New("PRUSALINK_URL and PRUSALINK_API_KEY are required when PRINTER_SOURCE=prusalink")
+		}
+	case PrinterSourceBambuCloud:
+		if cfg.BambuCloudToken == "" || cfg.BambuSerial == "" {
+			return errors.New("BAMBU_CLOUD_TOKEN and BAMBU_SERIAL are required when PRINTER_SOURCE=bambucloud")
+		}
+		if cfg.BambuCloudInterval < time.Minute {
+			return fmt.Errorf("BAMBU_CLOUD_INTERVAL must be at least 1m, got %s", cfg.BambuCloudInterval)
+		}
+	default:
+		return fmt.Errorf("invalid PRINTER_SOURCE %q (expected bambulab, metric, moonraker, prusalink or bambucloud)", cfg.PrinterSource)
+	}
+
+	if cfg.BambuQueuePowerOn {
+		if cfg.BambuCloudToken == "" || cfg.BambuSerial == "" {
+			return errors.New("BAMBU_CLOUD_TOKEN and BAMBU_SERIAL are required when BAMBU_QUEUE_POWER_ON=true")
+		}
+		if cfg.BambuQueueInterval < time.Minute {
+			return fmt.Errorf("BAMBU_QUEUE_INTERVAL must be at least 1m, got %s", cfg.BambuQueueInterval)
+		}
+		if cfg.BambuQueueBuffer < 0 {
+			return fmt.Errorf("BAMBU_QUEUE_BUFFER must not be negative, got %s", cfg.BambuQueueBuffer)
+		}
+	}
+
+	if cfg.BambuMQTTHost != "" {
+		if cfg.PrinterSource != PrinterSourceBambu {
+			return errors.New("BAMBU_MQTT_HOST requires PRINTER_SOURCE=bambulab")
+		}
+		if cfg.BambuAccessCode == "" || cfg.BambuSerial == "" {
+			return errors.New("BAMBU_ACCESS_CODE and BAMBU_SERIAL are required when BAMBU_MQTT_HOST is set")
+		}
+	}
+
+	if cfg.DuplicateGuard && cfg.DuplicateGuardWindow <= cfg.CheckInterval {
+		return fmt.Errorf("DUPLICATE_GUARD_WINDOW (%s) must be longer than CHECK_INTERVAL (%s)", cfg.DuplicateGuardWindow, cfg.CheckInterval)
+	}
+
+	if cfg.AlertmanagerToken != "" && cfg.HTTPAddr == "" {
+		return errors.New("HTTP_ADDR is required when ALERTMANAGER_TOKEN is set")
+	}
+
+	if cfg.MetricsAddr != "" && cfg.MetricsAddr == cfg.HTTPAddr {
+		return fmt.Errorf("METRICS_ADDR and HTTP_ADDR can't both be %s", cfg.MetricsAddr)
+	}
+
+	if cfg.HADiscovery && cfg.MQTTBroker == "" {
+		return errors.New("MQTT_BROKER is required when HA_DISCOVERY=true")
+	}
+
+	if cfg.HAToken != "" && cfg.HAURL == "" {
+		return errors.New("HA_URL is required when HA_TOKEN is set")
+	}
+	return nil
+}
+
+// parseShellyDevices splits the comma-separated SHELLY_DEVICES, keeping empty names for validation
+func parseShellyDevices(s string) []string {
+	names := strings.Split(s, ",")
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+	}
+	return names
+}
+
+// OffRecheckWait is how long an armed auto-off waits for its re-verification, at least one check interval
+func (cfg *Config) OffRecheckWait() time.Duration {
+	return max(cfg.OffRecheckDelay, cfg.CheckInterval)
+}
+
+// OffDelay is how long an auto-off waits after the standby threshold was reached: the veto window and
+// the wait for the re-verification of the two-stage off
+func (cfg *Config) OffDelay() time.Duration {
+	if cfg.OffRecheck {
+		return cfg.VetoWindow + cfg.OffRecheckWait()
+	}
+	return cfg.VetoWindow
+}
+
+// ReportLocation is the time zone the months of reports follow
+func (cfg *Config) ReportLocation() *time.Location {
+	if cfg.ReportTimezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(cfg.ReportTimezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// ReplicaName names this instance among replicas: LEADER_IDENTITY or the hostname
+func (cfg *Config) ReplicaName() string {
+	if cfg.LeaderIdentity != "" {
+		return cfg.LeaderIdentity
+	}
+	return hostname()
+}
+
+// InstanceName names the site of this instance in metrics, audit records and the status: INSTANCE_NAME or
+// the hostname. Replicas of one site share it.
+func (cfg *Config) InstanceName() string {
+	if cfg.Instance != "" {
+		return cfg.Instance
+	}
+	return hostname()
+}
+
+// hostname is the hostname, or gome-assistant if it can't be determined
+func hostname() string {
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return "gome-assistant"
+}
+
+// CalibrationStageValues are the values of CALIBRATION_STAGES, validated by Validate
+func (cfg *Config) CalibrationStageValues() []float64 {
+	var stages []float64
+	for _, field := range strings.Split(cfg.CalibrationStages, ",") {
+		if stage, err := strconv.ParseFloat(strings.TrimSpace(field), 64); err == nil {
+			stages = append(stages, stage)
+		}
+	}
+	return stages
+}
+
+// MaxMetricsAge is METRICS_MAX_AGE, twice the check interval if unset
+func (cfg *Config) MaxMetricsAge() time.Duration {
+	if cfg.MetricsMaxAge > 0 {
+		return cfg.MetricsMaxAge
+	}
+	return 2 * cfg.CheckInterval
+}
+
+func getEnv(key, defaultValue string) string {
+	if value, source, ok := lookupSetting(key, false); ok {
+		recordSetting(key, value, source)
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvAllowEmpty is getEnv for settings where an empty value disables a feature that is on by default
+func getEnvAllowEmpty(key, defaultValue string) string {
+	if value, source, ok := lookupSetting(key, true); ok {
+		recordSetting(key, value, source)
+		return value
+	}
+	return defaultValue
+}
+
+// invalidSettings collects the settings whose values don't parse, LoadFlags exits listing them
+var invalidSettings []string
+
+// invalidSetting records a value that isn't what, like "a number"
+func invalidSetting(key, value, what string) {
+	invalidSettings = append(invalidSettings, fmt.Sprintf("%s=%q is not %s", key, value, what))
+}
+
+// envDuration is getEnv for durations like 30s or 5m
+func envDuration(key, defaultValue string) time.Duration {
+	value := getEnv(key, defaultValue)
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		invalidSetting(key, value, "a duration like 30s or 5m")
+	}
+	return d
+}
+
+// envInt is getEnv for whole numbers
+func envInt(key, defaultValue string) int {
+	value := getEnv(key, defaultValue)
+	i, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		invalidSetting(key, value, "a whole number")
+	}
+	return i
+}
+
+// envFloat is getEnv for numbers, with a decimal point rather than a comma
+func envFloat(key, defaultValue string) float64 {
+	value := getEnv(key, defaultValue)
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		invalidSetting(key, value, "a number")
+	}
+	return f
+}
+
+// envLevel is getEnv for log levels
+func envLevel(key, defaultValue string) slog.Level {
+	value := getEnv(key, defaultValue)
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(value))); err != nil {
+		invalidSetting(key, value, "debug, info, warn or error")
+	}
+	return level
+}
+
+// envBool is getEnv for true or false
+func envBool(key string, defaultValue bool) bool {
+	value := getEnv(key, strconv.FormatBool(defaultValue))
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		invalidSetting(key, value, "true or false")
+	}
+	return b
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// load runs Load on the arguments with a fresh command line, with the password Validate requires
+func load(t *testing.T, args ...string) Config {
+	t.Helper()
+	commandLine, osArgs := flag.CommandLine, os.Args
+	t.Cleanup(func() { flag.CommandLine, os.Args = commandLine, osArgs })
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	os.Args = append([]string{"gome-assistant", "-vm-password", "secret"}, args...)
+	return Load()
+}
+
+// metaNames are device names with every character significant in a PromQL regex or string literal
+var metaNames = []string{
+	"bambu.x1c", "bambu+enclosure", "plug*", "plug?", "plug(1)", "plug[2]", "plug{3}",
+	"^start", "end$", "left|right", `back\slash`, `say "hi"`, "tab\there",
+}
+
+func TestShellyDevicesPattern(t *testing.T) {
+	cfg := load(t, "-shelly-devices", strings.Join(metaNames, ", "))
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	re, err := regexp.Compile(cfg.ShellyDevicePattern)
+	if err != nil {
+		t.Fatalf("pattern %q: %v", cfg.ShellyDevicePattern, err)
+	}
+	for _, name := range metaNames {
+		if !re.MatchString(name) {
+			t.Errorf("%q not matched by %q", name, cfg.ShellyDevicePattern)
+		}
+	}
+	// Names the characters would match as regex syntax, and the listed names with anything around them
+	for _, name := range []string{
+		"bambuXx1c", "bambuuenclosure", "plu", "pluggg", "plug1", "plug2", "plugggg", "start", "end", "left",
+		"backsslash", "bambu.x1c-2", "my-plug*", "left|right|up", "",
+	} {
+		if re.MatchString(name) {
+			t.Errorf("%q matched by %q", name, cfg.ShellyDevicePattern)
+		}
+	}
+}
+
+func TestShellyDevicesValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"single name", []string{"-shelly-devices", "bambu+enclosure"}, ""},
+		{"spaces around names", []string{"-shelly-devices", " a , b "}, ""},
+		{"empty name", []string{"-shelly-devices", "a,,b"}, `SHELLY_DEVICES "a,,b" contains an empty device name`},
+		{"trailing comma", []string{"-shelly-devices", "a,"}, "contains an empty device name"},
+		{"only spaces", []string{"-shelly-devices", "a, ,b"}, "contains an empty device name"},
+		{"duplicate", []string{"-shelly-devices", "a,b,a"}, `SHELLY_DEVICES lists "a" twice`},
+		{"duplicate after trimming", []string{"-shelly-devices", "a, a"}, `SHELLY_DEVICES lists "a" twice`},
+		{"with a pattern", []string{"-shelly-devices", "a", "-shelly-pattern", ".*"}, "SHELLY_DEVICES and SHELLY_DEVICE_PATTERN are mutually exclusive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := load(t, tt.args...)
+			err := cfg.Validate()
+			if (tt.want == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.want)) {
+				t.Errorf("Validate() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("pattern from the environment", func(t *testing.T) {
+		t.Setenv("SHELLY_DEVICE_PATTERN", ".*")
+		cfg := load(t, "-shelly-devices", "a")
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+			t.Errorf("Validate() = %v, want the conflict", err)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Device is one printer/Shelly pair of DEVICES with the settings it runs with
+type Device struct {
+	Name   string
+	Config Config // The global settings with the overrides of the entry
+}
+
+// deviceSettings apply the keys of a DEVICES entry to its copy of the settings
+var deviceSettings = map[string]func(cfg *Config, value string) error{
+	"pattern": func(cfg *Config, value string) error {
+		if _, err := regexp.Compile(value); err != nil {
+			return err
+		}
+		cfg.ShellyDevicePattern = value
+		return nil
+	},
+	"min_watts": func(cfg *Config, value string) (err error) {
+		cfg.MinWatts, err = strconv.ParseFloat(value, 64)
+		return err
+	},
+	"max_watts": func(cfg *Config, value string) (err error) {
+		cfg.MaxWatts, err = strconv.ParseFloat(value, 64)
+		return err
+	},
+	"standby_duration": func(cfg *Config, value string) (err error) {
+		cfg.StandbyDuration, err = time.ParseDuration(value)
+		return err
+	},
+	"relay_channel": func(cfg *Config, value string) (err error) {
+		cfg.ShellyRelayChannel, err = strconv.Atoi(value)
+		return err
+	},
+	"relay_type": func(cfg *Config, value string) error {
+		cfg.RelayType = value
+		return nil
+	},
+	"ha_switch_entity": func(cfg *Config, value string) error {
+		cfg.HASwitchEntity = value
+		return nil
+	},
+	"shelly_ip": func(cfg *Config, value string) error {
+		cfg.ShellyIP = value
+		return nil
+	},
+	"shelly_device_id": func(cfg *Config, value string) error {
+		cfg.ShellyDeviceID = value
+		return nil
+	},
+	"shelly_mqtt_id": func(cfg *Config, value string) error {
+		cfg.ShellyMQTTID = value
+		return nil
+	},
+	"bambu_serial": func(cfg *Config, value string) error {
+		cfg.BambuSerial = value
+		return nil
+	},
+	"printer_source": func(cfg *Config, value string) error {
+		cfg.PrinterSource = value
+		return nil
+	},
+	"printer_state_metric": func(cfg *Config, value string) error {
+		cfg.PrinterStateMetric = value
+		return nil
+	},
+	// The values are separated by | as commas separate the settings
+	"printer_busy_values": func(cfg *Config, value string) error {
+		cfg.PrinterBusyValues = strings.ReplaceAll(value, "|", ",")
+		return nil
+	},
+}
+
+// deviceKeys lists the keys of deviceSettings for errors
+const deviceKeys = "pattern, min_watts, max_watts, standby_duration, relay_channel, relay_type, ha_switch_entity, shelly_ip, shelly_device_id, shelly_mqtt_id, bambu_serial, printer_source, printer_state_metric or printer_busy_values"
+
+// DeviceList returns the entries of DEVICES, or the single device of the global settings without it.
+// Each entry reads "name:key=value,key=value" and entries are separated by semicolons.
+func (cfg *Config) DeviceList() ([]Device, error) {
+	if cfg.Devices == "" {
+		return []Device{{Config: *cfg}}, nil
+	}
+
+	var devices []Device
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(cfg.Devices, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, settings, _ := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !instanceName.MatchString(name) {
+			return nil, fmt.Errorf("device name %q must be at most 63 letters, digits, '_', '.' or '-', starting with a letter or digit", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("device %q is listed twice", name)
+		}
+		seen[name] = true
+
+		dev := Device{Name: name, Config: *cfg}
+		dev.Config.Devices = ""
+		dev.Config.StatusFile = devicePath(cfg.StatusFile, name)
+		dev.Config.StateFile = devicePath(cfg.StateFile, name)
+		hasPattern := false
+		for _, item := range strings.Split(settings, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(item, "=")
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			apply := deviceSettings[key]
+			if !ok || apply == nil {
+				return nil, fmt.Errorf("device %s: expected key=value with a key of %s, got %q", name, deviceKeys, item)
+			}
+			if err := apply(&dev.Config, value); err != nil {
+				return nil, fmt.Errorf("device %s: %s: %w", name, key, err)
+			}
+			hasPattern = hasPattern || key == "pattern"
+		}
+		if !hasPattern {
+			return nil, fmt.Errorf("device %s needs a pattern", name)
+		}
+		// The pattern replaces the exact names of SHELLY_DEVICES
+		dev.Config.ShellyDevices = ""
+		devices = append(devices, dev)
+	}
+	if len(devices) == 0 {
+		return nil, errors.New("no device is defined")
+	}
+	return devices, nil
+}
+
+// validateDevices checks every entry of DEVICES like the global settings
+func (cfg *Config) validateDevices() error {
+	devices, err := cfg.DeviceList()
+	if err != nil {
+		return err
+	}
+	for _, dev := range devices {
+		if err := dev.Config.Validate(); err != nil {
+			return fmt.Errorf("device %s: %w", dev.Name, err)
+		}
+	}
+	return nil
+}
+
+// devicePath inserts the device name before the extension of a per-device file, e.g. state.x1c.json
+func devicePath(path, name string) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + name + ext
+}
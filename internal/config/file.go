@@ -0,0 +1,166 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of a setting, in the order of precedence
+const (
+	sourceFlag = "flag"
+	sourceEnv  = "env"
+	sourceFile = "file"
+)
+
+// fileSetting is a setting of the config file with the line it is on
+type fileSetting struct {
+	value string
+	line  int
+}
+
+// The settings are read once per process. getEnv consults fileSettings after the environment, records
+// the keys it is asked for in knownKeys and the settings that don't keep their default in effective.
+var (
+	fileSettings map[string]fileSetting
+	knownKeys    map[string]bool
+	effective    []string
+)
+
+// secretSetting matches the names of settings and flags whose values are not logged
+var secretSetting = regexp.MustCompile(`(?i)password|token|secret|key|access.code|headers|webhook`)
+
+// lookupSetting returns the value of a setting from the environment, or from the config file without
+// it, with its source. As before, an empty environment variable counts as unset unless allowEmpty.
+func lookupSetting(key string, allowEmpty bool) (string, string, bool) {
+	knownKeys[key] = true
+	if value, ok := os.LookupEnv(key); ok && (allowEmpty || value != "") {
+		return value, sourceEnv, true
+	}
+	if s, ok := fileSettings[key]; ok && (allowEmpty || s.value != "") {
+		return s.value, sourceFile, true
+	}
+	return "", "", false
+}
+
+// recordSetting remembers a setting that doesn't have its default for Effective. The paths of the
+// _FILE variants of secrets are shown.
+func recordSetting(name, value, source string) {
+	if secretSetting.MatchString(name) && !strings.HasSuffix(name, "_FILE") && value != "" {
+		value = "***"
+	}
+	effective = append(effective, fmt.Sprintf("%s=%s (%s)", name, value, source))
+}
+
+// configFilePath returns the value of -config in args, or CONFIG_FILE. It runs before the flags are
+// parsed, as the file supplies their defaults.
+func configFilePath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return os.Getenv("CONFIG_FILE")
+}
+
+// loadConfigFile reads the YAML config file at path. Its top-level keys are the names of the environment
+// variables, in any case, with scalar values. The devices section maps each device name to its DEVICES
+// keys and is turned into DEVICES.
+func loadConfigFile(path string) (map[string]fileSetting, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	settings := map[string]fileSetting{}
+	if len(doc.Content) == 0 {
+		return settings, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: line %d: expected a mapping of settings", path, root.Line)
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		keyNode, valueNode := root.Content[i], root.Content[i+1]
+		key := strings.ToUpper(keyNode.Value)
+		if _, ok := settings[key]; ok {
+			return nil, fmt.Errorf("%s: line %d: %s is set twice", path, keyNode.Line, key)
+		}
+		if key == "DEVICES" && valueNode.Kind == yaml.MappingNode {
+			devices, err := fileDevices(valueNode)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			settings[key] = fileSetting{value: devices, line: keyNode.Line}
+			continue
+		}
+		if valueNode.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("%s: line %d: %s must be a single value", path, valueNode.Line, key)
+		}
+		settings[key] = fileSetting{value: valueNode.Value, line: keyNode.Line}
+	}
+	return settings, nil
+}
+
+// fileDevices turns the devices section into the DEVICES format, name:key=value,key=value;...
+func fileDevices(node *yaml.Node) (string, error) {
+	var entries []string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		nameNode, settingsNode := node.Content[i], node.Content[i+1]
+		if settingsNode.Kind != yaml.MappingNode {
+			return "", fmt.Errorf("line %d: device %s must be a mapping of its settings", settingsNode.Line, nameNode.Value)
+		}
+		var items []string
+		for j := 0; j+1 < len(settingsNode.Content); j += 2 {
+			keyNode, valueNode := settingsNode.Content[j], settingsNode.Content[j+1]
+			if valueNode.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("line %d: %s of device %s must be a single value", valueNode.Line, keyNode.Value, nameNode.Value)
+			}
+			if strings.ContainsAny(valueNode.Value, ",;") {
+				return "", fmt.Errorf("line %d: %s of device %s must not contain ',' or ';'", valueNode.Line, keyNode.Value, nameNode.Value)
+			}
+			items = append(items, keyNode.Value+"="+valueNode.Value)
+		}
+		entries = append(entries, nameNode.Value+":"+strings.Join(items, ","))
+	}
+	return strings.Join(entries, ";"), nil
+}
+
+// unknownFileSettings lists the keys of the config file that no setting asked for, with their lines
+func unknownFileSettings() []string {
+	var unknown []string
+	for key, s := range fileSettings {
+		if !knownKeys[key] {
+			unknown = append(unknown, fmt.Sprintf("%s (line %d)", key, s.line))
+		}
+	}
+	slices.Sort(unknown)
+	return unknown
+}
+
+// Effective lists the settings that don't have their default with their source, secrets redacted.
+// Flags come last and override a setting of the same name.
+func (cfg *Config) Effective() string {
+	if len(cfg.effective) == 0 {
+		return "all defaults"
+	}
+	return strings.Join(cfg.effective, ", ")
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// headerName matches the header names allowed in VM_HEADERS and SHELLY_HEADERS
+var headerName = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// secretHeaderWords mark headers whose values are credentials and never logged
+var secretHeaderWords = []string{"auth", "cookie", "token", "key", "secret", "password"}
+
+// parseHeaders reads "Name: value; Name: value" into headers
+func parseHeaders(s string) (http.Header, error) {
+	headers := http.Header{}
+	for i, pair := range strings.Split(s, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || !headerName.MatchString(name) {
+			// The value may be a credential, don't echo it
+			return nil, fmt.Errorf("header %d is invalid, expected Name: value", i+1)
+		}
+		headers.Add(name, value)
+	}
+	return headers, nil
+}
+
+// VMHeaderValues are the extra headers of VictoriaMetrics requests
+func (cfg *Config) VMHeaderValues() http.Header {
+	headers, _ := parseHeaders(cfg.VMHeaders)
+	return headers
+}
+
+// ShellyHeaderValues are the extra headers of requests to the Shelly device
+func (cfg *Config) ShellyHeaderValues() http.Header {
+	headers, _ := parseHeaders(cfg.ShellyHeaders)
+	return headers
+}
+
+// RedactHeaders formats headers for logs, hiding the values of credentials like Authorization or X-Api-Key
+func RedactHeaders(headers http.Header) string {
+	var parts []string
+	for name, values := range headers {
+		value := strings.Join(values, ", ")
+		lower := strings.ToLower(name)
+		for _, word := range secretHeaderWords {
+			if strings.Contains(lower, word) {
+				value = "<redacted>"
+				break
+			}
+		}
+		parts = append(parts, name+": "+value)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "; ")
+}
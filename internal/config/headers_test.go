@@ -0,0 +1,95 @@
+package config
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		in   string
+		want http.Header
+		err  string
+	}{
+		{"", http.Header{}, ""},
+		{"X-Org: workshop", http.Header{"X-Org": {"workshop"}}, ""},
+		{" x-org:workshop ; X-Scope-OrgID: 7 ;", http.Header{"X-Org": {"workshop"}, "X-Scope-Orgid": {"7"}}, ""},
+		{"X-Tag: a; X-Tag: b", http.Header{"X-Tag": {"a", "b"}}, ""},
+		// Only the first colon separates, the value may contain more
+		{"Forwarded: for=192.0.2.1:8080", http.Header{"Forwarded": {"for=192.0.2.1:8080"}}, ""},
+		{"X-Empty:", http.Header{"X-Empty": {""}}, ""},
+		{"X-Org workshop", nil, "header 1 is invalid, expected Name: value"},
+		{"X-Org: a; : b", nil, "header 2 is invalid"},
+		{"X Org: a", nil, "header 1 is invalid"},
+		{"X-Org\r\nX-Injected: a", nil, "header 1 is invalid"},
+	}
+	for _, tt := range tests {
+		got, err := parseHeaders(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseHeaders(%q) = %v, want error %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || len(got) != len(tt.want) {
+			t.Errorf("parseHeaders(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+			continue
+		}
+		for name, values := range tt.want {
+			if !slices.Equal(got[name], values) {
+				t.Errorf("parseHeaders(%q)[%s] = %q, want %q", tt.in, name, got[name], values)
+			}
+		}
+	}
+}
+
+func TestHeadersValidation(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-vm-headers", "X-Org: workshop", "-shelly-headers", "X-Api-Key: s3cret"}, ""},
+		{[]string{"-vm-headers", "X-Org: workshop; Authorization Bearer s3cret"}, "VM_HEADERS: header 2 is invalid"},
+		{[]string{"-shelly-headers", "X-Api-Key=s3cret"}, "SHELLY_HEADERS: header 1 is invalid"},
+	} {
+		cfg := load(t, tt.args...)
+		err := cfg.Validate()
+		if (tt.want == "") != (err == nil) || (err != nil && !strings.HasPrefix(err.Error(), tt.want)) {
+			t.Errorf("%v: Validate() = %v, want %q", tt.args, err, tt.want)
+		}
+		// A value that may be a credential isn't echoed
+		if err != nil && strings.Contains(err.Error(), "s3cret") {
+			t.Errorf("%v: error %q contains the value", tt.args, err)
+		}
+	}
+
+	cfg := load(t, "-vm-headers", "X-Org: workshop", "-shelly-headers", "X-Org: lab; Host: plug.internal")
+	if got := cfg.VMHeaderValues(); got.Get("X-Org") != "workshop" || len(got) != 1 {
+		t.Errorf("VM headers = %v", got)
+	}
+	if got := cfg.ShellyHeaderValues(); got.Get("X-Org") != "lab" || got.Get("Host") != "plug.internal" {
+		t.Errorf("Shelly headers = %v", got)
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	headers := http.Header{
+		"X-Org":         {"workshop"},
+		"Authorization": {"Bearer s3cret"},
+		"X-Api-Key":     {"s3cret"},
+		"Cookie":        {"session=s3cret"},
+		"X-Auth-Token":  {"s3cret"},
+		"X-Secret":      {"s3cret"},
+		"X-Password":    {"s3cret"},
+		"X-Tag":         {"a", "b"},
+	}
+	want := "Authorization: <redacted>; Cookie: <redacted>; X-Api-Key: <redacted>; X-Auth-Token: <redacted>; X-Org: workshop; X-Password: <redacted>; X-Secret: <redacted>; X-Tag: a, b"
+	if got := RedactHeaders(headers); got != want {
+		t.Errorf("RedactHeaders = %q, want %q", got, want)
+	}
+	if got := RedactHeaders(nil); got != "" {
+		t.Errorf("RedactHeaders(nil) = %q", got)
+	}
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// parseHostOverrides reads "name=ip,name=ip" into addresses by lower-case host name
+func parseHostOverrides(s string) (map[string]string, error) {
+	hosts := map[string]string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected name=ip, got %q", item)
+		}
+		addr, err := netip.ParseAddr(strings.Trim(value, "[]"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q for %s", value, name)
+		}
+		hosts[name] = addr.String()
+	}
+	return hosts, nil
+}
+
+// ShellyHostOverrides are the static addresses of Shelly host names
+func (cfg *Config) ShellyHostOverrides() map[string]string {
+	hosts, _ := parseHostOverrides(cfg.ShellyHosts)
+	return hosts
+}
+
+// validateShellyIP checks that SHELLY_IP is an IP address or a host name known to SHELLY_HOSTS or DNS,
+// optionally with a port
+func (cfg *Config) validateShellyIP() error {
+	host := strings.TrimSpace(cfg.ShellyIP)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+	if _, ok := cfg.ShellyHostOverrides()[strings.ToLower(host)]; ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+		return fmt.Errorf("SHELLY_IP %q is neither an IP address nor a resolvable host name: %w", cfg.ShellyIP, err)
+	}
+	return nil
+}
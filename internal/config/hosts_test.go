@@ -0,0 +1,65 @@
+package config
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestParseHostOverrides(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+		err  string
+	}{
+		{"", map[string]string{}, ""},
+		{"bambu-plug.lan=192.168.1.42", map[string]string{"bambu-plug.lan": "192.168.1.42"}, ""},
+		// Names are lower-cased, IPv6 addresses may be bracketed and are normalized
+		{" Bambu-Plug.LAN = 192.168.1.42 , shelly-v6=[FD00:0::5054],", map[string]string{"bambu-plug.lan": "192.168.1.42", "shelly-v6": "fd00::5054"}, ""},
+		{"plug=fe80::1%eth0", map[string]string{"plug": "fe80::1%eth0"}, ""},
+		{"plug=192.168.1.42,plug=192.168.1.43", map[string]string{"plug": "192.168.1.43"}, ""},
+		{"bambu-plug.lan", nil, `expected name=ip, got "bambu-plug.lan"`},
+		{"=192.168.1.42", nil, "expected name=ip"},
+		{"bambu-plug.lan=bambu-plug.local", nil, `invalid IP address "bambu-plug.local" for bambu-plug.lan`},
+		{"plug=192.168.1.42:80", nil, "invalid IP address"},
+	}
+	for _, tt := range tests {
+		got, err := parseHostOverrides(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseHostOverrides(%q) = %v, want error %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !maps.Equal(got, tt.want) {
+			t.Errorf("parseHostOverrides(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestHostOverridesValidation(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-shelly-hosts", "bambu-plug.lan=192.168.1.42"}, ""},
+		{[]string{"-shelly-hosts", "bambu-plug.lan:192.168.1.42"}, "SHELLY_HOSTS: expected name=ip"},
+		{[]string{"-shelly-hosts", "bambu-plug.lan=plug.local"}, "SHELLY_HOSTS: invalid IP address"},
+		// A name only SHELLY_HOSTS knows is a valid SHELLY_IP, in any case and with a port
+		{[]string{"-shelly-hosts", "bambu-plug.invalid=192.168.1.42", "-shelly-ip", "Bambu-Plug.invalid:8080"}, ""},
+		{[]string{"-shelly-hosts", "other-plug.invalid=192.168.1.42", "-shelly-ip", "bambu-plug.invalid"}, `SHELLY_IP "bambu-plug.invalid" is neither an IP address nor a resolvable host name`},
+		{[]string{"-shelly-dns-cache-ttl", "5m"}, ""},
+		{[]string{"-shelly-dns-cache-ttl", "-1m"}, "SHELLY_DNS_CACHE_TTL must not be negative"},
+	} {
+		cfg := load(t, tt.args...)
+		err := cfg.Validate()
+		if (tt.want == "") != (err == nil) || (err != nil && !strings.HasPrefix(err.Error(), tt.want)) {
+			t.Errorf("%v: Validate() = %v, want %q", tt.args, err, tt.want)
+		}
+	}
+
+	cfg := load(t, "-shelly-hosts", "Bambu-Plug.lan=192.168.1.42")
+	if got := cfg.ShellyHostOverrides(); got["bambu-plug.lan"] != "192.168.1.42" || len(got) != 1 {
+		t.Errorf("overrides = %v", got)
+	}
+}
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"time"
+)
+
+// setupLogging applies LOG_LEVEL and LOG_FORMAT to the default logger. The text format keeps writing
+// through the standard logger with its date and time, json replaces it for the log package too.
+func setupLogging(cfg *Config) {
+	if cfg.LogFormat != LogFormatJSON {
+		slog.SetLogLoggerLevel(cfg.LogLevel)
+		return
+	}
+	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: cfg.LogLevel, ReplaceAttr: jsonAttr})
+	slog.SetDefault(slog.New(handler))
+}
+
+// jsonAttr writes the time as RFC 3339 in UTC and durations like 15m0s, as in the text format,
+// instead of nanoseconds
+func jsonAttr(groups []string, a slog.Attr) slog.Attr {
+	switch {
+	case len(groups) == 0 && a.Key == slog.TimeKey:
+		return slog.String(a.Key, a.Value.Time().UTC().Format(time.RFC3339))
+	case a.Value.Kind() == slog.KindDuration:
+		return slog.String(a.Key, a.Value.Duration().String())
+	}
+	return a
+}
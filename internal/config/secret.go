@@ -0,0 +1,116 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// secretFile is a secret LoadFlags read from the file named by its _FILE variant
+type secretFile struct {
+	key   string // Setting of the secret, e.g. VM_PASSWORD
+	path  string
+	value string // Trimmed contents when they were read
+}
+
+// secretFiles are the secrets read from files by the getSecret calls of LoadFlags
+var secretFiles []secretFile
+
+// getSecret is getEnv for passwords and tokens, which can also be read from the file named by the
+// setting with a _FILE suffix, like a Docker secret. The contents are trimmed, setting both is an error.
+func getSecret(key string) string {
+	value := getEnv(key, "")
+	path := getEnv(key+"_FILE", "")
+	if path == "" {
+		return value
+	}
+	if value != "" {
+		invalidSettings = append(invalidSettings, fmt.Sprintf("%s and %s_FILE are both set", key, key))
+		return value
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		invalidSettings = append(invalidSettings, fmt.Sprintf("%s_FILE can't be read: %v", key, err))
+		return ""
+	}
+	value = strings.TrimSpace(string(data))
+	secretFiles = append(secretFiles, secretFile{key: key, path: path, value: value})
+	return value
+}
+
+// secretFlagConflicts returns a message for every secret read from a file whose flag was given as well.
+// The flags are named after the settings, -vm-password for VM_PASSWORD.
+func secretFlagConflicts(fs *flag.FlagSet, files []secretFile) []string {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var conflicts []string
+	for _, file := range files {
+		name := strings.ReplaceAll(strings.ToLower(file.key), "_", "-")
+		if set[name] {
+			conflicts = append(conflicts, fmt.Sprintf("-%s and %s_FILE are both set", name, file.key))
+		}
+	}
+	return conflicts
+}
+
+// reloadable are the secrets read by their clients on every request, through Secret, so a rotated
+// file takes effect without a restart
+var reloadable = map[string]func(cfg *Config) *string{
+	"VM_PASSWORD":        func(cfg *Config) *string { return &cfg.VictoriaMetricsPassword },
+	"SHELLY_PASSWORD":    func(cfg *Config) *string { return &cfg.ShellyPassword },
+	"HA_TOKEN":           func(cfg *Config) *string { return &cfg.HAToken },
+	"TELEGRAM_BOT_TOKEN": func(cfg *Config) *string { return &cfg.TelegramBotToken },
+}
+
+// secretsMu guards the reloadable secrets of every config against ReloadSecrets swapping them
+var secretsMu sync.RWMutex
+
+// Secret returns the current value of a reloadable secret, by its setting like VM_PASSWORD
+func (cfg *Config) Secret(key string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	return *reloadable[key](cfg)
+}
+
+// ReloadSecrets reads the files of the _FILE secrets again and swaps the changed ones that are
+// reloadable into cfg and the configs of its devices. It returns the settings it applied and those
+// that changed but only apply after a restart, like the password of a broker connection. A file that
+// can't be read or is empty, like one caught in the middle of being rewritten, fails the reload
+// without changing anything.
+func (cfg *Config) ReloadSecrets(devices []Device) (applied, pending []string, err error) {
+	values := make([]string, len(cfg.secretFiles))
+	for i, file := range cfg.secretFiles {
+		data, err := os.ReadFile(file.path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s_FILE can't be read: %w", file.key, err)
+		}
+		values[i] = strings.TrimSpace(string(data))
+		if values[i] == "" {
+			return nil, nil, fmt.Errorf("%s_FILE is empty", file.key)
+		}
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for i := range cfg.secretFiles {
+		file := &cfg.secretFiles[i]
+		if values[i] == file.value {
+			continue
+		}
+		field := reloadable[file.key]
+		if field == nil {
+			// Reported again on every reload until the restart
+			pending = append(pending, file.key)
+			continue
+		}
+		*field(cfg) = values[i]
+		for j := range devices {
+			*field(&devices[j].Config) = values[i]
+		}
+		file.value = values[i]
+		applied = append(applied, file.key)
+	}
+	return applied, pending, nil
+}
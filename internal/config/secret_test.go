@@ -0,0 +1,144 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeSecret writes contents to the secret file at path
+func writeSecret(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// secretsFrom points the _FILE variants of VM_PASSWORD and API_TOKEN at files in a temporary directory
+// and returns their paths
+func secretsFrom(t *testing.T) (vmPassword, apiToken string) {
+	t.Helper()
+	dir := t.TempDir()
+	vmPassword, apiToken = filepath.Join(dir, "vm_password"), filepath.Join(dir, "api_token")
+	writeSecret(t, vmPassword, "  s3cret\n")
+	writeSecret(t, apiToken, "token-1\n")
+	t.Setenv("VM_PASSWORD_FILE", vmPassword)
+	t.Setenv("API_TOKEN_FILE", apiToken)
+	return vmPassword, apiToken
+}
+
+func TestSecretFiles(t *testing.T) {
+	secretsFrom(t)
+	cfg := LoadFlags(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	if cfg.VictoriaMetricsPassword != "s3cret" || cfg.APIToken != "token-1" {
+		t.Errorf("secrets = %q and %q, want the trimmed file contents", cfg.VictoriaMetricsPassword, cfg.APIToken)
+	}
+}
+
+func TestReloadSecrets(t *testing.T) {
+	vmPassword, apiToken := secretsFrom(t)
+	t.Setenv("DEVICES", "x1c:pattern=x1c;voron:pattern=voron")
+	cfg := LoadFlags(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	devices, err := cfg.DeviceList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reload := func() ([]string, []string, error) { return cfg.ReloadSecrets(devices) }
+
+	// Only the contents count, not the whitespace around them
+	writeSecret(t, vmPassword, "s3cret")
+	if applied, pending, err := reload(); err != nil || len(applied) != 0 || len(pending) != 0 {
+		t.Errorf("unchanged files: ReloadSecrets() = %v, %v, %v", applied, pending, err)
+	}
+
+	writeSecret(t, vmPassword, "rotated\n")
+	writeSecret(t, apiToken, "token-2\n")
+	if applied, pending, err := reload(); err != nil || !slices.Equal(applied, []string{"VM_PASSWORD"}) || !slices.Equal(pending, []string{"API_TOKEN"}) {
+		t.Errorf("rotated files: ReloadSecrets() = %v, %v, %v, want VM_PASSWORD applied, API_TOKEN pending", applied, pending, err)
+	}
+	for _, c := range []*Config{&cfg, &devices[0].Config, &devices[1].Config} {
+		if c.Secret("VM_PASSWORD") != "rotated" {
+			t.Errorf("VM password = %q, want the rotated one in every config", c.Secret("VM_PASSWORD"))
+		}
+	}
+	// The API token stays in use until the restart, each reload mentions it again
+	if cfg.APIToken != "token-1" {
+		t.Errorf("API token = %q after the reload, want the loaded one", cfg.APIToken)
+	}
+	if applied, pending, err := reload(); err != nil || len(applied) != 0 || !slices.Equal(pending, []string{"API_TOKEN"}) {
+		t.Errorf("reload again: ReloadSecrets() = %v, %v, %v, want API_TOKEN still pending", applied, pending, err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		prep func()
+		want string
+	}{
+		{"empty file", func() { writeSecret(t, vmPassword, "\n") }, "VM_PASSWORD_FILE is empty"},
+		{"removed file", func() { _ = os.Remove(vmPassword) }, "VM_PASSWORD_FILE can't be read: open " + vmPassword + ": no such file or directory"},
+	} {
+		tt.prep()
+		if applied, pending, err := reload(); err == nil || err.Error() != tt.want {
+			t.Errorf("%s: ReloadSecrets() = %v, %v, %v, want %q", tt.name, applied, pending, err, tt.want)
+		}
+		if cfg.Secret("VM_PASSWORD") != "rotated" {
+			t.Errorf("%s: VM password = %q, want the one loaded before", tt.name, cfg.Secret("VM_PASSWORD"))
+		}
+	}
+}
+
+func TestReloadSecretsWithoutFiles(t *testing.T) {
+	cfg := load(t)
+	if applied, pending, err := cfg.ReloadSecrets(nil); err != nil || len(applied) != 0 || len(pending) != 0 {
+		t.Errorf("ReloadSecrets() = %v, %v, %v, want nothing to read", applied, pending, err)
+	}
+}
+
+func TestSecretFlagConflicts(t *testing.T) {
+	files := []secretFile{{key: "VM_PASSWORD"}, {key: "SHELLY_CLOUD_KEY"}, {key: "API_TOKEN"}}
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{"-vm-password=x"}, []string{"-vm-password and VM_PASSWORD_FILE are both set"}},
+		// An empty value given on the command line is set all the same
+		{[]string{"-shelly-cloud-key=", "-api-token", "y"}, []string{"-shelly-cloud-key and SHELLY_CLOUD_KEY_FILE are both set", "-api-token and API_TOKEN_FILE are both set"}},
+		{[]string{"-tapo-password", "z"}, nil},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		for _, name := range []string{"vm-password", "shelly-cloud-key", "api-token", "tapo-password"} {
+			fs.String(name, "", "")
+		}
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		if got := secretFlagConflicts(fs, files); !slices.Equal(got, tt.want) {
+			t.Errorf("%v: conflicts = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+// TestSecretFlagNames checks that every secret has a flag named after its setting, as
+// secretFlagConflicts expects
+func TestSecretFlagNames(t *testing.T) {
+	source, err := os.ReadFile("config.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets := regexp.MustCompile(`fs\.StringVar\(&cfg\.\w+, "([a-z0-9-]+)", getSecret\("([A-Z0-9_]+)"\)`).FindAllSubmatch(source, -1)
+	if len(secrets) < 20 {
+		t.Fatalf("%d secrets found in config.go", len(secrets))
+	}
+	for _, m := range secrets {
+		name, key := string(m[1]), string(m[2])
+		if want := strings.ReplaceAll(strings.ToLower(key), "_", "-"); name != want {
+			t.Errorf("%s: flag -%s, want -%s", key, name, want)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ShellyMQTTStateTopic is the topic the Shelly reports the relay state on, the command topic without
+// /command, with <id> left in place
+func (cfg *Config) ShellyMQTTStateTopic() string {
+	return strings.TrimSuffix(cfg.ShellyMQTTTopic, "/command")
+}
+
+func (cfg *Config) validateShellyMQTT() error {
+	if cfg.ShellyControl != ShellyControlMQTT {
+		return nil
+	}
+	if cfg.ShellyMQTTBroker == "" {
+		return errors.New("SHELLY_MQTT_BROKER is required when SHELLY_CONTROL=mqtt")
+	}
+	if u, err := url.Parse(cfg.ShellyMQTTBroker); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("SHELLY_MQTT_BROKER %q must be a URL like tcp://host:1883", cfg.ShellyMQTTBroker)
+	}
+	if !strings.HasSuffix(cfg.ShellyMQTTTopic, "/command") || strings.ContainsAny(cfg.ShellyMQTTTopic, "+#") {
+		return fmt.Errorf("SHELLY_MQTT_TOPIC must be a command topic ending in /command without wildcards, got %q", cfg.ShellyMQTTTopic)
+	}
+	if cfg.ShellyMQTTTimeout <= 0 {
+		return fmt.Errorf("SHELLY_MQTT_TIMEOUT must be positive, got %s", cfg.ShellyMQTTTimeout)
+	}
+	return nil
+}
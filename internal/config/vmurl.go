@@ -0,0 +1,28 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// validateVMURL checks that VM_URL is an absolute http(s) URL, which rejects IPv6 hosts without brackets
+func validateVMURL(s string) error {
+	u, err := url.Parse(s)
+	// Depending on the Go version unbracketed IPv6 hosts parse, with the address split up at a colon
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		(strings.Count(u.Host, ":") > 1 && !strings.HasPrefix(u.Host, "[")) {
+		return fmt.Errorf("invalid VM_URL %q, expected an http(s) URL with IPv6 hosts in brackets and zones escaped as %%25, like http://[fe80::1%%25eth0]:8428", s)
+	}
+	return nil
+}
+
+// VictoriaMetricsEndpoint builds the URL of a VictoriaMetrics API path below VM_URL, keeping any path prefix
+// of VM_URL
+func (cfg *Config) VictoriaMetricsEndpoint(path string, params url.Values) string {
+	// Validate rejected URLs that don't parse
+	u, _ := url.Parse(cfg.VictoriaMetricsURL)
+	u = u.JoinPath(path)
+	u.RawQuery = params.Encode()
+	return u.String()
+}
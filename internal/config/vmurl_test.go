@@ -0,0 +1,78 @@
+package config
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateVMURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"http://192.168.1.10:8428", true},
+		{"https://vm.example.com", true},
+		{"http://victoriametrics:8428/vm", true},
+		{"http://[fd00::10]:8428", true},
+		{"http://[fd00::10]", true},
+		{"http://[fe80::1%25eth0]:8428", true},
+		{"http://fd00::10:8428", false},
+		{"fd00::10", false},
+		{"vm.example.com:8428", false},
+		{"ftp://vm.example.com", false},
+		{"http://", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		err := validateVMURL(tt.url)
+		if (err == nil) != tt.valid {
+			t.Errorf("validateVMURL(%q) = %v, want valid %v", tt.url, err, tt.valid)
+		}
+		if err != nil && !strings.Contains(err.Error(), "IPv6 hosts in brackets") {
+			t.Errorf("validateVMURL(%q) = %v, want the hint on IPv6", tt.url, err)
+		}
+	}
+	if cfg := load(t, "-vm-url", "http://fd00::10:8428"); cfg.Validate() == nil {
+		t.Error("Validate accepted an unbracketed IPv6 VM_URL")
+	}
+}
+
+func TestVictoriaMetricsEndpoint(t *testing.T) {
+	params := url.Values{"query": {`shelly_watts{device_name=~".*"}`}, "time": {"1772395200"}}
+	tests := []struct {
+		base string
+		want string
+	}{
+		{"http://192.168.1.10:8428", "http://192.168.1.10:8428/api/v1/query?"},
+		{"https://vm.example.com/", "https://vm.example.com/api/v1/query?"},
+		{"http://vmauth:8427/select/0/prometheus", "http://vmauth:8427/select/0/prometheus/api/v1/query?"},
+		{"http://[fd00::10]:8428", "http://[fd00::10]:8428/api/v1/query?"},
+		{"http://[fe80::1%25eth0]:8428/", "http://[fe80::1%25eth0]:8428/api/v1/query?"},
+	}
+	for _, tt := range tests {
+		cfg := &Config{VictoriaMetricsURL: tt.base}
+		got := cfg.VictoriaMetricsEndpoint("/api/v1/query", params)
+		if want := tt.want + params.Encode(); got != want {
+			t.Errorf("endpoint of %q = %q, want %q", tt.base, got, want)
+		}
+		// The endpoint parses back with the host of VM_URL
+		u, err := url.Parse(got)
+		base, _ := url.Parse(tt.base)
+		if err != nil || u.Host != base.Host || u.Query().Get("query") != params.Get("query") {
+			t.Errorf("endpoint %q parses to %v, %v", got, u, err)
+		}
+	}
+	cfg := &Config{VictoriaMetricsURL: "http://[fd00::10]:8428"}
+	if got := cfg.VictoriaMetricsEndpoint("/api/v1/import/prometheus", nil); got != "http://[fd00::10]:8428/api/v1/import/prometheus" {
+		t.Errorf("import endpoint = %q", got)
+	}
+}
+
+func TestShellyIPValidation(t *testing.T) {
+	for _, ip := range []string{"192.168.1.42", "192.168.1.42:8080", "fd00::5054", "[fd00::5054]", "[fd00::5054]:8080", "fe80::1%eth0", "[fe80::1%eth0]:80"} {
+		if cfg := load(t, "-shelly-ip", ip); cfg.Validate() != nil {
+			t.Errorf("SHELLY_IP %q: %v", ip, cfg.Validate())
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"context"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics"
+)
+
+// checkAutoOn switches the relay on when the wake condition starts to hold while the relay is off, as
+// the power reading of 0 W shows. Only the start counts, so a printer switched off by hand while the
+// condition still holds stays off. It returns whether the relay was switched on. Errors are logged
+// and never hold up the off path. The caller holds state.mu, which is released for the query.
+func checkAutoOn(ctx context.Context, cfg *config.Config, state *State, watts float64) bool {
+	if !cfg.AutoOn {
+		return false
+	}
+	qctx, cancel := context.WithTimeout(ctx, cfg.QueryTimeout)
+	defer cancel()
+	var wake bool
+	var err error
+	state.unlocked(func() { wake, err = wakeCondition(qctx, cfg, state) })
+	if err != nil {
+		state.logger().Error("Checking the auto power-on condition failed", "error", err)
+		return false
+	}
+	started := wake && !state.AutoOnWake
+	state.AutoOnWake = wake
+	if !started || watts > 0 {
+		return false
+	}
+
+	if !canSwitch(cfg, state) {
+		state.logger().Error("Print job detected while the printer is off, but no Shelly IP is available")
+		return false
+	}
+	state.logger().Info("Print job detected while the printer is off, switching it on", "watts", watts)
+	if err := switchRelay(cfg, state, true, SourceAutoOn); err != nil {
+		state.logger().Error("Auto power-on failed", "action", ActionOn, "error", err)
+		return false
+	}
+	return true
+}
+
+// wakeCondition tells whether AUTO_ON_QUERY has a non-zero series, or the printer state source reports
+// a print without one
+func wakeCondition(ctx context.Context, cfg *config.Config, state *State) (bool, error) {
+	if cfg.AutoOnQuery == "" {
+		return state.Printer.Printing(ctx, state.Clock.Now())
+	}
+	return metrics.AnyNonZero(ctx, state.Metrics, state.Clock.Now(), cfg.AutoOnQuery)
+}
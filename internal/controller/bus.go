@@ -0,0 +1,348 @@
+package controller
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// DefaultBusBuffer is the number of events a subscriber may lag behind before events are dropped
+const DefaultBusBuffer = 128
+
+// Decision outcomes
+const (
+	OutcomeSkip       = "SKIP"        // A gate blocked the auto-off
+	OutcomeStandby    = "STANDBY"     // In standby, the standby clock is running
+	OutcomePendingOff = "PENDING_OFF" // Standby threshold met, waiting for the veto window
+	OutcomeArmed      = "ARMED"       // All gates passed, waiting for a later cycle to pass them again
+	OutcomeTurnOff    = "TURN_OFF"    // The relay is switched off
+)
+
+// Re-verification outcomes of an armed auto-off
+const (
+	RecheckConfirmed = "confirmed" // A later cycle passed every gate again
+	RecheckAborted   = "aborted"   // A later cycle decided otherwise, the auto-off is dropped
+	RecheckExpired   = "expired"   // No cycle re-verified it in time, the auto-off is armed again
+)
+
+// Skip reasons of decisions with OutcomeSkip
+const (
+	ReasonHold            = "hold"
+	ReasonCalendarHold    = "calendar_hold"
+	ReasonAlertPause      = "alert_pause"
+	ReasonMaintenance     = "maintenance"
+	ReasonRecentlyOff     = "recently_off"
+	ReasonBootGrace       = "boot_grace"
+	ReasonPrinting        = "printing"
+	ReasonPrintedRecently = "printed_recently"
+	ReasonPrintingByPower = "printing_by_power"
+	ReasonCalibrating     = "calibrating"
+	ReasonRelayOff        = "relay_off"
+	ReasonOutOfRange      = "out_of_range"
+	ReasonSolarSurplus    = "solar_surplus"
+	ReasonVetoed          = "vetoed"
+	ReasonNotLeader       = "not_leader"
+	ReasonDuplicate       = "duplicate_controller"
+	ReasonUntrusted       = "untrusted_reading"
+	ReasonRateLimited     = "rate_limited"
+	ReasonShortHistory    = "short_history"
+	ReasonPanic           = "panic"
+	ReasonAutoOn          = "auto_on"
+	ReasonInterrupted     = "interrupted"
+)
+
+// SkipReasons lists the skip reasons for metrics
+var SkipReasons = []string{
+	ReasonHold, ReasonCalendarHold, ReasonAlertPause, ReasonMaintenance, ReasonRecentlyOff, ReasonBootGrace,
+	ReasonPrinting, ReasonPrintedRecently, ReasonPrintingByPower, ReasonCalibrating, ReasonRelayOff,
+	ReasonOutOfRange, ReasonSolarSurplus, ReasonVetoed, ReasonNotLeader, ReasonDuplicate, ReasonUntrusted,
+	ReasonRateLimited, ReasonShortHistory, ReasonPanic, ReasonAutoOn, ReasonInterrupted,
+}
+
+// Actions and their sources
+const (
+	ActionOff      = "off"
+	ActionOn       = "on"
+	SourceAuto     = "auto"
+	SourceOvertemp = "overtemperature"
+	SourceQueue    = "bambu queue"
+	SourceAutoOn   = "auto-on"
+	SourceCLI      = "command line"
+)
+
+// BusEvent is implemented by all events published on the event bus
+type BusEvent interface {
+	busEvent()
+}
+
+// CycleCompleted is published after every check cycle
+type CycleCompleted struct {
+	Time     time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// DecisionMade is published for every evaluated cycle
+type DecisionMade struct {
+	Time             time.Time
+	Device           string
+	Outcome          string
+	Reason           string
+	Watts            float64
+	StandbyDuration  time.Duration
+	ProjectedOffTime time.Time // Zero unless an auto-off is projected
+	Announce         bool      // The decision starts a countdown worth announcing
+	Recheck          string    // Re-verification outcome of an armed auto-off decided by this cycle
+}
+
+// ActionExecuted is published when the relay was switched
+type ActionExecuted struct {
+	Time            time.Time
+	Device          string
+	Action          string
+	Source          string
+	Watts           float64
+	StandbyDuration time.Duration
+	DryRun          bool
+	Price           float64 // Electricity price per kWh at the time of an auto-off, 0 if unknown
+}
+
+// ActionFailed is published when switching the relay failed
+type ActionFailed struct {
+	Time            time.Time
+	Device          string
+	Action          string
+	Source          string
+	Err             error
+	Failures        int // Consecutive failures including this one
+	Watts           float64
+	StandbyDuration time.Duration
+}
+
+// ActionVetoed is published when an external hook vetoed a decided action
+type ActionVetoed struct {
+	Time            time.Time
+	Device          string
+	Action          string
+	Source          string
+	Reason          string
+	Watts           float64
+	StandbyDuration time.Duration
+}
+
+// ControlApplied is published when a hold or veto command changed the automation
+type ControlApplied struct {
+	Time    time.Time
+	Device  string
+	Source  string
+	Command string
+	Detail  string
+}
+
+// PowerOnDetected is published when the printer draws power again after being off
+type PowerOnDetected struct {
+	Time   time.Time
+	Device string
+	Watts  float64
+}
+
+// Reasons of LockoutEngaged
+const (
+	LockoutStaleMetrics = "stale metrics"
+	LockoutPrinterAuth  = "printer credentials rejected"
+)
+
+// LockoutEngaged is published when relay control is paused for safety
+type LockoutEngaged struct {
+	Time   time.Time
+	Device string
+	Reason string
+	Watts  float64
+}
+
+// MaintenanceHoldLong is published once per hold when a firmware update or processing state has been
+// blocking the auto-off for longer than expected
+type MaintenanceHoldLong struct {
+	Time   time.Time
+	Device string
+	Metric string
+	Since  time.Time
+}
+
+// OvertemperatureDetected is published once when the Shelly device gets hotter than the warning and
+// once more when it gets hotter than the critical threshold
+type OvertemperatureDetected struct {
+	Time      time.Time
+	Device    string
+	Celsius   float64
+	Threshold float64
+	Critical  bool // The relay is switched off whatever the printer does
+}
+
+// CyclePanicked is published when a check panicked. The check is skipped and the loop goes on.
+type CyclePanicked struct {
+	Time   time.Time
+	Device string
+	Value  string // What was passed to panic
+	Stack  string
+}
+
+// LeadershipChanged is published when this instance became the leader or lost the leadership
+type LeadershipChanged struct {
+	Time     time.Time
+	Identity string
+	Leader   bool
+}
+
+// SummaryReady is published once a day with the counters of the previous day
+type SummaryReady struct {
+	Time   time.Time
+	Device string
+	Stats  DailyStats
+}
+
+// PrintFinished is published once when a printer went from printing or paused to finished
+type PrintFinished struct {
+	Time             time.Time
+	Device           string
+	Printer          string    // Printer label of the state series, may be empty
+	ProjectedOffTime time.Time // When the auto-off follows if the printer stays in standby
+}
+
+// MonthlyReport sums up the auto-offs of a calendar month
+type MonthlyReport struct {
+	Month          string         `json:"month"`   // Like 2026-09
+	Partial        bool           `json:"partial"` // Recording started after the start of the month
+	AutoOffs       int            `json:"auto_offs"`
+	KWhSaved       float64        `json:"kwh_saved"`
+	CostSaved      float64        `json:"cost_saved"`
+	Currency       string         `json:"currency,omitempty"`
+	AvgIdleSeconds int            `json:"avg_idle_seconds"` // Standby time before an auto-off on average
+	Previous       *MonthlyReport `json:"previous,omitempty"`
+}
+
+// MonthlyReportReady is published on the first check of a month with the report of the previous month
+type MonthlyReportReady struct {
+	Time   time.Time
+	Report MonthlyReport
+}
+
+func (CycleCompleted) busEvent()          {}
+func (DecisionMade) busEvent()            {}
+func (ActionExecuted) busEvent()          {}
+func (ActionFailed) busEvent()            {}
+func (ActionVetoed) busEvent()            {}
+func (ControlApplied) busEvent()          {}
+func (PowerOnDetected) busEvent()         {}
+func (LockoutEngaged) busEvent()          {}
+func (MaintenanceHoldLong) busEvent()     {}
+func (OvertemperatureDetected) busEvent() {}
+func (CyclePanicked) busEvent()           {}
+func (LeadershipChanged) busEvent()       {}
+func (SummaryReady) busEvent()            {}
+func (MonthlyReportReady) busEvent()      {}
+func (PrintFinished) busEvent()           {}
+
+// Bus delivers published events to independent subscribers. Publishing never blocks:
+// every subscriber has its own buffered queue and worker, events for a full queue are dropped,
+// and errors or panics of one subscriber don't affect the others.
+type Bus struct {
+	mu   sync.RWMutex
+	subs []*subscription
+	wg   sync.WaitGroup
+}
+
+// subscription is one subscriber with its queue
+type subscription struct {
+	name    string
+	queue   chan BusEvent
+	handler func(BusEvent) error
+
+	mu      sync.Mutex
+	dropped int
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe registers a handler that receives every published event in its own goroutine
+func (b *Bus) Subscribe(name string, buffer int, handler func(BusEvent) error) {
+	sub := &subscription{
+		name:    name,
+		queue:   make(chan BusEvent, buffer),
+		handler: handler,
+	}
+
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for ev := range sub.queue {
+			sub.handle(ev)
+		}
+	}()
+}
+
+// Publish hands the event to every subscriber without waiting for them
+func (b *Bus) Publish(ev BusEvent) {
+	if b == nil {
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, sub := range b.subs {
+		select {
+		case sub.queue <- ev:
+		default:
+			sub.mu.Lock()
+			sub.dropped++
+			dropped := sub.dropped
+			sub.mu.Unlock()
+			// Log the first drop and then every 100th to keep a stuck subscriber from flooding the log
+			if dropped == 1 || dropped%100 == 0 {
+				slog.Warn("Event bus subscriber not keeping up, dropping events", "subscriber", sub.name, "dropped", dropped)
+			}
+		}
+	}
+}
+
+// Close stops accepting events and waits until all queued events were handled
+func (b *Bus) Close() {
+	b.mu.Lock()
+	for _, sub := range b.subs {
+		close(sub.queue)
+	}
+	b.subs = nil
+	b.mu.Unlock()
+
+	b.wg.Wait()
+}
+
+// handle runs the handler, isolating the bus from its errors and panics
+func (s *subscription) handle(ev BusEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Event bus subscriber panicked", "subscriber", s.name, "event", fmt.Sprintf("%T", ev), "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+
+	if err := s.handler(ev); err != nil {
+		slog.Error("Event bus subscriber failed", "subscriber", s.name, "event", fmt.Sprintf("%T", ev), "error", err)
+	}
+}
+
+// String describes the decision for logs and status output
+func (d DecisionMade) String() string {
+	if d.Reason == "" {
+		return d.Outcome
+	}
+	return fmt.Sprintf("%s (%s)", d.Outcome, d.Reason)
+}
@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// collector is a subscriber recording the events it handled
+type collector struct {
+	mu     sync.Mutex
+	events []BusEvent
+}
+
+func (c *collector) Handle(ev BusEvent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, ev)
+	return nil
+}
+
+func (c *collector) received() []BusEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]BusEvent(nil), c.events...)
+}
+
+func TestBusDeliversInOrderToEverySubscriber(t *testing.T) {
+	bus := NewBus()
+	a, b := &collector{}, &collector{}
+	bus.Subscribe("a", 100, a.Handle)
+	bus.Subscribe("b", 100, b.Handle)
+
+	for i := 0; i < 50; i++ {
+		bus.Publish(PowerOnDetected{Watts: float64(i)})
+	}
+	bus.Close()
+
+	for name, c := range map[string]*collector{"a": a, "b": b} {
+		events := c.received()
+		if len(events) != 50 {
+			t.Fatalf("%s received %d events, want 50", name, len(events))
+		}
+		for i, ev := range events {
+			if ev.(PowerOnDetected).Watts != float64(i) {
+				t.Fatalf("%s received event %d out of order: %v", name, i, ev)
+			}
+		}
+	}
+}
+
+func TestBusStuckSubscriberNeverBlocksPublish(t *testing.T) {
+	bus := NewBus()
+	release := make(chan struct{})
+	var stuckHandled atomic.Int32
+	bus.Subscribe("stuck", 4, func(BusEvent) error {
+		<-release
+		stuckHandled.Add(1)
+		return nil
+	})
+	healthy := &collector{}
+	bus.Subscribe("healthy", 1000, healthy.Handle)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			bus.Publish(ActionExecuted{Action: ActionOff})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Publish blocked on a stuck subscriber")
+	}
+
+	close(release)
+	bus.Close()
+	if got := len(healthy.received()); got != 1000 {
+		t.Errorf("healthy subscriber received %d events, want 1000", got)
+	}
+	// One event in the handler and a full queue of 4, the rest was dropped
+	if got := stuckHandled.Load(); got > 5 {
+		t.Errorf("stuck subscriber handled %d events, want at most its queue", got)
+	}
+}
+
+func TestBusIsolatesFailingSubscribers(t *testing.T) {
+	bus := NewBus()
+	bus.Subscribe("panics", 10, func(ev BusEvent) error {
+		panic("subscriber bug")
+	})
+	bus.Subscribe("fails", 10, func(ev BusEvent) error {
+		return errors.New("delivery failed")
+	})
+	healthy := &collector{}
+	bus.Subscribe("healthy", 10, healthy.Handle)
+
+	for i := 0; i < 3; i++ {
+		bus.Publish(CycleCompleted{})
+	}
+	bus.Close()
+	if got := len(healthy.received()); got != 3 {
+		t.Errorf("healthy subscriber received %d events, want 3", got)
+	}
+}
+
+func TestBusConcurrentPublishers(t *testing.T) {
+	bus := NewBus()
+	c := &collector{}
+	bus.Subscribe("collector", 10000, c.Handle)
+
+	var wg sync.WaitGroup
+	for p := 0; p < 8; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				bus.Publish(DecisionMade{Outcome: OutcomeSkip})
+			}
+		}()
+	}
+	// Subscribing while events are published must be safe as well
+	late := &collector{}
+	bus.Subscribe("late", 10000, late.Handle)
+	wg.Wait()
+	bus.Close()
+
+	if got := len(c.received()); got != 8*500 {
+		t.Errorf("received %d events, want %d", got, 8*500)
+	}
+	if got := len(late.received()); got > 8*500 {
+		t.Errorf("late subscriber received %d events, more than were published", got)
+	}
+}
+
+func TestBusCloseWaitsForQueuedEvents(t *testing.T) {
+	bus := NewBus()
+	var handled atomic.Int32
+	bus.Subscribe("slow", 10, func(BusEvent) error {
+		time.Sleep(5 * time.Millisecond)
+		handled.Add(1)
+		return nil
+	})
+	for i := 0; i < 10; i++ {
+		bus.Publish(CycleCompleted{})
+	}
+	bus.Close()
+	if got := handled.Load(); got != 10 {
+		t.Errorf("Close returned after %d of 10 queued events", got)
+	}
+	// Publishing after Close is dropped without a subscriber to deliver to
+	bus.Publish(CycleCompleted{})
+}
+
+func TestNilBusPublishIsANoOp(t *testing.T) {
+	var bus *Bus
+	bus.Publish(CycleCompleted{})
+}
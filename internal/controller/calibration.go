@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// calibrationReading is what the calibration queries of a check found
+type calibrationReading struct {
+	Stage      *float64   // Calibration stage reported by CALIBRATION_STAGE_METRIC, nil if none
+	StageFound bool       // CALIBRATION_STAGE_METRIC has series
+	PowerEnd   *time.Time // End of the latest sustained period above CALIBRATION_POWER_WATTS
+}
+
+// calibrating describes the calibration in progress, empty if there is none. The stage metric decides
+// where it exists, the sustained power above CALIBRATION_POWER_WATTS only without it. The caller holds
+// state.mu.
+func calibrating(cfg *config.Config, state *State, now time.Time, r calibrationReading) string {
+	if cfg.CalibrationStageMetric != "" {
+		if !r.StageFound && !state.CalibrationMissing {
+			state.logger().Warn("Calibration stage metric not found, ignoring it while it is missing", "metric", cfg.CalibrationStageMetric)
+		} else if r.StageFound && state.CalibrationMissing {
+			state.logger().Info("Calibration stage metric found", "metric", cfg.CalibrationStageMetric)
+		}
+		state.CalibrationMissing = !r.StageFound
+
+		if r.Stage != nil {
+			return fmt.Sprintf("%s=%g", cfg.CalibrationStageMetric, *r.Stage)
+		}
+		if r.StageFound {
+			return ""
+		}
+	}
+	// A period still running ends now
+	if r.PowerEnd != nil && !r.PowerEnd.Before(now) {
+		return fmt.Sprintf("power above %.0f W for %s", cfg.CalibrationPowerWatts, cfg.CalibrationPowerDuration)
+	}
+	return ""
+}
@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics/metricstest"
+)
+
+// bambuStages are the stage IDs of stg_cur, as bambulab_current_stage reports them, and whether the
+// default CALIBRATION_STAGES treat them as a calibration
+var bambuStages = []struct {
+	id          float64
+	name        string
+	calibration bool
+}{
+	{-1, "idle", false},
+	{0, "printing", false},
+	{1, "auto bed leveling", true},
+	{2, "heatbed preheating", false},
+	{3, "vibration compensation", true},
+	{4, "changing filament", false},
+	{5, "M400 pause", false},
+	{6, "paused, filament runout", false},
+	{7, "heating hotend", false},
+	{8, "calibrating extrusion", true},
+	{9, "scanning bed surface", false},
+	{10, "inspecting first layer", false},
+	{11, "identifying build plate", false},
+	{12, "calibrating micro lidar", true},
+	{13, "homing toolhead", false},
+	{14, "cleaning nozzle tip", false},
+	{15, "checking extruder temperature", false},
+	{16, "paused by the user", false},
+	{17, "paused, front cover falling", false},
+	{18, "calibrating the micro lidar", true},
+	{19, "calibrating extrusion flow", true},
+	{20, "paused, nozzle temperature malfunction", false},
+	{21, "paused, heatbed temperature malfunction", false},
+	{22, "unloading filament", false},
+	{23, "paused, skipped step", false},
+	{24, "loading filament", false},
+	{25, "calibrating motor noise", true},
+	{26, "paused, AMS lost", false},
+	{29, "cooling chamber", false},
+	{35, "paused, nozzle clog", false},
+	{255, "idle", false},
+}
+
+// stageSeries is bambulab_current_stage of the printer at the stage for the last 10 minutes
+func stageSeries(now time.Time, stage float64) metricstest.Series {
+	return metricstest.Series{
+		Labels:  map[string]string{"__name__": "bambulab_current_stage", "printer": "x1c"},
+		Samples: metricstest.Constant(now.Add(-10*time.Minute), now, 30*time.Second, stage),
+	}
+}
+
+// calibration sets the default CALIBRATION_* settings
+func calibration() func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.CalibrationStageMetric = "bambulab_current_stage"
+		cfg.CalibrationStages = "1,3,8,12,18,19,25"
+		cfg.CalibrationPowerDuration = time.Minute
+	}
+}
+
+func TestCalibrationStages(t *testing.T) {
+	for _, stage := range bambuStages {
+		t.Run(fmt.Sprintf("%g %s", stage.id, stage.name), func(t *testing.T) {
+			cfg, state, b := newIntegration(t, clock.Real{}, calibration())
+			now := time.Now()
+			b.setHistory(now, phase{length: time.Hour, watts: 8})
+			b.vm.Add(stageSeries(now, stage.id).Labels, stageSeries(now, stage.id).Samples...)
+
+			RunCycle(context.Background(), cfg, state)
+			if stage.calibration {
+				expectDecision(t, state, "calibration stage", OutcomeSkip, ReasonCalibrating)
+				if want := fmt.Sprintf("Printer is calibrating (bambulab_current_stage=%g), no action taken", stage.id); state.LastEvaluation.Detail != want {
+					t.Errorf("detail = %q, want %q", state.LastEvaluation.Detail, want)
+				}
+			} else {
+				expectDecision(t, state, "other stage", OutcomeTurnOff, "")
+			}
+		})
+	}
+}
+
+func TestCalibrationReading(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		set     func(cfg *config.Config)
+		stage   *float64 // Stage reported now, nil without the metric
+		history []phase
+		want    string
+	}{
+		{"configured stages", func(cfg *config.Config) { cfg.CalibrationStages = "9, 10" }, ptr(9.0), nil, "bambulab_current_stage=9"},
+		{"default stage not configured", func(cfg *config.Config) { cfg.CalibrationStages = "9,10" }, ptr(1.0), nil, ""},
+		{"other metric", func(cfg *config.Config) { cfg.CalibrationStageMetric, cfg.CalibrationStages = "printer_stage", "4" }, ptr(4.0), nil, "printer_stage=4"},
+		// Some routines draw less than a print, so the power heuristic has its own threshold
+		{"sustained power without the metric", func(cfg *config.Config) { cfg.CalibrationPowerWatts = 40 }, nil, []phase{{length: time.Hour, watts: 8}, {length: 2 * time.Minute, watts: 45}}, "power above 40 W for 1m0s"},
+		{"short spike without the metric", func(cfg *config.Config) { cfg.CalibrationPowerWatts = 40 }, nil, []phase{{length: time.Hour, watts: 8}, {length: 30 * time.Second, watts: 45}}, ""},
+		{"power ended", func(cfg *config.Config) { cfg.CalibrationPowerWatts = 40 }, nil, []phase{{length: time.Hour, watts: 8}, {length: 5 * time.Minute, watts: 45}, {length: 2 * time.Minute, watts: 8}}, ""},
+		// Where the metric exists it decides, the power doesn't
+		{"stage metric over power", func(cfg *config.Config) { cfg.CalibrationPowerWatts = 40 }, ptr(255.0), []phase{{length: time.Hour, watts: 8}, {length: 2 * time.Minute, watts: 45}}, ""},
+		{"power heuristic off", func(cfg *config.Config) {}, nil, []phase{{length: time.Hour, watts: 8}, {length: 2 * time.Minute, watts: 45}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, state, b := newIntegration(t, clock.Real{}, calibration(), tt.set)
+			now := time.Now().Truncate(time.Second)
+			history := tt.history
+			if history == nil {
+				history = []phase{{length: time.Hour, watts: 8}}
+			}
+			b.setHistory(now, history...)
+			if tt.stage != nil {
+				series := stageSeries(now, *tt.stage)
+				series.Labels["__name__"] = cfg.CalibrationStageMetric
+				b.vm.Add(series.Labels, series.Samples...)
+			}
+
+			state.mu.Lock()
+			in, err := gatherInputs(ctx, cfg, state, history[len(history)-1].watts, true)
+			state.mu.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if in.Calibrating != tt.want {
+				t.Errorf("calibrating = %q, want %q", in.Calibrating, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalibrationStagesValidation(t *testing.T) {
+	for _, tt := range []struct {
+		stages string
+		valid  bool
+	}{{"1,3,8,12,18,19,25", true}, {" 9 , 10 ", true}, {"", true}, {"1,,3", true}, {"1,lidar", false}, {"1;3", false}} {
+		cfg := loadConfig(t, "-vm-password", "secret", "-calibration-stages", tt.stages)
+		if err := cfg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("CALIBRATION_STAGES %q: Validate() = %v, want valid %v", tt.stages, err, tt.valid)
+		}
+	}
+}
+
+// ptr returns a pointer to v
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,385 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/calendar"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/leader"
+	"gome-assistant/internal/metrics"
+	"gome-assistant/internal/printer"
+	"gome-assistant/internal/version"
+)
+
+// ErrNoShellyIP is returned by manual commands before the Shelly IP was discovered
+var ErrNoShellyIP = errors.New("no Shelly IP available")
+
+// ErrPrinting is returned by ManualSwitch when switching off during a print without force
+var ErrPrinting = errors.New("a print is in progress")
+
+// ErrNotLeader is returned by manual commands on an instance that is not the elected leader
+var ErrNotLeader = errors.New("not the leader, relay control is done by another instance")
+
+// Status is a snapshot of the assistant state for status queries
+type Status struct {
+	Time           time.Time              `json:"time"`
+	Instance       string                 `json:"instance"`
+	Build          version.Info           `json:"build"`
+	Device         string                 `json:"device,omitempty"`
+	ShellyIP       string                 `json:"shelly_ip,omitempty"`
+	Watts          *float64               `json:"watts,omitempty"`
+	DryRun         bool                   `json:"dry_run"`
+	DryRunDiff     *DryRunDiff            `json:"dry_run_diff,omitempty"`
+	LastCycle      *time.Time             `json:"last_cycle,omitempty"`
+	LastCycleError string                 `json:"last_cycle_error,omitempty"`
+	Interval       int                    `json:"check_interval_seconds"`
+	Backoff        bool                   `json:"outage_backoff"`
+	LastRelayOff   *time.Time             `json:"last_relay_off,omitempty"`
+	RelayFailures  int                    `json:"relay_failures"`
+	Untrusted      int                    `json:"untrusted_readings"`
+	RateLimited    int                    `json:"actuations_blocked"`
+	SkippedCycles  int                    `json:"skipped_cycles"`
+	ShortHistory   *int                   `json:"short_history_seconds,omitempty"`
+	Price          *float64               `json:"price,omitempty"`
+	PeakPrice      bool                   `json:"peak_price"`
+	LockoutActive  bool                   `json:"lockout_active"`
+	HoldUntil      *time.Time             `json:"hold_until,omitempty"`
+	PendingOffAt   *time.Time             `json:"pending_off_at,omitempty"`
+	ArmedSince     *time.Time             `json:"armed_since,omitempty"`
+	ArmedExpires   *time.Time             `json:"armed_expires,omitempty"`
+	LastRecheck    string                 `json:"last_recheck,omitempty"`
+	AlertPause     *AlertPause            `json:"alert_pause,omitempty"`
+	CalendarHold   *calendar.Hold         `json:"calendar_hold,omitempty"`
+	AutoOffAt      *time.Time             `json:"auto_off_at,omitempty"`
+	MetricsBackend *metrics.BreakerStatus `json:"metrics_backend,omitempty"`
+	Leadership     *leader.Status         `json:"leadership,omitempty"`
+	Printer        *printer.BambuReport   `json:"printer,omitempty"`
+	Memory         []MemoryUsage          `json:"memory,omitempty"`
+}
+
+// GetStatus returns a snapshot of the current state
+func GetStatus(cfg *config.Config, state *State) Status {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	now := state.Clock.Now()
+	status := Status{
+		Time:           now,
+		Instance:       cfg.InstanceName(),
+		Build:          version.Get(),
+		Device:         state.DeviceName,
+		ShellyIP:       state.ShellyIP,
+		Watts:          state.LastWatts,
+		DryRun:         cfg.DryRun,
+		LastCycle:      state.LastCycleTime,
+		LastCycleError: state.LastCycleError,
+		Interval:       int(effectiveInterval(cfg, state).Seconds()),
+		Backoff:        effectiveInterval(cfg, state) != cfg.CheckInterval,
+		LastRelayOff:   state.LastRelayOffTime,
+		RelayFailures:  state.RelayFailures,
+		Untrusted:      state.UntrustedReadings,
+		RateLimited:    state.ActuationsBlocked,
+		SkippedCycles:  state.SkippedCycles,
+		LockoutActive:  state.LockoutActive,
+		LastRecheck:    state.LastRecheck,
+	}
+	if state.HistoryShort != nil {
+		covered := int(state.HistoryShort.Seconds())
+		status.ShortHistory = &covered
+	}
+	if cfg.DryRun {
+		diff := state.DryRunDiff
+		diff.Pending = len(state.DryRunWatches)
+		diff.Disagreements = slices.Clone(diff.Disagreements)
+		status.DryRunDiff = &diff
+	}
+	if state.HoldUntil != nil && now.Before(*state.HoldUntil) {
+		status.HoldUntil = state.HoldUntil
+	}
+	if state.PendingOffSince != nil {
+		at := state.PendingOffSince.Add(cfg.VetoWindow)
+		status.PendingOffAt = &at
+	}
+	if state.ArmedSince != nil {
+		expires := armedExpiry(cfg, *state.ArmedSince)
+		status.ArmedSince = state.ArmedSince
+		status.ArmedExpires = &expires
+	}
+	if price, ok := state.Prices.At(now); ok {
+		status.Price = &price
+		status.PeakPrice = cfg.PeakPrice > 0 && price > cfg.PeakPrice
+	}
+	status.AlertPause = activeAlertPause(state, now)
+	status.CalendarHold = state.Calendar.Active(now)
+	status.AutoOffAt = projectCountdown(cfg, state, now).OffAt
+	status.Leadership = state.Leader.Status()
+	if bambu, ok := state.Printer.(*printer.BambuMQTT); ok {
+		status.Printer = bambu.Report()
+	}
+	if breaker, ok := state.Metrics.(*metrics.Breaker); ok {
+		breakerStatus := breaker.Status()
+		status.MetricsBackend = &breakerStatus
+	}
+	for _, store := range state.Stores {
+		status.Memory = append(status.Memory, store.Usage())
+	}
+	return status
+}
+
+// String formats the status as human-readable text
+func (s Status) String() string {
+	var b strings.Builder
+	device := s.Device
+	if device == "" {
+		device = "unknown device"
+	}
+	fmt.Fprintf(&b, "Status of %s on %s\n", device, s.Instance)
+	if s.Watts != nil {
+		fmt.Fprintf(&b, "Power: %.1f W\n", *s.Watts)
+	}
+	if s.Printer != nil {
+		fmt.Fprintf(&b, "Printer: %s, nozzle %.0f°C, bed %.0f°C\n", s.Printer.GcodeState, s.Printer.NozzleTemp, s.Printer.BedTemp)
+	}
+	if s.Price != nil {
+		fmt.Fprintf(&b, "Electricity price: %.4f/kWh", *s.Price)
+		if s.PeakPrice {
+			b.WriteString(" (peak, shorter standby)")
+		}
+		b.WriteString("\n")
+	}
+	if s.LastCycle != nil {
+		fmt.Fprintf(&b, "Last check: %s ago", s.Time.Sub(*s.LastCycle).Round(time.Second))
+		if s.LastCycleError != "" {
+			fmt.Fprintf(&b, " (error: %s)", s.LastCycleError)
+		}
+		b.WriteString("\n")
+	}
+	if s.Backoff {
+		fmt.Fprintf(&b, "Checks failing, check interval stretched to %s\n", time.Duration(s.Interval)*time.Second)
+	}
+	if s.LastRelayOff != nil {
+		fmt.Fprintf(&b, "Last auto-off: %s\n", s.LastRelayOff.Format("2006-01-02 15:04"))
+	}
+	if s.HoldUntil != nil {
+		fmt.Fprintf(&b, "Hold active until %s\n", s.HoldUntil.Format("2006-01-02 15:04"))
+	}
+	if s.PendingOffAt != nil {
+		fmt.Fprintf(&b, "Auto-off pending at %s\n", s.PendingOffAt.Format("15:04:05"))
+	} else if s.AutoOffAt != nil {
+		fmt.Fprintf(&b, "Auto-off projected at %s\n", s.AutoOffAt.Format("15:04"))
+	}
+	if s.ArmedSince != nil {
+		fmt.Fprintf(&b, "Auto-off armed since %s, re-verification due by %s\n", s.ArmedSince.Format("15:04:05"), s.ArmedExpires.Format("15:04:05"))
+	}
+	if s.LastRecheck != "" {
+		fmt.Fprintf(&b, "Last re-verification: %s\n", s.LastRecheck)
+	}
+	if s.CalendarHold != nil {
+		fmt.Fprintf(&b, "Calendar hold %q until %s\n", s.CalendarHold.Summary, s.CalendarHold.End.Format("2006-01-02 15:04"))
+	}
+	if s.AlertPause != nil {
+		fmt.Fprintf(&b, "Paused by alert %s since %s\n", s.AlertPause.AlertName, s.AlertPause.Since.Format("15:04"))
+	}
+	if s.MetricsBackend != nil && s.MetricsBackend.OpenSince != nil {
+		fmt.Fprintf(&b, "Metrics backend unavailable, circuit %s since %s\n", s.MetricsBackend.State, s.MetricsBackend.OpenSince.Format("15:04"))
+	}
+	if s.Leadership != nil && !s.Leadership.Leader {
+		fmt.Fprintf(&b, "Following as %s, relay control by another instance\n", s.Leadership.Identity)
+	}
+	if s.LockoutActive {
+		b.WriteString("Relay control locked out (stale metrics)\n")
+	}
+	if s.RelayFailures > 0 {
+		fmt.Fprintf(&b, "Consecutive relay failures: %d\n", s.RelayFailures)
+	}
+	if s.Untrusted > 0 {
+		fmt.Fprintf(&b, "Untrusted power readings: %d\n", s.Untrusted)
+	}
+	if s.ShortHistory != nil {
+		fmt.Fprintf(&b, "Power history shorter than the lookbacks: %s\n", time.Duration(*s.ShortHistory)*time.Second)
+	}
+	if s.RateLimited > 0 {
+		fmt.Fprintf(&b, "Relay commands blocked by the rate limit: %d\n", s.RateLimited)
+	}
+	if s.DryRun {
+		b.WriteString("Dry run mode\n")
+	}
+	if d := s.DryRunDiff; d != nil && d.WouldOffs+len(d.Disagreements) > 0 {
+		fmt.Fprintf(&b, "Dry run against the relay: %d would-be auto-offs, %d executed by someone else, %d pending, %d disagreements\n",
+			d.WouldOffs, d.ExternalOffs, d.Pending, len(d.Disagreements))
+		for _, dis := range d.Disagreements {
+			fmt.Fprintf(&b, "- %s: %s\n", dis.Time.Format("2006-01-02 15:04"), dis.Detail)
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// armedExpiry is when an auto-off armed at since is no longer re-verified but armed again. It leaves
+// two check intervals after the re-check delay for the verifying cycle to run.
+func armedExpiry(cfg *config.Config, since time.Time) time.Time {
+	return since.Add(cfg.OffRecheckDelay + 2*cfg.CheckInterval)
+}
+
+// SetHold suspends automatic switching for the given duration; a zero duration clears the hold
+func SetHold(state *State, d time.Duration, source string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	now := state.Clock.Now()
+	state.commands++
+	if d <= 0 {
+		state.HoldUntil = nil
+		state.logger().Info("Manual hold cleared", "source", source)
+		state.Bus.Publish(ControlApplied{Time: now, Device: state.DeviceName, Source: source, Command: "hold_clear"})
+		return
+	}
+
+	until := now.Add(d)
+	state.HoldUntil = &until
+	state.PendingOffSince = nil
+	state.ArmedSince = nil
+	state.logger().Info("Manual hold set", "source", source, "until", until.Format(time.RFC3339))
+	state.Bus.Publish(ControlApplied{Time: now, Device: state.DeviceName, Source: source, Command: "hold", Detail: "until " + until.Format(time.RFC3339)})
+}
+
+// VetoPendingOff cancels an auto-off that is waiting in its veto window or armed for re-verification.
+// The standby clock restarts, so a full StandbyDuration has to pass before the next auto-off.
+func VetoPendingOff(state *State, source string) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.PendingOffSince == nil && state.ArmedSince == nil {
+		return fmt.Errorf("no auto-off is pending")
+	}
+
+	now := state.Clock.Now()
+	state.commands++
+	state.PendingOffSince = nil
+	state.ArmedSince = nil
+	state.VetoTime = &now
+	state.logger().Info("Pending auto-off vetoed", "source", source)
+	state.Bus.Publish(ControlApplied{Time: now, Device: state.DeviceName, Source: source, Command: "veto"})
+	return nil
+}
+
+// SwitchRelay switches the relay on request of source, bypassing the standby logic
+func SwitchRelay(cfg *config.Config, state *State, on bool, source string) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return switchRelay(cfg, state, on, source)
+}
+
+// switchRelay is SwitchRelay for callers holding state.mu
+func switchRelay(cfg *config.Config, state *State, on bool, source string) error {
+	if !state.Leader.IsLeader() {
+		return ErrNotLeader
+	}
+	if !canSwitch(cfg, state) {
+		return ErrNoShellyIP
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.QueryTimeout)
+	defer cancel()
+	if err := checkDuplicateController(ctx, cfg, state); err != nil {
+		return err
+	}
+
+	action := ActionOff
+	if on {
+		action = ActionOn
+	}
+
+	now := state.Clock.Now()
+	if err := actuate(cfg, state, on, source, false); err != nil {
+		if errors.Is(err, ErrRateLimited) {
+			return err
+		}
+		state.logger().Error("Switching the relay failed", "action", action, "source", source, "error", err)
+		state.Bus.Publish(ActionFailed{Time: now, Device: state.DeviceName, Action: action, Source: source, Err: err})
+		return err
+	}
+	state.logger().Info("Relay switched", "action", action, "source", source, "result", confirmedState(cfg, on))
+	state.commands++
+	if !on {
+		state.LastRelayOffTime = &now
+		state.PendingOffSince = nil
+		state.ArmedSince = nil
+	}
+	state.Bus.Publish(ActionExecuted{Time: now, Device: state.DeviceName, Action: action, Source: source, DryRun: cfg.DryRun})
+	return nil
+}
+
+// RequestSwitch handles a switch command of an integration such as a Home Assistant switch.
+// Switching on while an auto-off is pending or armed vetoes the auto-off, as the relay is still on.
+func RequestSwitch(cfg *config.Config, state *State, on bool, source string) error {
+	if on {
+		state.mu.Lock()
+		pending := state.PendingOffSince != nil || state.ArmedSince != nil
+		state.mu.Unlock()
+		if pending {
+			return VetoPendingOff(state, source)
+		}
+	}
+	return SwitchRelay(cfg, state, on, source)
+}
+
+// PowerOnForQueuedJob switches the relay on for a print job waiting in the printer queue and holds the
+// automation for BootGracePeriod plus BambuQueueBuffer, so the printer stays on until the job starts.
+// A printer drawing power already isn't switched, only held. The job title may be empty.
+func PowerOnForQueuedJob(cfg *config.Config, state *State, job, source string) error {
+	state.mu.Lock()
+	lastWatts := state.LastWatts
+	if lastWatts != nil {
+		state.Bus.Publish(ControlApplied{Time: state.Clock.Now(), Device: state.DeviceName, Source: source, Command: "print_queued", Detail: job})
+	}
+	state.mu.Unlock()
+	// Without a reading the relay state is unknown, and so is the Shelly IP
+	if lastWatts == nil {
+		return ErrNoShellyIP
+	}
+	// An idle printer that is already on could otherwise be switched off before the job starts
+	if *lastWatts > 0 {
+		state.logger().Info("Print job queued, the printer is already on", "job", jobName(job))
+	} else {
+		state.logger().Info("Print job queued, switching the printer on", "job", jobName(job))
+		if err := SwitchRelay(cfg, state, true, source); err != nil {
+			return err
+		}
+	}
+	SetHold(state, cfg.BootGracePeriod+cfg.BambuQueueBuffer, source)
+	return nil
+}
+
+// MarkPrintFinished starts the post-print cooldown now instead of once the printer state shows the end
+// of the print, and announces the finish with the expected auto-off
+func MarkPrintFinished(cfg *config.Config, state *State, job, source string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	now := state.Clock.Now()
+	state.commands++
+	state.PrintFinishedAt = &now
+	off := projectedOffAfterPrint(cfg, state, now)
+	state.logger().Info("Print job finished", "job", jobName(job), "source", source, "off_expected", off.Format("15:04:05"))
+	state.Bus.Publish(ControlApplied{Time: now, Device: state.DeviceName, Source: source, Command: "print_finished", Detail: job})
+	state.Bus.Publish(PrintFinished{Time: now, Device: state.DeviceName, ProjectedOffTime: off})
+}
+
+// jobName names a print job for logs
+func jobName(job string) string {
+	if job == "" {
+		return "A print job"
+	}
+	return fmt.Sprintf("Print job %q", job)
+}
+
+// Device returns the name of the controlled device, empty until the first reading
+func (s *State) Device() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.DeviceName
+}
@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"strings"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// Countdown is the projected auto-off as returned by GET /countdown
+type Countdown struct {
+	SecondsRemaining *int       `json:"seconds_remaining"`
+	OffAt            *time.Time `json:"off_at,omitempty"`
+	Reason           string     `json:"reason"` // standby, pending_off or armed while counting down, otherwise why no auto-off is projected
+}
+
+// projectCountdown projects the auto-off from the last decision and the commands applied since.
+// The caller holds state.mu.
+func projectCountdown(cfg *config.Config, state *State, now time.Time) Countdown {
+	none := func(reason string) Countdown {
+		return Countdown{Reason: reason}
+	}
+
+	d := state.LastDecision
+	switch {
+	case d == nil:
+		return none("no_decision")
+	case state.LastCycleError != "":
+		return none("error")
+	case now.Sub(d.Time) > 2*cfg.CheckInterval:
+		return none("stale")
+	}
+
+	// Commands since the last cycle change what the next cycle will do
+	if state.HoldUntil != nil && now.Before(*state.HoldUntil) {
+		return none(ReasonHold)
+	}
+	if state.Calendar.Active(now) != nil {
+		return none(ReasonCalendarHold)
+	}
+	if activeAlertPause(state, now) != nil {
+		return none(ReasonAlertPause)
+	}
+	if state.LastRelayOffTime != nil && state.LastRelayOffTime.After(d.Time) {
+		return none(ReasonRecentlyOff)
+	}
+
+	var offAt time.Time
+	switch d.Outcome {
+	case OutcomeStandby, OutcomePendingOff, OutcomeArmed:
+		offAt = d.ProjectedOffTime
+		// After a veto the standby clock starts over
+		if state.VetoTime != nil && state.VetoTime.After(d.Time) {
+			offAt = state.VetoTime.Add(standbyThreshold(cfg, state, now) + cfg.OffDelay())
+		}
+	case OutcomeSkip:
+		return none(d.Reason)
+	default:
+		return none(strings.ToLower(d.Outcome))
+	}
+
+	seconds := max(0, int(offAt.Sub(now).Seconds()))
+	return Countdown{SecondsRemaining: &seconds, OffAt: &offAt, Reason: strings.ToLower(d.Outcome)}
+}
+
+// GetCountdown projects the auto-off under the state lock
+func GetCountdown(cfg *config.Config, state *State) Countdown {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return projectCountdown(cfg, state, state.Clock.Now())
+}
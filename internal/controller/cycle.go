@@ -0,0 +1,588 @@
+// Package controller decides when to switch the printer off and owns the shared state,
+// the event bus and the control commands
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics"
+	"gome-assistant/internal/printer"
+)
+
+// RunCycle performs one check, publishes the heartbeat for it and returns the delay until the next check
+func RunCycle(ctx context.Context, cfg *config.Config, state *State) time.Duration {
+	next, _ := runCycle(ctx, cfg, state)
+	return next
+}
+
+// RunOnce performs a single check like RunCycle for -once, logging and returning why it failed
+func RunOnce(ctx context.Context, cfg *config.Config, state *State) error {
+	_, err := runCycle(ctx, cfg, state)
+	if err != nil {
+		state.logger().Error("Check failed", "error", err)
+	}
+	return err
+}
+
+func runCycle(ctx context.Context, cfg *config.Config, state *State) (time.Duration, error) {
+	state.cycle.Lock()
+	defer state.cycle.Unlock()
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	start := state.Clock.Now()
+	rollDailyStats(state, start)
+
+	err := checkSafely(ctx, cfg, state)
+	state.Daily.Cycles++
+	now := state.Clock.Now()
+	state.LastCycleTime = &now
+	state.LastCycleError = ""
+	if err != nil {
+		state.Daily.Errors++
+		state.LastCycleError = err.Error()
+	}
+
+	if cfg.StateFile != "" {
+		saveState(cfg, state, now)
+	}
+	if state.Heartbeat != nil {
+		state.Heartbeat.record(state, err)
+	} else {
+		state.unlocked(func() { publishHeartbeat(cfg, now, err != nil) })
+	}
+	// Followers of leader election don't control the device, their heartbeats would block the leader
+	if cfg.DuplicateGuard && state.DeviceName != "" && state.Leader.IsLeader() {
+		device := state.DeviceName
+		var pushErr error
+		state.unlocked(func() { pushErr = pushControllerHeartbeat(cfg, device, now) })
+		if pushErr != nil {
+			state.logger().Error("Controller heartbeat push failed", "error", pushErr)
+		}
+	}
+	state.Bus.Publish(CycleCompleted{Time: now, Duration: now.Sub(start), Err: err})
+	// The single check of -once has no next one to schedule
+	if cfg.Once {
+		return 0, err
+	}
+	return overrunDelay(cfg, state, now.Sub(start), nextCheckDelay(cfg, state, err)), err
+}
+
+// overrunDelay handles a cycle that took at least the check interval, so checks fell due while it ran,
+// and returns the delay until the next check. The next check always waits for the cycle, so cycles never
+// overlap: with CYCLE_OVERRUN=skip the missed checks are counted and dropped and next is kept, with queue
+// one check runs right away, never more. The caller holds state.mu.
+func overrunDelay(cfg *config.Config, state *State, took, next time.Duration) time.Duration {
+	interval := effectiveInterval(cfg, state)
+	if took < interval {
+		return next
+	}
+	if cfg.CycleOverrun == config.CycleOverrunQueue {
+		state.logger().Warn("Check cycle took longer than the check interval, running the next check right away", "took", took.Round(time.Millisecond), "interval", interval)
+		return 0
+	}
+	missed := int(took / interval)
+	state.SkippedCycles += missed
+	state.logger().Warn("Check cycle took longer than the check interval, skipping the missed checks", "took", took.Round(time.Millisecond), "interval", interval, "skipped", missed, "skipped_total", state.SkippedCycles)
+	return next
+}
+
+// checkSafely runs checkAndControl and turns a panic into a failed check with a skip decision, so a bug
+// neither kills the process nor loses the state. The caller holds state.mu.
+func checkSafely(ctx context.Context, cfg *config.Config, state *State) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		now := state.Clock.Now()
+		stack := string(debug.Stack())
+		state.logger().Error("Check panicked, skipping it", "panic", r, "stack", stack)
+		d := DecisionMade{Time: now, Device: state.DeviceName, Outcome: OutcomeSkip, Reason: ReasonPanic}
+		if state.LastWatts != nil {
+			d.Watts = *state.LastWatts
+		}
+		state.LastDecision = &d
+		state.Bus.Publish(d)
+		state.Bus.Publish(CyclePanicked{Time: now, Device: state.DeviceName, Value: fmt.Sprint(r), Stack: stack})
+		err = fmt.Errorf("check panicked: %v", r)
+	}()
+	return checkAndControl(ctx, cfg, state)
+}
+
+// nextCheckDelay retries a failed check after RetryDelay, so a momentary metrics hiccup doesn't postpone
+// the auto-off by a whole interval. After RetryMax fast retries in a row the checks fall back to the
+// check interval until one succeeds, and once they failed for OutageBackoffAfter the interval doubles
+// with every failed check up to OutageMaxInterval. The caller holds state.mu.
+func nextCheckDelay(cfg *config.Config, state *State, err error) time.Duration {
+	now := state.Clock.Now()
+	if err == nil {
+		if state.FastRetries > 0 {
+			state.logger().Info("Check succeeded, leaving fast retry mode")
+			state.FastRetries = 0
+		}
+		state.FailingSince = nil
+		setInterval(cfg, state, cfg.CheckInterval)
+		return cfg.CheckInterval
+	}
+
+	if state.FailingSince == nil {
+		state.FailingSince = &now
+	}
+	if cfg.OutageMaxInterval > cfg.CheckInterval && now.Sub(*state.FailingSince) >= cfg.OutageBackoffAfter {
+		setInterval(cfg, state, min(2*effectiveInterval(cfg, state), cfg.OutageMaxInterval))
+		return state.Interval
+	}
+
+	if cfg.RetryDelay <= 0 || cfg.RetryMax == 0 || state.FastRetries > cfg.RetryMax {
+		return cfg.CheckInterval
+	}
+	if state.FastRetries == cfg.RetryMax {
+		state.logger().Warn("Check still failing after the fast retries, retrying at the check interval", "retries", cfg.RetryMax, "interval", cfg.CheckInterval)
+		state.FastRetries++
+		return cfg.CheckInterval
+	}
+	if state.FastRetries == 0 {
+		state.logger().Warn("Check failed, entering fast retry mode", "retry_in", cfg.RetryDelay)
+	}
+	state.FastRetries++
+	return cfg.RetryDelay
+}
+
+// setInterval changes the check interval in effect and logs the change. The caller holds state.mu.
+func setInterval(cfg *config.Config, state *State, interval time.Duration) {
+	previous := effectiveInterval(cfg, state)
+	state.Interval = interval
+	switch {
+	case interval == previous:
+	case interval == cfg.CheckInterval:
+		state.logger().Info("Check succeeded, back to the check interval", "interval", interval)
+	default:
+		state.logger().Warn("Checks keep failing, stretching the check interval", "failing_since", state.FailingSince.Format("15:04:05"), "interval", interval)
+	}
+}
+
+// effectiveInterval is the check interval in effect, CheckInterval unless stretched by an outage.
+// The caller holds state.mu.
+func effectiveInterval(cfg *config.Config, state *State) time.Duration {
+	if state.Interval == 0 {
+		return cfg.CheckInterval
+	}
+	return state.Interval
+}
+
+// rollDailyStats publishes the daily summary once the day of the collected stats has passed
+func rollDailyStats(state *State, now time.Time) {
+	day := now.Format("2006-01-02")
+	if state.Daily.Date == day {
+		return
+	}
+
+	if state.Daily.Date != "" {
+		state.Bus.Publish(SummaryReady{Time: now, Device: state.DeviceName, Stats: state.Daily})
+	}
+	state.Daily = DailyStats{Date: day}
+}
+
+// checkAndControl evaluates the printer state and switches the relay if needed.
+// It returns an error when the cycle could not be evaluated or the relay command failed. The caller
+// holds state.mu, which is released for the network requests.
+func checkAndControl(ctx context.Context, cfg *config.Config, state *State) error {
+	state.logger().Debug("Checking printer and power status")
+
+	// Get current shelly power consumption
+	var reading *metrics.ShellyReading
+	var err error
+	state.unlocked(func() {
+		reading, err = metrics.ShellyBambuWatts(ctx, state.Metrics, state.Clock.Now(), metrics.ConfigDevice(cfg), cfg.MaxMetricsAge())
+	})
+	if err != nil {
+		state.logger().Error("Getting the Shelly power failed", "error", err)
+		return err
+	}
+	watts := reading.Watts
+	resolveDevice(ctx, cfg, state, reading)
+	if missing := reading.DeviceName == ""; missing != state.NameLabelMissing {
+		state.NameLabelMissing = missing
+		if missing {
+			state.logger().Warn("No power series has the name label, check SHELLY_NAME_LABEL", "label", cfg.ShellyNameLabel)
+		} else {
+			state.logger().Info("Power series have the name label again", "label", cfg.ShellyNameLabel)
+		}
+	}
+
+	if cfg.DryRun {
+		trackDryRun(cfg, state, state.Clock.Now(), watts)
+	}
+
+	// Report when the printer got powered on since the last cycle
+	if state.LastWatts != nil && *state.LastWatts == 0 && watts > 0 {
+		state.Bus.Publish(PowerOnDetected{Time: state.Clock.Now(), Device: state.DeviceName, Watts: watts})
+	}
+	state.LastWatts = &watts
+
+	// Safety check: Ensure we have metrics availability
+	var hasRecentMetrics bool
+	state.unlocked(func() {
+		hasRecentMetrics, err = metrics.HasRecentShellyMetrics(ctx, state.Metrics, state.Clock.Now(), metrics.ConfigDevice(cfg), cfg.MaxMetricsAge())
+	})
+	if err != nil || !hasRecentMetrics {
+		state.logger().Warn("No recent Shelly metrics found, skipping relay control for safety", "watts", watts)
+		if !state.LockoutActive {
+			state.LockoutActive = true
+			state.Bus.Publish(LockoutEngaged{Time: state.Clock.Now(), Device: state.DeviceName, Reason: LockoutStaleMetrics, Watts: watts})
+		}
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("no recent shelly metrics")
+	}
+	state.LockoutActive = false
+	checkHistory(ctx, cfg, state)
+
+	// decide publishes the decision of this cycle
+	decide := func(d DecisionMade) {
+		d.Time = state.Clock.Now()
+		d.Device = state.DeviceName
+		d.Watts = watts
+		if state.ArmedSince != nil && d.Outcome != OutcomeArmed && d.Outcome != OutcomeTurnOff {
+			d.Recheck = RecheckAborted
+		}
+		state.LastDecision = &d
+		state.Bus.Publish(d)
+	}
+	skip := func(reason string) {
+		decide(DecisionMade{Outcome: OutcomeSkip, Reason: reason})
+	}
+
+	// A pending auto-off only survives cycles that confirm it again
+	keepPendingOff := false
+	defer func() {
+		if !keepPendingOff {
+			state.PendingOffSince = nil
+		}
+	}()
+
+	// An armed auto-off is dropped by every cycle that does not re-verify it, errors included
+	keepArmed := false
+	defer func() {
+		if !keepArmed && state.ArmedSince != nil {
+			state.logger().Info("Re-verification failed, armed auto-off aborted")
+			state.ArmedSince = nil
+			state.LastRecheck = RecheckAborted
+		}
+	}()
+
+	if state.HoldUntil != nil && !state.Clock.Now().Before(*state.HoldUntil) {
+		state.logger().Info("Manual hold expired, resuming automation")
+		state.HoldUntil = nil
+	}
+
+	// An overheating plug is switched off before any gate is looked at
+	if tookOver, err := checkTemperature(ctx, cfg, state, watts); tookOver || err != nil {
+		if err != nil {
+			state.logger().Error("Checking the Shelly temperature failed", "error", err)
+		}
+		return err
+	}
+
+	// An implausible voltage or power factor means the power reading is suspect too
+	problem, err := checkReadingQuality(ctx, cfg, state, watts)
+	if err != nil {
+		state.logger().Error("Checking the data quality failed", "error", err)
+		return err
+	}
+	if problem != "" {
+		state.logger().Warn("Untrusted power reading, skipping relay control", "problem", problem, "watts", watts)
+		state.UntrustedReadings++
+		state.Daily.Untrusted++
+		skip(ReasonUntrusted)
+		return nil
+	}
+
+	// A print job waking the printer switches it on, and the off path waits for the next reading
+	if checkAutoOn(ctx, cfg, state, watts) {
+		skip(ReasonAutoOn)
+		return nil
+	}
+
+	// A failed auto-off is repeated without waiting for the standby duration again, every other gate
+	// and check still applies
+	if state.OffRetry != nil {
+		if reason := offRetryObstacle(cfg, state, watts); reason != "" {
+			state.logger().Info("Not retrying the failed auto-off", "reason", reason)
+			state.OffRetry = nil
+		} else {
+			state.logger().Info("Retrying the failed auto-off", "failed_for", state.Clock.Now().Sub(state.OffRetry.Since).Round(time.Second))
+		}
+	}
+
+	// A command while the gates are queried, like a hold or a veto, isn't in their inputs
+	commands := state.commands
+	interrupted := func() bool {
+		if state.commands == commands {
+			return false
+		}
+		state.logger().Info("A control command ran during the check, not switching off before the next one")
+		skip(ReasonInterrupted)
+		return true
+	}
+
+	ev, err := evaluate(ctx, cfg, state, watts, true)
+	if err != nil {
+		state.logger().Error("Evaluating the gates failed", "error", err)
+		// Notify once, the source keeps failing until the credentials are replaced
+		if errors.Is(err, printer.ErrUnauthorized) && !state.PrinterAuthFailed {
+			state.PrinterAuthFailed = true
+			state.Bus.Publish(LockoutEngaged{Time: state.Clock.Now(), Device: state.DeviceName, Reason: LockoutPrinterAuth, Watts: watts})
+		}
+		return err
+	}
+	state.PrinterAuthFailed = false
+	state.LastEvaluation = &ev
+	logDecision(state, &ev, watts)
+	retrying := state.OffRetry != nil
+	if retrying && ev.Outcome != OutcomeTurnOff {
+		state.logger().Info("Not retrying the failed auto-off", "decision", ev.Outcome, "reason", ev.Reason)
+		state.OffRetry = nil
+	}
+	if ev.Outcome == OutcomeSkip {
+		skip(ev.Reason)
+		return nil
+	}
+	standbyDuration := ev.StandbyDuration
+
+	if ev.Outcome == OutcomeTurnOff {
+		if interrupted() {
+			return nil
+		}
+		// No countdown starts while the rate limits hold back the command
+		if reason := actuationLimit(cfg, state, state.Clock.Now(), false); reason != "" {
+			_ = blockActuation(state, ActionOff, SourceAuto, reason)
+			skip(ReasonRateLimited)
+			return nil
+		}
+		// A window cut short by the retention or a fresh backend doesn't show the whole story
+		if cfg.HistoryRequired && state.HistoryShort != nil {
+			state.logger().Info("Power history too short, not switching off", "covered", state.HistoryShort.Round(time.Second), "lookback", historyLookback(cfg))
+			skip(ReasonShortHistory)
+			return nil
+		}
+		// A retry already waited out the veto window and the re-verification before it failed
+		if cfg.VetoWindow > 0 && !retrying {
+			keepPendingOff = true
+			if state.PendingOffSince == nil {
+				now := state.Clock.Now()
+				state.PendingOffSince = &now
+				state.logger().Info("Auto-off pending unless vetoed", "executing_in", cfg.VetoWindow)
+				decide(DecisionMade{
+					Outcome:          OutcomePendingOff,
+					StandbyDuration:  standbyDuration,
+					ProjectedOffTime: now.Add(cfg.VetoWindow),
+					Announce:         true,
+				})
+				return nil
+			}
+			if waited := state.Clock.Now().Sub(*state.PendingOffSince); waited < cfg.VetoWindow {
+				state.logger().Info("Auto-off pending unless vetoed", "executing_in", (cfg.VetoWindow - waited).Round(time.Second))
+				decide(DecisionMade{
+					Outcome:          OutcomePendingOff,
+					StandbyDuration:  standbyDuration,
+					ProjectedOffTime: state.PendingOffSince.Add(cfg.VetoWindow),
+				})
+				return nil
+			}
+			keepPendingOff = false
+		}
+
+		// The two-stage off warns and arms first, a later cycle has to pass every gate again
+		if cfg.OffRecheck && !retrying {
+			now := state.Clock.Now()
+			if state.ArmedSince != nil && now.After(armedExpiry(cfg, *state.ArmedSince)) {
+				state.logger().Info("Armed auto-off expired without re-verification, arming again")
+				state.ArmedSince = nil
+				state.LastRecheck = RecheckExpired
+			}
+			if state.ArmedSince == nil || now.Sub(*state.ArmedSince) < cfg.OffRecheckDelay {
+				keepArmed = true
+				keepPendingOff = state.PendingOffSince != nil
+				announce := state.ArmedSince == nil
+				if announce {
+					state.ArmedSince = &now
+					state.logger().Info("Auto-off armed, re-verifying all gates before switching off")
+				}
+				decide(DecisionMade{
+					Outcome:          OutcomeArmed,
+					StandbyDuration:  standbyDuration,
+					ProjectedOffTime: state.ArmedSince.Add(cfg.OffRecheckWait()),
+					Announce:         announce,
+				})
+				return nil
+			}
+			state.logger().Info("Armed auto-off re-verified", "after", now.Sub(*state.ArmedSince).Round(time.Second))
+			keepArmed = true
+			state.ArmedSince = nil
+			state.LastRecheck = RecheckConfirmed
+		}
+
+		// Followers evaluate like the leader but never actuate
+		if !state.Leader.IsLeader() {
+			state.logger().Info("Not the leader, observing only: would turn off relay")
+			skip(ReasonNotLeader)
+			return nil
+		}
+
+		if !canSwitch(cfg, state) {
+			state.logger().Error("No Shelly IP available")
+			return fmt.Errorf("no shelly IP available")
+		}
+
+		if err := checkDuplicateController(ctx, cfg, state); err != nil {
+			if errors.Is(err, ErrDuplicateController) {
+				skip(ReasonDuplicate)
+				return nil
+			}
+			return err
+		}
+
+		req := preActionRequest{
+			Time:           state.Clock.Now(),
+			Device:         state.DeviceName,
+			Action:         ActionOff,
+			Outcome:        OutcomeTurnOff,
+			Watts:          watts,
+			StandbySeconds: int(standbyDuration.Seconds()),
+		}
+		var allow bool
+		var reason string
+		state.unlocked(func() { allow, reason = askPreActionHook(cfg, req) })
+		if interrupted() {
+			return nil
+		}
+		if !allow {
+			// Like a manual veto, the standby clock starts over
+			now := state.Clock.Now()
+			state.VetoTime = &now
+			state.logger().Info("Auto-off vetoed by the pre-action hook", "reason", reason)
+			skip(ReasonVetoed)
+			state.Bus.Publish(ActionVetoed{Time: now, Device: state.DeviceName, Action: ActionOff, Source: "pre-action hook", Reason: reason, Watts: watts, StandbyDuration: standbyDuration})
+			return nil
+		}
+
+		turnOff := DecisionMade{Outcome: OutcomeTurnOff, StandbyDuration: standbyDuration}
+		if cfg.OffRecheck {
+			turnOff.Recheck = RecheckConfirmed
+		}
+		decide(turnOff)
+
+		return executeOff(ctx, cfg, state, watts, standbyDuration)
+	} else {
+		remaining := standbyThreshold(cfg, state, state.Clock.Now()) - standbyDuration
+
+		// Announce the auto-off countdown once per standby streak. The streak start derived
+		// from the metrics only jitters by the query step while the streak continues.
+		streakStart := state.Clock.Now().Add(-standbyDuration)
+		announce := state.AnnouncedStandbyStart == nil || streakStart.Sub(*state.AnnouncedStandbyStart) > 2*time.Minute
+		if announce {
+			state.AnnouncedStandbyStart = &streakStart
+		}
+		decide(DecisionMade{
+			Outcome:          OutcomeStandby,
+			StandbyDuration:  standbyDuration,
+			ProjectedOffTime: state.Clock.Now().Add(remaining + cfg.OffDelay()),
+			Announce:         announce,
+		})
+	}
+
+	return nil
+}
+
+// logDecision logs the outcome of evaluating the gates with the inputs it was decided on
+func logDecision(state *State, ev *Decision, watts float64) {
+	attrs := []any{"decision", ev.Outcome, "watts", watts, "standby_duration", ev.StandbyDuration.Round(time.Second)}
+	if ev.Reason != "" {
+		attrs = append(attrs, "reason", ev.Reason)
+	}
+	// With DEVICES the logger already names the device
+	if state.DeviceName != "" && state.Log == nil {
+		attrs = append(attrs, "device", state.DeviceName)
+	}
+	state.logger().Info(ev.Detail, attrs...)
+}
+
+// resolveDevice caches the Shelly IP for relay control and the identity of the device from a reading.
+// The caller holds state.mu.
+func resolveDevice(ctx context.Context, cfg *config.Config, state *State, reading *metrics.ShellyReading) {
+	if cfg.ShellyIP != "" {
+		useStaticIP(cfg, state, reading.IP)
+	} else if reading.IP != "" {
+		setShellyIP(state, reading.IP)
+	} else if cfg.ShellyInfoMetric != "" && reading.DeviceName != "" {
+		resolveInfoAddress(ctx, cfg, state, reading.DeviceName)
+	}
+	if cfg.ShellyMDNS && reading.IP == "" && state.ShellyIP == "" {
+		discoverShelly(ctx, cfg, state)
+	}
+	if reading.DeviceName != "" {
+		state.DeviceName = reading.DeviceName
+	}
+	if reading.CloudID != "" {
+		state.CloudID = reading.CloudID
+	}
+}
+
+// executeOff executes the auto-off decided on, and keeps it in OffRetry for the next cycle if the relay
+// command fails. The caller holds state.mu.
+func executeOff(ctx context.Context, cfg *config.Config, state *State, watts float64, standbyDuration time.Duration) error {
+	err := setRelayRetrying(ctx, cfg, state, false, SourceAuto)
+	if errors.Is(err, errRetryInterrupted) {
+		state.logger().Info("A control command ran during the relay retries, dropping the auto-off", "error", err)
+		state.OffRetry = nil
+		return nil
+	}
+	if err != nil {
+		state.RelayFailures++
+		state.Daily.RelayFailures++
+		state.logger().Error("Turning off the relay failed", "action", ActionOff, "error", err, "failures", state.RelayFailures)
+		state.Bus.Publish(ActionFailed{
+			Time:            state.Clock.Now(),
+			Device:          state.DeviceName,
+			Action:          ActionOff,
+			Source:          SourceAuto,
+			Err:             err,
+			Failures:        state.RelayFailures,
+			Watts:           watts,
+			StandbyDuration: standbyDuration,
+		})
+		if state.OffRetry == nil {
+			state.OffRetry = &OffRetry{Since: state.Clock.Now(), StandbyDuration: standbyDuration}
+		}
+		return err
+	}
+	state.logger().Info("Relay turned off", "action", ActionOff, "source", SourceAuto, "watts", watts, "standby_duration", standbyDuration.Round(time.Second), "result", confirmedState(cfg, false))
+	now := state.Clock.Now()
+	if cfg.DryRun {
+		watchDryRunOff(state, now)
+	}
+	state.LastRelayOffTime = &now
+	state.RelayFailures = 0
+	state.OffRetry = nil
+	state.Daily.RelayOffs++
+	price, _ := state.Prices.At(now)
+	state.Bus.Publish(ActionExecuted{
+		Time:            now,
+		Device:          state.DeviceName,
+		Action:          ActionOff,
+		Source:          SourceAuto,
+		Watts:           watts,
+		StandbyDuration: standbyDuration,
+		DryRun:          cfg.DryRun,
+		Price:           price,
+	})
+	return nil
+}
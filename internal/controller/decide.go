@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"gome-assistant/internal/calendar"
+)
+
+// DecisionInputs is everything the gates look at, gathered before deciding
+type DecisionInputs struct {
+	Now   time.Time
+	Watts float64
+
+	// Derived from the metrics
+	PowerOnRecently bool          // Power went from low to high within the boot grace period
+	Printing        bool          // A printer is running or paused
+	PrintedRecently bool          // A printer was running or paused within the last 15 minutes
+	StandbyDuration time.Duration // How long the power has been continuously in the standby range
+	HighPowerEnd    *time.Time    // When the latest sustained period above HighPowerWatts ended, Now while it lasts
+	Surplus         *float64      // Lowest solar surplus over SurplusWindow, nil if unknown or stale
+	Calibrating     string        // Calibration stage or power reported now, empty if none
+
+	// Holds and the last actions
+	HoldUntil        *time.Time
+	CalendarHold     *calendar.Hold
+	AlertPause       *AlertPause
+	Maintenance      string     // Query reporting a firmware update or processing, empty if none
+	MaintenanceSince *time.Time // Since when Maintenance has been reported
+	LastRelayOffTime *time.Time
+	VetoTime         *time.Time
+
+	// Thresholds from the config
+	BootGracePeriod    time.Duration
+	OffCooldown        time.Duration
+	MinWatts           float64
+	MaxWatts           float64
+	StandbyThreshold   time.Duration
+	HighPowerWatts     float64
+	HighPowerCooldown  time.Duration
+	MaintenanceMaxHold time.Duration
+	SurplusMinWatts    float64
+	SurplusWindow      time.Duration
+}
+
+// Decide runs the gates of the auto-off on the inputs. It performs no I/O and does not modify any state.
+func Decide(in DecisionInputs) Decision {
+	d := Decision{Time: in.Now, Watts: in.Watts, Outcome: OutcomeSkip}
+	skip := func(reason, detail string) Decision {
+		d.Reason = reason
+		d.Detail = detail
+		return d
+	}
+
+	if in.HoldUntil != nil && in.Now.Before(*in.HoldUntil) {
+		return skip(ReasonHold, fmt.Sprintf("Manual hold active until %s, no action taken", in.HoldUntil.Format(time.RFC3339)))
+	}
+	d.Gates |= GateNoHold
+
+	if hold := in.CalendarHold; hold != nil {
+		return skip(ReasonCalendarHold, fmt.Sprintf("Calendar hold %q active until %s, no action taken", hold.Summary, hold.End.Format(time.RFC3339)))
+	}
+	d.Gates |= GateNoCalendarHold
+
+	if pause := in.AlertPause; pause != nil {
+		return skip(ReasonAlertPause, fmt.Sprintf("Automation paused by firing alert %s, no action taken", pause.AlertName))
+	}
+	d.Gates |= GateNoAlertPause
+
+	// Cutting power during a firmware update can brick the printer. A stuck state only holds for MaintenanceMaxHold.
+	if in.Maintenance != "" && in.MaintenanceSince != nil {
+		if held := in.Now.Sub(*in.MaintenanceSince); held < in.MaintenanceMaxHold {
+			return skip(ReasonMaintenance, fmt.Sprintf("Update or processing in progress (%s) for %s, holding power", in.Maintenance, held.Round(time.Second)))
+		}
+	}
+	d.Gates |= GateNoMaintenance
+
+	// Safety check: If we recently turned off the relay, don't turn it off again
+	// This prevents race conditions where someone turns it back on immediately
+	if in.LastRelayOffTime != nil {
+		timeSinceLastOff := in.Now.Sub(*in.LastRelayOffTime)
+		if timeSinceLastOff < in.OffCooldown {
+			return skip(ReasonRecentlyOff, fmt.Sprintf("Relay was turned off %s ago, off cooldown for another %s", timeSinceLastOff.Round(time.Second), (in.OffCooldown-timeSinceLastOff).Round(time.Second)))
+		}
+	}
+	d.Gates |= GateNotRecentlyOff
+
+	// Check if printer was recently turned on (relay went from off to on)
+	if in.PowerOnRecently {
+		return skip(ReasonBootGrace, fmt.Sprintf("Printer was turned on within boot grace period (%s), skipping checks", in.BootGracePeriod))
+	}
+	d.Gates |= GateNoBootGrace
+
+	if in.Printing {
+		return skip(ReasonPrinting, "Printer is currently printing, no action taken")
+	}
+	d.Gates |= GateNotPrinting
+
+	if in.PrintedRecently {
+		return skip(ReasonPrintedRecently, "Printer was printing recently, waiting before checking standby")
+	}
+	d.Gates |= GateNotPrintedRecently
+
+	// Sustained high power is a print the printer state doesn't know about, e.g. one started from the SD card
+	if in.HighPowerEnd != nil {
+		sinceHigh := in.Now.Sub(*in.HighPowerEnd)
+		if sinceHigh <= 0 {
+			return skip(ReasonPrintingByPower, fmt.Sprintf("Power has been above %.0f W for a while, treating the printer as printing", in.HighPowerWatts))
+		}
+		if sinceHigh < in.HighPowerCooldown {
+			return skip(ReasonPrintingByPower, fmt.Sprintf("Power dropped below %.0f W %s ago, waiting %s before checking standby", in.HighPowerWatts, sinceHigh.Round(time.Second), in.HighPowerCooldown))
+		}
+	}
+	d.Gates |= GateNotPrintingByPower
+
+	// Bed leveling and calibration routines aren't prints to the printer state but must not be interrupted
+	if in.Calibrating != "" {
+		return skip(ReasonCalibrating, fmt.Sprintf("Printer is calibrating (%s), no action taken", in.Calibrating))
+	}
+	d.Gates |= GateNotCalibrating
+
+	// If power is already at 0, printer/relay is already off
+	if in.Watts == 0 {
+		return skip(ReasonRelayOff, "Printer is off (0W), no action needed")
+	}
+	d.Gates |= GateRelayOn
+
+	if in.Watts < in.MinWatts || in.Watts > in.MaxWatts {
+		return skip(ReasonOutOfRange, fmt.Sprintf("Power consumption (%.2f W) is outside standby range (%.1f-%.1f W)", in.Watts, in.MinWatts, in.MaxWatts))
+	}
+	d.Gates |= GateInRange
+
+	// After a veto the standby clock starts over
+	standbyDuration := in.StandbyDuration
+	if in.VetoTime != nil {
+		if sinceVeto := in.Now.Sub(*in.VetoTime); sinceVeto < standbyDuration {
+			standbyDuration = sinceVeto
+		}
+	}
+	// Standby only counts once the cooldown after high power has passed
+	if in.HighPowerEnd != nil {
+		if sinceCooldown := in.Now.Sub(in.HighPowerEnd.Add(in.HighPowerCooldown)); sinceCooldown < standbyDuration {
+			standbyDuration = sinceCooldown
+		}
+	}
+	d.StandbyDuration = standbyDuration
+
+	if standbyDuration < in.StandbyThreshold {
+		d.Outcome = OutcomeStandby
+		d.Detail = fmt.Sprintf("Printer in standby for %s, %.0f minutes until auto-off", standbyDuration.Round(time.Second), (in.StandbyThreshold - standbyDuration).Minutes())
+		return d
+	}
+	d.Gates |= GateStandbyReached
+
+	// The standby draw is free while it is covered by solar surplus
+	if in.Surplus != nil && *in.Surplus > in.SurplusMinWatts {
+		return skip(ReasonSolarSurplus, fmt.Sprintf("Solar surplus has stayed above %.0f W for %s (lowest %.0f W), keeping the printer on", in.SurplusMinWatts, in.SurplusWindow, *in.Surplus))
+	}
+	d.Gates |= GateNoSolarSurplus
+	d.Outcome = OutcomeTurnOff
+	d.Detail = fmt.Sprintf("Printer has been in standby for %s (threshold: %s), turning off relay", standbyDuration.Round(time.Second), in.StandbyThreshold)
+	return d
+}
@@ -0,0 +1,295 @@
+package controller
+
+import (
+	"bytes"
+	"log/slog"
+	"math/bits"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/calendar"
+)
+
+var decideNow = time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC)
+
+// ago returns a pointer to the time d before decideNow
+func ago(d time.Duration) *time.Time {
+	t := decideNow.Add(-d)
+	return &t
+}
+
+// watts returns a pointer to w
+func watts(w float64) *float64 {
+	return &w
+}
+
+// standbyInputs passes every gate: 8 W in standby for 20 minutes with the default thresholds
+func standbyInputs() DecisionInputs {
+	return DecisionInputs{
+		Now:                decideNow,
+		Watts:              8,
+		StandbyDuration:    20 * time.Minute,
+		BootGracePeriod:    20 * time.Minute,
+		OffCooldown:        10 * time.Minute,
+		MinWatts:           7,
+		MaxWatts:           9,
+		StandbyThreshold:   15 * time.Minute,
+		HighPowerWatts:     60,
+		HighPowerCooldown:  10 * time.Minute,
+		MaintenanceMaxHold: 2 * time.Hour,
+		SurplusMinWatts:    50,
+		SurplusWindow:      15 * time.Minute,
+	}
+}
+
+// passedBefore returns the gate bits of all gates evaluated before gate
+func passedBefore(gate uint) uint {
+	return gate - 1
+}
+
+// allGates has the bits of every gate set
+var allGates = uint(1)<<len(GateNames) - 1
+
+func TestDecideGates(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*DecisionInputs)
+		reason  string
+		blocked uint   // The gate that failed
+		detail  string // Part of the detail
+	}{
+		{"manual hold", func(in *DecisionInputs) { in.HoldUntil = ago(-time.Hour) }, ReasonHold, GateNoHold, "Manual hold active until 2026-03-01T21:00:00Z"},
+		{"calendar hold", func(in *DecisionInputs) {
+			in.CalendarHold = &calendar.Hold{Summary: "Long print", Start: *ago(time.Hour), End: *ago(-time.Hour)}
+		}, ReasonCalendarHold, GateNoCalendarHold, `Calendar hold "Long print"`},
+		{"alert pause", func(in *DecisionInputs) { in.AlertPause = &AlertPause{AlertName: "VictoriaMetricsDegraded"} }, ReasonAlertPause, GateNoAlertPause, "VictoriaMetricsDegraded"},
+		{"maintenance", func(in *DecisionInputs) {
+			in.Maintenance, in.MaintenanceSince = "bambulab_ota_progress", ago(10*time.Minute)
+		}, ReasonMaintenance, GateNoMaintenance, "(bambulab_ota_progress) for 10m0s"},
+		{"recently off", func(in *DecisionInputs) { in.LastRelayOffTime = ago(4 * time.Minute) }, ReasonRecentlyOff, GateNotRecentlyOff, "turned off 4m0s ago, off cooldown for another 6m0s"},
+		{"boot grace", func(in *DecisionInputs) { in.PowerOnRecently = true }, ReasonBootGrace, GateNoBootGrace, "boot grace period (20m0s)"},
+		{"printing", func(in *DecisionInputs) { in.Printing = true }, ReasonPrinting, GateNotPrinting, "currently printing"},
+		{"printed recently", func(in *DecisionInputs) { in.PrintedRecently = true }, ReasonPrintedRecently, GateNotPrintedRecently, "printing recently"},
+		{"high power now", func(in *DecisionInputs) { in.HighPowerEnd = ago(0) }, ReasonPrintingByPower, GateNotPrintingByPower, "above 60 W for a while"},
+		{"high power cooling down", func(in *DecisionInputs) { in.HighPowerEnd = ago(3 * time.Minute) }, ReasonPrintingByPower, GateNotPrintingByPower, "dropped below 60 W 3m0s ago"},
+		{"calibrating", func(in *DecisionInputs) { in.Calibrating = "bed leveling" }, ReasonCalibrating, GateNotCalibrating, "(bed leveling)"},
+		{"relay off", func(in *DecisionInputs) { in.Watts = 0 }, ReasonRelayOff, GateRelayOn, "(0W)"},
+		{"below the range", func(in *DecisionInputs) { in.Watts = 3.5 }, ReasonOutOfRange, GateInRange, "(3.50 W) is outside standby range (7.0-9.0 W)"},
+		{"above the range", func(in *DecisionInputs) { in.Watts = 45 }, ReasonOutOfRange, GateInRange, "(45.00 W)"},
+		{"solar surplus", func(in *DecisionInputs) { in.Surplus = watts(300) }, ReasonSolarSurplus, GateNoSolarSurplus, "lowest 300 W"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := standbyInputs()
+			tt.modify(&in)
+			d := Decide(in)
+			if d.Outcome != OutcomeSkip || d.Reason != tt.reason {
+				t.Errorf("decision = %s %q, want a skip for %q", d.Outcome, d.Reason, tt.reason)
+			}
+			if want := passedBefore(tt.blocked); d.Gates != want {
+				t.Errorf("gates = %b, want %b", d.Gates, want)
+			}
+			if !strings.Contains(d.Detail, tt.detail) {
+				t.Errorf("detail = %q, want %q in it", d.Detail, tt.detail)
+			}
+			if !d.Time.Equal(decideNow) || d.Watts != in.Watts {
+				t.Errorf("decision at %s with %v W, want the inputs", d.Time, d.Watts)
+			}
+		})
+	}
+}
+
+func TestDecideTurnOff(t *testing.T) {
+	d := Decide(standbyInputs())
+	if d.Outcome != OutcomeTurnOff || d.Reason != "" || d.Gates != allGates || d.StandbyDuration != 20*time.Minute {
+		t.Errorf("decision = %+v, want a turn off with all gates passed", d)
+	}
+	if d.Detail != "Printer has been in standby for 20m0s (threshold: 15m0s), turning off relay" {
+		t.Errorf("detail = %q", d.Detail)
+	}
+}
+
+// TestDecideGateOrder checks that the earliest failing gate decides, whatever else fails after it
+func TestDecideGateOrder(t *testing.T) {
+	failures := []func(*DecisionInputs){
+		func(in *DecisionInputs) { in.HoldUntil = ago(-time.Hour) },
+		func(in *DecisionInputs) { in.CalendarHold = &calendar.Hold{Summary: "x", End: *ago(-time.Hour)} },
+		func(in *DecisionInputs) { in.AlertPause = &AlertPause{AlertName: "x"} },
+		func(in *DecisionInputs) { in.Maintenance, in.MaintenanceSince = "x", ago(time.Minute) },
+		func(in *DecisionInputs) { in.LastRelayOffTime = ago(time.Minute) },
+		func(in *DecisionInputs) { in.PowerOnRecently = true },
+		func(in *DecisionInputs) { in.Printing = true },
+		func(in *DecisionInputs) { in.PrintedRecently = true },
+		func(in *DecisionInputs) { in.HighPowerEnd = ago(0) },
+		func(in *DecisionInputs) { in.Calibrating = "x" },
+		func(in *DecisionInputs) { in.Watts = 0 },
+	}
+	for first := range failures {
+		in := standbyInputs()
+		for _, fail := range failures[first:] {
+			fail(&in)
+		}
+		d := Decide(in)
+		if got := bits.OnesCount(d.Gates); d.Outcome != OutcomeSkip || got != first {
+			t.Errorf("failing gates %d and later: decision %s %q after %d gates, want a skip after %d", first, d.Outcome, d.Reason, got, first)
+		}
+	}
+}
+
+func TestDecideBoundaries(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*DecisionInputs)
+		outcome string
+		reason  string
+	}{
+		// The standby range excludes neither bound, the watts are compared as is
+		{"at MIN_WATTS", func(in *DecisionInputs) { in.Watts = 7 }, OutcomeTurnOff, ""},
+		{"below MIN_WATTS", func(in *DecisionInputs) { in.Watts = 6.99 }, OutcomeSkip, ReasonOutOfRange},
+		{"at MAX_WATTS", func(in *DecisionInputs) { in.Watts = 9 }, OutcomeTurnOff, ""},
+		{"above MAX_WATTS", func(in *DecisionInputs) { in.Watts = 9.01 }, OutcomeSkip, ReasonOutOfRange},
+		{"barely on", func(in *DecisionInputs) { in.Watts = 0.1 }, OutcomeSkip, ReasonOutOfRange},
+
+		{"standby at the threshold", func(in *DecisionInputs) { in.StandbyDuration = 15 * time.Minute }, OutcomeTurnOff, ""},
+		{"standby just short", func(in *DecisionInputs) { in.StandbyDuration = 15*time.Minute - time.Second }, OutcomeStandby, ""},
+		{"no standby", func(in *DecisionInputs) { in.StandbyDuration = 0 }, OutcomeStandby, ""},
+
+		{"off cooldown just ended", func(in *DecisionInputs) { in.LastRelayOffTime = ago(10 * time.Minute) }, OutcomeTurnOff, ""},
+		{"off cooldown just running", func(in *DecisionInputs) { in.LastRelayOffTime = ago(10*time.Minute - time.Second) }, OutcomeSkip, ReasonRecentlyOff},
+		{"off cooldown disabled", func(in *DecisionInputs) { in.OffCooldown, in.LastRelayOffTime = 0, ago(0) }, OutcomeTurnOff, ""},
+
+		{"hold just expired", func(in *DecisionInputs) { in.HoldUntil = ago(0) }, OutcomeTurnOff, ""},
+		{"hold for another second", func(in *DecisionInputs) { in.HoldUntil = ago(-time.Second) }, OutcomeSkip, ReasonHold},
+
+		{"maintenance at its max hold", func(in *DecisionInputs) { in.Maintenance, in.MaintenanceSince = "x", ago(2*time.Hour) }, OutcomeTurnOff, ""},
+		{"maintenance just short of its max hold", func(in *DecisionInputs) { in.Maintenance, in.MaintenanceSince = "x", ago(2*time.Hour-time.Second) }, OutcomeSkip, ReasonMaintenance},
+		{"maintenance without its start", func(in *DecisionInputs) { in.Maintenance = "x" }, OutcomeTurnOff, ""},
+
+		{"high power cooldown just ended", func(in *DecisionInputs) { in.HighPowerEnd = ago(10 * time.Minute) }, OutcomeStandby, ""},
+		{"high power cooldown ended long ago", func(in *DecisionInputs) { in.HighPowerEnd = ago(40 * time.Minute) }, OutcomeTurnOff, ""},
+
+		{"surplus at the minimum", func(in *DecisionInputs) { in.Surplus = watts(50) }, OutcomeTurnOff, ""},
+		{"surplus above the minimum", func(in *DecisionInputs) { in.Surplus = watts(50.1) }, OutcomeSkip, ReasonSolarSurplus},
+		{"importing power", func(in *DecisionInputs) { in.Surplus = watts(-200) }, OutcomeTurnOff, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := standbyInputs()
+			tt.modify(&in)
+			if d := Decide(in); d.Outcome != tt.outcome || d.Reason != tt.reason {
+				t.Errorf("decision = %s %q, want %s %q (%s)", d.Outcome, d.Reason, tt.outcome, tt.reason, d.Detail)
+			}
+		})
+	}
+}
+
+func TestDecideStandbyCounting(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*DecisionInputs)
+		standby time.Duration
+		outcome string
+	}{
+		{"from the metrics", func(in *DecisionInputs) { in.StandbyDuration = 12 * time.Minute }, 12 * time.Minute, OutcomeStandby},
+		{"restarted by a veto", func(in *DecisionInputs) { in.VetoTime = ago(5 * time.Minute) }, 5 * time.Minute, OutcomeStandby},
+		{"veto before the streak", func(in *DecisionInputs) { in.VetoTime = ago(time.Hour) }, 20 * time.Minute, OutcomeTurnOff},
+		{"veto just one threshold ago", func(in *DecisionInputs) { in.VetoTime = ago(15 * time.Minute) }, 15 * time.Minute, OutcomeTurnOff},
+		// The high power streak ended 14 minutes ago, its 10 minute cooldown 4 minutes ago
+		{"after the high power cooldown", func(in *DecisionInputs) { in.HighPowerEnd = ago(14 * time.Minute) }, 4 * time.Minute, OutcomeStandby},
+		{"veto and high power", func(in *DecisionInputs) {
+			in.HighPowerEnd, in.VetoTime = ago(14*time.Minute), ago(2*time.Minute)
+		}, 2 * time.Minute, OutcomeStandby},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := standbyInputs()
+			tt.modify(&in)
+			d := Decide(in)
+			if d.StandbyDuration != tt.standby || d.Outcome != tt.outcome {
+				t.Errorf("decision = %s after %s of standby, want %s after %s", d.Outcome, d.StandbyDuration, tt.outcome, tt.standby)
+			}
+			if d.Outcome == OutcomeStandby && d.Gates != passedBefore(GateStandbyReached) {
+				t.Errorf("gates = %b, want all before the standby threshold", d.Gates)
+			}
+		})
+	}
+
+	in := standbyInputs()
+	in.StandbyDuration = 9*time.Minute + 40*time.Second
+	if d := Decide(in); d.Detail != "Printer in standby for 9m40s, 5 minutes until auto-off" {
+		t.Errorf("detail = %q", d.Detail)
+	}
+}
+
+func TestDecideCombinations(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*DecisionInputs)
+		reason string
+	}{
+		{"standby met during the boot grace", func(in *DecisionInputs) {
+			in.StandbyDuration, in.PowerOnRecently = time.Hour, true
+		}, ReasonBootGrace},
+		{"boot grace during the off cooldown", func(in *DecisionInputs) {
+			in.PowerOnRecently, in.LastRelayOffTime = true, ago(2*time.Minute)
+		}, ReasonRecentlyOff},
+		{"printing in the standby range", func(in *DecisionInputs) { in.Printing = true }, ReasonPrinting},
+		{"paused print at 0 W", func(in *DecisionInputs) { in.Printing, in.Watts = true, 0 }, ReasonPrinting},
+		{"expired hold and a pause", func(in *DecisionInputs) {
+			in.HoldUntil, in.AlertPause = ago(time.Minute), &AlertPause{AlertName: "x"}
+		}, ReasonAlertPause},
+		{"stuck maintenance and printing", func(in *DecisionInputs) {
+			in.Maintenance, in.MaintenanceSince, in.Printing = "x", ago(3*time.Hour), true
+		}, ReasonPrinting},
+		{"calibrating out of range", func(in *DecisionInputs) { in.Calibrating, in.Watts = "x", 120 }, ReasonCalibrating},
+		{"surplus before the standby threshold", func(in *DecisionInputs) {
+			in.Surplus, in.StandbyDuration = watts(500), time.Minute
+		}, ""},
+		{"surplus and a hold", func(in *DecisionInputs) { in.Surplus, in.HoldUntil = watts(500), ago(-time.Minute) }, ReasonHold},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := standbyInputs()
+			tt.modify(&in)
+			d := Decide(in)
+			if d.Reason != tt.reason || (tt.reason != "" && d.Outcome != OutcomeSkip) {
+				t.Errorf("decision = %s %q, want reason %q", d.Outcome, d.Reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestDecideIsPure(t *testing.T) {
+	in := standbyInputs()
+	in.HoldUntil, in.VetoTime, in.HighPowerEnd = ago(time.Minute), ago(30*time.Minute), ago(time.Hour)
+	before := in
+	first, second := Decide(in), Decide(in)
+	if first != second {
+		t.Errorf("decisions differ: %+v, %+v", first, second)
+	}
+	if in != before || !in.HoldUntil.Equal(*ago(time.Minute)) {
+		t.Error("Decide modified its inputs")
+	}
+}
+
+func TestLogDecisionDevice(t *testing.T) {
+	var log bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&log, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	ev := &Decision{Outcome: OutcomeSkip, Reason: ReasonPrinting, Detail: "Printing"}
+
+	logDecision(&State{DeviceName: "shellyplugsg3-bambu"}, ev, 120)
+	if !strings.Contains(log.String(), " device=shellyplugsg3-bambu") {
+		t.Errorf("log = %q, want the Shelly name as device", log.String())
+	}
+
+	// The logger of a device of DEVICES already names it
+	var deviceLog bytes.Buffer
+	state := &State{DeviceName: "shellyplugsg3-bambu", Log: slog.New(slog.NewTextHandler(&deviceLog, nil)).With("device", "x1c")}
+	logDecision(state, ev, 120)
+	if got := strings.Count(deviceLog.String(), "device="); got != 1 || !strings.Contains(deviceLog.String(), " device=x1c") {
+		t.Errorf("log = %q, want device=x1c only", deviceLog.String())
+	}
+}
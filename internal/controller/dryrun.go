@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// maxDryRunDisagreements is how many disagreements DryRunDiff keeps, the latest ones
+const maxDryRunDisagreements = 20
+
+// DryRunDiff compares the would-be auto-offs of the dry run with what the relay did, e.g. when another
+// automation still switches the plug
+type DryRunDiff struct {
+	WouldOffs     int                  `json:"would_offs"`
+	ExternalOffs  int                  `json:"externally_executed"`
+	Pending       int                  `json:"pending,omitempty"`
+	Disagreements []DryRunDisagreement `json:"disagreements,omitempty"`
+}
+
+// DryRunDisagreement is a would-be auto-off the relay didn't follow, or an off without one
+type DryRunDisagreement struct {
+	Time   time.Time `json:"time"`
+	Detail string    `json:"detail"`
+}
+
+// add counts a disagreement, dropping the oldest beyond maxDryRunDisagreements
+func (d *DryRunDiff) add(at time.Time, detail string) {
+	d.Disagreements = append(d.Disagreements, DryRunDisagreement{Time: at, Detail: detail})
+	if len(d.Disagreements) > maxDryRunDisagreements {
+		d.Disagreements = d.Disagreements[len(d.Disagreements)-maxDryRunDisagreements:]
+	}
+}
+
+// watchDryRunOff starts watching a would-be auto-off of the dry run. The caller holds state.mu.
+func watchDryRunOff(state *State, now time.Time) {
+	state.DryRunWatches = append(state.DryRunWatches, now)
+	state.DryRunDiff.WouldOffs++
+	state.Daily.DryRun.WouldOffs++
+}
+
+// trackDryRun checks the watched would-be auto-offs against the power: 0 W means someone else switched
+// the relay off, power left on for DRY_RUN_WATCH means the relay stayed on. An off without any would-be
+// auto-off disagrees too. The caller holds state.mu, before LastWatts is updated.
+func trackDryRun(cfg *config.Config, state *State, now time.Time, watts float64) {
+	disagree := func(at time.Time, detail string) {
+		state.logger().Warn("Dry run disagrees with the relay", "detail", detail)
+		state.DryRunDiff.add(at, detail)
+		state.Daily.DryRun.add(at, detail)
+	}
+
+	off := watts == 0
+	if len(state.DryRunWatches) == 0 {
+		if off && state.LastWatts != nil && *state.LastWatts > 0 {
+			disagree(now, "relay went off without a would-be auto-off")
+		}
+		return
+	}
+
+	var pending []time.Time
+	for _, at := range state.DryRunWatches {
+		switch {
+		case off:
+			state.logger().Info("Dry run agrees with the relay, it went off after the would-be auto-off", "after", now.Sub(at).Round(time.Second))
+			state.DryRunDiff.ExternalOffs++
+			state.Daily.DryRun.ExternalOffs++
+		case now.Sub(at) >= cfg.DryRunWatch:
+			disagree(at, fmt.Sprintf("relay stayed on for %s after the would-be auto-off at %s", cfg.DryRunWatch, at.Format("15:04")))
+		default:
+			pending = append(pending, at)
+		}
+	}
+	state.DryRunWatches = pending
+}
@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics"
+)
+
+// controllerHeartbeatMetric is pushed every cycle by instances with DUPLICATE_GUARD enabled
+const controllerHeartbeatMetric = "gome_assistant_controller_heartbeat"
+
+// ErrDuplicateController is returned when another instance controls the same device
+var ErrDuplicateController = errors.New("another instance controls this device")
+
+// pushControllerHeartbeat announces that this instance controls the device. The sample carries no
+// timestamp, so VictoriaMetrics stamps it with its own clock and the clocks of the instances never
+// get compared.
+func pushControllerHeartbeat(cfg *config.Config, device string, now time.Time) error {
+	body := fmt.Sprintf("%s{instance=%q,device=%q} %d\n", controllerHeartbeatMetric, cfg.ReplicaName(), device, now.Unix())
+	return importToVM(cfg, body)
+}
+
+// otherController returns the name of another instance that pushed a heartbeat for the device within
+// DUPLICATE_GUARD_WINDOW, empty if there is none. The query is evaluated at the time of VictoriaMetrics.
+func otherController(ctx context.Context, cfg *config.Config, c metrics.Client, device string) (string, error) {
+	query := fmt.Sprintf(`last_over_time(%s{device=%q,instance!=%q}[%ds])`,
+		controllerHeartbeatMetric, device, cfg.ReplicaName(), int(cfg.DuplicateGuardWindow.Seconds()))
+	series, err := c.QueryInstant(ctx, query, time.Time{})
+	if err != nil {
+		return "", fmt.Errorf("checking for other controllers: %w", err)
+	}
+
+	var others []string
+	for _, s := range series {
+		name := s.Labels["instance"]
+		if name == "" {
+			name = "unnamed"
+		}
+		others = append(others, name)
+	}
+	return strings.Join(others, ", "), nil
+}
+
+// checkDuplicateController refuses actuation while another instance controls the same device.
+// A failed check refuses as well, as a duplicate cannot be ruled out. The caller holds state.mu, which is
+// released for the query.
+func checkDuplicateController(ctx context.Context, cfg *config.Config, state *State) error {
+	if !cfg.DuplicateGuard {
+		return nil
+	}
+	device := state.DeviceName
+	var other string
+	var err error
+	state.unlocked(func() { other, err = otherController(ctx, cfg, state.Metrics, device) })
+	if err != nil {
+		return err
+	}
+	if other != "" {
+		state.logger().Error("Another instance controls the same Shelly, refusing to actuate", "instance", other, "shelly", state.DeviceName)
+		return fmt.Errorf("%w: %s", ErrDuplicateController, other)
+	}
+	return nil
+}
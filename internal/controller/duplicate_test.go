@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/leader"
+	"gome-assistant/internal/metrics/metricstest"
+)
+
+// heartbeatOf returns the labels of the controller heartbeat of an instance for the test plug
+func heartbeatOf(instance string) map[string]string {
+	return map[string]string{"__name__": controllerHeartbeatMetric, "instance": instance, "device": "bambu-plug"}
+}
+
+// guard enables the duplicate guard for the named instance
+func guard(instance string) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.DuplicateGuard = true
+		cfg.DuplicateGuardWindow = 3 * time.Minute
+		cfg.LeaderIdentity = instance
+	}
+}
+
+// checkDuplicate runs checkDuplicateController under the state lock, like a cycle does
+func checkDuplicate(ctx context.Context, cfg *config.Config, state *State) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return checkDuplicateController(ctx, cfg, state)
+}
+
+func TestDuplicateControllerOverlapping(t *testing.T) {
+	ctx := context.Background()
+	cfgA, stateA, b := newIntegration(t, clock.Real{}, guard("a"))
+	cfgB, stateB := newInstance(t, clock.Real{}, b, guard("b"))
+	b.setHistory(time.Now(), phase{length: time.Hour, watts: 8})
+
+	// Alone, a switches off and announces itself
+	RunCycle(ctx, cfgA, stateA)
+	expectDecision(t, stateA, "a alone", OutcomeTurnOff, "")
+	if b.plug.On() {
+		t.Fatal("a did not switch off")
+	}
+
+	// b started by mistake sees the heartbeat of a and refuses
+	b.plug.SetOn(true)
+	RunCycle(ctx, cfgB, stateB)
+	expectDecision(t, stateB, "b next to a", OutcomeSkip, ReasonDuplicate)
+	if !b.plug.On() || len(b.plug.Commands()) != 1 {
+		t.Errorf("b switched the relay: %v", b.plug.Commands())
+	}
+
+	// Now that b announced itself too, neither switches, automatically or by command
+	err := checkDuplicate(ctx, cfgA, stateA)
+	if !errors.Is(err, ErrDuplicateController) || err.Error() != "another instance controls this device: b" {
+		t.Errorf("a: error = %v, want a conflict with b", err)
+	}
+	if err := checkDuplicate(ctx, cfgB, stateB); !errors.Is(err, ErrDuplicateController) {
+		t.Errorf("b: error = %v, want a conflict with a", err)
+	}
+}
+
+func TestDuplicateControllerNonOverlapping(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	tests := []struct {
+		name      string
+		heartbeat map[string]string
+		at        time.Time
+	}{
+		{"aged out of the window", heartbeatOf("old"), now.Add(-4 * time.Minute)},
+		{"of another device", map[string]string{"__name__": controllerHeartbeatMetric, "instance": "other", "device": "prusa-plug"}, now},
+		{"of this instance", heartbeatOf("a"), now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, state, b := newIntegration(t, clock.Real{}, guard("a"))
+			b.setHistory(now, phase{length: time.Hour, watts: 8})
+			b.vm.Add(tt.heartbeat, metricstest.Sample{Time: tt.at, Value: float64(tt.at.Unix())})
+
+			RunCycle(ctx, cfg, state)
+			expectDecision(t, state, tt.name, OutcomeTurnOff, "")
+			if b.plug.On() {
+				t.Error("relay still on")
+			}
+		})
+	}
+
+	t.Run("just inside the window", func(t *testing.T) {
+		cfg, state, b := newIntegration(t, clock.Real{}, guard("a"))
+		state.DeviceName = "bambu-plug"
+		b.vm.Add(heartbeatOf("old"), metricstest.Sample{Time: now.Add(-150 * time.Second), Value: 1})
+		if err := checkDuplicate(ctx, cfg, state); !errors.Is(err, ErrDuplicateController) {
+			t.Errorf("error = %v, want a conflict", err)
+		}
+	})
+}
+
+func TestDuplicateControllerClockSkew(t *testing.T) {
+	ctx := context.Background()
+	// The clocks of both instances are hours off, in opposite directions
+	cfgA, stateA, b := newIntegration(t, clock.NewFake(time.Now().Add(6*time.Hour)), guard("a"))
+	cfgB, stateB := newInstance(t, clock.NewFake(time.Now().Add(-6*time.Hour)), b, guard("b"))
+	stateA.DeviceName, stateB.DeviceName = "bambu-plug", "bambu-plug"
+
+	if err := pushControllerHeartbeat(cfgA, stateA.DeviceName, stateA.Clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// VictoriaMetrics stamps the heartbeat with its own clock, which is all the check compares with
+	if err := checkDuplicate(ctx, cfgB, stateB); !errors.Is(err, ErrDuplicateController) {
+		t.Errorf("b: error = %v, want a conflict with a despite the skew", err)
+	}
+	if err := checkDuplicate(ctx, cfgA, stateA); err != nil {
+		t.Errorf("a: error = %v, want no conflict with its own heartbeat", err)
+	}
+}
+
+func TestDuplicateControllerCheckFails(t *testing.T) {
+	cfg, state, b := newIntegration(t, clock.Real{}, guard("a"))
+	state.DeviceName = "bambu-plug"
+	b.vm.Fail(503, "unavailable")
+	err := checkDuplicate(context.Background(), cfg, state)
+	if err == nil || errors.Is(err, ErrDuplicateController) {
+		t.Errorf("error = %v, want the failed check", err)
+	}
+}
+
+// newElector returns an elector of the instance renewing the file lock once
+func newElector(t *testing.T, lockFile, instance string) *leader.Elector {
+	t.Helper()
+	cfg, _, _ := newIntegration(t, clock.Real{}, func(cfg *config.Config) {
+		cfg.LeaderElection = config.LeaderFile
+		cfg.LeaderLockFile = lockFile
+		cfg.LeaderIdentity = instance
+		cfg.LeaderLeaseDuration = 30 * time.Second
+		cfg.LeaderRenewInterval = 10 * time.Second
+	})
+	e, err := leader.New(cfg, clock.Real{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Renew(context.Background())
+	return e
+}
+
+func TestDuplicateGuardWithLeaderElection(t *testing.T) {
+	ctx := context.Background()
+	lockFile := filepath.Join(t.TempDir(), "leader.lock")
+	cfgA, stateA, b := newIntegration(t, clock.Real{}, guard("a"))
+	cfgB, stateB := newInstance(t, clock.Real{}, b, guard("b"))
+	stateA.Leader, stateB.Leader = newElector(t, lockFile, "a"), newElector(t, lockFile, "b")
+	if !stateA.Leader.IsLeader() || stateB.Leader.IsLeader() {
+		t.Fatalf("a leads %v, b leads %v, want only a", stateA.Leader.IsLeader(), stateB.Leader.IsLeader())
+	}
+	b.setHistory(time.Now(), phase{length: time.Hour, watts: 8})
+
+	// The follower observes without announcing itself, so the leader still switches
+	RunCycle(ctx, cfgB, stateB)
+	expectDecision(t, stateB, "follower", OutcomeSkip, ReasonNotLeader)
+	RunCycle(ctx, cfgA, stateA)
+	expectDecision(t, stateA, "leader", OutcomeTurnOff, "")
+	if b.plug.On() {
+		t.Error("the leader did not switch off")
+	}
+	if err := checkDuplicate(ctx, cfgA, stateA); err != nil {
+		t.Errorf("leader: error = %v, want no heartbeat of the follower", err)
+	}
+}
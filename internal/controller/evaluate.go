@@ -0,0 +1,272 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics"
+	"gome-assistant/internal/printer"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// postPrintCooldown is how long after a print the auto-off keeps waiting, for safety
+const postPrintCooldown = 15 * time.Minute
+
+// Gates of the auto-off in evaluation order. Every passed gate sets its bit in Decision.Gates.
+const (
+	GateNoHold uint = 1 << iota
+	GateNoCalendarHold
+	GateNoAlertPause
+	GateNoMaintenance
+	GateNotRecentlyOff
+	GateNoBootGrace
+	GateNotPrinting
+	GateNotPrintedRecently
+	GateNotPrintingByPower
+	GateNotCalibrating
+	GateRelayOn
+	GateInRange
+	GateStandbyReached
+	GateNoSolarSurplus
+)
+
+// GateNames name the gates for metrics, in bit order
+var GateNames = []string{
+	"no_hold", "no_calendar_hold", "no_alert_pause", "no_maintenance", "not_recently_off", "no_boot_grace",
+	"not_printing", "not_printed_recently", "not_printing_by_power", "not_calibrating", "relay_on", "in_range",
+	"standby_reached", "no_solar_surplus",
+}
+
+// Decision is the result of running the gates for a power reading
+type Decision struct {
+	Time            time.Time
+	Watts           float64
+	Outcome         string // OutcomeSkip, OutcomeStandby or OutcomeTurnOff once all gates passed
+	Reason          string // Skip reason
+	Detail          string // Human-readable explanation for the log
+	StandbyDuration time.Duration
+	Gates           uint
+}
+
+// gatherInputs queries the metrics and collects the state the gates look at. With track it also
+// advances what the cycles keep track of: the maintenance hold, finished prints and the restored
+// standby streak. Probes and inspections pass false, so they neither consume the restored state nor
+// notify. The caller holds state.mu, which is released while the queries run.
+func gatherInputs(ctx context.Context, cfg *config.Config, state *State, watts float64, track bool) (DecisionInputs, error) {
+	now := state.Clock.Now()
+	threshold := standbyThreshold(cfg, state, now)
+	retry := state.OffRetry
+	in := DecisionInputs{
+		Now:                now,
+		Watts:              watts,
+		HoldUntil:          state.HoldUntil,
+		CalendarHold:       state.Calendar.Active(now),
+		AlertPause:         activeAlertPause(state, now),
+		LastRelayOffTime:   state.LastRelayOffTime,
+		VetoTime:           state.VetoTime,
+		BootGracePeriod:    cfg.BootGracePeriod,
+		OffCooldown:        cfg.OffCooldown,
+		MinWatts:           cfg.MinWatts,
+		MaxWatts:           cfg.MaxWatts,
+		StandbyThreshold:   threshold,
+		HighPowerWatts:     cfg.PrintPowerWatts,
+		HighPowerCooldown:  cfg.PrintPowerCooldown,
+		MaintenanceMaxHold: cfg.MaintenanceMaxHold,
+		SurplusMinWatts:    cfg.SurplusMinWatts,
+		SurplusWindow:      cfg.SurplusWindow,
+	}
+
+	queries := map[string]func(context.Context) error{
+		// Look back BootGracePeriod + 1 minute to see power transitions
+		"checking power transition history": func(ctx context.Context) (err error) {
+			in.PowerOnRecently, err = metrics.WasPowerTurnedOnRecently(ctx, state.Metrics, now, metrics.ConfigDevice(cfg), cfg.BootGracePeriod)
+			return err
+		},
+		"checking print status": func(ctx context.Context) (err error) {
+			in.Printing, err = state.Printer.Printing(ctx, now)
+			return err
+		},
+		"checking recent print history": func(ctx context.Context) (err error) {
+			in.PrintedRecently, err = state.Printer.PrintedRecently(ctx, now, postPrintCooldown)
+			return err
+		},
+		"checking standby duration": func(ctx context.Context) (err error) {
+			// A retried auto-off goes on with the standby duration it was decided on
+			if track && retry != nil {
+				in.StandbyDuration = retry.StandbyDuration
+				return nil
+			}
+			if cfg.StandbyMode == config.StandbyModeQuantile {
+				in.StandbyDuration, err = metrics.QuantileStandby(ctx, state.Metrics, now, metrics.ConfigDevice(cfg), cfg.MinWatts, cfg.MaxWatts, threshold)
+				return err
+			}
+			var idle *metrics.IdleFilter
+			if cfg.StandbyRequireIdle {
+				history, ok := state.Printer.(printer.StateHistory)
+				if !ok {
+					return fmt.Errorf("printer state source %s has no state history", state.Printer.Name())
+				}
+				idle = &metrics.IdleFilter{}
+				idle.Query, idle.Busy = history.StateQuery()
+			}
+			in.StandbyDuration, err = metrics.StandbyDuration(ctx, state.Metrics, now, metrics.ConfigDevice(cfg), cfg.MinWatts, cfg.MaxWatts, cfg.StandbyMaxSpread, cfg.StandbyMaxStddev, cfg.StandbyDuration, idle)
+			return err
+		},
+	}
+	var missingMaintenance []string
+	if maintenanceQueries := parseMaintenanceMetrics(cfg.MaintenanceMetrics); len(maintenanceQueries) > 0 {
+		queries["checking update and processing state"] = func(ctx context.Context) (err error) {
+			in.Maintenance, missingMaintenance, err = metrics.ActiveMaintenance(ctx, state.Metrics, now, maintenanceQueries)
+			return err
+		}
+	}
+	if cfg.PrintPowerWatts > 0 {
+		// The streak has to have lasted PrintPowerDuration and may have ended up to PrintPowerCooldown ago
+		queries["checking high power history"] = func(ctx context.Context) (err error) {
+			in.HighPowerEnd, err = metrics.SustainedHighPowerEnd(ctx, state.Metrics, now, metrics.ConfigDevice(cfg), cfg.PrintPowerWatts, cfg.PrintPowerDuration, cfg.PrintPowerDuration+cfg.PrintPowerCooldown+time.Minute)
+			return err
+		}
+	}
+	var calibration calibrationReading
+	if cfg.CalibrationStageMetric != "" {
+		queries["checking calibration stage"] = func(ctx context.Context) (err error) {
+			calibration.Stage, calibration.StageFound, err = metrics.MatchingState(ctx, state.Metrics, now, cfg.CalibrationStageMetric, cfg.CalibrationStageValues())
+			return err
+		}
+	}
+	if cfg.CalibrationPowerWatts > 0 {
+		queries["checking calibration power"] = func(ctx context.Context) (err error) {
+			calibration.PowerEnd, err = metrics.SustainedHighPowerEnd(ctx, state.Metrics, now, metrics.ConfigDevice(cfg), cfg.CalibrationPowerWatts, cfg.CalibrationPowerDuration, cfg.CalibrationPowerDuration+time.Minute)
+			return err
+		}
+	}
+	var printerStates map[string]float64
+	if history, ok := state.Printer.(printer.StateHistory); ok {
+		query, _ := history.StateQuery()
+		queries["checking printer states"] = func(ctx context.Context) (err error) {
+			printerStates, err = metrics.StatesByPrinter(ctx, state.Metrics, now, query)
+			return err
+		}
+	}
+	if cfg.SurplusQuery != "" {
+		queries["checking solar surplus"] = func(ctx context.Context) (err error) {
+			in.Surplus, err = metrics.LowestOverWindow(ctx, state.Metrics, now, cfg.SurplusQuery, cfg.SurplusWindow, cfg.MaxMetricsAge())
+			return err
+		}
+	}
+	var err error
+	state.unlocked(func() { err = runQueries(ctx, cfg, state.Queries, queries) })
+	if err != nil {
+		return in, err
+	}
+	if track {
+		trackMaintenance(cfg, state, now, in.Maintenance, missingMaintenance)
+		in.MaintenanceSince = state.MaintenanceSince
+		trackPrintFinish(cfg, state, in, printerStates)
+	} else if in.Maintenance != "" {
+		// A hold not tracked yet starts now
+		in.MaintenanceSince = &now
+		if state.MaintenanceSince != nil {
+			in.MaintenanceSince = state.MaintenanceSince
+		}
+	}
+	in.Calibrating = calibrating(cfg, state, now, calibration)
+	// A print reported finished by a trigger holds off standby like one seen in the printer state
+	if t := state.PrintFinishedAt; t != nil && now.Sub(*t) < postPrintCooldown {
+		in.PrintedRecently = true
+	}
+	if track {
+		resumeStandby(state, &in)
+	} else {
+		previewStandby(state, &in)
+	}
+	return in, nil
+}
+
+// QueryLimit bounds the metric queries running at the same time across the devices sharing it
+type QueryLimit chan struct{}
+
+// NewQueryLimit returns a limit of n queries at a time
+func NewQueryLimit(n int) QueryLimit {
+	return make(QueryLimit, n)
+}
+
+// runQueries runs the queries in parallel, at most QueryConcurrency at a time and each limited to
+// QueryTimeout. With a shared limit, a query also waits for a slot of it, which doesn't count against
+// its timeout. The first failure cancels the remaining queries and is returned prefixed with its name.
+// A panicking query fails like any other instead of taking down the process.
+func runQueries(ctx context.Context, cfg *config.Config, limit QueryLimit, queries map[string]func(context.Context) error) error {
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(cfg.QueryConcurrency)
+	for name, query := range queries {
+		g.Go(func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("%s: panic: %v", name, r)
+				}
+			}()
+			if limit != nil {
+				select {
+				case limit <- struct{}{}:
+					defer func() { <-limit }()
+				case <-ctx.Done():
+					return fmt.Errorf("%s: %w", name, ctx.Err())
+				}
+			}
+			qctx, cancel := context.WithTimeout(ctx, cfg.QueryTimeout)
+			defer cancel()
+			if err := query(qctx); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// evaluate gathers the inputs and decides without acting on the result. The caller holds state.mu.
+func evaluate(ctx context.Context, cfg *config.Config, state *State, watts float64, track bool) (Decision, error) {
+	in, err := gatherInputs(ctx, cfg, state, watts, track)
+	if err != nil {
+		return Decision{}, err
+	}
+	return Decide(in), nil
+}
+
+// ProbeEvaluation returns the evaluation of the last cycle or probe if it is younger than the check
+// interval, and evaluates a fresh reading otherwise. The state lock is released while it queries.
+func ProbeEvaluation(ctx context.Context, cfg *config.Config, state *State) (Decision, bool, error) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if last := state.LastEvaluation; last != nil && state.Clock.Now().Sub(last.Time) < cfg.CheckInterval {
+		return *last, true, nil
+	}
+
+	var reading *metrics.ShellyReading
+	var fresh bool
+	var err error
+	state.unlocked(func() {
+		reading, err = metrics.ShellyBambuWatts(ctx, state.Metrics, state.Clock.Now(), metrics.ConfigDevice(cfg), cfg.MaxMetricsAge())
+		if err == nil {
+			fresh, err = metrics.HasRecentShellyMetrics(ctx, state.Metrics, state.Clock.Now(), metrics.ConfigDevice(cfg), cfg.MaxMetricsAge())
+		}
+	})
+	if err != nil {
+		return Decision{}, false, err
+	}
+	if !fresh {
+		return Decision{}, false, errors.New("no recent shelly metrics")
+	}
+
+	ev, err := evaluate(ctx, cfg, state, reading.Watts, false)
+	if err != nil {
+		return Decision{}, false, err
+	}
+	state.LastEvaluation = &ev
+	return ev, false, nil
+}
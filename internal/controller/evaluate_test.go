@@ -0,0 +1,251 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics"
+	"gome-assistant/internal/printer"
+)
+
+// countingClient passes the queries on after holding each for a while, counting how many run at once
+type countingClient struct {
+	next metrics.Client
+	hold time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	max      int
+	total    int
+}
+
+// begin counts a query in and holds it
+func (c *countingClient) begin() {
+	c.mu.Lock()
+	c.inFlight++
+	c.total++
+	c.max = max(c.max, c.inFlight)
+	c.mu.Unlock()
+	time.Sleep(c.hold)
+}
+
+// end counts a query out
+func (c *countingClient) end() {
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+}
+
+func (c *countingClient) QueryInstant(ctx context.Context, promql string, at time.Time) ([]metrics.Series, error) {
+	c.begin()
+	defer c.end()
+	return c.next.QueryInstant(ctx, promql, at)
+}
+
+func (c *countingClient) QueryRange(ctx context.Context, promql string, start, end time.Time, step time.Duration) ([]metrics.Series, error) {
+	c.begin()
+	defer c.end()
+	return c.next.QueryRange(ctx, promql, start, end, step)
+}
+
+// counts returns the most queries in flight at once and the total
+func (c *countingClient) counts() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.max, c.total
+}
+
+func TestQueryConcurrencyLimit(t *testing.T) {
+	for _, limit := range []int{1, 2, 4} {
+		t.Run("limit "+strconv.Itoa(limit), func(t *testing.T) {
+			// Every optional query enabled, so a cycle fans out well beyond the limit
+			cfg, state, b := newIntegration(t, clock.Real{}, calibration(), func(cfg *config.Config) {
+				cfg.QueryConcurrency = limit
+				cfg.MaintenanceMetrics, cfg.MaintenanceMaxHold = "bambulab_ota_progress", 2*time.Hour
+				cfg.SurplusQuery, cfg.SurplusMinWatts, cfg.SurplusWindow = "solar_surplus_watts", 100, 10*time.Minute
+				cfg.PrintPowerWatts, cfg.PrintPowerDuration, cfg.PrintPowerCooldown = 60, 3*time.Minute, 10*time.Minute
+			})
+			counter := &countingClient{next: state.Metrics, hold: 20 * time.Millisecond}
+			state.Metrics = counter
+			source, err := printer.New(cfg, counter, clock.Real{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			state.Printer = source
+			b.setHistory(time.Now(), phase{length: time.Hour, watts: 8})
+
+			RunCycle(context.Background(), cfg, state)
+			if state.LastCycleError != "" {
+				t.Fatalf("cycle error %q", state.LastCycleError)
+			}
+			most, total := counter.counts()
+			if most > limit {
+				t.Errorf("%d queries at once, want at most %d", most, limit)
+			}
+			if total <= 4 {
+				t.Fatalf("%d queries, want a cycle with more than the largest limit", total)
+			}
+			if most < limit {
+				t.Errorf("at most %d queries at once, want the limit of %d used", most, limit)
+			}
+		})
+	}
+}
+
+// newQueryConfig returns a configuration with the given query limits
+func newQueryConfig(concurrency int, timeout time.Duration) *config.Config {
+	return &config.Config{QueryConcurrency: concurrency, QueryTimeout: timeout}
+}
+
+func TestRunQueriesIsolation(t *testing.T) {
+	t.Run("panic", func(t *testing.T) {
+		err := runQueries(context.Background(), newQueryConfig(2, time.Second), nil, map[string]func(context.Context) error{
+			"checking the panic": func(context.Context) error { panic("boom") },
+		})
+		if err == nil || err.Error() != "checking the panic: panic: boom" {
+			t.Errorf("error = %v, want the recovered panic", err)
+		}
+	})
+
+	t.Run("error names the query", func(t *testing.T) {
+		failure := errors.New("VM query failed")
+		err := runQueries(context.Background(), newQueryConfig(2, time.Second), nil, map[string]func(context.Context) error{
+			"checking power": func(context.Context) error { return failure },
+		})
+		if !errors.Is(err, failure) || !strings.HasPrefix(err.Error(), "checking power: ") {
+			t.Errorf("error = %v, want the failure prefixed with its query", err)
+		}
+	})
+
+	t.Run("each query has its own timeout", func(t *testing.T) {
+		var mu sync.Mutex
+		var deadlines []time.Duration
+		query := func(ctx context.Context) error {
+			deadline, _ := ctx.Deadline()
+			mu.Lock()
+			deadlines = append(deadlines, time.Until(deadline))
+			mu.Unlock()
+			time.Sleep(30 * time.Millisecond)
+			return nil
+		}
+		// Run one after another, the later ones would run out of time on a shared deadline
+		err := runQueries(context.Background(), newQueryConfig(1, 50*time.Millisecond), nil, map[string]func(context.Context) error{
+			"a": query, "b": query, "c": query,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range deadlines {
+			if d < 40*time.Millisecond {
+				t.Errorf("deadlines %v, want each about 50ms from its start", deadlines)
+			}
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		err := runQueries(context.Background(), newQueryConfig(2, 10*time.Millisecond), nil, map[string]func(context.Context) error{
+			"checking standby": func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("error = %v, want the query timeout", err)
+		}
+	})
+
+	t.Run("failure cancels the others", func(t *testing.T) {
+		err := runQueries(context.Background(), newQueryConfig(2, time.Minute), nil, map[string]func(context.Context) error{
+			"failing": func(context.Context) error { return errors.New("down") },
+			"waiting": func(ctx context.Context) error {
+				<-ctx.Done()
+				return nil
+			},
+		})
+		if err == nil || err.Error() != "failing: down" {
+			t.Errorf("error = %v, want the first failure", err)
+		}
+	})
+}
+
+func TestSharedQueryLimit(t *testing.T) {
+	t.Run("bounds the queries of every device together", func(t *testing.T) {
+		const devices, limit = 4, 3
+		shared := NewQueryLimit(limit)
+		cfg := newQueryConfig(limit, time.Second)
+		var mu sync.Mutex
+		var inFlight, most, total int
+		query := func(context.Context) error {
+			mu.Lock()
+			inFlight++
+			total++
+			most = max(most, inFlight)
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return nil
+		}
+		var wg sync.WaitGroup
+		for range devices {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// Every device alone may run as many queries at once as the shared limit allows
+				err := runQueries(context.Background(), cfg, shared, map[string]func(context.Context) error{
+					"a": query, "b": query, "c": query, "d": query,
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if most != limit || total != devices*4 {
+			t.Errorf("at most %d of %d queries at once, want %d", most, total, limit)
+		}
+	})
+
+	t.Run("waiting doesn't count against the query timeout", func(t *testing.T) {
+		shared := NewQueryLimit(1)
+		shared <- struct{}{} // Taken by another device
+		go func() {
+			time.Sleep(80 * time.Millisecond)
+			<-shared
+		}()
+		err := runQueries(context.Background(), newQueryConfig(1, 50*time.Millisecond), shared, map[string]func(context.Context) error{
+			"checking standby": func(ctx context.Context) error { return ctx.Err() },
+		})
+		if err != nil {
+			t.Errorf("query after waiting for its turn: %v", err)
+		}
+	})
+
+	t.Run("the cycle ends the wait", func(t *testing.T) {
+		shared := NewQueryLimit(1)
+		shared <- struct{}{}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		ran := false
+		err := runQueries(ctx, newQueryConfig(1, time.Minute), shared, map[string]func(context.Context) error{
+			"checking standby": func(context.Context) error {
+				ran = true
+				return nil
+			},
+		})
+		if !errors.Is(err, context.DeadlineExceeded) || err.Error() != "checking standby: context deadline exceeded" || ran {
+			t.Errorf("error = %v with the query run %v, want the cycle deadline while waiting", err, ran)
+		}
+		if len(shared) != 1 {
+			t.Errorf("%d slots taken, want only the other device's", len(shared))
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/outbound"
+)
+
+// publishHeartbeat signals external monitoring that a cycle has run.
+// Failures are only logged and never affect control decisions.
+func publishHeartbeat(cfg *config.Config, now time.Time, failed bool) {
+	var err error
+	switch cfg.HeartbeatMode {
+	case config.HeartbeatVM:
+		err = pushHeartbeatToVM(cfg, now)
+	case config.HeartbeatHTTP:
+		err = pingHeartbeatURL(cfg, failed)
+	default:
+		return
+	}
+
+	if err != nil {
+		slog.Error("Publishing the heartbeat failed", "mode", cfg.HeartbeatMode, "error", err)
+	}
+}
+
+// Heartbeat publishes one heartbeat per tick for the cycles of every device, so the devices of DEVICES
+// don't each ping HEARTBEAT_URL with their own result
+type Heartbeat struct {
+	cfg *config.Config
+
+	mu     sync.Mutex
+	failed map[*State]bool // Whether the latest cycle of a device failed
+	ran    bool            // A cycle ran since the last heartbeat
+}
+
+// NewHeartbeat returns a heartbeat publishing with the settings of cfg
+func NewHeartbeat(cfg *config.Config) *Heartbeat {
+	return &Heartbeat{cfg: cfg, failed: map[*State]bool{}}
+}
+
+// record notes the result of a cycle of state for the next heartbeat
+func (h *Heartbeat) record(state *State, cycleErr error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failed[state] = cycleErr != nil
+	h.ran = true
+}
+
+// Publish publishes a heartbeat if a cycle ran since the last one, failed if the latest cycle of any
+// device failed
+func (h *Heartbeat) Publish(now time.Time) {
+	h.mu.Lock()
+	ran, failed := h.ran, false
+	for _, f := range h.failed {
+		failed = failed || f
+	}
+	h.ran = false
+	h.mu.Unlock()
+	if ran {
+		publishHeartbeat(h.cfg, now, failed)
+	}
+}
+
+// Run publishes a heartbeat every CHECK_INTERVAL until ctx is done
+func (h *Heartbeat) Run(ctx context.Context, clk clock.Clock) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(h.cfg.CheckInterval):
+			h.Publish(clk.Now())
+		}
+	}
+}
+
+// pushHeartbeatToVM writes a gome_heartbeat_timestamp sample via the VictoriaMetrics import API
+func pushHeartbeatToVM(cfg *config.Config, now time.Time) error {
+	return importToVM(cfg, fmt.Sprintf("gome_heartbeat_timestamp{job=\"gome-assistant\",instance_name=%q} %d\n", cfg.InstanceName(), now.Unix()))
+}
+
+// importToVM writes samples in the Prometheus text format via the VictoriaMetrics import API.
+// Samples without a timestamp get the time of VictoriaMetrics.
+func importToVM(cfg *config.Config, body string) error {
+	importURL := cfg.VictoriaMetricsEndpoint("/api/v1/import/prometheus", nil)
+
+	req, err := http.NewRequest("POST", importURL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(cfg.VictoriaMetricsUser, cfg.Secret("VM_PASSWORD"))
+	req.Header.Set("Content-Type", "text/plain")
+
+	client := outbound.Client(10*time.Second, cfg.VMHeaderValues())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	// VictoriaMetrics answers imports with 204 No Content
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("VM import failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	return nil
+}
+
+// pingHeartbeatURL pings a healthchecks.io style URL, appending /fail for error cycles
+func pingHeartbeatURL(cfg *config.Config, failed bool) error {
+	pingURL := strings.TrimSuffix(cfg.HeartbeatURL, "/")
+	if failed {
+		pingURL += "/fail"
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(pingURL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("heartbeat ping failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/version"
+)
+
+func TestHeartbeatImportHeaders(t *testing.T) {
+	var headers http.Header
+	var body string
+	vm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/import/prometheus" {
+			http.NotFound(w, r)
+			return
+		}
+		headers = r.Header.Clone()
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(vm.Close)
+
+	cfg := &config.Config{
+		VictoriaMetricsURL: vm.URL, VictoriaMetricsUser: "gome", VictoriaMetricsPassword: "secret",
+		VMHeaders: "X-Org: workshop; X-Scope-OrgID: 7", HeartbeatMode: config.HeartbeatVM,
+	}
+	now := time.Unix(1772395200, 0)
+	if err := pushHeartbeatToVM(cfg, now); err != nil {
+		t.Fatal(err)
+	}
+	user, password, _ := (&http.Request{Header: headers}).BasicAuth()
+	if headers.Get("User-Agent") != version.UserAgent() || headers.Get("X-Org") != "workshop" || headers.Get("X-Scope-Orgid") != "7" ||
+		headers.Get("Content-Type") != "text/plain" || user != "gome" || password != "secret" {
+		t.Errorf("headers = %v", headers)
+	}
+	if want := `gome_heartbeat_timestamp{job="gome-assistant",instance_name="` + cfg.InstanceName() + `"} 1772395200` + "\n"; body != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestHeartbeatAggregatesDevices(t *testing.T) {
+	var pings []string
+	ping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pings = append(pings, r.URL.Path)
+	}))
+	t.Cleanup(ping.Close)
+
+	h := NewHeartbeat(&config.Config{HeartbeatMode: config.HeartbeatHTTP, HeartbeatURL: ping.URL + "/uuid"})
+	x1c, voron := &State{}, &State{}
+	now := time.Unix(1772395200, 0)
+	steps := []struct {
+		name   string
+		cycles func()
+		want   []string
+	}{
+		{"one device failed", func() { h.record(x1c, nil); h.record(voron, errors.New("VM query failed")) }, []string{"/uuid/fail"}},
+		// The failed device is still failing until its next cycle
+		{"the other device ran", func() { h.record(x1c, nil) }, []string{"/uuid/fail", "/uuid/fail"}},
+		{"no cycle", func() {}, []string{"/uuid/fail", "/uuid/fail"}},
+		{"both succeeded", func() { h.record(voron, nil); h.record(x1c, nil) }, []string{"/uuid/fail", "/uuid/fail", "/uuid"}},
+	}
+	for _, step := range steps {
+		step.cycles()
+		h.Publish(now)
+		if !slices.Equal(pings, step.want) {
+			t.Errorf("%s: pings = %q, want %q", step.name, pings, step.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// Ring is a fixed-size buffer keeping the most recent items
+type Ring[T any] struct {
+	name    string
+	mu      sync.Mutex
+	items   []T
+	next    int
+	full    bool
+	evicted int
+}
+
+func newRing[T any](name string, size int) *Ring[T] {
+	return &Ring[T]{name: name, items: make([]T, size)}
+}
+
+// Add stores an item, replacing the oldest once the buffer is full
+func (r *Ring[T]) Add(item T) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.full {
+		r.evicted++
+	}
+	r.items[r.next] = item
+	r.next = (r.next + 1) % len(r.items)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Usage reports the items kept against the size of the ring
+func (r *Ring[T]) Usage() MemoryUsage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := r.next
+	if r.full {
+		entries = len(r.items)
+	}
+	return MemoryUsage{Store: r.name, Entries: entries, Budget: len(r.items), Evicted: r.evicted}
+}
+
+// Recent returns up to limit items, newest first; limit <= 0 returns all
+func (r *Ring[T]) Recent(limit int) []T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := r.next
+	if r.full {
+		count = len(r.items)
+	}
+	if limit > 0 && limit < count {
+		count = limit
+	}
+
+	result := make([]T, 0, count)
+	for i := 1; i <= count; i++ {
+		result = append(result, r.items[(r.next-i+len(r.items))%len(r.items)])
+	}
+	return result
+}
+
+// DecisionRecord is a decision as returned by the API
+type DecisionRecord struct {
+	Time             time.Time  `json:"time"`
+	Device           string     `json:"device,omitempty"`
+	Outcome          string     `json:"outcome"`
+	Reason           string     `json:"reason,omitempty"`
+	Watts            float64    `json:"watts"`
+	StandbySeconds   int        `json:"standby_seconds"`
+	ProjectedOffTime *time.Time `json:"projected_off_time,omitempty"`
+	Recheck          string     `json:"recheck,omitempty"`
+}
+
+// ActionRecord is a relay action as returned by the API
+type ActionRecord struct {
+	Time   time.Time `json:"time"`
+	Device string    `json:"device,omitempty"`
+	Action string    `json:"action"`
+	Source string    `json:"source"`
+	Result string    `json:"result"` // ok, failed, vetoed or dry_run
+	Detail string    `json:"detail,omitempty"`
+	Watts  float64   `json:"watts"`
+}
+
+// History records recent decisions and actions from the event bus
+type History struct {
+	Decisions *Ring[DecisionRecord]
+	Actions   *Ring[ActionRecord]
+}
+
+func NewHistory(cfg *config.Config) *History {
+	return &History{
+		Decisions: newRing[DecisionRecord]("decisions", cfg.DecisionHistorySize),
+		Actions:   newRing[ActionRecord]("actions", cfg.ActionHistorySize),
+	}
+}
+
+// Handle is the event bus subscriber recording the history
+func (h *History) Handle(be BusEvent) error {
+	if e, ok := be.(DecisionMade); ok {
+		h.Decisions.Add(NewDecisionRecord(e))
+	}
+	if record, ok := NewActionRecord(be); ok {
+		h.Actions.Add(record)
+	}
+	return nil
+}
+
+func NewDecisionRecord(e DecisionMade) DecisionRecord {
+	record := DecisionRecord{
+		Time:           e.Time,
+		Device:         e.Device,
+		Outcome:        e.Outcome,
+		Reason:         e.Reason,
+		Watts:          e.Watts,
+		StandbySeconds: int(e.StandbyDuration.Seconds()),
+		Recheck:        e.Recheck,
+	}
+	if !e.ProjectedOffTime.IsZero() {
+		t := e.ProjectedOffTime
+		record.ProjectedOffTime = &t
+	}
+	return record
+}
+
+// NewActionRecord converts executed, failed and vetoed actions
+func NewActionRecord(be BusEvent) (ActionRecord, bool) {
+	switch e := be.(type) {
+	case ActionExecuted:
+		result := "ok"
+		if e.DryRun {
+			result = "dry_run"
+		}
+		return ActionRecord{Time: e.Time, Device: e.Device, Action: e.Action, Source: e.Source, Result: result, Watts: e.Watts}, true
+	case ActionFailed:
+		return ActionRecord{Time: e.Time, Device: e.Device, Action: e.Action, Source: e.Source, Result: "failed", Detail: e.Err.Error(), Watts: e.Watts}, true
+	case ActionVetoed:
+		return ActionRecord{Time: e.Time, Device: e.Device, Action: e.Action, Source: e.Source, Result: "vetoed", Detail: e.Reason, Watts: e.Watts}, true
+	}
+	return ActionRecord{}, false
+}
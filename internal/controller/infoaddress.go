@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/deviceaddr"
+	"gome-assistant/internal/metrics"
+)
+
+// InfoAddress is the Shelly IP looked up in SHELLY_INFO_METRIC for a device name
+type InfoAddress struct {
+	Name    string
+	IP      string // Empty while the join is ambiguous
+	Checked time.Time
+}
+
+// resolveInfoAddress sets the Shelly IP from SHELLY_INFO_METRIC when the power series has no address
+// label. The join is cached for SHELLY_INFO_REFRESH or until the device name changes. An ambiguous join
+// is reported and clears the IP rather than guessing, a failed query keeps the cached one until the
+// next cycle retries. The caller holds state.mu, which is released for the query.
+func resolveInfoAddress(ctx context.Context, cfg *config.Config, state *State, name string) {
+	now := state.Clock.Now()
+	cached := state.InfoAddress
+	if cached == nil || cached.Name != name || now.Sub(cached.Checked) >= cfg.ShellyInfoRefresh {
+		var ip string
+		var err error
+		state.unlocked(func() {
+			ip, err = metrics.InfoAddress(ctx, state.Metrics, now, cfg.ShellyInfoMetric, metrics.ConfigDevice(cfg), name, cfg.MaxMetricsAge())
+		})
+		switch {
+		case errors.Is(err, metrics.ErrAmbiguousInfo):
+			state.logger().Warn("Not taking the Shelly IP from the info metric", "metric", cfg.ShellyInfoMetric, "error", err)
+		case err != nil:
+			state.logger().Error("Looking up the Shelly IP in the info metric failed", "metric", cfg.ShellyInfoMetric, "error", err)
+			return
+		case cached == nil || cached.IP != ip:
+			state.logger().Info("Found the Shelly in the info metric", "ip", ip, "metric", cfg.ShellyInfoMetric)
+		}
+		cached = &InfoAddress{Name: name, IP: ip, Checked: now}
+		state.InfoAddress = cached
+	}
+	setShellyIP(state, cached.IP)
+}
+
+// setShellyIP caches the address of the Shelly normalized to a URL host, so IPv6 labels like
+// fd00::5054 get their brackets. An invalid address keeps the previous one. The caller holds state.mu.
+func setShellyIP(state *State, address string) {
+	host, err := deviceaddr.Host(address)
+	if err != nil {
+		state.logger().Warn("Ignoring the Shelly address from the metrics", "error", err)
+		return
+	}
+	state.ShellyIP = host
+}
+
+// useStaticIP sets SHELLY_IP as the Shelly address, skipping the lookup in the metrics. An address
+// label naming another device is logged once per address. The caller holds state.mu.
+func useStaticIP(cfg *config.Config, state *State, labelIP string) {
+	setShellyIP(state, cfg.ShellyIP)
+	host, err := deviceaddr.Host(labelIP)
+	if labelIP == "" || err != nil || host == state.ShellyIP {
+		state.LabelIPConflict = ""
+		return
+	}
+	if host != state.LabelIPConflict {
+		state.logger().Warn("The metrics report another Shelly address, using SHELLY_IP instead", "reported", host, "ip", state.ShellyIP)
+		state.LabelIPConflict = host
+	}
+}
@@ -0,0 +1,27 @@
+package controller
+
+import "testing"
+
+func TestSetShellyIP(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"192.168.1.42", "192.168.1.42"},
+		{"shelly-plug.lan", "shelly-plug.lan"},
+		// The ip_address label of an IPv6-only LAN
+		{"fd00::5054", "[fd00::5054]"},
+		{"[fd00::5054]:8080", "[fd00::5054]:8080"},
+		{"fe80::1%eth0", "[fe80::1%eth0]"},
+		// An invalid label keeps the address there was
+		{"http://192.168.1.42", "[fe80::1%eth0]"},
+		{"", "[fe80::1%eth0]"},
+	}
+	state := &State{}
+	for _, tt := range tests {
+		setShellyIP(state, tt.address)
+		if state.ShellyIP != tt.want {
+			t.Errorf("address %q: Shelly IP = %q, want %q", tt.address, state.ShellyIP, tt.want)
+		}
+	}
+}
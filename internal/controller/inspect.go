@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics"
+)
+
+// Inspection is what the gates see right now, as printed by the status subcommand
+type Inspection struct {
+	Device    string
+	Watts     float64
+	MetricAge time.Duration // Age of the latest power sample
+	Stale     bool          // The latest power sample is older than the metrics may be
+	Inputs    DecisionInputs
+	Decision  Decision
+}
+
+// OffConditionMet reports whether a check would switch the relay off now, before the veto window and
+// the pre-action hook
+func (s *Inspection) OffConditionMet() bool {
+	return !s.Stale && s.Decision.Outcome == OutcomeTurnOff
+}
+
+// Inspect runs the queries of a check and decides on them without switching the relay,
+// publishing a decision, saving the state or advancing what the cycles track
+func Inspect(ctx context.Context, cfg *config.Config, state *State) (*Inspection, error) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	now := state.Clock.Now()
+	reading, err := metrics.ShellyBambuWatts(ctx, state.Metrics, now, metrics.ConfigDevice(cfg), cfg.MaxMetricsAge())
+	if err != nil {
+		return nil, fmt.Errorf("getting shelly watts: %w", err)
+	}
+	state.DeviceName = reading.DeviceName
+	age, err := metrics.ShellyMetricsAge(ctx, state.Metrics, now, metrics.ConfigDevice(cfg), cfg.MaxMetricsAge())
+	if err != nil {
+		return nil, fmt.Errorf("checking the metric age: %w", err)
+	}
+	status := &Inspection{Device: reading.DeviceName, Watts: reading.Watts, Stale: age == nil || *age > cfg.MaxMetricsAge()}
+	if age != nil {
+		status.MetricAge = max(0, *age)
+	}
+
+	status.Inputs, err = gatherInputs(ctx, cfg, state, reading.Watts, false)
+	if err != nil {
+		return nil, err
+	}
+	status.Decision = Decide(status.Inputs)
+	return status, nil
+}
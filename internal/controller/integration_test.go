@@ -0,0 +1,299 @@
+package controller
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics"
+	"gome-assistant/internal/metrics/metricstest"
+	"gome-assistant/internal/printer"
+	"gome-assistant/internal/relay"
+	"gome-assistant/internal/shelly/shellytest"
+)
+
+// backends are the fake VictoriaMetrics and Shelly plug a controller runs against
+type backends struct {
+	vm   *metricstest.VM
+	plug *shellytest.Plug
+}
+
+// newIntegration wires a controller like main does, against fake backends and the default configuration.
+// configure adjusts the settings.
+func newIntegration(t *testing.T, clk clock.Clock, configure ...func(cfg *config.Config)) (*config.Config, *State, *backends) {
+	t.Helper()
+	b := &backends{vm: metricstest.NewVM(t), plug: shellytest.NewPlug(t, 1)}
+	cfg, state := newInstance(t, clk, b, configure...)
+	return cfg, state, b
+}
+
+// newInstance wires another controller against the fake backends, like a second container would be
+func newInstance(t *testing.T, clk clock.Clock, b *backends, configure ...func(cfg *config.Config)) (*config.Config, *State) {
+	t.Helper()
+	cfg := &config.Config{
+		VictoriaMetricsURL:   b.vm.URL,
+		ShellyDevicePattern:  ".*[Bb]ambu.*",
+		ShellyNameLabel:      "device_name",
+		ShellyAddressLabel:   "ip_address",
+		CheckInterval:        time.Minute,
+		MinWatts:             7,
+		MaxWatts:             9,
+		StandbyDuration:      15 * time.Minute,
+		BootGracePeriod:      20 * time.Minute,
+		OffCooldown:          10 * time.Minute,
+		QueryConcurrency:     4,
+		QueryTimeout:         10 * time.Second,
+		MaxRangePoints:       2000,
+		HeartbeatMode:        config.HeartbeatOff,
+		PreActionHookFailure: config.PreActionAllow,
+		PrinterSource:        config.PrinterSourceBambu,
+		RelayType:            config.RelayShelly,
+	}
+	for _, fn := range configure {
+		fn(cfg)
+	}
+
+	client := metrics.NewHTTPClient(cfg)
+	source, err := printer.New(cfg, client, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugRelay, err := relay.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := NewBus()
+	t.Cleanup(bus.Close)
+	return cfg, &State{Bus: bus, Metrics: client, Printer: source, Relay: plugRelay, Clock: clk}
+}
+
+// loadConfig runs config.Load on the arguments with a fresh command line
+func loadConfig(t *testing.T, args ...string) config.Config {
+	t.Helper()
+	commandLine, osArgs := flag.CommandLine, os.Args
+	t.Cleanup(func() { flag.CommandLine, os.Args = commandLine, osArgs })
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	os.Args = append([]string{"gome-assistant"}, args...)
+	return config.Load()
+}
+
+// phase is a stretch of the simulated history
+type phase struct {
+	length time.Duration
+	watts  float64
+	gcode  float64 // bambulab_gcode_state, 2 while printing
+}
+
+// setHistory replaces the series with the phases, the last one ending at end, sampled every 30 seconds
+// like the exporters are scraped
+func (b *backends) setHistory(end time.Time, phases ...phase) {
+	end = end.Truncate(time.Second)
+	start := end
+	for _, p := range phases {
+		start = start.Add(-p.length)
+	}
+	at := func(t time.Time) phase {
+		boundary := start
+		for _, p := range phases {
+			boundary = boundary.Add(p.length)
+			if t.Before(boundary) {
+				return p
+			}
+		}
+		return phases[len(phases)-1]
+	}
+	step := 30 * time.Second
+	b.vm.Set(
+		metricstest.Series{Labels: metricstest.ShellyWatts("bambu-plug", b.plug.Address()), Samples: metricstest.Samples(start, end, step, func(t time.Time) float64 { return at(t).watts })},
+		metricstest.Series{Labels: metricstest.GcodeState("x1c"), Samples: metricstest.Samples(start, end, step, func(t time.Time) float64 { return at(t).gcode })},
+	)
+}
+
+// expectDecision checks the decision of the last cycle
+func expectDecision(t *testing.T, state *State, step, outcome, reason string) {
+	t.Helper()
+	d := state.LastDecision
+	if d == nil {
+		t.Fatalf("%s: no decision, cycle error %q", step, state.LastCycleError)
+	}
+	if d.Outcome != outcome || d.Reason != reason {
+		t.Errorf("%s: decision = %s %q, want %s %q (cycle error %q)", step, d.Outcome, d.Reason, outcome, reason, state.LastCycleError)
+	}
+}
+
+func TestIntegrationPrintToAutoOff(t *testing.T) {
+	for _, gen := range []int{1, 2} {
+		t.Run(map[int]string{1: "gen1", 2: "gen2"}[gen], func(t *testing.T) {
+			b := &backends{vm: metricstest.NewVM(t), plug: shellytest.NewPlug(t, gen)}
+			cfg, state := newInstance(t, clock.Real{}, b)
+			now := time.Now()
+			print := phase{length: time.Hour, watts: 250, gcode: 2}
+
+			b.setHistory(now, phase{length: 10 * time.Minute, watts: 8}, print)
+			RunCycle(context.Background(), cfg, state)
+			expectDecision(t, state, "printing", OutcomeSkip, ReasonPrinting)
+			if state.ShellyIP != b.plug.Address() || state.DeviceName != "bambu-plug" {
+				t.Errorf("device = %q at %q, want bambu-plug at %q", state.DeviceName, state.ShellyIP, b.plug.Address())
+			}
+
+			b.setHistory(now, print, phase{length: 5 * time.Minute, watts: 8})
+			RunCycle(context.Background(), cfg, state)
+			expectDecision(t, state, "just printed", OutcomeSkip, ReasonPrintedRecently)
+
+			// Past the post-print cooldown, the print power is only left in the buffer before the window
+			b.setHistory(now, print, phase{length: 17 * time.Minute, watts: 8})
+			RunCycle(context.Background(), cfg, state)
+			expectDecision(t, state, "standby reached", OutcomeTurnOff, "")
+			if commands := b.plug.Commands(); len(commands) != 1 || commands[0].On || b.plug.On() {
+				t.Fatalf("relay commands = %v, want one off", commands)
+			}
+			if state.LastRelayOffTime == nil || state.RelayFailures != 0 || state.Daily.RelayOffs != 1 {
+				t.Errorf("after the auto-off: last off %v, failures %d, offs %d", state.LastRelayOffTime, state.RelayFailures, state.Daily.RelayOffs)
+			}
+
+			b.setHistory(now, print, phase{length: 17 * time.Minute, watts: 8}, phase{length: time.Minute, watts: 0})
+			RunCycle(context.Background(), cfg, state)
+			expectDecision(t, state, "off cooldown", OutcomeSkip, ReasonRecentlyOff)
+			if len(b.plug.Commands()) != 1 {
+				t.Errorf("relay commands after the auto-off: %v", b.plug.Commands())
+			}
+		})
+	}
+}
+
+func TestIntegrationBootGrace(t *testing.T) {
+	cfg, state, b := newIntegration(t, clock.Real{}, func(cfg *config.Config) { cfg.StandbyDuration = 5 * time.Minute })
+	// Switched on 8 minutes ago, the boot draw was short of a print
+	b.setHistory(time.Now(), phase{length: time.Hour, watts: 0}, phase{length: 2 * time.Minute, watts: 120}, phase{length: 6 * time.Minute, watts: 8})
+	RunCycle(context.Background(), cfg, state)
+	expectDecision(t, state, "boot grace", OutcomeSkip, ReasonBootGrace)
+	if len(b.plug.Commands()) != 0 {
+		t.Errorf("relay commands during the boot grace: %v", b.plug.Commands())
+	}
+}
+
+func TestIntegrationStaleMetrics(t *testing.T) {
+	cfg, state, b := newIntegration(t, clock.Real{}, func(cfg *config.Config) { cfg.StandbyDuration = 5 * time.Minute })
+	b.setHistory(time.Now().Add(-30*time.Minute), phase{length: time.Hour, watts: 8})
+	RunCycle(context.Background(), cfg, state)
+	if state.LastCycleError == "" || state.LastDecision != nil {
+		t.Errorf("stale metrics: error %q, decision %+v, want a failed cycle", state.LastCycleError, state.LastDecision)
+	}
+	if len(b.plug.Commands()) != 0 {
+		t.Errorf("relay commands on stale metrics: %v", b.plug.Commands())
+	}
+}
+
+func TestIntegrationFailingPlug(t *testing.T) {
+	cfg, state, b := newIntegration(t, clock.Real{}, func(cfg *config.Config) { cfg.RelayAttempts = 1 })
+	b.setHistory(time.Now(), phase{length: time.Hour, watts: 8})
+	b.plug.Fail(500)
+	RunCycle(context.Background(), cfg, state)
+	expectDecision(t, state, "failing plug", OutcomeTurnOff, "")
+	if state.LastCycleError == "" || state.RelayFailures != 1 || state.OffRetry == nil || state.LastRelayOffTime != nil {
+		t.Errorf("failed off: error %q, failures %d, retry %v, last off %v", state.LastCycleError, state.RelayFailures, state.OffRetry, state.LastRelayOffTime)
+	}
+}
+
+// setPrintByPower replaces the series with a print started from the screen of the printer, which the
+// exporter missed: gcode_state stays idle, the power draw between 110 and 260 W is the only sign of it.
+// The print ran for an hour and ended at printEnd, after that the printer stands by at 8 W.
+func (b *backends) setPrintByPower(now, printEnd time.Time) {
+	now = now.Truncate(time.Second)
+	start := printEnd.Add(-90 * time.Minute)
+	watts := func(t time.Time) float64 {
+		if t.Before(printEnd.Add(-time.Hour)) || !t.Before(printEnd) {
+			return 8
+		}
+		return 110 + float64(int(t.Sub(start)/(30*time.Second))*53%150)
+	}
+	b.vm.Set(
+		metricstest.Series{Labels: metricstest.ShellyWatts("bambu-plug", b.plug.Address()), Samples: metricstest.Samples(start, now, 30*time.Second, watts)},
+		metricstest.Series{Labels: metricstest.GcodeState("x1c"), Samples: metricstest.Constant(start, now, 30*time.Second, 0)},
+	)
+}
+
+func TestIntegrationPrintingByPower(t *testing.T) {
+	cfg, state, b := newIntegration(t, clock.Real{}, func(cfg *config.Config) {
+		cfg.PrintPowerWatts = 60
+		cfg.PrintPowerDuration = 3 * time.Minute
+		cfg.PrintPowerCooldown = 10 * time.Minute
+	})
+	ctx := context.Background()
+	now := time.Now()
+	steps := []struct {
+		sincePrint time.Duration // Since the print ended, negative while it runs
+		outcome    string
+		reason     string
+	}{
+		{-30 * time.Minute, OutcomeSkip, ReasonPrintingByPower},
+		{-time.Minute, OutcomeSkip, ReasonPrintingByPower},
+		{5 * time.Minute, OutcomeSkip, ReasonPrintingByPower},
+		// After the cooldown only the standby counting starts, the print draw is still in its window
+		{12 * time.Minute, OutcomeStandby, ""},
+		{40 * time.Minute, OutcomeTurnOff, ""},
+	}
+	for _, step := range steps {
+		b.setPrintByPower(now, now.Add(-step.sincePrint))
+		RunCycle(ctx, cfg, state)
+		expectDecision(t, state, fmt.Sprintf("%s after the print", step.sincePrint), step.outcome, step.reason)
+		if step.outcome != OutcomeTurnOff && len(b.plug.Commands()) != 0 {
+			t.Fatalf("%s after the print: relay commands %v", step.sincePrint, b.plug.Commands())
+		}
+	}
+	if b.plug.On() {
+		t.Error("relay still on after the standby")
+	}
+}
+
+func TestIntegrationPrinterUnreachable(t *testing.T) {
+	// Nothing listens on the PrusaLink URL, so the printer state is unknown
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	cfg, state, b := newIntegration(t, clock.Real{}, func(cfg *config.Config) {
+		cfg.PrinterSource = config.PrinterSourcePrusaLink
+		cfg.PrusaLinkURL = closed.URL
+		cfg.PrusaLinkAPIKey = "key"
+	})
+	b.setHistory(time.Now(), phase{length: time.Hour, watts: 8})
+	RunCycle(context.Background(), cfg, state)
+	if !strings.Contains(state.LastCycleError, "querying PrusaLink") {
+		t.Errorf("cycle error %q, want the unreachable printer", state.LastCycleError)
+	}
+	if len(b.plug.Commands()) != 0 {
+		t.Errorf("relay commands with an unknown printer state: %v", b.plug.Commands())
+	}
+}
+
+// TestIntegrationQueries pins the queries of a cycle with the default configuration
+func TestIntegrationQueries(t *testing.T) {
+	cfg, state, b := newIntegration(t, clock.Real{})
+	b.setHistory(time.Now(), phase{length: time.Hour, watts: 8})
+	RunCycle(context.Background(), cfg, state)
+
+	const device = `{device_name=~".*[Bb]ambu.*"}`
+	want := []string{
+		"bambulab_gcode_state",
+		"bambulab_gcode_state",
+		"last_over_time(shelly_watts" + device + "[120s])",
+		"max_over_time(bambulab_gcode_state[15m0s])",
+		"shelly_watts" + device,
+		"shelly_watts" + device,
+		"tfirst_over_time(shelly_watts" + device + "[1260s])",
+		"tlast_over_time(shelly_watts" + device + "[120s])",
+	}
+	got := b.vm.Queries()
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("queries of a cycle:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/printer"
+)
+
+// blockingSource is a printer state source whose first answer waits until release is closed
+type blockingSource struct {
+	printer.StateSource
+	once    sync.Once
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSource) Printing(ctx context.Context, now time.Time) (bool, error) {
+	s.once.Do(func() {
+		close(s.entered)
+		<-s.release
+	})
+	return s.StateSource.Printing(ctx, now)
+}
+
+// within fails the test if fn doesn't return in time, as it would waiting for the state lock
+func within(t *testing.T, what string, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s waited for the running cycle", what)
+	}
+}
+
+func TestCommandsDuringCycleQueries(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC))
+	cfg, state, b := newIntegration(t, clk)
+	source := &blockingSource{StateSource: state.Printer, entered: make(chan struct{}), release: make(chan struct{})}
+	state.Printer = source
+	b.setHistory(clk.Now(), phase{length: time.Hour, watts: 8})
+
+	cycleDone := make(chan struct{})
+	go func() {
+		defer close(cycleDone)
+		RunCycle(context.Background(), cfg, state)
+	}()
+	<-source.entered
+
+	// The status and the commands don't wait for the queries of the cycle
+	within(t, "GetStatus", func() { GetStatus(cfg, state) })
+	within(t, "GetCountdown", func() { GetCountdown(cfg, state) })
+	within(t, "SetHold", func() { SetHold(state, time.Hour, "test") })
+	close(source.release)
+	<-cycleDone
+
+	// The gates were queried before the hold, the cycle doesn't act on them
+	expectDecision(t, state, "hold during the queries", OutcomeSkip, ReasonInterrupted)
+	if !b.plug.On() {
+		t.Error("the relay was switched off despite the hold")
+	}
+}
+
+func TestCommandsDuringRelayRetries(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC))
+	cfg, state, b := newIntegration(t, clk, func(cfg *config.Config) {
+		cfg.RelayAttempts, cfg.RelayRetryDelay = 3, time.Minute
+	})
+	b.setHistory(clk.Now(), phase{length: time.Hour, watts: 8})
+	b.plug.Fail(500)
+
+	cycleDone := make(chan struct{})
+	go func() {
+		defer close(cycleDone)
+		RunCycle(context.Background(), cfg, state)
+	}()
+	for clk.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The backoff between the attempts doesn't hold the state lock either
+	within(t, "GetStatus", func() { GetStatus(cfg, state) })
+	within(t, "SetHold", func() { SetHold(state, time.Hour, "test") })
+	b.plug.Fail(0)
+	clk.Advance(time.Minute)
+	<-cycleDone
+
+	// The hold ends the retries instead of switching off after all
+	if !b.plug.On() || state.OffRetry != nil || state.RelayFailures != 0 {
+		t.Errorf("plug on %v, retry %v, %d failures, want the auto-off dropped", b.plug.On(), state.OffRetry, state.RelayFailures)
+	}
+	if state.LastCycleError != "" {
+		t.Errorf("cycle error %q, want none", state.LastCycleError)
+	}
+}
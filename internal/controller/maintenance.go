@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"strings"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// parseMaintenanceMetrics parses the semicolon-separated MAINTENANCE_METRICS. Selectors may contain commas.
+func parseMaintenanceMetrics(s string) []string {
+	var queries []string
+	for _, query := range strings.Split(s, ";") {
+		if query = strings.TrimSpace(query); query != "" {
+			queries = append(queries, query)
+		}
+	}
+	return queries
+}
+
+// trackMaintenance keeps when the current update or processing state started and notifies once when
+// it holds for longer than MaintenanceNotifyAfter. The caller holds state.mu.
+func trackMaintenance(cfg *config.Config, state *State, now time.Time, active string, missing []string) {
+	nowMissing := map[string]bool{}
+	for _, query := range missing {
+		nowMissing[query] = true
+		if !state.MaintenanceMissing[query] {
+			state.logger().Warn("Maintenance metric not found, ignoring it while it is missing", "query", query)
+		}
+	}
+	for query := range state.MaintenanceMissing {
+		if !nowMissing[query] {
+			state.logger().Info("Maintenance metric found", "query", query)
+		}
+	}
+	state.MaintenanceMissing = nowMissing
+
+	if active == "" {
+		if state.MaintenanceSince != nil {
+			state.logger().Info("Update or processing finished", "after", now.Sub(*state.MaintenanceSince).Round(time.Second))
+		}
+		state.MaintenanceSince = nil
+		state.MaintenanceNotified = false
+		state.MaintenanceExpired = false
+		return
+	}
+
+	if state.MaintenanceSince == nil {
+		state.logger().Info("Update or processing in progress, holding power", "state", active)
+		state.MaintenanceSince = &now
+	}
+	held := now.Sub(*state.MaintenanceSince)
+	if held >= cfg.MaintenanceNotifyAfter && !state.MaintenanceNotified {
+		state.MaintenanceNotified = true
+		state.Bus.Publish(MaintenanceHoldLong{Time: now, Device: state.DeviceName, Metric: active, Since: *state.MaintenanceSince})
+	}
+	if held >= cfg.MaintenanceMaxHold && !state.MaintenanceExpired {
+		state.MaintenanceExpired = true
+		state.logger().Warn("Update or processing reported for too long, assuming it is stuck and no longer holding power", "state", active, "held", held.Round(time.Second))
+	}
+}
@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics"
+)
+
+// ManualSwitch switches the relay for the on and off subcommands. The device is resolved like a check
+// does, falling back to SHELLY_IP or the address of STATE_FILE when the metrics can't be read. Switching
+// off is refused with ErrPrinting while a print is in progress unless force is set.
+func ManualSwitch(ctx context.Context, cfg *config.Config, state *State, on, force bool) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	now := state.Clock.Now()
+	reading, err := metrics.ShellyBambuWatts(ctx, state.Metrics, now, metrics.ConfigDevice(cfg), cfg.MaxMetricsAge())
+	switch {
+	case err == nil:
+		resolveDevice(ctx, cfg, state, reading)
+	case cfg.ShellyIP != "":
+		useStaticIP(cfg, state, "")
+	case state.ShellyIP != "":
+		state.logger().Warn("Getting the Shelly power failed, using the Shelly address of the state file", "ip", state.ShellyIP, "error", err)
+	default:
+		state.logger().Error("Getting the Shelly power failed", "error", err)
+		if cfg.ShellyMDNS {
+			discoverShelly(ctx, cfg, state)
+		}
+	}
+
+	if !on && !force {
+		printing, err := state.Printer.Printing(ctx, now)
+		if err != nil {
+			return fmt.Errorf("checking print status: %w", err)
+		}
+		if printing {
+			return ErrPrinting
+		}
+	}
+	return switchRelay(cfg, state, on, SourceCLI)
+}
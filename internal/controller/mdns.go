@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/shelly"
+)
+
+// mdnsTimeout is how long a discovery listens for answers
+const mdnsTimeout = 3 * time.Second
+
+// mdnsRetry is how long a discovery that found nothing waits before browsing again
+const mdnsRetry = time.Minute
+
+// discoverShelly looks for the Shelly via mDNS when the metrics have no address, matching the instance
+// names against SHELLY_DEVICE_PATTERN. The address is kept until a relay command can't connect to it.
+// The caller holds state.mu, which is released while it listens.
+func discoverShelly(ctx context.Context, cfg *config.Config, state *State) {
+	if state.MDNSAddress != "" {
+		setShellyIP(state, state.MDNSAddress)
+		return
+	}
+	now := state.Clock.Now()
+	if state.MDNSCheckedAt != nil && now.Sub(*state.MDNSCheckedAt) < mdnsRetry {
+		return
+	}
+	state.MDNSCheckedAt = &now
+
+	pattern, err := regexp.Compile(cfg.ShellyDevicePattern)
+	if err != nil {
+		state.logger().Error("Compiling SHELLY_DEVICE_PATTERN for mDNS failed", "error", err)
+		return
+	}
+	var found shelly.Discovered
+	state.unlocked(func() { found, err = shelly.Discover(ctx, pattern, mdnsTimeout) })
+	if err != nil {
+		state.logger().Warn("mDNS discovery of the Shelly failed", "retry_in", mdnsRetry, "error", err)
+		return
+	}
+	state.logger().Info("Discovered the Shelly via mDNS", "shelly", found.Instance, "ip", found.Address)
+	state.MDNSAddress = found.Address
+	setShellyIP(state, found.Address)
+}
@@ -0,0 +1,14 @@
+package controller
+
+// MemoryUsage is how full a bounded in-memory store is, for /status and /probe
+type MemoryUsage struct {
+	Store   string `json:"store"`
+	Entries int    `json:"entries"`
+	Budget  int    `json:"budget"`
+	Evicted int    `json:"evicted"` // Oldest entries dropped to stay within the budget
+}
+
+// MemoryStore is an in-memory store bounded by an entry budget, dropping its oldest entries when full
+type MemoryStore interface {
+	Usage() MemoryUsage
+}
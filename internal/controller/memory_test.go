@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+)
+
+func TestRingBudget(t *testing.T) {
+	tests := []struct {
+		size, added int
+	}{
+		{1, 0}, {1, 1}, {1, 5}, {3, 2}, {3, 3}, {3, 4}, {720, 10000},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d of %d", tt.added, tt.size), func(t *testing.T) {
+			r := newRing[int]("test", tt.size)
+			for i := range tt.added {
+				r.Add(i)
+			}
+			want := MemoryUsage{Store: "test", Entries: min(tt.added, tt.size), Budget: tt.size, Evicted: max(tt.added-tt.size, 0)}
+			if got := r.Usage(); got != want {
+				t.Errorf("usage = %+v, want %+v", got, want)
+			}
+			// The oldest are the ones dropped
+			recent := r.Recent(0)
+			if len(recent) != want.Entries {
+				t.Fatalf("%d recent items, want %d", len(recent), want.Entries)
+			}
+			for i, item := range recent {
+				if item != tt.added-1-i {
+					t.Fatalf("recent = %v, want the newest first", recent)
+				}
+			}
+			if limited := r.Recent(2); len(limited) != min(2, want.Entries) {
+				t.Errorf("Recent(2) = %v", limited)
+			}
+		})
+	}
+}
+
+// TestMemoryBudgetsOverManyCycles runs thousands of cycles of many devices against one history, like
+// DEVICES does, and checks that the stores stay within their budgets
+func TestMemoryBudgetsOverManyCycles(t *testing.T) {
+	const devices, rounds = 8, 125
+	const decisionBudget, actionBudget = 50, 20
+	ctx := context.Background()
+	clk := clock.NewFake(time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC))
+	budgets := func(cfg *config.Config) {
+		cfg.StandbyDuration = 3 * time.Minute
+		cfg.BootGracePeriod = time.Minute
+		cfg.OffCooldown = 0
+		cfg.DecisionHistorySize = decisionBudget
+		cfg.ActionHistorySize = actionBudget
+	}
+
+	cfg, _, _ := newIntegration(t, clk, budgets)
+	bus := NewBus()
+	hist := NewHistory(cfg)
+	bus.Subscribe("history", DefaultBusBuffer, hist.Handle)
+	type device struct {
+		cfg   *config.Config
+		b     *backends
+		state *State
+	}
+	var all []device
+	for range devices {
+		dcfg, state, b := newIntegration(t, clk, budgets)
+		state.Bus = bus
+		state.Stores = []MemoryStore{hist.Decisions, hist.Actions}
+		all = append(all, device{cfg: dcfg, b: b, state: state})
+	}
+
+	offs := 0
+	for round := range rounds {
+		for i, d := range all {
+			// Every few rounds a device is switched back on, so actions keep coming
+			if (round+i)%5 == 0 && !d.b.plug.On() {
+				d.b.plug.SetOn(true)
+			}
+			watts := 8.0
+			if !d.b.plug.On() {
+				watts = 0
+			}
+			d.b.setHistory(clk.Now(), phase{length: 10 * time.Minute, watts: watts})
+			RunCycle(ctx, d.cfg, d.state)
+			if d.state.LastDecision != nil && d.state.LastDecision.Outcome == OutcomeTurnOff {
+				offs++
+			}
+			// Only the commands of the last hour are kept for the rate limits
+			if n := len(d.state.Actuations); n > 60 {
+				t.Fatalf("round %d: %d actuations kept", round, n)
+			}
+		}
+		for _, store := range all[0].state.Stores {
+			if u := store.Usage(); u.Entries > u.Budget {
+				t.Fatalf("round %d: %s holds %d entries, over its budget of %d", round, u.Store, u.Entries, u.Budget)
+			}
+		}
+		clk.Advance(cfg.CheckInterval)
+	}
+	bus.Close()
+
+	if offs < rounds {
+		t.Fatalf("%d auto-offs in %d cycles, want actions to fill the action history", offs, devices*rounds)
+	}
+	decisions, actions := hist.Decisions.Usage(), hist.Actions.Usage()
+	if want := (MemoryUsage{Store: "decisions", Entries: decisionBudget, Budget: decisionBudget, Evicted: devices*rounds - decisionBudget}); decisions != want {
+		t.Errorf("decisions = %+v, want %+v", decisions, want)
+	}
+	if want := (MemoryUsage{Store: "actions", Entries: actionBudget, Budget: actionBudget, Evicted: offs - actionBudget}); actions != want {
+		t.Errorf("actions = %+v, want %+v", actions, want)
+	}
+	// What is kept are the decisions of the last rounds
+	end := clk.Now().Add(-cfg.CheckInterval)
+	for _, d := range hist.Decisions.Recent(0) {
+		if end.Sub(d.Time) > time.Duration(decisionBudget/devices+1)*cfg.CheckInterval {
+			t.Errorf("decision of %s kept at %s", d.Time, end)
+			break
+		}
+	}
+	if status := GetStatus(all[0].cfg, all[0].state); len(status.Memory) != 2 || status.Memory[0] != decisions || status.Memory[1] != actions {
+		t.Errorf("status memory = %+v, want %+v and %+v", status.Memory, decisions, actions)
+	}
+}
+
+// TestHistoryBudgetsOverEvents feeds the history the events of a week of cycles of a hundred devices
+func TestHistoryBudgetsOverEvents(t *testing.T) {
+	const devices, cycles = 100, 7 * 24 * 60
+	hist := NewHistory(&config.Config{DecisionHistorySize: 720, ActionHistorySize: 100})
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	for cycle := range cycles {
+		now := start.Add(time.Duration(cycle) * time.Minute)
+		for i := range devices {
+			device := fmt.Sprintf("plug-%d", i)
+			hist.Handle(DecisionMade{Time: now, Device: device, Outcome: OutcomeStandby})
+			if (cycle+i)%60 == 0 {
+				hist.Handle(ActionExecuted{Time: now, Device: device, Action: ActionOff, Source: SourceAuto})
+			}
+		}
+		if u := hist.Decisions.Usage(); u.Entries > u.Budget {
+			t.Fatalf("cycle %d: %d decisions kept, over the budget of %d", cycle, u.Entries, u.Budget)
+		}
+	}
+
+	if u := hist.Decisions.Usage(); u.Entries != 720 || u.Evicted != devices*cycles-720 {
+		t.Errorf("decisions = %+v", u)
+	}
+	if u := hist.Actions.Usage(); u.Entries != 100 || u.Evicted != devices*cycles/60-100 {
+		t.Errorf("actions = %+v", u)
+	}
+	// 720 decisions of a hundred devices are the last 7 cycles and the last 20 devices of the one before
+	if oldest := hist.Decisions.Recent(0)[719]; oldest.Time != start.Add((cycles-8)*time.Minute) || oldest.Device != "plug-80" {
+		t.Errorf("oldest decision kept = %+v", oldest)
+	}
+}
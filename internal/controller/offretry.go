@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// OffRetry is an auto-off whose relay command still failed after RELAY_ATTEMPTS attempts
+type OffRetry struct {
+	Since           time.Time     // When the auto-off failed first
+	StandbyDuration time.Duration // Standby duration the auto-off was decided on
+}
+
+// offRetryObstacle returns why a failed auto-off must not be repeated without evaluating the gates
+// again, or "" if it can be. The caller holds state.mu.
+func offRetryObstacle(cfg *config.Config, state *State, watts float64) string {
+	now := state.Clock.Now()
+	switch {
+	case state.HoldUntil != nil && now.Before(*state.HoldUntil):
+		return "manual hold active"
+	case state.Calendar.Active(now) != nil:
+		return "calendar hold active"
+	case activeAlertPause(state, now) != nil:
+		return "automation paused by a firing alert"
+	case state.VetoTime != nil && state.VetoTime.After(state.OffRetry.Since):
+		return "vetoed since"
+	case watts < cfg.MinWatts || watts > cfg.MaxWatts:
+		return fmt.Sprintf("%.1fW is outside the standby range of %.1f - %.1fW", watts, cfg.MinWatts, cfg.MaxWatts)
+	case !state.Leader.IsLeader():
+		return "not the leader"
+	}
+	return ""
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+)
+
+// failedOff returns a controller on a fake clock whose auto-off failed, a cycle after it, with the plug
+// working again
+func failedOff(t *testing.T, configure ...func(cfg *config.Config)) (*config.Config, *State, *backends, *clock.Fake) {
+	t.Helper()
+	clk := clock.NewFake(time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC))
+	cfg, state, b := newIntegration(t, clk, append([]func(cfg *config.Config){func(cfg *config.Config) { cfg.RelayAttempts = 1 }}, configure...)...)
+	b.plug.Fail(500)
+	// A veto window or the re-verification take a few cycles
+	for range 10 {
+		b.setHistory(clk.Now(), phase{length: time.Hour, watts: 8})
+		if RunCycle(context.Background(), cfg, state); state.OffRetry != nil {
+			break
+		}
+		clk.Advance(cfg.CheckInterval)
+	}
+	if state.OffRetry == nil {
+		t.Fatalf("no retry after the failed off, decision %+v, cycle error %q", state.LastDecision, state.LastCycleError)
+	}
+	b.plug.Fail(0)
+	clk.Advance(cfg.CheckInterval)
+	return cfg, state, b, clk
+}
+
+func TestOffRetry(t *testing.T) {
+	cfg, state, b, clk := failedOff(t)
+	standby := state.OffRetry.StandbyDuration
+	// The standby streak isn't counted again, a regular evaluation would still be standing by
+	b.setHistory(clk.Now(), phase{length: time.Hour, watts: 20}, phase{length: 2 * time.Minute, watts: 8})
+
+	RunCycle(context.Background(), cfg, state)
+	expectDecision(t, state, "retry", OutcomeTurnOff, "")
+	if b.plug.On() || state.OffRetry != nil || state.LastDecision.StandbyDuration != standby {
+		t.Errorf("plug on %v, retry %v, standby %s, want it off on the %s it was decided on", b.plug.On(), state.OffRetry, state.LastDecision.StandbyDuration, standby)
+	}
+}
+
+func TestOffRetryGates(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(cfg *config.Config)
+		history []phase
+		keep    bool // Whether the retry is still pending after the cycle
+		outcome string
+		reason  string
+	}{
+		{"printing", nil, []phase{{length: time.Hour, watts: 8, gcode: 2}}, false, OutcomeSkip, ReasonPrinting},
+		{"boot grace", nil, []phase{{length: time.Hour, watts: 0}, {length: time.Minute, watts: 30}, {length: 5 * time.Minute, watts: 8}}, false, OutcomeSkip, ReasonBootGrace},
+		{"maintenance", func(cfg *config.Config) {
+			cfg.MaintenanceMetrics, cfg.MaintenanceMaxHold = "firmware_updating", 2*time.Hour
+		}, nil, false, OutcomeSkip, ReasonMaintenance},
+		// The holdups of the command let the retry wait for the next cycle
+		{"rate limit", limits(0, 1), nil, true, OutcomeSkip, ReasonRateLimited},
+		{"veto window", func(cfg *config.Config) { cfg.VetoWindow = 5 * time.Minute }, nil, false, OutcomeTurnOff, ""},
+		{"re-verification", func(cfg *config.Config) { cfg.OffRecheck = true }, nil, false, OutcomeTurnOff, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var configure []func(cfg *config.Config)
+			if tt.set != nil {
+				configure = append(configure, tt.set)
+			}
+			cfg, state, b, clk := failedOff(t, configure...)
+			history := tt.history
+			if history == nil {
+				history = []phase{{length: time.Hour, watts: 8}}
+			}
+			b.setHistory(clk.Now(), history...)
+			if cfg.MaintenanceMetrics != "" {
+				b.vm.Add(map[string]string{"__name__": "firmware_updating"}, stageSeries(clk.Now(), 1).Samples...)
+			}
+
+			RunCycle(context.Background(), cfg, state)
+			expectDecision(t, state, tt.name, tt.outcome, tt.reason)
+			if off := tt.outcome == OutcomeTurnOff; b.plug.On() == off {
+				t.Errorf("plug on %v after %s", b.plug.On(), tt.outcome)
+			}
+			if (state.OffRetry != nil) != tt.keep {
+				t.Errorf("retry = %v, want kept %v", state.OffRetry, tt.keep)
+			}
+		})
+	}
+}
+
+func TestOffRetryPreActionHook(t *testing.T) {
+	allowing, _ := newHook(t, http.StatusOK, `{"allow": true}`, 0)
+	cfg, state, b, clk := failedOff(t, func(cfg *config.Config) { cfg.PreActionHookURL = allowing.URL })
+	hook, requests := newHook(t, http.StatusOK, `{"allow": false, "reason": "printer cooling down"}`, 0)
+	cfg.PreActionHookURL = hook.URL
+
+	RunCycle(context.Background(), cfg, state)
+	expectDecision(t, state, "denied retry", OutcomeSkip, ReasonVetoed)
+	if req := <-requests; req.Action != ActionOff || req.StandbySeconds != int(state.LastEvaluation.StandbyDuration.Seconds()) {
+		t.Errorf("hook request = %+v, want the retried off", req)
+	}
+
+	// Like a manual veto it ends the retry, the standby clock starts over
+	clk.Advance(cfg.CheckInterval)
+	b.setHistory(clk.Now(), phase{length: time.Hour, watts: 8})
+	RunCycle(context.Background(), cfg, state)
+	if state.OffRetry != nil || !b.plug.On() {
+		t.Errorf("retry %v, plug on %v after the veto", state.OffRetry, b.plug.On())
+	}
+}
+
+func TestOffRetryDuplicateController(t *testing.T) {
+	cfg, state, b, clk := failedOff(t, guard("a"))
+	otherCfg, other := newInstance(t, clk, b, guard("b"))
+	// The other instance started checking the device since the failure
+	b.setHistory(clk.Now(), phase{length: time.Hour, watts: 8})
+	RunCycle(context.Background(), otherCfg, other)
+
+	RunCycle(context.Background(), cfg, state)
+	expectDecision(t, state, "retry next to b", OutcomeSkip, ReasonDuplicate)
+	if state.OffRetry == nil {
+		t.Error("retry dropped by the duplicate guard, want it kept for the next cycle")
+	}
+}
@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/printer"
+)
+
+// slowSource is a printer state source whose answers take delay on the fake clock, like a VM under load
+type slowSource struct {
+	printer.StateSource
+	clock *clock.Fake
+	delay time.Duration
+	calls int
+}
+
+func (s *slowSource) Printing(ctx context.Context, now time.Time) (bool, error) {
+	s.calls++
+	s.clock.Advance(s.delay)
+	return s.StateSource.Printing(ctx, now)
+}
+
+// newSlowController returns a controller in standby whose print status query takes delay, its log and
+// a function running a check of the loop
+func newSlowController(t *testing.T, delay time.Duration, overrun string) (*config.Config, *State, *slowSource, *bytes.Buffer, func() time.Duration) {
+	t.Helper()
+	ctx := context.Background()
+	clk := clock.NewFake(time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC))
+	cfg, state, b := newIntegration(t, clk, func(cfg *config.Config) { cfg.CycleOverrun = overrun })
+	source := &slowSource{StateSource: state.Printer, clock: clk, delay: delay}
+	state.Printer = source
+	var log bytes.Buffer
+	state.Log = slog.New(slog.NewTextHandler(&log, nil))
+	b.setHistory(clk.Now(), phase{length: time.Hour, watts: 8})
+	return cfg, state, source, &log, func() time.Duration { return loopCycle(ctx, cfg, state, clk, b) }
+}
+
+func TestCycleOverrunSkip(t *testing.T) {
+	cfg, state, source, log, cycle := newSlowController(t, 150*time.Second, config.CycleOverrunSkip)
+
+	// A cycle of 2.5 intervals drops the two checks that fell due and waits the whole interval
+	if next := cycle(); next != time.Minute {
+		t.Errorf("next check in %s, want the interval", next)
+	}
+	expectDecision(t, state, "slow cycle", OutcomeTurnOff, "")
+	if state.SkippedCycles != 2 {
+		t.Errorf("%d skipped cycles, want 2", state.SkippedCycles)
+	}
+	if out := log.String(); !strings.Contains(out, "skipping the missed checks") || !strings.Contains(out, "took=2m30s interval=1m0s skipped=2 skipped_total=2") {
+		t.Errorf("log = %q, want the skip", out)
+	}
+
+	// Exactly the interval misses the check due at its end, a faster cycle none
+	source.delay = time.Minute
+	cycle()
+	source.delay = 59 * time.Second
+	cycle()
+	if state.SkippedCycles != 3 || source.calls != 3 {
+		t.Errorf("%d skipped cycles after %d, want 3 after 3", state.SkippedCycles, source.calls)
+	}
+	if status := GetStatus(cfg, state); status.SkippedCycles != 3 {
+		t.Errorf("status skipped cycles = %d, want 3", status.SkippedCycles)
+	}
+}
+
+func TestCycleOverrunQueue(t *testing.T) {
+	_, state, source, log, cycle := newSlowController(t, 150*time.Second, config.CycleOverrunQueue)
+
+	// However many checks fell due, exactly one runs right away
+	if next := cycle(); next != 0 {
+		t.Errorf("next check in %s, want right away", next)
+	}
+	if !strings.Contains(log.String(), "running the next check right away") {
+		t.Errorf("log = %q, want the queued check", log.String())
+	}
+	source.delay = time.Second
+	if next := cycle(); next != time.Minute {
+		t.Errorf("next check after the queued one in %s, want the interval", next)
+	}
+	if state.SkippedCycles != 0 || source.calls != 2 {
+		t.Errorf("%d skipped cycles after %d, want none after 2", state.SkippedCycles, source.calls)
+	}
+}
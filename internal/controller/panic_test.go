@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics"
+	"gome-assistant/internal/printer"
+)
+
+// panickingMetrics is a metrics client that panics on the first panics checks of recent metrics,
+// which run in the goroutine of the check
+type panickingMetrics struct {
+	metrics.Client
+
+	mu     sync.Mutex
+	panics int
+}
+
+func (m *panickingMetrics) QueryInstant(ctx context.Context, promql string, at time.Time) ([]metrics.Series, error) {
+	if strings.HasPrefix(promql, "tlast_over_time") {
+		m.mu.Lock()
+		panics := m.panics > 0
+		m.panics--
+		m.mu.Unlock()
+		if panics {
+			var seen map[string]bool
+			seen[promql] = true // A nil map write, like a bug would
+		}
+	}
+	return m.Client.QueryInstant(ctx, promql, at)
+}
+
+// panickingSource is a printer state source that panics while panics is set
+type panickingSource struct {
+	printer.StateSource
+	panics bool
+}
+
+func (s *panickingSource) Printing(ctx context.Context, now time.Time) (bool, error) {
+	if s.panics {
+		panic("printer source exploded")
+	}
+	return s.StateSource.Printing(ctx, now)
+}
+
+// fastRetries sets the default RETRY_* and OUTAGE_* settings
+func fastRetries(cfg *config.Config) {
+	cfg.RetryDelay = 10 * time.Second
+	cfg.RetryMax = 5
+	cfg.OutageBackoffAfter = 10 * time.Minute
+	cfg.OutageMaxInterval = 10 * time.Minute
+}
+
+// loopCycle runs a check like the loop of main does, stepping the clock to the next one, and returns
+// the delay
+func loopCycle(ctx context.Context, cfg *config.Config, state *State, clk *clock.Fake, b *backends) time.Duration {
+	next := RunCycle(ctx, cfg, state)
+	clk.Advance(next)
+	watts := 8.0
+	if !b.plug.On() {
+		watts = 0
+	}
+	b.setHistory(clk.Now(), phase{length: time.Hour, watts: watts})
+	return next
+}
+
+func TestCyclePanicKeepsTheLoopRunning(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC))
+	cfg, state, b := newIntegration(t, clk, fastRetries)
+	events := &collector{}
+	state.Bus.Subscribe("test", 100, events.Handle)
+	state.Metrics = &panickingMetrics{Client: state.Metrics, panics: 3}
+	b.setHistory(clk.Now(), phase{length: time.Hour, watts: 8})
+
+	// A panic on every check goes on like a failed check, with the fast retries
+	for i := 1; i <= 3; i++ {
+		next := loopCycle(ctx, cfg, state, clk, b)
+		expectDecision(t, state, "panicking check", OutcomeSkip, ReasonPanic)
+		if !strings.HasPrefix(state.LastCycleError, "check panicked: assignment to entry in nil map") {
+			t.Errorf("cycle %d: error %q, want the panic", i, state.LastCycleError)
+		}
+		if next != cfg.RetryDelay || state.FastRetries != i || state.Daily.Errors != i || state.Daily.Cycles != i {
+			t.Errorf("cycle %d: next in %s, %d fast retries, %d errors in %d cycles", i, next, state.FastRetries, state.Daily.Errors, state.Daily.Cycles)
+		}
+		if state.LastDecision.Watts != 8 {
+			t.Errorf("cycle %d: decision watts = %g, want the last reading", i, state.LastDecision.Watts)
+		}
+	}
+	if !b.plug.On() {
+		t.Fatal("plug switched off by a panicking check")
+	}
+
+	// Once the check works again the loop carries on where it was
+	next := loopCycle(ctx, cfg, state, clk, b)
+	expectDecision(t, state, "working check", OutcomeTurnOff, "")
+	if b.plug.On() || state.LastCycleError != "" || state.FastRetries != 0 || next != cfg.CheckInterval {
+		t.Errorf("after the panics: plug on %v, error %q, %d fast retries, next in %s", b.plug.On(), state.LastCycleError, state.FastRetries, next)
+	}
+	if state.Daily.Cycles != 4 || state.Daily.RelayOffs != 1 {
+		t.Errorf("%d cycles with %d offs, want 4 with one", state.Daily.Cycles, state.Daily.RelayOffs)
+	}
+
+	state.Bus.Close()
+	var panicked []CyclePanicked
+	var completed int
+	for _, ev := range events.received() {
+		switch e := ev.(type) {
+		case CyclePanicked:
+			panicked = append(panicked, e)
+		case CycleCompleted:
+			completed++
+		}
+	}
+	if len(panicked) != 3 || completed != 4 {
+		t.Fatalf("%d panics published and %d cycles completed, want 3 and 4", len(panicked), completed)
+	}
+	// The stack goes to the audit log and the notification, it has to lead to the bug
+	if p := panicked[0]; p.Device != "bambu-plug" || p.Value != "assignment to entry in nil map" || !strings.Contains(p.Stack, "(*panickingMetrics).QueryInstant") {
+		t.Errorf("published %+v, want the panic with the stack of the client", p)
+	}
+}
+
+func TestQueryPanicKeepsTheLoopRunning(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC))
+	cfg, state, b := newIntegration(t, clk, fastRetries)
+	source := &panickingSource{StateSource: state.Printer, panics: true}
+	state.Printer = source
+	b.setHistory(clk.Now(), phase{length: time.Hour, watts: 8})
+
+	// The queries run in goroutines of their own, where the check's recover doesn't reach
+	next := loopCycle(ctx, cfg, state, clk, b)
+	if want := "checking print status: panic: printer source exploded"; state.LastCycleError != want {
+		t.Errorf("cycle error = %q, want %q", state.LastCycleError, want)
+	}
+	if next != cfg.RetryDelay || len(b.plug.Commands()) != 0 {
+		t.Errorf("next in %s with relay commands %v, want a retry without any", next, b.plug.Commands())
+	}
+
+	source.panics = false
+	loopCycle(ctx, cfg, state, clk, b)
+	expectDecision(t, state, "source working again", OutcomeTurnOff, "")
+}
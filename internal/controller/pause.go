@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// AlertPause is a firing alert that pauses automatic switching
+type AlertPause struct {
+	AlertName string    `json:"alert_name"`
+	Since     time.Time `json:"since"`
+	Expires   time.Time `json:"expires"`
+}
+
+// activeAlertPause returns a pause by a firing alert, dropping pauses whose safety timeout passed.
+// The caller must hold state.mu.
+func activeAlertPause(state *State, now time.Time) *AlertPause {
+	var active *AlertPause
+	for key, pause := range state.AlertPauses {
+		if !now.Before(pause.Expires) {
+			state.logger().Info("Pause by an alert expired without being resolved, resuming automation", "alert", pause.AlertName)
+			delete(state.AlertPauses, key)
+			continue
+		}
+		if active == nil || pause.Since.Before(active.Since) {
+			p := pause
+			active = &p
+		}
+	}
+	return active
+}
+
+// AlertUpdate is the reported state of an alert that pauses automation
+type AlertUpdate struct {
+	Key       string // Identifies the alert across notifications
+	AlertName string
+	Firing    bool // Firing or resolved
+}
+
+// ApplyAlertUpdates pauses automation for firing alerts and resumes it for resolved ones.
+// It returns the number of active pauses.
+func ApplyAlertUpdates(cfg *config.Config, state *State, updates []AlertUpdate) int {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	now := state.Clock.Now()
+	if state.AlertPauses == nil {
+		state.AlertPauses = map[string]AlertPause{}
+	}
+	for _, u := range updates {
+		pause, active := state.AlertPauses[u.Key]
+		switch {
+		case u.Firing:
+			if !active {
+				pause = AlertPause{AlertName: u.AlertName, Since: now}
+				state.commands++
+				state.logger().Info("Alert firing, pausing automation", "alert", u.AlertName)
+			}
+			pause.Expires = now.Add(cfg.AlertmanagerPauseTimeout)
+			state.AlertPauses[u.Key] = pause
+		case active:
+			delete(state.AlertPauses, u.Key)
+			state.logger().Info("Alert resolved", "alert", u.AlertName)
+		}
+	}
+	return len(state.AlertPauses)
+}
@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gome-assistant/internal/atomicfile"
+	"gome-assistant/internal/config"
+)
+
+// stateFileSchemaVersion is bumped on incompatible changes of the state file
+const stateFileSchemaVersion = 1
+
+// PersistedState is the part of the state that survives a restart in STATE_FILE
+type PersistedState struct {
+	SchemaVersion         int                `json:"schema_version"`
+	Saved                 time.Time          `json:"saved"`
+	Device                string             `json:"device,omitempty"`
+	StandbyStart          *time.Time         `json:"standby_start,omitempty"`
+	AnnouncedStandbyStart *time.Time         `json:"announced_standby_start,omitempty"`
+	PendingOffSince       *time.Time         `json:"pending_off_since,omitempty"`
+	ArmedSince            *time.Time         `json:"armed_since,omitempty"`
+	VetoTime              *time.Time         `json:"veto_time,omitempty"`
+	LastRelayOff          *time.Time         `json:"last_relay_off,omitempty"`
+	ShellyIP              string             `json:"shelly_ip,omitempty"`
+	PrinterStates         map[string]float64 `json:"printer_states,omitempty"`
+}
+
+// LoadState reads STATE_FILE for the first evaluation to validate. A missing file is no error, and a
+// file older than StandbyDuration is ignored: whatever happened in the meantime, the streak is over.
+func LoadState(cfg *config.Config, state *State) error {
+	data, err := os.ReadFile(cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var persisted PersistedState
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return fmt.Errorf("parsing %s: %w", cfg.StateFile, err)
+	}
+	if persisted.SchemaVersion != stateFileSchemaVersion {
+		return fmt.Errorf("%s has schema version %d, expected %d", cfg.StateFile, persisted.SchemaVersion, stateFileSchemaVersion)
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	// A veto keeps restarting the standby clock and the cooldown runs out on its own, however old the file is
+	state.VetoTime = persisted.VetoTime
+	state.LastRelayOffTime = persisted.LastRelayOff
+	// The address serves until the metrics report one, a discovery via mDNS is done afresh
+	if !cfg.ShellyMDNS {
+		state.ShellyIP = persisted.ShellyIP
+	}
+	if age := state.Clock.Now().Sub(persisted.Saved); age > cfg.StandbyDuration {
+		state.logger().Info("State file too old, not resuming the standby streak", "path", cfg.StateFile, "age", age.Round(time.Second))
+		return nil
+	}
+	state.Restored = &persisted
+	// A print that finished during the restart is announced once, one announced before it isn't again
+	state.PrinterStates = persisted.PrinterStates
+	return nil
+}
+
+// saveState rewrites STATE_FILE after a cycle. The caller holds state.mu.
+func saveState(cfg *config.Config, state *State, now time.Time) {
+	persisted := PersistedState{
+		SchemaVersion:         stateFileSchemaVersion,
+		Saved:                 now,
+		Device:                state.DeviceName,
+		StandbyStart:          state.StandbyCarry,
+		AnnouncedStandbyStart: state.AnnouncedStandbyStart,
+		PendingOffSince:       state.PendingOffSince,
+		ArmedSince:            state.ArmedSince,
+		VetoTime:              state.VetoTime,
+	}
+	// Until validated, the restored file is kept as it is
+	if r := state.Restored; r != nil {
+		persisted = *r
+	} else if ev := state.LastEvaluation; persisted.StandbyStart == nil && ev != nil && ev.StandbyDuration > 0 {
+		start := ev.Time.Add(-ev.StandbyDuration)
+		persisted.StandbyStart = &start
+	}
+	persisted.PrinterStates = state.PrinterStates
+	persisted.LastRelayOff = state.LastRelayOffTime
+	persisted.ShellyIP = state.ShellyIP
+
+	data, err := json.MarshalIndent(persisted, "", "  ")
+	if err == nil {
+		err = atomicfile.Write(cfg.StateFile, append(data, '\n'))
+	}
+	// Only report the first failure until writing works again
+	switch {
+	case err != nil && !state.StateFileFailing:
+		state.logger().Error("Writing the state file failed", "path", cfg.StateFile, "error", err)
+	case err == nil && state.StateFileFailing:
+		state.logger().Info("Writing the state file recovered", "path", cfg.StateFile)
+	}
+	state.StateFileFailing = err != nil
+}
+
+// resumeStandby validates the state restored from STATE_FILE against the first fresh inputs and carries
+// the start of its standby streak over the restart, for as long as the power stays in standby. A print or
+// power out of the standby range discards it. The caller holds state.mu.
+func resumeStandby(state *State, in *DecisionInputs) {
+	if r := state.Restored; r != nil {
+		state.Restored = nil
+		if reason := restoreRejected(state, r, *in); reason != "" {
+			state.logger().Info("Discarding the restored standby streak", "reason", reason)
+		} else {
+			if r.StandbyStart != nil {
+				state.logger().Info("Resuming the standby streak", "since", r.StandbyStart.Format("15:04:05"))
+			}
+			state.StandbyCarry = r.StandbyStart
+			state.AnnouncedStandbyStart = r.AnnouncedStandbyStart
+			state.PendingOffSince = r.PendingOffSince
+			state.ArmedSince = r.ArmedSince
+		}
+	}
+
+	if state.StandbyCarry == nil {
+		return
+	}
+	if standbyBroken(*in) != "" {
+		state.StandbyCarry = nil
+		return
+	}
+	in.StandbyDuration = max(in.StandbyDuration, in.Now.Sub(*state.StandbyCarry))
+}
+
+// previewStandby extends the standby duration by the streak resumeStandby would carry, leaving the
+// restored state for the next cycle. The caller holds state.mu.
+func previewStandby(state *State, in *DecisionInputs) {
+	carry := state.StandbyCarry
+	if r := state.Restored; r != nil {
+		carry = nil
+		if restoreRejected(state, r, *in) == "" {
+			carry = r.StandbyStart
+		}
+	}
+	if carry != nil && standbyBroken(*in) == "" {
+		in.StandbyDuration = max(in.StandbyDuration, in.Now.Sub(*carry))
+	}
+}
+
+// restoreRejected tells why the restored state doesn't apply to the inputs, empty if it does. The
+// caller holds state.mu.
+func restoreRejected(state *State, r *PersistedState, in DecisionInputs) string {
+	if reason := standbyBroken(in); reason != "" {
+		return reason
+	}
+	if r.Device != "" && r.Device != state.DeviceName {
+		return fmt.Sprintf("the streak is of another Shelly %s", r.Device)
+	}
+	return ""
+}
+
+// standbyBroken tells why the inputs end a standby streak, empty if they continue it
+func standbyBroken(in DecisionInputs) string {
+	switch {
+	case in.Printing:
+		return "the printer is printing"
+	case in.PrintedRecently:
+		return "the printer was printing recently"
+	case in.Watts < in.MinWatts || in.Watts > in.MaxWatts:
+		return fmt.Sprintf("power %.1f W is out of the standby range", in.Watts)
+	case in.StandbyDuration == 0:
+		return "the power history shows no standby"
+	}
+	return ""
+}
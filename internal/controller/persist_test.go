@@ -0,0 +1,250 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics/metricstest"
+)
+
+// restart replaces the controller by a new instance reading the state file, like after an image
+// update, with the exporters scraped while it is down. With lostHistory the power history before the restart is gone too,
+// as with a retention or scrape gap.
+func (s *simulation) restart(down time.Duration, lostHistory bool) {
+	s.t.Helper()
+	if lostHistory {
+		s.b.vm.Set()
+	}
+	for end := s.clk.Now().Add(down); s.clk.Now().Before(end); s.clk.Advance(scrapeInterval) {
+		s.scrape()
+	}
+	s.cfg, s.state = newInstance(s.t, s.clk, s.b, s.configure...)
+	if err := LoadState(s.cfg, s.state); err != nil {
+		s.t.Fatal(err)
+	}
+	s.nextCycle = s.clk.Now()
+}
+
+// offAt runs the simulation for an hour, restarting after the minutes, and returns the minute the relay
+// was switched off. Without the variation checks the streak counts from the end of the boot draw.
+func offAt(t *testing.T, restartAfter time.Duration, lostHistory bool, configure ...func(cfg *config.Config)) string {
+	t.Helper()
+	s := newSimulation(t, append([]func(cfg *config.Config){func(cfg *config.Config) {
+		cfg.BootGracePeriod = 5 * time.Minute
+		cfg.StandbyMaxSpread, cfg.StandbyMaxStddev = 0, 0
+	}}, configure...)...)
+	if restartAfter > 0 {
+		s.run(restartAfter)
+		s.restart(time.Minute, lostHistory)
+	}
+	s.run(time.Hour - s.clk.Now().Sub(s.start))
+	if len(s.switches) != 1 {
+		t.Fatalf("relay changes = %v, want one off", s.switches)
+	}
+	return s.switches[0]
+}
+
+func TestRestartResumesStandby(t *testing.T) {
+	stateFile := func(t *testing.T) func(cfg *config.Config) {
+		path := filepath.Join(t.TempDir(), "state.json")
+		return func(cfg *config.Config) { cfg.StateFile = path }
+	}
+	want := offAt(t, 0, false, stateFile(t))
+	tests := []struct {
+		name         string
+		restartAfter time.Duration
+		lostHistory  bool
+	}{
+		{"during the boot grace", 3 * time.Minute, false},
+		// The history is lost, the streak continues from the state file alone
+		{"after the boot grace", 7 * time.Minute, true},
+		{"in the middle of the streak", 10 * time.Minute, true},
+		{"a minute before the off", 15 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := offAt(t, tt.restartAfter, tt.lostHistory, stateFile(t)); got != want {
+				t.Errorf("relay changes = %s, want %s as without the restart", got, want)
+			}
+		})
+	}
+
+	t.Run("without a state file", func(t *testing.T) {
+		// The streak starts over with the history that is left
+		if got := offAt(t, 10*time.Minute, true); got == want {
+			t.Errorf("relay changes = %s like without the restart, want a later off", got)
+		}
+	})
+}
+
+func TestRestartWhileArmed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s := newSimulation(t, func(cfg *config.Config) {
+		cfg.BootGracePeriod = 5 * time.Minute
+		cfg.OffRecheck, cfg.OffRecheckDelay = true, 5*time.Minute
+		cfg.StateFile = path
+	})
+	for s.state.ArmedSince == nil && s.minute() < 30 {
+		s.run(time.Minute)
+	}
+	armed := *s.state.ArmedSince
+	s.restart(time.Minute, true)
+	events := &collector{}
+	s.state.Bus.Subscribe("test", 100, events.Handle)
+	s.run(10 * time.Minute)
+	s.state.Bus.Close()
+
+	// The restored arming is re-verified after its delay instead of arming and announcing again
+	for _, ev := range events.received() {
+		if d, ok := ev.(DecisionMade); ok && d.Announce {
+			t.Errorf("announced again after the restart: %+v", d)
+		}
+	}
+	if len(s.switches) != 1 || s.state.LastRelayOffTime == nil || s.state.LastRelayOffTime.Before(armed.Add(5*time.Minute)) {
+		t.Errorf("relay changes = %v, last off %v, want one off re-verified 5 minutes after arming at %s", s.switches, s.state.LastRelayOffTime, armed)
+	}
+	if s.state.LastRecheck != RecheckConfirmed {
+		t.Errorf("last recheck = %q, want it confirmed", s.state.LastRecheck)
+	}
+}
+
+func TestRestartKeepsOffCooldown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s := newSimulation(t, func(cfg *config.Config) { cfg.StateFile = path })
+	s.run(25 * time.Minute)
+	off := s.state.LastRelayOffTime
+	if off == nil {
+		t.Fatalf("relay changes = %v, want an off", s.switches)
+	}
+
+	// The new instance has no off of its own, its cooldown counts from the persisted one
+	s.restart(time.Minute, false)
+	if got := s.state.LastRelayOffTime; got == nil || !got.Equal(*off) {
+		t.Errorf("last off after the restart = %v, want %s", got, off)
+	}
+}
+
+// writeState writes a state file of the test plug, saved now
+func writeState(t *testing.T, path string, now time.Time, edit func(*PersistedState)) {
+	t.Helper()
+	standbyStart := now.Add(-12 * time.Minute)
+	persisted := PersistedState{SchemaVersion: stateFileSchemaVersion, Saved: now, Device: "bambu-plug", StandbyStart: &standbyStart}
+	if edit != nil {
+		edit(&persisted)
+	}
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoredStateValidation(t *testing.T) {
+	now := time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		edit    func(*PersistedState)
+		history []phase
+		want    time.Duration // Standby duration of the first cycle
+	}{
+		// Only the last 3 minutes survived in the metrics
+		{"resumed", nil, []phase{{length: 3 * time.Minute, watts: 8}}, 12 * time.Minute},
+		{"printing", nil, []phase{{length: 3 * time.Minute, watts: 8, gcode: 2}}, 0},
+		{"out of band", nil, []phase{{length: 3 * time.Minute, watts: 60}}, 0},
+		{"another Shelly", func(p *PersistedState) { p.Device = "other-plug" }, []phase{{length: 3 * time.Minute, watts: 8}}, 3 * time.Minute},
+		{"too old", func(p *PersistedState) { p.Saved = now.Add(-16 * time.Minute) }, []phase{{length: 3 * time.Minute, watts: 8}}, 3 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.json")
+			writeState(t, path, now, tt.edit)
+			cfg, state, b := newIntegration(t, clock.NewFake(now), func(cfg *config.Config) {
+				cfg.StateFile = path
+				cfg.BootGracePeriod = 5 * time.Minute
+			})
+			b.setHistory(now, tt.history...)
+			if err := LoadState(cfg, state); err != nil {
+				t.Fatal(err)
+			}
+
+			RunCycle(context.Background(), cfg, state)
+			if state.Restored != nil {
+				t.Error("restored state left after the first cycle")
+			}
+			if ev := state.LastEvaluation; ev == nil || ev.StandbyDuration.Round(time.Minute) != tt.want {
+				t.Errorf("evaluation = %+v, want standby for %s", ev, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeKeepsRestoredState(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "state.json")
+	// Printing when the state was saved, finished during the restart, and an update in progress now
+	writeState(t, path, now, func(p *PersistedState) { p.PrinterStates = map[string]float64{"x1c": 2} })
+	cfg, state, b := newIntegration(t, clock.NewFake(now), func(cfg *config.Config) {
+		cfg.StateFile = path
+		cfg.MaintenanceMetrics = "bambulab_firmware_updating"
+		cfg.MaintenanceMaxHold = 2 * time.Hour
+	})
+	b.setHistory(now, phase{length: 3 * time.Minute, watts: 8})
+	b.vm.Add(map[string]string{"__name__": "bambulab_firmware_updating"}, metricstest.Constant(now.Add(-3*time.Minute), now, 30*time.Second, 1)...)
+	if err := LoadState(cfg, state); err != nil {
+		t.Fatal(err)
+	}
+	state.DeviceName = "bambu-plug"
+	events := &collector{}
+	state.Bus.Subscribe("test", 100, events.Handle)
+
+	for _, endpoint := range []string{"probe", "inspect"} {
+		if endpoint == "probe" {
+			ev, _, err := ProbeEvaluation(ctx, cfg, state)
+			if err != nil || ev.Reason != ReasonMaintenance {
+				t.Errorf("probe: evaluation = %+v, %v, want the maintenance hold", ev, err)
+			}
+			state.LastEvaluation = nil
+		} else {
+			status, err := Inspect(ctx, cfg, state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The streak of the state file shows, without the state file being used up
+			if standby := status.Inputs.StandbyDuration; standby.Round(time.Minute) != 12*time.Minute || status.Decision.Reason != ReasonMaintenance {
+				t.Errorf("inspect: standby for %s, decision %+v, want the restored 12 minutes and the maintenance hold", standby, status.Decision)
+			}
+		}
+		if state.Restored == nil || state.StandbyCarry != nil {
+			t.Errorf("%s: restored state consumed", endpoint)
+		}
+		if state.MaintenanceSince != nil || state.PrinterStates["x1c"] != 2 {
+			t.Errorf("%s: tracked state advanced: maintenance since %v, printer states %v", endpoint, state.MaintenanceSince, state.PrinterStates)
+		}
+	}
+
+	// The first cycle validates the state file and announces the finished print, once
+	RunCycle(ctx, cfg, state)
+	RunCycle(ctx, cfg, state)
+	state.Bus.Close()
+	if state.Restored != nil || state.StandbyCarry == nil || state.MaintenanceSince == nil {
+		t.Errorf("after the cycle: restored %v, carry %v, maintenance since %v", state.Restored, state.StandbyCarry, state.MaintenanceSince)
+	}
+	finished := 0
+	for _, ev := range events.received() {
+		if _, ok := ev.(PrintFinished); ok {
+			finished++
+		}
+	}
+	if finished != 1 {
+		t.Errorf("%d print finished notifications, want the one of the cycle", finished)
+	}
+}
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// preActionRequest is the pending decision posted to the pre-action hook
+type preActionRequest struct {
+	Time           time.Time `json:"time"`
+	Device         string    `json:"device,omitempty"`
+	Action         string    `json:"action"`
+	Outcome        string    `json:"outcome"`
+	Watts          float64   `json:"watts"`
+	StandbySeconds int       `json:"standby_seconds"`
+}
+
+// preActionResponse is the answer of the pre-action hook
+type preActionResponse struct {
+	Allow  *bool  `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// askPreActionHook asks the configured hook whether the decided action may be executed.
+// It returns whether to proceed and, if not, the reason. Without a configured hook every action proceeds.
+func askPreActionHook(cfg *config.Config, req preActionRequest) (bool, string) {
+	if cfg.PreActionHookURL == "" {
+		return true, ""
+	}
+
+	allow, reason, err := callPreActionHook(cfg, req)
+	if err == nil {
+		return allow, reason
+	}
+
+	if cfg.PreActionHookFailure == config.PreActionDeny {
+		slog.Error("Pre-action hook failed, skipping the action (fail closed)", "action", req.Action, "error", err)
+		return false, "pre-action hook failed: " + err.Error()
+	}
+	slog.Error("Pre-action hook failed, proceeding with the action (fail open)", "action", req.Action, "error", err)
+	return true, ""
+}
+
+func callPreActionHook(cfg *config.Config, req preActionRequest) (bool, string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return false, "", err
+	}
+
+	client := &http.Client{Timeout: cfg.PreActionHookTimeout}
+	resp, err := client.Post(cfg.PreActionHookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("pre-action hook failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var answer preActionResponse
+	if err := json.Unmarshal(respBody, &answer); err != nil {
+		return false, "", fmt.Errorf("invalid pre-action hook response: %w", err)
+	}
+	if answer.Allow == nil {
+		return false, "", fmt.Errorf("pre-action hook response has no allow field")
+	}
+	return *answer.Allow, answer.Reason, nil
+}
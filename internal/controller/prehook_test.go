@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// newHook returns a pre-action hook answering with status and body after delay, recording the request bodies
+func newHook(t *testing.T, status int, body string, delay time.Duration) (*httptest.Server, chan preActionRequest) {
+	t.Helper()
+	requests := make(chan preActionRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req preActionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("invalid hook request: %v", err)
+		}
+		requests <- req
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func TestPreActionHook(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		delay   time.Duration
+		failure string
+		allow   bool
+		reason  string
+	}{
+		{"allow", http.StatusOK, `{"allow": true}`, 0, config.PreActionDeny, true, ""},
+		{"deny", http.StatusOK, `{"allow": false, "reason": "guests are printing"}`, 0, config.PreActionAllow, false, "guests are printing"},
+		{"timeout fail open", http.StatusOK, `{"allow": false}`, time.Second, config.PreActionAllow, true, ""},
+		{"timeout fail closed", http.StatusOK, `{"allow": true}`, time.Second, config.PreActionDeny, false, "pre-action hook failed: "},
+		{"malformed fail open", http.StatusOK, `allow`, 0, config.PreActionAllow, true, ""},
+		{"malformed fail closed", http.StatusOK, `allow`, 0, config.PreActionDeny, false, "pre-action hook failed: invalid pre-action hook response"},
+		{"no allow field", http.StatusOK, `{"reason": "maybe"}`, 0, config.PreActionDeny, false, "pre-action hook failed: pre-action hook response has no allow field"},
+		{"error status", http.StatusInternalServerError, `{"allow": true}`, 0, config.PreActionDeny, false, "pre-action hook failed: pre-action hook failed with status 500"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook, requests := newHook(t, tt.status, tt.body, tt.delay)
+			cfg := &config.Config{PreActionHookURL: hook.URL, PreActionHookTimeout: 100 * time.Millisecond, PreActionHookFailure: tt.failure}
+			req := preActionRequest{Time: time.Date(2026, 3, 1, 20, 15, 0, 0, time.UTC), Device: "plug", Action: ActionOff, Outcome: OutcomeTurnOff, Watts: 8.1, StandbySeconds: 1800}
+
+			start := time.Now()
+			allow, reason := askPreActionHook(cfg, req)
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("waited %s for the hook, want at most its timeout", elapsed)
+			}
+			if allow != tt.allow || !strings.HasPrefix(reason, tt.reason) || (tt.reason == "" && reason != "") {
+				t.Errorf("askPreActionHook = %v, %q, want %v, %q", allow, reason, tt.allow, tt.reason)
+			}
+			if got := <-requests; got != req {
+				t.Errorf("hook received %+v, want %+v", got, req)
+			}
+		})
+	}
+}
+
+func TestPreActionHookUnreachable(t *testing.T) {
+	hook, _ := newHook(t, http.StatusOK, "", 0)
+	hook.Close()
+	for failure, want := range map[string]bool{config.PreActionAllow: true, config.PreActionDeny: false} {
+		cfg := &config.Config{PreActionHookURL: hook.URL, PreActionHookTimeout: time.Second, PreActionHookFailure: failure}
+		if allow, _ := askPreActionHook(cfg, preActionRequest{Action: ActionOff}); allow != want {
+			t.Errorf("%s: allow = %v, want %v", failure, allow, want)
+		}
+	}
+}
+
+func TestPreActionHookNotConfigured(t *testing.T) {
+	if allow, reason := askPreActionHook(&config.Config{PreActionHookFailure: config.PreActionDeny}, preActionRequest{}); !allow || reason != "" {
+		t.Errorf("askPreActionHook = %v, %q, want every action to proceed", allow, reason)
+	}
+}
@@ -0,0 +1,30 @@
+package controller
+
+import (
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// standbyThreshold is the standby duration before an auto-off at now: PeakStandbyDuration while the
+// electricity price is above PeakPrice, StandbyDuration otherwise or when no price is known.
+// The caller holds state.mu.
+func standbyThreshold(cfg *config.Config, state *State, now time.Time) time.Duration {
+	if cfg.PeakPrice <= 0 {
+		return cfg.StandbyDuration
+	}
+	price, ok := state.Prices.At(now)
+	peak := ok && price > cfg.PeakPrice
+	if peak != state.PeakPrice {
+		if peak {
+			state.logger().Info("Electricity price above PEAK_PRICE, switching off after a shorter standby", "price", price, "standby_duration", cfg.PeakStandbyDuration)
+		} else {
+			state.logger().Info("Electricity price no longer above PEAK_PRICE", "standby_duration", cfg.StandbyDuration)
+		}
+		state.PeakPrice = peak
+	}
+	if peak {
+		return cfg.PeakStandbyDuration
+	}
+	return cfg.StandbyDuration
+}
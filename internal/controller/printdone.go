@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"maps"
+	"slices"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/printer"
+)
+
+// trackPrintFinish remembers the latest state of every printer and announces once when one went from
+// printing or paused to finished. A printer missing from the states keeps its previous one, so a gap
+// in the metrics doesn't hide a finish. The caller holds state.mu.
+func trackPrintFinish(cfg *config.Config, state *State, in DecisionInputs, states map[string]float64) {
+	if states == nil {
+		return
+	}
+	history := state.Printer.(printer.StateHistory)
+	_, busy := history.StateQuery()
+	var failed []float64
+	if f, ok := state.Printer.(printer.FailedStates); ok {
+		failed = f.FailedValues()
+	}
+
+	// The states of the first cycle are only remembered
+	if state.PrinterStates != nil {
+		for name, current := range states {
+			previous, ok := state.PrinterStates[name]
+			if !ok || !slices.Contains(busy, previous) || slices.Contains(busy, current) {
+				continue
+			}
+			if slices.Contains(failed, current) {
+				state.logger().Warn("Print failed", "printer", printerName(name), "state", current)
+				continue
+			}
+			if t := state.PrintFinishedAt; t != nil && in.Now.Sub(*t) < postPrintCooldown {
+				state.logger().Info("Print finished, already announced by a trigger", "printer", printerName(name), "state", current)
+				continue
+			}
+			off := projectedOffAfterPrint(cfg, state, in.Now)
+			state.logger().Info("Print finished", "printer", printerName(name), "state", current, "off_expected", off.Format("15:04:05"))
+			state.Bus.Publish(PrintFinished{Time: in.Now, Device: state.DeviceName, Printer: name, ProjectedOffTime: off})
+		}
+	} else {
+		state.PrinterStates = map[string]float64{}
+	}
+	maps.Copy(state.PrinterStates, states)
+}
+
+// projectedOffAfterPrint estimates the auto-off after a print that finished now, if the printer then
+// stays in standby. Standby counts once the high power cooldown has passed, and the auto-off waits for
+// the post-print cooldown at least. The caller holds state.mu.
+func projectedOffAfterPrint(cfg *config.Config, state *State, now time.Time) time.Time {
+	start := now
+	if cfg.PrintPowerWatts > 0 {
+		start = start.Add(cfg.PrintPowerCooldown)
+	}
+	off := start.Add(standbyThreshold(cfg, state, now))
+	if cooled := now.Add(postPrintCooldown); off.Before(cooled) {
+		off = cooled
+	}
+	return off.Add(cfg.OffDelay())
+}
+
+// printerName names the printer of a state series for logs
+func printerName(label string) string {
+	if label == "" {
+		return "the printer"
+	}
+	return label
+}
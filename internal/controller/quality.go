@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics"
+)
+
+// untrustedPowerFactorWatts is the power above which a power factor of exactly 0 is implausible
+const untrustedPowerFactorWatts = 5
+
+// checkReadingQuality cross-checks the power reading against the voltage and power factor of the
+// device. It returns why the reading can't be trusted, empty if it can. The caller holds state.mu, which
+// is released for the queries.
+func checkReadingQuality(ctx context.Context, cfg *config.Config, state *State, watts float64) (string, error) {
+	now := state.Clock.Now()
+	value := func(metric string) (v *float64, err error) {
+		state.unlocked(func() { v, err = metrics.ShellyValue(ctx, state.Metrics, now, metric, metrics.ConfigDevice(cfg)) })
+		return v, err
+	}
+	if cfg.VoltageMetric != "" {
+		voltage, err := value(cfg.VoltageMetric)
+		if err != nil {
+			return "", err
+		}
+		if qualityMetricFound(state, cfg.VoltageMetric, voltage != nil) && (*voltage < cfg.VoltageMin || *voltage > cfg.VoltageMax) {
+			return fmt.Sprintf("voltage %.1f V outside %.0f-%.0f V", *voltage, cfg.VoltageMin, cfg.VoltageMax), nil
+		}
+	}
+	if cfg.PowerFactorMetric != "" {
+		pf, err := value(cfg.PowerFactorMetric)
+		if err != nil {
+			return "", err
+		}
+		if qualityMetricFound(state, cfg.PowerFactorMetric, pf != nil) && *pf == 0 && watts > untrustedPowerFactorWatts {
+			return fmt.Sprintf("power factor 0 at %.1f W", watts), nil
+		}
+	}
+	return "", nil
+}
+
+// qualityMetricFound returns found and logs once when the metric goes missing or appears again, so a
+// device without it only disables its check
+func qualityMetricFound(state *State, metric string, found bool) bool {
+	if state.QualityMissing == nil {
+		state.QualityMissing = map[string]bool{}
+	}
+	if !found && !state.QualityMissing[metric] {
+		state.logger().Warn("Data quality metric not found for the device, skipping its check", "metric", metric)
+	} else if found && state.QualityMissing[metric] {
+		state.logger().Info("Data quality metric found", "metric", metric)
+	}
+	state.QualityMissing[metric] = !found
+	return found
+}
@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/printer"
+)
+
+// queuedJob returns a controller on a fake clock after a cycle that read the printer drawing watts for
+// the last 10 minutes, with the plug switched accordingly
+func queuedJob(t *testing.T, watts float64, configure ...func(cfg *config.Config)) (*config.Config, *State, *backends, *clock.Fake) {
+	t.Helper()
+	clk := clock.NewFake(time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC))
+	cfg, state, b := newIntegration(t, clk, append([]func(cfg *config.Config){func(cfg *config.Config) {
+		cfg.BootGracePeriod = 5 * time.Minute
+		cfg.BambuQueueBuffer = 10 * time.Minute
+	}}, configure...)...)
+	b.plug.SetOn(watts > 0)
+	b.setHistory(clk.Now(), phase{length: 50 * time.Minute, watts: 0}, phase{length: 10 * time.Minute, watts: watts})
+	RunCycle(context.Background(), cfg, state)
+	if state.LastWatts == nil {
+		t.Fatalf("no reading, cycle error %q", state.LastCycleError)
+	}
+	return cfg, state, b, clk
+}
+
+func TestPowerOnForQueuedJob(t *testing.T) {
+	tests := []struct {
+		name     string
+		watts    float64
+		switched bool
+	}{
+		{"off", 0, true},
+		// An idle printer left on is held all the same, or the auto-off could beat the job to it
+		{"already on", 8, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, state, b, clk := queuedJob(t, tt.watts)
+			if err := PowerOnForQueuedJob(cfg, state, "benchy", SourceQueue); err != nil {
+				t.Fatal(err)
+			}
+			if switched := len(b.plug.Commands()) > 0; switched != tt.switched || !b.plug.On() {
+				t.Errorf("commands %v, plug on %v, want switched %v", b.plug.Commands(), b.plug.On(), tt.switched)
+			}
+			if want := clk.Now().Add(15 * time.Minute); state.HoldUntil == nil || !state.HoldUntil.Equal(want) {
+				t.Errorf("hold until %v, want %v", state.HoldUntil, want)
+			}
+		})
+	}
+}
+
+// fakeBambuCloud serves a task list with a job queued for the printer with serial
+func fakeBambuCloud(t *testing.T, serial string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/user-service/my/tasks" || r.Header.Get("Authorization") != "Bearer cloud-token" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"hits": [{"id": 7, "deviceId": %q, "title": "benchy", "status": "PENDING"}]}`, serial)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// TestBambuQueueHoldsPrinterOn runs the poller of the Bambu Cloud queue like main does, against a printer
+// idling with the plug on
+func TestBambuQueueHoldsPrinterOn(t *testing.T) {
+	cloud := fakeBambuCloud(t, "01S00A000000001")
+	cfg, state, b, clk := queuedJob(t, 8, func(cfg *config.Config) {
+		cfg.BambuCloudURL, cfg.BambuCloudToken, cfg.BambuSerial = cloud.URL, "cloud-token", "01S00A000000001"
+		cfg.BambuQueuePowerOn, cfg.BambuQueueInterval = true, 2*time.Minute
+	})
+	handled := make(chan error, 1)
+	queue := printer.NewBambuQueue(cfg, func(job printer.QueuedJob) error {
+		err := PowerOnForQueuedJob(cfg, state, job.Title, SourceQueue)
+		handled <- err
+		return err
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Run(ctx)
+
+	select {
+	case err := <-handled:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued job wasn't handled")
+	}
+	status := GetStatus(cfg, state)
+	if want := clk.Now().Add(15 * time.Minute); status.HoldUntil == nil || !status.HoldUntil.Equal(want) {
+		t.Errorf("hold until %v, want %v", status.HoldUntil, want)
+	}
+	if commands := b.plug.Commands(); len(commands) != 0 {
+		t.Errorf("commands %v, want the plug left on", commands)
+	}
+
+	// The hold keeps the idle printer on through a standby that would otherwise end in the auto-off
+	clk.Advance(14 * time.Minute)
+	b.setHistory(clk.Now(), phase{length: 50 * time.Minute, watts: 0}, phase{length: 24 * time.Minute, watts: 8})
+	RunCycle(context.Background(), cfg, state)
+	expectDecision(t, state, "held for the job", OutcomeSkip, ReasonHold)
+}
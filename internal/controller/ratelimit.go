@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// ErrRateLimited is returned for relay commands within ACTUATION_MIN_SPACING of the previous one or
+// beyond ACTUATION_MAX_PER_HOUR
+var ErrRateLimited = errors.New("relay command rate limit reached")
+
+// actuationLimit tells which rate limit a relay command now would exceed, empty if it may be sent. A
+// retry of a failed command is only bound by ACTUATION_MAX_PER_HOUR. The caller holds state.mu.
+func actuationLimit(cfg *config.Config, state *State, now time.Time, retry bool) string {
+	state.Actuations = slices.DeleteFunc(state.Actuations, func(t time.Time) bool { return now.Sub(t) >= time.Hour })
+	if n := len(state.Actuations); n > 0 && cfg.ActuationMinSpacing > 0 && !retry {
+		if since := now.Sub(state.Actuations[n-1]); since < cfg.ActuationMinSpacing {
+			return fmt.Sprintf("the last command was sent %s ago, the minimum spacing is %s", since.Round(time.Second), cfg.ActuationMinSpacing)
+		}
+	}
+	if cfg.ActuationMaxPerHour > 0 && len(state.Actuations) >= cfg.ActuationMaxPerHour {
+		return fmt.Sprintf("%d commands were sent within the last hour", len(state.Actuations))
+	}
+	return ""
+}
+
+// actuate sends a relay command unless it exceeds the rate limits, and counts it against them. Every
+// relay command goes through it, retries included. Cutting power for overtemperature is never held
+// back, but counts against the limits of other commands. The caller holds state.mu.
+func actuate(cfg *config.Config, state *State, on bool, source string, retry bool) error {
+	now := state.Clock.Now()
+	if reason := actuationLimit(cfg, state, now, retry); reason != "" && source != SourceOvertemp {
+		action := ActionOff
+		if on {
+			action = ActionOn
+		}
+		return blockActuation(state, action, source, reason)
+	}
+	recordActuation(state, now)
+	return setRelay(cfg, state, on)
+}
+
+// blockActuation logs and counts a relay command held back by the rate limits. The caller holds state.mu.
+func blockActuation(state *State, action, source, reason string) error {
+	state.ActuationsBlocked++
+	state.logger().Warn("Relay command blocked by the rate limit", "action", action, "source", source, "reason", reason)
+	return fmt.Errorf("%w: %s", ErrRateLimited, reason)
+}
+
+// recordActuation counts a relay command against the rate limits, whether it succeeds or not. The caller
+// holds state.mu.
+func recordActuation(state *State, now time.Time) {
+	state.Actuations = append(state.Actuations, now)
+}
@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+)
+
+// limits sets the rate limits of relay commands
+func limits(spacing time.Duration, perHour int) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.ActuationMinSpacing = spacing
+		cfg.ActuationMaxPerHour = perHour
+	}
+}
+
+func TestActuationFailedCommandCounts(t *testing.T) {
+	cfg, state, b := newIntegration(t, clock.Real{}, limits(time.Minute, 10))
+	b.setHistory(time.Now(), phase{length: time.Hour, watts: 8})
+	b.plug.Fail(500)
+
+	RunCycle(context.Background(), cfg, state)
+	expectDecision(t, state, "failing plug", OutcomeTurnOff, "")
+	if len(state.Actuations) != 1 || state.ActuationsBlocked != 0 {
+		t.Errorf("%d commands counted, %d blocked, want the failed off counted", len(state.Actuations), state.ActuationsBlocked)
+	}
+
+	// A manual command right after it is held back by the spacing
+	b.plug.Fail(0)
+	if err := SwitchRelay(cfg, state, false, "api"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("manual command: error = %v, want %v", err, ErrRateLimited)
+	}
+	if state.ActuationsBlocked != 1 || len(state.Actuations) != 1 {
+		t.Errorf("after the manual command: %d commands counted, %d blocked", len(state.Actuations), state.ActuationsBlocked)
+	}
+}
+
+// retried makes an auto-off relay command attempted three times
+func retried(cfg *config.Config) {
+	cfg.RelayAttempts = 3
+	cfg.RelayRetryDelay = time.Millisecond
+}
+
+func TestActuationRetriesCount(t *testing.T) {
+	cfg, state, b := newIntegration(t, clock.Real{}, limits(time.Minute, 10), retried)
+	b.setHistory(time.Now(), phase{length: time.Hour, watts: 8})
+	b.plug.Fail(500)
+
+	RunCycle(context.Background(), cfg, state)
+	expectDecision(t, state, "failing plug", OutcomeTurnOff, "")
+	// The retries aren't held back by the spacing, but each is a command of its own
+	if len(state.Actuations) != 3 || state.ActuationsBlocked != 0 {
+		t.Errorf("%d commands counted, %d blocked, want all 3 attempts counted", len(state.Actuations), state.ActuationsBlocked)
+	}
+}
+
+func TestActuationRetriesStopAtHourlyLimit(t *testing.T) {
+	cfg, state, b := newIntegration(t, clock.Real{}, limits(0, 2), retried)
+	b.setHistory(time.Now(), phase{length: time.Hour, watts: 8})
+	b.plug.Fail(500)
+
+	RunCycle(context.Background(), cfg, state)
+	if len(state.Actuations) != 2 || state.ActuationsBlocked != 1 {
+		t.Errorf("%d commands counted, %d blocked, want the third attempt blocked", len(state.Actuations), state.ActuationsBlocked)
+	}
+	if state.RelayFailures != 1 || state.OffRetry == nil {
+		t.Errorf("failures %d, retry %v, want the off failed and remembered", state.RelayFailures, state.OffRetry)
+	}
+}
+
+func TestActuationOvertemperature(t *testing.T) {
+	cfg, state, b := newIntegration(t, clock.Real{}, limits(time.Minute, 1))
+	state.ShellyIP = b.plug.Address()
+	state.Actuations = []time.Time{time.Now()}
+
+	// Never held back, but counted
+	if err := overtemperatureOff(cfg, state, 200); err != nil {
+		t.Fatal(err)
+	}
+	if b.plug.On() || len(state.Actuations) != 2 || state.ActuationsBlocked != 0 {
+		t.Errorf("relay on %v, %d commands counted, %d blocked", b.plug.On(), len(state.Actuations), state.ActuationsBlocked)
+	}
+	if err := SwitchRelay(cfg, state, true, "telegram"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("manual command: error = %v, want %v", err, ErrRateLimited)
+	}
+}
+
+func TestActuationLimit(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		actuations []time.Duration // Ago
+		retry      bool
+		want       string
+	}{
+		{"first", nil, false, ""},
+		{"within the spacing", []time.Duration{30 * time.Second}, false, "the last command was sent 30s ago, the minimum spacing is 1m0s"},
+		{"retry within the spacing", []time.Duration{30 * time.Second}, true, ""},
+		{"after the spacing", []time.Duration{time.Minute}, false, ""},
+		{"hourly limit", []time.Duration{50 * time.Minute, 40 * time.Minute, 30 * time.Minute}, false, "3 commands were sent within the last hour"},
+		{"retry at the hourly limit", []time.Duration{30 * time.Minute, 20 * time.Minute, 30 * time.Second}, true, "3 commands were sent within the last hour"},
+		{"older than an hour", []time.Duration{time.Hour, 40 * time.Minute, 30 * time.Minute}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, state, _ := newIntegration(t, clock.Real{}, limits(time.Minute, 3))
+			for _, ago := range tt.actuations {
+				state.Actuations = append(state.Actuations, now.Add(-ago))
+			}
+			if got := actuationLimit(cfg, state, now, tt.retry); got != tt.want {
+				t.Errorf("actuationLimit = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
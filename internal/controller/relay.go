@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/shelly"
+)
+
+// setRelay switches the relay at relayAddress with the RELAY_TYPE backend, or via the
+// Shelly Cloud with SHELLY_CONTROL=cloud or when the LAN command fails. The caller holds state.mu.
+func setRelay(cfg *config.Config, state *State, on bool) error {
+	cloud := cfg.ShellyCloudEnabled() && cloudID(cfg, state) != ""
+	if cfg.ShellyControl == config.ShellyControlCloud {
+		return setRelayCloud(cfg, state, on)
+	}
+	if relayAddress(cfg, state) == "" && cloud {
+		state.logger().Info("No Shelly address available, switching via the Shelly Cloud")
+		return setRelayCloud(cfg, state, on)
+	}
+
+	err := setRelayLAN(cfg, state, on)
+	if err == nil || !cloud {
+		return err
+	}
+	state.logger().Warn("Switching the relay failed, retrying via the Shelly Cloud", "ip", relayAddress(cfg, state), "error", err)
+	if cloudErr := setRelayCloud(cfg, state, on); cloudErr != nil {
+		return fmt.Errorf("%w, and via the Shelly Cloud: %w", err, cloudErr)
+	}
+	return nil
+}
+
+// errRetryInterrupted ends the retries of a relay command when a control command ran while they waited
+var errRetryInterrupted = errors.New("retries interrupted by a control command")
+
+// setRelayRetrying repeats a failed relay command up to RELAY_ATTEMPTS attempts in total, waiting
+// RELAY_RETRY_DELAY before the second and twice as long before every further one. Each attempt counts
+// against the rate limits, and one they hold back ends the retries. The waits release state.mu, a
+// control command during one ends the retries with errRetryInterrupted. The caller holds state.mu.
+func setRelayRetrying(ctx context.Context, cfg *config.Config, state *State, on bool, source string) error {
+	action := ActionOff
+	if on {
+		action = ActionOn
+	}
+	delay := cfg.RelayRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := actuate(cfg, state, on, source, attempt > 1)
+		if err == nil || attempt >= cfg.RelayAttempts || errors.Is(err, ErrRateLimited) {
+			return err
+		}
+		state.logger().Warn("Switching the relay failed, retrying", "action", action, "attempt", attempt, "attempts", cfg.RelayAttempts, "retry_in", delay, "error", err)
+		commands := state.commands
+		waited := false
+		state.unlocked(func() {
+			select {
+			case <-ctx.Done():
+			case <-state.Clock.After(delay):
+				waited = true
+			}
+		})
+		if !waited {
+			return err
+		}
+		if state.commands != commands {
+			return fmt.Errorf("%w: %w", errRetryInterrupted, err)
+		}
+		delay *= 2
+	}
+}
+
+// setRelayLAN switches the relay at relayAddress. An address discovered via mDNS that can't be
+// connected to is discovered again and the command repeated once.
+func setRelayLAN(cfg *config.Config, state *State, on bool) error {
+	err := switchAt(cfg, state, on)
+	if err == nil || state.MDNSAddress == "" || state.ShellyIP != state.MDNSAddress || !shelly.Unreachable(err) {
+		return err
+	}
+
+	state.logger().Warn("Shelly unreachable, discovering it again via mDNS", "ip", state.ShellyIP, "error", err)
+	previous := state.MDNSAddress
+	state.ShellyIP, state.MDNSAddress, state.MDNSCheckedAt = "", "", nil
+	discoverShelly(context.Background(), cfg, state)
+	if state.ShellyIP == "" || state.ShellyIP == previous {
+		return err
+	}
+	return switchAt(cfg, state, on)
+}
+
+// setRelayCloud switches the relay via the Shelly Cloud, telling a rejected key from an offline device
+func setRelayCloud(cfg *config.Config, state *State, on bool) error {
+	id := cloudID(cfg, state)
+	if id == "" {
+		return fmt.Errorf("no Shelly Cloud ID available, set SHELLY_DEVICE_ID or check SHELLY_ID_LABEL")
+	}
+	err := shelly.CloudSetRelay(cfg, id, on)
+	switch {
+	case errors.Is(err, shelly.ErrCloudAuth):
+		state.logger().Error("The Shelly Cloud rejected the auth key, check SHELLY_CLOUD_KEY and SHELLY_CLOUD_SERVER", "error", err)
+	case errors.Is(err, shelly.ErrDeviceOffline):
+		state.logger().Warn("Device offline in the Shelly Cloud", "cloud_id", id, "error", err)
+	}
+	return err
+}
+
+// cloudID is the Shelly Cloud ID of the device: SHELLY_DEVICE_ID, or the one of SHELLY_ID_LABEL
+func cloudID(cfg *config.Config, state *State) string {
+	if cfg.ShellyDeviceID != "" {
+		return cfg.ShellyDeviceID
+	}
+	return state.CloudID
+}
+
+// canSwitch reports whether a relay command has an address: the one of relayAddress, or the Shelly
+// Cloud ID when the cloud is configured. Home Assistant switches its entity without one.
+func canSwitch(cfg *config.Config, state *State) bool {
+	if cfg.RelayType == config.RelayHomeAssistant {
+		return true
+	}
+	cloud := cfg.ShellyCloudEnabled() && cloudID(cfg, state) != ""
+	if cfg.ShellyControl == config.ShellyControlCloud {
+		return cloud
+	}
+	return relayAddress(cfg, state) != "" || cloud
+}
+
+// relayAddress is the address the RELAY_TYPE backend switches: the ID in the MQTT topics with
+// SHELLY_CONTROL=mqtt, SHELLY_MQTT_ID or the device name of the metrics, otherwise the Shelly IP
+func relayAddress(cfg *config.Config, state *State) string {
+	if cfg.ShellyControl != config.ShellyControlMQTT {
+		return state.ShellyIP
+	}
+	if cfg.ShellyMQTTID != "" {
+		return cfg.ShellyMQTTID
+	}
+	return state.DeviceName
+}
+
+func switchAt(cfg *config.Config, state *State, on bool) error {
+	if on {
+		return state.Relay.On(relayAddress(cfg, state))
+	}
+	return state.Relay.Off(relayAddress(cfg, state))
+}
+
+// confirmedState is the relay state a successful setRelay leaves, for the success logs
+func confirmedState(cfg *config.Config, on bool) string {
+	switch {
+	case cfg.DryRun:
+		return "not verified in the dry run"
+	case cfg.ShellyControl == config.ShellyControlCloud:
+		return "sent via the Shelly Cloud"
+	case on:
+		return "confirmed on"
+	}
+	return "confirmed off"
+}
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics"
+)
+
+// historyCheckInterval is how often the power history is compared with the lookbacks
+const historyCheckInterval = 10 * time.Minute
+
+// historyLookback is the longest window the gates query of the power history
+func historyLookback(cfg *config.Config) time.Duration {
+	lookback := cfg.BootGracePeriod + time.Minute
+	if cfg.StandbyMode == config.StandbyModeQuantile {
+		lookback = max(lookback, cfg.StandbyDuration)
+	} else {
+		lookback = max(lookback, max(cfg.StandbyDuration, cfg.PeakStandbyDuration)+5*time.Minute)
+	}
+	if cfg.PrintPowerWatts > 0 {
+		lookback = max(lookback, cfg.PrintPowerDuration+cfg.PrintPowerCooldown+time.Minute)
+	}
+	if cfg.CalibrationPowerWatts > 0 {
+		lookback = max(lookback, cfg.CalibrationPowerDuration+time.Minute)
+	}
+	return lookback
+}
+
+// checkHistory warns when the power history is shorter than the longest lookback, e.g. on a fresh
+// VictoriaMetrics or with a short retention, where the range queries silently return a truncated
+// window. It runs on the first cycle and every historyCheckInterval, failures are only logged. The
+// caller holds state.mu, which is released for the query.
+func checkHistory(ctx context.Context, cfg *config.Config, state *State) {
+	now := state.Clock.Now()
+	if state.HistoryCheckedAt != nil && now.Sub(*state.HistoryCheckedAt) < historyCheckInterval {
+		return
+	}
+	lookback := historyLookback(cfg)
+	var covered time.Duration
+	var ok bool
+	var err error
+	state.unlocked(func() {
+		covered, ok, err = metrics.PowerHistory(ctx, state.Metrics, now, metrics.ConfigDevice(cfg), lookback)
+	})
+	if err != nil {
+		state.logger().Error("Checking the power history failed", "error", err)
+		return
+	}
+	state.HistoryCheckedAt = &now
+
+	if ok {
+		if state.HistoryShort != nil {
+			state.logger().Info("Power history covers the longest lookback again", "lookback", lookback)
+		}
+		state.HistoryShort = nil
+		return
+	}
+	state.HistoryShort = &covered
+	hint := "the gates decide on a truncated window"
+	if cfg.HistoryRequired {
+		hint = "holding the auto-off until it does"
+	}
+	state.logger().Warn("Power history shorter than the longest lookback, check the retention of VictoriaMetrics", "covered", covered.Round(time.Second), "lookback", lookback, "effect", hint)
+}
@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+)
+
+// shortArgs make the longest lookback 8 minutes: the standby duration and the 5 minutes the standby query
+// adds, without the print power gate
+var shortArgs = []string{"-boot-grace", "1m", "-standby-duration", "3m", "-peak-standby-duration", "3m", "-print-power-watts", "0"}
+
+// shortLookbacks sets the lookbacks of shortArgs
+func shortLookbacks(cfg *config.Config) {
+	cfg.BootGracePeriod = time.Minute
+	cfg.StandbyDuration = 3 * time.Minute
+	cfg.PeakStandbyDuration = 3 * time.Minute
+	cfg.PrintPowerWatts = 0
+}
+
+// historyRequired sets HISTORY_REQUIRED
+func historyRequired(cfg *config.Config) {
+	cfg.HistoryRequired = true
+}
+
+// newShortHistory returns a controller on a fake clock whose power series only started 5 minutes ago,
+// in standby since, and the log it writes
+func newShortHistory(t *testing.T, configure ...func(cfg *config.Config)) (*config.Config, *State, *backends, *clock.Fake, *bytes.Buffer) {
+	t.Helper()
+	clk := clock.NewFake(time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC))
+	cfg, state, b := newIntegration(t, clk, append([]func(cfg *config.Config){shortLookbacks}, configure...)...)
+	var log bytes.Buffer
+	state.Log = slog.New(slog.NewTextHandler(&log, nil))
+	b.setHistory(clk.Now(), phase{length: 5 * time.Minute, watts: 8})
+	return cfg, state, b, clk, &log
+}
+
+func TestShortHistoryWarning(t *testing.T) {
+	cfg, state, b, _, log := newShortHistory(t)
+	if got := historyLookback(cfg); got != 8*time.Minute {
+		t.Fatalf("lookback = %s, want 8m", got)
+	}
+
+	RunCycle(context.Background(), cfg, state)
+	// Without HISTORY_REQUIRED the gates go on with the window there is
+	expectDecision(t, state, "short history", OutcomeTurnOff, "")
+	if len(b.plug.Commands()) != 1 {
+		t.Errorf("relay commands = %v, want the off", b.plug.Commands())
+	}
+	if state.HistoryShort == nil || *state.HistoryShort != 5*time.Minute {
+		t.Errorf("short history = %v, want 5m", state.HistoryShort)
+	}
+	if out := log.String(); !strings.Contains(out, "Power history shorter than the longest lookback") || !strings.Contains(out, "covered=5m0s lookback=8m0s") ||
+		!strings.Contains(out, "the gates decide on a truncated window") {
+		t.Errorf("log = %q, want the warning", out)
+	}
+	if status := GetStatus(cfg, state); status.ShortHistory == nil || *status.ShortHistory != 300 {
+		t.Errorf("status short history = %v, want 300 seconds", status.ShortHistory)
+	}
+}
+
+func TestShortHistoryRequired(t *testing.T) {
+	ctx := context.Background()
+	cfg, state, b, clk, log := newShortHistory(t, historyRequired)
+
+	RunCycle(ctx, cfg, state)
+	expectDecision(t, state, "5 minutes of history", OutcomeSkip, ReasonShortHistory)
+	if len(b.plug.Commands()) != 0 {
+		t.Fatalf("relay commands = %v with a short history", b.plug.Commands())
+	}
+	if !strings.Contains(log.String(), "holding the auto-off until it does") {
+		t.Errorf("log = %q, want the hold in the warning", log.String())
+	}
+
+	// The history is long enough after 4 more minutes, but it is only checked again after 10
+	for _, after := range []time.Duration{4 * time.Minute, 9 * time.Minute} {
+		clk.Set(time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC).Add(after))
+		b.setHistory(clk.Now(), phase{length: 5*time.Minute + after, watts: 8})
+		RunCycle(ctx, cfg, state)
+		expectDecision(t, state, after.String()+" later", OutcomeSkip, ReasonShortHistory)
+	}
+
+	clk.Set(time.Date(2026, 3, 1, 20, 10, 0, 0, time.UTC))
+	b.setHistory(clk.Now(), phase{length: 15 * time.Minute, watts: 8})
+	log.Reset()
+	RunCycle(ctx, cfg, state)
+	expectDecision(t, state, "history long enough", OutcomeTurnOff, "")
+	if state.HistoryShort != nil || !strings.Contains(log.String(), "Power history covers the longest lookback again") {
+		t.Errorf("short history = %v, log %q, want it cleared", state.HistoryShort, log.String())
+	}
+	if len(b.plug.Commands()) != 1 {
+		t.Errorf("relay commands = %v, want the off", b.plug.Commands())
+	}
+}
+
+func TestShortHistoryCheckFailure(t *testing.T) {
+	cfg, state, b, _, log := newShortHistory(t, historyRequired)
+	b.vm.Fail(500, "storage unavailable")
+
+	state.mu.Lock()
+	checkHistory(context.Background(), cfg, state)
+	state.mu.Unlock()
+	if state.HistoryCheckedAt != nil || state.HistoryShort != nil {
+		t.Errorf("after a failed check: checked at %v, short %v, want neither", state.HistoryCheckedAt, state.HistoryShort)
+	}
+	if !strings.Contains(log.String(), "Checking the power history failed") {
+		t.Errorf("log = %q, want the failure", log.String())
+	}
+
+	// The next cycle checks again instead of waiting the interval
+	b.vm.Fail(0, "")
+	state.mu.Lock()
+	checkHistory(context.Background(), cfg, state)
+	state.mu.Unlock()
+	if state.HistoryShort == nil || *state.HistoryShort != 5*time.Minute {
+		t.Errorf("short history = %v, want 5m on the retry", state.HistoryShort)
+	}
+}
+
+func TestHistoryLookback(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want time.Duration
+	}{
+		{"defaults", nil, 21 * time.Minute},
+		{"long standby", []string{"-standby-duration", "30m"}, 35 * time.Minute},
+		{"long peak standby", []string{"-peak-standby-duration", "20m"}, 25 * time.Minute},
+		{"quantile standby", []string{"-standby-mode", "quantile", "-standby-duration", "30m"}, 30 * time.Minute},
+		// The print power gate looks back over its duration and cooldown
+		{"print power", []string{"-print-power-cooldown", "1h"}, time.Hour + 4*time.Minute},
+		{"short lookbacks", shortArgs, 8 * time.Minute},
+		{"calibration power", []string{"-calibration-power-watts", "40", "-calibration-power-duration", "30m"}, 31 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, append([]string{"-vm-password", "secret"}, tt.args...)...)
+			if got := historyLookback(&cfg); got != tt.want {
+				t.Errorf("lookback = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
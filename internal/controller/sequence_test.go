@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics/metricstest"
+)
+
+// scrapeInterval is how often the simulated exporters report
+const scrapeInterval = 30 * time.Second
+
+// bootDraw is how long a printer draws bootWatts after being switched on
+const (
+	bootDraw  = 2 * time.Minute
+	bootWatts = 120
+)
+
+// simulation steps a controller through simulated time on a fake clock. The plug draws power by its
+// relay state: nothing while off, the boot draw after being switched on and standby power after that.
+type simulation struct {
+	t     *testing.T
+	cfg   *config.Config
+	state *State
+	b     *backends
+	clk   *clock.Fake
+	start time.Time
+
+	configure []func(cfg *config.Config)
+
+	onSince   *time.Time
+	nextCycle time.Time
+	changes   []string // Decisions whenever they change, as "minute outcome reason"
+	switches  []string // Relay changes, as "minute on|off"
+}
+
+// newSimulation starts with the plug switched on at the start, after an hour off
+func newSimulation(t *testing.T, configure ...func(cfg *config.Config)) *simulation {
+	t.Helper()
+	start := time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start.Add(-time.Hour))
+	cfg, state, b := newIntegration(t, clk, configure...)
+	s := &simulation{t: t, cfg: cfg, state: state, b: b, clk: clk, start: start, configure: configure, nextCycle: start}
+	b.plug.SetOn(false)
+	for clk.Now().Before(start) {
+		s.scrape()
+		clk.Advance(scrapeInterval)
+	}
+	b.plug.SetOn(true)
+	return s
+}
+
+// watts is the draw of the printer behind the plug now
+func (s *simulation) watts() float64 {
+	now := s.clk.Now()
+	if !s.b.plug.On() {
+		if s.onSince != nil {
+			s.switches = append(s.switches, fmt.Sprintf("%g off", s.minute()))
+		}
+		s.onSince = nil
+		return 0
+	}
+	if s.onSince == nil {
+		s.onSince = &now
+		if now.After(s.start) {
+			s.switches = append(s.switches, fmt.Sprintf("%g on", s.minute()))
+		}
+	}
+	if now.Sub(*s.onSince) < bootDraw {
+		return bootWatts
+	}
+	return 8
+}
+
+// scrape records the current power and an idle printer
+func (s *simulation) scrape() {
+	now := s.clk.Now()
+	s.b.vm.Add(metricstest.ShellyWatts("bambu-plug", s.b.plug.Address()), metricstest.Sample{Time: now, Value: s.watts()})
+	s.b.vm.Add(metricstest.GcodeState("x1c"), metricstest.Sample{Time: now, Value: 0})
+}
+
+// run advances the simulation by d, scraping and running the cycles when they are due
+func (s *simulation) run(d time.Duration) {
+	s.t.Helper()
+	for end := s.clk.Now().Add(d); s.clk.Now().Before(end); {
+		s.scrape()
+		if !s.clk.Now().Before(s.nextCycle) {
+			next := RunCycle(context.Background(), s.cfg, s.state)
+			s.nextCycle = s.clk.Now().Add(next)
+			s.record()
+		}
+		s.clk.Advance(scrapeInterval)
+	}
+}
+
+// record notes the decision of the cycle if it differs from the previous one
+func (s *simulation) record() {
+	outcome := "ERROR " + s.state.LastCycleError
+	if d := s.state.LastDecision; d != nil && s.state.LastCycleError == "" {
+		outcome = strings.TrimSpace(d.Outcome + " " + d.Reason)
+	}
+	change := fmt.Sprintf("%g %s", s.minute(), outcome)
+	if n := len(s.changes); n == 0 || !strings.HasSuffix(s.changes[n-1], " "+outcome) {
+		s.changes = append(s.changes, change)
+	}
+}
+
+// minute is the simulated time since the plug was switched on at the start
+func (s *simulation) minute() float64 {
+	return s.clk.Now().Sub(s.start).Minutes()
+}
+
+// expect compares the decision and relay changes with the wanted ones
+func (s *simulation) expect(decisions, switches []string) {
+	s.t.Helper()
+	if got := strings.Join(s.changes, "\n"); got != strings.Join(decisions, "\n") {
+		s.t.Errorf("decisions:\n%s\nwant:\n%s", got, strings.Join(decisions, "\n"))
+	}
+	if got := strings.Join(s.switches, ", "); got != strings.Join(switches, ", ") {
+		s.t.Errorf("relay changes = %s, want %s", got, strings.Join(switches, ", "))
+	}
+}
+
+func TestSequenceBootToOff(t *testing.T) {
+	s := newSimulation(t)
+	s.run(time.Hour)
+	// The boot draw is seen as a power-on for the boot grace plus a minute. The standby window of
+	// STANDBY_DURATION has long cleared of the boot draw by then, so it is all standby.
+	s.expect([]string{
+		"0 SKIP boot_grace",
+		"21 TURN_OFF",
+		"22 SKIP recently_off",
+		"31 SKIP relay_off",
+	}, []string{"21.5 off"})
+	if s.state.Daily.RelayOffs != 1 || s.state.LastRelayOffTime == nil || !s.state.LastRelayOffTime.Equal(s.start.Add(21*time.Minute)) {
+		t.Errorf("offs = %d, last at %v", s.state.Daily.RelayOffs, s.state.LastRelayOffTime)
+	}
+}
+
+func TestSequenceSwitchedOnDuringCooldown(t *testing.T) {
+	s := newSimulation(t)
+	s.run(25 * time.Minute)
+	// Switched back on 3.5 minutes after the auto-off: the cooldown holds first, then the boot grace
+	s.b.plug.SetOn(true)
+	s.run(45 * time.Minute)
+	s.expect([]string{
+		"0 SKIP boot_grace",
+		"21 TURN_OFF",
+		"22 SKIP recently_off",
+		"31 SKIP boot_grace",
+		"46 TURN_OFF",
+		"47 SKIP recently_off",
+		"56 SKIP relay_off",
+	}, []string{"21.5 off", "25 on", "46.5 off"})
+}
+
+func TestSequenceBootGraceOutlastsStandby(t *testing.T) {
+	s := newSimulation(t, func(cfg *config.Config) { cfg.BootGracePeriod = 40 * time.Minute })
+	s.run(time.Hour)
+	// Standby was reached long before, the auto-off follows the boot grace right away
+	s.expect([]string{
+		"0 SKIP boot_grace",
+		"41 TURN_OFF",
+		"42 SKIP recently_off",
+		"51 SKIP relay_off",
+	}, []string{"41.5 off"})
+}
+
+func TestSequenceCooldownOutlastsBootGrace(t *testing.T) {
+	s := newSimulation(t, func(cfg *config.Config) {
+		cfg.StandbyDuration, cfg.BootGracePeriod, cfg.OffCooldown = 5*time.Minute, 5*time.Minute, 30*time.Minute
+	})
+	s.run(15 * time.Minute)
+	s.b.plug.SetOn(true)
+	s.run(45 * time.Minute)
+	// Standby waits for the boot draw to leave the 5 minute window. The second boot grace passes during
+	// the cooldown, which alone holds back the next auto-off until it ends.
+	s.expect([]string{
+		"0 SKIP boot_grace",
+		"6 STANDBY",
+		"7 TURN_OFF",
+		"8 SKIP recently_off",
+		"37 TURN_OFF",
+		"38 SKIP recently_off",
+	}, []string{"7.5 off", "15 on", "37.5 off"})
+}
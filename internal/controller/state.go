@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/calendar"
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/leader"
+	"gome-assistant/internal/metrics"
+	"gome-assistant/internal/price"
+	"gome-assistant/internal/printer"
+	"gome-assistant/internal/relay"
+)
+
+// State tracks the current state of the assistant
+type State struct {
+	mu       sync.Mutex // Guards the fields, released by the cycles for their network requests
+	cycle    sync.Mutex // Serializes the check cycles
+	commands int        // Control commands applied, a cycle drops its auto-off when one ran meanwhile
+
+	ShellyIP              string                // Cached Shelly device IP from metrics
+	DeviceName            string                // Cached Shelly device name from metrics
+	NameLabelMissing      bool                  // The power series lack the identity label, logged once
+	InfoAddress           *InfoAddress          // Shelly IP joined from SHELLY_INFO_METRIC
+	LabelIPConflict       string                // Address label disagreeing with SHELLY_IP, logged once
+	MDNSAddress           string                // Shelly address discovered via mDNS, until it is unreachable
+	MDNSCheckedAt         *time.Time            // When the last mDNS discovery ran
+	CloudID               string                // Shelly Cloud ID from SHELLY_ID_LABEL
+	LastRelayOffTime      *time.Time            // When we last turned off the relay
+	LastWatts             *float64              // Power reading of the previous cycle
+	RelayFailures         int                   // Consecutive failed relay commands
+	OffRetry              *OffRetry             // Auto-off whose relay command failed, repeated by the next cycle
+	Actuations            []time.Time           // Relay commands sent within the last hour, for the rate limits
+	ActuationsBlocked     int                   // Relay commands held back by the rate limits
+	LockoutActive         bool                  // Relay control is paused for safety
+	PrinterAuthFailed     bool                  // The printer state source rejects the credentials, notified once
+	MaintenanceSince      *time.Time            // Since when an update or processing state has been reported
+	MaintenanceNotified   bool                  // The long maintenance hold was notified
+	MaintenanceExpired    bool                  // The maintenance hold passed MaintenanceMaxHold
+	MaintenanceMissing    map[string]bool       // Maintenance queries without series, logged once
+	PrinterStates         map[string]float64    // Latest state value by printer, to notice finished prints
+	AutoOnWake            bool                  // The AUTO_ON wake condition held in the last cycle
+	PrintFinishedAt       *time.Time            // When a trigger reported the end of a print
+	CalibrationMissing    bool                  // CALIBRATION_STAGE_METRIC has no series, logged once
+	HistoryCheckedAt      *time.Time            // When the power history was last compared with the lookbacks
+	HistoryShort          *time.Duration        // Power history while it is shorter than the longest lookback
+	QualityMissing        map[string]bool       // Data quality metrics without series, logged once
+	UntrustedReadings     int                   // Cycles skipped for an implausible voltage or power factor
+	DryRunWatches         []time.Time           // Would-be auto-offs of the dry run whose outcome is still watched
+	DryRunDiff            DryRunDiff            // Would-be auto-offs against the observed relay, since the start
+	TempLevel             string                // Highest overtemperature level notified, until it cools down
+	TempMissing           bool                  // No temperature reading was found, logged once
+	AnnouncedStandbyStart *time.Time            // Start of the standby streak whose auto-off countdown was notified
+	StandbyCarry          *time.Time            // Start of a standby streak resumed from STATE_FILE, until it breaks
+	Restored              *PersistedState       // Read from STATE_FILE, validated by the first evaluation
+	StateFileFailing      bool                  // Writing STATE_FILE failed, logged once
+	Daily                 DailyStats            // Counters for the daily summary
+	LastCycleTime         *time.Time            // When the last check cycle finished
+	LastCycleError        string                // Error of the last check cycle, if any
+	SkippedCycles         int                   // Checks that fell due while a longer cycle ran and were dropped
+	FastRetries           int                   // Consecutive failed cycles retried after RetryDelay
+	FailingSince          *time.Time            // When the current streak of failed cycles started
+	Interval              time.Duration         // Check interval in effect, stretched during an outage
+	HoldUntil             *time.Time            // Automatic switching is suspended until then
+	PendingOffSince       *time.Time            // When the current auto-off entered its veto window
+	ArmedSince            *time.Time            // When the current auto-off was armed for re-verification
+	LastRecheck           string                // Outcome of the last re-verification of an armed auto-off
+	VetoTime              *time.Time            // When a pending auto-off was last vetoed
+	Bus                   *Bus                  // Receives the events of cycles and actions
+	Metrics               metrics.Client        // Answers the power and printer queries
+	Queries               QueryLimit            // Limit of the metric queries shared by every device, nil for none
+	Printer               printer.StateSource   // Tells whether the printer is printing
+	Relay                 relay.Controller      // Switches the plug at ShellyIP
+	Clock                 clock.Clock           // Source of the current time for all timing decisions
+	Leader                *leader.Elector       // Leader election among replicas, nil if every instance actuates
+	AlertPauses           map[string]AlertPause // Firing alerts pausing automation, by fingerprint
+	Calendar              *calendar.Holds       // Holds from calendar events, nil if not configured
+	Prices                *price.Prices         // Hourly electricity prices, nil if not configured
+	Stores                []MemoryStore         // Bounded in-memory stores reported in /status and /probe
+	Log                   *slog.Logger          // Adds the device name of DEVICES to the logs, nil for the default logger
+	Heartbeat             *Heartbeat            // Shared by every device, nil to publish the heartbeat after each cycle
+	PeakPrice             bool                  // The price is above PeakPrice, logged on change
+	LastEvaluation        *Decision             // Latest evaluation of the gates by a cycle or probe
+	LastDecision          *DecisionMade         // Decision of the last cycle that got that far
+}
+
+// logger returns Log, or the default logger without one
+func (s *State) logger() *slog.Logger {
+	if s.Log == nil {
+		return slog.Default()
+	}
+	return s.Log
+}
+
+// unlocked runs fn with mu released, for the network requests of a cycle, so status queries and control
+// commands don't wait for them. fn must not touch the fields mu guards, and they may have changed when it
+// returns. The caller holds state.mu.
+func (s *State) unlocked(fn func()) {
+	s.mu.Unlock()
+	defer s.mu.Lock()
+	fn()
+}
+
+// DailyStats collects counters for one day of operation
+type DailyStats struct {
+	Date          string
+	Cycles        int
+	Errors        int
+	RelayOffs     int
+	RelayFailures int
+	Untrusted     int
+	DryRun        DryRunDiff
+}
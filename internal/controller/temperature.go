@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics"
+	"gome-assistant/internal/relay"
+)
+
+// Overtemperature levels of State.TempLevel
+const (
+	TempWarning  = "warning"
+	TempCritical = "critical"
+)
+
+// tempHysteresis is how far below the warning threshold the device has to cool down before an
+// overtemperature is notified again
+const tempHysteresis = 5
+
+// checkTemperature notifies when the Shelly device runs hot and switches the relay off above the
+// critical threshold, overriding every gate. It reports whether it took over the cycle. The caller
+// holds state.mu.
+func checkTemperature(ctx context.Context, cfg *config.Config, state *State, watts float64) (bool, error) {
+	if cfg.TempMetric == "" {
+		return false, nil
+	}
+	celsius, err := readTemperature(ctx, cfg, state)
+	if err != nil {
+		return false, err
+	}
+	if celsius == nil {
+		if !state.TempMissing {
+			state.logger().Warn("No Shelly temperature in the metric or the status API, skipping the overtemperature check", "metric", cfg.TempMetric)
+			state.TempMissing = true
+		}
+		return false, nil
+	}
+	if state.TempMissing {
+		state.logger().Info("Shelly temperature found", "celsius", *celsius)
+		state.TempMissing = false
+	}
+
+	now := state.Clock.Now()
+	switch {
+	case *celsius >= cfg.TempCritical:
+		if state.TempLevel != TempCritical {
+			state.TempLevel = TempCritical
+			state.logger().Error("Shelly overheating, turning off relay whatever the printer does", "celsius", *celsius, "critical", cfg.TempCritical)
+			state.Bus.Publish(OvertemperatureDetected{Time: now, Device: state.DeviceName, Celsius: *celsius, Threshold: cfg.TempCritical, Critical: true})
+		}
+		// No power draw means the relay is already off
+		if watts == 0 {
+			return false, nil
+		}
+		return true, overtemperatureOff(cfg, state, watts)
+	case *celsius >= cfg.TempWarning:
+		if state.TempLevel == "" {
+			state.TempLevel = TempWarning
+			state.logger().Warn("Shelly running hot", "celsius", *celsius, "warning", cfg.TempWarning)
+			state.Bus.Publish(OvertemperatureDetected{Time: now, Device: state.DeviceName, Celsius: *celsius, Threshold: cfg.TempWarning})
+		}
+	case *celsius < cfg.TempWarning-tempHysteresis:
+		if state.TempLevel != "" {
+			state.logger().Info("Shelly cooled down", "celsius", *celsius)
+			state.TempLevel = ""
+		}
+	}
+	return false, nil
+}
+
+// readTemperature reads the temperature metric of the device and falls back to its status API, nil if
+// neither has one. The caller holds state.mu, which is released for the requests.
+func readTemperature(ctx context.Context, cfg *config.Config, state *State) (*float64, error) {
+	ip := state.ShellyIP
+	var celsius *float64
+	var err error
+	state.unlocked(func() {
+		celsius, err = metrics.ShellyValue(ctx, state.Metrics, state.Clock.Now(), cfg.TempMetric, metrics.ConfigDevice(cfg))
+	})
+	if err != nil || celsius != nil || ip == "" {
+		return celsius, err
+	}
+	temps, ok := state.Relay.(relay.Temperatures)
+	if !ok {
+		return nil, nil
+	}
+	state.unlocked(func() { celsius, err = temps.Temperature(ip) })
+	if err != nil {
+		if !state.TempMissing {
+			state.logger().Error("Reading the Shelly temperature from its status API failed", "error", err)
+		}
+		return nil, nil
+	}
+	return celsius, nil
+}
+
+// overtemperatureOff switches the relay off for an overheating device. The caller holds state.mu.
+func overtemperatureOff(cfg *config.Config, state *State, watts float64) error {
+	// Followers evaluate like the leader but never actuate
+	if !state.Leader.IsLeader() {
+		state.logger().Info("Not the leader, observing only: would turn off relay for overtemperature")
+		return nil
+	}
+	if !canSwitch(cfg, state) {
+		state.logger().Error("No Shelly IP available")
+		return fmt.Errorf("no shelly IP available")
+	}
+
+	if err := actuate(cfg, state, false, SourceOvertemp, false); err != nil {
+		state.logger().Error("Turning off the relay failed", "action", ActionOff, "source", SourceOvertemp, "error", err)
+		state.RelayFailures++
+		state.Daily.RelayFailures++
+		state.Bus.Publish(ActionFailed{
+			Time:     state.Clock.Now(),
+			Device:   state.DeviceName,
+			Action:   ActionOff,
+			Source:   SourceOvertemp,
+			Err:      err,
+			Failures: state.RelayFailures,
+			Watts:    watts,
+		})
+		return err
+	}
+	state.logger().Info("Relay turned off for overtemperature", "action", ActionOff, "source", SourceOvertemp, "watts", watts, "result", confirmedState(cfg, false))
+	now := state.Clock.Now()
+	state.LastRelayOffTime = &now
+	state.RelayFailures = 0
+	state.Daily.RelayOffs++
+	state.Bus.Publish(ActionExecuted{
+		Time:   now,
+		Device: state.DeviceName,
+		Action: ActionOff,
+		Source: SourceOvertemp,
+		Watts:  watts,
+		DryRun: cfg.DryRun,
+	})
+	return nil
+}
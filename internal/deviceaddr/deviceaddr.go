@@ -0,0 +1,61 @@
+// Package deviceaddr normalizes the addresses of plugs from the metrics and the config for every relay backend
+package deviceaddr
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// Host normalizes the address of a plug from a label or the config to the host of its URL:
+// an IPv4 address or hostname with an optional port, or an IPv6 address in brackets, like
+// [fd00::5054] or [fe80::1%eth0]:8080. IPv6 addresses are accepted with or without brackets.
+func Host(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	if address == "" || strings.ContainsAny(address, "/?#@ ") {
+		return "", fmt.Errorf("invalid device address %q", address)
+	}
+	// A bare IPv6 address, whose colons would otherwise be taken for a port
+	if addr, err := netip.ParseAddr(address); err == nil {
+		return HostOf(addr), nil
+	}
+	if inner, ok := strings.CutPrefix(address, "["); ok && strings.HasSuffix(inner, "]") {
+		addr, err := netip.ParseAddr(strings.TrimSuffix(inner, "]"))
+		if err != nil || !addr.Is6() {
+			return "", fmt.Errorf("invalid device address %q", address)
+		}
+		return HostOf(addr), nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		if strings.Contains(address, ":") {
+			return "", fmt.Errorf("invalid device address %q", address)
+		}
+		return address, nil
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		host = addr.String()
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// HostOf formats an address as URL host, bracketing IPv6
+func HostOf(addr netip.Addr) string {
+	if addr.Is4() || addr.Is4In6() {
+		return addr.Unmap().String()
+	}
+	return "[" + addr.String() + "]"
+}
+
+// URL builds the URL of a device API path with net/url, so zones of link-local addresses are escaped
+func URL(address, path, query string) (string, error) {
+	host, err := Host(address)
+	if err != nil {
+		return "", err
+	}
+	u := url.URL{Scheme: "http", Host: host, Path: path, RawQuery: query}
+	return u.String(), nil
+}
@@ -0,0 +1,85 @@
+package deviceaddr
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHost(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string // Empty for an invalid address
+	}{
+		{"192.168.1.42", "192.168.1.42"},
+		{"192.168.1.42:8080", "192.168.1.42:8080"},
+		{" 192.168.1.42 ", "192.168.1.42"},
+		{"shelly-plug.lan", "shelly-plug.lan"},
+		{"shelly-plug.lan:80", "shelly-plug.lan:80"},
+		// IPv6 from a label comes without brackets, from the config with or without
+		{"fd00::5054", "[fd00::5054]"},
+		{"[fd00::5054]", "[fd00::5054]"},
+		{"[fd00::5054]:8080", "[fd00::5054]:8080"},
+		{"FD00:0:0::5054", "[fd00::5054]"},
+		{"::1", "[::1]"},
+		{"fe80::1%eth0", "[fe80::1%eth0]"},
+		{"[fe80::1%eth0]", "[fe80::1%eth0]"},
+		{"[fe80::1%eth0]:8080", "[fe80::1%eth0]:8080"},
+		// An IPv4 address mapped to IPv6 is the IPv4 address
+		{"::ffff:192.168.1.42", "192.168.1.42"},
+		{"", ""},
+		{"http://192.168.1.42", ""},
+		{"192.168.1.42/relay/0", ""},
+		{"user@192.168.1.42", ""},
+		{"shelly plug", ""},
+		{"fd00::5054:8080:", ""},
+		{"[192.168.1.42]", ""},
+		{"[fd00::zz]", ""},
+		{"[fd00::5054", ""},
+	}
+	for _, tt := range tests {
+		got, err := Host(tt.address)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("Host(%q) = %q, want an error", tt.address, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Host(%q) = %q, %v, want %q", tt.address, got, err, tt.want)
+		}
+	}
+}
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		address, path, query string
+		want                 string
+	}{
+		{"192.168.1.42", "/relay/0", "turn=off", "http://192.168.1.42/relay/0?turn=off"},
+		{"shelly-plug.lan", "/rpc/Switch.GetStatus", "id=0", "http://shelly-plug.lan/rpc/Switch.GetStatus?id=0"},
+		{"fd00::5054", "/relay/0", "turn=off", "http://[fd00::5054]/relay/0?turn=off"},
+		{"[fd00::5054]:8080", "/shelly", "", "http://[fd00::5054]:8080/shelly"},
+		// The zone is escaped in the URL
+		{"fe80::1%eth0", "/rpc/Switch.Set", "", "http://[fe80::1%25eth0]/rpc/Switch.Set"},
+		{"[fe80::1%wlan0]:80", "/relay/1", "turn=on", "http://[fe80::1%25wlan0]:80/relay/1?turn=on"},
+	}
+	for _, tt := range tests {
+		got, err := URL(tt.address, tt.path, tt.query)
+		if err != nil || got != tt.want {
+			t.Errorf("URL(%q) = %q, %v, want %q", tt.address, got, err, tt.want)
+			continue
+		}
+		// The URL parses back to the same host
+		req, err := http.NewRequest(http.MethodGet, got, nil)
+		if err != nil {
+			t.Errorf("%s: %v", got, err)
+			continue
+		}
+		if host, _ := Host(tt.address); req.URL.Host != host {
+			t.Errorf("%s: host %q, want %q", got, req.URL.Host, host)
+		}
+	}
+	if _, err := URL("http://192.168.1.42", "/shelly", ""); err == nil {
+		t.Error("URL as address accepted")
+	}
+}
@@ -0,0 +1,136 @@
+// Package homeassistant reports the printer state through the Home Assistant REST API
+package homeassistant
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+	"gome-assistant/internal/mqtt"
+)
+
+// Reporter pushes the state of every cycle to Home Assistant sensor entities
+type Reporter struct {
+	cfg    *config.Config
+	url    string
+	client *http.Client
+
+	// Touched only by the bus subscriber goroutine
+	decision *controller.DecisionMade
+	failing  bool
+}
+
+// haState is the body of POST /api/states/<entity_id>
+type haState struct {
+	State      string         `json:"state"`
+	Attributes map[string]any `json:"attributes"`
+}
+
+func NewReporter(cfg *config.Config) *Reporter {
+	return &Reporter{
+		cfg:    cfg,
+		url:    strings.TrimSuffix(cfg.HAURL, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Handle is the event bus subscriber of the Home Assistant REST reporter
+func (r *Reporter) Handle(be controller.BusEvent) error {
+	switch e := be.(type) {
+	case controller.DecisionMade:
+		r.decision = &e
+	case controller.CycleCompleted:
+		d := r.decision
+		r.decision = nil
+		if d == nil {
+			return nil
+		}
+		err := r.report(*d)
+		// Only report the first failure while Home Assistant is down
+		if err != nil && r.failing {
+			return nil
+		}
+		if err == nil && r.failing {
+			slog.Info("Home Assistant state reporting recovered")
+		}
+		r.failing = err != nil
+		return err
+	}
+	return nil
+}
+
+// report updates the power and state sensors of the decision's device
+func (r *Reporter) report(d controller.DecisionMade) error {
+	prefix := "sensor.gome_assistant_" + mqtt.HAID(mqtt.TopicSegment(d.Device))
+
+	var projected any
+	if !d.ProjectedOffTime.IsZero() {
+		projected = d.ProjectedOffTime.Format(time.RFC3339)
+	}
+
+	states := map[string]haState{
+		prefix + "_power": {
+			State: fmt.Sprintf("%.1f", d.Watts),
+			Attributes: map[string]any{
+				"friendly_name":       d.Device + " power",
+				"unit_of_measurement": "W",
+				"device_class":        "power",
+				"state_class":         "measurement",
+			},
+		},
+		prefix + "_state": {
+			State: d.Outcome,
+			Attributes: map[string]any{
+				"friendly_name":      d.Device + " auto-off state",
+				"reason":             d.Reason,
+				"watts":              d.Watts,
+				"standby_seconds":    int(d.StandbyDuration.Seconds()),
+				"projected_off_time": projected,
+				"icon":               "mdi:printer-3d",
+			},
+		},
+	}
+
+	for entityID, state := range states {
+		if err := r.post(entityID, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Reporter) post(entityID string, state haState) error {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", r.url+"/api/states/"+entityID, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.cfg.Secret("HA_TOKEN"))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	// 201 when the entity was created, 200 when it was updated
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("home assistant state update of %s failed with status %d: %s", entityID, resp.StatusCode, string(body))
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+const testToken = "long-lived-token"
+
+// entityID is the entity ID syntax Home Assistant accepts
+var entityID = regexp.MustCompile(`^sensor\.[a-z0-9_]+$`)
+
+// fakeHA is a Home Assistant REST API validating and recording state updates
+type fakeHA struct {
+	*httptest.Server
+	t *testing.T
+
+	mu     sync.Mutex
+	down   bool
+	states map[string]haState
+}
+
+func newFakeHA(t *testing.T) *fakeHA {
+	t.Helper()
+	f := &fakeHA{t: t, states: map[string]haState{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeHA) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		http.Error(w, "502: Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	if got := r.Header.Get("Authorization"); got != "Bearer "+testToken {
+		http.Error(w, "401: Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id, ok := strings.CutPrefix(r.URL.Path, "/api/states/")
+	if r.Method != http.MethodPost || !ok {
+		http.Error(w, "404: Not Found", http.StatusNotFound)
+		return
+	}
+	if !entityID.MatchString(id) {
+		f.t.Errorf("invalid entity ID %q", id)
+		http.Error(w, "Invalid entity ID", http.StatusBadRequest)
+		return
+	}
+	var state haState
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "Invalid JSON specified.", http.StatusBadRequest)
+		return
+	}
+	status := http.StatusOK
+	if _, ok := f.states[id]; !ok {
+		status = http.StatusCreated
+	}
+	f.states[id] = state
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"entity_id": id, "state": state.State})
+}
+
+func (f *fakeHA) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *fakeHA) state(t *testing.T, id string) haState {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state, ok := f.states[id]
+	if !ok {
+		t.Fatalf("entity %s not reported, have %v", id, f.states)
+	}
+	return state
+}
+
+// cycle hands a decision and the end of its cycle to the reporter
+func cycle(r *Reporter, d controller.DecisionMade) error {
+	if err := r.Handle(d); err != nil {
+		return err
+	}
+	return r.Handle(controller.CycleCompleted{})
+}
+
+func TestReporterCreatesAndUpdatesSensors(t *testing.T) {
+	ha := newFakeHA(t)
+	r := NewReporter(&config.Config{HAURL: ha.URL + "/", HAToken: testToken})
+
+	projected := time.Date(2026, 3, 1, 20, 45, 0, 0, time.UTC)
+	err := cycle(r, controller.DecisionMade{
+		Device:           "Bambu Plug/X1C",
+		Outcome:          controller.OutcomeSkip,
+		Reason:           "standby 10m0s of 30m0s",
+		Watts:            8.14,
+		StandbyDuration:  10 * time.Minute,
+		ProjectedOffTime: projected,
+	})
+	if err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+
+	power := ha.state(t, "sensor.gome_assistant_bambu_plug_x1c_power")
+	if power.State != "8.1" {
+		t.Errorf("power state = %q, want 8.1", power.State)
+	}
+	for key, want := range map[string]any{"unit_of_measurement": "W", "device_class": "power", "state_class": "measurement", "friendly_name": "Bambu Plug/X1C power"} {
+		if power.Attributes[key] != want {
+			t.Errorf("power attribute %s = %v, want %v", key, power.Attributes[key], want)
+		}
+	}
+
+	state := ha.state(t, "sensor.gome_assistant_bambu_plug_x1c_state")
+	if state.State != controller.OutcomeSkip {
+		t.Errorf("state = %q, want %q", state.State, controller.OutcomeSkip)
+	}
+	for key, want := range map[string]any{"reason": "standby 10m0s of 30m0s", "watts": 8.14, "standby_seconds": 600.0, "projected_off_time": "2026-03-01T20:45:00Z"} {
+		if state.Attributes[key] != want {
+			t.Errorf("state attribute %s = %v, want %v", key, state.Attributes[key], want)
+		}
+	}
+
+	// The second cycle updates the existing entities, without a projected off time
+	if err := cycle(r, controller.DecisionMade{Device: "Bambu Plug/X1C", Outcome: controller.OutcomeSkip, Watts: 120}); err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	state = ha.state(t, "sensor.gome_assistant_bambu_plug_x1c_state")
+	if v, ok := state.Attributes["projected_off_time"]; !ok || v != nil {
+		t.Errorf("projected_off_time = %v, want null", v)
+	}
+	if got := ha.state(t, "sensor.gome_assistant_bambu_plug_x1c_power").State; got != "120.0" {
+		t.Errorf("power state = %q, want 120.0", got)
+	}
+}
+
+func TestReporterIgnoresCyclesWithoutDecision(t *testing.T) {
+	ha := newFakeHA(t)
+	r := NewReporter(&config.Config{HAURL: ha.URL, HAToken: testToken})
+	if err := r.Handle(controller.CycleCompleted{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ha.states) != 0 {
+		t.Errorf("reported %v without a decision", ha.states)
+	}
+}
+
+func TestReporterReportsOutageOnce(t *testing.T) {
+	ha := newFakeHA(t)
+	r := NewReporter(&config.Config{HAURL: ha.URL, HAToken: testToken})
+	d := controller.DecisionMade{Device: "plug", Outcome: controller.OutcomeSkip}
+
+	ha.setDown(true)
+	err := cycle(r, d)
+	if err == nil || !strings.Contains(err.Error(), "status 502") {
+		t.Fatalf("first failure: error = %v, want the status", err)
+	}
+	if strings.Contains(err.Error(), testToken) {
+		t.Errorf("error %q contains the token", err)
+	}
+	if err := cycle(r, d); err != nil {
+		t.Fatalf("repeated failure reported: %v", err)
+	}
+
+	ha.setDown(false)
+	if err := cycle(r, d); err != nil {
+		t.Fatalf("after recovery: %v", err)
+	}
+	ha.state(t, "sensor.gome_assistant_plug_state")
+
+	ha.setDown(true)
+	if err := cycle(r, d); err == nil {
+		t.Fatal("failure of a new outage not reported")
+	}
+}
+
+func TestReporterRejectedToken(t *testing.T) {
+	ha := newFakeHA(t)
+	r := NewReporter(&config.Config{HAURL: ha.URL, HAToken: "revoked"})
+	err := cycle(r, controller.DecisionMade{Device: "plug"})
+	if err == nil || !strings.Contains(err.Error(), "status 401") {
+		t.Fatalf("error = %v, want status 401", err)
+	}
+	if strings.Contains(err.Error(), "revoked") {
+		t.Errorf("error %q contains the token", err)
+	}
+}
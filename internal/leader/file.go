@@ -0,0 +1,95 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileLock is a lease stored as a JSON file on storage shared by all instances.
+// The holder rewrites it every renew interval; a record older than the lease duration is up for grabs.
+type fileLock struct {
+	path string
+}
+
+// fileRecord is the content of the lock file
+type fileRecord struct {
+	Holder    string    `json:"holder"`
+	RenewedAt time.Time `json:"renewed_at"`
+}
+
+func (l *fileLock) Name() string {
+	return "lock file " + l.path
+}
+
+func (l *fileLock) TryAcquire(_ context.Context, identity string, now time.Time, leaseDuration time.Duration) (bool, error) {
+	record, err := l.read()
+	if err != nil {
+		return false, err
+	}
+	if record != nil && record.Holder != identity && now.Sub(record.RenewedAt) < leaseDuration {
+		return false, nil
+	}
+
+	if err := l.write(fileRecord{Holder: identity, RenewedAt: now}); err != nil {
+		return false, err
+	}
+
+	// Another instance may have taken over the expired lease at the same time; the last rename wins
+	record, err = l.read()
+	if err != nil {
+		return false, err
+	}
+	return record != nil && record.Holder == identity, nil
+}
+
+func (l *fileLock) Release(_ context.Context, identity string) error {
+	record, err := l.read()
+	if err != nil || record == nil || record.Holder != identity {
+		return err
+	}
+	return os.Remove(l.path)
+}
+
+// read returns the current record, nil if there is none
+func (l *fileLock) read() (*fileRecord, error) {
+	data, err := os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record fileRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", l.path, err)
+	}
+	return &record, nil
+}
+
+// write replaces the record atomically so readers never see a partial write
+func (l *fileLock) write(record fileRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), "."+filepath.Base(l.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after the rename
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path)
+}
@@ -0,0 +1,227 @@
+package leader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/outbound"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into pods
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// microTime is the timestamp format of Lease fields
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// inCluster reports whether the process runs in a Kubernetes pod with a service account
+func inCluster() bool {
+	if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return false
+	}
+	_, err := os.Stat(serviceAccountDir + "/token")
+	return err == nil
+}
+
+// kubernetesLease is a coordination.k8s.io/v1 Lease updated through the API server of the cluster.
+// Updates carry the resourceVersion, so of two instances racing for an expired lease only one succeeds.
+type kubernetesLease struct {
+	namespace string
+	name      string
+	leasesURL string // Collection of the leases in the namespace
+	client    *http.Client
+}
+
+// lease is the part of the Lease object the elector reads and writes
+type lease struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   map[string]any `json:"metadata"` // Kept as is, including the resourceVersion
+	Spec       struct {
+		HolderIdentity       *string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          *string `json:"acquireTime,omitempty"`
+		RenewTime            *string `json:"renewTime,omitempty"`
+		LeaseTransitions     *int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+func newKubernetesLease(namespace, name string) (*kubernetesLease, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("kubernetes leader election requires running in a cluster (KUBERNETES_SERVICE_HOST is not set)")
+	}
+	if namespace == "" {
+		data, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("LEADER_LEASE_NAMESPACE is required outside of a pod: %w", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("reading cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("cluster CA contains no certificates")
+	}
+
+	return &kubernetesLease{
+		namespace: namespace,
+		name:      name,
+		leasesURL: fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", net.JoinHostPort(host, port), namespace),
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &outbound.Transport{Base: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}},
+		},
+	}, nil
+}
+
+func (k *kubernetesLease) Name() string {
+	return "Kubernetes lease " + k.namespace + "/" + k.name
+}
+
+func (k *kubernetesLease) url() string {
+	return k.leasesURL + "/" + k.name
+}
+
+func (k *kubernetesLease) TryAcquire(ctx context.Context, identity string, now time.Time, leaseDuration time.Duration) (bool, error) {
+	current, err := k.get(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	renewTime := now.UTC().Format(microTime)
+	seconds := int(leaseDuration.Seconds())
+	if current == nil {
+		l := &lease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		l.Metadata = map[string]any{"name": k.name, "namespace": k.namespace}
+		transitions := 0
+		l.Spec.HolderIdentity = &identity
+		l.Spec.LeaseDurationSeconds = &seconds
+		l.Spec.AcquireTime = &renewTime
+		l.Spec.RenewTime = &renewTime
+		l.Spec.LeaseTransitions = &transitions
+		return k.write(ctx, http.MethodPost, k.leasesURL, l)
+	}
+
+	holder := ""
+	if current.Spec.HolderIdentity != nil {
+		holder = *current.Spec.HolderIdentity
+	}
+	if holder != "" && holder != identity && !leaseExpired(current, now) {
+		return false, nil
+	}
+
+	if holder != identity {
+		transitions := 1
+		if current.Spec.LeaseTransitions != nil {
+			transitions = *current.Spec.LeaseTransitions + 1
+		}
+		current.Spec.HolderIdentity = &identity
+		current.Spec.AcquireTime = &renewTime
+		current.Spec.LeaseTransitions = &transitions
+	}
+	current.Spec.LeaseDurationSeconds = &seconds
+	current.Spec.RenewTime = &renewTime
+	return k.write(ctx, http.MethodPut, k.url(), current)
+}
+
+func (k *kubernetesLease) Release(ctx context.Context, identity string) error {
+	current, err := k.get(ctx)
+	if err != nil || current == nil || current.Spec.HolderIdentity == nil || *current.Spec.HolderIdentity != identity {
+		return err
+	}
+	empty := ""
+	current.Spec.HolderIdentity = &empty
+	_, err = k.write(ctx, http.MethodPut, k.url(), current)
+	return err
+}
+
+// leaseExpired reports whether the holder missed renewing the lease within its duration
+func leaseExpired(l *lease, now time.Time) bool {
+	if l.Spec.RenewTime == nil || l.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	renewed, err := time.Parse(microTime, *l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.Sub(renewed) >= time.Duration(*l.Spec.LeaseDurationSeconds)*time.Second
+}
+
+// get returns the lease, nil if it does not exist yet
+func (k *kubernetesLease) get(ctx context.Context) (*lease, error) {
+	resp, err := k.do(ctx, http.MethodGet, k.url(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("reading lease failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	var l lease
+	if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// write creates or updates the lease. A conflict means another instance changed it first.
+func (k *kubernetesLease) write(ctx context.Context, method, url string, l *lease) (bool, error) {
+	body, err := json.Marshal(l)
+	if err != nil {
+		return false, err
+	}
+	resp, err := k.do(ctx, method, url, body)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("writing lease failed with status %d: %s", resp.StatusCode, string(body))
+	}
+}
+
+// do sends an API request with the service account token, which is reread as it rotates
+func (k *kubernetesLease) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("reading service account token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+	return k.client.Do(req)
+}
@@ -0,0 +1,191 @@
+// Package leader elects the one instance among redundant replicas that may switch the relay
+package leader
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+)
+
+// Lock is a lease on shared storage that at most one identity holds at a time
+type Lock interface {
+	// TryAcquire acquires or renews the lease for identity and reports whether it is held
+	TryAcquire(ctx context.Context, identity string, now time.Time, leaseDuration time.Duration) (bool, error)
+	// Release gives up the lease if identity holds it
+	Release(ctx context.Context, identity string) error
+	// Name describes the lock for logs
+	Name() string
+}
+
+// Status is a snapshot of the leadership of this instance
+type Status struct {
+	Identity string     `json:"identity"`
+	Leader   bool       `json:"leader"`
+	Lock     string     `json:"lock"`
+	Renewed  *time.Time `json:"renewed,omitempty"`
+}
+
+// Elector keeps trying to acquire the lock and renews it while leading
+type Elector struct {
+	lock          Lock
+	identity      string
+	leaseDuration time.Duration
+	renewInterval time.Duration
+	clock         clock.Clock
+	onChange      func(identity string, leader bool)
+
+	mu        sync.Mutex
+	leader    bool
+	renewedAt time.Time
+}
+
+// New creates the elector for the configured lock. onChange is called on every change of leadership.
+func New(cfg *config.Config, clk clock.Clock, onChange func(identity string, leader bool)) (*Elector, error) {
+	mode := cfg.LeaderElection
+	if mode == config.LeaderAuto {
+		mode = config.LeaderFile
+		if inCluster() {
+			mode = config.LeaderKubernetes
+		}
+	}
+
+	var lock Lock
+	switch mode {
+	case config.LeaderFile:
+		if cfg.LeaderLockFile == "" {
+			return nil, fmt.Errorf("LEADER_LOCK_FILE is required for file leader election")
+		}
+		lock = &fileLock{path: cfg.LeaderLockFile}
+	case config.LeaderKubernetes:
+		l, err := newKubernetesLease(cfg.LeaderLeaseNamespace, cfg.LeaderLeaseName)
+		if err != nil {
+			return nil, err
+		}
+		lock = l
+	default:
+		return nil, fmt.Errorf("invalid LEADER_ELECTION %q", cfg.LeaderElection)
+	}
+
+	return &Elector{
+		lock:          lock,
+		identity:      cfg.ReplicaName(),
+		leaseDuration: cfg.LeaderLeaseDuration,
+		renewInterval: cfg.LeaderRenewInterval,
+		clock:         clk,
+		onChange:      onChange,
+	}, nil
+}
+
+// Run renews the lease every renew interval until ctx is done
+func (e *Elector) Run(ctx context.Context) {
+	ticker := e.clock.NewTicker(e.renewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			e.Renew(ctx)
+		}
+	}
+}
+
+// Renew tries to acquire or renew the lease once
+func (e *Elector) Renew(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, e.renewInterval)
+	defer cancel()
+
+	now := e.clock.Now()
+	held, err := e.lock.TryAcquire(ctx, e.identity, now, e.leaseDuration)
+	if err != nil {
+		slog.Error("Leader election failed", "lock", e.lock.Name(), "error", err)
+	}
+
+	e.mu.Lock()
+	if held {
+		e.renewedAt = now
+	}
+	// A failed renewal keeps the leadership until the lease is no longer fresh
+	leader := held || (err != nil && e.leader && e.fresh(e.clock.Now()))
+	changed := leader != e.leader
+	e.leader = leader
+	e.mu.Unlock()
+
+	if changed {
+		e.announce(leader)
+	}
+}
+
+// IsLeader reports whether this instance may actuate. The lease must have been renewed recently enough
+// that no other instance can have acquired it in the meantime. A nil elector always leads.
+func (e *Elector) IsLeader() bool {
+	if e == nil {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader && e.fresh(e.clock.Now())
+}
+
+// Status returns a snapshot of the leadership, nil for a nil elector
+func (e *Elector) Status() *Status {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	status := &Status{Identity: e.identity, Leader: e.leader && e.fresh(e.clock.Now()), Lock: e.lock.Name()}
+	if !e.renewedAt.IsZero() {
+		renewed := e.renewedAt
+		status.Renewed = &renewed
+	}
+	return status
+}
+
+// fresh reports whether the lease is safe to act on, leaving one renew interval of margin before it
+// expires for other instances. The caller holds e.mu.
+func (e *Elector) fresh(now time.Time) bool {
+	return now.Sub(e.renewedAt) < e.leaseDuration-e.renewInterval
+}
+
+// Release gives up the leadership on shutdown, so a follower can take over without waiting for the
+// lease to expire
+func (e *Elector) Release() {
+	e.mu.Lock()
+	wasLeader := e.leader
+	e.leader = false
+	e.mu.Unlock()
+	if !wasLeader {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.lock.Release(ctx, e.identity); err != nil {
+		slog.Error("Releasing leadership failed", "lock", e.lock.Name(), "error", err)
+		return
+	}
+	slog.Info("Released leadership", "identity", e.identity)
+}
+
+func (e *Elector) announce(leader bool) {
+	if leader {
+		slog.Info("Acquired leadership, relay control enabled", "identity", e.identity, "lock", e.lock.Name())
+	} else {
+		slog.Warn("Lost leadership, observing only", "identity", e.identity, "lock", e.lock.Name())
+	}
+	if e.onChange != nil {
+		e.onChange(e.identity, leader)
+	}
+}
+
+// Identity returns the name this instance competes under
+func (e *Elector) Identity() string {
+	return e.identity
+}
@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/clock"
+)
+
+// States of the circuit breaker
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// BreakerStates are the states of the circuit breaker, for metrics
+var BreakerStates = []string{BreakerClosed, BreakerOpen, BreakerHalfOpen}
+
+// ErrBackendUnavailable is returned without querying while the circuit is open
+var ErrBackendUnavailable = errors.New("metrics backend unavailable")
+
+// BreakerStatus is a snapshot of the circuit breaker
+type BreakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenSince           *time.Time `json:"open_since,omitempty"`
+}
+
+// Breaker is a circuit breaker around a Client. After threshold consecutive failures it fails all
+// queries instantly for the cooldown, then lets a single probe query through to decide whether to close.
+type Breaker struct {
+	client    Client
+	threshold int
+	cooldown  time.Duration
+	clock     clock.Clock
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool // The probe query of the half-open state is in flight
+}
+
+// NewBreaker wraps the client in a closed circuit breaker
+func NewBreaker(c Client, threshold int, cooldown time.Duration, clk clock.Clock) *Breaker {
+	return &Breaker{client: c, threshold: threshold, cooldown: cooldown, clock: clk, state: BreakerClosed}
+}
+
+// QueryInstant runs the instant query unless the circuit is open
+func (b *Breaker) QueryInstant(ctx context.Context, promql string, at time.Time) ([]Series, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	series, err := b.client.QueryInstant(ctx, promql, at)
+	b.record(err)
+	return series, err
+}
+
+// QueryRange runs the range query unless the circuit is open
+func (b *Breaker) QueryRange(ctx context.Context, promql string, start, end time.Time, step time.Duration) ([]Series, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	series, err := b.client.QueryRange(ctx, promql, start, end, step)
+	b.record(err)
+	return series, err
+}
+
+// Status returns a snapshot of the breaker
+func (b *Breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{State: b.state, ConsecutiveFailures: b.failures}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		status.OpenSince = &openedAt
+	}
+	return status
+}
+
+// allow decides whether a query may reach the backend
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.clock.Now().Sub(b.openedAt) < b.cooldown {
+			return ErrBackendUnavailable
+		}
+		b.state = BreakerHalfOpen
+		slog.Info("Metrics circuit half-open, sending a probe query")
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrBackendUnavailable
+		}
+	default:
+		return nil
+	}
+	b.probing = true
+	return nil
+}
+
+// record updates the breaker with the result of a query
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// A query cancelled by the caller says nothing about the backend
+	if errors.Is(err, context.Canceled) {
+		b.probing = false
+		return
+	}
+
+	if err == nil {
+		if b.state != BreakerClosed {
+			slog.Info("Metrics circuit closed, backend recovered")
+		}
+		b.state = BreakerClosed
+		b.failures = 0
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+		if b.state == BreakerHalfOpen {
+			slog.Error("Metrics circuit open again, probe query failed", "error", err)
+		} else {
+			slog.Error("Metrics circuit open, failing queries", "failures", b.failures, "cooldown", b.cooldown, "error", err)
+		}
+		b.state = BreakerOpen
+		b.openedAt = b.clock.Now()
+		b.probing = false
+	}
+}
@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+)
+
+var errBackendDown = errors.New("VM query failed: connection refused")
+
+// scriptedClient answers every query with its current error, holding queries while hold is set
+type scriptedClient struct {
+	err   error
+	hold  chan struct{}
+	calls int
+}
+
+func (c *scriptedClient) QueryInstant(ctx context.Context, promql string, at time.Time) ([]Series, error) {
+	c.calls++
+	if c.hold != nil {
+		<-c.hold
+	}
+	return nil, c.err
+}
+
+func (c *scriptedClient) QueryRange(ctx context.Context, promql string, start, end time.Time, step time.Duration) ([]Series, error) {
+	return c.QueryInstant(ctx, promql, end)
+}
+
+// newTestBreaker returns a breaker opening after 3 failures for a minute, on a fake clock
+func newTestBreaker() (*Breaker, *scriptedClient, *clock.Fake) {
+	client := &scriptedClient{}
+	clk := clock.NewFake(fixtureTime)
+	return NewBreaker(client, 3, time.Minute, clk), client, clk
+}
+
+// query runs an instant query through the breaker
+func query(b *Breaker) error {
+	_, err := b.QueryInstant(context.Background(), "up", time.Time{})
+	return err
+}
+
+// expectBreaker checks the state and failure count of the breaker
+func expectBreaker(t *testing.T, b *Breaker, step, state string, failures int) {
+	t.Helper()
+	if s := b.Status(); s.State != state || s.ConsecutiveFailures != failures {
+		t.Errorf("%s: breaker %s after %d failures, want %s after %d", step, s.State, s.ConsecutiveFailures, state, failures)
+	}
+}
+
+func TestBreakerClosed(t *testing.T) {
+	b, client, _ := newTestBreaker()
+	expectBreaker(t, b, "new", BreakerClosed, 0)
+	if s := b.Status(); s.OpenSince != nil {
+		t.Errorf("open since %s while closed", s.OpenSince)
+	}
+
+	client.err = errBackendDown
+	for i := 1; i < 3; i++ {
+		if err := query(b); !errors.Is(err, errBackendDown) {
+			t.Fatalf("query %d: error = %v, want the backend error", i, err)
+		}
+	}
+	expectBreaker(t, b, "below the threshold", BreakerClosed, 2)
+
+	// A success in between starts the count over
+	client.err = nil
+	if err := query(b); err != nil {
+		t.Fatal(err)
+	}
+	expectBreaker(t, b, "after a success", BreakerClosed, 0)
+	client.err = errBackendDown
+	query(b)
+	query(b)
+	expectBreaker(t, b, "two failures again", BreakerClosed, 2)
+	if client.calls != 5 {
+		t.Errorf("%d queries reached the backend, want all 5", client.calls)
+	}
+}
+
+func TestBreakerThroughAllStates(t *testing.T) {
+	b, client, clk := newTestBreaker()
+	client.err = errBackendDown
+	for range 3 {
+		query(b)
+	}
+	expectBreaker(t, b, "at the threshold", BreakerOpen, 3)
+	openedAt := clk.Now()
+	if s := b.Status(); s.OpenSince == nil || !s.OpenSince.Equal(openedAt) {
+		t.Errorf("open since %v, want %s", s.OpenSince, openedAt)
+	}
+
+	// Open: queries fail instantly without reaching the backend, range queries too
+	clk.Advance(time.Minute - time.Second)
+	if err := query(b); !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("open: error = %v, want %v", err, ErrBackendUnavailable)
+	}
+	if _, err := b.QueryRange(context.Background(), "up", clk.Now().Add(-time.Hour), clk.Now(), time.Minute); !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("open range query: error = %v", err)
+	}
+	if client.calls != 3 {
+		t.Errorf("%d queries reached the backend while open, want 3", client.calls)
+	}
+
+	// Half-open after the cooldown: a failing probe opens it again for another cooldown
+	clk.Advance(time.Second)
+	if err := query(b); !errors.Is(err, errBackendDown) {
+		t.Errorf("probe: error = %v, want the backend error", err)
+	}
+	expectBreaker(t, b, "failed probe", BreakerOpen, 4)
+	if s := b.Status(); !s.OpenSince.Equal(clk.Now()) {
+		t.Errorf("open since %s, want the failed probe at %s", s.OpenSince, clk.Now())
+	}
+	clk.Advance(30 * time.Second)
+	if err := query(b); !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("reopened: error = %v", err)
+	}
+
+	// A successful probe closes it
+	clk.Advance(30 * time.Second)
+	client.err = nil
+	if err := query(b); err != nil {
+		t.Errorf("probe: %v", err)
+	}
+	expectBreaker(t, b, "successful probe", BreakerClosed, 0)
+	if s := b.Status(); s.OpenSince != nil {
+		t.Errorf("open since %s after closing", s.OpenSince)
+	}
+	if client.calls != 5 {
+		t.Errorf("%d queries reached the backend, want 3 failures and 2 probes", client.calls)
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	b, client, clk := newTestBreaker()
+	client.err = errBackendDown
+	for range 3 {
+		query(b)
+	}
+	clk.Advance(time.Minute)
+
+	client.hold, client.err = make(chan struct{}), nil
+	probe := make(chan error)
+	go func() { probe <- query(b) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Status().State != BreakerHalfOpen {
+		if time.Now().After(deadline) {
+			t.Fatal("the probe never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Other queries fail while the probe is in flight
+	if err := query(b); !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("during the probe: error = %v, want %v", err, ErrBackendUnavailable)
+	}
+	close(client.hold)
+	if err := <-probe; err != nil {
+		t.Errorf("probe: %v", err)
+	}
+	expectBreaker(t, b, "after the probe", BreakerClosed, 0)
+}
+
+func TestBreakerIgnoresCancelledQueries(t *testing.T) {
+	b, client, clk := newTestBreaker()
+	client.err = context.Canceled
+	for range 5 {
+		query(b)
+	}
+	expectBreaker(t, b, "cancelled queries", BreakerClosed, 0)
+
+	client.err = errBackendDown
+	for range 3 {
+		query(b)
+	}
+	clk.Advance(time.Minute)
+	// A cancelled probe decides nothing, the next query probes again
+	client.err = context.Canceled
+	query(b)
+	expectBreaker(t, b, "cancelled probe", BreakerHalfOpen, 3)
+	client.err = nil
+	if err := query(b); err != nil {
+		t.Errorf("second probe: %v", err)
+	}
+	expectBreaker(t, b, "second probe", BreakerClosed, 0)
+}
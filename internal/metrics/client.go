@@ -0,0 +1,222 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/outbound"
+)
+
+// Client runs PromQL queries against a Prometheus-compatible backend
+type Client interface {
+	// QueryInstant evaluates promql at the given time, each series carries a single sample.
+	// A zero time evaluates at the current time of the backend.
+	QueryInstant(ctx context.Context, promql string, at time.Time) ([]Series, error)
+	// QueryRange evaluates promql from start to end with the given resolution
+	QueryRange(ctx context.Context, promql string, start, end time.Time, step time.Duration) ([]Series, error)
+}
+
+// HTTPClient queries the VictoriaMetrics HTTP API
+type HTTPClient struct {
+	cfg       *config.Config
+	maxPoints int
+	client    *http.Client
+
+	mu           sync.Mutex
+	coarsened    map[string]time.Time // Last warning about the coarsened step of a range query
+	queryErrors  int
+	lastErr      error
+	failingSince time.Time
+}
+
+// QueryStats counts the queries of an HTTPClient
+type QueryStats struct {
+	Errors       int       // Instant and range queries failed by VictoriaMetrics, see failed
+	LastErr      error     // Of the most recent query, nil if it succeeded or none ran yet
+	FailingSince time.Time // First failed query since the last success, zero without LastErr
+}
+
+// NewHTTPClient returns a client for the configured VictoriaMetrics instance
+func NewHTTPClient(cfg *config.Config) *HTTPClient {
+	return &HTTPClient{
+		cfg:       cfg,
+		maxPoints: cfg.MaxRangePoints,
+		client:    outbound.Client(cfg.QueryTimeout, cfg.VMHeaderValues()),
+		coarsened: map[string]time.Time{},
+	}
+}
+
+// QueryInstant runs an instant query via /api/v1/query
+func (c *HTTPClient) QueryInstant(ctx context.Context, promql string, at time.Time) ([]Series, error) {
+	params := url.Values{}
+	params.Set("query", promql)
+	if !at.IsZero() {
+		params.Set("time", strconv.FormatInt(at.Unix(), 10))
+	}
+
+	series, err := c.get(ctx, "/api/v1/query", params, "vector")
+	if err != nil {
+		return nil, c.failed(fmt.Errorf("VM query failed: %w", err))
+	}
+	c.succeeded()
+	return series, nil
+}
+
+// QueryRange runs a range query via /api/v1/query_range. The step is coarsened when the window would
+// return more than MAX_RANGE_POINTS points per series, and a response with more points is rejected.
+func (c *HTTPClient) QueryRange(ctx context.Context, promql string, start, end time.Time, step time.Duration) ([]Series, error) {
+	if coarse := coarsenStep(end.Sub(start), step, c.maxPoints); coarse != step {
+		c.logCoarsened(promql, end.Sub(start), step, coarse)
+		step = coarse
+	}
+
+	params := url.Values{}
+	params.Set("query", promql)
+	params.Set("start", strconv.FormatInt(start.Unix(), 10))
+	params.Set("end", strconv.FormatInt(end.Unix(), 10))
+	params.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+
+	series, err := c.get(ctx, "/api/v1/query_range", params, "matrix")
+	if err != nil {
+		return nil, c.failed(fmt.Errorf("VM range query failed: %w", err))
+	}
+	points := 0
+	for _, s := range series {
+		points += len(s.Samples)
+	}
+	if points > c.maxPoints*max(len(series), 1) {
+		return nil, c.failed(fmt.Errorf("VM range query returned %d points in %d series, more than MAX_RANGE_POINTS (%d) per series", points, len(series), c.maxPoints))
+	}
+	c.succeeded()
+	return series, nil
+}
+
+// failed counts a query that failed because VictoriaMetrics is unreachable or broken and returns its error.
+// Only transport errors and 5xx responses count: a query cancelled by the caller or rejected with a 4xx,
+// like an invalid PromQL expression, says nothing about the health of the backend.
+func (c *HTTPClient) failed(err error) error {
+	if !backendFailure(err) {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queryErrors++
+	if c.lastErr == nil {
+		c.failingSince = time.Now()
+	}
+	c.lastErr = err
+	return err
+}
+
+func (c *HTTPClient) succeeded() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastErr = nil
+}
+
+// Stats returns the query counts since the start and the result of the most recent query
+func (c *HTTPClient) Stats() QueryStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := QueryStats{Errors: c.queryErrors, LastErr: c.lastErr}
+	if c.lastErr != nil {
+		stats.FailingSince = c.failingSince
+	}
+	return stats
+}
+
+// statusError is a response of the API with a status other than 200
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.code, e.body)
+}
+
+// backendFailure reports whether err of a query is a failure of the backend: a 5xx response or a transport
+// error, timeouts included
+func backendFailure(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.code >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// coarsenStep returns step, coarsened to whole seconds so that window yields at most maxPoints points
+func coarsenStep(window, step time.Duration, maxPoints int) time.Duration {
+	if maxPoints <= 0 || step <= 0 || int64(window/step)+1 <= int64(maxPoints) {
+		return step
+	}
+	// maxPoints-1 intervals between maxPoints points, rounded up to stay below the cap
+	coarse := (window + time.Duration(maxPoints-1) - 1) / time.Duration(maxPoints-1)
+	return coarse.Truncate(time.Second) + time.Second
+}
+
+// coarsenedLogInterval is how often a coarsened step is logged again for the same query and window
+const coarsenedLogInterval = time.Hour
+
+// logCoarsened warns about a coarsened step at most once per coarsenedLogInterval for each query and
+// window, as every cycle repeats the query
+func (c *HTTPClient) logCoarsened(promql string, window, step, coarse time.Duration) {
+	key := fmt.Sprintf("%s %s", promql, window)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if last, ok := c.coarsened[key]; ok && time.Since(last) < coarsenedLogInterval {
+		return
+	}
+	c.coarsened[key] = time.Now()
+	slog.Warn("Range query would exceed MAX_RANGE_POINTS, coarsening the step", "window", window, "step", step, "max_points", c.maxPoints, "coarse_step", coarse, "query", promql)
+}
+
+// get performs an authenticated API request and decodes the series of the expected result type
+func (c *HTTPClient) get(ctx context.Context, path string, params url.Values, resultType string) ([]Series, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.cfg.VictoriaMetricsEndpoint(path, params), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.cfg.VictoriaMetricsUser, c.cfg.Secret("VM_PASSWORD"))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &statusError{code: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+
+	var result VMQueryResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("returned status: %s", result.Status)
+	}
+	if result.Data.ResultType != resultType {
+		return nil, fmt.Errorf("expected result type %s, got %q", resultType, result.Data.ResultType)
+	}
+	return result.Data.Result, nil
+}
@@ -0,0 +1,359 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics/metricstest"
+	"gome-assistant/internal/version"
+)
+
+func TestCoarsenStep(t *testing.T) {
+	tests := []struct {
+		name      string
+		window    time.Duration
+		step      time.Duration
+		maxPoints int
+		want      time.Duration
+	}{
+		{"standby window", 20 * time.Minute, time.Minute, 2000, time.Minute},
+		{"exactly at the cap", 1999 * time.Minute, time.Minute, 2000, time.Minute},
+		{"one point over", 2000 * time.Minute, time.Minute, 2000, 61 * time.Second},
+		// A 48h BOOT_GRACE_PERIOD looks back 48h and a minute
+		{"48h boot grace", 48*time.Hour + time.Minute, time.Minute, 2000, 87 * time.Second},
+		{"a day at 1s", 24 * time.Hour, time.Second, 2000, 44 * time.Second},
+		{"a week", 7 * 24 * time.Hour, time.Minute, 2000, 303 * time.Second},
+		{"sub-second step", 10 * time.Minute, 100 * time.Millisecond, 2000, time.Second},
+		{"smallest cap", time.Hour, time.Minute, 10, 401 * time.Second},
+		{"no cap", 48 * time.Hour, time.Second, 0, time.Second},
+		{"no step", 48 * time.Hour, 0, 2000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := coarsenStep(tt.window, tt.step, tt.maxPoints)
+			if got != tt.want {
+				t.Errorf("coarsenStep(%s, %s, %d) = %s, want %s", tt.window, tt.step, tt.maxPoints, got, tt.want)
+			}
+			if got > 0 && tt.maxPoints > 0 {
+				if points := int(tt.window/got) + 1; points > tt.maxPoints {
+					t.Errorf("%d points at %s, more than %d", points, got, tt.maxPoints)
+				}
+				if got%time.Second != 0 && got != tt.step {
+					t.Errorf("coarsened step %s is not whole seconds", got)
+				}
+			}
+		})
+	}
+}
+
+// stepRecorder answers range queries with a point per step, or with a fixed number of points when
+// ignoreStep is set, and records the steps asked for
+type stepRecorder struct {
+	*httptest.Server
+	ignoreStep int
+
+	mu    sync.Mutex
+	steps map[string]time.Duration
+}
+
+// newStepRecorder starts a stepRecorder, closed when the test ends
+func newStepRecorder(t *testing.T) *stepRecorder {
+	t.Helper()
+	r := &stepRecorder{steps: map[string]time.Duration{}}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *stepRecorder) serve(w http.ResponseWriter, req *http.Request) {
+	start, _ := strconv.ParseInt(req.FormValue("start"), 10, 64)
+	end, _ := strconv.ParseInt(req.FormValue("end"), 10, 64)
+	seconds, _ := strconv.ParseFloat(req.FormValue("step"), 64)
+	step := time.Duration(seconds * float64(time.Second))
+	r.mu.Lock()
+	r.steps[req.FormValue("query")] = step
+	r.mu.Unlock()
+
+	points := r.ignoreStep
+	if points == 0 {
+		points = int(time.Duration(end-start)*time.Second/step) + 1
+	}
+	values := make([][]any, points)
+	for i := range values {
+		values[i] = []any{float64(start) + float64(i)*seconds, "8"}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "success", "data": map[string]any{
+		"resultType": "matrix",
+		"result":     []any{map[string]any{"metric": map[string]string{"device_name": "shellyplugsg3-bambu"}, "values": values}},
+	}})
+}
+
+// step returns the step of the query containing part
+func (r *stepRecorder) step(t *testing.T, part string) time.Duration {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for query, step := range r.steps {
+		if strings.Contains(query, part) {
+			return step
+		}
+	}
+	t.Fatalf("no query containing %q in %v", part, r.steps)
+	return 0
+}
+
+// TestCoarsenedStepWarning checks that a coarsened step is logged as a warning, again only once
+// coarsenedLogInterval passed
+func TestCoarsenedStepWarning(t *testing.T) {
+	var log bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&log, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	r := newStepRecorder(t)
+	c := newTestClient(r.URL)
+	c.maxPoints = 10
+	query := func() {
+		t.Helper()
+		if _, err := c.QueryRange(context.Background(), "shelly_watts", fixtureTime.Add(-time.Hour), fixtureTime, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	warnings := func() int {
+		return strings.Count(log.String(), "level=WARN msg=\"Range query would exceed MAX_RANGE_POINTS")
+	}
+
+	query()
+	query()
+	if got := warnings(); got != 1 {
+		t.Errorf("%d warnings after two queries, want 1:\n%s", got, log.String())
+	}
+	for key := range c.coarsened {
+		c.coarsened[key] = time.Now().Add(-coarsenedLogInterval)
+	}
+	query()
+	if got := warnings(); got != 2 {
+		t.Errorf("%d warnings after the interval, want 2:\n%s", got, log.String())
+	}
+}
+
+// TestRangeStepsOfPathologicalConfigs checks the steps the helpers query with for windows far beyond
+// the defaults
+func TestRangeStepsOfPathologicalConfigs(t *testing.T) {
+	ctx := context.Background()
+	now := fixtureTime
+	tests := []struct {
+		name      string
+		maxPoints int
+		query     func(c Client) error
+		want      time.Duration
+	}{
+		{"BOOT_GRACE_PERIOD=48h", 2000, func(c Client) error {
+			_, err := WasPowerTurnedOnRecently(ctx, c, now, testDevice, 48*time.Hour)
+			return err
+		}, 87 * time.Second}, // Over the 48h and the minute the query adds
+		{"STANDBY_DURATION=36h", 2000, func(c Client) error {
+			_, err := StandbyDuration(ctx, c, now, testDevice, 7, 9, 40, 10, 36*time.Hour, nil)
+			return err
+		}, 65 * time.Second},
+		{"PRINT_POWER_COOLDOWN=72h", 2000, func(c Client) error {
+			_, err := SustainedHighPowerEnd(ctx, c, now, testDevice, 60, 3*time.Minute, 72*time.Hour+4*time.Minute)
+			return err
+		}, 130 * time.Second},
+		{"MAX_RANGE_POINTS=10", 10, func(c Client) error {
+			_, err := StandbyDuration(ctx, c, now, testDevice, 7, 9, 40, 10, 15*time.Minute, nil)
+			return err
+		}, 134 * time.Second},
+		{"defaults", 2000, func(c Client) error {
+			_, err := StandbyDuration(ctx, c, now, testDevice, 7, 9, 40, 10, 15*time.Minute, nil)
+			return err
+		}, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newStepRecorder(t)
+			c := newTestClient(r.URL)
+			c.maxPoints = tt.maxPoints
+			if err := tt.query(c); err != nil {
+				t.Fatal(err)
+			}
+			if got := r.step(t, "shelly_watts"); got != tt.want {
+				t.Errorf("step = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangeResponseCap(t *testing.T) {
+	r := newStepRecorder(t)
+	c := newTestClient(r.URL)
+	c.maxPoints = 100
+	// A backend ignoring the step, like with a 1s exporter and a step it doesn't honor
+	r.ignoreStep = 101
+	_, err := c.QueryRange(context.Background(), "shelly_watts", fixtureTime.Add(-time.Hour), fixtureTime, time.Minute)
+	if want := "VM range query returned 101 points in 1 series, more than MAX_RANGE_POINTS (100) per series"; err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %q", err, want)
+	}
+
+	r.ignoreStep = 100
+	if series, err := c.QueryRange(context.Background(), "shelly_watts", fixtureTime.Add(-time.Hour), fixtureTime, time.Minute); err != nil || len(series[0].Samples) != 100 {
+		t.Errorf("at the cap: %d series, %v", len(series), err)
+	}
+}
+
+func TestVMHeaders(t *testing.T) {
+	var mu sync.Mutex
+	var received []http.Header
+	vm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received = append(received, r.Header.Clone())
+		mu.Unlock()
+		resultType := "vector"
+		if strings.HasSuffix(r.URL.Path, "/query_range") {
+			resultType = "matrix"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"` + resultType + `","result":[]}}`))
+	}))
+	t.Cleanup(vm.Close)
+
+	c := NewHTTPClient(&config.Config{
+		VictoriaMetricsURL: vm.URL, VictoriaMetricsUser: "gome", VictoriaMetricsPassword: "secret",
+		QueryTimeout: 5 * time.Second, MaxRangePoints: 2000, VMHeaders: "X-Org: workshop; X-Scope-OrgID: 7",
+	})
+	if _, err := c.QueryInstant(context.Background(), "up", fixtureTime); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.QueryRange(context.Background(), "up", fixtureTime.Add(-time.Hour), fixtureTime, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("%d requests received, want 2", len(received))
+	}
+	for i, h := range received {
+		user, password, _ := (&http.Request{Header: h}).BasicAuth()
+		if h.Get("User-Agent") != version.UserAgent() || h.Get("X-Org") != "workshop" || h.Get("X-Scope-Orgid") != "7" || user != "gome" || password != "secret" {
+			t.Errorf("request %d: headers %v", i+1, h)
+		}
+	}
+}
+
+func TestQueryOverIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	var paths []string
+	vm := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	vm.Listener = l
+	vm.Start()
+	t.Cleanup(vm.Close)
+
+	// VM_URL with a bracketed IPv6 host and a path prefix, like behind vmauth
+	c := newTestClient(vm.URL + "/select/0/prometheus")
+	if _, err := c.QueryInstant(context.Background(), "up", fixtureTime); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != "/select/0/prometheus/api/v1/query" {
+		t.Errorf("paths = %v", paths)
+	}
+}
+
+func TestQueryErrorsCounted(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		prep    func(vm *metricstest.VM, c *HTTPClient) context.Context
+		counted bool
+	}{
+		{"500", func(vm *metricstest.VM, _ *HTTPClient) context.Context {
+			vm.Fail(http.StatusInternalServerError, "storage unavailable")
+			return context.Background()
+		}, true},
+		{"503", func(vm *metricstest.VM, _ *HTTPClient) context.Context {
+			vm.Fail(http.StatusServiceUnavailable, "too many concurrent requests")
+			return context.Background()
+		}, true},
+		{"unreachable", func(vm *metricstest.VM, _ *HTTPClient) context.Context {
+			vm.Close()
+			return context.Background()
+		}, true},
+		{"timeout", func(vm *metricstest.VM, c *HTTPClient) context.Context {
+			vm.Delay(time.Second)
+			c.client.Timeout = 50 * time.Millisecond
+			return context.Background()
+		}, true},
+		// Rejected queries and cancelled ones don't mean the backend is down
+		{"400", func(vm *metricstest.VM, _ *HTTPClient) context.Context {
+			vm.Fail(http.StatusBadRequest, `cannot parse "sum(": unexpected end of input`)
+			return context.Background()
+		}, false},
+		{"422", func(vm *metricstest.VM, _ *HTTPClient) context.Context {
+			vm.Fail(http.StatusUnprocessableEntity, "cannot execute query: too many series")
+			return context.Background()
+		}, false},
+		{"cancelled", func(*metricstest.VM, *HTTPClient) context.Context { return cancelled }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, vm := newFakeVM(t)
+			ctx := tt.prep(vm, c)
+			if _, err := c.QueryInstant(ctx, "up", fixtureTime); err == nil {
+				t.Fatal("query succeeded")
+			}
+			if _, err := c.QueryRange(ctx, "up", fixtureTime.Add(-time.Hour), fixtureTime, time.Minute); err == nil {
+				t.Fatal("range query succeeded")
+			}
+			stats := c.Stats()
+			if counted := stats.Errors == 2 && stats.LastErr != nil && !stats.FailingSince.IsZero(); counted != tt.counted {
+				t.Errorf("stats = %+v, want counted %v", stats, tt.counted)
+			}
+			if !tt.counted && (stats.Errors != 0 || stats.LastErr != nil) {
+				t.Errorf("stats = %+v, want none", stats)
+			}
+		})
+	}
+}
+
+// TestIgnoredQueryErrorsKeepTheFailure checks that a rejected query neither ends nor restarts a failure
+// of the backend
+func TestIgnoredQueryErrorsKeepTheFailure(t *testing.T) {
+	c, vm := newFakeVM(t)
+	vm.Fail(http.StatusBadGateway, "vmselect unreachable")
+	_, _ = c.QueryInstant(context.Background(), "up", fixtureTime)
+	failing := c.Stats()
+
+	vm.Fail(http.StatusBadRequest, "invalid query")
+	_, _ = c.QueryInstant(context.Background(), "up(", fixtureTime)
+	if stats := c.Stats(); stats != failing {
+		t.Errorf("after a 400: stats = %+v, want %+v", stats, failing)
+	}
+
+	vm.Fail(0, "")
+	if _, err := c.QueryInstant(context.Background(), "up", fixtureTime); err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.Stats(); stats.Errors != 1 || stats.LastErr != nil || !stats.FailingSince.IsZero() {
+		t.Errorf("after a success: stats = %+v, want the error counted and the failure over", stats)
+	}
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Sample is a single value of a series
+type Sample struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// Series is a labelled set of samples in chronological order
+type Series struct {
+	Labels  map[string]string
+	Samples []Sample
+}
+
+// VMQueryResult represents a VictoriaMetrics query response
+type VMQueryResult struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string   `json:"resultType"` // "vector" for instant queries, "matrix" for range queries
+		Result     []Series `json:"result"`
+	} `json:"data"`
+}
+
+// UnmarshalJSON decodes a [timestamp, "value"] pair of the API
+func (s *Sample) UnmarshalJSON(b []byte) error {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return fmt.Errorf("sample: %w", err)
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("sample: expected [timestamp, value], got %d elements", len(pair))
+	}
+
+	var ts float64
+	if err := json.Unmarshal(pair[0], &ts); err != nil {
+		return fmt.Errorf("sample timestamp: %w", err)
+	}
+	// Seconds beyond int64 don't convert to a time
+	if math.IsNaN(ts) || math.IsInf(ts, 0) || ts >= math.MaxInt64 || ts < math.MinInt64 {
+		return fmt.Errorf("sample timestamp: invalid value %v", ts)
+	}
+	var valueStr string
+	if err := json.Unmarshal(pair[1], &valueStr); err != nil {
+		return fmt.Errorf("sample value: %w", err)
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return fmt.Errorf("sample value: %w", err)
+	}
+
+	sec, frac := math.Modf(ts)
+	s.Timestamp = time.Unix(int64(sec), int64(frac*1e9))
+	s.Value = value
+	return nil
+}
+
+// UnmarshalJSON decodes a series of an instant ("value") or range ("values") result
+func (s *Series) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Metric map[string]string `json:"metric"`
+		Value  *Sample           `json:"value"`
+		Values []Sample          `json:"values"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	switch {
+	case raw.Value != nil && raw.Values != nil:
+		return fmt.Errorf("series has both value and values")
+	case raw.Value != nil:
+		s.Samples = []Sample{*raw.Value}
+	case raw.Values != nil:
+		s.Samples = raw.Values
+	default:
+		return fmt.Errorf("series has neither value nor values")
+	}
+	s.Labels = raw.Metric
+	return nil
+}
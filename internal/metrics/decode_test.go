@@ -0,0 +1,254 @@
+package metrics
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSampleUnmarshal(t *testing.T) {
+	tests := []struct {
+		json  string
+		want  Sample
+		error string // Prefix, the rest comes from encoding/json
+	}{
+		{`[1772395200,"8.31"]`, Sample{time.Unix(1772395200, 0), 8.31}, ""},
+		{`[1772395200.25,"-0.5"]`, Sample{time.Unix(1772395200, 250e6), -0.5}, ""},
+		{`[1772395200,"+Inf"]`, Sample{time.Unix(1772395200, 0), math.Inf(1)}, ""},
+		{`[1772395200,"-Inf"]`, Sample{time.Unix(1772395200, 0), math.Inf(-1)}, ""},
+		{`[1772395200,8.31]`, Sample{}, "sample value: json: cannot unmarshal number into Go value of type string"},
+		{`[1772395200,null]`, Sample{}, `sample value: strconv.ParseFloat: parsing "": invalid syntax`},
+		{`[1772395200,"eight"]`, Sample{}, `sample value: strconv.ParseFloat: parsing "eight": invalid syntax`},
+		{`["1772395200","8"]`, Sample{}, "sample timestamp: json: cannot unmarshal string into Go value of type float64"},
+		{`[1e300,"8"]`, Sample{}, "sample timestamp: invalid value 1e+300"},
+		{`[1772395200]`, Sample{}, "sample: expected [timestamp, value], got 1 elements"},
+		{`[1772395200,"8",1]`, Sample{}, "sample: expected [timestamp, value], got 3 elements"},
+		{`[]`, Sample{}, "sample: expected [timestamp, value], got 0 elements"},
+		{`{"value":"8"}`, Sample{}, "sample: json: cannot unmarshal object"},
+	}
+	for _, tt := range tests {
+		var s Sample
+		err := json.Unmarshal([]byte(tt.json), &s)
+		if tt.error != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.error) {
+				t.Errorf("%s: error = %v, want %q", tt.json, err, tt.error)
+			}
+			continue
+		}
+		if err != nil || !s.Timestamp.Equal(tt.want.Timestamp) || s.Value != tt.want.Value {
+			t.Errorf("%s = %+v, %v, want %+v", tt.json, s, err, tt.want)
+		}
+	}
+
+	// NaN doesn't compare equal, not even to itself
+	var s Sample
+	if err := json.Unmarshal([]byte(`[1772395200,"NaN"]`), &s); err != nil || !math.IsNaN(s.Value) {
+		t.Errorf("NaN = %+v, %v", s, err)
+	}
+}
+
+func TestSeriesUnmarshal(t *testing.T) {
+	tests := []struct {
+		json    string
+		samples int
+		error   string
+	}{
+		{`{"metric":{"printer":"x1c"},"value":[1772395200,"2"]}`, 1, ""},
+		{`{"metric":{"printer":"x1c"},"values":[[1772395140,"2"],[1772395200,"0"]]}`, 2, ""},
+		{`{"metric":{},"values":[]}`, 0, ""},
+		{`{"metric":{},"value":[1772395200,"2"],"values":[[1772395200,"2"]]}`, 0, "series has both value and values"},
+		{`{"metric":{"printer":"x1c"}}`, 0, "series has neither value nor values"},
+		{`{"metric":{},"values":[[1772395140,"2"],[1772395200]]}`, 0, "sample: expected [timestamp, value], got 1 elements"},
+		{`{"metric":{"printer":2},"value":[1772395200,"2"]}`, 0, "json: cannot unmarshal number into Go struct field .metric"},
+	}
+	for _, tt := range tests {
+		var s Series
+		err := json.Unmarshal([]byte(tt.json), &s)
+		if tt.error != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.error) {
+				t.Errorf("%s: error = %v, want %q", tt.json, err, tt.error)
+			}
+			continue
+		}
+		if err != nil || len(s.Samples) != tt.samples || s.Labels == nil {
+			t.Errorf("%s = %+v, %v, want %d samples", tt.json, s, err, tt.samples)
+		}
+	}
+}
+
+// TestDecodeRecordedResponses decodes every recorded response, the error and the partial one included
+func TestDecodeRecordedResponses(t *testing.T) {
+	responses, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil || len(responses) == 0 {
+		t.Fatalf("recorded responses: %v, %v", responses, err)
+	}
+	for _, path := range responses {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result VMQueryResult
+		if err := json.Unmarshal(data, &result); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+
+	var special VMQueryResult
+	if err := json.Unmarshal(loadFixture(t, "vm_special_values.json"), &special); err != nil {
+		t.Fatal(err)
+	}
+	samples := special.Data.Result[0].Samples
+	if len(samples) != 4 || !math.IsNaN(samples[0].Value) || !math.IsInf(samples[1].Value, 1) || !math.IsInf(samples[2].Value, -1) ||
+		!samples[2].Timestamp.Equal(time.Unix(1772395170, 125e6)) || samples[3].Value != 8.09 {
+		t.Errorf("special values = %+v", samples)
+	}
+}
+
+// seedResponses adds the recorded responses of testdata to the corpus of f, whole or split into the
+// series and samples of their results
+func seedResponses(f *testing.F, part string) {
+	responses, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range responses {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		if part == "response" {
+			f.Add(data)
+			continue
+		}
+		var raw struct {
+			Data struct {
+				Result []struct {
+					Value  json.RawMessage   `json:"value"`
+					Values []json.RawMessage `json:"values"`
+				} `json:"result"`
+			} `json:"data"`
+		}
+		var series struct {
+			Data struct {
+				Result []json.RawMessage `json:"result"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			f.Fatalf("%s: %v", path, err)
+		}
+		if err := json.Unmarshal(data, &series); err != nil {
+			f.Fatalf("%s: %v", path, err)
+		}
+		if part == "series" {
+			for _, s := range series.Data.Result {
+				f.Add([]byte(s))
+			}
+			continue
+		}
+		for _, s := range raw.Data.Result {
+			if s.Value != nil {
+				f.Add([]byte(s.Value))
+			}
+			for _, v := range s.Values {
+				f.Add([]byte(v))
+			}
+		}
+	}
+}
+
+// encodeSample encodes s the way the API does
+func encodeSample(s Sample) string {
+	ts := float64(s.Timestamp.Unix()) + float64(s.Timestamp.Nanosecond())/1e9
+	return "[" + strconv.FormatFloat(ts, 'f', -1, 64) + "," + strconv.Quote(strconv.FormatFloat(s.Value, 'g', -1, 64)) + "]"
+}
+
+// sameSample reports whether a decoded again is b, within the float precision of the timestamp
+func sameSample(a, b Sample) bool {
+	if a.Value != b.Value && !(math.IsNaN(a.Value) && math.IsNaN(b.Value)) {
+		return false
+	}
+	diff := a.Timestamp.Sub(b.Timestamp).Abs()
+	return diff <= time.Microsecond+time.Duration(math.Abs(float64(a.Timestamp.Unix()))*1e-6)
+}
+
+func FuzzSampleUnmarshal(f *testing.F) {
+	seedResponses(f, "samples")
+	for _, edge := range []string{
+		`[1772395200,"NaN"]`, `[1772395200,"+Inf"]`, `[1772395200,"-Inf"]`, `[1772395200,"Infinity"]`,
+		`[-1.5,"0"]`, `[1772395200.999999999,"1e308"]`, `[1e300,"1"]`, `[9.3e18,"1"]`,
+		`[1772395200,8]`, `[1772395200,true]`, `[1772395200,null]`, `[null,"8"]`, `["1772395200","8"]`,
+		`[1772395200]`, `[]`, `[1772395200,"8",0]`, `null`, `{}`, `"8"`,
+	} {
+		f.Add([]byte(edge))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var s Sample
+		if err := json.Unmarshal(data, &s); err != nil {
+			return
+		}
+		// A decoded sample encodes to an equal one
+		encoded := encodeSample(s)
+		var again Sample
+		if err := json.Unmarshal([]byte(encoded), &again); err != nil {
+			t.Fatalf("%s decoded to %+v, encoded as %s: %v", data, s, encoded, err)
+		}
+		if !sameSample(s, again) {
+			t.Fatalf("%s decoded to %+v, encoded as %s decodes to %+v", data, s, encoded, again)
+		}
+	})
+}
+
+func FuzzSeriesUnmarshal(f *testing.F) {
+	seedResponses(f, "series")
+	seedResponses(f, "response")
+	for _, edge := range []string{
+		`{"metric":{},"value":[1772395200,"NaN"]}`, `{"metric":{},"values":[[1772395200,"+Inf"],[1772395260,"-Inf"]]}`,
+		`{"metric":{},"values":[[1772395200,8]]}`, `{"metric":{},"values":[[1772395200]]}`, `{"metric":{},"values":[]}`,
+		`{"metric":{},"value":[],"values":[]}`, `{"metric":{"printer":2},"value":[1772395200,"2"]}`,
+		`{"metric":null,"value":[1772395200,"2"]}`, `{"value":null}`, `{"values":null}`, `[]`, `null`,
+	} {
+		f.Add([]byte(edge))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var s Series
+		if err := json.Unmarshal(data, &s); err != nil {
+			return
+		}
+		// A decoded series encodes as a range result with the same samples
+		encoded := `{"metric":` + mustJSON(t, s.Labels) + `,"values":[`
+		for i, sample := range s.Samples {
+			if i > 0 {
+				encoded += ","
+			}
+			encoded += encodeSample(sample)
+		}
+		encoded += "]}"
+		var again Series
+		if err := json.Unmarshal([]byte(encoded), &again); err != nil {
+			t.Fatalf("%s decoded to %+v, encoded as %s: %v", data, s, encoded, err)
+		}
+		if len(again.Samples) != len(s.Samples) || len(again.Labels) != len(s.Labels) {
+			t.Fatalf("%s decoded to %+v, encoded as %s decodes to %+v", data, s, encoded, again)
+		}
+		for i := range s.Samples {
+			if !sameSample(s.Samples[i], again.Samples[i]) {
+				t.Fatalf("sample %d of %s: %+v, decoded again %+v", i, data, s.Samples[i], again.Samples[i])
+			}
+		}
+	})
+}
+
+// mustJSON encodes v
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,563 @@
+// Package metrics queries power and printer metrics from VictoriaMetrics
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// ShellyReading is the latest power reading of the matched Shelly device
+type ShellyReading struct {
+	DeviceName string
+	IP         string
+	CloudID    string // From Device.IDLabel
+	Watts      float64
+}
+
+// rangeStep is the resolution of the range queries over the power history
+const rangeStep = 60 * time.Second
+
+// IsBambuPrinting checks if any bambu printer is currently printing
+// bambulab_gcode_state: 0 = idle, 1 = running, 2 = paused, 3 = completed, 4 = error
+func IsBambuPrinting(ctx context.Context, c Client, now time.Time) (bool, error) {
+	series, err := c.QueryInstant(ctx, `bambulab_gcode_state`, now)
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range series {
+		if state, ok := latest(s); ok && (state == 1 || state == 2) {
+			// 1 = running, 2 = paused (still consider paused as "printing")
+			slog.Debug("Printer is printing or paused", "printer", s.Labels["printer"], "state", state)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ShellyBambuWatts gets the power consumption, name and IP of the shelly device connected to bambu.
+// The latest sample within maxAge counts, so scrapes sparser than the staleness window of the backend
+// still return a reading.
+func ShellyBambuWatts(ctx context.Context, c Client, now time.Time, device Device, maxAge time.Duration) (*ShellyReading, error) {
+	// Query for shelly device matching the configured pattern
+	series, err := c.QueryInstant(ctx, fmt.Sprintf("last_over_time(%s[%ds])", shellyWattsQuery(device), int(maxAge.Seconds())), now)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(series) == 0 {
+		return nil, fmt.Errorf("no shelly device matching pattern '%s' found", device.Pattern)
+	}
+
+	// Get the first matching device's power consumption and IP. A pattern matching the empty string also
+	// selects series without the identity label, they only count if no series has it.
+	s := series[0]
+	for _, candidate := range series {
+		if candidate.Labels[device.NameLabel] != "" {
+			s = candidate
+			break
+		}
+	}
+	ipAddress := s.Labels[device.AddressLabel]
+
+	watts, ok := latest(s)
+	if !ok {
+		return nil, fmt.Errorf("could not parse power value")
+	}
+	if ipAddress != "" {
+		slog.Debug("Found Shelly device", "ip", ipAddress)
+	}
+	reading := &ShellyReading{DeviceName: s.Labels[device.NameLabel], IP: ipAddress, Watts: watts}
+	if device.IDLabel != "" {
+		reading.CloudID = s.Labels[device.IDLabel]
+	}
+	return reading, nil
+}
+
+// ErrAmbiguousInfo is returned when the info metric doesn't tell a single address of the device
+var ErrAmbiguousInfo = errors.New("ambiguous device info")
+
+// InfoAddress returns the address label of the info metric series of the named device, for exporters
+// that leave it off the power series. No series, a series without the address label or different
+// addresses for the same name fail with ErrAmbiguousInfo instead of picking one.
+func InfoAddress(ctx context.Context, c Client, now time.Time, metric string, device Device, name string, maxAge time.Duration) (string, error) {
+	series, err := c.QueryInstant(ctx, fmt.Sprintf("last_over_time(%s{%s=%q}[%ds])", metric, device.NameLabel, name, int(maxAge.Seconds())), now)
+	if err != nil {
+		return "", err
+	}
+
+	var addresses []string
+	for _, s := range series {
+		if got := s.Labels[device.NameLabel]; got != name {
+			return "", fmt.Errorf("%w: %s series for %q is labeled %s=%q", ErrAmbiguousInfo, metric, name, device.NameLabel, got)
+		}
+		address := s.Labels[device.AddressLabel]
+		if address == "" {
+			return "", fmt.Errorf("%w: %s series for %q has no %s label", ErrAmbiguousInfo, metric, name, device.AddressLabel)
+		}
+		if !slices.Contains(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+	switch len(addresses) {
+	case 0:
+		return "", fmt.Errorf("%w: no %s series for %q", ErrAmbiguousInfo, metric, name)
+	case 1:
+		return addresses[0], nil
+	}
+	slices.Sort(addresses)
+	return "", fmt.Errorf("%w: %s series for %q have %d addresses: %s", ErrAmbiguousInfo, metric, name, len(addresses), strings.Join(addresses, ", "))
+}
+
+// HasRecentShellyMetrics checks if shelly metrics have been updated recently. The age is taken from
+// the timestamp of the latest sample itself, not from the evaluation time of the query.
+func HasRecentShellyMetrics(ctx context.Context, c Client, now time.Time, device Device, within time.Duration) (bool, error) {
+	age, err := ShellyMetricsAge(ctx, c, now, device, within)
+	if err != nil || age == nil {
+		return false, err
+	}
+	return *age <= within, nil
+}
+
+// ShellyMetricsAge returns the age of the latest power sample within the lookback, nil if there is none
+func ShellyMetricsAge(ctx context.Context, c Client, now time.Time, device Device, lookback time.Duration) (*time.Duration, error) {
+	last, err := instantValue(ctx, c, now, fmt.Sprintf("tlast_over_time(%s[%ds])", shellyWattsQuery(device), int(lookback.Seconds())))
+	if err != nil || last == nil {
+		return nil, err
+	}
+	age := now.Sub(time.Unix(0, int64(*last*1e9)))
+	return &age, nil
+}
+
+// WasPowerTurnedOnRecently checks if power went from 0 to >0 within the lookback period
+func WasPowerTurnedOnRecently(ctx context.Context, c Client, now time.Time, device Device, lookback time.Duration) (bool, error) {
+	// Use range query to look back
+	series, err := c.QueryRange(ctx, shellyWattsQuery(device), now.Add(-lookback-1*time.Minute), now, rangeStep)
+	if err != nil {
+		return false, err
+	}
+
+	if len(series) == 0 {
+		return false, nil
+	}
+
+	// Check for power transition from ~0 to >10W (indicating relay turned on)
+	// This would indicate printer was powered on
+	samples := series[0].Samples
+	if len(samples) > 2 {
+		// Look for a transition from low to high power
+		var previousLow bool
+		for _, sample := range samples {
+			if sample.Value < 5 {
+				previousLow = true
+			} else if previousLow && sample.Value > 10 {
+				// Found transition from off/low to on
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// WasPrintingRecently checks if the printer was printing within the lookback period
+func WasPrintingRecently(ctx context.Context, c Client, now time.Time, lookback time.Duration) (bool, error) {
+	// Query for recent gcode_state values
+	query := `max_over_time(bambulab_gcode_state[` + lookback.String() + `])`
+	series, err := c.QueryInstant(ctx, query, now)
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range series {
+		// If max state in the period was 1 or 2 (running/paused), it was printing
+		if state, ok := latest(s); ok && (state == 1 || state == 2) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// SustainedHighPowerEnd returns when the latest period of power above threshold that lasted at least
+// minDuration ended, nil if there was none within lookback. A period still running ends now.
+func SustainedHighPowerEnd(ctx context.Context, c Client, now time.Time, device Device, threshold float64, minDuration, lookback time.Duration) (*time.Time, error) {
+	series, err := c.QueryRange(ctx, shellyWattsQuery(device), now.Add(-lookback), now, rangeStep)
+	if err != nil {
+		return nil, err
+	}
+	if len(series) == 0 {
+		return nil, nil
+	}
+
+	var end, streakStart *time.Time
+	samples := series[0].Samples
+	for i := range samples {
+		if samples[i].Value > threshold {
+			if streakStart == nil {
+				streakStart = &samples[i].Timestamp
+			}
+			continue
+		}
+		// The streak ended with this sample
+		if streakStart != nil && samples[i-1].Timestamp.Sub(*streakStart) >= minDuration {
+			end = &samples[i].Timestamp
+		}
+		streakStart = nil
+	}
+	if streakStart != nil && samples[len(samples)-1].Timestamp.Sub(*streakStart) >= minDuration {
+		end = &now
+	}
+	return end, nil
+}
+
+// ActiveMaintenance returns the first query that reports a non-zero state, e.g. bambulab_upgrade_state
+// during a firmware update. Queries without any series are returned as missing.
+func ActiveMaintenance(ctx context.Context, c Client, now time.Time, queries []string) (string, []string, error) {
+	var active string
+	var missing []string
+	for _, query := range queries {
+		series, err := c.QueryInstant(ctx, query, now)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(series) == 0 {
+			missing = append(missing, query)
+			continue
+		}
+		for _, s := range series {
+			if state, ok := latest(s); ok && state != 0 && active == "" {
+				active = query
+			}
+		}
+	}
+	return active, missing, nil
+}
+
+// IsStateBusy checks if any series of the state query currently has one of the busy values
+func IsStateBusy(ctx context.Context, c Client, now time.Time, query string, busy []float64) (bool, error) {
+	series, err := c.QueryInstant(ctx, query, now)
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range series {
+		if state, ok := latest(s); ok && slices.Contains(busy, state) {
+			slog.Debug("Printer is printing or paused", "printer", s.Labels["printer"], "state", state)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AnyNonZero checks if any series of the query currently has a value other than 0
+func AnyNonZero(ctx context.Context, c Client, now time.Time, query string) (bool, error) {
+	series, err := c.QueryInstant(ctx, query, now)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range series {
+		if value, ok := latest(s); ok && value != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MatchingState returns the first latest value of the state query that is one of values, nil if none
+// is. found is false when the query has no series at all.
+func MatchingState(ctx context.Context, c Client, now time.Time, query string, values []float64) (match *float64, found bool, err error) {
+	series, err := c.QueryInstant(ctx, query, now)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, s := range series {
+		if state, ok := latest(s); ok && slices.Contains(values, state) {
+			return &state, true, nil
+		}
+	}
+	return nil, len(series) > 0, nil
+}
+
+// StatesByPrinter returns the latest value of every series of the state query by its printer label
+func StatesByPrinter(ctx context.Context, c Client, now time.Time, query string) (map[string]float64, error) {
+	series, err := c.QueryInstant(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+
+	states := map[string]float64{}
+	for _, s := range series {
+		if state, ok := latest(s); ok {
+			states[s.Labels["printer"]] = state
+		}
+	}
+	return states, nil
+}
+
+// WasStateBusyRecently checks if any series of the state query had one of the busy values within the
+// lookback period
+func WasStateBusyRecently(ctx context.Context, c Client, now time.Time, query string, busy []float64, lookback time.Duration) (bool, error) {
+	series, err := c.QueryRange(ctx, query, now.Add(-lookback), now, rangeStep)
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range series {
+		for _, sample := range s.Samples {
+			if slices.Contains(busy, sample.Value) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// ShellyValue returns the latest value of another metric of the Shelly device, e.g.
+// shelly_voltage, nil if the device has no such series
+func ShellyValue(ctx context.Context, c Client, now time.Time, metric string, device Device) (*float64, error) {
+	return instantValue(ctx, c, now, deviceQuery(metric, device))
+}
+
+// PowerHistory returns how far back the power series reaches within lookback, 0 if it has no samples.
+// ok tells whether it covers lookback, give or take a query step.
+func PowerHistory(ctx context.Context, c Client, now time.Time, device Device, lookback time.Duration) (covered time.Duration, ok bool, err error) {
+	first, err := instantValue(ctx, c, now, fmt.Sprintf("tfirst_over_time(%s[%ds])", shellyWattsQuery(device), int(lookback.Seconds())))
+	if err != nil || first == nil {
+		return 0, false, err
+	}
+	covered = now.Sub(time.Unix(int64(*first), 0))
+	return covered, covered >= lookback-rangeStep, nil
+}
+
+// QuantileStandby reports the whole window as standby when the 5th and 95th percentile of the power over
+// it are both in the standby range, and 0 otherwise. A few outliers don't interrupt the standby, but the
+// progress of a window that isn't there yet is unknown.
+func QuantileStandby(ctx context.Context, c Client, now time.Time, device Device, minWatts, maxWatts float64, window time.Duration) (time.Duration, error) {
+	selector := fmt.Sprintf("%s[%ds]", shellyWattsQuery(device), int(window.Seconds()))
+
+	// The samples have to cover the window, not just the time since the device appeared
+	first, err := instantValue(ctx, c, now, "tfirst_over_time("+selector+")")
+	if err != nil || first == nil {
+		return 0, err
+	}
+	if now.Sub(time.Unix(int64(*first), 0)) < window-rangeStep {
+		return 0, nil
+	}
+
+	for _, q := range []float64{0.05, 0.95} {
+		watts, err := instantValue(ctx, c, now, fmt.Sprintf("quantile_over_time(%g, %s)", q, selector))
+		if err != nil || watts == nil {
+			return 0, err
+		}
+		if *watts <= minWatts || *watts >= maxWatts {
+			return 0, nil
+		}
+	}
+	return window, nil
+}
+
+// LowestOverWindow returns the lowest value of the first series of query over the window, e.g. the solar
+// surplus. It is nil if the series doesn't cover the whole window or has no sample within maxAge, so a
+// missing or stale metric counts as unknown rather than as a value.
+func LowestOverWindow(ctx context.Context, c Client, now time.Time, query string, window, maxAge time.Duration) (*float64, error) {
+	series, err := c.QueryRange(ctx, query, now.Add(-window), now, rangeStep)
+	if err != nil {
+		return nil, err
+	}
+	if len(series) == 0 || len(series[0].Samples) == 0 {
+		return nil, nil
+	}
+
+	samples := series[0].Samples
+	if samples[0].Timestamp.After(now.Add(-window+rangeStep)) || now.Sub(samples[len(samples)-1].Timestamp) > maxAge {
+		return nil, nil
+	}
+	lowest := samples[0].Value
+	for _, sample := range samples[1:] {
+		lowest = min(lowest, sample.Value)
+	}
+	return &lowest, nil
+}
+
+// instantValue returns the latest value of the first series of query, nil if there is none
+func instantValue(ctx context.Context, c Client, now time.Time, query string) (*float64, error) {
+	series, err := c.QueryInstant(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	if len(series) == 0 {
+		return nil, nil
+	}
+	value, ok := latest(series[0])
+	if !ok {
+		return nil, nil
+	}
+	return &value, nil
+}
+
+// IdleFilter restricts the standby duration to samples at which a state query had none of the busy values
+type IdleFilter struct {
+	Query string
+	Busy  []float64
+}
+
+// StandbyDuration calculates how long power has been continuously in standby range. A standby window,
+// the last maxDuration, whose power spreads more than maxSpread or deviates more than maxStddev doesn't
+// count as standby (0 disables).
+// With an idle filter the printer state must have been idle at every counted sample as well.
+func StandbyDuration(ctx context.Context, c Client, now time.Time, device Device, minWatts, maxWatts, maxSpread, maxStddev float64, maxDuration time.Duration, idle *IdleFilter) (time.Duration, error) {
+	// Query power values over the max duration + buffer
+	lookback := maxDuration + 5*time.Minute
+	series, err := c.QueryRange(ctx, shellyWattsQuery(device), now.Add(-lookback), now, rangeStep)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(series) == 0 {
+		return 0, nil
+	}
+
+	samples := series[0].Samples
+
+	// A heating bed alternates between low and high power. Depending on the sampling phase many
+	// consecutive samples can look like standby, but the whole window still varies too much. The
+	// buffer before the window is left out, the end of a print in it says nothing about standby.
+	windowStart := now.Add(-maxDuration)
+	first, _ := slices.BinarySearchFunc(samples, windowStart, func(sample Sample, t time.Time) int {
+		return sample.Timestamp.Compare(t)
+	})
+	if spread, stddev := powerSpread(samples[first:]); (maxSpread > 0 && spread > maxSpread) || (maxStddev > 0 && stddev > maxStddev) {
+		slog.Debug("Power varies within the standby window, not counting it as standby", "spread", spread, "stddev", stddev)
+		return 0, nil
+	}
+
+	var states []Series
+	if idle != nil {
+		states, err = c.QueryRange(ctx, idle.Query, now.Add(-lookback), now, rangeStep)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Find the continuous period where power was in standby range
+	// Work backwards from most recent
+	var standbyStart *time.Time
+	for i := len(samples) - 1; i >= 0; i-- {
+		if samples[i].Value > minWatts && samples[i].Value < maxWatts && (idle == nil || idleAt(states, idle.Busy, samples[i].Timestamp)) {
+			// Still in standby range
+			standbyStart = &samples[i].Timestamp
+		} else {
+			// Left standby range, stop
+			break
+		}
+	}
+
+	if standbyStart != nil {
+		return now.Sub(*standbyStart), nil
+	}
+	return 0, nil
+}
+
+// idleAt reports whether none of the state series had a busy value at t. Each series is judged by its
+// sample closest to t within half a step; a time without any such sample counts as busy.
+func idleAt(states []Series, busy []float64, t time.Time) bool {
+	found := false
+	for _, s := range states {
+		i, _ := slices.BinarySearchFunc(s.Samples, t, func(sample Sample, t time.Time) int {
+			return sample.Timestamp.Compare(t)
+		})
+		distance := func(j int) time.Duration {
+			return s.Samples[j].Timestamp.Sub(t).Abs()
+		}
+		// The closest sample is the first one at or after t or the one before it
+		closest := -1
+		for _, j := range []int{i - 1, i} {
+			if j >= 0 && j < len(s.Samples) && (closest < 0 || distance(j) < distance(closest)) {
+				closest = j
+			}
+		}
+		if closest < 0 || distance(closest) > rangeStep/2 {
+			continue
+		}
+		if slices.Contains(busy, s.Samples[closest].Value) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// powerSpread returns the difference between the highest and lowest sample and the standard deviation
+func powerSpread(samples []Sample) (float64, float64) {
+	if len(samples) == 0 {
+		return 0, 0
+	}
+	low, high, sum := math.Inf(1), math.Inf(-1), 0.0
+	for _, sample := range samples {
+		low = math.Min(low, sample.Value)
+		high = math.Max(high, sample.Value)
+		sum += sample.Value
+	}
+	mean := sum / float64(len(samples))
+	var squares float64
+	for _, sample := range samples {
+		squares += (sample.Value - mean) * (sample.Value - mean)
+	}
+	return high - low, math.Sqrt(squares / float64(len(samples)))
+}
+
+// Device selects the series of the Shelly device by its identity label
+type Device struct {
+	Pattern      string // Regex matched against NameLabel
+	NameLabel    string // Label naming the device, device_name by default
+	AddressLabel string // Label holding the IP address, ip_address by default
+	ChannelLabel string // Label of the relay channel of the power series, empty to match any
+	Channel      int    // Relay channel matched by ChannelLabel
+	IDLabel      string // Label holding the Shelly Cloud ID, empty if the series have none
+}
+
+// ConfigDevice returns the device selected by SHELLY_DEVICE_PATTERN and the label settings
+func ConfigDevice(cfg *config.Config) Device {
+	return Device{
+		Pattern:      cfg.ShellyDevicePattern,
+		NameLabel:    cfg.ShellyNameLabel,
+		AddressLabel: cfg.ShellyAddressLabel,
+		ChannelLabel: cfg.ShellyChannelLabel,
+		Channel:      cfg.ShellyRelayChannel,
+		IDLabel:      cfg.ShellyIDLabel,
+	}
+}
+
+// shellyWattsQuery selects the power of the Shelly devices matching the device pattern, of the relay
+// channel if the series are labeled with it
+func shellyWattsQuery(device Device) string {
+	if device.ChannelLabel != "" {
+		return fmt.Sprintf(`shelly_watts{%s=~%q,%s="%d"}`, device.NameLabel, device.Pattern, device.ChannelLabel, device.Channel)
+	}
+	return deviceQuery("shelly_watts", device)
+}
+
+// deviceQuery selects metric of the Shelly devices matching the device pattern. The pattern is quoted
+// as a string literal, so backslashes of escaped regex characters survive.
+func deviceQuery(metric string, device Device) string {
+	return fmt.Sprintf(`%s{%s=~%q}`, metric, device.NameLabel, device.Pattern)
+}
+
+// latest returns the most recent value of a series
+func latest(s Series) (float64, bool) {
+	if len(s.Samples) == 0 {
+		return 0, false
+	}
+	return s.Samples[len(s.Samples)-1].Value, true
+}
@@ -0,0 +1,743 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics/metricstest"
+)
+
+const (
+	lastWattsQuery  = `last_over_time(shelly_watts{device_name=~".*[Bb]ambu.*"}[120s])`
+	tlastWattsQuery = `tlast_over_time(shelly_watts{device_name=~".*[Bb]ambu.*"}[120s])`
+	wattsQuery      = `shelly_watts{device_name=~".*[Bb]ambu.*"}`
+)
+
+// gcodeStates returns a bambulab_gcode_state series per printer, each with a sample every minute
+// for the last 30 minutes ending at the given state
+func gcodeStates(now time.Time, states map[string]float64) []metricstest.Series {
+	var series []metricstest.Series
+	for printer, state := range states {
+		series = append(series, metricstest.Series{
+			Labels:  metricstest.GcodeState(printer),
+			Samples: metricstest.Constant(now.Add(-30*time.Minute), now, time.Minute, state),
+		})
+	}
+	return series
+}
+
+func TestIsBambuPrinting(t *testing.T) {
+	now := fixtureTime
+	tests := []struct {
+		name   string
+		states map[string]float64
+		want   bool
+	}{
+		{"no printer", nil, false},
+		{"idle", map[string]float64{"x1c": 0}, false},
+		{"running", map[string]float64{"x1c": 1}, true},
+		{"paused", map[string]float64{"x1c": 2}, true},
+		{"completed", map[string]float64{"x1c": 3}, false},
+		{"error", map[string]float64{"x1c": 4}, false},
+		{"one of two printing", map[string]float64{"x1c": 0, "p1s": 1}, true},
+		{"none of two printing", map[string]float64{"x1c": 3, "p1s": 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newFakeVM(t, gcodeStates(now, tt.states)...)
+			got, err := IsBambuPrinting(context.Background(), c, now)
+			if err != nil || got != tt.want {
+				t.Errorf("IsBambuPrinting = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsBambuPrintingStaleState(t *testing.T) {
+	// The exporter stopped reporting a running print 10 minutes ago, beyond the staleness of the backend
+	c, _ := newFakeVM(t, gcodeStates(fixtureTime.Add(-10*time.Minute), map[string]float64{"x1c": 1})...)
+	if got, err := IsBambuPrinting(context.Background(), c, fixtureTime); err != nil || got {
+		t.Errorf("IsBambuPrinting = %v, %v, want false for a stale state", got, err)
+	}
+}
+
+func TestIsBambuPrintingRecorded(t *testing.T) {
+	c, vm := newReplayVM(t, map[string]string{"bambulab_gcode_state": "gcode_state.json"})
+	if got, err := IsBambuPrinting(context.Background(), c, fixtureTime); err != nil || !got {
+		t.Errorf("IsBambuPrinting = %v, %v, want true for the paused p1s", got, err)
+	}
+	if vm.count("bambulab_gcode_state") != 1 {
+		t.Errorf("queried %d times, want once", vm.count("bambulab_gcode_state"))
+	}
+}
+
+func TestIsBambuPrintingErrors(t *testing.T) {
+	c, vm := newFakeVM(t)
+	vm.Fail(503, "service unavailable")
+	if _, err := IsBambuPrinting(context.Background(), c, fixtureTime); err == nil || !strings.Contains(err.Error(), "status 503") {
+		t.Errorf("error = %v, want the status", err)
+	}
+}
+
+func TestShellyBambuWatts(t *testing.T) {
+	now := fixtureTime
+	other := metricstest.Series{Labels: metricstest.ShellyWatts("shelly-desk-lamp", "192.168.1.50"), Samples: metricstest.Constant(now.Add(-5*time.Minute), now, time.Minute, 40)}
+	c, vm := newFakeVM(t, wattsSeries(now, 8, 8.2, 8.3), other)
+
+	reading, err := ShellyBambuWatts(context.Background(), c, now, testDevice, 2*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ShellyReading{DeviceName: "shellyplugsg3-bambu", IP: "192.168.1.42", Watts: 8.3}
+	if *reading != want {
+		t.Errorf("reading = %+v, want %+v", *reading, want)
+	}
+	if got := vm.Queries(); len(got) != 1 || got[0] != lastWattsQuery {
+		t.Errorf("queries = %q, want %q", got, lastWattsQuery)
+	}
+}
+
+func TestShellyBambuWattsRecorded(t *testing.T) {
+	c, _ := newReplayVM(t, map[string]string{lastWattsQuery: "shelly_watts_last.json"})
+	reading, err := ShellyBambuWatts(context.Background(), c, fixtureTime, testDevice, 2*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ShellyReading{DeviceName: "shellyplugsg3-bambu", IP: "192.168.1.42", Watts: 8.31}); *reading != want {
+		t.Errorf("reading = %+v, want %+v", *reading, want)
+	}
+}
+
+func TestShellyBambuWattsLabels(t *testing.T) {
+	now := fixtureTime
+	// A pattern matching the empty string also selects series without the name label
+	unnamed := metricstest.Series{Labels: map[string]string{"__name__": "shelly_watts", "ip_address": "192.168.1.9"}, Samples: metricstest.Constant(now.Add(-time.Minute), now, time.Minute, 50)}
+	named := wattsSeries(now, 8.1)
+	named.Labels["shelly_id"] = "a8032ab1c2d3"
+	device := Device{Pattern: ".*", NameLabel: "device_name", AddressLabel: "ip_address", IDLabel: "shelly_id"}
+
+	c, _ := newFakeVM(t, unnamed, named)
+	reading, err := ShellyBambuWatts(context.Background(), c, now, device, 2*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reading.DeviceName != "shellyplugsg3-bambu" || reading.CloudID != "a8032ab1c2d3" || reading.Watts != 8.1 {
+		t.Errorf("reading = %+v, want the named series with its cloud ID", *reading)
+	}
+
+	c, _ = newFakeVM(t, unnamed)
+	reading, err = ShellyBambuWatts(context.Background(), c, now, device, 2*time.Minute)
+	if err != nil || reading.DeviceName != "" || reading.IP != "192.168.1.9" || reading.Watts != 50 {
+		t.Errorf("only an unnamed series: reading = %+v, %v", reading, err)
+	}
+}
+
+func TestShellyBambuWattsMissing(t *testing.T) {
+	now := fixtureTime
+	tests := []struct {
+		name   string
+		series []metricstest.Series
+	}{
+		{"no series", nil},
+		{"older than the max age", []metricstest.Series{wattsSeries(now.Add(-3*time.Minute), 8, 8)}},
+		{"other device", []metricstest.Series{{Labels: metricstest.ShellyWatts("shelly-desk-lamp", "192.168.1.50"), Samples: metricstest.Constant(now.Add(-time.Minute), now, time.Minute, 40)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newFakeVM(t, tt.series...)
+			_, err := ShellyBambuWatts(context.Background(), c, now, testDevice, 2*time.Minute)
+			if err == nil || err.Error() != "no shelly device matching pattern '.*[Bb]ambu.*' found" {
+				t.Errorf("error = %v", err)
+			}
+		})
+	}
+}
+
+// TestShellyDevicesSelector selects devices named with regex characters by SHELLY_DEVICES, where the
+// names as a pattern would select the decoys
+func TestShellyDevicesSelector(t *testing.T) {
+	now := fixtureTime
+	for _, tt := range []struct{ name, decoy string }{
+		{"bambu+enclosure", "bambuuuenclosure"},
+		{"bambu.x1c", "bambu-x1c"},
+		{"plug(1)", "plug1"},
+		{"plug[2]", "plug2"},
+		{"left|right", "left"},
+		{"^start$", "start"},
+		{`back\slash`, "backslash"},
+		{`say "hi"`, "say hi"},
+		{"plug*?{3}", "plu"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, "-shelly-devices", tt.name)
+			decoy := metricstest.Series{Labels: metricstest.ShellyWatts(tt.decoy, "192.168.1.50"), Samples: metricstest.Constant(now.Add(-time.Minute), now, time.Minute, 40)}
+			target := metricstest.Series{Labels: metricstest.ShellyWatts(tt.name, "192.168.1.42"), Samples: metricstest.Constant(now.Add(-time.Minute), now, time.Minute, 8)}
+
+			c, _ := newFakeVM(t, decoy, target)
+			reading, err := ShellyBambuWatts(context.Background(), c, now, ConfigDevice(&cfg), 2*time.Minute)
+			if err != nil || reading.DeviceName != tt.name || reading.Watts != 8 {
+				t.Errorf("reading = %+v, %v, want %q", reading, err, tt.name)
+			}
+			c, _ = newFakeVM(t, decoy)
+			if _, err := ShellyBambuWatts(context.Background(), c, now, ConfigDevice(&cfg), 2*time.Minute); err == nil {
+				t.Errorf("decoy %q selected", tt.decoy)
+			}
+		})
+	}
+}
+
+// TestSparseScrapes reads a sample scraped 4.5 minutes ago, as with a 5 minute scrape interval, with
+// the windows of several METRICS_MAX_AGE and CHECK_INTERVAL settings
+func TestSparseScrapes(t *testing.T) {
+	now := fixtureTime
+	tests := []struct {
+		name  string
+		cfg   config.Config
+		fresh bool
+	}{
+		{"defaults", config.Config{CheckInterval: time.Minute}, false}, // Twice the default CHECK_INTERVAL of 60s
+		{"max age 4m29s", config.Config{CheckInterval: time.Minute, MetricsMaxAge: 269 * time.Second}, false},
+		{"max age 4m31s", config.Config{CheckInterval: time.Minute, MetricsMaxAge: 271 * time.Second}, true},
+		{"max age 6m", config.Config{CheckInterval: time.Minute, MetricsMaxAge: 6 * time.Minute}, true},
+		{"interval 5m", config.Config{CheckInterval: 5 * time.Minute}, true}, // Twice that is 10 minutes
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxAge := tt.cfg.MaxMetricsAge()
+			series := wattsSeries(now.Add(-270*time.Second), 8.4, 8.2)
+			c, vm := newFakeVM(t, series)
+
+			reading, err := ShellyBambuWatts(context.Background(), c, now, testDevice, maxAge)
+			if tt.fresh && (err != nil || reading.Watts != 8.2) {
+				t.Errorf("reading = %+v, %v, want the sample of 4.5 minutes ago", reading, err)
+			}
+			if !tt.fresh && err == nil {
+				t.Errorf("reading = %+v, want none within %s", reading, maxAge)
+			}
+			recent, err := HasRecentShellyMetrics(context.Background(), c, now, testDevice, maxAge)
+			if err != nil || recent != tt.fresh {
+				t.Errorf("HasRecentShellyMetrics = %v, %v, want %v", recent, err, tt.fresh)
+			}
+			if age, _ := ShellyMetricsAge(context.Background(), c, now, testDevice, maxAge); tt.fresh && (age == nil || *age != 270*time.Second) {
+				t.Errorf("age = %v, want the 4m30s of the sample itself", age)
+			}
+			// Both queries bridge the gap with the window of METRICS_MAX_AGE
+			window := fmt.Sprintf("[%ds])", int(maxAge.Seconds()))
+			for _, q := range vm.Queries() {
+				if !strings.HasSuffix(q, window) {
+					t.Errorf("query %s, want a window of %s", q, window)
+				}
+			}
+		})
+	}
+}
+
+func TestHasRecentShellyMetrics(t *testing.T) {
+	now := fixtureTime
+	tests := []struct {
+		name string
+		age  time.Duration // Of the latest sample
+		want bool
+	}{
+		{"fresh", 0, true},
+		{"seconds old", 30 * time.Second, true},
+		{"just within", 119 * time.Second, true},
+		{"at the limit", 120 * time.Second, false}, // Outside the left-open range of the query
+		{"stale", 5 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, vm := newFakeVM(t, wattsSeries(now.Add(-tt.age), 8, 8, 8))
+			got, err := HasRecentShellyMetrics(context.Background(), c, now, testDevice, 2*time.Minute)
+			if err != nil || got != tt.want {
+				t.Errorf("HasRecentShellyMetrics = %v, %v, want %v", got, err, tt.want)
+			}
+			if q := vm.Queries(); len(q) != 1 || q[0] != tlastWattsQuery {
+				t.Errorf("queries = %q, want %q", q, tlastWattsQuery)
+			}
+		})
+	}
+}
+
+func TestHasRecentShellyMetricsRecorded(t *testing.T) {
+	tight := `tlast_over_time(shelly_watts{device_name=~".*[Bb]ambu.*"}[10s])`
+	c, _ := newReplayVM(t, map[string]string{tlastWattsQuery: "shelly_watts_tlast.json", tight: "shelly_watts_tlast.json"})
+	age, err := ShellyMetricsAge(context.Background(), c, fixtureTime, testDevice, 2*time.Minute)
+	if err != nil || age == nil || *age != 15*time.Second {
+		t.Fatalf("ShellyMetricsAge = %v, %v, want 15s", age, err)
+	}
+	if recent, err := HasRecentShellyMetrics(context.Background(), c, fixtureTime, testDevice, 2*time.Minute); err != nil || !recent {
+		t.Errorf("HasRecentShellyMetrics = %v, %v", recent, err)
+	}
+	// The same 15s old sample is stale for a tighter limit
+	if recent, _ := HasRecentShellyMetrics(context.Background(), c, fixtureTime, testDevice, 10*time.Second); recent {
+		t.Error("a 15s old sample counts as within 10s")
+	}
+}
+
+func TestHasRecentShellyMetricsErrors(t *testing.T) {
+	c, vm := newFakeVM(t)
+	vm.Fail(500, "internal error")
+	if recent, err := HasRecentShellyMetrics(context.Background(), c, fixtureTime, testDevice, 2*time.Minute); err == nil || recent {
+		t.Errorf("HasRecentShellyMetrics = %v, %v, want an error", recent, err)
+	}
+}
+
+func TestPowerHistory(t *testing.T) {
+	now := fixtureTime
+	lookback := 21 * time.Minute
+	tests := []struct {
+		name    string
+		values  []float64 // Every minute up to now
+		covered time.Duration
+		ok      bool
+	}{
+		{"no series", nil, 0, false},
+		// A series that only started 5 minutes ago, like on a fresh VictoriaMetrics
+		{"started 5 minutes ago", repeat(8, 6), 5 * time.Minute, false},
+		{"a step short", repeat(8, 21), 20 * time.Minute, true},
+		{"two steps short", repeat(8, 20), 19 * time.Minute, false},
+		// The range leaves out its start, so minutely samples never cover more than a step less
+		{"longer retention", repeat(8, 120), 20 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var series []metricstest.Series
+			if tt.values != nil {
+				series = append(series, wattsSeries(now, tt.values...))
+			}
+			c, vm := newFakeVM(t, series...)
+			covered, ok, err := PowerHistory(context.Background(), c, now, testDevice, lookback)
+			if err != nil || covered != tt.covered || ok != tt.ok {
+				t.Errorf("PowerHistory = %s, %v, %v, want %s, %v", covered, ok, err, tt.covered, tt.ok)
+			}
+			if want := `tfirst_over_time(shelly_watts{device_name=~".*[Bb]ambu.*"}[1260s])`; len(vm.Queries()) != 1 || vm.Queries()[0] != want {
+				t.Errorf("queries = %q, want %q", vm.Queries(), want)
+			}
+		})
+	}
+
+	c, vm := newFakeVM(t)
+	vm.Fail(500, "internal error")
+	if _, ok, err := PowerHistory(context.Background(), c, now, testDevice, lookback); err == nil || ok {
+		t.Errorf("PowerHistory = %v, %v, want an error", ok, err)
+	}
+}
+
+func TestWasPowerTurnedOnRecently(t *testing.T) {
+	now := fixtureTime
+	tests := []struct {
+		name   string
+		values []float64 // Every minute up to now
+		want   bool
+	}{
+		{"no series", nil, false},
+		{"switched on and booting", append(repeat(0, 10), 95, 40, 8, 8), true},
+		{"switched on during the last minute", append(repeat(0, 20), 120), true},
+		{"standby all along", repeat(8, 25), false},
+		{"off all along", repeat(0, 25), false},
+		{"on without a boot draw", append(repeat(0, 10), repeat(8, 10)...), false},
+		{"switched off", append(repeat(120, 10), repeat(0, 10)...), false},
+		{"near zero to high", append(repeat(4.9, 10), 10.5), true},
+		{"low but not off to high", append(repeat(5, 10), 120), false},
+		{"boot before the lookback", append(append(repeat(0, 10), 95), repeat(8, 25)...), false},
+		{"too few samples", []float64{0, 120}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var series []metricstest.Series
+			if tt.values != nil {
+				series = append(series, wattsSeries(now, tt.values...))
+			}
+			c, _ := newFakeVM(t, series...)
+			got, err := WasPowerTurnedOnRecently(context.Background(), c, now, testDevice, 20*time.Minute)
+			if err != nil || got != tt.want {
+				t.Errorf("WasPowerTurnedOnRecently = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWasPowerTurnedOnRecentlyRecorded(t *testing.T) {
+	for fixture, want := range map[string]bool{"shelly_watts_boot.json": true, "shelly_watts_standby.json": false} {
+		c, _ := newReplayVM(t, map[string]string{wattsQuery: fixture})
+		if got, err := WasPowerTurnedOnRecently(context.Background(), c, fixtureTime, testDevice, 20*time.Minute); err != nil || got != want {
+			t.Errorf("%s: WasPowerTurnedOnRecently = %v, %v, want %v", fixture, got, err, want)
+		}
+	}
+}
+
+func TestWasPrintingRecently(t *testing.T) {
+	now := fixtureTime
+	// state returns a gcode state series that was busy until the given time ago, idle since
+	state := func(printer string, busy float64, until time.Duration) metricstest.Series {
+		end := now.Add(-until)
+		return metricstest.Series{Labels: metricstest.GcodeState(printer), Samples: metricstest.Samples(now.Add(-time.Hour), now, time.Minute, func(t time.Time) float64 {
+			if t.After(end) {
+				return 0
+			}
+			return busy
+		})}
+	}
+	tests := []struct {
+		name   string
+		series []metricstest.Series
+		want   bool
+	}{
+		{"no printer", nil, false},
+		{"printing now", []metricstest.Series{state("x1c", 1, 0)}, true},
+		{"finished 5 minutes ago", []metricstest.Series{state("x1c", 1, 5*time.Minute)}, true},
+		{"paused 14 minutes ago", []metricstest.Series{state("x1c", 2, 14*time.Minute)}, true},
+		{"finished 20 minutes ago", []metricstest.Series{state("x1c", 1, 20*time.Minute)}, false},
+		{"completed state only", []metricstest.Series{state("x1c", 3, 0)}, false},
+		{"error state only", []metricstest.Series{state("x1c", 4, 0)}, false},
+		{"second printer", []metricstest.Series{state("x1c", 0, 0), state("p1s", 1, 10*time.Minute)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, vm := newFakeVM(t, tt.series...)
+			got, err := WasPrintingRecently(context.Background(), c, now, 15*time.Minute)
+			if err != nil || got != tt.want {
+				t.Errorf("WasPrintingRecently = %v, %v, want %v", got, err, tt.want)
+			}
+			if q := vm.Queries(); len(q) != 1 || q[0] != "max_over_time(bambulab_gcode_state[15m0s])" {
+				t.Errorf("queries = %q", q)
+			}
+		})
+	}
+}
+
+func TestWasPrintingRecentlyRecorded(t *testing.T) {
+	c, _ := newReplayVM(t, map[string]string{"max_over_time(bambulab_gcode_state[15m0s])": "gcode_state_max.json"})
+	if got, err := WasPrintingRecently(context.Background(), c, fixtureTime, 15*time.Minute); err != nil || !got {
+		t.Errorf("WasPrintingRecently = %v, %v, want true for the p1s", got, err)
+	}
+}
+
+func TestStandbyDuration(t *testing.T) {
+	now := fixtureTime
+	heater := func(n int) []float64 {
+		values := make([]float64, n)
+		for i := range values {
+			values[i] = 8
+			if i%3 == 0 {
+				values[i] = 95
+			}
+		}
+		return values
+	}
+	tests := []struct {
+		name   string
+		values []float64 // Every minute up to now
+		want   time.Duration
+	}{
+		{"no series", nil, 0},
+		{"standby beyond the lookback", repeat(8, 40), 20 * time.Minute},
+		{"standby for 7 minutes", append(repeat(0, 15), repeat(8, 8)...), 7 * time.Minute},
+		{"just left standby", append(repeat(8, 20), 0), 0},
+		{"at the minimum", repeat(7, 30), 0},
+		{"at the maximum", repeat(9, 30), 0},
+		{"within the bounds", repeat(8.99, 30), 20 * time.Minute},
+		{"heater cycling", heater(30), 0},
+		{"spread of a print in the window", append(repeat(45, 5), repeat(8, 12)...), 0},
+		// The lookback reaches 5 minutes further back than the window, into the end of the print
+		{"print ending before the window", append(repeat(60, 4), repeat(8, 17)...), 16 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var series []metricstest.Series
+			if tt.values != nil {
+				series = append(series, wattsSeries(now, tt.values...))
+			}
+			c, _ := newFakeVM(t, series...)
+			got, err := StandbyDuration(context.Background(), c, now, testDevice, 7, 9, 40, 10, 15*time.Minute, nil)
+			if err != nil || got != tt.want {
+				t.Errorf("StandbyDuration = %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStandbyDurationSpreadLimits(t *testing.T) {
+	now := fixtureTime
+	// A 30 W spike 10 minutes ago: too wide for a 20 W spread, fine for 40 W; 0 disables the checks
+	values := append(append(repeat(8, 10), 38), repeat(8, 10)...)
+	for _, tt := range []struct {
+		spread, stddev float64
+		want           time.Duration
+	}{
+		{40, 0, 9 * time.Minute},
+		{20, 0, 0},
+		{0, 0, 9 * time.Minute},
+		{0, 8, 9 * time.Minute}, // The spike makes for a standard deviation of 7.3 W over the window
+		{0, 7, 0},
+	} {
+		c, _ := newFakeVM(t, wattsSeries(now, values...))
+		got, err := StandbyDuration(context.Background(), c, now, testDevice, 7, 9, tt.spread, tt.stddev, 15*time.Minute, nil)
+		if err != nil || got != tt.want {
+			t.Errorf("spread %.0f, stddev %.0f: StandbyDuration = %s, %v, want %s", tt.spread, tt.stddev, got, err, tt.want)
+		}
+	}
+}
+
+// heaterCycling returns the power of a bed holding its temperature after a print, scraped every 15s: 45s
+// at 90 W every 4.5 minutes, 11 W in between. phase shifts the heating relative to the queries.
+func heaterCycling(now time.Time, phase time.Duration) metricstest.Series {
+	const period, heating = 270 * time.Second, 45 * time.Second
+	start := now.Add(-40 * time.Minute)
+	samples := metricstest.Samples(start, now, 15*time.Second, func(t time.Time) float64 {
+		if (t.Sub(start)+phase)%period < heating {
+			return 90
+		}
+		return 11
+	})
+	return metricstest.Series{Labels: metricstest.ShellyWatts("shellyplugsg3-bambu", "192.168.1.42"), Samples: samples}
+}
+
+func TestStandbyDurationHeaterCycling(t *testing.T) {
+	now := fixtureTime
+	// A standby range of 7-12 W includes the 11 W between the heating pulses
+	var naiveMax time.Duration
+	for phase := time.Duration(0); phase < 270*time.Second; phase += 15 * time.Second {
+		c, _ := newFakeVM(t, heaterCycling(now, phase))
+		got, err := StandbyDuration(context.Background(), c, now, testDevice, 7, 12, 40, 10, 15*time.Minute, nil)
+		if err != nil || got != 0 {
+			t.Errorf("phase %s: StandbyDuration = %s, %v, want no standby", phase, got, err)
+		}
+		for _, limits := range [][2]float64{{40, 0}, {0, 10}} {
+			if got, _ := StandbyDuration(context.Background(), c, now, testDevice, 7, 12, limits[0], limits[1], 15*time.Minute, nil); got != 0 {
+				t.Errorf("phase %s, spread %.0f, stddev %.0f: StandbyDuration = %s, want either check to catch it", phase, limits[0], limits[1], got)
+			}
+		}
+		// Without the checks the scan counts the low samples since the last pulse it happened to see
+		naive, _ := StandbyDuration(context.Background(), c, now, testDevice, 7, 12, 0, 0, 15*time.Minute, nil)
+		naiveMax = max(naiveMax, naive)
+	}
+	if naiveMax < 5*time.Minute {
+		t.Errorf("longest naive standby = %s, want phases that look like minutes of standby", naiveMax)
+	}
+}
+
+func TestStandbyDurationIdleFilter(t *testing.T) {
+	now := fixtureTime
+	idle := &IdleFilter{Query: "bambulab_gcode_state", Busy: []float64{1, 2}}
+	// The power is in the standby band all along, only the printer state tells paused prints apart
+	tests := []struct {
+		name  string
+		state func(ago time.Duration) float64
+		want  time.Duration
+	}{
+		{"paused until 6 minutes ago", func(ago time.Duration) float64 { return busyIf(ago > 6*time.Minute, 2) }, 6 * time.Minute},
+		{"paused in the middle of the window", func(ago time.Duration) float64 { return busyIf(ago > 10*time.Minute && ago <= 14*time.Minute, 2) }, 10 * time.Minute},
+		{"paused for one sample", func(ago time.Duration) float64 { return busyIf(ago == 3*time.Minute, 2) }, 2 * time.Minute},
+		{"preparing", func(ago time.Duration) float64 { return busyIf(ago > 4*time.Minute, 1) }, 4 * time.Minute},
+		{"still paused", func(time.Duration) float64 { return 2 }, 0},
+		{"paused again just now", func(ago time.Duration) float64 { return busyIf(ago == 0, 2) }, 0},
+		{"idle all along", func(time.Duration) float64 { return 0 }, 20 * time.Minute},
+		{"failed is not busy", func(time.Duration) float64 { return 4 }, 20 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := metricstest.Series{Labels: metricstest.GcodeState("x1c"), Samples: metricstest.Samples(now.Add(-30*time.Minute), now, time.Minute, func(t time.Time) float64 {
+				return tt.state(now.Sub(t))
+			})}
+			c, _ := newFakeVM(t, wattsSeries(now, repeat(8, 30)...), state)
+			got, err := StandbyDuration(context.Background(), c, now, testDevice, 7, 9, 40, 10, 15*time.Minute, idle)
+			if err != nil || got != tt.want {
+				t.Errorf("StandbyDuration = %s, %v, want %s", got, err, tt.want)
+			}
+			if got, _ := StandbyDuration(context.Background(), c, now, testDevice, 7, 9, 40, 10, 15*time.Minute, nil); got != 20*time.Minute {
+				t.Errorf("without the filter: StandbyDuration = %s, want the whole window", got)
+			}
+		})
+	}
+
+	t.Run("no state series", func(t *testing.T) {
+		c, _ := newFakeVM(t, wattsSeries(now, repeat(8, 30)...))
+		if got, err := StandbyDuration(context.Background(), c, now, testDevice, 7, 9, 40, 10, 15*time.Minute, idle); err != nil || got != 0 {
+			t.Errorf("StandbyDuration = %s, %v, want no standby without a known state", got, err)
+		}
+	})
+}
+
+// busyIf returns the busy state value if cond holds, and the idle 0 otherwise
+func busyIf(cond bool, value float64) float64 {
+	if cond {
+		return value
+	}
+	return 0
+}
+
+func TestStandbyDurationIdleFilterRecorded(t *testing.T) {
+	const stateQuery = `bambulab_gcode_state{printer="x1c"}`
+	c, _ := newReplayVM(t, map[string]string{wattsQuery: "shelly_watts_paused.json", stateQuery: "gcode_state_paused.json"})
+	// Paused at standby draw from 14 to 9 minutes ago
+	idle := &IdleFilter{Query: stateQuery, Busy: []float64{1, 2}}
+	got, err := StandbyDuration(context.Background(), c, fixtureTime, testDevice, 7, 9, 40, 10, 15*time.Minute, idle)
+	if err != nil || got != 8*time.Minute {
+		t.Errorf("StandbyDuration = %s, %v, want the 8 minutes since the pause ended", got, err)
+	}
+	if got, _ := StandbyDuration(context.Background(), c, fixtureTime, testDevice, 7, 9, 40, 10, 15*time.Minute, nil); got != 20*time.Minute {
+		t.Errorf("without the filter: StandbyDuration = %s, want the whole window", got)
+	}
+}
+
+func TestIdleAt(t *testing.T) {
+	at := fixtureTime
+	// series returns a state series with the values at the offsets from at
+	series := func(points map[time.Duration]float64) Series {
+		var s Series
+		for _, offset := range []time.Duration{-time.Minute, -31 * time.Second, -29 * time.Second, -10 * time.Second, 0, 20 * time.Second, 30 * time.Second, time.Minute} {
+			if v, ok := points[offset]; ok {
+				s.Samples = append(s.Samples, Sample{Timestamp: at.Add(offset), Value: v})
+			}
+		}
+		return s
+	}
+	busy := []float64{1, 2}
+	tests := []struct {
+		name   string
+		states []Series
+		want   bool
+	}{
+		{"idle at the time", []Series{series(map[time.Duration]float64{0: 0})}, true},
+		{"busy at the time", []Series{series(map[time.Duration]float64{0: 2})}, false},
+		{"closest sample idle", []Series{series(map[time.Duration]float64{-time.Minute: 2, -10 * time.Second: 0, 30 * time.Second: 2})}, true},
+		{"closest sample busy", []Series{series(map[time.Duration]float64{-29 * time.Second: 0, 20 * time.Second: 2})}, false},
+		{"within half a step", []Series{series(map[time.Duration]float64{30 * time.Second: 0})}, true},
+		{"beyond half a step", []Series{series(map[time.Duration]float64{-31 * time.Second: 0, -time.Minute: 0})}, false},
+		{"no series", nil, false},
+		{"empty series", []Series{{}}, false},
+		{"one of two printers busy", []Series{series(map[time.Duration]float64{0: 0}), series(map[time.Duration]float64{0: 2})}, false},
+		{"one printer without a sample", []Series{series(map[time.Duration]float64{0: 0}), series(map[time.Duration]float64{time.Minute: 2})}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := idleAt(tt.states, busy, at); got != tt.want {
+				t.Errorf("idleAt = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStandbyDurationRecorded(t *testing.T) {
+	c, _ := newReplayVM(t, map[string]string{wattsQuery: "shelly_watts_standby.json"})
+	got, err := StandbyDuration(context.Background(), c, fixtureTime, testDevice, 7, 9, 40, 10, 15*time.Minute, nil)
+	if err != nil || got != 13*time.Minute {
+		t.Errorf("StandbyDuration = %s, %v, want the 13 minutes since the plug was switched on", got, err)
+	}
+}
+
+// printDraw returns n samples of a print drawing between 110 and 260 W, as the heaters and motors vary
+func printDraw(n int) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = 110 + float64(i*53%150)
+	}
+	return values
+}
+
+func TestSustainedHighPowerEnd(t *testing.T) {
+	now := fixtureTime
+	// A lookback of PRINT_POWER_DURATION + PRINT_POWER_COOLDOWN + 1m with the defaults
+	const lookback = 14 * time.Minute
+	at := func(ago time.Duration) *time.Time {
+		t := now.Add(-ago)
+		return &t
+	}
+	tests := []struct {
+		name   string
+		values []float64 // Every minute up to now
+		want   *time.Time
+	}{
+		{"no series", nil, nil},
+		{"standby", repeat(8, 30), nil},
+		{"mid-print", append(repeat(8, 10), printDraw(20)...), &now},
+		{"print ended 3 minutes ago", append(printDraw(20), repeat(8, 4)...), at(3 * time.Minute)},
+		// The lookback still shows PRINT_POWER_DURATION of a streak that ended a cooldown ago, not more
+		{"ended a cooldown ago", append(printDraw(20), repeat(8, 11)...), at(10 * time.Minute)},
+		{"ended longer than a cooldown ago", append(printDraw(20), repeat(8, 12)...), nil},
+		{"spike too short", append(append(repeat(8, 10), printDraw(3)...), repeat(8, 5)...), nil},
+		{"just long enough", append(append(repeat(8, 10), printDraw(4)...), repeat(8, 5)...), at(4 * time.Minute)},
+		{"started just now", append(repeat(8, 20), printDraw(3)...), nil},
+		{"running for the minimum", append(repeat(8, 20), printDraw(4)...), &now},
+		// A dip during the print splits the streak, the later streak counts
+		{"dip mid-print", append(append(append(printDraw(10), 40), printDraw(5)...), repeat(8, 2)...), at(time.Minute)},
+		{"at the threshold", repeat(60, 30), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var series []metricstest.Series
+			if tt.values != nil {
+				series = append(series, wattsSeries(now, tt.values...))
+			}
+			c, _ := newFakeVM(t, series...)
+			got, err := SustainedHighPowerEnd(context.Background(), c, now, testDevice, 60, 3*time.Minute, lookback)
+			if err != nil || (got == nil) != (tt.want == nil) || (got != nil && !got.Equal(*tt.want)) {
+				t.Errorf("SustainedHighPowerEnd = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// standbyFixture returns 30 minutes at 8 W scraped every 15s, with a 90 W sample at each of the spikes
+// before now and no samples before the start
+func standbyFixture(now time.Time, start time.Duration, spikes ...time.Duration) metricstest.Series {
+	samples := metricstest.Samples(now.Add(-start), now, 15*time.Second, func(t time.Time) float64 {
+		for _, spike := range spikes {
+			if t.Equal(now.Add(-spike)) {
+				return 90
+			}
+		}
+		return 8
+	})
+	return metricstest.Series{Labels: metricstest.ShellyWatts("shellyplugsg3-bambu", "192.168.1.42"), Samples: samples}
+}
+
+// TestStandbyModes compares the standby durations of the modes over the same series, for a
+// STANDBY_DURATION of 15 minutes
+func TestStandbyModes(t *testing.T) {
+	now := fixtureTime
+	const window = 15 * time.Minute
+	tests := []struct {
+		name     string
+		series   metricstest.Series
+		raw      time.Duration // Without the variation checks
+		checked  time.Duration // With the default spread and standard deviation limits
+		quantile time.Duration
+	}{
+		{"steady standby", standbyFixture(now, 30*time.Minute), 20 * time.Minute, 20 * time.Minute, window},
+		// The README example: the raw scan restarts at the spike, the checks wait for it to leave the
+		// window, the percentiles don't notice it
+		{"a spike 5 minutes ago", standbyFixture(now, 30*time.Minute, 5*time.Minute), 4 * time.Minute, 0, window},
+		// A spike older than the window doesn't hold up the checks
+		{"a spike 18 minutes ago", standbyFixture(now, 30*time.Minute, 18*time.Minute), 17 * time.Minute, 17 * time.Minute, window},
+		{"two spikes", standbyFixture(now, 30*time.Minute, 3*time.Minute, 11*time.Minute), 2 * time.Minute, 0, window},
+		// More than 5% of the samples reach the 95th percentile
+		{"four spikes", standbyFixture(now, 30*time.Minute, 2*time.Minute, 5*time.Minute, 8*time.Minute, 12*time.Minute), time.Minute, 0, 0},
+		// The percentiles need samples over the whole window
+		{"switched on 10 minutes ago", standbyFixture(now, 10*time.Minute), 10 * time.Minute, 10 * time.Minute, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newFakeVM(t, tt.series)
+			ctx := context.Background()
+			raw, err := StandbyDuration(ctx, c, now, testDevice, 7, 9, 0, 0, window, nil)
+			if err != nil || raw != tt.raw {
+				t.Errorf("raw = %s, %v, want %s", raw, err, tt.raw)
+			}
+			checked, err := StandbyDuration(ctx, c, now, testDevice, 7, 9, 40, 10, window, nil)
+			if err != nil || checked != tt.checked {
+				t.Errorf("raw with the checks = %s, %v, want %s", checked, err, tt.checked)
+			}
+			quantile, err := QuantileStandby(ctx, c, now, testDevice, 7, 9, window)
+			if err != nil || quantile != tt.quantile {
+				t.Errorf("quantile = %s, %v, want %s", quantile, err, tt.quantile)
+			}
+		})
+	}
+}
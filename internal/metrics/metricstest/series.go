@@ -0,0 +1,28 @@
+package metricstest
+
+import "time"
+
+// ShellyWatts returns the labels of the shelly_watts series of a Shelly device with the default
+// SHELLY_NAME_LABEL and SHELLY_ADDRESS_LABEL
+func ShellyWatts(name, address string) map[string]string {
+	return map[string]string{"__name__": "shelly_watts", "device_name": name, "ip_address": address}
+}
+
+// GcodeState returns the labels of the bambulab_gcode_state series of a printer
+func GcodeState(printer string) map[string]string {
+	return map[string]string{"__name__": "bambulab_gcode_state", "printer": printer}
+}
+
+// Samples returns a sample every step from start through end, valued by fn
+func Samples(start, end time.Time, step time.Duration, fn func(t time.Time) float64) []Sample {
+	var samples []Sample
+	for t := start; !t.After(end); t = t.Add(step) {
+		samples = append(samples, Sample{Time: t, Value: fn(t)})
+	}
+	return samples
+}
+
+// Constant returns a sample of value every step from start through end
+func Constant(start, end time.Time, step time.Duration, value float64) []Sample {
+	return Samples(start, end, step, func(time.Time) float64 { return value })
+}
@@ -0,0 +1,535 @@
+// Package metricstest provides a fake VictoriaMetrics for tests, answering the PromQL queries of the
+// controller over series defined in Go
+package metricstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Lookback is how far back an instant selector finds the latest sample, like the staleness window of
+// the backend
+const Lookback = 5 * time.Minute
+
+// Sample is a value of a series at a time
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+// Series is a labeled set of samples in chronological order. The metric name is the __name__ label.
+type Series struct {
+	Labels  map[string]string
+	Samples []Sample
+}
+
+// VM is a fake VictoriaMetrics serving /api/v1/query and /api/v1/query_range. It understands plain
+// selectors with label matchers and the *_over_time functions the controller uses; other queries fail
+// with status 400 unless a handler is registered for them. Samples pushed to /api/v1/import/prometheus
+// are added to the series.
+type VM struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	series   []Series
+	handlers map[string]func(at time.Time) []Series
+	status   int    // Status of every query, 0 to answer them
+	body     string // Body of failed queries
+	delay    time.Duration
+	queries  []string
+}
+
+// NewVM starts a fake VictoriaMetrics with the series, closed when the test ends
+func NewVM(t testing.TB, series ...Series) *VM {
+	t.Helper()
+	vm := &VM{series: series, handlers: map[string]func(time.Time) []Series{}}
+	vm.Server = httptest.NewServer(http.HandlerFunc(vm.serve))
+	t.Cleanup(vm.Close)
+	return vm
+}
+
+// Set replaces the series
+func (vm *VM) Set(series ...Series) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.series = series
+}
+
+// Add appends samples to the series with exactly the labels, adding the series if there is none
+func (vm *VM) Add(labels map[string]string, samples ...Sample) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.addLocked(labels, samples...)
+}
+
+// addLocked is Add with vm.mu held
+func (vm *VM) addLocked(labels map[string]string, samples ...Sample) {
+	for i := range vm.series {
+		if equalLabels(vm.series[i].Labels, labels) {
+			vm.series[i].Samples = append(vm.series[i].Samples, samples...)
+			return
+		}
+	}
+	vm.series = append(vm.series, Series{Labels: labels, Samples: samples})
+}
+
+// Handle answers the query with the series returned by fn instead of evaluating it
+func (vm *VM) Handle(query string, fn func(at time.Time) []Series) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.handlers[query] = fn
+}
+
+// Fail makes every query fail with status and body, or answers them again with status 0
+func (vm *VM) Fail(status int, body string) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.status, vm.body = status, body
+}
+
+// Delay holds every response for d, or for as long as the request lasts, whichever is shorter
+func (vm *VM) Delay(d time.Duration) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.delay = d
+}
+
+// Queries returns the PromQL of every query received so far
+func (vm *VM) Queries() []string {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return slices.Clone(vm.queries)
+}
+
+// apiResponse is the JSON body of the query API
+type apiResponse struct {
+	Status    string   `json:"status"`
+	ErrorType string   `json:"errorType,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Data      *apiData `json:"data,omitempty"`
+}
+
+type apiData struct {
+	ResultType string      `json:"resultType"`
+	Result     []apiSeries `json:"result"`
+}
+
+type apiSeries struct {
+	Metric map[string]string `json:"metric"`
+	Value  []any             `json:"value,omitempty"`
+	Values [][]any           `json:"values,omitempty"`
+}
+
+func (vm *VM) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/v1/import/prometheus" {
+		vm.importText(w, r)
+		return
+	}
+	query := r.FormValue("query")
+	vm.mu.Lock()
+	vm.queries = append(vm.queries, query)
+	status, body, delay := vm.status, vm.body, vm.delay
+	vm.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+		return
+	}
+
+	var data apiData
+	var err error
+	switch r.URL.Path {
+	case "/api/v1/query":
+		at := time.Now()
+		if v := r.FormValue("time"); v != "" {
+			at, err = parseTime(v)
+		}
+		if err == nil {
+			data, err = vm.instant(query, at)
+		}
+	case "/api/v1/query_range":
+		data, err = vm.queryRange(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiResponse{Status: "error", ErrorType: "bad_data", Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, apiResponse{Status: "success", Data: &data})
+}
+
+// importText adds the samples of a Prometheus text import. Samples without a timestamp are stamped with
+// the time of the fake, like VictoriaMetrics does with its own clock.
+func (vm *VM) importText(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.status != 0 {
+		w.WriteHeader(vm.status)
+		_, _ = w.Write([]byte(vm.body))
+		return
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		labels, sample, err := parseImportLine(line)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		vm.addLocked(labels, sample)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseImportLine parses a line like name{label="value"} 1 1772395200000, the timestamp in milliseconds
+func parseImportLine(line string) (map[string]string, Sample, error) {
+	end := strings.LastIndex(line, "}") + 1
+	if end == 0 {
+		end = strings.Index(line, " ")
+	}
+	if end <= 0 {
+		return nil, Sample{}, fmt.Errorf("invalid import line %q", line)
+	}
+	matchers, err := parseSelector(line[:end])
+	if err != nil {
+		return nil, Sample{}, err
+	}
+	labels := map[string]string{}
+	for _, m := range matchers {
+		labels[m.label] = m.value
+	}
+	fields := strings.Fields(line[end:])
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, Sample{}, fmt.Errorf("invalid import line %q", line)
+	}
+	sample := Sample{Time: time.Now()}
+	if sample.Value, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return nil, Sample{}, fmt.Errorf("invalid value in %q", line)
+	}
+	if len(fields) == 2 {
+		ms, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, Sample{}, fmt.Errorf("invalid timestamp in %q", line)
+		}
+		sample.Time = time.UnixMilli(ms)
+	}
+	return labels, sample, nil
+}
+
+func (vm *VM) instant(query string, at time.Time) (apiData, error) {
+	series, err := vm.eval(query, at)
+	if err != nil {
+		return apiData{}, err
+	}
+	data := apiData{ResultType: "vector", Result: []apiSeries{}}
+	for _, s := range series {
+		data.Result = append(data.Result, apiSeries{Metric: s.Labels, Value: pair(at, s.Samples[0].Value)})
+	}
+	return data, nil
+}
+
+func (vm *VM) queryRange(r *http.Request) (apiData, error) {
+	start, err := parseTime(r.FormValue("start"))
+	if err != nil {
+		return apiData{}, err
+	}
+	end, err := parseTime(r.FormValue("end"))
+	if err != nil {
+		return apiData{}, err
+	}
+	// Seconds or a duration like 60s, as VictoriaMetrics accepts both
+	step, err := time.ParseDuration(r.FormValue("step"))
+	if seconds, serr := strconv.ParseFloat(r.FormValue("step"), 64); serr == nil {
+		step, err = time.Duration(seconds*float64(time.Second)), nil
+	}
+	if err != nil || step <= 0 {
+		return apiData{}, fmt.Errorf("invalid step %q", r.FormValue("step"))
+	}
+
+	// Every step evaluates the query like an instant query, the points are grouped by series
+	byLabels := map[string]*apiSeries{}
+	var keys []string
+	for t := start; !t.After(end); t = t.Add(step) {
+		series, err := vm.eval(r.FormValue("query"), t)
+		if err != nil {
+			return apiData{}, err
+		}
+		for _, s := range series {
+			key := labelsKey(s.Labels)
+			if byLabels[key] == nil {
+				byLabels[key] = &apiSeries{Metric: s.Labels}
+				keys = append(keys, key)
+			}
+			byLabels[key].Values = append(byLabels[key].Values, pair(t, s.Samples[0].Value))
+		}
+	}
+	data := apiData{ResultType: "matrix", Result: []apiSeries{}}
+	for _, key := range keys {
+		data.Result = append(data.Result, *byLabels[key])
+	}
+	return data, nil
+}
+
+// rangeFunc matches a function over a range vector, with an optional scalar argument first
+var rangeFunc = regexp.MustCompile(`^([a-z_]+)\((?:([0-9.]+),\s*)?(.+)\[([0-9a-z.]+)\]\)$`)
+
+// eval evaluates the query at a time, each series of the result carrying a single sample
+func (vm *VM) eval(query string, at time.Time) ([]Series, error) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	query = strings.TrimSpace(query)
+	if fn, ok := vm.handlers[query]; ok {
+		return latestOf(fn(at), at), nil
+	}
+
+	m := rangeFunc.FindStringSubmatch(query)
+	if m == nil {
+		sel, err := parseSelector(query)
+		if err != nil {
+			return nil, err
+		}
+		return latestOf(vm.selectLocked(sel), at), nil
+	}
+	sel, err := parseSelector(m[3])
+	if err != nil {
+		return nil, err
+	}
+	window, err := time.ParseDuration(m[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid range %q", m[4])
+	}
+	var result []Series
+	for _, s := range vm.selectLocked(sel) {
+		var samples []Sample
+		for _, sample := range s.Samples {
+			if sample.Time.After(at.Add(-window)) && !sample.Time.After(at) {
+				samples = append(samples, sample)
+			}
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		value, err := overTime(m[1], m[2], samples)
+		if err != nil {
+			return nil, err
+		}
+		labels := map[string]string{}
+		for k, v := range s.Labels {
+			if k != "__name__" {
+				labels[k] = v
+			}
+		}
+		result = append(result, Series{Labels: labels, Samples: []Sample{{Time: at, Value: value}}})
+	}
+	return result, nil
+}
+
+// overTime aggregates the samples within the range of a function
+func overTime(fn, arg string, samples []Sample) (float64, error) {
+	values := make([]float64, len(samples))
+	for i, s := range samples {
+		values[i] = s.Value
+	}
+	switch fn {
+	case "last_over_time":
+		return values[len(values)-1], nil
+	case "tlast_over_time":
+		return unixSeconds(samples[len(samples)-1].Time), nil
+	case "tfirst_over_time":
+		return unixSeconds(samples[0].Time), nil
+	case "max_over_time":
+		return slices.Max(values), nil
+	case "min_over_time":
+		return slices.Min(values), nil
+	case "count_over_time":
+		return float64(len(values)), nil
+	case "quantile_over_time":
+		q, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid quantile %q", arg)
+		}
+		return quantile(q, values), nil
+	}
+	return 0, fmt.Errorf("unsupported function %s", fn)
+}
+
+// quantile interpolates linearly between the closest ranks, like quantile_over_time of Prometheus
+func quantile(q float64, values []float64) float64 {
+	sorted := slices.Clone(values)
+	sort.Float64s(sorted)
+	rank := q * float64(len(sorted)-1)
+	lower := math.Floor(rank)
+	upper := math.Min(lower+1, float64(len(sorted)-1))
+	weight := rank - lower
+	return sorted[int(lower)]*(1-weight) + sorted[int(upper)]*weight
+}
+
+// latestOf returns the latest sample within Lookback at or before at of every series that has one
+func latestOf(series []Series, at time.Time) []Series {
+	var result []Series
+	for _, s := range series {
+		for i := len(s.Samples) - 1; i >= 0; i-- {
+			sample := s.Samples[i]
+			if sample.Time.After(at) {
+				continue
+			}
+			if at.Sub(sample.Time) <= Lookback {
+				result = append(result, Series{Labels: s.Labels, Samples: []Sample{sample}})
+			}
+			break
+		}
+	}
+	return result
+}
+
+// matcher is a label matcher of a selector
+type matcher struct {
+	label string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (m matcher) matches(labels map[string]string) bool {
+	v := labels[m.label]
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	default:
+		return !m.re.MatchString(v)
+	}
+}
+
+// matcherSyntax matches one label matcher with a double-quoted value
+var matcherSyntax = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*("(?:[^"\\]|\\.)*")\s*(?:,|$)`)
+
+// metricName matches valid metric names
+var metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// parseSelector parses a selector like shelly_watts{device_name=~".*bambu.*",channel="0"}
+func parseSelector(s string) ([]matcher, error) {
+	name, rest, hasMatchers := strings.Cut(strings.TrimSpace(s), "{")
+	var matchers []matcher
+	if name != "" {
+		if !metricName.MatchString(name) {
+			return nil, fmt.Errorf("unsupported query %q", s)
+		}
+		matchers = append(matchers, matcher{label: "__name__", op: "=", value: name})
+	}
+	if !hasMatchers {
+		return matchers, nil
+	}
+	rest, ok := strings.CutSuffix(rest, "}")
+	if !ok {
+		return nil, fmt.Errorf("unsupported query %q", s)
+	}
+	for strings.TrimSpace(rest) != "" {
+		m := matcherSyntax.FindStringSubmatch(rest)
+		if m == nil {
+			return nil, fmt.Errorf("invalid label matchers in %q", s)
+		}
+		value, err := strconv.Unquote(m[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid label value %s in %q", m[3], s)
+		}
+		mt := matcher{label: m[1], op: m[2], value: value}
+		if mt.op == "=~" || mt.op == "!~" {
+			if mt.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return nil, fmt.Errorf("invalid regex %q: %w", value, err)
+			}
+		}
+		matchers = append(matchers, mt)
+		rest = rest[len(m[0]):]
+	}
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("unsupported query %q", s)
+	}
+	return matchers, nil
+}
+
+// selectLocked returns the series matching every matcher. The caller holds vm.mu.
+func (vm *VM) selectLocked(matchers []matcher) []Series {
+	var result []Series
+	for _, s := range vm.series {
+		if !slices.ContainsFunc(matchers, func(m matcher) bool { return !m.matches(s.Labels) }) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func equalLabels(a, b map[string]string) bool {
+	return labelsKey(a) == labelsKey(b)
+}
+
+// labelsKey identifies a label set
+func labelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%q,", k, labels[k])
+	}
+	return b.String()
+}
+
+// parseTime parses a Unix timestamp in seconds, with an optional fraction
+func parseTime(s string) (time.Time, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	sec, frac := math.Modf(v)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// pair formats a sample as [timestamp, "value"] like the API
+func pair(t time.Time, v float64) []any {
+	return []any{unixSeconds(t), strconv.FormatFloat(v, 'f', -1, 64)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,160 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// haDevice is the device block shared by all entities of one printer
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// haEntity is a Home Assistant MQTT discovery config
+type haEntity struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	ObjectID          string   `json:"object_id"`
+	StateTopic        string   `json:"state_topic"`
+	CommandTopic      string   `json:"command_topic,omitempty"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	PayloadOn         string   `json:"payload_on,omitempty"`
+	PayloadOff        string   `json:"payload_off,omitempty"`
+	Icon              string   `json:"icon,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+// haDiscoveryConfig is one discovery message with the topic it is published to
+type haDiscoveryConfig struct {
+	topic  string
+	entity haEntity
+}
+
+// discoveryConfigs returns the discovery messages of a device: a switch for the relay,
+// sensors for power and standby duration and a binary sensor for a pending auto-off
+func (p *Publisher) discoveryConfigs(device string) []haDiscoveryConfig {
+	segment := TopicSegment(device)
+	nodeID := p.nodePrefix + HAID(segment)
+	dev := haDevice{
+		Identifiers:  []string{nodeID},
+		Name:         device,
+		Manufacturer: "gome-assistant",
+		Model:        "Shelly controlled printer",
+	}
+
+	entity := func(component, object, name string) haDiscoveryConfig {
+		return haDiscoveryConfig{
+			topic: fmt.Sprintf("%s/%s/%s/%s/config", p.discoveryPrefix, component, nodeID, object),
+			entity: haEntity{
+				Name:              name,
+				UniqueID:          nodeID + "_" + object,
+				ObjectID:          nodeID + "_" + object,
+				AvailabilityTopic: p.availabilityTopic(),
+				Device:            dev,
+			},
+		}
+	}
+
+	relay := entity("switch", "relay", "Printer power")
+	relay.entity.StateTopic = p.deviceTopic(device, "relay")
+	relay.entity.CommandTopic = p.deviceTopic(device, "relay/set")
+	relay.entity.PayloadOn = "ON"
+	relay.entity.PayloadOff = "OFF"
+	relay.entity.Icon = "mdi:printer-3d"
+
+	watts := entity("sensor", "watts", "Power")
+	watts.entity.StateTopic = p.deviceTopic(device, "watts")
+	watts.entity.DeviceClass = "power"
+	watts.entity.StateClass = "measurement"
+	watts.entity.UnitOfMeasurement = "W"
+
+	standby := entity("sensor", "standby", "Standby duration")
+	standby.entity.StateTopic = p.deviceTopic(device, "standby_seconds")
+	standby.entity.DeviceClass = "duration"
+	standby.entity.UnitOfMeasurement = "s"
+
+	pending := entity("binary_sensor", "pending_off", "Auto-off pending")
+	pending.entity.StateTopic = p.deviceTopic(device, "pending_off")
+	pending.entity.PayloadOn = "ON"
+	pending.entity.PayloadOff = "OFF"
+	pending.entity.Icon = "mdi:timer-sand"
+
+	return []haDiscoveryConfig{relay, watts, standby, pending}
+}
+
+// announce publishes the discovery configs of a device and subscribes to its switch command topic,
+// once per broker connection
+func (p *Publisher) announce(device string) error {
+	p.mu.Lock()
+	done := p.discovered[device]
+	p.mu.Unlock()
+	if done || (p.discoveryPrefix == "" && p.onSwitch == nil) {
+		return nil
+	}
+
+	if p.discoveryPrefix != "" {
+		for _, c := range p.discoveryConfigs(device) {
+			payload, err := json.Marshal(c.entity)
+			if err != nil {
+				return err
+			}
+			if err := p.publish(c.topic, true, string(payload)); err != nil {
+				return err
+			}
+		}
+		slog.Info("Home Assistant discovery published", "device", device)
+	}
+	if p.onSwitch != nil {
+		topic := p.deviceTopic(device, "relay/set")
+		token := p.client.Subscribe(topic, 1, func(_ paho.Client, msg paho.Message) { p.handleSwitchCommand(device, msg) })
+		if !token.WaitTimeout(mqttPublishTimeout) {
+			return fmt.Errorf("subscribing to %s timed out", topic)
+		}
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("subscribing to %s: %w", topic, err)
+		}
+	}
+
+	p.mu.Lock()
+	p.discovered[device] = true
+	p.mu.Unlock()
+	return nil
+}
+
+// removeDiscovery deletes the retained discovery messages so the entities disappear from Home Assistant
+func (p *Publisher) removeDiscovery() {
+	p.mu.Lock()
+	devices := make([]string, 0, len(p.discovered))
+	for device := range p.discovered {
+		devices = append(devices, device)
+	}
+	p.mu.Unlock()
+
+	for _, device := range devices {
+		for _, c := range p.discoveryConfigs(device) {
+			if err := p.publish(c.topic, true, ""); err != nil {
+				slog.Error("Removing the Home Assistant discovery failed", "device", device, "error", err)
+			}
+		}
+	}
+}
+
+// HAID restricts s to the characters allowed in discovery node and object IDs
+func HAID(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
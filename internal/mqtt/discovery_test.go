@@ -0,0 +1,111 @@
+package mqtt
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/controller"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeClient records what the publisher publishes and subscribes to, the other methods of paho.Client
+// aren't used
+type fakeClient struct {
+	paho.Client
+
+	mu        sync.Mutex
+	published []string // Topics
+	handlers  map[string]paho.MessageHandler
+}
+
+func (c *fakeClient) Publish(topic string, _ byte, _ bool, _ interface{}) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published = append(c.published, topic)
+	return &paho.DummyToken{}
+}
+
+func (c *fakeClient) Subscribe(topic string, _ byte, handler paho.MessageHandler) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[topic] = handler
+	return &paho.DummyToken{}
+}
+
+// fakeMessage is a message received on a topic
+type fakeMessage struct {
+	paho.Message
+	topic   string
+	payload string
+}
+
+func (m fakeMessage) Topic() string   { return m.topic }
+func (m fakeMessage) Payload() []byte { return []byte(m.payload) }
+
+// switchCommand is a command passed to the switch handler
+type switchCommand struct {
+	device string
+	on     bool
+}
+
+func TestAnnouncePerDevice(t *testing.T) {
+	client := &fakeClient{handlers: map[string]paho.MessageHandler{}}
+	commands := make(chan switchCommand, 4)
+	p := &Publisher{
+		client:          client,
+		baseTopic:       "gome-assistant",
+		nodePrefix:      "gome_assistant_",
+		discoveryPrefix: "homeassistant",
+		discovered:      map[string]bool{},
+		onSwitch: func(device string, on bool) error {
+			commands <- switchCommand{device, on}
+			return nil
+		},
+	}
+	for _, device := range []string{"bambu-plug", "Voron Plug", "bambu-plug"} {
+		_ = p.Handle(controller.DecisionMade{Device: device, Outcome: controller.OutcomeStandby})
+		if err := p.Handle(controller.CycleCompleted{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, topic := range []string{"homeassistant/switch/gome_assistant_bambu_plug/relay/config", "homeassistant/switch/gome_assistant_voron_plug/relay/config"} {
+		if !slices.Contains(client.published, topic) {
+			t.Errorf("discovery %s not published, got %v", topic, client.published)
+		}
+	}
+	var configs int
+	for _, topic := range client.published {
+		if strings.HasSuffix(topic, "/config") {
+			configs++
+		}
+	}
+	if configs != 8 {
+		t.Errorf("%d discovery configs published, want 4 per device once", configs)
+	}
+	if len(client.handlers) != 2 || client.handlers["gome-assistant/bambu-plug/relay/set"] == nil || client.handlers["gome-assistant/voron_plug/relay/set"] == nil {
+		t.Fatalf("subscribed to %v, want the command topic of each device", client.handlers)
+	}
+
+	// A command reaches the handler with the name of its device
+	topic := "gome-assistant/voron_plug/relay/set"
+	client.handlers[topic](client, fakeMessage{topic: topic, payload: "off"})
+	select {
+	case cmd := <-commands:
+		if cmd != (switchCommand{"Voron Plug", false}) {
+			t.Errorf("command = %+v, want off for Voron Plug", cmd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the switch handler wasn't called")
+	}
+	client.handlers[topic](client, fakeMessage{topic: topic, payload: "toggle"})
+	select {
+	case cmd := <-commands:
+		t.Errorf("invalid payload passed on as %+v", cmd)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,268 @@
+// Package mqtt publishes state and actions to an MQTT broker, optionally with Home Assistant discovery
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttPublishTimeout bounds how long a single publish may wait for the broker
+const mqttPublishTimeout = 5 * time.Second
+
+// Availability payloads
+const (
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+)
+
+// SwitchHandler executes a switch command received over MQTT for the Shelly device name it was
+// subscribed to
+type SwitchHandler func(device string, on bool) error
+
+// Publisher mirrors state and decisions to an MQTT broker
+type Publisher struct {
+	client           paho.Client
+	baseTopic        string // With INSTANCE_NAME as the last level when set
+	nodePrefix       string // Of the Home Assistant node IDs
+	discoveryPrefix  string // Empty disables Home Assistant discovery
+	discoveryCleanup bool
+	onSwitch         SwitchHandler
+
+	mu         sync.Mutex
+	discovered map[string]bool // Devices announced on this connection, with their command topic subscribed
+
+	// Touched only by the bus subscriber goroutine
+	decision   *controller.DecisionMade
+	lastDevice string
+}
+
+// mqttAction is the payload of action topics
+type mqttAction struct {
+	Action    string    `json:"action"`
+	Source    string    `json:"source"`
+	Timestamp time.Time `json:"timestamp"`
+	Watts     float64   `json:"watts"`
+	DryRun    bool      `json:"dry_run,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Failures  int       `json:"failures,omitempty"`
+}
+
+// NewPublisher connects to the broker. The connection is retried in the background,
+// so an unreachable broker at startup doesn't prevent the assistant from running.
+// The switch command topic of each device is only subscribed to when onSwitch is set.
+func NewPublisher(cfg *config.Config, onSwitch SwitchHandler) (*Publisher, error) {
+	p := &Publisher{
+		baseTopic:  strings.TrimSuffix(cfg.MQTTBaseTopic, "/"),
+		onSwitch:   onSwitch,
+		nodePrefix: "gome_assistant_",
+		discovered: map[string]bool{},
+	}
+	// Instances of several sites on one broker keep their topics and entities apart
+	if cfg.Instance != "" {
+		p.baseTopic += "/" + cfg.Instance
+		p.nodePrefix += HAID(strings.ToLower(cfg.Instance)) + "_"
+	}
+	if cfg.HADiscovery {
+		p.discoveryPrefix = strings.TrimSuffix(cfg.HADiscoveryPrefix, "/")
+		p.discoveryCleanup = cfg.HADiscoveryCleanup
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(cfg.MQTTBroker).
+		SetClientID(cfg.MQTTClientID).
+		SetUsername(cfg.MQTTUser).
+		SetPassword(cfg.MQTTPassword).
+		SetConnectTimeout(10*time.Second).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5*time.Second).
+		SetMaxReconnectInterval(2*time.Minute).
+		SetWill(p.availabilityTopic(), mqttOffline, 1, true).
+		SetOnConnectHandler(func(c paho.Client) {
+			slog.Info("MQTT connected", "broker", cfg.MQTTBroker)
+			c.Publish(p.availabilityTopic(), 1, true, mqttOnline)
+			// The broker may have lost retained messages and subscriptions, announce the devices again
+			p.mu.Lock()
+			p.discovered = map[string]bool{}
+			p.mu.Unlock()
+		}).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			slog.Warn("MQTT connection lost, reconnecting", "error", err)
+		})
+
+	if cfg.MQTTTLSCAFile != "" || cfg.MQTTTLSInsecure {
+		tlsConfig := &tls.Config{InsecureSkipVerify: cfg.MQTTTLSInsecure}
+		if cfg.MQTTTLSCAFile != "" {
+			pem, err := os.ReadFile(cfg.MQTTTLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("MQTT_TLS_CA_FILE: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("MQTT_TLS_CA_FILE: no certificates found in %s", cfg.MQTTTLSCAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	p.client = paho.NewClient(opts)
+	// With connect retry enabled the token only completes once connected, don't wait for it
+	p.client.Connect()
+	return p, nil
+}
+
+// Handle is the event bus subscriber of the MQTT publisher
+func (p *Publisher) Handle(be controller.BusEvent) error {
+	switch e := be.(type) {
+	case controller.DecisionMade:
+		p.decision = &e
+		p.lastDevice = e.Device
+		return nil
+
+	case controller.CycleCompleted:
+		return p.publishState(e)
+
+	case controller.ActionExecuted:
+		payload := mqttAction{Action: e.Action, Source: e.Source, Timestamp: e.Time, Watts: e.Watts, DryRun: e.DryRun}
+		if e.DryRun {
+			// Keep simulated actions apart so automations don't react to them
+			return p.publishJSON(p.deviceTopic(e.Device, "events/dry_run_action"), false, payload)
+		}
+		if err := p.publish(p.deviceTopic(e.Device, "relay"), true, onOff(e.Action == controller.ActionOn)); err != nil {
+			return err
+		}
+		if err := p.publishJSON(p.deviceTopic(e.Device, "last_action"), true, payload); err != nil {
+			return err
+		}
+		return p.publishJSON(p.deviceTopic(e.Device, "events/action"), false, payload)
+
+	case controller.ActionFailed:
+		payload := mqttAction{Action: e.Action, Source: e.Source, Timestamp: e.Time, Watts: e.Watts, Error: e.Err.Error(), Failures: e.Failures}
+		return p.publishJSON(p.deviceTopic(e.Device, "events/failure"), false, payload)
+	}
+	return nil
+}
+
+// publishState publishes the retained state topics of the decision of the completed cycle
+func (p *Publisher) publishState(cycle controller.CycleCompleted) error {
+	d := p.decision
+	p.decision = nil
+	if d == nil {
+		if cycle.Err == nil {
+			return nil
+		}
+		// The cycle failed before deciding anything
+		return p.publish(p.deviceTopic(p.lastDevice, "state"), true, "ERROR")
+	}
+
+	if err := p.announce(d.Device); err != nil {
+		return err
+	}
+
+	values := []struct{ topic, payload string }{
+		{"state", d.Outcome},
+		{"watts", strconv.FormatFloat(d.Watts, 'f', 1, 64)},
+		{"standby_seconds", strconv.Itoa(int(d.StandbyDuration.Seconds()))},
+		{"relay", onOff(d.Watts > 0)},
+		{"pending_off", onOff(!d.ProjectedOffTime.IsZero())},
+	}
+	for _, v := range values {
+		if err := p.publish(p.deviceTopic(d.Device, v.topic), true, v.payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Publisher) publishJSON(topic string, retained bool, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.publish(topic, retained, string(payload))
+}
+
+func (p *Publisher) publish(topic string, retained bool, payload string) error {
+	token := p.client.Publish(topic, 1, retained, payload)
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		return fmt.Errorf("publishing %s timed out", topic)
+	}
+	return token.Error()
+}
+
+// handleSwitchCommand passes ON/OFF payloads of <base>/<device>/relay/set to the switch handler
+func (p *Publisher) handleSwitchCommand(device string, msg paho.Message) {
+	payload := strings.ToUpper(strings.TrimSpace(string(msg.Payload())))
+	if payload != "ON" && payload != "OFF" {
+		slog.Warn("Ignoring an MQTT switch command", "payload", payload, "topic", msg.Topic())
+		return
+	}
+
+	// Don't block the MQTT client while the command waits for a running check cycle
+	go func() {
+		if err := p.onSwitch(device, payload == "ON"); err != nil {
+			slog.Error("MQTT switch command failed", "payload", payload, "device", device, "error", err)
+		}
+	}()
+}
+
+// Close marks the assistant offline and disconnects from the broker
+func (p *Publisher) Close() {
+	if p.client.IsConnected() {
+		if p.discoveryCleanup {
+			p.removeDiscovery()
+		}
+		if err := p.publish(p.availabilityTopic(), true, mqttOffline); err != nil {
+			slog.Error("Publishing the MQTT availability failed", "error", err)
+		}
+	}
+	p.client.Disconnect(1000)
+}
+
+func (p *Publisher) availabilityTopic() string {
+	return p.topic("availability")
+}
+
+func (p *Publisher) topic(name string) string {
+	return p.baseTopic + "/" + name
+}
+
+func (p *Publisher) deviceTopic(device, name string) string {
+	return p.baseTopic + "/" + TopicSegment(device) + "/" + name
+}
+
+// TopicSegment turns a device name into a single topic level without wildcards
+func TopicSegment(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '+', '#', ' ':
+			return '_'
+		}
+		return r
+	}, strings.ToLower(s))
+}
+
+// onOff formats a boolean as the ON/OFF payload used by Home Assistant
+func onOff(b bool) string {
+	if b {
+		return "ON"
+	}
+	return "OFF"
+}
@@ -0,0 +1,121 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/outbound"
+)
+
+// gotifyNotifier sends events to a Gotify server
+type gotifyNotifier struct {
+	serverURL string
+	token     string
+	client    *http.Client
+}
+
+func newGotifyNotifier(cfg *config.Config) *gotifyNotifier {
+	return &gotifyNotifier{
+		serverURL: strings.TrimSuffix(cfg.GotifyURL, "/"),
+		token:     cfg.GotifyToken,
+		// A dedicated transport keeps the connection to the server alive between messages
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &outbound.Transport{Base: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				MaxIdleConns:    2,
+				IdleConnTimeout: 5 * time.Minute,
+			}},
+		},
+	}
+}
+
+func (g *gotifyNotifier) Name() string {
+	return "gotify"
+}
+
+// gotifyMessage is the JSON body of POST /message
+type gotifyMessage struct {
+	Title    string                 `json:"title"`
+	Message  string                 `json:"message"`
+	Priority int                    `json:"priority"`
+	Extras   map[string]interface{} `json:"extras,omitempty"`
+}
+
+// Notify posts the event as a markdown message
+func (g *gotifyNotifier) Notify(ev Event) error {
+	msg := gotifyMessage{
+		Title:    ev.Title,
+		Message:  eventMarkdown(ev),
+		Priority: gotifyPriority(ev.Severity),
+		Extras: map[string]interface{}{
+			"client::display": map[string]string{"contentType": "text/markdown"},
+		},
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", g.serverURL+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", g.token)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gotify message failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
+
+// gotifyPriority maps event severity to Gotify priorities (0..10)
+func gotifyPriority(s Severity) int {
+	switch s {
+	case SeverityLow:
+		return 1
+	case SeverityWarning:
+		return 7
+	case SeverityCritical:
+		return 10
+	default:
+		return 4
+	}
+}
+
+// eventMarkdown renders the event message followed by its decision context as a markdown table
+func eventMarkdown(ev Event) string {
+	var b strings.Builder
+	b.WriteString(ev.Message)
+	b.WriteString("\n\n| | |\n|---|---|\n")
+	if ev.Device != "" {
+		fmt.Fprintf(&b, "| Device | %s |\n", ev.Device)
+	}
+	fmt.Fprintf(&b, "| Event | %s |\n", ev.Type)
+	fmt.Fprintf(&b, "| Severity | %s |\n", ev.Severity)
+	if ev.Watts > 0 {
+		fmt.Fprintf(&b, "| Power | %.1f W |\n", ev.Watts)
+	}
+	if ev.StandbyDuration > 0 {
+		fmt.Fprintf(&b, "| Standby | %s |\n", ev.StandbyDuration.Round(time.Second))
+	}
+	fmt.Fprintf(&b, "| Time | %s |\n", ev.Time.Format("2006-01-02 15:04:05"))
+	return b.String()
+}
@@ -0,0 +1,130 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+func TestGotifyNotifySendsKeyAndJSON(t *testing.T) {
+	srv := newFakeServer(t, http.StatusOK, `{"id":1}`)
+	n := newGotifyNotifier(&config.Config{GotifyURL: srv.URL + "/", GotifyToken: "AppToken.1"})
+
+	ev := Event{
+		Type:            EventRelayOff,
+		Severity:        SeverityCritical,
+		Time:            time.Date(2026, 3, 1, 20, 15, 0, 0, time.UTC),
+		Device:          "bambu-plug",
+		Title:           "Printer powered off",
+		Message:         "Switched off",
+		Watts:           8.14,
+		StandbyDuration: 30*time.Minute + 400*time.Millisecond,
+	}
+	if err := n.Notify(ev); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	req := srv.only(t)
+	if req.Method != http.MethodPost || req.Path != "/message" {
+		t.Errorf("request = %s %s, want POST /message", req.Method, req.Path)
+	}
+	if got := req.Header.Get("X-Gotify-Key"); got != "AppToken.1" {
+		t.Errorf("X-Gotify-Key = %q", got)
+	}
+	if got := req.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	var msg struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+		Extras   map[string]map[string]string
+	}
+	if err := json.Unmarshal([]byte(req.Body), &msg); err != nil {
+		t.Fatalf("body %q: %v", req.Body, err)
+	}
+	if msg.Title != "Printer powered off" || msg.Priority != 10 {
+		t.Errorf("title, priority = %q, %d", msg.Title, msg.Priority)
+	}
+	if got := msg.Extras["client::display"]["contentType"]; got != "text/markdown" {
+		t.Errorf("contentType = %q", got)
+	}
+	for _, row := range []string{"Switched off\n\n", "| Device | bambu-plug |", "| Event | relay_off |", "| Severity | critical |", "| Power | 8.1 W |", "| Standby | 30m0s |", "| Time | 2026-03-01 20:15:00 |"} {
+		if !strings.Contains(msg.Message, row) {
+			t.Errorf("message %q lacks %q", msg.Message, row)
+		}
+	}
+}
+
+func TestGotifyPriorities(t *testing.T) {
+	for severity, want := range map[Severity]int{SeverityLow: 1, SeverityInfo: 4, SeverityWarning: 7, SeverityCritical: 10} {
+		if got := gotifyPriority(severity); got != want {
+			t.Errorf("gotifyPriority(%s) = %d, want %d", severity, got, want)
+		}
+	}
+}
+
+func TestGotifyNotifyReportsErrorStatus(t *testing.T) {
+	srv := newFakeServer(t, http.StatusUnauthorized, `{"error":"Unauthorized","errorCode":401}`)
+	n := newGotifyNotifier(&config.Config{GotifyURL: srv.URL, GotifyToken: "wrong"})
+
+	err := n.Notify(Event{Title: "t", Message: "m"})
+	if err == nil || !strings.Contains(err.Error(), "status 401") || !strings.Contains(err.Error(), "Unauthorized") {
+		t.Fatalf("error = %v", err)
+	}
+}
+
+func TestGotifyReusesTheConnection(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = io.WriteString(w, `{"id":1}`)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	n := newGotifyNotifier(&config.Config{GotifyURL: srv.URL, GotifyToken: "AppToken.1"})
+	for i := 0; i < 3; i++ {
+		if err := n.Notify(Event{Title: "t", Message: "m"}); err != nil {
+			t.Fatalf("message %d: %v", i+1, err)
+		}
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("opened %d connections for 3 messages, want 1", got)
+	}
+}
+
+func TestSendTestReachesEveryNotifier(t *testing.T) {
+	good := newFakeServer(t, http.StatusOK, `{"id":1}`)
+	bad := newFakeServer(t, http.StatusInternalServerError, "down")
+	notifiers := []filteredNotifier{
+		{Notifier: newGotifyNotifier(&config.Config{GotifyURL: good.URL, GotifyToken: "a"})},
+		{Notifier: newGotifyNotifier(&config.Config{GotifyURL: bad.URL, GotifyToken: "b"})},
+	}
+
+	err := SendTest(notifiers)
+	if err == nil || err.Error() != "1 of 2 test notifications failed" {
+		t.Fatalf("error = %v", err)
+	}
+	if !strings.Contains(good.only(t).Body, "gome-assistant test notification") {
+		t.Errorf("body = %q", good.only(t).Body)
+	}
+	bad.only(t)
+
+	if err := SendTest(nil); err == nil {
+		t.Error("SendTest without notifiers succeeded")
+	}
+}
@@ -0,0 +1,168 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// Matrix delivery limits
+const (
+	matrixAttempts      = 3
+	matrixMaxRetryAfter = 30 * time.Second
+)
+
+// matrixNotifier posts events to a Matrix room through the client-server API
+type matrixNotifier struct {
+	homeserver string
+	token      string
+	roomID     string
+	client     *http.Client
+
+	mu       sync.Mutex
+	txn      int
+	disabled bool // set once the homeserver rejected the access token
+}
+
+func newMatrixNotifier(cfg *config.Config) *matrixNotifier {
+	return &matrixNotifier{
+		homeserver: strings.TrimSuffix(cfg.MatrixHomeserver, "/"),
+		token:      cfg.MatrixAccessToken,
+		roomID:     cfg.MatrixRoomID,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (m *matrixNotifier) Name() string {
+	return "matrix"
+}
+
+// matrixMessage is the content of an m.room.message event
+type matrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format"`
+	FormattedBody string `json:"formatted_body"`
+}
+
+// matrixError is the standard error body of the client-server API
+type matrixError struct {
+	ErrCode      string `json:"errcode"`
+	Error        string `json:"error"`
+	RetryAfterMS int64  `json:"retry_after_ms"`
+}
+
+// Notify sends the event, waiting out rate limits a bounded number of times
+func (m *matrixNotifier) Notify(ev Event) error {
+	m.mu.Lock()
+	disabled := m.disabled
+	m.txn++
+	// The transaction ID makes retries of the same message idempotent
+	txnID := fmt.Sprintf("gome-%d-%d", time.Now().UnixNano(), m.txn)
+	m.mu.Unlock()
+	if disabled {
+		return fmt.Errorf("disabled after the homeserver rejected the access token")
+	}
+
+	msgtype := "m.text"
+	if ev.Severity <= SeverityLow {
+		msgtype = "m.notice"
+	}
+	body, err := json.Marshal(matrixMessage{
+		MsgType:       msgtype,
+		Body:          fmt.Sprintf("%s\n\n%s", ev.Title, eventPlainText(ev)),
+		Format:        "org.matrix.custom.html",
+		FormattedBody: eventHTML(ev),
+	})
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := m.send(txnID, body)
+		if err == nil || retryAfter == 0 || attempt == matrixAttempts {
+			return err
+		}
+		slog.Warn("Matrix rate limit hit", "retry_in", retryAfter)
+		time.Sleep(retryAfter)
+	}
+}
+
+// send puts the message once and returns how long to wait when rate limited
+func (m *matrixNotifier) send(txnID string, body []byte) (time.Duration, error) {
+	sendURL := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		m.homeserver, url.PathEscape(m.roomID), url.PathEscape(txnID))
+
+	req, err := http.NewRequest("PUT", sendURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.token)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusOK {
+		return 0, nil
+	}
+
+	var merr matrixError
+	_ = json.Unmarshal(respBody, &merr)
+	switch merr.ErrCode {
+	case "M_LIMIT_EXCEEDED":
+		retryAfter := time.Duration(merr.RetryAfterMS) * time.Millisecond
+		if retryAfter <= 0 {
+			retryAfter = time.Second
+		}
+		return min(retryAfter, matrixMaxRetryAfter), fmt.Errorf("matrix rate limit exceeded")
+	case "M_UNKNOWN_TOKEN", "M_MISSING_TOKEN":
+		m.mu.Lock()
+		m.disabled = true
+		m.mu.Unlock()
+		slog.Error("Matrix homeserver rejected the access token, disabling Matrix notifications")
+		return 0, fmt.Errorf("matrix rejected the access token: %s", merr.ErrCode)
+	case "":
+		return 0, fmt.Errorf("matrix message failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return 0, fmt.Errorf("matrix message failed with status %d: %s: %s", resp.StatusCode, merr.ErrCode, merr.Error)
+}
+
+// eventHTML renders the event as HTML with its decision context
+func eventHTML(ev Event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<b>%s</b><br>%s", html.EscapeString(ev.Title), strings.ReplaceAll(html.EscapeString(ev.Message), "\n", "<br>"))
+	b.WriteString("<ul>")
+	if ev.Device != "" {
+		fmt.Fprintf(&b, "<li>Device: %s</li>", html.EscapeString(ev.Device))
+	}
+	fmt.Fprintf(&b, "<li>Event: %s (%s)</li>", ev.Type, ev.Severity)
+	if ev.Watts > 0 {
+		fmt.Fprintf(&b, "<li>Power: %.1f W</li>", ev.Watts)
+	}
+	if ev.StandbyDuration > 0 {
+		fmt.Fprintf(&b, "<li>Standby: %s</li>", ev.StandbyDuration.Round(time.Second))
+	}
+	if !ev.ProjectedOffTime.IsZero() {
+		fmt.Fprintf(&b, "<li>Auto-off at: %s</li>", ev.ProjectedOffTime.Format("15:04"))
+	}
+	fmt.Fprintf(&b, "<li>Time: %s</li>", ev.Time.Format("2006-01-02 15:04:05"))
+	b.WriteString("</ul>")
+	return b.String()
+}
@@ -0,0 +1,185 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// fakeResponse is a scripted answer of the fake homeserver
+type fakeResponse struct {
+	status int
+	body   string
+}
+
+// fakeHomeserver answers room message events with scripted responses, then with success
+type fakeHomeserver struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses []fakeResponse
+	requests  []recordedRequest
+}
+
+func newFakeHomeserver(t *testing.T, responses ...fakeResponse) *fakeHomeserver {
+	t.Helper()
+	f := &fakeHomeserver{responses: responses}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.requests = append(f.requests, recordedRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: string(body)})
+		resp := fakeResponse{http.StatusOK, `{"event_id":"$event"}`}
+		if len(f.responses) > 0 {
+			resp, f.responses = f.responses[0], f.responses[1:]
+		}
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.status)
+		_, _ = io.WriteString(w, resp.body)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeHomeserver) received() []recordedRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]recordedRequest(nil), f.requests...)
+}
+
+func newTestMatrix(hs *fakeHomeserver) *matrixNotifier {
+	return newMatrixNotifier(&config.Config{MatrixHomeserver: hs.URL + "/", MatrixAccessToken: "syt_token", MatrixRoomID: "!family:example.org"})
+}
+
+func TestMatrixSendsRoomMessage(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	ev := Event{
+		Type:     EventRelayOff,
+		Severity: SeverityInfo,
+		Time:     time.Date(2026, 3, 1, 20, 15, 0, 0, time.UTC),
+		Device:   "<plug>",
+		Title:    "Printer powered off",
+		Message:  "Standby for 30m\nbelow 10 W",
+		Watts:    8.14,
+	}
+	if err := newTestMatrix(hs).Notify(ev); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	requests := hs.received()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	req := requests[0]
+	if req.Method != http.MethodPut || !strings.HasPrefix(req.Path, "/_matrix/client/v3/rooms/!family:example.org/send/m.room.message/gome-") {
+		t.Errorf("request = %s %s", req.Method, req.Path)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer syt_token" {
+		t.Errorf("Authorization = %q", got)
+	}
+	var msg matrixMessage
+	if err := json.Unmarshal([]byte(req.Body), &msg); err != nil {
+		t.Fatalf("body %q: %v", req.Body, err)
+	}
+	if msg.MsgType != "m.text" || msg.Format != "org.matrix.custom.html" {
+		t.Errorf("msgtype, format = %q, %q", msg.MsgType, msg.Format)
+	}
+	if !strings.HasPrefix(msg.Body, "Printer powered off\n\n") {
+		t.Errorf("body = %q", msg.Body)
+	}
+	for _, want := range []string{"<b>Printer powered off</b><br>Standby for 30m<br>below 10 W", "<li>Device: &lt;plug&gt;</li>", "<li>Event: relay_off (info)</li>", "<li>Power: 8.1 W</li>", "<li>Time: 2026-03-01 20:15:00</li>"} {
+		if !strings.Contains(msg.FormattedBody, want) {
+			t.Errorf("formatted_body %q lacks %q", msg.FormattedBody, want)
+		}
+	}
+}
+
+func TestMatrixLowSeverityIsANotice(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	if err := newTestMatrix(hs).Notify(Event{Severity: SeverityLow, Title: "t"}); err != nil {
+		t.Fatal(err)
+	}
+	var msg matrixMessage
+	_ = json.Unmarshal([]byte(hs.received()[0].Body), &msg)
+	if msg.MsgType != "m.notice" {
+		t.Errorf("msgtype = %q, want m.notice", msg.MsgType)
+	}
+}
+
+func TestMatrixWaitsOutTheRateLimit(t *testing.T) {
+	limited := fakeResponse{http.StatusTooManyRequests, `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":20}`}
+	hs := newFakeHomeserver(t, limited)
+
+	start := time.Now()
+	if err := newTestMatrix(hs).Notify(Event{Title: "t"}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("retried after %s, want retry_after_ms", elapsed)
+	}
+	requests := hs.received()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(requests))
+	}
+	// The retry reuses the transaction ID so the homeserver can deduplicate it
+	if requests[0].Path != requests[1].Path {
+		t.Errorf("retry path %q differs from %q", requests[1].Path, requests[0].Path)
+	}
+
+	// A homeserver that keeps limiting makes the notifier give up after matrixAttempts
+	limited.body = `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":1}`
+	hs = newFakeHomeserver(t, limited, limited, limited)
+	err := newTestMatrix(hs).Notify(Event{Title: "t"})
+	if err == nil || !strings.Contains(err.Error(), "rate limit") {
+		t.Fatalf("error = %v, want the rate limit", err)
+	}
+	if got := len(hs.received()); got != matrixAttempts {
+		t.Errorf("sent %d attempts, want %d", got, matrixAttempts)
+	}
+}
+
+func TestMatrixRejectedTokenDisablesTheNotifier(t *testing.T) {
+	hs := newFakeHomeserver(t, fakeResponse{http.StatusUnauthorized, `{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid access token passed."}`})
+	m := newTestMatrix(hs)
+
+	err := m.Notify(Event{Title: "t"})
+	if err == nil || !strings.Contains(err.Error(), "rejected the access token: M_UNKNOWN_TOKEN") {
+		t.Fatalf("error = %v", err)
+	}
+	if strings.Contains(err.Error(), "syt_token") {
+		t.Errorf("error %q contains the token", err)
+	}
+	if err := m.Notify(Event{Title: "t"}); err == nil || !strings.Contains(err.Error(), "disabled") {
+		t.Fatalf("second message: error = %v, want disabled", err)
+	}
+	if got := len(hs.received()); got != 1 {
+		t.Errorf("sent %d requests, want none after the token was rejected", got-1)
+	}
+}
+
+func TestMatrixOtherErrors(t *testing.T) {
+	tests := []struct {
+		resp fakeResponse
+		want string
+	}{
+		{fakeResponse{http.StatusForbidden, `{"errcode":"M_FORBIDDEN","error":"User not in room"}`}, "status 403: M_FORBIDDEN: User not in room"},
+		{fakeResponse{http.StatusBadGateway, "Bad Gateway\n"}, "status 502: Bad Gateway"},
+	}
+	for _, tt := range tests {
+		hs := newFakeHomeserver(t, tt.resp)
+		err := newTestMatrix(hs).Notify(Event{Title: "t"})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("error = %v, want %q", err, tt.want)
+		}
+		if got := len(hs.received()); got != 1 {
+			t.Errorf("%d: sent %d requests, want no retry", tt.resp.status, got)
+		}
+	}
+}
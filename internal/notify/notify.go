@@ -0,0 +1,593 @@
+// Package notify sends notifications through the configured services and answers Telegram commands
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+// Severity describes how urgent a notification event is
+type Severity int
+
+const (
+	SeverityLow Severity = iota
+	SeverityInfo
+	SeverityWarning
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityLow:
+		return "low"
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityCritical:
+		return "critical"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// EventType identifies the kind of notification event
+type EventType string
+
+const (
+	EventRelayOff        EventType = "relay_off"
+	EventRelayOn         EventType = "relay_on"
+	EventPendingOff      EventType = "pending_off"
+	EventActuationFailed EventType = "actuation_failed"
+	EventActionVetoed    EventType = "action_vetoed"
+	EventSafetyLockout   EventType = "safety_lockout"
+	EventDailySummary    EventType = "daily_summary"
+	EventMonthlyReport   EventType = "monthly_report"
+	EventPrintFinished   EventType = "print_finished"
+	EventLeadership      EventType = "leadership"
+	EventMaintenanceHold EventType = "maintenance_hold"
+	EventOvertemperature EventType = "overtemperature"
+	EventCheckPanic      EventType = "check_panic"
+	EventQuietDigest     EventType = "quiet_hours_digest"
+)
+
+// allEventTypes lists every event type that can be selected for notification
+var allEventTypes = []EventType{
+	EventRelayOff,
+	EventRelayOn,
+	EventPendingOff,
+	EventActuationFailed,
+	EventActionVetoed,
+	EventSafetyLockout,
+	EventDailySummary,
+	EventMonthlyReport,
+	EventPrintFinished,
+	EventLeadership,
+	EventMaintenanceHold,
+	EventOvertemperature,
+	EventCheckPanic,
+	EventQuietDigest,
+}
+
+// Event is a notification-worthy occurrence
+type Event struct {
+	Type             EventType
+	Severity         Severity
+	Time             time.Time
+	Device           string
+	Instance         string // INSTANCE_NAME or the hostname
+	Title            string
+	Message          string
+	Reason           string
+	Watts            float64
+	StandbyDuration  time.Duration
+	ProjectedOffTime time.Time // Zero unless an auto-off is projected
+}
+
+// Notifier delivers events to a notification channel
+type Notifier interface {
+	Name() string
+	Notify(ev Event) error
+}
+
+// EventFilter is the set of event types a notifier is subscribed to
+type EventFilter map[EventType]bool
+
+// parseEventFilter parses a comma-separated list of event types ("all" selects every type)
+func parseEventFilter(s string) (EventFilter, error) {
+	filter := EventFilter{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			for _, t := range allEventTypes {
+				filter[t] = true
+			}
+			continue
+		}
+		known := false
+		for _, t := range allEventTypes {
+			if string(t) == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event type %q", name)
+		}
+		filter[EventType(name)] = true
+	}
+	return filter, nil
+}
+
+// errNotifyRepeated is returned by notifiers for failures of a streak that was already reported
+var errNotifyRepeated = errors.New("notification failed again")
+
+// filteredNotifier only forwards events selected by its filter
+type filteredNotifier struct {
+	Notifier
+	events EventFilter
+}
+
+// BuildNotifiers creates all notifiers enabled in the configuration
+func BuildNotifiers(cfg *config.Config) ([]filteredNotifier, error) {
+	var notifiers []filteredNotifier
+
+	if cfg.NtfyTopic != "" {
+		events, err := parseEventFilter(cfg.NtfyEvents)
+		if err != nil {
+			return nil, fmt.Errorf("NTFY_EVENTS: %w", err)
+		}
+		notifiers = append(notifiers, filteredNotifier{Notifier: newNtfyNotifier(cfg), events: events})
+	}
+
+	if cfg.TelegramBotToken != "" {
+		if cfg.TelegramChatID == "" {
+			return nil, fmt.Errorf("TELEGRAM_CHAT_ID is required when TELEGRAM_BOT_TOKEN is set")
+		}
+		events, err := parseEventFilter(cfg.TelegramEvents)
+		if err != nil {
+			return nil, fmt.Errorf("TELEGRAM_EVENTS: %w", err)
+		}
+		notifiers = append(notifiers, filteredNotifier{Notifier: newTelegramNotifier(cfg), events: events})
+	}
+
+	if cfg.PushoverToken != "" {
+		if cfg.PushoverUser == "" {
+			return nil, fmt.Errorf("PUSHOVER_USER is required when PUSHOVER_TOKEN is set")
+		}
+		events, err := parseEventFilter(cfg.PushoverEvents)
+		if err != nil {
+			return nil, fmt.Errorf("PUSHOVER_EVENTS: %w", err)
+		}
+		notifiers = append(notifiers, filteredNotifier{Notifier: newPushoverNotifier(cfg), events: events})
+	}
+
+	if cfg.GotifyToken != "" {
+		if cfg.GotifyURL == "" {
+			return nil, fmt.Errorf("GOTIFY_URL is required when GOTIFY_TOKEN is set")
+		}
+		events, err := parseEventFilter(cfg.GotifyEvents)
+		if err != nil {
+			return nil, fmt.Errorf("GOTIFY_EVENTS: %w", err)
+		}
+		notifiers = append(notifiers, filteredNotifier{Notifier: newGotifyNotifier(cfg), events: events})
+	}
+
+	if cfg.SMTPHost != "" {
+		switch cfg.SMTPSecurity {
+		case config.SMTPStartTLS, config.SMTPTLS, config.SMTPPlain:
+		default:
+			return nil, fmt.Errorf("invalid SMTP_SECURITY %q (expected starttls, tls or none)", cfg.SMTPSecurity)
+		}
+		if cfg.SMTPFrom == "" || cfg.SMTPTo == "" {
+			return nil, fmt.Errorf("SMTP_FROM and SMTP_TO are required when SMTP_HOST is set")
+		}
+		events, err := parseEventFilter(cfg.SMTPEvents)
+		if err != nil {
+			return nil, fmt.Errorf("SMTP_EVENTS: %w", err)
+		}
+		notifiers = append(notifiers, filteredNotifier{Notifier: newSMTPNotifier(cfg), events: events})
+	}
+
+	if cfg.MatrixAccessToken != "" {
+		if cfg.MatrixHomeserver == "" || cfg.MatrixRoomID == "" {
+			return nil, fmt.Errorf("MATRIX_HOMESERVER and MATRIX_ROOM_ID are required when MATRIX_ACCESS_TOKEN is set")
+		}
+		events, err := parseEventFilter(cfg.MatrixEvents)
+		if err != nil {
+			return nil, fmt.Errorf("MATRIX_EVENTS: %w", err)
+		}
+		notifiers = append(notifiers, filteredNotifier{Notifier: newMatrixNotifier(cfg), events: events})
+	}
+
+	if cfg.SignalAPIURL != "" {
+		if cfg.SignalNumber == "" || strings.TrimSpace(cfg.SignalRecipients) == "" {
+			return nil, fmt.Errorf("SIGNAL_NUMBER and SIGNAL_RECIPIENTS are required when SIGNAL_API_URL is set")
+		}
+		events, err := parseEventFilter(cfg.SignalEvents)
+		if err != nil {
+			return nil, fmt.Errorf("SIGNAL_EVENTS: %w", err)
+		}
+		notifiers = append(notifiers, filteredNotifier{Notifier: newSignalNotifier(cfg), events: events})
+	}
+
+	targets, err := parseWebhookTargets(cfg.WebhookURLs)
+	if err != nil {
+		return nil, fmt.Errorf("WEBHOOK_URLS: %w", err)
+	}
+	for _, target := range targets {
+		events, err := parseEventFilter(target.Events)
+		if err != nil {
+			return nil, fmt.Errorf("WEBHOOK_URLS %s: %w", target.URL, err)
+		}
+		notifiers = append(notifiers, filteredNotifier{Notifier: newWebhookNotifier(cfg, target.URL), events: events})
+	}
+
+	return notifiers, nil
+}
+
+// Sink turns bus events into notification events and delivers them
+type Sink struct {
+	notifiers        []filteredNotifier
+	policy           *Policy
+	templates        Templates
+	failureThreshold int
+	instance         string
+	prefix           string // Prepended to messages when INSTANCE_NAME is set
+}
+
+func NewSink(cfg *config.Config, notifiers []filteredNotifier, policy *Policy, templates Templates) *Sink {
+	s := &Sink{
+		notifiers:        notifiers,
+		policy:           policy,
+		templates:        templates,
+		failureThreshold: cfg.FailureNotifyThreshold,
+		instance:         cfg.InstanceName(),
+	}
+	if cfg.Instance != "" {
+		s.prefix = "[" + cfg.Instance + "] "
+	}
+	return s
+}
+
+// Handle is the event bus subscriber of the notifiers
+func (s *Sink) Handle(be controller.BusEvent) error {
+	if _, ok := be.(controller.CycleCompleted); ok {
+		s.flush()
+		return nil
+	}
+	if ev, ok := s.translate(be); ok {
+		s.notify(ev)
+	}
+	return nil
+}
+
+// translate maps a bus event to the notification event it should produce, if any
+func (s *Sink) translate(be controller.BusEvent) (Event, bool) {
+	switch e := be.(type) {
+	case controller.PowerOnDetected:
+		return Event{
+			Type:     EventRelayOn,
+			Severity: SeverityInfo,
+			Time:     e.Time,
+			Device:   e.Device,
+			Title:    "Printer powered on",
+			Message:  fmt.Sprintf("Printer is drawing %.1f W again", e.Watts),
+			Reason:   "power draw detected after 0 W",
+			Watts:    e.Watts,
+		}, true
+
+	case controller.LockoutEngaged:
+		message := "No recent Shelly metrics found, relay control is paused until metrics are fresh again"
+		if e.Reason == controller.LockoutPrinterAuth {
+			message = "The printer state source rejects its credentials, relay control is paused until they are replaced"
+		}
+		return Event{
+			Type:     EventSafetyLockout,
+			Severity: SeverityWarning,
+			Time:     e.Time,
+			Device:   e.Device,
+			Title:    "Relay control locked out",
+			Message:  message,
+			Reason:   e.Reason,
+			Watts:    e.Watts,
+		}, true
+
+	case controller.MaintenanceHoldLong:
+		return Event{
+			Type:     EventMaintenanceHold,
+			Severity: SeverityWarning,
+			Time:     e.Time,
+			Device:   e.Device,
+			Title:    "Update or processing takes long",
+			Message:  fmt.Sprintf("%s has reported an update or processing since %s, the auto-off is held", e.Metric, e.Since.Format("15:04")),
+			Reason:   "maintenance state",
+		}, true
+
+	case controller.OvertemperatureDetected:
+		ev := Event{
+			Type:     EventOvertemperature,
+			Severity: SeverityWarning,
+			Time:     e.Time,
+			Device:   e.Device,
+			Title:    "Shelly plug running hot",
+			Message:  fmt.Sprintf("The Shelly plug is at %.0f°C, above the warning threshold of %.0f°C", e.Celsius, e.Threshold),
+			Reason:   "overtemperature",
+		}
+		if e.Critical {
+			ev.Severity = SeverityCritical
+			ev.Title = "Shelly plug overheating, cutting power"
+			ev.Message = fmt.Sprintf("The Shelly plug is at %.0f°C, above the critical threshold of %.0f°C. The printer is switched off even if it is printing.", e.Celsius, e.Threshold)
+		}
+		return ev, true
+
+	case controller.CyclePanicked:
+		return Event{
+			Type:     EventCheckPanic,
+			Severity: SeverityCritical,
+			Time:     e.Time,
+			Device:   e.Device,
+			Title:    "Check panicked",
+			Message:  fmt.Sprintf("A check panicked and was skipped, the controller keeps running: %s. The stack is in the log and the audit log.", e.Value),
+			Reason:   e.Value,
+		}, true
+
+	case controller.LeadershipChanged:
+		ev := Event{
+			Type:     EventLeadership,
+			Severity: SeverityInfo,
+			Time:     e.Time,
+			Title:    "Leadership acquired",
+			Message:  fmt.Sprintf("%s is now the leader and controls the relay", e.Identity),
+			Reason:   "leader election",
+		}
+		if !e.Leader {
+			ev.Severity = SeverityWarning
+			ev.Title = "Leadership lost"
+			ev.Message = fmt.Sprintf("%s lost the leadership and only observes", e.Identity)
+		}
+		return ev, true
+
+	case controller.DecisionMade:
+		if !e.Announce {
+			return Event{}, false
+		}
+		ev := Event{
+			Type:             EventPendingOff,
+			Severity:         SeverityInfo,
+			Time:             e.Time,
+			Device:           e.Device,
+			Title:            "Printer auto-off pending",
+			Watts:            e.Watts,
+			StandbyDuration:  e.StandbyDuration,
+			ProjectedOffTime: e.ProjectedOffTime,
+		}
+		remaining := e.ProjectedOffTime.Sub(e.Time)
+		switch e.Outcome {
+		case controller.OutcomePendingOff:
+			ev.Message = fmt.Sprintf("Printer will be switched off in %s unless the auto-off is cancelled", remaining.Round(time.Second))
+			ev.Reason = fmt.Sprintf("standby for %s", e.StandbyDuration.Round(time.Second))
+		case controller.OutcomeArmed:
+			ev.Severity = SeverityWarning
+			ev.Message = fmt.Sprintf("Printer standby confirmed at %.1f W, re-verifying before switching off in %s", e.Watts, remaining.Round(time.Second))
+			ev.Reason = "auto-off armed"
+		case controller.OutcomeStandby:
+			ev.Message = fmt.Sprintf("Printer is in standby at %.1f W and will be switched off in %.0f minutes", e.Watts, remaining.Minutes())
+			ev.Reason = "standby power detected"
+		default:
+			return Event{}, false
+		}
+		return ev, true
+
+	case controller.ActionExecuted:
+		ev := Event{
+			Type:            EventRelayOff,
+			Severity:        SeverityInfo,
+			Time:            e.Time,
+			Device:          e.Device,
+			Title:           "Printer powered off",
+			Watts:           e.Watts,
+			StandbyDuration: e.StandbyDuration,
+		}
+		if e.Action == controller.ActionOn {
+			ev.Type = EventRelayOn
+			ev.Title = "Printer powered on"
+		}
+		switch e.Source {
+		case controller.SourceAuto:
+			ev.Message = fmt.Sprintf("Printer was in standby for %s at %.1f W and has been switched %s", e.StandbyDuration.Round(time.Second), e.Watts, e.Action)
+			ev.Reason = fmt.Sprintf("standby for %s", e.StandbyDuration.Round(time.Second))
+		case controller.SourceOvertemp:
+			ev.Message = "Printer was switched off because the Shelly plug is overheating"
+			ev.Reason = "overtemperature"
+		case controller.SourceQueue:
+			ev.Message = "Printer was switched on for a print job queued in Bambu Cloud"
+			ev.Reason = "queued print job"
+		default:
+			ev.Message = fmt.Sprintf("Printer was switched %s by %s", e.Action, e.Source)
+			ev.Reason = "manual command via " + e.Source
+		}
+		return ev, true
+
+	case controller.ActionFailed:
+		// Manual commands report failures to their caller
+		if (e.Source != controller.SourceAuto && e.Source != controller.SourceOvertemp) || s.failureThreshold <= 0 || e.Failures%s.failureThreshold != 0 {
+			return Event{}, false
+		}
+		return Event{
+			Type:            EventActuationFailed,
+			Severity:        SeverityWarning,
+			Time:            e.Time,
+			Device:          e.Device,
+			Title:           fmt.Sprintf("Turning %s the printer failed", e.Action),
+			Message:         fmt.Sprintf("Relay %s command failed %d times in a row: %v", e.Action, e.Failures, e.Err),
+			Reason:          e.Err.Error(),
+			Watts:           e.Watts,
+			StandbyDuration: e.StandbyDuration,
+		}, true
+
+	case controller.ActionVetoed:
+		reason := e.Reason
+		if reason == "" {
+			reason = "no reason given"
+		}
+		return Event{
+			Type:            EventActionVetoed,
+			Severity:        SeverityInfo,
+			Time:            e.Time,
+			Device:          e.Device,
+			Title:           "Printer auto-off vetoed",
+			Message:         fmt.Sprintf("Switching the printer %s was vetoed by the %s: %s", e.Action, e.Source, reason),
+			Reason:          reason,
+			Watts:           e.Watts,
+			StandbyDuration: e.StandbyDuration,
+		}, true
+
+	case controller.SummaryReady:
+		message := fmt.Sprintf("%d auto-offs, %d actuation failures, %d checks (%d with errors, %d with untrusted readings)",
+			e.Stats.RelayOffs, e.Stats.RelayFailures, e.Stats.Cycles, e.Stats.Errors, e.Stats.Untrusted)
+		if d := e.Stats.DryRun; d.WouldOffs+len(d.Disagreements) > 0 {
+			message += fmt.Sprintf("\nDry run: %d would-be auto-offs, %d executed by someone else, %d disagreements", d.WouldOffs, d.ExternalOffs, len(d.Disagreements))
+			for _, dis := range d.Disagreements {
+				message += fmt.Sprintf("\n- %s: %s", dis.Time.Format("15:04"), dis.Detail)
+			}
+		}
+		return Event{
+			Type:     EventDailySummary,
+			Severity: SeverityLow,
+			Time:     e.Time,
+			Device:   e.Device,
+			Title:    fmt.Sprintf("Daily summary for %s", e.Stats.Date),
+			Message:  message,
+		}, true
+
+	case controller.PrintFinished:
+		name := "The print"
+		if e.Printer != "" {
+			name = "The print on " + e.Printer
+		}
+		return Event{
+			Type:             EventPrintFinished,
+			Severity:         SeverityInfo,
+			Time:             e.Time,
+			Device:           e.Device,
+			Title:            "Print finished",
+			Message:          fmt.Sprintf("%s finished. The printer will be switched off at %s (in %s) if it stays in standby.", name, e.ProjectedOffTime.Format("15:04"), e.ProjectedOffTime.Sub(e.Time).Round(time.Minute)),
+			Reason:           "print finished",
+			ProjectedOffTime: e.ProjectedOffTime,
+		}, true
+
+	case controller.MonthlyReportReady:
+		rep := e.Report
+		title := "Monthly report for " + rep.Month
+		if rep.Partial {
+			title += " (partially recorded)"
+		}
+		return Event{
+			Type:     EventMonthlyReport,
+			Severity: SeverityLow,
+			Time:     e.Time,
+			Title:    title,
+			Message:  fmt.Sprintf("%s\nPrevious month: %s", reportLine(rep), reportLine(*rep.Previous)),
+		}, true
+	}
+	return Event{}, false
+}
+
+// reportLine sums up a monthly report in one line
+func reportLine(r controller.MonthlyReport) string {
+	line := fmt.Sprintf("%d auto-offs saved %.2f kWh", r.AutoOffs, r.KWhSaved)
+	if r.Currency != "" {
+		line += fmt.Sprintf(" (%.2f %s)", r.CostSaved, r.Currency)
+	}
+	if r.AutoOffs > 0 {
+		line += fmt.Sprintf(", %s in standby before each on average", (time.Duration(r.AvgIdleSeconds) * time.Second).Round(time.Minute))
+	}
+	if r.Partial {
+		line += ", partially recorded"
+	}
+	return line
+}
+
+// notify sends the event to every notifier subscribed to its type.
+// Delivery failures are logged and never affect control decisions.
+func (s *Sink) notify(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	ev.Instance = s.instance
+	ev.Message = s.templates.Render(ev)
+
+	if s.policy != nil {
+		// Quiet hours may have ended within the cycle, the held events go out before this one
+		s.flush()
+		var ok bool
+		if ev, ok = s.policy.Filter(ev); !ok {
+			return
+		}
+	}
+	s.deliver(ev)
+}
+
+// flush delivers the digest of events held back during quiet hours once they are over
+func (s *Sink) flush() {
+	if s.policy == nil {
+		return
+	}
+	if digest, ok := s.policy.Flush(); ok {
+		s.deliver(digest)
+	}
+}
+
+// deliver fans the event out to the subscribed notifiers
+func (s *Sink) deliver(ev Event) {
+	ev.Instance = s.instance
+	ev.Message = s.prefix + ev.Message
+	for _, n := range s.notifiers {
+		if !n.events[ev.Type] {
+			continue
+		}
+		if err := n.Notify(ev); err != nil && !errors.Is(err, errNotifyRepeated) {
+			slog.Error("Sending a notification failed", "event", ev.Type, "notifier", n.Name(), "error", err)
+		}
+	}
+}
+
+// SendTest sends a test message through every configured notifier
+func SendTest(notifiers []filteredNotifier) error {
+	if len(notifiers) == 0 {
+		return fmt.Errorf("no notifiers configured")
+	}
+
+	ev := Event{
+		Type:     "test",
+		Severity: SeverityInfo,
+		Time:     time.Now(),
+		Title:    "gome-assistant test notification",
+		Message:  "If you can read this, notifications are set up correctly.",
+	}
+
+	failed := 0
+	for _, n := range notifiers {
+		if err := n.Notify(ev); err != nil {
+			slog.Error("Test notification failed", "notifier", n.Name(), "error", err)
+			failed++
+			continue
+		}
+		slog.Info("Test notification sent", "notifier", n.Name())
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d test notifications failed", failed, len(notifiers))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// ntfyNotifier publishes events to an ntfy topic
+type ntfyNotifier struct {
+	serverURL string
+	topic     string
+	token     string
+	client    *http.Client
+}
+
+func newNtfyNotifier(cfg *config.Config) *ntfyNotifier {
+	return &ntfyNotifier{
+		serverURL: strings.TrimSuffix(cfg.NtfyURL, "/"),
+		topic:     cfg.NtfyTopic,
+		token:     cfg.NtfyToken,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (n *ntfyNotifier) Name() string {
+	return "ntfy"
+}
+
+// Notify publishes the event using ntfy's header based API
+func (n *ntfyNotifier) Notify(ev Event) error {
+	publishURL := fmt.Sprintf("%s/%s", n.serverURL, n.topic)
+
+	req, err := http.NewRequest("POST", publishURL, strings.NewReader(ev.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", ev.Title)
+	req.Header.Set("Priority", strconv.Itoa(ntfyPriority(ev.Severity)))
+	req.Header.Set("Tags", strings.Join(ntfyTags(ev), ","))
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("ntfy publish failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// ntfyPriority maps event severity to ntfy priorities (1=min .. 5=urgent)
+func ntfyPriority(s Severity) int {
+	switch s {
+	case SeverityLow:
+		return 2
+	case SeverityWarning:
+		return 4
+	case SeverityCritical:
+		return 5
+	default:
+		return 3
+	}
+}
+
+// ntfyTags returns the emoji tag for the severity followed by the event type
+func ntfyTags(ev Event) []string {
+	var emoji string
+	switch ev.Severity {
+	case SeverityLow:
+		emoji = "bar_chart"
+	case SeverityWarning:
+		emoji = "warning"
+	case SeverityCritical:
+		emoji = "rotating_light"
+	default:
+		emoji = "electric_plug"
+	}
+	return []string{emoji, string(ev.Type)}
+}
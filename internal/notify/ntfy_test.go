@@ -0,0 +1,162 @@
+package notify
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+// recordedRequest is a request received by a fakeServer
+type recordedRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   string
+}
+
+// fakeServer records the requests of a notifier and answers them with a fixed status and body
+type fakeServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	response string
+	requests []recordedRequest
+}
+
+func newFakeServer(t *testing.T, status int, response string) *fakeServer {
+	t.Helper()
+	f := &fakeServer{status: status, response: response}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.requests = append(f.requests, recordedRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Header: r.Header.Clone(), Body: string(body)})
+		status, response := f.status, f.response
+		f.mu.Unlock()
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, response)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// respond changes the answer of later requests
+func (f *fakeServer) respond(status int, response string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status, f.response = status, response
+}
+
+func (f *fakeServer) received() []recordedRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]recordedRequest(nil), f.requests...)
+}
+
+// only returns the single request received so far
+func (f *fakeServer) only(t *testing.T) recordedRequest {
+	t.Helper()
+	requests := f.received()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	return requests[0]
+}
+
+func TestNtfyNotifySendsHeadersAndBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		severity Severity
+		priority string
+		tags     string
+		auth     string
+	}{
+		{name: "info without token", severity: SeverityInfo, priority: "3", tags: "electric_plug,relay_off"},
+		{name: "low", severity: SeverityLow, priority: "2", tags: "bar_chart,relay_off"},
+		{name: "warning", severity: SeverityWarning, priority: "4", tags: "warning,relay_off"},
+		{name: "critical with token", token: "tk_secret", severity: SeverityCritical, priority: "5", tags: "rotating_light,relay_off", auth: "Bearer tk_secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeServer(t, http.StatusOK, "{}")
+			n := newNtfyNotifier(&config.Config{NtfyURL: srv.URL + "/", NtfyTopic: "printer", NtfyToken: tt.token})
+
+			err := n.Notify(Event{Type: EventRelayOff, Severity: tt.severity, Title: "Printer powered off", Message: "Switched off after 30m"})
+			if err != nil {
+				t.Fatalf("Notify: %v", err)
+			}
+			req := srv.only(t)
+			if req.Method != http.MethodPost || req.Path != "/printer" {
+				t.Errorf("request = %s %s, want POST /printer", req.Method, req.Path)
+			}
+			if req.Body != "Switched off after 30m" {
+				t.Errorf("body = %q", req.Body)
+			}
+			for header, want := range map[string]string{"Title": "Printer powered off", "Priority": tt.priority, "Tags": tt.tags, "Authorization": tt.auth} {
+				if got := req.Header.Get(header); got != want {
+					t.Errorf("%s = %q, want %q", header, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNtfyNotifyReportsErrorStatus(t *testing.T) {
+	srv := newFakeServer(t, http.StatusForbidden, "{\"error\":\"forbidden\"}\n")
+	n := newNtfyNotifier(&config.Config{NtfyURL: srv.URL, NtfyTopic: "printer"})
+
+	err := n.Notify(Event{Type: EventRelayOff, Title: "t", Message: "m"})
+	if err == nil || !strings.Contains(err.Error(), `status 403: {"error":"forbidden"}`) {
+		t.Fatalf("error = %v, want the status and the trimmed body", err)
+	}
+}
+
+func TestSinkDeliversOnlySubscribedEvents(t *testing.T) {
+	srv := newFakeServer(t, http.StatusOK, "")
+	cfg := &config.Config{NtfyURL: srv.URL, NtfyTopic: "printer", NtfyEvents: "relay_off"}
+	notifiers, err := BuildNotifiers(cfg)
+	if err != nil {
+		t.Fatalf("BuildNotifiers: %v", err)
+	}
+	sink := NewSink(cfg, notifiers, nil, nil)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	_ = sink.Handle(controller.PowerOnDetected{Time: now, Device: "plug", Watts: 40})
+	_ = sink.Handle(controller.ActionExecuted{Time: now, Device: "plug", Action: controller.ActionOff, Source: controller.SourceAuto, Watts: 8, StandbyDuration: 30 * time.Minute})
+
+	req := srv.only(t)
+	if got := req.Header.Get("Title"); got != "Printer powered off" {
+		t.Errorf("Title = %q, want the relay_off event", got)
+	}
+	if !strings.Contains(req.Body, "standby for 30m0s at 8.0 W") {
+		t.Errorf("body = %q", req.Body)
+	}
+}
+
+func TestParseEventFilter(t *testing.T) {
+	filter, err := parseEventFilter("relay_off, actuation_failed,,")
+	if err != nil {
+		t.Fatalf("parseEventFilter: %v", err)
+	}
+	if len(filter) != 2 || !filter[EventRelayOff] || !filter[EventActuationFailed] {
+		t.Errorf("filter = %v", filter)
+	}
+
+	all, err := parseEventFilter("all")
+	if err != nil || len(all) != len(allEventTypes) {
+		t.Errorf("all = %v, %v, want every event type", all, err)
+	}
+
+	if _, err := parseEventFilter("relay_off,nope"); err == nil {
+		t.Error("unknown event type accepted")
+	}
+}
@@ -0,0 +1,239 @@
+package notify
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+// policyDigestLimit is the number of suppressed events listed in the quiet hours digest
+const policyDigestLimit = 10
+
+// Policy decides which events reach the notifiers: it enforces per-type minimum
+// intervals between identical events, coalesces repeats, caps the overall rate and
+// holds back non-critical events during notification quiet hours
+type Policy struct {
+	mu  sync.Mutex
+	now func() time.Time
+
+	intervals map[EventType]time.Duration
+	limiter   *rateLimiter
+	quiet     *quietHours
+
+	last          map[string]*policyEntry
+	lastBudget    int // Most entries kept in last, the oldest delivery is forgotten first
+	lastEvicted   int
+	quietHeld     []Event
+	quietHeldMore int
+}
+
+// policyEntry tracks the last delivery of one kind of event
+type policyEntry struct {
+	sent       time.Time
+	suppressed int
+}
+
+func NewPolicy(cfg *config.Config) (*Policy, error) {
+	intervals, err := parseEventDurations(cfg.NotifyMinIntervals)
+	if err != nil {
+		return nil, fmt.Errorf("NOTIFY_MIN_INTERVALS: %w", err)
+	}
+
+	var quiet *quietHours
+	if cfg.NotifyQuietHours != "" {
+		quiet, err = parseQuietHours(cfg.NotifyQuietHours)
+		if err != nil {
+			return nil, fmt.Errorf("NOTIFY_QUIET_HOURS: %w", err)
+		}
+	}
+
+	return &Policy{
+		now:        time.Now,
+		intervals:  intervals,
+		limiter:    newRateLimiter(cfg.NotifyMaxPerHour, time.Hour),
+		quiet:      quiet,
+		last:       map[string]*policyEntry{},
+		lastBudget: cfg.NotifyDedupSize,
+	}, nil
+}
+
+// Filter returns the event to deliver, possibly rewritten to mention coalesced repeats,
+// and whether it should be delivered at all
+func (p *Policy) Filter(ev Event) (Event, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	critical := ev.Severity >= SeverityCritical
+
+	if !critical && p.quiet != nil && p.quiet.Contains(now) {
+		if len(p.quietHeld) < policyDigestLimit {
+			p.quietHeld = append(p.quietHeld, ev)
+		} else {
+			p.quietHeldMore++
+		}
+		return ev, false
+	}
+
+	if interval := p.intervals[ev.Type]; interval > 0 {
+		key := string(ev.Type) + "|" + ev.Device + "|" + ev.Title
+		entry := p.last[key]
+		if entry != nil && now.Sub(entry.sent) < interval {
+			entry.suppressed++
+			return ev, false
+		}
+		if entry != nil && entry.suppressed > 0 {
+			ev = coalesced(ev, entry.suppressed+1)
+		}
+		if entry == nil && len(p.last) >= p.lastBudget {
+			p.evictOldest()
+		}
+		p.last[key] = &policyEntry{sent: now}
+	}
+
+	if !critical && !p.limiter.Allow(now) {
+		slog.Warn("Notification rate limit reached, dropping the event", "event", ev.Type)
+		return ev, false
+	}
+
+	return ev, true
+}
+
+// evictOldest forgets the event delivered longest ago. The caller holds p.mu.
+func (p *Policy) evictOldest() {
+	var oldest string
+	for key, entry := range p.last {
+		if oldest == "" || entry.sent.Before(p.last[oldest].sent) {
+			oldest = key
+		}
+	}
+	delete(p.last, oldest)
+	p.lastEvicted++
+}
+
+// Usage reports the events remembered for the minimum intervals against NOTIFY_DEDUP_SIZE
+func (p *Policy) Usage() controller.MemoryUsage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return controller.MemoryUsage{Store: "notify_dedup", Entries: len(p.last), Budget: p.lastBudget, Evicted: p.lastEvicted}
+}
+
+// Flush returns a digest of the events held back during quiet hours once they have ended
+func (p *Policy) Flush() (Event, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if len(p.quietHeld) == 0 || (p.quiet != nil && p.quiet.Contains(now)) {
+		return Event{}, false
+	}
+
+	var b strings.Builder
+	for _, ev := range p.quietHeld {
+		fmt.Fprintf(&b, "%s %s: %s\n", ev.Time.Format("15:04"), ev.Title, ev.Message)
+	}
+	if p.quietHeldMore > 0 {
+		fmt.Fprintf(&b, "... and %d more\n", p.quietHeldMore)
+	}
+
+	digest := Event{
+		Type:     EventQuietDigest,
+		Severity: SeverityLow,
+		Time:     now,
+		Title:    fmt.Sprintf("%d notifications during quiet hours", len(p.quietHeld)+p.quietHeldMore),
+		Message:  strings.TrimSuffix(b.String(), "\n"),
+	}
+	for _, ev := range p.quietHeld {
+		if ev.Severity > digest.Severity {
+			digest.Severity = ev.Severity
+		}
+	}
+	p.quietHeld = nil
+	p.quietHeldMore = 0
+	return digest, true
+}
+
+// coalesced rewrites an event to mention how often it occurred since the last delivery
+func coalesced(ev Event, count int) Event {
+	if ev.Severity >= SeverityWarning {
+		ev.Title = fmt.Sprintf("%s (still failing, x%d)", ev.Title, count)
+	} else {
+		ev.Title = fmt.Sprintf("%s (x%d)", ev.Title, count)
+	}
+	return ev
+}
+
+// parseEventDurations parses "event=duration,event=duration"
+func parseEventDurations(s string) (map[EventType]time.Duration, error) {
+	result := map[EventType]time.Duration{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected event=duration, got %q", item)
+		}
+		filter, err := parseEventFilter(name)
+		if err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration for %s: %w", name, err)
+		}
+		for t := range filter {
+			result[t] = d
+		}
+	}
+	return result, nil
+}
+
+// quietHours is a daily time window, which may span midnight
+type quietHours struct {
+	start, end int // minutes since midnight
+}
+
+// parseQuietHours parses "HH:MM-HH:MM"
+func parseQuietHours(s string) (*quietHours, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("expected HH:MM-HH:MM, got %q", s)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("start and end of %q are equal", s)
+	}
+	return &quietHours{start: start, end: end}, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether t falls into the window
+func (q *quietHours) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if q.start < q.end {
+		return m >= q.start && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
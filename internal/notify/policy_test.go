@@ -0,0 +1,267 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// fakeNow is a controllable clock for the policy
+type fakeNow struct{ t time.Time }
+
+func (f *fakeNow) now() time.Time          { return f.t }
+func (f *fakeNow) advance(d time.Duration) { f.t = f.t.Add(d) }
+
+// set moves the clock to the time of day
+func (f *fakeNow) set(hour, minute int) {
+	f.t = time.Date(f.t.Year(), f.t.Month(), f.t.Day(), hour, minute, 0, 0, time.UTC)
+}
+
+// nextDay moves the clock to the time of day of the next day
+func (f *fakeNow) nextDay(hour, minute int) {
+	f.t = f.t.AddDate(0, 0, 1)
+	f.set(hour, minute)
+}
+
+// newTestPolicy returns a policy of cfg reading the time from a fake clock at noon
+func newTestPolicy(t *testing.T, cfg *config.Config) (*Policy, *fakeNow) {
+	t.Helper()
+	if cfg.NotifyDedupSize == 0 {
+		cfg.NotifyDedupSize = 100
+	}
+	p, err := NewPolicy(cfg)
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+	clk := &fakeNow{t: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+	p.now = clk.now
+	return p, clk
+}
+
+func TestPolicyMinIntervalCoalescesRepeats(t *testing.T) {
+	p, clk := newTestPolicy(t, &config.Config{NotifyMinIntervals: "actuation_failed=10m,relay_off=1h"})
+	failed := Event{Type: EventActuationFailed, Severity: SeverityWarning, Device: "plug", Title: "Turning off the printer failed"}
+
+	if _, ok := p.Filter(failed); !ok {
+		t.Fatal("first event suppressed")
+	}
+	for i := 0; i < 2; i++ {
+		clk.advance(4 * time.Minute)
+		if _, ok := p.Filter(failed); ok {
+			t.Fatalf("repeat %d within the interval delivered", i+1)
+		}
+	}
+	// Another device is a different event
+	other := failed
+	other.Device = "plug-2"
+	if _, ok := p.Filter(other); !ok {
+		t.Fatal("event of another device suppressed")
+	}
+
+	clk.advance(2*time.Minute + time.Second)
+	ev, ok := p.Filter(failed)
+	if !ok {
+		t.Fatal("event after the interval suppressed")
+	}
+	if ev.Title != "Turning off the printer failed (still failing, x3)" {
+		t.Errorf("title = %q", ev.Title)
+	}
+
+	off := Event{Type: EventRelayOff, Severity: SeverityInfo, Title: "Printer powered off"}
+	p.Filter(off)
+	p.Filter(off)
+	clk.advance(time.Hour)
+	if ev, _ := p.Filter(off); ev.Title != "Printer powered off (x2)" {
+		t.Errorf("title = %q", ev.Title)
+	}
+
+	// Types without an interval are never deduplicated
+	on := Event{Type: EventRelayOn, Title: "Printer powered on"}
+	for i := 0; i < 3; i++ {
+		if ev, ok := p.Filter(on); !ok || ev.Title != on.Title {
+			t.Fatalf("event %d without interval = %q, %v", i+1, ev.Title, ok)
+		}
+	}
+}
+
+func TestPolicyRateLimitSparesCritical(t *testing.T) {
+	p, clk := newTestPolicy(t, &config.Config{NotifyMaxPerHour: 2})
+	info := Event{Type: EventRelayOff, Severity: SeverityInfo, Title: "off"}
+	critical := Event{Type: EventSafetyLockout, Severity: SeverityCritical, Title: "lockout"}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := p.Filter(info); !ok {
+			t.Fatalf("event %d within the limit dropped", i+1)
+		}
+	}
+	if _, ok := p.Filter(info); ok {
+		t.Fatal("event beyond the limit delivered")
+	}
+	if _, ok := p.Filter(critical); !ok {
+		t.Fatal("critical event dropped by the rate limit")
+	}
+	clk.advance(30 * time.Minute)
+	if _, ok := p.Filter(info); !ok {
+		t.Fatal("event after the refill dropped")
+	}
+}
+
+func TestPolicyQuietHoursAcrossMidnight(t *testing.T) {
+	p, clk := newTestPolicy(t, &config.Config{NotifyQuietHours: "22:00-07:00"})
+
+	clk.set(21, 59)
+	if _, ok := p.Filter(Event{Type: EventRelayOff, Title: "before"}); !ok {
+		t.Fatal("event before the quiet hours held")
+	}
+	if _, ok := p.Flush(); ok {
+		t.Fatal("digest without held events")
+	}
+
+	clk.set(22, 0)
+	if _, ok := p.Filter(Event{Type: EventRelayOff, Severity: SeverityInfo, Time: clk.t, Title: "Printer powered off", Message: "at 22:00"}); ok {
+		t.Fatal("event in the quiet hours delivered")
+	}
+	if _, ok := p.Filter(Event{Type: EventActuationFailed, Severity: SeverityCritical, Title: "Turning off the printer failed"}); !ok {
+		t.Fatal("critical event held in the quiet hours")
+	}
+	clk.nextDay(3, 30)
+	if _, ok := p.Filter(Event{Type: EventSafetyLockout, Severity: SeverityWarning, Time: clk.t, Title: "Relay control locked out", Message: "no metrics"}); ok {
+		t.Fatal("event after midnight delivered")
+	}
+	if _, ok := p.Flush(); ok {
+		t.Fatal("digest released while the quiet hours last")
+	}
+
+	clk.set(7, 0)
+	digest, ok := p.Flush()
+	if !ok {
+		t.Fatal("no digest after the quiet hours")
+	}
+	if digest.Type != EventQuietDigest || digest.Severity != SeverityWarning {
+		t.Errorf("digest type, severity = %s, %s", digest.Type, digest.Severity)
+	}
+	if digest.Title != "2 notifications during quiet hours" {
+		t.Errorf("title = %q", digest.Title)
+	}
+	want := "22:00 Printer powered off: at 22:00\n03:30 Relay control locked out: no metrics"
+	if digest.Message != want {
+		t.Errorf("message = %q, want %q", digest.Message, want)
+	}
+	if _, ok := p.Flush(); ok {
+		t.Fatal("digest sent twice")
+	}
+}
+
+func TestPolicyDigestIsCapped(t *testing.T) {
+	p, clk := newTestPolicy(t, &config.Config{NotifyQuietHours: "00:00-06:00"})
+	clk.set(1, 0)
+	for i := 0; i < policyDigestLimit+3; i++ {
+		p.Filter(Event{Type: EventRelayOff, Time: clk.t, Title: "off"})
+	}
+	clk.set(6, 0)
+	digest, ok := p.Flush()
+	if !ok {
+		t.Fatal("no digest")
+	}
+	if !strings.HasPrefix(digest.Title, "13 notifications") {
+		t.Errorf("title = %q", digest.Title)
+	}
+	if lines := strings.Split(digest.Message, "\n"); len(lines) != policyDigestLimit+1 || lines[len(lines)-1] != "... and 3 more" {
+		t.Errorf("message = %q", digest.Message)
+	}
+}
+
+func TestPolicyDedupBudgetEvictsOldest(t *testing.T) {
+	p, clk := newTestPolicy(t, &config.Config{NotifyMinIntervals: "relay_off=1h", NotifyDedupSize: 2})
+	for _, device := range []string{"a", "b", "c"} {
+		p.Filter(Event{Type: EventRelayOff, Device: device, Title: "off"})
+		clk.advance(time.Minute)
+	}
+	usage := p.Usage()
+	if usage.Entries != 2 || usage.Budget != 2 || usage.Evicted != 1 {
+		t.Fatalf("usage = %+v", usage)
+	}
+	// a was forgotten, so its repeat is delivered; c is still remembered
+	if _, ok := p.Filter(Event{Type: EventRelayOff, Device: "a", Title: "off"}); !ok {
+		t.Error("evicted event suppressed")
+	}
+	if _, ok := p.Filter(Event{Type: EventRelayOff, Device: "c", Title: "off"}); ok {
+		t.Error("remembered event delivered")
+	}
+}
+
+// TestPolicyDedupBudgetOverManyCycles sends the events of thousands of cycles of many devices, with
+// titles that vary like the messages of failures do
+func TestPolicyDedupBudgetOverManyCycles(t *testing.T) {
+	const devices, cycles, budget = 40, 2000, 64
+	p, clk := newTestPolicy(t, &config.Config{NotifyMinIntervals: "relay_off=1h,actuation_failed=10m", NotifyDedupSize: budget})
+	for cycle := range cycles {
+		for i := range devices {
+			device := fmt.Sprintf("plug-%d", i)
+			p.Filter(Event{Type: EventRelayOff, Severity: SeverityCritical, Device: device, Title: "off"})
+			if (cycle+i)%7 == 0 {
+				p.Filter(Event{Type: EventActuationFailed, Severity: SeverityCritical, Device: device, Title: fmt.Sprintf("attempt %d failed", cycle%50)})
+			}
+		}
+		if u := p.Usage(); u.Entries > budget {
+			t.Fatalf("cycle %d: %d events remembered, over the budget of %d", cycle, u.Entries, budget)
+		}
+		clk.advance(time.Minute)
+	}
+	u := p.Usage()
+	if u.Entries != budget || u.Evicted == 0 {
+		t.Errorf("usage = %+v after %d cycles, want a full budget with evictions", u, cycles)
+	}
+	// The latest delivery is remembered whatever was evicted before it
+	latest := Event{Type: EventRelayOff, Severity: SeverityCritical, Device: "plug-new", Title: "off"}
+	if _, ok := p.Filter(latest); !ok {
+		t.Fatal("new event suppressed")
+	}
+	if _, ok := p.Filter(latest); ok {
+		t.Error("repeat of the latest event delivered")
+	}
+}
+
+func TestPolicyConfigErrors(t *testing.T) {
+	for _, cfg := range []config.Config{
+		{NotifyMinIntervals: "relay_off"},
+		{NotifyMinIntervals: "relay_off=soon"},
+		{NotifyMinIntervals: "nope=1m"},
+		{NotifyQuietHours: "22:00"},
+		{NotifyQuietHours: "22:00-25:00"},
+		{NotifyQuietHours: "07:00-07:00"},
+	} {
+		if _, err := NewPolicy(&cfg); err == nil {
+			t.Errorf("NOTIFY_MIN_INTERVALS=%q NOTIFY_QUIET_HOURS=%q accepted", cfg.NotifyMinIntervals, cfg.NotifyQuietHours)
+		}
+	}
+}
+
+func TestQuietHoursContains(t *testing.T) {
+	day, _ := parseQuietHours("09:30-17:00")
+	night, _ := parseQuietHours("22:00-07:00")
+	at := func(h, m int) time.Time { return time.Date(2026, 1, 1, h, m, 0, 0, time.UTC) }
+	tests := []struct {
+		q    *quietHours
+		t    time.Time
+		want bool
+	}{
+		{day, at(9, 29), false},
+		{day, at(9, 30), true},
+		{day, at(16, 59), true},
+		{day, at(17, 0), false},
+		{night, at(21, 59), false},
+		{night, at(22, 0), true},
+		{night, at(0, 0), true},
+		{night, at(6, 59), true},
+		{night, at(7, 0), false},
+	}
+	for _, tt := range tests {
+		if got := tt.q.Contains(tt.t); got != tt.want {
+			t.Errorf("%+v.Contains(%s) = %v, want %v", *tt.q, tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+}
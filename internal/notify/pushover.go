@@ -0,0 +1,158 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// Pushover API limits
+const (
+	pushoverMaxTitle   = 250
+	pushoverMaxMessage = 1024
+	pushoverAttempts   = 3
+)
+
+// pushoverNotifier sends events through the Pushover messages API
+type pushoverNotifier struct {
+	apiURL string
+	token  string
+	user   string
+	retry  time.Duration
+	expire time.Duration
+	client *http.Client
+
+	mu       sync.Mutex
+	disabled bool // set once Pushover rejected the credentials
+}
+
+func newPushoverNotifier(cfg *config.Config) *pushoverNotifier {
+	return &pushoverNotifier{
+		apiURL: strings.TrimSuffix(cfg.PushoverAPIURL, "/"),
+		token:  cfg.PushoverToken,
+		user:   cfg.PushoverUser,
+		retry:  cfg.PushoverRetry,
+		expire: cfg.PushoverExpire,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *pushoverNotifier) Name() string {
+	return "pushover"
+}
+
+// pushoverResponse is the JSON body returned by the messages API
+type pushoverResponse struct {
+	Status  int      `json:"status"`
+	Request string   `json:"request"`
+	Errors  []string `json:"errors"`
+	Token   string   `json:"token"`
+	User    string   `json:"user"`
+}
+
+// Notify sends the event, retrying transient failures a bounded number of times
+func (p *pushoverNotifier) Notify(ev Event) error {
+	p.mu.Lock()
+	disabled := p.disabled
+	p.mu.Unlock()
+	if disabled {
+		return fmt.Errorf("disabled after Pushover rejected the credentials")
+	}
+
+	title := ev.Title
+	if ev.Device != "" {
+		title = fmt.Sprintf("%s: %s", ev.Device, ev.Title)
+	}
+
+	priority := pushoverPriority(ev.Severity)
+	form := url.Values{
+		"token":     {p.token},
+		"user":      {p.user},
+		"title":     {truncate(title, pushoverMaxTitle)},
+		"message":   {truncate(ev.Message, pushoverMaxMessage)},
+		"priority":  {strconv.Itoa(priority)},
+		"timestamp": {strconv.FormatInt(ev.Time.Unix(), 10)},
+	}
+	if priority == 2 {
+		// Emergency priority repeats the alert until acknowledged or expired
+		form.Set("retry", strconv.Itoa(int(p.retry.Seconds())))
+		form.Set("expire", strconv.Itoa(int(p.expire.Seconds())))
+	}
+
+	var err error
+	for attempt := 1; attempt <= pushoverAttempts; attempt++ {
+		var retryable bool
+		retryable, err = p.send(form)
+		if err == nil || !retryable {
+			return err
+		}
+		if attempt < pushoverAttempts {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", pushoverAttempts, err)
+}
+
+// send posts the message once and reports whether a failure is worth retrying
+func (p *pushoverNotifier) send(form url.Values) (bool, error) {
+	resp, err := p.client.PostForm(p.apiURL+"/1/messages.json", form)
+	if err != nil {
+		return true, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		var result pushoverResponse
+		if err := json.Unmarshal(body, &result); err != nil || len(result.Errors) == 0 {
+			return false, fmt.Errorf("pushover rejected the message with status %d", resp.StatusCode)
+		}
+		if result.Token == "invalid" || result.User == "invalid" {
+			p.mu.Lock()
+			p.disabled = true
+			p.mu.Unlock()
+			slog.Error("Pushover rejected the app token or user key, disabling Pushover notifications")
+		}
+		return false, fmt.Errorf("pushover rejected the message: %s", strings.Join(result.Errors, "; "))
+	}
+
+	return true, fmt.Errorf("pushover request failed with status %d", resp.StatusCode)
+}
+
+// pushoverPriority maps event severity to Pushover priorities (-1 quiet .. 2 emergency)
+func pushoverPriority(s Severity) int {
+	switch s {
+	case SeverityLow:
+		return -1
+	case SeverityWarning:
+		return 1
+	case SeverityCritical:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// truncate shortens s to at most limit runes
+func truncate(s string, limit int) string {
+	r := []rune(s)
+	if len(r) <= limit {
+		return s
+	}
+	return string(r[:limit-1]) + "…"
+}
@@ -0,0 +1,95 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// signalAttempts bounds the deliveries of one message
+const signalAttempts = 3
+
+// signalBackoff is the wait after the first failed delivery, growing linearly with the attempts
+var signalBackoff = 2 * time.Second
+
+// signalNotifier sends events through a signal-cli-rest-api container
+type signalNotifier struct {
+	apiURL     string
+	number     string
+	recipients []string
+	client     *http.Client
+}
+
+func newSignalNotifier(cfg *config.Config) *signalNotifier {
+	var recipients []string
+	for _, r := range strings.Split(cfg.SignalRecipients, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			recipients = append(recipients, r)
+		}
+	}
+	return &signalNotifier{
+		apiURL:     strings.TrimSuffix(cfg.SignalAPIURL, "/"),
+		number:     cfg.SignalNumber,
+		recipients: recipients,
+		// Sending waits for the Signal servers, which can take a while
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *signalNotifier) Name() string {
+	return "signal"
+}
+
+// signalSendRequest is the body of POST /v2/send
+type signalSendRequest struct {
+	Message    string   `json:"message"`
+	Number     string   `json:"number"`
+	Recipients []string `json:"recipients"`
+}
+
+// Notify sends the event, retrying failures a bounded number of times
+func (s *signalNotifier) Notify(ev Event) error {
+	text := ev.Title + "\n\n" + ev.Message
+	if ev.Device != "" {
+		text = ev.Device + ": " + text
+	}
+	body, err := json.Marshal(signalSendRequest{Message: text, Number: s.number, Recipients: s.recipients})
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for attempt := 1; attempt <= signalAttempts; attempt++ {
+		err := s.send(body)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+		if attempt < signalAttempts {
+			time.Sleep(time.Duration(attempt) * signalBackoff)
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %s", signalAttempts, strings.Join(errs, "; "))
+}
+
+func (s *signalNotifier) send(body []byte) error {
+	resp, err := s.client.Post(s.apiURL+"/v2/send", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("signal send failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// fastSignalRetries shortens the backoff between deliveries for the test
+func fastSignalRetries(t *testing.T) {
+	backoff := signalBackoff
+	signalBackoff = time.Millisecond
+	t.Cleanup(func() { signalBackoff = backoff })
+}
+
+func TestSignalSendsPayload(t *testing.T) {
+	srv := newFakeServer(t, http.StatusCreated, `{"timestamp":"1772395200000"}`)
+	n := newSignalNotifier(&config.Config{SignalAPIURL: srv.URL + "/", SignalNumber: "+4915100000000", SignalRecipients: "+4915111111111, group.abc=,"})
+
+	if err := n.Notify(Event{Device: "bambu-plug", Title: "Printer powered off", Message: "Standby for 30m"}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	req := srv.only(t)
+	if req.Method != http.MethodPost || req.Path != "/v2/send" {
+		t.Errorf("request = %s %s, want POST /v2/send", req.Method, req.Path)
+	}
+	if got := req.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	var payload map[string]any
+	if err := json.Unmarshal([]byte(req.Body), &payload); err != nil {
+		t.Fatalf("body %q: %v", req.Body, err)
+	}
+	want := map[string]any{
+		"message":    "bambu-plug: Printer powered off\n\nStandby for 30m",
+		"number":     "+4915100000000",
+		"recipients": []any{"+4915111111111", "group.abc="},
+	}
+	if len(payload) != len(want) {
+		t.Errorf("payload = %v, want only %v", payload, want)
+	}
+	for key, value := range want {
+		got, _ := json.Marshal(payload[key])
+		expected, _ := json.Marshal(value)
+		if string(got) != string(expected) {
+			t.Errorf("%s = %s, want %s", key, got, expected)
+		}
+	}
+}
+
+func TestSignalRetriesThenSucceeds(t *testing.T) {
+	fastSignalRetries(t)
+	srv := newFakeServer(t, http.StatusBadGateway, "signal-cli not ready")
+	n := newSignalNotifier(&config.Config{SignalAPIURL: srv.URL, SignalNumber: "+49151", SignalRecipients: "+49152"})
+
+	done := make(chan error, 1)
+	go func() { done <- n.Notify(Event{Title: "t"}) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.received()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	srv.respond(http.StatusOK, `{"timestamp":"1"}`)
+	if err := <-done; err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got := len(srv.received()); got < 2 || got > signalAttempts {
+		t.Errorf("sent %d requests, want a retry within %d attempts", got, signalAttempts)
+	}
+}
+
+func TestSignalPropagatesErrors(t *testing.T) {
+	fastSignalRetries(t)
+	srv := newFakeServer(t, http.StatusBadRequest, `{"error":"Invalid recipient"}`+"\n")
+	n := newSignalNotifier(&config.Config{SignalAPIURL: srv.URL, SignalNumber: "+49151", SignalRecipients: "nope"})
+
+	err := n.Notify(Event{Title: "t"})
+	if err == nil {
+		t.Fatal("no error")
+	}
+	want := `giving up after 3 attempts: signal send failed with status 400: {"error":"Invalid recipient"}`
+	if !strings.HasPrefix(err.Error(), want) || strings.Count(err.Error(), "status 400") != signalAttempts {
+		t.Errorf("error = %q, want a summary of %d attempts", err, signalAttempts)
+	}
+	if got := len(srv.received()); got != signalAttempts {
+		t.Errorf("sent %d requests, want %d", got, signalAttempts)
+	}
+
+	srv.Close()
+	if err := n.Notify(Event{Title: "t"}); err == nil || !strings.Contains(err.Error(), "giving up after 3 attempts") {
+		t.Errorf("unreachable API: error = %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// smtpNotifier sends events as plain-text emails
+type smtpNotifier struct {
+	host          string
+	port          string
+	security      string
+	user          string
+	password      string
+	from          string
+	to            []string
+	subjectPrefix string
+
+	mu      sync.Mutex
+	failing bool // a failure of the current streak was already reported
+}
+
+func newSMTPNotifier(cfg *config.Config) *smtpNotifier {
+	var to []string
+	for _, addr := range strings.Split(cfg.SMTPTo, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+
+	return &smtpNotifier{
+		host:          cfg.SMTPHost,
+		port:          cfg.SMTPPort,
+		security:      cfg.SMTPSecurity,
+		user:          cfg.SMTPUser,
+		password:      cfg.SMTPPassword,
+		from:          cfg.SMTPFrom,
+		to:            to,
+		subjectPrefix: cfg.SMTPSubjectPrefix,
+	}
+}
+
+func (s *smtpNotifier) Name() string {
+	return "smtp"
+}
+
+// Notify sends the event by mail. Only the first failure of a failure streak is reported,
+// later ones are returned as errNotifyRepeated.
+func (s *smtpNotifier) Notify(ev Event) error {
+	err := s.send(s.buildMessage(ev))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		if s.failing {
+			return errNotifyRepeated
+		}
+		s.failing = true
+		return err
+	}
+	if s.failing {
+		s.failing = false
+		slog.Info("SMTP delivery recovered")
+	}
+	return nil
+}
+
+// buildMessage renders the event as a MIME plain-text mail
+func (s *smtpNotifier) buildMessage(ev Event) []byte {
+	subject := ev.Title
+	if ev.Device != "" {
+		subject = fmt.Sprintf("%s: %s", ev.Device, subject)
+	}
+	if s.subjectPrefix != "" {
+		subject = s.subjectPrefix + " " + subject
+	}
+
+	var msg bytes.Buffer
+	header := func(k, v string) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", k, v)
+	}
+	header("From", s.from)
+	header("To", strings.Join(s.to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", ev.Time.Format(time.RFC1123Z))
+	header("Message-ID", s.messageID())
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	msg.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&msg)
+	_, _ = qp.Write([]byte(strings.ReplaceAll(eventPlainText(ev), "\n", "\r\n")))
+	_ = qp.Close()
+
+	return msg.Bytes()
+}
+
+// messageID generates a unique Message-ID header value
+func (s *smtpNotifier) messageID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	domain := "gome-assistant"
+	if at := strings.LastIndex(s.from, "@"); at >= 0 {
+		domain = strings.Trim(s.from[at+1:], "> ")
+	}
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(b), domain)
+}
+
+// send delivers the message using the configured transport security
+func (s *smtpNotifier) send(msg []byte) error {
+	addr := net.JoinHostPort(s.host, s.port)
+	tlsConfig := &tls.Config{ServerName: s.host}
+
+	var c *smtp.Client
+	switch s.security {
+	case config.SMTPTLS:
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+		c, err = smtp.NewClient(conn, s.host)
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+	default:
+		conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		c, err = smtp.NewClient(conn, s.host)
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+		if s.security == config.SMTPStartTLS {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				_ = c.Close()
+				return fmt.Errorf("STARTTLS failed: %w", err)
+			}
+		}
+	}
+	defer func() {
+		_ = c.Close()
+	}()
+
+	if s.user != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.user, s.password, s.host)); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+
+	if err := c.Mail(s.from); err != nil {
+		return err
+	}
+	for _, rcpt := range s.to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("recipient %s rejected: %w", rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// eventPlainText renders the event message followed by its decision context
+func eventPlainText(ev Event) string {
+	var b strings.Builder
+	b.WriteString(ev.Message)
+	b.WriteString("\n\n")
+	if ev.Device != "" {
+		fmt.Fprintf(&b, "Device:   %s\n", ev.Device)
+	}
+	fmt.Fprintf(&b, "Event:    %s (%s)\n", ev.Type, ev.Severity)
+	if ev.Watts > 0 {
+		fmt.Fprintf(&b, "Power:    %.1f W\n", ev.Watts)
+	}
+	if ev.StandbyDuration > 0 {
+		fmt.Fprintf(&b, "Standby:  %s\n", ev.StandbyDuration.Round(time.Second))
+	}
+	fmt.Fprintf(&b, "Time:     %s\n", ev.Time.Format("2006-01-02 15:04:05 MST"))
+	return b.String()
+}
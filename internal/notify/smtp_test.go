@@ -0,0 +1,230 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// fakeMail is a mail accepted by fakeSMTP
+type fakeMail struct {
+	auth string // user and password of AUTH PLAIN, separated by a colon
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTP is a local SMTP listener speaking just enough of the protocol for net/smtp
+type fakeSMTP struct {
+	listener net.Listener
+
+	mu         sync.Mutex
+	rejectAuth bool
+	mails      []fakeMail
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSMTP{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return f
+}
+
+// config returns an SMTP configuration without transport security pointing at the listener
+func (f *fakeSMTP) config() *config.Config {
+	host, port, _ := net.SplitHostPort(f.listener.Addr().String())
+	return &config.Config{SMTPHost: host, SMTPPort: port, SMTPSecurity: config.SMTPPlain, SMTPFrom: "gome@example.com", SMTPTo: "a@example.com, b@example.com"}
+}
+
+func (f *fakeSMTP) setRejectAuth(reject bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rejectAuth = reject
+}
+
+func (f *fakeSMTP) received() []fakeMail {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeMail(nil), f.mails...)
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = io.WriteString(conn, line+"\r\n") }
+
+	reply("220 fake ESMTP")
+	var m fakeMail
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch {
+		case verb == "EHLO" || verb == "HELO":
+			reply("250-fake")
+			reply("250 AUTH PLAIN")
+		case strings.HasPrefix(strings.ToUpper(line), "AUTH PLAIN "):
+			decoded, _ := base64.StdEncoding.DecodeString(line[len("AUTH PLAIN "):])
+			parts := strings.Split(string(decoded), "\x00")
+			f.mu.Lock()
+			reject := f.rejectAuth
+			f.mu.Unlock()
+			if reject || len(parts) != 3 {
+				reply("535 5.7.8 Authentication credentials invalid")
+				continue
+			}
+			m.auth = parts[1] + ":" + parts[2]
+			reply("235 2.7.0 Authentication successful")
+		case verb == "MAIL":
+			m.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+			reply("250 OK")
+		case verb == "RCPT":
+			m.to = append(m.to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+			reply("250 OK")
+		case verb == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			m.data = data.String()
+			f.mu.Lock()
+			f.mails = append(f.mails, m)
+			f.mu.Unlock()
+			m = fakeMail{}
+			reply("250 OK queued")
+		case verb == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPNotifyDeliversMail(t *testing.T) {
+	srv := newFakeSMTP(t)
+	cfg := srv.config()
+	cfg.SMTPUser = "gome"
+	cfg.SMTPPassword = "s3cret"
+	cfg.SMTPSubjectPrefix = "[printer]"
+	n := newSMTPNotifier(cfg)
+
+	ev := Event{
+		Type:     EventActuationFailed,
+		Severity: SeverityWarning,
+		Time:     time.Date(2026, 3, 1, 20, 15, 0, 0, time.UTC),
+		Device:   "bambu-plug",
+		Title:    "Turning off the printer failed",
+		Message:  "Relay off command failed 3 times in a row: connection refused. Will retry on the next check, which is a long line to be wrapped",
+		Watts:    8.1,
+	}
+	if err := n.Notify(ev); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	mails := srv.received()
+	if len(mails) != 1 {
+		t.Fatalf("got %d mails, want 1", len(mails))
+	}
+	got := mails[0]
+	if got.auth != "gome:s3cret" || got.from != "gome@example.com" || strings.Join(got.to, ",") != "a@example.com,b@example.com" {
+		t.Errorf("envelope = %+v", got)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(got.data))
+	if err != nil {
+		t.Fatalf("parsing the mail: %v", err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if subject != "[printer] bambu-plug: Turning off the printer failed" {
+		t.Errorf("Subject = %q", subject)
+	}
+	if got := msg.Header.Get("Content-Transfer-Encoding"); got != "quoted-printable" {
+		t.Errorf("Content-Transfer-Encoding = %q", got)
+	}
+	if id := msg.Header.Get("Message-Id"); !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("Message-ID = %q", id)
+	}
+	body, _ := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	for _, want := range []string{ev.Message, "Device:   bambu-plug", "Event:    actuation_failed (warning)", "Power:    8.1 W", "Time:     2026-03-01 20:15:00 UTC"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("body %q lacks %q", body, want)
+		}
+	}
+}
+
+func TestSMTPReportsFailuresOncePerStreak(t *testing.T) {
+	srv := newFakeSMTP(t)
+	cfg := srv.config()
+	cfg.SMTPUser = "gome"
+	cfg.SMTPPassword = "wrong"
+	n := newSMTPNotifier(cfg)
+	ev := Event{Title: "t", Message: "m"}
+
+	srv.setRejectAuth(true)
+	if err := n.Notify(ev); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Fatalf("first failure: error = %v, want the authentication error", err)
+	}
+	if err := n.Notify(ev); !errors.Is(err, errNotifyRepeated) {
+		t.Fatalf("second failure: error = %v, want errNotifyRepeated", err)
+	}
+
+	srv.setRejectAuth(false)
+	if err := n.Notify(ev); err != nil {
+		t.Fatalf("after recovery: %v", err)
+	}
+
+	srv.setRejectAuth(true)
+	if err := n.Notify(ev); err == nil || errors.Is(err, errNotifyRepeated) {
+		t.Fatalf("failure of a new streak: error = %v, want it reported", err)
+	}
+	if got := len(srv.received()); got != 1 {
+		t.Errorf("delivered %d mails, want 1", got)
+	}
+}
+
+func TestSMTPConnectionFailure(t *testing.T) {
+	srv := newFakeSMTP(t)
+	cfg := srv.config()
+	_ = srv.listener.Close()
+
+	if err := newSMTPNotifier(cfg).Notify(Event{Title: "t", Message: "m"}); err == nil {
+		t.Fatal("no error without a listener")
+	}
+}
@@ -0,0 +1,170 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// telegramNotifier sends events to a Telegram chat via the Bot API
+type telegramNotifier struct {
+	cfg     *config.Config // For the bot token, which can be rotated while running
+	apiURL  string
+	chatID  string
+	client  *http.Client
+	limiter *rateLimiter
+}
+
+func newTelegramNotifier(cfg *config.Config) *telegramNotifier {
+	return &telegramNotifier{
+		cfg:     cfg,
+		apiURL:  strings.TrimSuffix(cfg.TelegramAPIURL, "/"),
+		chatID:  cfg.TelegramChatID,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		limiter: newRateLimiter(cfg.TelegramMaxPerHour, time.Hour),
+	}
+}
+
+func (t *telegramNotifier) Name() string {
+	return "telegram"
+}
+
+// Notify sends the event as a MarkdownV2 formatted message
+func (t *telegramNotifier) Notify(ev Event) error {
+	if !t.limiter.Allow(time.Now()) {
+		return fmt.Errorf("rate limit reached, dropping %s message", ev.Type)
+	}
+
+	text := fmt.Sprintf("*%s*\n%s", escapeMarkdownV2(ev.Title), escapeMarkdownV2(ev.Message))
+	if ev.Device != "" {
+		text += fmt.Sprintf("\n_%s_", escapeMarkdownV2(ev.Device))
+	}
+	return t.sendMessage(t.chatID, text, "MarkdownV2")
+}
+
+// telegramResponse is the common envelope of Bot API responses
+type telegramResponse struct {
+	OK          bool            `json:"ok"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+// sendMessage calls the sendMessage method of the Bot API
+func (t *telegramNotifier) sendMessage(chatID, text, parseMode string) error {
+	payload := map[string]string{
+		"chat_id": chatID,
+		"text":    text,
+	}
+	if parseMode != "" {
+		payload["parse_mode"] = parseMode
+	}
+	_, err := t.call(context.Background(), "sendMessage", payload)
+	return err
+}
+
+// call invokes a Bot API method and returns its result.
+// Errors never contain the bot token, which is part of the request URL.
+func (t *telegramNotifier) call(ctx context.Context, method string, payload interface{}) (json.RawMessage, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	token := t.cfg.Secret("TELEGRAM_BOT_TOKEN")
+	methodURL := fmt.Sprintf("%s/bot%s/%s", t.apiURL, token, method)
+	req, err := http.NewRequestWithContext(ctx, "POST", methodURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, redact(err, token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, redact(err, token)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	var result telegramResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("telegram %s failed with status %d", method, resp.StatusCode)
+	}
+	if !result.OK {
+		return nil, fmt.Errorf("telegram %s failed with status %d: %s", method, resp.StatusCode, result.Description)
+	}
+
+	return result.Result, nil
+}
+
+// redact removes the bot token from errors, e.g. the URL in *url.Error
+func redact(err error, token string) error {
+	if token == "" {
+		return err
+	}
+	return errors.New(strings.ReplaceAll(err.Error(), token, "<redacted>"))
+}
+
+// escapeMarkdownV2 escapes all characters with special meaning in Telegram's MarkdownV2
+func escapeMarkdownV2(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune("\\_*[]()~`>#+-=|{}.!", r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// rateLimiter is a token bucket allowing limit events per period with bursts of up to limit
+type rateLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	interval time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+// newRateLimiter creates a limiter allowing limit events per period; limit <= 0 disables it
+func newRateLimiter(limit int, period time.Duration) *rateLimiter {
+	r := &rateLimiter{limit: limit, tokens: float64(limit)}
+	if limit > 0 {
+		r.interval = period / time.Duration(limit)
+	}
+	return r
+}
+
+// Allow reports whether an event may happen now and consumes a token if so
+func (r *rateLimiter) Allow(now time.Time) bool {
+	if r.limit <= 0 {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.last.IsZero() {
+		r.tokens += float64(now.Sub(r.last)) / float64(r.interval)
+		if r.tokens > float64(r.limit) {
+			r.tokens = float64(r.limit)
+		}
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
@@ -0,0 +1,250 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+// telegramPollTimeout is the long-polling timeout passed to getUpdates
+const telegramPollTimeout = 30 * time.Second
+
+// telegramUpdate is the subset of a Bot API update we handle
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Text string `json:"text"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+	} `json:"message"`
+}
+
+// TelegramBot answers commands sent to the bot
+type TelegramBot struct {
+	api     *telegramNotifier
+	devices []botDevice // Every device, the first is the one the bot was created for
+	allowed map[int64]bool
+}
+
+// botDevice is a device the commands act on, with its name in DEVICES, empty without it
+type botDevice struct {
+	name  string
+	cfg   *config.Config
+	state *controller.State
+}
+
+func NewTelegramBot(cfg *config.Config, state *controller.State) (*TelegramBot, error) {
+	api := newTelegramNotifier(cfg)
+	// Long polling keeps the request open for telegramPollTimeout
+	api.client = &http.Client{Timeout: telegramPollTimeout + 10*time.Second}
+
+	ids := cfg.TelegramAllowedChatIDs
+	if ids == "" {
+		ids = cfg.TelegramChatID
+	}
+	allowed := map[int64]bool{}
+	for _, s := range strings.Split(ids, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chat ID %q in TELEGRAM_ALLOWED_CHAT_IDS", s)
+		}
+		allowed[id] = true
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("no allowed chat IDs configured")
+	}
+
+	return &TelegramBot{api: api, devices: []botDevice{{cfg: cfg, state: state}}, allowed: allowed}, nil
+}
+
+// SetDevices hands the bot every device of DEVICES, the first being the one it was created for. The
+// commands take a device by its name as their last argument.
+func (b *TelegramBot) SetDevices(devices []config.Device, states []*controller.State) {
+	b.devices = make([]botDevice, len(devices))
+	for i := range devices {
+		b.devices[i] = botDevice{name: devices[i].Name, cfg: &devices[i].Config, state: states[i]}
+	}
+}
+
+// device returns the device named by its name in DEVICES or the Shelly device name of its power series
+func (b *TelegramBot) device(name string) (botDevice, bool) {
+	for _, d := range b.devices {
+		if d.name == name {
+			return d, true
+		}
+	}
+	for _, d := range b.devices {
+		if d.state.Device() == name {
+			return d, true
+		}
+	}
+	return botDevice{}, false
+}
+
+// targets splits the device name off the end of the arguments of a command taking n of its own. It
+// returns the named device, or every device without a name, and false for an unknown name.
+func (b *TelegramBot) targets(args []string, n int) ([]botDevice, []string, bool) {
+	if len(args) <= n {
+		return b.devices, args, true
+	}
+	d, ok := b.device(args[len(args)-1])
+	if !ok {
+		return nil, args, false
+	}
+	return []botDevice{d}, args[:len(args)-1], true
+}
+
+// Run long-polls getUpdates until ctx is done
+func (b *TelegramBot) Run(ctx context.Context) {
+	slog.Info("Telegram commands enabled", "chats", len(b.allowed))
+
+	var offset int64
+	for {
+		updates, err := b.getUpdates(ctx, offset)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Error("Polling Telegram updates failed", "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message == nil || !strings.HasPrefix(u.Message.Text, "/") {
+				continue
+			}
+			b.handle(u.Message.Chat.ID, u.Message.Text)
+		}
+	}
+}
+
+// getUpdates fetches pending updates starting at offset
+func (b *TelegramBot) getUpdates(ctx context.Context, offset int64) ([]telegramUpdate, error) {
+	payload := map[string]interface{}{
+		"offset":          offset,
+		"timeout":         int(telegramPollTimeout.Seconds()),
+		"allowed_updates": []string{"message"},
+	}
+
+	result, err := b.api.call(ctx, "getUpdates", payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []telegramUpdate
+	if err := json.Unmarshal(result, &updates); err != nil {
+		return nil, fmt.Errorf("could not decode updates: %w", err)
+	}
+	return updates, nil
+}
+
+// handle executes a command and replies to the chat it came from
+func (b *TelegramBot) handle(chatID int64, text string) {
+	if !b.allowed[chatID] {
+		slog.Warn("Rejected Telegram command from an unknown chat", "chat", chatID)
+		return
+	}
+
+	reply := b.execute(text)
+	if err := b.api.sendMessage(strconv.FormatInt(chatID, 10), reply, ""); err != nil {
+		slog.Error("Replying to a Telegram command failed", "error", err)
+	}
+}
+
+// execute runs a bot command and returns the reply text
+func (b *TelegramBot) execute(text string) string {
+	fields := strings.Fields(text)
+	// Commands may be addressed as /command@botname in groups
+	command := strings.SplitN(fields[0], "@", 2)[0]
+	args := fields[1:]
+	source := "telegram"
+
+	slog.Info("Telegram command", "command", command)
+
+	// /hold takes its duration, the other commands only the device
+	own := 0
+	if command == "/hold" {
+		own = 1
+	}
+	targets, args, ok := b.targets(args, own)
+	if !ok {
+		return fmt.Sprintf("Unknown device %s", args[len(args)-1])
+	}
+	// Status and holds cover every device without a name, the relay commands act on the first one
+	first := targets[0]
+
+	switch command {
+	case "/status":
+		if len(targets) == 1 {
+			return controller.GetStatus(first.cfg, first.state).String()
+		}
+		statuses := make([]string, len(targets))
+		for i, d := range targets {
+			statuses[i] = d.name + ":\n" + controller.GetStatus(d.cfg, d.state).String()
+		}
+		return strings.Join(statuses, "\n\n")
+
+	case "/hold":
+		if len(args) != 1 {
+			return "Usage: /hold <duration> (e.g. /hold 2h) or /hold off"
+		}
+		if args[0] == "off" {
+			for _, d := range targets {
+				controller.SetHold(d.state, 0, source)
+			}
+			return "Hold cleared, automation resumed"
+		}
+		hold, err := time.ParseDuration(args[0])
+		if err != nil || hold <= 0 {
+			return fmt.Sprintf("Invalid duration %q", args[0])
+		}
+		for _, d := range targets {
+			controller.SetHold(d.state, hold, source)
+		}
+		return fmt.Sprintf("Automation on hold until %s", time.Now().Add(hold).Format("2006-01-02 15:04"))
+
+	case "/cancel":
+		if err := controller.VetoPendingOff(first.state, source); err != nil {
+			return fmt.Sprintf("Nothing to cancel: %v", err)
+		}
+		return "Pending auto-off cancelled"
+
+	case "/off", "/on":
+		on := command == "/on"
+		if err := controller.SwitchRelay(first.cfg, first.state, on, source); err != nil {
+			return fmt.Sprintf("Switching relay failed: %v", err)
+		}
+		if on {
+			return "Relay switched on"
+		}
+		return "Relay switched off"
+
+	case "/help", "/start":
+		help := "Commands:\n/status - current state\n/hold <duration> - pause automation (/hold off resumes)\n/cancel - veto a pending auto-off\n/off, /on - switch the relay now"
+		if len(b.devices) > 1 {
+			help += "\nEnd a command with a device name to pick one, e.g. /off voron"
+		}
+		return help
+	}
+
+	return fmt.Sprintf("Unknown command %s, try /help", command)
+}
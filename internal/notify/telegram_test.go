@@ -0,0 +1,301 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+const testBotToken = "123456:secret-token"
+
+// fakeTelegram is a Bot API serving queued updates to getUpdates and recording sendMessage calls
+type fakeTelegram struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	updates []telegramUpdate
+	sent    []map[string]string
+	paths   []string
+	reject  string // Description of a failed sendMessage, "" to accept
+}
+
+func newFakeTelegram(t *testing.T) *fakeTelegram {
+	t.Helper()
+	f := &fakeTelegram{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeTelegram) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	f.paths = append(f.paths, r.URL.Path)
+	f.mu.Unlock()
+
+	switch strings.TrimPrefix(r.URL.Path, "/bot"+testBotToken+"/") {
+	case "getUpdates":
+		f.mu.Lock()
+		updates := f.updates
+		f.updates = nil
+		f.mu.Unlock()
+		if len(updates) == 0 {
+			// Long polling: hold the request until the bot gives up on it
+			select {
+			case <-r.Context().Done():
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+		result, _ := json.Marshal(updates)
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": json.RawMessage(result)})
+	case "sendMessage":
+		var payload map[string]string
+		_ = json.Unmarshal(body, &payload)
+		f.mu.Lock()
+		f.sent = append(f.sent, payload)
+		reject := f.reject
+		f.mu.Unlock()
+		if reject != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]any{"ok": false, "description": reject})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": map[string]any{}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": false, "description": "Not Found"})
+	}
+}
+
+// queue adds updates for the next getUpdates
+func (f *fakeTelegram) queue(updates ...telegramUpdate) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.updates = append(f.updates, updates...)
+}
+
+func (f *fakeTelegram) messages() []map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]string(nil), f.sent...)
+}
+
+// waitMessages waits until n messages were sent
+func (f *fakeTelegram) waitMessages(t *testing.T, n int) []map[string]string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if sent := f.messages(); len(sent) >= n {
+			return sent
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("got %d messages, want %d", len(f.messages()), n)
+	return nil
+}
+
+// command is an update carrying text sent in chat
+func command(id, chat int64, text string) telegramUpdate {
+	var u telegramUpdate
+	u.UpdateID = id
+	u.Message = &struct {
+		Text string `json:"text"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+	}{Text: text}
+	u.Message.Chat.ID = chat
+	return u
+}
+
+func TestTelegramNotifySendsEscapedMessage(t *testing.T) {
+	api := newFakeTelegram(t)
+	n := newTelegramNotifier(&config.Config{TelegramAPIURL: api.URL + "/", TelegramBotToken: testBotToken, TelegramChatID: "42"})
+
+	err := n.Notify(Event{Type: EventRelayOff, Title: "Printer powered off", Message: "Standby at 8.5 W (30m)", Device: "bambu-plug"})
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	sent := api.waitMessages(t, 1)
+	want := map[string]string{
+		"chat_id":    "42",
+		"parse_mode": "MarkdownV2",
+		"text":       "*Printer powered off*\nStandby at 8\\.5 W \\(30m\\)\n_bambu\\-plug_",
+	}
+	for key, value := range want {
+		if sent[0][key] != value {
+			t.Errorf("%s = %q, want %q", key, sent[0][key], value)
+		}
+	}
+	if api.paths[0] != "/bot"+testBotToken+"/sendMessage" {
+		t.Errorf("path = %q", api.paths[0])
+	}
+}
+
+func TestTelegramErrorsKeepTheTokenSecret(t *testing.T) {
+	api := newFakeTelegram(t)
+	api.reject = "Bad Request: chat not found"
+	n := newTelegramNotifier(&config.Config{TelegramAPIURL: api.URL, TelegramBotToken: testBotToken, TelegramChatID: "42"})
+
+	err := n.Notify(Event{Title: "t", Message: "m"})
+	if err == nil || !strings.Contains(err.Error(), "status 400: Bad Request: chat not found") {
+		t.Fatalf("error = %v, want the description of the Bot API", err)
+	}
+
+	api.Close()
+	err = n.Notify(Event{Title: "t", Message: "m"})
+	if err == nil {
+		t.Fatal("no error with the Bot API down")
+	}
+	if strings.Contains(err.Error(), testBotToken) {
+		t.Errorf("error %q contains the bot token", err)
+	}
+}
+
+func TestTelegramRateLimit(t *testing.T) {
+	api := newFakeTelegram(t)
+	n := newTelegramNotifier(&config.Config{TelegramAPIURL: api.URL, TelegramBotToken: testBotToken, TelegramChatID: "42", TelegramMaxPerHour: 2})
+
+	for i := 0; i < 2; i++ {
+		if err := n.Notify(Event{Title: "t", Message: "m"}); err != nil {
+			t.Fatalf("message %d: %v", i+1, err)
+		}
+	}
+	if err := n.Notify(Event{Type: EventRelayOff, Title: "t", Message: "m"}); err == nil || !strings.Contains(err.Error(), "rate limit") {
+		t.Fatalf("third message: error = %v, want the rate limit", err)
+	}
+	if got := len(api.messages()); got != 2 {
+		t.Errorf("sent %d messages, want 2", got)
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	r := newRateLimiter(2, time.Hour)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if !r.Allow(start) || !r.Allow(start) {
+		t.Fatal("burst of 2 not allowed")
+	}
+	if r.Allow(start.Add(time.Minute)) {
+		t.Fatal("allowed beyond the burst")
+	}
+	if !r.Allow(start.Add(31 * time.Minute)) {
+		t.Fatal("not refilled after half the period")
+	}
+	if !newRateLimiter(0, time.Hour).Allow(start) {
+		t.Fatal("a limit of 0 must disable the limiter")
+	}
+}
+
+func TestTelegramBotAnswersCommands(t *testing.T) {
+	api := newFakeTelegram(t)
+	cfg := &config.Config{TelegramAPIURL: api.URL, TelegramBotToken: testBotToken, TelegramChatID: "42", TelegramAllowedChatIDs: "42, 43"}
+	state := &controller.State{Clock: clock.Real{}}
+	bot, err := NewTelegramBot(cfg, state)
+	if err != nil {
+		t.Fatalf("NewTelegramBot: %v", err)
+	}
+
+	api.queue(
+		command(1, 7, "/hold 2h"), // Not allowed, ignored
+		command(2, 42, "hello"),   // Not a command, ignored
+		command(3, 42, "/hold@gome_bot 2h"),
+		command(4, 43, "/cancel"),
+		command(5, 43, "/frobnicate"),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		bot.Run(ctx)
+		close(done)
+	}()
+	sent := api.waitMessages(t, 3)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the context was cancelled")
+	}
+
+	wantReplies := []struct{ chat, prefix string }{
+		{"42", "Automation on hold until "},
+		{"43", "Nothing to cancel: "},
+		{"43", "Unknown command /frobnicate"},
+	}
+	if len(sent) != len(wantReplies) {
+		t.Fatalf("sent %d replies, want %d: %v", len(sent), len(wantReplies), sent)
+	}
+	for i, want := range wantReplies {
+		if sent[i]["chat_id"] != want.chat || !strings.HasPrefix(sent[i]["text"], want.prefix) {
+			t.Errorf("reply %d = %v, want %q to chat %s", i+1, sent[i], want.prefix, want.chat)
+		}
+		if _, ok := sent[i]["parse_mode"]; ok {
+			t.Errorf("reply %d is sent with a parse mode", i+1)
+		}
+	}
+	if state.HoldUntil == nil || time.Until(*state.HoldUntil) < 119*time.Minute {
+		t.Errorf("HoldUntil = %v, want 2h from now", state.HoldUntil)
+	}
+}
+
+func TestTelegramBotDevices(t *testing.T) {
+	cfg := &config.Config{TelegramBotToken: testBotToken, TelegramChatID: "42"}
+	devices := []config.Device{{Name: "x1c", Config: *cfg}, {Name: "voron", Config: *cfg}}
+	states := []*controller.State{{Clock: clock.Real{}, DeviceName: "bambu-plug"}, {Clock: clock.Real{}, DeviceName: "voron-plug"}}
+	bot, err := NewTelegramBot(&devices[0].Config, states[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot.SetDevices(devices, states)
+	held := func() [2]bool { return [2]bool{states[0].HoldUntil != nil, states[1].HoldUntil != nil} }
+
+	// Without a name the hold covers every device
+	bot.execute("/hold 2h")
+	if got := held(); got != [2]bool{true, true} {
+		t.Errorf("held = %v after /hold 2h, want both", got)
+	}
+	bot.execute("/hold off x1c")
+	if got := held(); got != [2]bool{false, true} {
+		t.Errorf("held = %v after /hold off x1c, want only voron", got)
+	}
+
+	since := time.Now()
+	states[1].PendingOffSince = &since
+	if reply := bot.execute("/cancel"); !strings.HasPrefix(reply, "Nothing to cancel") {
+		t.Errorf("/cancel = %q, want nothing pending on the first device", reply)
+	}
+	if reply := bot.execute("/cancel voron-plug"); reply != "Pending auto-off cancelled" || states[1].PendingOffSince != nil {
+		t.Errorf("/cancel voron-plug = %q, pending since %v", reply, states[1].PendingOffSince)
+	}
+
+	if reply := bot.execute("/status"); !strings.HasPrefix(reply, "x1c:\n") || !strings.Contains(reply, "\n\nvoron:\n") {
+		t.Errorf("/status = %q, want the status of both devices", reply)
+	}
+	if reply := bot.execute("/status voron"); strings.Contains(reply, "x1c") {
+		t.Errorf("/status voron = %q, want only voron", reply)
+	}
+	for _, text := range []string{"/off prusa", "/hold 2h prusa", "/status prusa"} {
+		if reply := bot.execute(text); reply != "Unknown device prusa" {
+			t.Errorf("%s = %q, want the unknown device", text, reply)
+		}
+	}
+}
+
+func TestTelegramBotRejectsInvalidChatIDs(t *testing.T) {
+	_, err := NewTelegramBot(&config.Config{TelegramBotToken: testBotToken, TelegramAllowedChatIDs: "42,abc"}, &controller.State{})
+	if err == nil {
+		t.Fatal("invalid chat ID accepted")
+	}
+	if _, err := NewTelegramBot(&config.Config{TelegramBotToken: testBotToken}, &controller.State{}); err == nil {
+		t.Fatal("no allowed chat accepted")
+	}
+}
@@ -0,0 +1,114 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Templates overrides the message body of events per event type
+type Templates map[EventType]*template.Template
+
+// templatesFile is the YAML layout holding notification templates
+type templatesFile struct {
+	NotificationTemplates map[string]string `yaml:"notification_templates"`
+}
+
+// templateFuncs are the helper functions available in notification templates
+var templateFuncs = template.FuncMap{
+	// round rounds a duration to whole seconds
+	"round": func(d time.Duration) time.Duration { return d.Round(time.Second) },
+	// clock formats a time as HH:MM, or "-" if it is zero
+	"clock": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format("15:04")
+	},
+}
+
+// LoadTemplates reads and validates the templates from a YAML file.
+// An empty path means the built-in messages are used for every event.
+func LoadTemplates(path string) (Templates, error) {
+	templates := Templates{}
+	if path == "" {
+		return templates, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file templatesFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for name, text := range file.NotificationTemplates {
+		if _, err := parseEventFilter(name); err != nil || name == "all" {
+			return nil, fmt.Errorf("%s: unknown event type %q", path, name)
+		}
+		tmpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		// Execute once against sample data so references to unknown fields fail at startup
+		if err := tmpl.Execute(&bytes.Buffer{}, sampleEvent(EventType(name))); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		templates[EventType(name)] = tmpl
+	}
+
+	return templates, nil
+}
+
+// Render returns the message of the event, rendered from its template if one is configured.
+// Rendering errors fall back to the built-in message.
+func (t Templates) Render(ev Event) string {
+	tmpl, ok := t[ev.Type]
+	if !ok {
+		return ev.Message
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, ev); err != nil {
+		slog.Error("Rendering a notification template failed", "event", ev.Type, "error", err)
+		return ev.Message
+	}
+	return b.String()
+}
+
+// RenderSample renders the message of an event type with fake data
+func RenderSample(t Templates, eventType EventType) (string, error) {
+	if _, err := parseEventFilter(string(eventType)); err != nil || eventType == "all" {
+		return "", fmt.Errorf("unknown event type %q", eventType)
+	}
+
+	ev := sampleEvent(eventType)
+	ev.Message = t.Render(ev)
+	return fmt.Sprintf("%s\n\n%s", ev.Title, ev.Message), nil
+}
+
+// sampleEvent returns an event of the given type filled with fake data
+func sampleEvent(eventType EventType) Event {
+	now := time.Now()
+	return Event{
+		Type:             eventType,
+		Severity:         SeverityInfo,
+		Time:             now,
+		Device:           "bambu-plug",
+		Instance:         "workshop",
+		Title:            fmt.Sprintf("Sample %s notification", eventType),
+		Message:          "Printer was in standby for 15m0s at 8.1 W and has been switched off",
+		Reason:           "standby for 15m0s",
+		Watts:            8.1,
+		StandbyDuration:  15 * time.Minute,
+		ProjectedOffTime: now.Add(5 * time.Minute),
+	}
+}
@@ -0,0 +1,173 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// webhookQueueSize bounds the number of events waiting for delivery per URL
+const webhookQueueSize = 64
+
+// webhookTarget is one configured webhook URL with its event selection
+type webhookTarget struct {
+	URL    string
+	Events string
+}
+
+// parseWebhookTargets parses "url[|event,event];url..." entries
+func parseWebhookTargets(s string) ([]webhookTarget, error) {
+	var targets []webhookTarget
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		target := webhookTarget{URL: entry, Events: "all"}
+		if i := strings.Index(entry, "|"); i >= 0 {
+			target.URL = strings.TrimSpace(entry[:i])
+			target.Events = entry[i+1:]
+		}
+		if u, err := url.Parse(target.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid webhook URL %q", target.URL)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// webhookPayload is the JSON document posted for every event
+type webhookPayload struct {
+	Type      EventType      `json:"type"`
+	Severity  string         `json:"severity"`
+	Timestamp time.Time      `json:"timestamp"`
+	Device    string         `json:"device,omitempty"`
+	Instance  string         `json:"instance,omitempty"`
+	Title     string         `json:"title"`
+	Message   string         `json:"message"`
+	Context   webhookContext `json:"context"`
+}
+
+// webhookContext carries the decision context of an event
+type webhookContext struct {
+	Watts          float64 `json:"watts"`
+	StandbySeconds float64 `json:"standby_seconds"`
+}
+
+// webhookNotifier posts events to a single URL from a background worker,
+// so slow receivers never stall the control loop
+type webhookNotifier struct {
+	url     string
+	secret  string
+	retries int
+	client  *http.Client
+	queue   chan []byte
+}
+
+func newWebhookNotifier(cfg *config.Config, targetURL string) *webhookNotifier {
+	w := &webhookNotifier{
+		url:     targetURL,
+		secret:  cfg.WebhookSecret,
+		retries: cfg.WebhookRetries,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan []byte, webhookQueueSize),
+	}
+	go w.run()
+	return w
+}
+
+func (w *webhookNotifier) Name() string {
+	if u, err := url.Parse(w.url); err == nil {
+		return "webhook " + u.Host
+	}
+	return "webhook"
+}
+
+// Notify queues the event for asynchronous delivery
+func (w *webhookNotifier) Notify(ev Event) error {
+	body, err := json.Marshal(webhookPayload{
+		Type:      ev.Type,
+		Severity:  ev.Severity.String(),
+		Timestamp: ev.Time,
+		Device:    ev.Device,
+		Instance:  ev.Instance,
+		Title:     ev.Title,
+		Message:   ev.Message,
+		Context: webhookContext{
+			Watts:          ev.Watts,
+			StandbySeconds: ev.StandbyDuration.Seconds(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case w.queue <- body:
+		return nil
+	default:
+		return fmt.Errorf("delivery queue full, dropping %s event", ev.Type)
+	}
+}
+
+// run delivers queued events with bounded retries and exponential backoff
+func (w *webhookNotifier) run() {
+	for body := range w.queue {
+		var err error
+		for attempt := 0; attempt <= w.retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(1<<(attempt-1)) * time.Second)
+			}
+			if err = w.post(body); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			slog.Error("Delivering a webhook failed", "webhook", w.Name(), "attempts", w.retries+1, "error", err)
+		}
+	}
+}
+
+// post sends one event, signing the body when a secret is configured
+func (w *webhookNotifier) post(body []byte) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.secret != "" {
+		req.Header.Set("X-Gome-Signature", "sha256="+signHMAC(w.secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// signHMAC returns the hex encoded HMAC-SHA256 of body
+func signHMAC(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
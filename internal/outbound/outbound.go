@@ -0,0 +1,53 @@
+// Package outbound sets the User-Agent and configured static headers on outbound HTTP requests
+package outbound
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"gome-assistant/internal/version"
+)
+
+// base is the default transport of the standard library, captured before InstallDefault replaces it
+var base = http.DefaultTransport
+
+// Transport adds the User-Agent, unless the request sets its own, and the headers to every request.
+// Headers replace those of the request, including the User-Agent.
+type Transport struct {
+	Base    http.RoundTripper
+	Headers http.Header
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", version.UserAgent())
+	}
+	for name, values := range t.Headers {
+		if name == "Host" {
+			req.Host = values[0]
+			continue
+		}
+		req.Header[name] = values
+	}
+	return t.Base.RoundTrip(req)
+}
+
+// InstallDefault makes every client without a transport of its own send the User-Agent
+func InstallDefault() {
+	http.DefaultTransport = &Transport{Base: base}
+}
+
+// Client returns a client sending the User-Agent and headers
+func Client(timeout time.Duration, headers http.Header) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: &Transport{Base: base, Headers: headers}}
+}
+
+// DialClient returns a client like Client that connects through dial, e.g. to resolve host names itself
+func DialClient(timeout time.Duration, headers http.Header, dial func(ctx context.Context, network, address string) (net.Conn, error)) *http.Client {
+	transport := base.(*http.Transport).Clone()
+	transport.DialContext = dial
+	return &http.Client{Timeout: timeout, Transport: &Transport{Base: transport, Headers: headers}}
+}
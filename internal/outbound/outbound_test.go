@@ -0,0 +1,158 @@
+package outbound
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/version"
+)
+
+// recorder is a server recording the headers and host of the requests it receives
+type recorder struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	headers []http.Header
+	hosts   []string
+}
+
+// newRecorder starts a recorder, closed when the test ends
+func newRecorder(t *testing.T) *recorder {
+	t.Helper()
+	r := &recorder{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		r.headers = append(r.headers, req.Header.Clone())
+		r.hosts = append(r.hosts, req.Host)
+		r.mu.Unlock()
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// last returns the headers and host of the last request
+func (r *recorder) last(t *testing.T) (http.Header, string) {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.headers) == 0 {
+		t.Fatal("no request received")
+	}
+	return r.headers[len(r.headers)-1], r.hosts[len(r.hosts)-1]
+}
+
+func TestTransportHeaders(t *testing.T) {
+	r := newRecorder(t)
+	tests := []struct {
+		name    string
+		headers http.Header // Configured
+		request http.Header // Set by the caller
+		want    http.Header
+		host    string
+	}{
+		{"default user agent", nil, nil, http.Header{"User-Agent": {version.UserAgent()}}, ""},
+		{"user agent of the request", nil, http.Header{"User-Agent": {"webhook/1"}}, http.Header{"User-Agent": {"webhook/1"}}, ""},
+		{"configured headers", http.Header{"X-Org": {"workshop"}, "X-Scope-Orgid": {"7"}}, nil,
+			http.Header{"User-Agent": {version.UserAgent()}, "X-Org": {"workshop"}, "X-Scope-Orgid": {"7"}}, ""},
+		// Configured headers win over those of the request, the user agent too
+		{"replaced", http.Header{"User-Agent": {"vmauth-route"}, "X-Org": {"workshop"}}, http.Header{"User-Agent": {"webhook/1"}, "X-Org": {"other"}},
+			http.Header{"User-Agent": {"vmauth-route"}, "X-Org": {"workshop"}}, ""},
+		{"repeated header", http.Header{"X-Tag": {"a", "b"}}, nil, http.Header{"User-Agent": {version.UserAgent()}, "X-Tag": {"a", "b"}}, ""},
+		{"host", http.Header{"Host": {"plug.internal"}}, nil, http.Header{"User-Agent": {version.UserAgent()}}, "plug.internal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, r.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, values := range tt.request {
+				req.Header[name] = values
+			}
+			before := req.Header.Clone()
+			resp, err := Client(5*time.Second, tt.headers).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			got, host := r.last(t)
+			for name, values := range tt.want {
+				if !slices.Equal(got[name], values) {
+					t.Errorf("%s = %q, want %q", name, got[name], values)
+				}
+			}
+			if _, ok := got["Host"]; ok {
+				t.Error("Host sent as a header")
+			}
+			want := tt.host
+			if want == "" {
+				want = r.Listener.Addr().String()
+			}
+			if host != want {
+				t.Errorf("host = %q, want %q", host, want)
+			}
+			// The request of the caller is left as it was, e.g. for a retry
+			if len(req.Header) != len(before) || req.Header.Get("User-Agent") != before.Get("User-Agent") {
+				t.Errorf("request headers changed to %v", req.Header)
+			}
+		})
+	}
+}
+
+func TestDialClient(t *testing.T) {
+	r := newRecorder(t)
+	var dialed []string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		return (&net.Dialer{}).DialContext(ctx, network, r.Listener.Addr().String())
+	}
+	client := DialClient(5*time.Second, http.Header{"X-Org": {"workshop"}}, dial)
+	resp, err := client.Get("http://shelly-plug.lan/shelly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	got, host := r.last(t)
+	if got.Get("X-Org") != "workshop" || got.Get("User-Agent") != version.UserAgent() || host != "shelly-plug.lan" {
+		t.Errorf("headers = %v for host %q", got, host)
+	}
+	if len(dialed) != 1 || dialed[0] != "shelly-plug.lan:80" {
+		t.Errorf("dialed %v, want the host of the URL", dialed)
+	}
+}
+
+func TestInstallDefault(t *testing.T) {
+	previous := http.DefaultTransport
+	t.Cleanup(func() { http.DefaultTransport = previous })
+	r := newRecorder(t)
+
+	InstallDefault()
+	resp, err := http.Get(r.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, _ := r.last(t); got.Get("User-Agent") != version.UserAgent() {
+		t.Errorf("user agent = %q, want %q", got.Get("User-Agent"), version.UserAgent())
+	}
+
+	// The version set with -ldflags is the one sent
+	defer func(v string) { version.Version = v }(version.Version)
+	version.Version = "1.4.2"
+	resp, err = http.Get(r.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, _ := r.last(t); got.Get("User-Agent") != "gome-assistant/1.4.2" {
+		t.Errorf("user agent = %q, want gome-assistant/1.4.2", got.Get("User-Agent"))
+	}
+}
@@ -0,0 +1,134 @@
+// Package price fetches hourly electricity prices from Tibber or aWATTar
+package price
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// Slot is the price per kWh over a period
+type Slot struct {
+	Start time.Time
+	End   time.Time
+	Price float64
+}
+
+// source fetches the known upcoming price slots
+type source interface {
+	fetch(ctx context.Context) ([]Slot, error)
+	name() string
+}
+
+// Prices fetches the prices periodically. A failed fetch keeps the slots of the last successful one, so
+// an outage of the price source only matters once they have run out.
+type Prices struct {
+	source  source
+	refresh time.Duration
+
+	mu          sync.Mutex
+	slots       []Slot // Sorted by start
+	lastSuccess time.Time
+}
+
+func New(cfg *config.Config) (*Prices, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	var src source
+	switch cfg.PriceSource {
+	case config.PriceSourceTibber:
+		src = &tibber{token: cfg.TibberToken, client: client}
+	case config.PriceSourceAwattar:
+		src = &awattar{url: cfg.AwattarURL, client: client}
+	default:
+		return nil, fmt.Errorf("invalid PRICE_SOURCE %q", cfg.PriceSource)
+	}
+	return &Prices{source: src, refresh: cfg.PriceRefresh}, nil
+}
+
+// Name describes the price source for logs
+func (p *Prices) Name() string {
+	return p.source.name()
+}
+
+// Run fetches the prices immediately and then every refresh interval until ctx is done
+func (p *Prices) Run(ctx context.Context) {
+	for {
+		p.Update(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.refresh):
+		}
+	}
+}
+
+// Update replaces the slots with freshly fetched ones. On failure the last successful fetch is kept.
+func (p *Prices) Update(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	slots, err := p.source.fetch(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil && len(slots) == 0 {
+		err = fmt.Errorf("no prices returned")
+	}
+	if err != nil {
+		if p.lastSuccess.IsZero() {
+			slog.Error("Fetching electricity prices failed, no prices available", "source", p.source.name(), "error", err)
+		} else {
+			slog.Warn("Fetching electricity prices failed, using the last prices", "source", p.source.name(), "age", time.Since(p.lastSuccess).Round(time.Second), "error", err)
+		}
+		return
+	}
+
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Start.Before(slots[j].Start) })
+	p.slots = slots
+	p.lastSuccess = time.Now()
+}
+
+// At returns the price per kWh at t, false if no fetched slot covers it. A nil Prices knows no price.
+func (p *Prices) At(t time.Time) (float64, bool) {
+	if p == nil {
+		return 0, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, s := range p.slots {
+		if s.Start.After(t) {
+			break
+		}
+		if t.Before(s.End) {
+			return s.Price, true
+		}
+	}
+	return 0, false
+}
+
+// get sends the request and returns the body, failing on other statuses than 200 OK
+func get(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("price request failed with status %d: %s", resp.StatusCode, string(body[:min(len(body), 1024)]))
+	}
+	return body, nil
+}
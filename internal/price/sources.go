@@ -0,0 +1,121 @@
+package price
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// tibberURL is the GraphQL endpoint of the Tibber API
+const tibberURL = "https://api.tibber.com/v1-beta/gql"
+
+// tibberQuery asks for the prices of today and tomorrow, including taxes and fees
+const tibberQuery = `{viewer{homes{currentSubscription{priceInfo{today{total startsAt} tomorrow{total startsAt}}}}}}`
+
+// tibber reads the prices of the first home of the Tibber account
+type tibber struct {
+	token  string
+	client *http.Client
+}
+
+func (t *tibber) name() string { return "Tibber" }
+
+func (t *tibber) fetch(ctx context.Context) ([]Slot, error) {
+	payload, err := json.Marshal(map[string]string{"query": tibberQuery})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tibberURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	req.Header.Set("Content-Type", "application/json")
+	body, err := get(t.client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	type price struct {
+		Total    float64   `json:"total"`
+		StartsAt time.Time `json:"startsAt"`
+	}
+	var result struct {
+		Data struct {
+			Viewer struct {
+				Homes []struct {
+					CurrentSubscription struct {
+						PriceInfo struct {
+							Today    []price `json:"today"`
+							Tomorrow []price `json:"tomorrow"`
+						} `json:"priceInfo"`
+					} `json:"currentSubscription"`
+				} `json:"homes"`
+			} `json:"viewer"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("decoding Tibber response: %w", err)
+	}
+	if len(result.Errors) > 0 {
+		return nil, fmt.Errorf("tibber: %s", result.Errors[0].Message)
+	}
+	if len(result.Data.Viewer.Homes) == 0 {
+		return nil, fmt.Errorf("tibber account has no homes")
+	}
+
+	info := result.Data.Viewer.Homes[0].CurrentSubscription.PriceInfo
+	prices := append(info.Today, info.Tomorrow...)
+	slots := make([]Slot, 0, len(prices))
+	for i, p := range prices {
+		// A slot lasts until the next one starts, the last one an hour
+		end := p.StartsAt.Add(time.Hour)
+		if i+1 < len(prices) && prices[i+1].StartsAt.After(p.StartsAt) {
+			end = prices[i+1].StartsAt
+		}
+		slots = append(slots, Slot{Start: p.StartsAt, End: end, Price: p.Total})
+	}
+	return slots, nil
+}
+
+// awattar reads the market prices of aWATTar, which exclude taxes and fees
+type awattar struct {
+	url    string
+	client *http.Client
+}
+
+func (a *awattar) name() string { return "aWATTar" }
+
+func (a *awattar) fetch(ctx context.Context) ([]Slot, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := get(a.client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Data []struct {
+			Start       int64   `json:"start_timestamp"`
+			End         int64   `json:"end_timestamp"`
+			MarketPrice float64 `json:"marketprice"` // Per MWh
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("decoding aWATTar response: %w", err)
+	}
+
+	slots := make([]Slot, 0, len(result.Data))
+	for _, d := range result.Data {
+		slots = append(slots, Slot{Start: time.UnixMilli(d.Start), End: time.UnixMilli(d.End), Price: d.MarketPrice / 1000})
+	}
+	return slots, nil
+}
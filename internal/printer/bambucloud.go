@@ -0,0 +1,91 @@
+package printer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"gome-assistant/internal/config"
+)
+
+// ErrUnauthorized is returned while the API of a state source rejects the configured credentials
+var ErrUnauthorized = errors.New("printer state source rejected the credentials")
+
+// bambuCloudDevices is the part of the bound device list of the Bambu Cloud API the source reads
+type bambuCloudDevices struct {
+	Devices []struct {
+		DevID       string `json:"dev_id"`
+		Name        string `json:"name"`
+		Online      bool   `json:"online"`
+		PrintStatus string `json:"print_status"`
+	} `json:"devices"`
+}
+
+// bambuCloudBusy maps print_status of the Bambu Cloud API to whether the printer is busy.
+// FAILED is the error state.
+var bambuCloudBusy = map[string]bool{
+	"ACTIVE":  true,
+	"RUNNING": true,
+	"PREPARE": true,
+	"PAUSE":   true,
+	"IDLE":    false,
+	"SUCCESS": false,
+	"FINISH":  false,
+	"FAILED":  false,
+}
+
+// newBambuCloud polls the Bambu Cloud API for the print status of BAMBU_SERIAL, at most every
+// BAMBU_CLOUD_INTERVAL. A rejected token, an offline printer or an unknown status fail the check.
+func newBambuCloud(cfg *config.Config) *polledSource {
+	url := strings.TrimSuffix(cfg.BambuCloudURL, "/") + "/v1/iot-service/api/user/bind"
+	client := &http.Client{Timeout: cfg.QueryTimeout}
+	authFailed := false // Touched only while polledSource.mu is held
+
+	return &polledSource{
+		name:     "Bambu Cloud " + cfg.BambuSerial,
+		cacheTTL: cfg.BambuCloudInterval,
+		poll: func(ctx context.Context) (string, bool, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return "", false, err
+			}
+			req.Header.Set("Authorization", "Bearer "+cfg.BambuCloudToken)
+
+			var result bambuCloudDevices
+			err = getJSON(client, req, &result)
+			var statusErr *statusError
+			if errors.As(err, &statusErr) && (statusErr.Code == http.StatusUnauthorized || statusErr.Code == http.StatusForbidden) {
+				if !authFailed {
+					slog.Error("Bambu Cloud rejected the token, relay control is blocked until it is replaced", "status", statusErr.Code)
+				}
+				authFailed = true
+				return "", false, fmt.Errorf("querying Bambu Cloud: %w", ErrUnauthorized)
+			}
+			if err != nil {
+				return "", false, fmt.Errorf("querying Bambu Cloud: %w", err)
+			}
+			if authFailed {
+				slog.Info("Bambu Cloud accepts the token again")
+				authFailed = false
+			}
+
+			for _, device := range result.Devices {
+				if device.DevID != cfg.BambuSerial {
+					continue
+				}
+				if !device.Online {
+					return "", false, fmt.Errorf("printer %s is offline in Bambu Cloud", cfg.BambuSerial)
+				}
+				busy, ok := bambuCloudBusy[device.PrintStatus]
+				if !ok {
+					return "", false, fmt.Errorf("unknown Bambu Cloud print status %q", device.PrintStatus)
+				}
+				return device.PrintStatus, busy, nil
+			}
+			return "", false, fmt.Errorf("printer %s is not bound to the Bambu Cloud account", cfg.BambuSerial)
+		},
+	}
+}
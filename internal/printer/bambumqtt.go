@@ -0,0 +1,273 @@
+package printer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// BambuReport is the latest state a Bambu Lab printer pushed over MQTT
+type BambuReport struct {
+	Time         time.Time `json:"time"`
+	GcodeState   string    `json:"gcode_state"` // IDLE, PREPARE, SLICING, RUNNING, PAUSE, FINISH or FAILED
+	NozzleTemp   float64   `json:"nozzle_temp"`
+	BedTemp      float64   `json:"bed_temp"`
+	PartFan      int       `json:"part_fan_percent"`
+	AuxFan       int       `json:"aux_fan_percent"`
+	ChamberFan   int       `json:"chamber_fan_percent"`
+	HeatbreakFan int       `json:"heatbreak_fan_percent"`
+}
+
+// bambuBusy maps gcode_state to whether the printer is busy; FAILED is the error state
+var bambuBusy = map[string]bool{
+	"PREPARE": true,
+	"SLICING": true,
+	"RUNNING": true,
+	"PAUSE":   true,
+	"IDLE":    false,
+	"FINISH":  false,
+	"FAILED":  false,
+}
+
+// bambuMessage is the part of a device/<serial>/report message the source reads. P1 printers only
+// send the changed fields, so every field is optional.
+type bambuMessage struct {
+	Print *struct {
+		GcodeState        *string  `json:"gcode_state"`
+		NozzleTemper      *float64 `json:"nozzle_temper"`
+		BedTemper         *float64 `json:"bed_temper"`
+		CoolingFanSpeed   *string  `json:"cooling_fan_speed"`
+		BigFan1Speed      *string  `json:"big_fan1_speed"`
+		BigFan2Speed      *string  `json:"big_fan2_speed"`
+		HeatbreakFanSpeed *string  `json:"heatbreak_fan_speed"`
+	} `json:"print"`
+}
+
+// BambuMQTT reads the print state straight from the MQTT broker of a Bambu Lab printer in LAN mode.
+// While the connection is down or no state was received yet, it answers from the fallback source.
+type BambuMQTT struct {
+	host     string
+	fallback StateSource
+	clock    clock.Clock
+
+	mu        sync.Mutex
+	report    *BambuReport
+	liveSince time.Time // Start of the current connection with a known state, zero while not live
+	lastBusy  time.Time
+}
+
+func newBambuMQTT(cfg *config.Config, fallback StateSource, clk clock.Clock) (*BambuMQTT, error) {
+	tlsConfig, err := bambuTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &BambuMQTT{host: cfg.BambuMQTTHost, fallback: fallback, clock: clk}
+	reportTopic := "device/" + cfg.BambuSerial + "/report"
+	requestTopic := "device/" + cfg.BambuSerial + "/request"
+
+	opts := paho.NewClientOptions().
+		AddBroker("ssl://" + net.JoinHostPort(cfg.BambuMQTTHost, "8883")).
+		SetClientID("gome-assistant-" + cfg.ReplicaName()).
+		SetUsername("bblp").
+		SetPassword(cfg.BambuAccessCode).
+		SetTLSConfig(tlsConfig).
+		SetConnectTimeout(10 * time.Second).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetMaxReconnectInterval(2 * time.Minute).
+		SetOnConnectHandler(func(c paho.Client) {
+			slog.Info("Bambu MQTT connected", "host", cfg.BambuMQTTHost)
+			c.Subscribe(reportTopic, 0, b.handleReport)
+			// Ask for the full state, P1 printers only push changes otherwise
+			c.Publish(requestTopic, 0, false, `{"pushing":{"sequence_id":"0","command":"pushall"}}`)
+		}).
+		SetConnectionLostHandler(b.connectionLost)
+
+	// With connect retry enabled the token only completes once connected, don't wait for it
+	paho.NewClient(opts).Connect()
+	return b, nil
+}
+
+// bambuTLSConfig accepts the self-signed certificate of the printer. Its name is the serial number
+// rather than the host, so with BAMBU_MQTT_CA_FILE the chain is verified and the name is checked
+// against BAMBU_SERIAL instead of the host name.
+func bambuTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if cfg.BambuMQTTCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(cfg.BambuMQTTCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("BAMBU_MQTT_CA_FILE: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("BAMBU_MQTT_CA_FILE: no certificates found in %s", cfg.BambuMQTTCAFile)
+	}
+
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		var certs []*x509.Certificate
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		if len(certs) == 0 {
+			return errors.New("printer sent no certificate")
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(x509.VerifyOptions{Roots: pool, Intermediates: intermediates}); err != nil {
+			return err
+		}
+		if certs[0].Subject.CommonName != cfg.BambuSerial {
+			return fmt.Errorf("printer certificate is issued to %q, expected serial %s", certs[0].Subject.CommonName, cfg.BambuSerial)
+		}
+		return nil
+	}
+	return tlsConfig, nil
+}
+
+// connectionLost answers from the fallback until a report arrives over the new connection
+func (b *BambuMQTT) connectionLost(_ paho.Client, err error) {
+	slog.Warn("Bambu MQTT connection lost, falling back until reconnected", "fallback", b.fallback.Name(), "error", err)
+	b.mu.Lock()
+	b.liveSince = time.Time{}
+	b.mu.Unlock()
+}
+
+// handleReport merges a report message into the current state
+func (b *BambuMQTT) handleReport(_ paho.Client, msg paho.Message) {
+	var m bambuMessage
+	if err := json.Unmarshal(msg.Payload(), &m); err != nil {
+		slog.Warn("Ignoring a malformed Bambu MQTT report", "error", err)
+		return
+	}
+	if m.Print == nil {
+		return // Not a print status message, e.g. an answer to another client
+	}
+
+	now := b.clock.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	report := BambuReport{}
+	if b.report != nil {
+		report = *b.report
+	}
+	report.Time = now
+	if p := m.Print; p.GcodeState != nil {
+		if *p.GcodeState != report.GcodeState {
+			slog.Info("Bambu printer state changed", "state", *p.GcodeState)
+			if *p.GcodeState == "FAILED" {
+				slog.Warn("Bambu printer reports a failed print")
+			}
+		}
+		report.GcodeState = *p.GcodeState
+	}
+	if p := m.Print; p.NozzleTemper != nil {
+		report.NozzleTemp = *p.NozzleTemper
+	}
+	if p := m.Print; p.BedTemper != nil {
+		report.BedTemp = *p.BedTemper
+	}
+	setFanPercent(&report.PartFan, m.Print.CoolingFanSpeed)
+	setFanPercent(&report.AuxFan, m.Print.BigFan1Speed)
+	setFanPercent(&report.ChamberFan, m.Print.BigFan2Speed)
+	setFanPercent(&report.HeatbreakFan, m.Print.HeatbreakFanSpeed)
+	b.report = &report
+
+	busy, known := bambuBusy[report.GcodeState]
+	switch {
+	case !known:
+		b.liveSince = time.Time{}
+	case b.liveSince.IsZero():
+		b.liveSince = now
+	}
+	if busy {
+		b.lastBusy = now
+	}
+}
+
+// setFanPercent converts a fan speed in the printer's 0-15 steps to a percentage
+func setFanPercent(dst *int, speed *string) {
+	if speed == nil {
+		return
+	}
+	if steps, err := strconv.Atoi(*speed); err == nil {
+		*dst = int(math.Round(float64(steps) * 100 / 15))
+	}
+}
+
+func (b *BambuMQTT) Name() string {
+	return fmt.Sprintf("Bambu MQTT %s (fallback %s)", b.host, b.fallback.Name())
+}
+
+func (b *BambuMQTT) Printing(ctx context.Context, now time.Time) (bool, error) {
+	b.mu.Lock()
+	if b.liveSince.IsZero() {
+		b.mu.Unlock()
+		return b.fallback.Printing(ctx, now)
+	}
+	state := b.report.GcodeState
+	b.mu.Unlock()
+
+	busy := bambuBusy[state]
+	if busy {
+		slog.Debug("Printer is printing or paused", "printer", b.host, "state", state)
+	}
+	return busy, nil
+}
+
+// PrintedRecently answers from the reports once the connection has been live for the whole lookback
+func (b *BambuMQTT) PrintedRecently(ctx context.Context, now time.Time, lookback time.Duration) (bool, error) {
+	b.mu.Lock()
+	if b.liveSince.IsZero() || now.Sub(b.liveSince) < lookback {
+		b.mu.Unlock()
+		return b.fallback.PrintedRecently(ctx, now, lookback)
+	}
+	defer b.mu.Unlock()
+	return bambuBusy[b.report.GcodeState] || now.Sub(b.lastBusy) <= lookback, nil
+}
+
+// StateQuery returns the state metric of the fallback, the live reports have no history
+func (b *BambuMQTT) StateQuery() (string, []float64) {
+	return b.fallback.(StateHistory).StateQuery()
+}
+
+func (b *BambuMQTT) FailedValues() []float64 {
+	return b.fallback.(FailedStates).FailedValues()
+}
+
+// Report returns the latest report, nil before the first one
+func (b *BambuMQTT) Report() *BambuReport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.report == nil {
+		return nil
+	}
+	report := *b.report
+	return &report
+}
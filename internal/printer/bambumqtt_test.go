@@ -0,0 +1,280 @@
+package printer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+)
+
+// reportMessage is an MQTT message carrying a report payload
+type reportMessage struct {
+	payload []byte
+}
+
+func (m reportMessage) Duplicate() bool   { return false }
+func (m reportMessage) Qos() byte         { return 0 }
+func (m reportMessage) Retained() bool    { return false }
+func (m reportMessage) Topic() string     { return "device/01S00C123456789/report" }
+func (m reportMessage) MessageID() uint16 { return 0 }
+func (m reportMessage) Payload() []byte   { return m.payload }
+func (m reportMessage) Ack()              {}
+
+// stubSource answers with fixed values and counts its calls
+type stubSource struct {
+	printing, recently bool
+	err                error
+	calls              int
+}
+
+func (s *stubSource) Printing(context.Context, time.Time) (bool, error) {
+	s.calls++
+	return s.printing, s.err
+}
+
+func (s *stubSource) PrintedRecently(context.Context, time.Time, time.Duration) (bool, error) {
+	s.calls++
+	return s.recently, s.err
+}
+
+func (s *stubSource) Name() string { return "stub" }
+
+// newTestBambuMQTT returns the MQTT source without a connection, fed by deliver
+func newTestBambuMQTT() (*BambuMQTT, *stubSource, *clock.Fake) {
+	fallback := &stubSource{}
+	clk := clock.NewFake(pollTime)
+	return &BambuMQTT{host: "x1c.lan", fallback: fallback, clock: clk}, fallback, clk
+}
+
+// deliver hands the captured payload in testdata to the source like the broker would
+func deliver(t *testing.T, b *BambuMQTT, fixture string) {
+	t.Helper()
+	payload, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.handleReport(nil, reportMessage{payload: payload})
+}
+
+func TestBambuReportPayloads(t *testing.T) {
+	b, _, clk := newTestBambuMQTT()
+	steps := []struct {
+		fixture string
+		want    BambuReport
+	}{
+		// The full state of an X1C after pushall: fan speeds in 0-15 steps become percentages
+		{"bambu_x1c_pushall.json", BambuReport{GcodeState: "RUNNING", NozzleTemp: 219.81, BedTemp: 54.94, PartFan: 100, AuxFan: 67, ChamberFan: 47, HeatbreakFan: 100}},
+		// P1 printers only send what changed, the rest is kept
+		{"bambu_p1s_delta.json", BambuReport{GcodeState: "RUNNING", NozzleTemp: 220.12, BedTemp: 55.03, PartFan: 100, AuxFan: 67, ChamberFan: 47, HeatbreakFan: 100}},
+		{"bambu_p1s_finish.json", BambuReport{GcodeState: "FINISH", NozzleTemp: 188.5, BedTemp: 50.2, HeatbreakFan: 40}},
+		{"bambu_p1s_failed.json", BambuReport{GcodeState: "FAILED", NozzleTemp: 188.5, BedTemp: 50.2, HeatbreakFan: 40}},
+	}
+	for _, step := range steps {
+		clk.Advance(time.Minute)
+		deliver(t, b, step.fixture)
+		step.want.Time = clk.Now()
+		if got := b.Report(); got == nil || *got != step.want {
+			t.Errorf("%s: report = %+v, want %+v", step.fixture, got, step.want)
+		}
+	}
+}
+
+func TestBambuReportIgnored(t *testing.T) {
+	b, _, _ := newTestBambuMQTT()
+	deliver(t, b, "bambu_version_info.json")
+	b.handleReport(nil, reportMessage{payload: []byte(`{"print":{"gcode_state":`)})
+	if r := b.Report(); r != nil {
+		t.Fatalf("report = %+v from messages without a print status", r)
+	}
+
+	deliver(t, b, "bambu_x1c_pushall.json")
+	before := *b.Report()
+	deliver(t, b, "bambu_version_info.json")
+	b.handleReport(nil, reportMessage{payload: []byte("not json")})
+	// A fan speed the printer sends in an unexpected format leaves the last one
+	b.handleReport(nil, reportMessage{payload: []byte(`{"print":{"cooling_fan_speed":"high"}}`)})
+	if r := b.Report(); r.GcodeState != before.GcodeState || r.PartFan != before.PartFan || r.NozzleTemp != before.NozzleTemp {
+		t.Errorf("report = %+v after ignored messages, want %+v", r, before)
+	}
+}
+
+func TestBambuMQTTFallback(t *testing.T) {
+	ctx := context.Background()
+	b, fallback, clk := newTestBambuMQTT()
+	fallback.printing = true
+
+	// Until the first report the fallback answers
+	if busy, _ := b.Printing(ctx, clk.Now()); !busy || fallback.calls != 1 {
+		t.Errorf("before a report: printing %v after %d fallback calls, want the fallback", busy, fallback.calls)
+	}
+
+	deliver(t, b, "bambu_p1s_finish.json")
+	if busy, err := b.Printing(ctx, clk.Now()); busy || err != nil || fallback.calls != 1 {
+		t.Errorf("live: printing = %v, %v after %d fallback calls, want the report", busy, err, fallback.calls)
+	}
+
+	// A dropped connection falls back, even though the last report is still there
+	b.connectionLost(nil, errors.New("EOF"))
+	if busy, _ := b.Printing(ctx, clk.Now()); !busy || fallback.calls != 2 {
+		t.Errorf("disconnected: printing %v after %d fallback calls, want the fallback", busy, fallback.calls)
+	}
+	if b.Report() == nil {
+		t.Error("report dropped with the connection")
+	}
+
+	// The first report after reconnecting is live again
+	clk.Advance(time.Minute)
+	deliver(t, b, "bambu_x1c_pushall.json")
+	if busy, _ := b.Printing(ctx, clk.Now()); !busy || fallback.calls != 2 {
+		t.Errorf("reconnected: printing %v after %d fallback calls, want the report", busy, fallback.calls)
+	}
+
+	// A state the source doesn't know isn't trusted
+	b.handleReport(nil, reportMessage{payload: []byte(`{"print":{"gcode_state":"CALIBRATING_LIDAR"}}`)})
+	if b.Printing(ctx, clk.Now()); fallback.calls != 3 {
+		t.Errorf("unknown state: %d fallback calls, want the fallback", fallback.calls)
+	}
+}
+
+func TestBambuMQTTPrintedRecently(t *testing.T) {
+	ctx := context.Background()
+	b, fallback, clk := newTestBambuMQTT()
+	fallback.recently = true
+	lookback := 10 * time.Minute
+
+	deliver(t, b, "bambu_x1c_pushall.json")
+	clk.Advance(time.Minute)
+	deliver(t, b, "bambu_p1s_finish.json")
+	// The connection hasn't been live for the whole lookback, the reports would miss earlier prints
+	if recently, _ := b.PrintedRecently(ctx, clk.Now(), lookback); !recently || fallback.calls != 1 {
+		t.Errorf("young connection: printed recently %v after %d fallback calls, want the fallback", recently, fallback.calls)
+	}
+
+	fallback.recently = false
+	tests := []struct {
+		at   time.Duration // Since the connection came up with the print running, a minute before it finished
+		want bool
+	}{
+		{lookback, true}, // The last busy report is just a lookback ago
+		{lookback + time.Second, false},
+	}
+	for _, tt := range tests {
+		recently, err := b.PrintedRecently(ctx, pollTime.Add(tt.at), lookback)
+		if err != nil || recently != tt.want {
+			t.Errorf("%s in: printed recently = %v, %v, want %v", tt.at, recently, err, tt.want)
+		}
+	}
+	if fallback.calls != 1 {
+		t.Errorf("%d fallback calls once live long enough, want 1", fallback.calls)
+	}
+
+	// After a reconnect the lookback has to pass again
+	b.connectionLost(nil, errors.New("EOF"))
+	clk.Set(pollTime.Add(time.Hour))
+	deliver(t, b, "bambu_p1s_finish.json")
+	b.PrintedRecently(ctx, clk.Now().Add(time.Minute), lookback)
+	if fallback.calls != 2 {
+		t.Errorf("%d fallback calls after reconnecting, want 2", fallback.calls)
+	}
+}
+
+// writeCert creates a certificate for cn signed by parent, or self-signed without one, and returns it
+// with its key
+func writeCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestBambuTLSConfig(t *testing.T) {
+	// Without a CA file the self-signed certificate of the printer is accepted as is
+	insecure, err := bambuTLSConfig(&config.Config{})
+	if err != nil || !insecure.InsecureSkipVerify || insecure.VerifyPeerCertificate != nil {
+		t.Fatalf("without a CA file: %+v, %v", insecure, err)
+	}
+
+	ca, caKey := writeCert(t, "BBL CA", nil, nil)
+	caFile := filepath.Join(t.TempDir(), "bambu-ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := bambuTLSConfig(&config.Config{BambuMQTTCAFile: caFile, BambuSerial: "01S00C123456789"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The name of the certificate is the serial, so the host name check is replaced
+	if !tlsConfig.InsecureSkipVerify {
+		t.Error("host name verification left on")
+	}
+
+	printer, _ := writeCert(t, "01S00C123456789", ca, caKey)
+	other, _ := writeCert(t, "01P00A987654321", ca, caKey)
+	otherCA, otherKey := writeCert(t, "Other CA", nil, nil)
+	foreign, _ := writeCert(t, "01S00C123456789", otherCA, otherKey)
+	tests := []struct {
+		name  string
+		certs [][]byte
+		want  string
+	}{
+		{"printer", [][]byte{printer.Raw}, ""},
+		{"printer with its CA", [][]byte{printer.Raw, ca.Raw}, ""},
+		{"other printer", [][]byte{other.Raw}, `issued to "01P00A987654321", expected serial 01S00C123456789`},
+		{"other CA", [][]byte{foreign.Raw}, "unknown authority"},
+		{"no certificate", nil, "printer sent no certificate"},
+		{"garbage", [][]byte{[]byte("not a certificate")}, "x509"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tlsConfig.VerifyPeerCertificate(tt.certs, nil)
+			if (tt.want == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.want)) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	for _, content := range []string{"", "no PEM here"} {
+		empty := filepath.Join(t.TempDir(), "empty.pem")
+		os.WriteFile(empty, []byte(content), 0o600)
+		if _, err := bambuTLSConfig(&config.Config{BambuMQTTCAFile: empty}); err == nil {
+			t.Errorf("CA file %q accepted", content)
+		}
+	}
+	if _, err := bambuTLSConfig(&config.Config{BambuMQTTCAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("missing CA file accepted")
+	}
+}
@@ -0,0 +1,111 @@
+package printer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+// bambuTaskQueued lists the task statuses of the Bambu Cloud API meaning the job waits for the printer
+var bambuTaskQueued = map[string]bool{
+	"PENDING": true,
+	"QUEUED":  true,
+}
+
+// bambuCloudTasks is the part of the task list of the Bambu Cloud API the queue reads
+type bambuCloudTasks struct {
+	Hits []struct {
+		ID       int64  `json:"id"`
+		DeviceID string `json:"deviceId"`
+		Title    string `json:"title"`
+		Status   string `json:"status"`
+	} `json:"hits"`
+}
+
+// QueuedJob is a print job waiting in the Bambu Cloud queue of the printer
+type QueuedJob struct {
+	ID    int64
+	Title string
+}
+
+// BambuQueue polls the Bambu Cloud task list of BAMBU_SERIAL and hands every newly queued job to a
+// handler once. A failing handler gets the job again on the next poll.
+type BambuQueue struct {
+	url      string
+	token    string
+	serial   string
+	interval time.Duration
+	client   *http.Client
+	handle   func(QueuedJob) error
+
+	// Touched only by the Run goroutine
+	handled map[int64]bool
+}
+
+func NewBambuQueue(cfg *config.Config, handle func(QueuedJob) error) *BambuQueue {
+	query := url.Values{"deviceId": {cfg.BambuSerial}, "limit": {"20"}}
+	return &BambuQueue{
+		url:      strings.TrimSuffix(cfg.BambuCloudURL, "/") + "/v1/user-service/my/tasks?" + query.Encode(),
+		token:    cfg.BambuCloudToken,
+		serial:   cfg.BambuSerial,
+		interval: cfg.BambuQueueInterval,
+		client:   &http.Client{Timeout: cfg.QueryTimeout},
+		handle:   handle,
+		handled:  map[int64]bool{},
+	}
+}
+
+// Run polls the queue immediately and then every interval until ctx is done
+func (q *BambuQueue) Run(ctx context.Context) {
+	for {
+		if err := q.poll(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Reading the Bambu Cloud queue failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(q.interval):
+		}
+	}
+}
+
+// poll hands the queued jobs not handled yet to the handler. Jobs that left the queue are forgotten.
+func (q *BambuQueue) poll(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, q.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+q.token)
+	var tasks bambuCloudTasks
+	if err := getJSON(q.client, req, &tasks); err != nil {
+		return fmt.Errorf("querying Bambu Cloud tasks: %w", err)
+	}
+
+	queued := map[int64]bool{}
+	for _, task := range tasks.Hits {
+		if task.DeviceID != q.serial || !bambuTaskQueued[task.Status] {
+			continue
+		}
+		queued[task.ID] = true
+		if q.handled[task.ID] {
+			continue
+		}
+		if err := q.handle(QueuedJob{ID: task.ID, Title: task.Title}); err != nil {
+			slog.Error("Powering on for a queued job failed, retrying on the next poll", "job", task.Title, "error", err)
+			continue
+		}
+		q.handled[task.ID] = true
+	}
+	for id := range q.handled {
+		if !queued[id] {
+			delete(q.handled, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package printer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"gome-assistant/internal/config"
+)
+
+// moonrakerResponse is the part of the print_stats object query the source reads
+type moonrakerResponse struct {
+	Result struct {
+		Status struct {
+			PrintStats struct {
+				State string `json:"state"` // standby, printing, paused, complete, cancelled or error
+			} `json:"print_stats"`
+		} `json:"status"`
+	} `json:"result"`
+}
+
+// newMoonraker polls print_stats of the Moonraker API of a Klipper printer
+func newMoonraker(cfg *config.Config) *polledSource {
+	url := strings.TrimSuffix(cfg.MoonrakerURL, "/")
+	client := &http.Client{Timeout: cfg.QueryTimeout}
+
+	return &polledSource{
+		name: "Moonraker " + url,
+		poll: func(ctx context.Context) (string, bool, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/printer/objects/query?print_stats", nil)
+			if err != nil {
+				return "", false, err
+			}
+			if cfg.MoonrakerAPIKey != "" {
+				req.Header.Set("X-Api-Key", cfg.MoonrakerAPIKey)
+			}
+
+			var result moonrakerResponse
+			if err := getJSON(client, req, &result); err != nil {
+				return "", false, fmt.Errorf("querying Moonraker: %w", err)
+			}
+			state := result.Result.Status.PrintStats.State
+			if state == "" {
+				return "", false, fmt.Errorf("moonraker response has no print_stats state")
+			}
+			return state, state == "printing" || state == "paused", nil
+		},
+	}
+}
+
+// getJSON sends the request and decodes the JSON body of a 200 response into v
+func getJSON(client *http.Client, req *http.Request, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return &statusError{Code: resp.StatusCode, Body: string(body)}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// statusError is returned by getJSON for responses other than 200
+type statusError struct {
+	Code int
+	Body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.Code, e.Body)
+}
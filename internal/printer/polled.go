@@ -0,0 +1,85 @@
+package printer
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// polledSource is a StateSource asking the API of the printer. The APIs keep no state history, so it
+// remembers when it last saw the printer busy.
+type polledSource struct {
+	name     string
+	poll     func(ctx context.Context) (state string, busy bool, err error)
+	cacheTTL time.Duration // How long a reading or failure is reused instead of polling again
+
+	mu        sync.Mutex // Held while polling, so concurrent callers share one request
+	lastBusy  time.Time
+	last      *reading
+	lastErr   error
+	lastErrAt time.Time
+}
+
+// reading is a successful poll
+type reading struct {
+	at    time.Time
+	state string
+	busy  bool
+}
+
+func (p *polledSource) Name() string {
+	return p.name
+}
+
+func (p *polledSource) Printing(ctx context.Context, now time.Time) (bool, error) {
+	r, err := p.read(ctx, now)
+	if err != nil {
+		return false, err
+	}
+	if r.busy {
+		slog.Debug("Printer is printing or paused", "printer", p.name, "state", r.state)
+	}
+	return r.busy, nil
+}
+
+// PrintedRecently only knows about prints seen since the start of the process
+func (p *polledSource) PrintedRecently(ctx context.Context, now time.Time, lookback time.Duration) (bool, error) {
+	r, err := p.read(ctx, now)
+	if err != nil || r.busy {
+		return r.busy, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.lastBusy.IsZero() && now.Sub(p.lastBusy) <= lookback, nil
+}
+
+// read returns the cached reading or failure while it is younger than cacheTTL and polls otherwise.
+// Caching failures keeps a failing API from being asked again on every call.
+func (p *polledSource) read(ctx context.Context, now time.Time) (reading, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.lastErr != nil && now.Sub(p.lastErrAt) < p.cacheTTL {
+		return reading{}, p.lastErr
+	}
+	if p.lastErr == nil && p.last != nil && now.Sub(p.last.at) < p.cacheTTL {
+		return *p.last, nil
+	}
+
+	state, busy, err := p.poll(ctx)
+	if err != nil {
+		// A poll cancelled along with the cycle says nothing about the API
+		if ctx.Err() == nil {
+			p.lastErr, p.lastErrAt = err, now
+		}
+		return reading{}, err
+	}
+	p.lastErr = nil
+	r := reading{at: now, state: state, busy: busy}
+	p.last = &r
+	if busy {
+		p.lastBusy = now
+	}
+	return r, nil
+}
@@ -0,0 +1,130 @@
+// Package printer answers whether the printer is busy, from metrics or from the API of the printer
+package printer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/metrics"
+)
+
+// StateSource tells whether the printer is printing. Paused counts as printing, an error state does not.
+type StateSource interface {
+	// Printing reports whether the printer is printing or paused now
+	Printing(ctx context.Context, now time.Time) (bool, error)
+	// PrintedRecently reports whether the printer was printing or paused within lookback
+	PrintedRecently(ctx context.Context, now time.Time, lookback time.Duration) (bool, error)
+	// Name describes the source for logs
+	Name() string
+}
+
+// StateHistory is implemented by the sources backed by a state metric, whose history can be lined up
+// with the power history
+type StateHistory interface {
+	// StateQuery returns the query of the state and its values meaning printing or paused
+	StateQuery() (string, []float64)
+}
+
+// FailedStates is implemented by the sources whose state tells a failed print from a finished one
+type FailedStates interface {
+	// FailedValues returns the state values meaning the print failed
+	FailedValues() []float64
+}
+
+// New creates the state source selected by PRINTER_SOURCE
+func New(cfg *config.Config, c metrics.Client, clk clock.Clock) (StateSource, error) {
+	switch cfg.PrinterSource {
+	case config.PrinterSourceBambu:
+		if cfg.BambuMQTTHost != "" {
+			return newBambuMQTT(cfg, &bambuSource{metrics: c}, clk)
+		}
+		return &bambuSource{metrics: c}, nil
+	case config.PrinterSourceMetric:
+		busy, err := parseBusyValues(cfg.PrinterBusyValues)
+		if err != nil {
+			return nil, err
+		}
+		return &metricSource{metrics: c, query: cfg.PrinterStateMetric, busy: busy}, nil
+	case config.PrinterSourceMoonraker:
+		return newMoonraker(cfg), nil
+	case config.PrinterSourcePrusaLink:
+		return newPrusaLink(cfg), nil
+	case config.PrinterSourceBambuCloud:
+		return newBambuCloud(cfg), nil
+	default:
+		return nil, fmt.Errorf("invalid PRINTER_SOURCE %q", cfg.PrinterSource)
+	}
+}
+
+// bambuSource reads bambulab_gcode_state of the Bambu Lab exporter
+type bambuSource struct {
+	metrics metrics.Client
+}
+
+func (b *bambuSource) Printing(ctx context.Context, now time.Time) (bool, error) {
+	return metrics.IsBambuPrinting(ctx, b.metrics, now)
+}
+
+func (b *bambuSource) PrintedRecently(ctx context.Context, now time.Time, lookback time.Duration) (bool, error) {
+	return metrics.WasPrintingRecently(ctx, b.metrics, now, lookback)
+}
+
+func (b *bambuSource) Name() string {
+	return "bambulab_gcode_state"
+}
+
+func (b *bambuSource) StateQuery() (string, []float64) {
+	return "bambulab_gcode_state", []float64{1, 2}
+}
+
+func (b *bambuSource) FailedValues() []float64 {
+	return []float64{4}
+}
+
+// metricSource reads a state metric of any exporter, e.g. klipper_print_state of moonraker-exporter
+type metricSource struct {
+	metrics metrics.Client
+	query   string
+	busy    []float64 // State values meaning printing or paused
+}
+
+func (m *metricSource) Printing(ctx context.Context, now time.Time) (bool, error) {
+	return metrics.IsStateBusy(ctx, m.metrics, now, m.query, m.busy)
+}
+
+func (m *metricSource) PrintedRecently(ctx context.Context, now time.Time, lookback time.Duration) (bool, error) {
+	return metrics.WasStateBusyRecently(ctx, m.metrics, now, m.query, m.busy, lookback)
+}
+
+func (m *metricSource) Name() string {
+	return m.query
+}
+
+func (m *metricSource) StateQuery() (string, []float64) {
+	return m.query, m.busy
+}
+
+// parseBusyValues parses the comma-separated PRINTER_BUSY_VALUES
+func parseBusyValues(s string) ([]float64, error) {
+	var busy []float64
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PRINTER_BUSY_VALUES entry %q: %w", field, err)
+		}
+		busy = append(busy, v)
+	}
+	if len(busy) == 0 {
+		return nil, fmt.Errorf("PRINTER_BUSY_VALUES must list at least one value")
+	}
+	return busy, nil
+}
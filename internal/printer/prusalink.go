@@ -0,0 +1,65 @@
+package printer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"gome-assistant/internal/config"
+)
+
+// prusaLinkStatus is the part of /api/v1/status the source reads
+type prusaLinkStatus struct {
+	Printer struct {
+		State string `json:"state"`
+	} `json:"printer"`
+}
+
+// prusaLinkBusy maps the PrusaLink printer states to whether the printer is busy. ERROR and ATTENTION
+// are error states, which don't count as printing, like an error state of the other sources.
+var prusaLinkBusy = map[string]bool{
+	"PRINTING":  true,
+	"PAUSED":    true,
+	"BUSY":      true, // Working outside of a print job, e.g. preheating or calibrating
+	"IDLE":      false,
+	"READY":     false,
+	"FINISHED":  false,
+	"STOPPED":   false,
+	"ERROR":     false,
+	"ATTENTION": false,
+}
+
+// newPrusaLink polls the local PrusaLink API of a Prusa printer. An unknown state fails the check
+// like an unreachable printer.
+func newPrusaLink(cfg *config.Config) *polledSource {
+	url := strings.TrimSuffix(cfg.PrusaLinkURL, "/")
+	client := &http.Client{Timeout: cfg.QueryTimeout}
+
+	return &polledSource{
+		name:     "PrusaLink " + url,
+		cacheTTL: cfg.PrusaLinkCacheTTL,
+		poll: func(ctx context.Context) (string, bool, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/api/v1/status", nil)
+			if err != nil {
+				return "", false, err
+			}
+			req.Header.Set("X-Api-Key", cfg.PrusaLinkAPIKey)
+
+			var status prusaLinkStatus
+			if err := getJSON(client, req, &status); err != nil {
+				return "", false, fmt.Errorf("querying PrusaLink: %w", err)
+			}
+			state := status.Printer.State
+			busy, ok := prusaLinkBusy[state]
+			if !ok {
+				return "", false, fmt.Errorf("unknown PrusaLink printer state %q", state)
+			}
+			if state == "ERROR" || state == "ATTENTION" {
+				slog.Warn("PrusaLink reports a printer problem", "state", state)
+			}
+			return state, busy, nil
+		},
+	}
+}
@@ -0,0 +1,222 @@
+package printer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/config"
+)
+
+var pollTime = time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC)
+
+// fakePrusaLink serves /api/v1/status of a printer in a settable state, checking the API key
+type fakePrusaLink struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	state    string
+	status   int // Status of every request, 0 to answer them
+	requests int
+}
+
+// newFakePrusaLink starts a fake PrusaLink with the printer idle, closed when the test ends
+func newFakePrusaLink(t *testing.T) *fakePrusaLink {
+	t.Helper()
+	p := &fakePrusaLink{state: "IDLE"}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serve))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *fakePrusaLink) serve(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests++
+	switch {
+	case r.URL.Path != "/api/v1/status":
+		http.NotFound(w, r)
+	case r.Header.Get("X-Api-Key") != "prusa-key":
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	case p.status != 0:
+		w.WriteHeader(p.status)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"printer": map[string]any{"state": p.state, "temp_nozzle": 24.5, "temp_bed": 23.9},
+		})
+	}
+}
+
+// set changes the state of the printer
+func (p *fakePrusaLink) set(state string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = state
+}
+
+// fail answers every request with status, or normally again with 0
+func (p *fakePrusaLink) fail(status int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = status
+}
+
+// count returns the number of requests so far
+func (p *fakePrusaLink) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.requests
+}
+
+// newPrusaLinkSource returns the prusalink source for the URL. configure adjusts the settings.
+func newPrusaLinkSource(t *testing.T, url string, configure ...func(cfg *config.Config)) StateSource {
+	t.Helper()
+	cfg := &config.Config{
+		PrinterSource:     config.PrinterSourcePrusaLink,
+		PrusaLinkURL:      url + "/",
+		PrusaLinkAPIKey:   "prusa-key",
+		PrusaLinkCacheTTL: 15 * time.Second,
+	}
+	for _, fn := range configure {
+		fn(cfg)
+	}
+	source, err := New(cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func TestPrusaLinkStates(t *testing.T) {
+	tests := []struct {
+		state string
+		busy  bool
+	}{
+		{"PRINTING", true},
+		{"PAUSED", true},
+		{"BUSY", true},
+		{"IDLE", false},
+		{"READY", false},
+		{"FINISHED", false},
+		{"STOPPED", false},
+		{"ERROR", false},
+		{"ATTENTION", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.state, func(t *testing.T) {
+			fake := newFakePrusaLink(t)
+			fake.set(tt.state)
+			source := newPrusaLinkSource(t, fake.URL)
+			busy, err := source.Printing(context.Background(), pollTime)
+			if err != nil || busy != tt.busy {
+				t.Errorf("printing = %v, %v, want %v", busy, err, tt.busy)
+			}
+			if recently, err := source.PrintedRecently(context.Background(), pollTime, time.Hour); err != nil || recently != tt.busy {
+				t.Errorf("printed recently = %v, %v, want %v", recently, err, tt.busy)
+			}
+		})
+	}
+}
+
+func TestPrusaLinkFailures(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*fakePrusaLink)
+		key   string
+		want  string
+	}{
+		{"unknown state", func(p *fakePrusaLink) { p.set("SUMMONING") }, "prusa-key", `unknown PrusaLink printer state "SUMMONING"`},
+		{"server error", func(p *fakePrusaLink) { p.fail(http.StatusServiceUnavailable) }, "prusa-key", "querying PrusaLink: status 503"},
+		{"wrong API key", func(p *fakePrusaLink) {}, "wrong", "status 401"},
+		{"unreachable", func(p *fakePrusaLink) { p.Close() }, "prusa-key", "querying PrusaLink"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakePrusaLink(t)
+			tt.setup(fake)
+			source := newPrusaLinkSource(t, fake.URL, func(cfg *config.Config) { cfg.PrusaLinkAPIKey = tt.key })
+			// A failed reading is unknown, neither printing nor idle, so the cycle fails and nothing switches
+			busy, err := source.Printing(context.Background(), pollTime)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+			if busy {
+				t.Error("printing despite the failure")
+			}
+		})
+	}
+}
+
+func TestPrusaLinkCache(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakePrusaLink(t)
+	source := newPrusaLinkSource(t, fake.URL)
+
+	fake.set("PRINTING")
+	source.Printing(ctx, pollTime)
+	fake.set("FINISHED")
+	// Within the cache TTL the reading is reused
+	if busy, _ := source.Printing(ctx, pollTime.Add(14*time.Second)); !busy || fake.count() != 1 {
+		t.Errorf("cached: printing %v after %d requests, want the cached print after 1", busy, fake.count())
+	}
+	if busy, _ := source.Printing(ctx, pollTime.Add(15*time.Second)); busy || fake.count() != 2 {
+		t.Errorf("expired: printing %v after %d requests, want the finished print after 2", busy, fake.count())
+	}
+
+	// Failures are cached too, the API is not asked on every call
+	fake.fail(http.StatusServiceUnavailable)
+	at := pollTime.Add(time.Minute)
+	for i := range 3 {
+		if _, err := source.Printing(ctx, at.Add(time.Duration(i)*time.Second)); err == nil {
+			t.Error("no error from the failing API")
+		}
+	}
+	if fake.count() != 3 {
+		t.Errorf("%d requests, want the failure cached after one", fake.count())
+	}
+	fake.fail(0)
+	if busy, err := source.Printing(ctx, at.Add(15*time.Second)); err != nil || busy {
+		t.Errorf("recovered: printing = %v, %v", busy, err)
+	}
+}
+
+func TestPrusaLinkCancelledPollNotCached(t *testing.T) {
+	fake := newFakePrusaLink(t)
+	source := newPrusaLinkSource(t, fake.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := source.Printing(ctx, pollTime); !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want the cancellation", err)
+	}
+	if _, err := source.Printing(context.Background(), pollTime); err != nil {
+		t.Errorf("after the cancelled poll: %v", err)
+	}
+}
+
+func TestPrusaLinkPrintedRecently(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakePrusaLink(t)
+	source := newPrusaLinkSource(t, fake.URL, func(cfg *config.Config) { cfg.PrusaLinkCacheTTL = 0 })
+
+	if recently, _ := source.PrintedRecently(ctx, pollTime, 10*time.Minute); recently {
+		t.Error("printed recently before any print was seen")
+	}
+	fake.set("PRINTING")
+	source.Printing(ctx, pollTime)
+	fake.set("FINISHED")
+	for _, tt := range []struct {
+		after time.Duration
+		want  bool
+	}{{time.Minute, true}, {10 * time.Minute, true}, {10*time.Minute + time.Second, false}} {
+		if recently, err := source.PrintedRecently(ctx, pollTime.Add(tt.after), 10*time.Minute); err != nil || recently != tt.want {
+			t.Errorf("%s after the print: printed recently = %v, %v, want %v", tt.after, recently, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package relay
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gome-assistant/internal/config"
+)
+
+// listenIPv6 listens on the IPv6 loopback, skipping the test where there is none
+func listenIPv6(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestTasmotaOverIPv6(t *testing.T) {
+	l := listenIPv6(t)
+	var queries []string
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("cmnd"))
+		_, _ = w.Write([]byte(`{"POWER":"OFF"}`))
+	}))
+	s.Listener = l
+	s.Start()
+	t.Cleanup(s.Close)
+
+	r, err := New(&config.Config{RelayType: config.RelayTasmota})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The address is the listener's, like SHELLY_IP=[::1]:8080, passed to the URL with its brackets
+	if err := r.Off(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 1 || queries[0] != "Power1 Off" {
+		t.Errorf("commands = %v", queries)
+	}
+	if _, err := r.Status("http://[::1]"); err == nil || !strings.Contains(err.Error(), "invalid device address") {
+		t.Errorf("URL as address: %v", err)
+	}
+}
+
+func TestKasaOverIPv6(t *testing.T) {
+	l := listenIPv6(t)
+	requests := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var header [4]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[:]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		requests <- string(kasaDecrypt(body))
+		resp := []byte(`{"system":{"get_sysinfo":{"relay_state":1}}}`)
+		binary.BigEndian.PutUint32(header[:], uint32(len(resp)))
+		_, _ = conn.Write(append(header[:], kasaEncrypt(resp)...))
+	}()
+
+	r, err := New(&config.Config{RelayType: config.RelayKasa})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if on, err := r.Status(l.Addr().String()); err != nil || !on {
+		t.Fatalf("Status = %v, %v", on, err)
+	}
+	if got := <-requests; got != `{"system":{"get_sysinfo":{}}}` {
+		t.Errorf("request = %s", got)
+	}
+}
+
+func TestKasaAddress(t *testing.T) {
+	// Without a port the plug is dialed on 9999, whatever the form of the address
+	for _, tt := range []struct{ address, dialed string }{
+		{"fd00::5054", "[fd00::5054]:9999"},
+		{"[fd00::5054]", "[fd00::5054]:9999"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:9999"},
+		{"192.168.1.42", "192.168.1.42:9999"},
+		{"[fd00::5054]:8080", "[fd00::5054]:8080"},
+	} {
+		host, err := kasaAddress(tt.address)
+		if err != nil || host != tt.dialed {
+			t.Errorf("kasaAddress(%q) = %q, %v, want %q", tt.address, host, err, tt.dialed)
+		}
+	}
+	if _, err := kasaAddress("http://192.168.1.42"); err == nil {
+		t.Error("URL as address accepted")
+	}
+}
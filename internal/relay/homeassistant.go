@@ -0,0 +1,161 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/outbound"
+)
+
+// errHAAuth is returned when Home Assistant rejects HA_TOKEN
+var errHAAuth = errors.New("home assistant rejected HA_TOKEN")
+
+const (
+	haConfirmTimeout = 10 * time.Second       // How long the entity may take to report the new state
+	haPollInterval   = 500 * time.Millisecond // Interval of reading the entity while waiting
+)
+
+// haRelay switches the HA_SWITCH_ENTITY switch of Home Assistant via its REST API, so the plug's
+// history and automations in Home Assistant see every command. The address of the plug is not used.
+type haRelay struct {
+	cfg    *config.Config
+	url    string
+	client *http.Client
+}
+
+func newHomeAssistant(cfg *config.Config) *haRelay {
+	return &haRelay{cfg: cfg, url: strings.TrimSuffix(cfg.HAURL, "/"), client: outbound.Client(10*time.Second, nil)}
+}
+
+func (h *haRelay) On(string) error {
+	return h.set(true)
+}
+
+func (h *haRelay) Off(string) error {
+	return h.set(false)
+}
+
+// set calls switch.turn_on or switch.turn_off, then reads the entity until it reports the new state, as
+// Home Assistant returns before the integration has switched the plug
+func (h *haRelay) set(on bool) error {
+	if h.cfg.DryRun {
+		slog.Info("[DRY RUN] Would switch via Home Assistant", "action", onOff(on), "entity", h.cfg.HASwitchEntity)
+		return nil
+	}
+	body, err := json.Marshal(map[string]string{"entity_id": h.cfg.HASwitchEntity})
+	if err != nil {
+		return err
+	}
+	resp, err := h.do(http.MethodPost, "/api/services/switch/turn_"+onOff(on), body)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	deadline := time.Now().Add(haConfirmTimeout)
+	for {
+		state, err := h.state()
+		if err != nil {
+			return fmt.Errorf("verifying the relay: %w", err)
+		}
+		if state == onOff(on) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s is still %s %s after turning it %s", h.cfg.HASwitchEntity, state, haConfirmTimeout, onOff(on))
+		}
+		time.Sleep(haPollInterval)
+	}
+}
+
+func (h *haRelay) Status(string) (bool, error) {
+	state, err := h.state()
+	if err != nil {
+		return false, err
+	}
+	switch state {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s is %s", h.cfg.HASwitchEntity, state)
+}
+
+func (h *haRelay) Name() string {
+	return "Home Assistant " + h.cfg.HASwitchEntity
+}
+
+// SelfTest reads the entity once, failing if Home Assistant rejects the token or doesn't know the
+// entity. Home Assistant being unreachable is only logged, as it may still be starting.
+func (h *haRelay) SelfTest() error {
+	state, err := h.state()
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr):
+		slog.Warn("Home Assistant unreachable, relay commands fail until it is up", "url", h.url, "error", err)
+		return nil
+	case err != nil:
+		return err
+	case state == "unavailable" || state == "unknown":
+		slog.Warn("Switch entity unavailable in Home Assistant, check the integration of the plug", "entity", h.cfg.HASwitchEntity, "state", state)
+	}
+	return nil
+}
+
+// state reads the state of the entity, like on, off or unavailable
+func (h *haRelay) state() (string, error) {
+	resp, err := h.do(http.MethodGet, "/api/states/"+h.cfg.HASwitchEntity, nil)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var result struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decoding the state of %s: %w", h.cfg.HASwitchEntity, err)
+	}
+	return result.State, nil
+}
+
+// do sends an authorized request to the REST API and returns the response if it succeeded
+func (h *haRelay) do(method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, h.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.cfg.Secret("HA_TOKEN"))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	respBody, _ := io.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, errHAAuth
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("home assistant has no entity %s, check HA_SWITCH_ENTITY", h.cfg.HASwitchEntity)
+	}
+	return nil, fmt.Errorf("home assistant request %s failed with status %d: %s", path, resp.StatusCode, string(respBody))
+}
@@ -0,0 +1,172 @@
+package relay
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/deviceaddr"
+)
+
+// kasaPort is the TCP port of the local protocol of Kasa plugs
+const kasaPort = "9999"
+
+// kasaRelay switches TP-Link Kasa plugs like the HS110 with set_relay_state of their local protocol:
+// JSON with a length prefix, obfuscated with an autokey XOR cipher
+type kasaRelay struct {
+	cfg *config.Config
+}
+
+func (k *kasaRelay) On(address string) error {
+	return k.set(address, true)
+}
+
+func (k *kasaRelay) Off(address string) error {
+	return k.set(address, false)
+}
+
+func (k *kasaRelay) set(address string, on bool) error {
+	if k.cfg.DryRun {
+		slog.Info("[DRY RUN] Would switch the Kasa plug", "action", onOff(on), "ip", address)
+		return nil
+	}
+	state := 0
+	if on {
+		state = 1
+	}
+	var resp struct {
+		System struct {
+			SetRelayState struct {
+				ErrCode int    `json:"err_code"`
+				ErrMsg  string `json:"err_msg"`
+			} `json:"set_relay_state"`
+		} `json:"system"`
+	}
+	if err := kasaCall(address, map[string]any{"system": map[string]any{"set_relay_state": map[string]int{"state": state}}}, &resp); err != nil {
+		return err
+	}
+	if result := resp.System.SetRelayState; result.ErrCode != 0 {
+		return fmt.Errorf("kasa set_relay_state failed with error %d: %s", result.ErrCode, result.ErrMsg)
+	}
+
+	isOn, err := k.Status(address)
+	if err != nil {
+		return fmt.Errorf("verifying the relay: %w", err)
+	}
+	if isOn != on {
+		return fmt.Errorf("kasa plug is still %s after turning it %s", onOff(isOn), onOff(on))
+	}
+	return nil
+}
+
+func (k *kasaRelay) Status(address string) (bool, error) {
+	var resp struct {
+		System struct {
+			SysInfo struct {
+				RelayState *int `json:"relay_state"`
+			} `json:"get_sysinfo"`
+		} `json:"system"`
+	}
+	if err := kasaCall(address, map[string]any{"system": map[string]any{"get_sysinfo": map[string]any{}}}, &resp); err != nil {
+		return false, err
+	}
+	if resp.System.SysInfo.RelayState == nil {
+		return false, fmt.Errorf("kasa get_sysinfo has no relay_state")
+	}
+	return *resp.System.SysInfo.RelayState == 1, nil
+}
+
+func (k *kasaRelay) Name() string {
+	return "Kasa"
+}
+
+// kasaCall sends a request to the plug at address, on port 9999 unless it names one, and decodes the
+// response into v
+func kasaCall(address string, request, v any) error {
+	address, err := kasaAddress(address)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	msg := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(msg, uint32(len(payload)))
+	if _, err := conn.Write(append(msg, kasaEncrypt(payload)...)); err != nil {
+		return fmt.Errorf("sending the kasa request: %w", err)
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return fmt.Errorf("reading the kasa response: %w", err)
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > 1<<20 {
+		return fmt.Errorf("kasa response of %d bytes is too large", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return fmt.Errorf("reading the kasa response: %w", err)
+	}
+	if err := json.Unmarshal(kasaDecrypt(body), v); err != nil {
+		return fmt.Errorf("decoding the kasa response: %w", err)
+	}
+	return nil
+}
+
+// kasaAddress normalizes the address of the plug to the host and port to dial, 9999 unless it names one
+func kasaAddress(address string) (string, error) {
+	host, err := deviceaddr.Host(address)
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(trimBrackets(host), kasaPort)
+	}
+	return host, nil
+}
+
+// kasaEncrypt XORs every byte with the previous ciphertext byte, starting with 171
+func kasaEncrypt(plain []byte) []byte {
+	key := byte(171)
+	out := make([]byte, len(plain))
+	for i, b := range plain {
+		key ^= b
+		out[i] = key
+	}
+	return out
+}
+
+func kasaDecrypt(cipher []byte) []byte {
+	key := byte(171)
+	out := make([]byte, len(cipher))
+	for i, b := range cipher {
+		out[i] = key ^ b
+		key = b
+	}
+	return out
+}
+
+// trimBrackets removes the brackets of an IPv6 URL host, for joining it with a port again
+func trimBrackets(host string) string {
+	if len(host) > 1 && host[0] == '[' && host[len(host)-1] == ']' {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
@@ -0,0 +1,217 @@
+package relay
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttPublishTimeout bounds how long publishing a command may wait for the broker
+const mqttPublishTimeout = 5 * time.Second
+
+// Connections by broker and user, shared by the devices of DEVICES as a client ID can only be
+// connected once
+var (
+	mqttMu          sync.Mutex
+	mqttConnections = map[string]*mqttConnection{}
+)
+
+// mqttRelay switches a Shelly by publishing on or off to its MQTT command topic, confirmed by the
+// state topic the Shelly reports the relay on. The address of commands is the ID in the topics.
+type mqttRelay struct {
+	cfg  *config.Config
+	conn *mqttConnection
+}
+
+func newShellyMQTT(cfg *config.Config) *mqttRelay {
+	conn := connectMQTT(cfg)
+	conn.subscribe(strings.ReplaceAll(cfg.ShellyMQTTStateTopic(), "<id>", "+"))
+	return &mqttRelay{cfg: cfg, conn: conn}
+}
+
+func (m *mqttRelay) On(id string) error {
+	return m.set(id, true)
+}
+
+func (m *mqttRelay) Off(id string) error {
+	return m.set(id, false)
+}
+
+// set publishes the command and waits for the state topic to report the new state
+func (m *mqttRelay) set(id string, on bool) error {
+	command, state := m.topics(id)
+	if m.cfg.DryRun {
+		slog.Info("[DRY RUN] Would publish the relay command", "action", onOff(on), "topic", command)
+		return nil
+	}
+	if !m.conn.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to the MQTT broker %s", m.cfg.ShellyMQTTBroker)
+	}
+
+	updates := m.conn.watch(state)
+	defer m.conn.unwatch(state, updates)
+	token := m.conn.client.Publish(command, 1, false, onOff(on))
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		return fmt.Errorf("publishing %s timed out", command)
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("publishing %s: %w", command, err)
+	}
+
+	timeout := time.NewTimer(m.cfg.ShellyMQTTTimeout)
+	defer timeout.Stop()
+	last := "nothing"
+	for {
+		select {
+		case payload := <-updates:
+			if payload == onOff(on) {
+				return nil
+			}
+			last = payload
+		case <-timeout.C:
+			return fmt.Errorf("%s reported %s within %s of turning the relay %s", state, last, m.cfg.ShellyMQTTTimeout, onOff(on))
+		}
+	}
+}
+
+// Status returns the state the Shelly last reported, as Gen1 devices have no request for it
+func (m *mqttRelay) Status(id string) (bool, error) {
+	_, state := m.topics(id)
+	switch payload := m.conn.last(state); payload {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	case "":
+		return false, fmt.Errorf("no state was reported on %s yet", state)
+	default:
+		return false, fmt.Errorf("unexpected relay state %q on %s", payload, state)
+	}
+}
+
+func (m *mqttRelay) Name() string {
+	return "Shelly MQTT at " + m.cfg.ShellyMQTTBroker
+}
+
+// topics returns the command and state topic of the device
+func (m *mqttRelay) topics(id string) (command, state string) {
+	return strings.ReplaceAll(m.cfg.ShellyMQTTTopic, "<id>", id), strings.ReplaceAll(m.cfg.ShellyMQTTStateTopic(), "<id>", id)
+}
+
+// mqttConnection is a connection to SHELLY_MQTT_BROKER that reconnects in the background and keeps the
+// last payload of the subscribed state topics
+type mqttConnection struct {
+	client paho.Client
+
+	mu      sync.Mutex
+	filters []string                 // Subscribed again on every connect
+	states  map[string]string        // Last payload by topic
+	waiters map[string][]chan string // Channels of commands waiting for a topic
+}
+
+// connectMQTT returns the connection of the broker, connecting if there is none yet
+func connectMQTT(cfg *config.Config) *mqttConnection {
+	mqttMu.Lock()
+	defer mqttMu.Unlock()
+	key := cfg.ShellyMQTTBroker + " " + cfg.ShellyMQTTUser
+	if conn, ok := mqttConnections[key]; ok {
+		return conn
+	}
+
+	conn := &mqttConnection{states: map[string]string{}, waiters: map[string][]chan string{}}
+	opts := paho.NewClientOptions().
+		AddBroker(cfg.ShellyMQTTBroker).
+		SetClientID(cfg.MQTTClientID + "-shelly").
+		SetUsername(cfg.ShellyMQTTUser).
+		SetPassword(cfg.ShellyMQTTPassword).
+		SetConnectTimeout(10 * time.Second).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetMaxReconnectInterval(2 * time.Minute).
+		SetOnConnectHandler(func(c paho.Client) {
+			slog.Info("Shelly MQTT connected", "broker", cfg.ShellyMQTTBroker)
+			conn.mu.Lock()
+			filters := append([]string(nil), conn.filters...)
+			conn.mu.Unlock()
+			for _, filter := range filters {
+				c.Subscribe(filter, 1, conn.handle)
+			}
+		}).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			slog.Warn("Shelly MQTT connection lost, reconnecting", "error", err)
+		}).
+		SetReconnectingHandler(func(paho.Client, *paho.ClientOptions) {
+			slog.Info("Shelly MQTT reconnecting", "broker", cfg.ShellyMQTTBroker)
+		})
+	conn.client = paho.NewClient(opts)
+	// With connect retry enabled the token only completes once connected, don't wait for it
+	conn.client.Connect()
+	mqttConnections[key] = conn
+	return conn
+}
+
+// subscribe adds a topic filter, subscribing right away if connected
+func (c *mqttConnection) subscribe(filter string) {
+	c.mu.Lock()
+	for _, f := range c.filters {
+		if f == filter {
+			c.mu.Unlock()
+			return
+		}
+	}
+	c.filters = append(c.filters, filter)
+	c.mu.Unlock()
+	if c.client.IsConnectionOpen() {
+		c.client.Subscribe(filter, 1, c.handle)
+	}
+}
+
+func (c *mqttConnection) handle(_ paho.Client, msg paho.Message) {
+	payload := strings.ToLower(strings.TrimSpace(string(msg.Payload())))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states[msg.Topic()] = payload
+	for _, ch := range c.waiters[msg.Topic()] {
+		select {
+		case ch <- payload:
+		default:
+		}
+	}
+}
+
+// watch returns a channel receiving the payloads of topic until unwatch
+func (c *mqttConnection) watch(topic string) chan string {
+	ch := make(chan string, 4)
+	c.mu.Lock()
+	c.waiters[topic] = append(c.waiters[topic], ch)
+	c.mu.Unlock()
+	return ch
+}
+
+func (c *mqttConnection) unwatch(topic string, ch chan string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	waiters := c.waiters[topic]
+	for i, w := range waiters {
+		if w == ch {
+			c.waiters[topic] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(c.waiters[topic]) == 0 {
+		delete(c.waiters, topic)
+	}
+}
+
+func (c *mqttConnection) last(topic string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.states[topic]
+}
@@ -0,0 +1,55 @@
+// Package relay switches the smart plug the printer is plugged into, with the backend selected by
+// RELAY_TYPE
+package relay
+
+import (
+	"fmt"
+
+	"gome-assistant/internal/config"
+)
+
+// Controller switches the relay of the plug at an address, the host of its URL from the metrics or
+// the config, or the ID of a Shelly in its MQTT topics. On and Off return once the plug confirmed the new state, or right away in a dry run.
+type Controller interface {
+	// On switches the relay on
+	On(address string) error
+	// Off switches the relay off
+	Off(address string) error
+	// Status reads whether the relay is on
+	Status(address string) (bool, error)
+	// Name describes the backend for logs
+	Name() string
+}
+
+// Temperatures is implemented by the backends whose plugs report their internal temperature
+type Temperatures interface {
+	// Temperature reads the temperature in °C, nil if the plug doesn't report one
+	Temperature(address string) (*float64, error)
+}
+
+// SelfTester is implemented by the backends that check their settings against the service at startup
+type SelfTester interface {
+	// SelfTest returns an error if the service rejects the settings
+	SelfTest() error
+}
+
+// New creates the backend selected by RELAY_TYPE
+func New(cfg *config.Config) (Controller, error) {
+	switch cfg.RelayType {
+	case config.RelayShelly:
+		if cfg.ShellyControl == config.ShellyControlMQTT {
+			return newShellyMQTT(cfg), nil
+		}
+		return &shellyRelay{cfg: cfg}, nil
+	case config.RelayTasmota:
+		return newTasmota(cfg), nil
+	case config.RelayKasa:
+		return &kasaRelay{cfg: cfg}, nil
+	case config.RelayTapo:
+		return newTapo(cfg), nil
+	case config.RelayHomeAssistant:
+		return newHomeAssistant(cfg), nil
+	default:
+		return nil, fmt.Errorf("invalid RELAY_TYPE %q", cfg.RelayType)
+	}
+}
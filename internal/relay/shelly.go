@@ -0,0 +1,82 @@
+package relay
+
+import (
+	"log/slog"
+	"sync"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/shelly"
+)
+
+// shellyRelay switches Shelly plugs with the API of their generation
+type shellyRelay struct {
+	cfg *config.Config
+
+	mu         sync.Mutex
+	gen        int    // Generation detected for genAddress, GenUnknown before detection
+	genAddress string // Address the generation was detected for
+}
+
+func (s *shellyRelay) On(address string) error {
+	gen, err := s.generation(address)
+	if err != nil {
+		return err
+	}
+	return shelly.SetRelayOn(s.cfg, address, gen)
+}
+
+func (s *shellyRelay) Off(address string) error {
+	gen, err := s.generation(address)
+	if err != nil {
+		return err
+	}
+	return shelly.SetRelayOff(s.cfg, address, gen)
+}
+
+func (s *shellyRelay) Status(address string) (bool, error) {
+	gen, err := s.generation(address)
+	if err != nil {
+		return false, err
+	}
+	return shelly.RelayOn(s.cfg, address, gen)
+}
+
+func (s *shellyRelay) Temperature(address string) (*float64, error) {
+	gen, err := s.generation(address)
+	if err != nil {
+		return nil, err
+	}
+	return shelly.Temperature(s.cfg, address, gen)
+}
+
+func (s *shellyRelay) Name() string {
+	return "Shelly"
+}
+
+// generation returns the API generation of the Shelly: SHELLY_GEN, or detected once per address.
+// A dry run carries on without a detected generation.
+func (s *shellyRelay) generation(address string) (int, error) {
+	switch s.cfg.ShellyGen {
+	case config.ShellyGen1:
+		return shelly.Gen1, nil
+	case config.ShellyGen2:
+		return shelly.Gen2, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gen != shelly.GenUnknown && s.genAddress == address {
+		return s.gen, nil
+	}
+
+	gen, err := shelly.DetectGen(s.cfg, address)
+	if err != nil {
+		if s.cfg.DryRun {
+			slog.Info("[DRY RUN] Detecting the Shelly generation failed", "error", err)
+			return shelly.GenUnknown, nil
+		}
+		return shelly.GenUnknown, err
+	}
+	slog.Info("Detected the Shelly generation", "gen", gen, "ip", address)
+	s.gen, s.genAddress = gen, address
+	return gen, nil
+}
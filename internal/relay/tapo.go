@@ -0,0 +1,274 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/deviceaddr"
+	"gome-assistant/internal/outbound"
+)
+
+// errTapoAuth is returned when the plug doesn't accept TAPO_USER and TAPO_PASSWORD in the handshake
+var errTapoAuth = errors.New("the Tapo plug rejected TAPO_USER and TAPO_PASSWORD")
+
+// tapoRelay switches TP-Link Tapo plugs like the P110 with set_device_info of their local KLAP
+// protocol: a two-step handshake over HTTP proving the account credentials, then AES-encrypted
+// requests. The session is kept until a request fails.
+type tapoRelay struct {
+	cfg    *config.Config
+	client *http.Client
+
+	mu      sync.Mutex
+	session *klapSession
+}
+
+func newTapo(cfg *config.Config) *tapoRelay {
+	return &tapoRelay{cfg: cfg, client: outbound.Client(5*time.Second, nil)}
+}
+
+func (t *tapoRelay) On(address string) error {
+	return t.set(address, true)
+}
+
+func (t *tapoRelay) Off(address string) error {
+	return t.set(address, false)
+}
+
+func (t *tapoRelay) set(address string, on bool) error {
+	if t.cfg.DryRun {
+		slog.Info("[DRY RUN] Would switch the Tapo plug", "action", onOff(on), "ip", address)
+		return nil
+	}
+	if err := t.call(address, map[string]any{"method": "set_device_info", "params": map[string]bool{"device_on": on}}, nil); err != nil {
+		return err
+	}
+	isOn, err := t.Status(address)
+	if err != nil {
+		return fmt.Errorf("verifying the relay: %w", err)
+	}
+	if isOn != on {
+		return fmt.Errorf("tapo plug is still %s after turning it %s", onOff(isOn), onOff(on))
+	}
+	return nil
+}
+
+func (t *tapoRelay) Status(address string) (bool, error) {
+	var info struct {
+		DeviceOn *bool `json:"device_on"`
+	}
+	if err := t.call(address, map[string]string{"method": "get_device_info"}, &info); err != nil {
+		return false, err
+	}
+	if info.DeviceOn == nil {
+		return false, fmt.Errorf("tapo get_device_info has no device_on")
+	}
+	return *info.DeviceOn, nil
+}
+
+func (t *tapoRelay) Name() string {
+	return "Tapo"
+}
+
+// call sends a request in the session with the plug, handshaking first if there is none for address,
+// and decodes the result into v unless it is nil. A failed request is retried once in a new session,
+// as the plug drops sessions after a while.
+func (t *tapoRelay) call(address string, request, v any) error {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var body []byte
+	for attempt := 0; ; attempt++ {
+		if t.session == nil || t.session.address != address {
+			if t.session, err = t.handshake(address); err != nil {
+				return err
+			}
+		}
+		body, err = t.session.request(t.client, payload)
+		if err == nil {
+			break
+		}
+		t.session = nil
+		if attempt > 0 {
+			return err
+		}
+	}
+
+	var resp struct {
+		ErrorCode int             `json:"error_code"`
+		Result    json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("decoding the tapo response: %w", err)
+	}
+	if resp.ErrorCode != 0 {
+		return fmt.Errorf("tapo request failed with error %d", resp.ErrorCode)
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Result, v); err != nil {
+		return fmt.Errorf("decoding the tapo result: %w", err)
+	}
+	return nil
+}
+
+// klapSession holds the keys derived in the handshake with the plug at address
+type klapSession struct {
+	address string
+	cookie  string
+	key     []byte // AES-128 key
+	iv      []byte // First 12 bytes of the IV, followed by the sequence number
+	sig     []byte // Prefix of the request signatures
+	seq     int32
+}
+
+// handshake proves the credentials to the plug: the plug returns its seed with a hash showing it knows
+// the credentials too, and accepts the session once the client answers with the hash of both seeds
+func (t *tapoRelay) handshake(address string) (*klapSession, error) {
+	localSeed := make([]byte, 16)
+	if _, err := rand.Read(localSeed); err != nil {
+		return nil, err
+	}
+	user := sha1.Sum([]byte(t.cfg.TapoUser))
+	password := sha1.Sum([]byte(t.cfg.TapoPassword))
+	auth := sha256.Sum256(append(user[:], password[:]...))
+
+	body, cookie, err := t.post(address, "/app/handshake1", localSeed, "")
+	if err != nil {
+		return nil, fmt.Errorf("tapo handshake failed: %w", err)
+	}
+	if len(body) != 48 {
+		return nil, fmt.Errorf("tapo handshake failed: unexpected response of %d bytes", len(body))
+	}
+	remoteSeed, serverHash := body[:16], body[16:]
+	if expected := sha256.Sum256(concat(localSeed, remoteSeed, auth[:])); subtle.ConstantTimeCompare(expected[:], serverHash) != 1 {
+		return nil, errTapoAuth
+	}
+
+	proof := sha256.Sum256(concat(remoteSeed, localSeed, auth[:]))
+	if _, _, err := t.post(address, "/app/handshake2", proof[:], cookie); err != nil {
+		return nil, fmt.Errorf("tapo handshake failed: %w", err)
+	}
+
+	seeds := concat(localSeed, remoteSeed, auth[:])
+	key := sha256.Sum256(concat([]byte("lsk"), seeds))
+	iv := sha256.Sum256(concat([]byte("iv"), seeds))
+	sig := sha256.Sum256(concat([]byte("ldk"), seeds))
+	return &klapSession{
+		address: address,
+		cookie:  cookie,
+		key:     key[:16],
+		iv:      iv[:12],
+		sig:     sig[:28],
+		seq:     int32(binary.BigEndian.Uint32(iv[28:])),
+	}, nil
+}
+
+// request encrypts payload with the next sequence number, signs it and returns the decrypted response
+func (s *klapSession) request(client *http.Client, payload []byte) ([]byte, error) {
+	s.seq++
+	seq := binary.BigEndian.AppendUint32(nil, uint32(s.seq))
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	iv := concat(s.iv, seq)
+
+	padding := aes.BlockSize - len(payload)%aes.BlockSize
+	plain := concat(payload, bytes.Repeat([]byte{byte(padding)}, padding))
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plain)
+	signature := sha256.Sum256(concat(s.sig, seq, encrypted))
+
+	apiURL, err := deviceaddr.URL(s.address, "/app/request", "seq="+strconv.Itoa(int(s.seq)))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, apiURL, bytes.NewReader(concat(signature[:], encrypted)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Cookie", s.cookie)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tapo request failed with status %d", resp.StatusCode)
+	}
+	if len(body) < 32+aes.BlockSize || (len(body)-32)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("tapo response of %d bytes is not encrypted", len(body))
+	}
+
+	decrypted := make([]byte, len(body)-32)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, body[32:])
+	padding = int(decrypted[len(decrypted)-1])
+	if padding < 1 || padding > aes.BlockSize {
+		return nil, fmt.Errorf("tapo response has invalid padding")
+	}
+	return decrypted[:len(decrypted)-padding], nil
+}
+
+// post sends a handshake step and returns the body and the session cookie of the response
+func (t *tapoRelay) post(address, path string, body []byte, cookie string) ([]byte, string, error) {
+	apiURL, err := deviceaddr.URL(address, path, "")
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, apiURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	if cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s failed with status %d", path, resp.StatusCode)
+	}
+	for _, c := range resp.Cookies() {
+		if c.Name == "TP_SESSIONID" {
+			cookie = c.Name + "=" + c.Value
+		}
+	}
+	return respBody, cookie, nil
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
@@ -0,0 +1,130 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/deviceaddr"
+	"gome-assistant/internal/outbound"
+)
+
+// tasmotaRelay switches Tasmota plugs via the command endpoint /cm
+type tasmotaRelay struct {
+	cfg    *config.Config
+	client *http.Client
+}
+
+func newTasmota(cfg *config.Config) *tasmotaRelay {
+	return &tasmotaRelay{cfg: cfg, client: outbound.Client(5*time.Second, nil)}
+}
+
+func (t *tasmotaRelay) On(address string) error {
+	return t.set(address, true)
+}
+
+func (t *tasmotaRelay) Off(address string) error {
+	return t.set(address, false)
+}
+
+// set sends Power<n> On or Off, confirmed by the state in the response like {"POWER":"OFF"}
+func (t *tasmotaRelay) set(address string, on bool) error {
+	if t.cfg.DryRun {
+		slog.Info("[DRY RUN] Would switch the Tasmota relay", "action", onOff(on), "relay", t.relay(), "ip", address)
+		return nil
+	}
+	state := "Off"
+	if on {
+		state = "On"
+	}
+	isOn, err := t.command(address, state)
+	if err != nil {
+		return err
+	}
+	if isOn != on {
+		return fmt.Errorf("tasmota relay %d is still %s after turning it %s", t.relay(), onOff(isOn), onOff(on))
+	}
+	return nil
+}
+
+func (t *tasmotaRelay) Status(address string) (bool, error) {
+	return t.command(address, "")
+}
+
+func (t *tasmotaRelay) Name() string {
+	return "Tasmota"
+}
+
+// relay is the Tasmota relay number of SHELLY_RELAY_CHANNEL, which counts from 0 like the Shelly API
+func (t *tasmotaRelay) relay() int {
+	return t.cfg.ShellyRelayChannel + 1
+}
+
+// command sends Power<n> with the argument, empty to only read the state, and returns the relay state
+// of the response
+func (t *tasmotaRelay) command(address, arg string) (bool, error) {
+	cmnd := "Power" + strconv.Itoa(t.relay())
+	if arg != "" {
+		cmnd += " " + arg
+	}
+	query := url.Values{"cmnd": {cmnd}}
+	if t.cfg.TasmotaPassword != "" {
+		query.Set("user", t.cfg.TasmotaUser)
+		query.Set("password", t.cfg.TasmotaPassword)
+	}
+	apiURL, err := deviceaddr.URL(address, "/cm", query.Encode())
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := t.client.Get(apiURL)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusUnauthorized {
+		return false, fmt.Errorf("tasmota rejected the login, check TASMOTA_USER and TASMOTA_PASSWORD")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("tasmota request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result map[string]any
+	if err := json.Unmarshal(body, &result); err != nil {
+		return false, fmt.Errorf("decoding tasmota response %s: %w", string(body), err)
+	}
+	// Single-relay plugs answer POWER instead of POWER1
+	power, ok := result["POWER"+strconv.Itoa(t.relay())].(string)
+	if !ok && t.relay() == 1 {
+		power, ok = result["POWER"].(string)
+	}
+	switch {
+	case !ok:
+		// Tasmota answers {"WARNING":"Need user=<username>&password=<password>"} with a web password set
+		if warning, _ := result["WARNING"].(string); warning != "" {
+			return false, fmt.Errorf("tasmota refused the command: %s, check TASMOTA_PASSWORD", warning)
+		}
+		return false, fmt.Errorf("tasmota response has no state of relay %d: %s", t.relay(), string(body))
+	case power == "ON":
+		return true, nil
+	case power == "OFF":
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected tasmota relay state %q", power)
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
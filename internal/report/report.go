@@ -0,0 +1,120 @@
+// Package report sums up the audit log into monthly savings reports
+package report
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+
+	"gome-assistant/internal/audit"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+// Build reports the month of monthStart, compared with the previous month. The energy saved is the
+// standby power at each auto-off for as long as the printer stayed off, up to now. It costs the
+// electricity price at the auto-off if one was recorded, ENERGY_PRICE otherwise.
+func Build(cfg *config.Config, records []audit.Record, monthStart, now time.Time) controller.MonthlyReport {
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+
+	report := month(cfg, records, monthStart, now)
+	previous := month(cfg, records, monthStart.AddDate(0, -1, 0), now)
+	report.Previous = &previous
+	return report
+}
+
+// MonthStart returns the start of the month of t in the report time zone
+func MonthStart(cfg *config.Config, t time.Time) time.Time {
+	t = t.In(cfg.ReportLocation())
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// month sums up the sorted records for the month starting at start
+func month(cfg *config.Config, records []audit.Record, start, now time.Time) controller.MonthlyReport {
+	end := start.AddDate(0, 1, 0)
+	report := controller.MonthlyReport{Month: start.Format("2006-01"), Partial: len(records) == 0 || records[0].Time.After(start)}
+	if cfg.EnergyPrice > 0 || cfg.PriceSource != config.PriceSourceOff {
+		report.Currency = cfg.EnergyCurrency
+	}
+
+	var idle time.Duration
+	for i, r := range records {
+		if r.Type != "action" || r.Source != controller.SourceAuto || r.Action != controller.ActionOff || r.DryRun {
+			continue
+		}
+		if !r.Time.Before(end) {
+			break
+		}
+		if !r.Time.Before(start) {
+			report.AutoOffs++
+			idle += time.Duration(r.StandbySeconds) * time.Second
+		}
+
+		// Off until the printer draws power again or is switched on
+		offEnd := now
+		for _, next := range records[i+1:] {
+			if next.Device == r.Device && (next.Type == "power_on" || next.Type == "action" && next.Action == controller.ActionOn && !next.DryRun) {
+				offEnd = next.Time
+				break
+			}
+		}
+		from, to := r.Time, offEnd
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(end) {
+			to = end
+		}
+		if off := to.Sub(from); off > 0 {
+			kwh := r.Watts * off.Hours() / 1000
+			report.KWhSaved += kwh
+			// Weighted by the dynamic price at the auto-off where it was known
+			price := cfg.EnergyPrice
+			if r.Price > 0 {
+				price = r.Price
+			}
+			report.CostSaved += kwh * price
+		}
+	}
+
+	if report.AutoOffs > 0 {
+		report.AvgIdleSeconds = int((idle / time.Duration(report.AutoOffs)).Seconds())
+	}
+	return report
+}
+
+// Reporter publishes the report of the previous month on the first check of a month
+type Reporter struct {
+	cfg *config.Config
+	bus *controller.Bus
+
+	// Touched only by the bus subscriber goroutine
+	month time.Time
+}
+
+func New(cfg *config.Config, bus *controller.Bus) *Reporter {
+	return &Reporter{cfg: cfg, bus: bus}
+}
+
+// Handle is the event bus subscriber of the monthly report
+func (r *Reporter) Handle(be controller.BusEvent) error {
+	cycle, ok := be.(controller.CycleCompleted)
+	if !ok {
+		return nil
+	}
+	current := MonthStart(r.cfg, cycle.Time)
+	if r.month.IsZero() || current.Equal(r.month) {
+		r.month = current
+		return nil
+	}
+	r.month = current
+
+	records, err := audit.ReadFile(r.cfg.AuditFile)
+	if err != nil {
+		return err
+	}
+	report := Build(r.cfg, records, current.AddDate(0, -1, 0), cycle.Time)
+	slog.Info("Monthly report", "month", report.Month, "auto_offs", report.AutoOffs, "kwh_saved", report.KWhSaved)
+	r.bus.Publish(controller.MonthlyReportReady{Time: cycle.Time, Report: report})
+	return nil
+}
@@ -0,0 +1,175 @@
+package report
+
+import (
+	"math"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/audit"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+// fixture is an audit log from September to November 2026. It has auto-offs spanning the end of
+// September and of October in Europe/Berlin, and one spanning the end of summer time on October 25.
+var fixture = filepath.Join("testdata", "audit_2026_autumn.jsonl")
+
+// reportTime is when the reports are built, after the last record
+var reportTime = time.Date(2026, 11, 2, 0, 0, 0, 0, time.UTC)
+
+// testConfig returns a configuration with months in the time zone and an energy price of 0.30 EUR
+func testConfig(timezone string) *config.Config {
+	return &config.Config{ReportTimezone: timezone, EnergyPrice: 0.3, EnergyCurrency: "EUR", AuditFile: fixture}
+}
+
+// readFixture returns the records of the fixture audit log
+func readFixture(t *testing.T) []audit.Record {
+	t.Helper()
+	records, err := audit.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// expectReport compares a report with the wanted one, the sums within rounding
+func expectReport(t *testing.T, got, want controller.MonthlyReport) {
+	t.Helper()
+	if got.Month != want.Month || got.Partial != want.Partial || got.AutoOffs != want.AutoOffs || got.AvgIdleSeconds != want.AvgIdleSeconds || got.Currency != want.Currency ||
+		math.Abs(got.KWhSaved-want.KWhSaved) > 1e-9 || math.Abs(got.CostSaved-want.CostSaved) > 1e-9 {
+		got.Previous = nil
+		t.Errorf("report = %+v, want %+v", got, want)
+	}
+}
+
+func TestMonthStart(t *testing.T) {
+	tests := []struct {
+		timezone string
+		at       time.Time
+		want     time.Time
+	}{
+		{"Europe/Berlin", time.Date(2026, 10, 31, 22, 30, 0, 0, time.UTC), time.Date(2026, 9, 30, 22, 0, 0, 0, time.UTC)},
+		// Half an hour before midnight in UTC, already November in Berlin, where summer time has ended
+		{"Europe/Berlin", time.Date(2026, 10, 31, 23, 30, 0, 0, time.UTC), time.Date(2026, 10, 31, 23, 0, 0, 0, time.UTC)},
+		{"UTC", time.Date(2026, 10, 31, 23, 30, 0, 0, time.UTC), time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)},
+		{"America/New_York", time.Date(2026, 11, 1, 3, 0, 0, 0, time.UTC), time.Date(2026, 10, 1, 4, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := MonthStart(testConfig(tt.timezone), tt.at); !got.Equal(tt.want) {
+			t.Errorf("MonthStart(%s) in %s = %s, want %s", tt.at, tt.timezone, got.UTC(), tt.want)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	records := readFixture(t)
+	tests := []struct {
+		name     string
+		timezone string
+		month    time.Time // In UTC, the start of the month follows the time zone
+		want     controller.MonthlyReport
+		previous controller.MonthlyReport
+	}{
+		{
+			name: "October in Berlin", timezone: "Europe/Berlin", month: time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC),
+			// The 01:00 CEST auto-off on October 25 stayed off for 4 hours, though the clock says 3. The
+			// off at 22:00 CEST on September 30 adds its 2 hours after midnight, the one at 23:30 CET on
+			// October 31 its first half hour. 0.4 EUR was the price of the summer time one.
+			want: controller.MonthlyReport{Month: "2026-10", AutoOffs: 2, AvgIdleSeconds: 1050, Currency: "EUR",
+				KWhSaved: 0.020 + 0.036 + 0.006, CostSaved: 0.020*0.3 + 0.036*0.4 + 0.006*0.3},
+			// Recording started on September 3
+			previous: controller.MonthlyReport{Month: "2026-09", Partial: true, AutoOffs: 2, AvgIdleSeconds: 1350, Currency: "EUR",
+				KWhSaved: 0.064 + 0.020, CostSaved: (0.064 + 0.020) * 0.3},
+		},
+		{
+			name: "October in UTC", timezone: "UTC", month: time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC),
+			// The off of September 30 ends at midnight, the one of October 31 lies in October entirely
+			want: controller.MonthlyReport{Month: "2026-10", AutoOffs: 2, AvgIdleSeconds: 1050, Currency: "EUR",
+				KWhSaved: 0.036 + 0.012, CostSaved: 0.036*0.4 + 0.012*0.3},
+			previous: controller.MonthlyReport{Month: "2026-09", Partial: true, AutoOffs: 2, AvgIdleSeconds: 1350, Currency: "EUR",
+				KWhSaved: 0.064 + 0.040, CostSaved: (0.064 + 0.040) * 0.3},
+		},
+		{
+			name: "November in Berlin", timezone: "Europe/Berlin", month: time.Date(2026, 11, 1, 12, 0, 0, 0, time.UTC),
+			// The half hour of the October 31 off after midnight saves energy without an auto-off
+			want: controller.MonthlyReport{Month: "2026-11", Currency: "EUR", KWhSaved: 0.006, CostSaved: 0.006 * 0.3},
+			previous: controller.MonthlyReport{Month: "2026-10", AutoOffs: 2, AvgIdleSeconds: 1050, Currency: "EUR",
+				KWhSaved: 0.020 + 0.036 + 0.006, CostSaved: 0.020*0.3 + 0.036*0.4 + 0.006*0.3},
+		},
+		{
+			name: "before the recording", timezone: "Europe/Berlin", month: time.Date(2026, 8, 15, 0, 0, 0, 0, time.UTC),
+			want:     controller.MonthlyReport{Month: "2026-08", Partial: true, Currency: "EUR"},
+			previous: controller.MonthlyReport{Month: "2026-07", Partial: true, Currency: "EUR"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(tt.timezone)
+			report := Build(cfg, records, MonthStart(cfg, tt.month), reportTime)
+			expectReport(t, report, tt.want)
+			if report.Previous == nil {
+				t.Fatal("no previous month")
+			}
+			expectReport(t, *report.Previous, tt.previous)
+		})
+	}
+}
+
+func TestBuildOpenOff(t *testing.T) {
+	records := readFixture(t)
+	// Still off at the time of the report, the saving runs until then
+	records = records[:len(records)-1]
+	cfg := testConfig("Europe/Berlin")
+	at := time.Date(2026, 11, 1, 1, 0, 0, 0, time.UTC)
+	report := Build(cfg, records, MonthStart(cfg, at), at)
+	if want := 12 * 2.0 / 1000; math.Abs(report.KWhSaved-want) > 1e-9 {
+		t.Errorf("kWh saved = %g, want %g for the 2 hours off so far", report.KWhSaved, want)
+	}
+}
+
+// reports collects the published monthly reports
+type reports struct {
+	mu    sync.Mutex
+	ready []controller.MonthlyReportReady
+}
+
+func (r *reports) Handle(ev controller.BusEvent) error {
+	if ready, ok := ev.(controller.MonthlyReportReady); ok {
+		r.mu.Lock()
+		r.ready = append(r.ready, ready)
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+func TestReporterFirstCheckOfMonth(t *testing.T) {
+	cfg := testConfig("Europe/Berlin")
+	bus := controller.NewBus()
+	published := &reports{}
+	bus.Subscribe("test", 10, published.Handle)
+	reporter := New(cfg, bus)
+
+	for _, at := range []time.Time{
+		time.Date(2026, 10, 31, 22, 0, 0, 0, time.UTC),
+		time.Date(2026, 10, 31, 22, 59, 0, 0, time.UTC),
+		// Midnight in Berlin
+		time.Date(2026, 10, 31, 23, 0, 0, 0, time.UTC),
+		time.Date(2026, 10, 31, 23, 1, 0, 0, time.UTC),
+		time.Date(2026, 11, 1, 12, 0, 0, 0, time.UTC),
+	} {
+		if err := reporter.Handle(controller.CycleCompleted{Time: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bus.Close()
+
+	if len(published.ready) != 1 {
+		t.Fatalf("%d reports published, want one", len(published.ready))
+	}
+	ready := published.ready[0]
+	if !ready.Time.Equal(time.Date(2026, 10, 31, 23, 0, 0, 0, time.UTC)) || ready.Report.Month != "2026-10" || ready.Report.Previous == nil || ready.Report.Previous.Month != "2026-09" {
+		t.Errorf("published %+v, want the October report at midnight in Berlin", ready)
+	}
+}
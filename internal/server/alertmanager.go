@@ -0,0 +1,116 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/controller"
+)
+
+// alertmanagerPayload is the subset of the Alertmanager webhook payload (version 4) we use
+type alertmanagerPayload struct {
+	Version string              `json:"version"`
+	Status  string              `json:"status"`
+	Alerts  []alertmanagerAlert `json:"alerts"`
+}
+
+// alertmanagerAlert is one alert of a webhook notification
+type alertmanagerAlert struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	Fingerprint string            `json:"fingerprint"`
+}
+
+// parsePauseAlerts parses the comma-separated alert names that pause automation
+func parsePauseAlerts(s string) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// handleAlertmanager receives Alertmanager webhook notifications. Firing alerts with a configured
+// name pause automatic switching until they resolve or ALERTMANAGER_PAUSE_TIMEOUT passes without
+// Alertmanager repeating them. They pause every device, or the one the device parameter names.
+func (s *Server) handleAlertmanager(w http.ResponseWriter, r *http.Request) {
+	if !alertmanagerAuthorized(r, s.cfg.AlertmanagerToken) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	targets, ok := s.targets(w, r.URL.Query().Get("device"))
+	if !ok {
+		return
+	}
+
+	var payload alertmanagerPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid Alertmanager payload: "+err.Error())
+		return
+	}
+
+	pauseAlerts := parsePauseAlerts(s.cfg.AlertmanagerPauseAlerts)
+	var updates []controller.AlertUpdate
+	for _, alert := range payload.Alerts {
+		name := alert.Labels["alertname"]
+		if !pauseAlerts[name] || (alert.Status != "firing" && alert.Status != "resolved") {
+			continue
+		}
+		key := alert.Fingerprint
+		if key == "" {
+			key = alertKey(alert.Labels)
+		}
+		updates = append(updates, controller.AlertUpdate{Key: key, AlertName: name, Firing: alert.Status == "firing"})
+	}
+
+	// A single device keeps the plain count, DEVICES adds the count of each device
+	resp := map[string]any{}
+	counts := map[string]int{}
+	for i, d := range targets {
+		active := controller.ApplyAlertUpdates(d.cfg, d.state, updates)
+		if i == 0 {
+			resp["active_pauses"] = active
+		}
+		if d.name != "" {
+			counts[d.name] = active
+		}
+	}
+	if len(counts) > 0 {
+		resp["devices"] = counts
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// alertmanagerAuthorized accepts the shared secret as bearer token or as basic auth password,
+// the two credential types Alertmanager's http_config can send
+func alertmanagerAuthorized(r *http.Request, token string) bool {
+	presented := ""
+	if _, password, ok := r.BasicAuth(); ok {
+		presented = password
+	} else if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		presented = bearer
+	}
+	return presented != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
+// alertKey identifies an alert by its labels when Alertmanager sent no fingerprint
+func alertKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + "=" + labels[k] + ",")
+	}
+	return b.String()
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+const testAlertmanagerToken = "am-secret"
+
+// newAlertmanagerServer returns a server pausing for the VictoriaMetrics and exporter alerts
+func newAlertmanagerServer(t *testing.T) (*Server, *clock.Fake) {
+	t.Helper()
+	cfg := &config.Config{
+		AlertmanagerToken:        testAlertmanagerToken,
+		AlertmanagerPauseAlerts:  "VictoriaMetricsDegraded, PrinterExporterDown",
+		AlertmanagerPauseTimeout: 6 * time.Hour,
+	}
+	clk := clock.NewFake(time.Date(2026, 3, 1, 20, 11, 0, 0, time.UTC))
+	state := &controller.State{Clock: clk}
+	s, err := New(cfg, state, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s, clk
+}
+
+// postFixture posts the Alertmanager payload of testdata/name with the shared secret as bearer token
+func postFixture(t *testing.T, s *Server, name string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/alertmanager", strings.NewReader(string(body)))
+	req.Header.Set("Authorization", "Bearer "+testAlertmanagerToken)
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func alertPause(s *Server) *controller.AlertPause {
+	return controller.GetStatus(s.cfg, s.state).AlertPause
+}
+
+func TestAlertmanagerFiringPausesUntilResolved(t *testing.T) {
+	s, clk := newAlertmanagerServer(t)
+
+	rec := postFixture(t, s, "alertmanager_firing.json")
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"active_pauses":1}` {
+		t.Fatalf("firing: %d %s", rec.Code, rec.Body)
+	}
+	pause := alertPause(s)
+	if pause == nil || pause.AlertName != "VictoriaMetricsDegraded" {
+		t.Fatalf("pause = %+v, want VictoriaMetricsDegraded (DiskAlmostFull isn't configured)", pause)
+	}
+
+	// Alertmanager repeats the notification, which doesn't start another pause
+	clk.Advance(4 * time.Hour)
+	if rec := postFixture(t, s, "alertmanager_firing.json"); !strings.Contains(rec.Body.String(), `"active_pauses":1`) {
+		t.Fatalf("repeat: %s", rec.Body)
+	}
+	if got := alertPause(s); got == nil || !got.Since.Equal(pause.Since) {
+		t.Errorf("pause after the repeat = %+v, want it since %s", got, pause.Since)
+	}
+
+	if rec := postFixture(t, s, "alertmanager_resolved.json"); !strings.Contains(rec.Body.String(), `"active_pauses":0`) {
+		t.Fatalf("resolved: %s", rec.Body)
+	}
+	if got := alertPause(s); got != nil {
+		t.Errorf("pause after resolved = %+v", got)
+	}
+}
+
+func TestAlertmanagerPauseTimesOut(t *testing.T) {
+	s, clk := newAlertmanagerServer(t)
+	postFixture(t, s, "alertmanager_firing.json")
+
+	clk.Advance(6*time.Hour - time.Second)
+	if alertPause(s) == nil {
+		t.Fatal("pause ended before the timeout")
+	}
+	// A repeat extends the timeout
+	postFixture(t, s, "alertmanager_firing.json")
+	clk.Advance(6*time.Hour - time.Second)
+	if alertPause(s) == nil {
+		t.Fatal("repeat didn't extend the timeout")
+	}
+	// A missed resolved notification doesn't pause forever
+	clk.Advance(time.Second)
+	if got := alertPause(s); got != nil {
+		t.Errorf("pause after the timeout = %+v", got)
+	}
+}
+
+func TestAlertmanagerAlertWithoutFingerprint(t *testing.T) {
+	s, _ := newAlertmanagerServer(t)
+	postFixture(t, s, "alertmanager_no_fingerprint.json")
+	if pause := alertPause(s); pause == nil || pause.AlertName != "PrinterExporterDown" {
+		t.Fatalf("pause = %+v, want PrinterExporterDown", pause)
+	}
+	// Identified by its labels, the same alert doesn't pause twice
+	if rec := postFixture(t, s, "alertmanager_no_fingerprint.json"); !strings.Contains(rec.Body.String(), `"active_pauses":1`) {
+		t.Errorf("repeat: %s", rec.Body)
+	}
+}
+
+func TestAlertmanagerAuthorization(t *testing.T) {
+	s, _ := newAlertmanagerServer(t)
+	body, err := os.ReadFile("testdata/alertmanager_firing.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		auth func(*http.Request)
+		want int
+	}{
+		{"none", func(*http.Request) {}, http.StatusUnauthorized},
+		{"wrong bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+		{"empty bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer ") }, http.StatusUnauthorized},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("alertmanager", "nope") }, http.StatusUnauthorized},
+		{"basic auth", func(r *http.Request) { r.SetBasicAuth("alertmanager", testAlertmanagerToken) }, http.StatusOK},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+testAlertmanagerToken) }, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/alertmanager", strings.NewReader(string(body)))
+		tt.auth(req)
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestAlertmanagerRejectsInvalidPayload(t *testing.T) {
+	s, _ := newAlertmanagerServer(t)
+	req := httptest.NewRequest(http.MethodPost, "/alertmanager", strings.NewReader(`{"alerts":`))
+	req.Header.Set("Authorization", "Bearer "+testAlertmanagerToken)
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gome-assistant/internal/audit"
+	"gome-assistant/internal/controller"
+	"gome-assistant/internal/report"
+)
+
+// SourceAPI attributes actions to the HTTP control API
+const SourceAPI = "api"
+
+// registerAPI adds the control API routes to the listener
+func (s *Server) registerAPI() {
+	s.mux.HandleFunc("GET /status", s.authorize(accessRead, s.handleStatus))
+	s.mux.HandleFunc("GET /decisions", s.authorize(accessRead, s.handleDecisions))
+	s.mux.HandleFunc("GET /actions", s.authorize(accessRead, s.handleActions))
+	s.mux.HandleFunc("GET /events", s.authorize(accessRead, s.handleEvents))
+	s.mux.HandleFunc("GET /countdown", s.authorize(accessRead, s.handleCountdown))
+	s.mux.HandleFunc("POST /hold", s.authorize(accessWrite, s.handleSetHold))
+	s.mux.HandleFunc("DELETE /hold", s.authorize(accessWrite, s.handleClearHold))
+	s.mux.HandleFunc("POST /veto", s.authorize(accessWrite, s.handleVeto))
+	s.mux.HandleFunc("POST /relay/{action}", s.authorize(accessWrite, s.handleRelay))
+	s.mux.HandleFunc("POST /trigger/print-queued", s.authorize(accessWrite, s.handlePrintQueued))
+	s.mux.HandleFunc("POST /trigger/print-finished", s.authorize(accessWrite, s.handlePrintFinished))
+	if s.cfg.AuditFile != "" {
+		s.mux.HandleFunc("GET /reports", s.authorize(accessRead, s.handleReports))
+	}
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.queryDevice(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, controller.GetStatus(d.cfg, d.state))
+}
+
+// handleDecisions returns the most recent decisions, newest first (?limit=n)
+func (s *Server) handleDecisions(w http.ResponseWriter, r *http.Request) {
+	limit, ok := queryLimit(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.history.Decisions.Recent(limit))
+}
+
+// handleActions returns the most recent relay actions, newest first (?limit=n)
+func (s *Server) handleActions(w http.ResponseWriter, r *http.Request) {
+	limit, ok := queryLimit(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.history.Actions.Recent(limit))
+}
+
+// queryLimit parses the limit query parameter, answering the request itself if it is invalid
+func queryLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return 100, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		writeError(w, http.StatusBadRequest, "invalid limit")
+		return 0, false
+	}
+	return n, true
+}
+
+// holdRequest is the body of POST /hold
+type holdRequest struct {
+	Duration string `json:"duration"`
+	Device   string `json:"device"` // Name in DEVICES or Shelly device name, every device if empty
+}
+
+func (s *Server) handleSetHold(w http.ResponseWriter, r *http.Request) {
+	var req holdRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 {
+		writeError(w, http.StatusBadRequest, "duration must be a positive duration such as 2h")
+		return
+	}
+	s.setHold(w, r, req.Device, d)
+}
+
+func (s *Server) handleClearHold(w http.ResponseWriter, r *http.Request) {
+	s.setHold(w, r, r.URL.Query().Get("device"), 0)
+}
+
+// setHold sets or, with d of 0, clears the hold of the named device or of every device, and answers with
+// the status of the first of them
+func (s *Server) setHold(w http.ResponseWriter, r *http.Request, name string, d time.Duration) {
+	targets, ok := s.targets(w, name)
+	if !ok {
+		return
+	}
+	for _, dev := range targets {
+		controller.SetHold(dev.state, d, apiSource(r))
+	}
+	writeJSON(w, http.StatusOK, controller.GetStatus(targets[0].cfg, targets[0].state))
+}
+
+func (s *Server) handleVeto(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.queryDevice(w, r)
+	if !ok {
+		return
+	}
+	if err := controller.VetoPendingOff(d.state, apiSource(r)); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, controller.GetStatus(d.cfg, d.state))
+}
+
+func (s *Server) handleRelay(w http.ResponseWriter, r *http.Request) {
+	action := r.PathValue("action")
+	if action != controller.ActionOn && action != controller.ActionOff {
+		writeError(w, http.StatusNotFound, "unknown relay action "+action)
+		return
+	}
+	d, ok := s.queryDevice(w, r)
+	if !ok {
+		return
+	}
+
+	if err := controller.SwitchRelay(d.cfg, d.state, action == controller.ActionOn, apiSource(r)); err != nil {
+		writeError(w, switchErrorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, controller.GetStatus(d.cfg, d.state))
+}
+
+// switchErrorStatus maps a failed relay command to the status of its response
+func switchErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, controller.ErrNoShellyIP):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, controller.ErrNotLeader), errors.Is(err, controller.ErrDuplicateController):
+		return http.StatusConflict
+	case errors.Is(err, controller.ErrRateLimited):
+		return http.StatusTooManyRequests
+	}
+	return http.StatusBadGateway
+}
+
+func (s *Server) handleCountdown(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.queryDevice(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, controller.GetCountdown(d.cfg, d.state))
+}
+
+// handleReports returns the savings report of a month from the audit log (?month=2026-09, default the
+// current month so far)
+func (s *Server) handleReports(w http.ResponseWriter, r *http.Request) {
+	now := s.state.Clock.Now()
+	start := report.MonthStart(s.cfg, now)
+	if v := r.URL.Query().Get("month"); v != "" {
+		t, err := time.ParseInLocation("2006-01", v, s.cfg.ReportLocation())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "month must look like 2026-09")
+			return
+		}
+		start = t
+	}
+
+	records, err := audit.ReadFile(s.cfg.AuditFile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "reading audit log: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, report.Build(s.cfg, records, start, now))
+}
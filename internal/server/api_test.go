@@ -0,0 +1,387 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/audit"
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+	"gome-assistant/internal/metrics"
+	"gome-assistant/internal/metrics/metricstest"
+	"gome-assistant/internal/printer"
+	"gome-assistant/internal/relay"
+	"gome-assistant/internal/shelly/shellytest"
+)
+
+const (
+	testAdminToken = "admin-secret"
+	testReadToken  = "read-secret"
+)
+
+// testBackend is the real HTTP server of a controller against a fake VictoriaMetrics and a fake Shelly
+type testBackend struct {
+	cfg    *config.Config
+	server *Server
+	state  *controller.State
+	vm     *metricstest.VM
+	plug   *shellytest.Plug
+	url    string
+	audit  string // Path of the audit log
+}
+
+// newTestBackend serves the API of a controller whose printer has been idle at 8 W for 40 minutes.
+// configure adjusts the default settings.
+func newTestBackend(t *testing.T, configure ...func(cfg *config.Config)) *testBackend {
+	t.Helper()
+	plug := shellytest.NewPlug(t, 1)
+	now := time.Now().Truncate(time.Second)
+	vm := metricstest.NewVM(t,
+		metricstest.Series{Labels: metricstest.ShellyWatts("bambu-plug", plug.Address()), Samples: metricstest.Constant(now.Add(-40*time.Minute), now, time.Minute, 8)},
+		metricstest.Series{Labels: metricstest.GcodeState("x1c"), Samples: metricstest.Constant(now.Add(-40*time.Minute), now, time.Minute, 0)},
+	)
+	b := &testBackend{vm: vm, plug: plug, audit: filepath.Join(t.TempDir(), "audit.jsonl")}
+
+	b.cfg = &config.Config{
+		VictoriaMetricsURL:      vm.URL,
+		VictoriaMetricsPassword: "vm-secret",
+		ShellyDevicePattern:     ".*[Bb]ambu.*",
+		ShellyNameLabel:         "device_name",
+		ShellyAddressLabel:      "ip_address",
+		DecisionHistorySize:     720,
+		ActionHistorySize:       100,
+		CheckInterval:           time.Minute,
+		MinWatts:                7,
+		MaxWatts:                9,
+		StandbyDuration:         15 * time.Minute,
+		BootGracePeriod:         20 * time.Minute,
+		OffCooldown:             10 * time.Minute,
+		QueryConcurrency:        4,
+		QueryTimeout:            10 * time.Second,
+		MaxRangePoints:          2000,
+		HeartbeatMode:           config.HeartbeatOff,
+		PreActionHookFailure:    config.PreActionAllow,
+		PrinterSource:           config.PrinterSourceBambu,
+		RelayType:               config.RelayShelly,
+		FailureNotifyThreshold:  3,
+		APITokens:               "admin:" + testAdminToken + ",dashboard:" + testReadToken + ":read",
+		AuditFile:               b.audit,
+	}
+	for _, fn := range configure {
+		fn(b.cfg)
+	}
+
+	bus := controller.NewBus()
+	client := metrics.NewHTTPClient(b.cfg)
+	source, err := printer.New(b.cfg, client, clock.Real{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugRelay, err := relay.New(b.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.state = &controller.State{Bus: bus, Metrics: client, Printer: source, Relay: plugRelay, Clock: clock.Real{}}
+	hist := controller.NewHistory(b.cfg)
+	bus.Subscribe("history", controller.DefaultBusBuffer, hist.Handle)
+	auditLog, err := audit.New(b.audit, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus.Subscribe("audit", controller.DefaultBusBuffer, auditLog.Handle)
+
+	s, err := New(b.cfg, b.state, hist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus.Subscribe("event stream", controller.DefaultBusBuffer, s.Handle)
+	b.server = s
+	srv := httptest.NewServer(s.srv.Handler)
+	b.url = srv.URL
+	t.Cleanup(func() {
+		srv.Close()
+		bus.Close()
+		auditLog.Close()
+	})
+	return b
+}
+
+// cycle runs a check cycle of the controller
+func (b *testBackend) cycle() {
+	controller.RunCycle(context.Background(), b.cfg, b.state)
+}
+
+// do sends a request with the bearer token, "" for none, and decodes the JSON response into v unless it is nil
+func (b *testBackend) do(t *testing.T, method, path, token, body string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, b.url+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("%s %s: Content-Type = %q", method, path, got)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	if v != nil {
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatalf("%s %s: decoding %s: %v", method, path, data, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// eventually waits for cond, which the asynchronous bus subscribers fulfill
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// auditRecords reads the audit log
+func (b *testBackend) auditRecords(t *testing.T) []audit.Record {
+	t.Helper()
+	f, err := os.Open(b.audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	var records []audit.Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r audit.Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("audit line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAPIStatusAndDecisions(t *testing.T) {
+	b := newTestBackend(t)
+	b.cycle()
+
+	var status controller.Status
+	if code := b.do(t, http.MethodGet, "/status", testReadToken, "", &status); code != http.StatusOK {
+		t.Fatalf("GET /status = %d", code)
+	}
+	if status.Device != "bambu-plug" || status.ShellyIP != b.plug.Address() || status.Watts == nil || *status.Watts != 8 {
+		t.Errorf("status = device %q, ip %q, watts %v", status.Device, status.ShellyIP, status.Watts)
+	}
+	if status.LastCycle == nil || status.LastCycleError != "" {
+		t.Errorf("last cycle = %v, error %q", status.LastCycle, status.LastCycleError)
+	}
+
+	var decisions []controller.DecisionRecord
+	eventually(t, "the decision", func() bool {
+		b.do(t, http.MethodGet, "/decisions?limit=5", testReadToken, "", &decisions)
+		return len(decisions) > 0
+	})
+	// 40 minutes at 8 W, but the standby count starts within the lookback of the range query
+	if d := decisions[0]; d.Device != "bambu-plug" || d.Watts != 8 || (d.Outcome != controller.OutcomeStandby && d.Outcome != controller.OutcomeTurnOff) {
+		t.Errorf("decision = %+v", d)
+	}
+	if code := b.do(t, http.MethodGet, "/decisions?limit=x", testReadToken, "", nil); code != http.StatusBadRequest {
+		t.Errorf("invalid limit = %d, want 400", code)
+	}
+}
+
+func TestAPIAuthorization(t *testing.T) {
+	b := newTestBackend(t)
+	tests := []struct {
+		method, path, token string
+		want                int
+	}{
+		{http.MethodGet, "/status", "", http.StatusUnauthorized},
+		{http.MethodGet, "/status", "wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/status", testReadToken, http.StatusOK},
+		{http.MethodPost, "/hold", "", http.StatusUnauthorized},
+		{http.MethodPost, "/hold", testReadToken, http.StatusForbidden},
+		{http.MethodDelete, "/hold", testReadToken, http.StatusForbidden},
+		{http.MethodPost, "/veto", testReadToken, http.StatusForbidden},
+		{http.MethodPost, "/relay/off", testReadToken, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		var body apiError
+		code := b.do(t, tt.method, tt.path, tt.token, `{"duration":"1h"}`, &body)
+		if code != tt.want {
+			t.Errorf("%s %s with %q = %d, want %d", tt.method, tt.path, tt.token, code, tt.want)
+		}
+		if code != http.StatusOK && body.Error == "" {
+			t.Errorf("%s %s: error response without a message", tt.method, tt.path)
+		}
+	}
+	if b.plug.Commands() != nil {
+		t.Errorf("unauthorized requests switched the relay: %v", b.plug.Commands())
+	}
+}
+
+func TestAPIHoldBlocksTheAutoOff(t *testing.T) {
+	b := newTestBackend(t, func(cfg *config.Config) { cfg.StandbyDuration = 10 * time.Minute })
+
+	var status controller.Status
+	if code := b.do(t, http.MethodPost, "/hold", testAdminToken, `{"duration":"2h"}`, &status); code != http.StatusOK {
+		t.Fatalf("POST /hold = %d", code)
+	}
+	if status.HoldUntil == nil || time.Until(*status.HoldUntil) < 119*time.Minute {
+		t.Fatalf("hold_until = %v, want in 2h", status.HoldUntil)
+	}
+
+	b.cycle()
+	if !b.plug.On() {
+		t.Fatal("the relay was switched off during the hold")
+	}
+	if d := b.state.LastDecision; d == nil || d.Reason != controller.ReasonHold {
+		t.Errorf("decision = %+v, want a skip for the hold", d)
+	}
+
+	var cleared controller.Status
+	if code := b.do(t, http.MethodDelete, "/hold", testAdminToken, "", &cleared); code != http.StatusOK || cleared.HoldUntil != nil {
+		t.Fatalf("DELETE /hold = %d, hold_until %v", code, cleared.HoldUntil)
+	}
+	b.cycle()
+	if b.plug.On() {
+		t.Error("the relay is still on after clearing the hold")
+	}
+
+	eventually(t, "the audit records", func() bool { return len(b.auditRecords(t)) >= 3 })
+	records := b.auditRecords(t)
+	for i, want := range []struct{ typ, source, action string }{
+		{"control", "api:admin", "hold"},
+		{"control", "api:admin", "hold_clear"},
+		{"action", controller.SourceAuto, controller.ActionOff},
+	} {
+		if r := records[i]; r.Type != want.typ || r.Source != want.source || r.Action != want.action {
+			t.Errorf("audit record %d = %+v, want %s %s by %s", i+1, r, want.typ, want.action, want.source)
+		}
+	}
+}
+
+func TestAPIHoldRejectsInvalidDurations(t *testing.T) {
+	b := newTestBackend(t)
+	for _, body := range []string{`{"duration":"soon"}`, `{"duration":"-1h"}`, `{}`, `{"duration":`} {
+		var resp apiError
+		if code := b.do(t, http.MethodPost, "/hold", testAdminToken, body, &resp); code != http.StatusBadRequest || resp.Error == "" {
+			t.Errorf("POST /hold %s = %d %+v, want 400 with an error", body, code, resp)
+		}
+	}
+}
+
+func TestAPIVetoCancelsThePendingOff(t *testing.T) {
+	b := newTestBackend(t, func(cfg *config.Config) {
+		cfg.StandbyDuration = 10 * time.Minute
+		cfg.VetoWindow = 10 * time.Minute
+	})
+
+	var resp apiError
+	if code := b.do(t, http.MethodPost, "/veto", testAdminToken, "", &resp); code != http.StatusConflict || resp.Error != "no auto-off is pending" {
+		t.Errorf("POST /veto without a pending off = %d %+v", code, resp)
+	}
+
+	b.cycle()
+	var status controller.Status
+	b.do(t, http.MethodGet, "/status", testAdminToken, "", &status)
+	if status.PendingOffAt == nil {
+		t.Fatalf("no pending off after the standby, decision %+v", b.state.LastDecision)
+	}
+	var vetoed controller.Status
+	if code := b.do(t, http.MethodPost, "/veto", testAdminToken, "", &vetoed); code != http.StatusOK || vetoed.PendingOffAt != nil {
+		t.Fatalf("POST /veto = %d, pending_off_at %v", code, vetoed.PendingOffAt)
+	}
+	b.cycle()
+	if !b.plug.On() {
+		t.Error("the relay was switched off after the veto")
+	}
+}
+
+func TestAPIManualRelay(t *testing.T) {
+	b := newTestBackend(t)
+
+	// The Shelly address is only known from the metrics of a cycle
+	var resp apiError
+	if code := b.do(t, http.MethodPost, "/relay/off", testAdminToken, "", &resp); code != http.StatusServiceUnavailable {
+		t.Errorf("POST /relay/off before a cycle = %d %+v, want 503", code, resp)
+	}
+	b.do(t, http.MethodPost, "/hold", testAdminToken, `{"duration":"1h"}`, nil)
+	b.cycle()
+
+	var status controller.Status
+	if code := b.do(t, http.MethodPost, "/relay/off", testAdminToken, "", &status); code != http.StatusOK || b.plug.On() {
+		t.Fatalf("POST /relay/off = %d, relay on %v", code, b.plug.On())
+	}
+	if code := b.do(t, http.MethodPost, "/relay/on", testAdminToken, "", &status); code != http.StatusOK || !b.plug.On() {
+		t.Fatalf("POST /relay/on = %d, relay on %v", code, b.plug.On())
+	}
+	if code := b.do(t, http.MethodPost, "/relay/toggle", testAdminToken, "", &resp); code != http.StatusNotFound {
+		t.Errorf("POST /relay/toggle = %d, want 404", code)
+	}
+
+	b.plug.Fail(http.StatusInternalServerError)
+	if code := b.do(t, http.MethodPost, "/relay/off", testAdminToken, "", &resp); code != http.StatusBadGateway || resp.Error == "" {
+		t.Errorf("POST /relay/off with a failing plug = %d %+v, want 502", code, resp)
+	}
+
+	var actions []controller.ActionRecord
+	eventually(t, "the actions", func() bool {
+		b.do(t, http.MethodGet, "/actions", testAdminToken, "", &actions)
+		return len(actions) == 3
+	})
+	for i, want := range []struct{ action, result string }{{controller.ActionOff, "failed"}, {controller.ActionOn, "ok"}, {controller.ActionOff, "ok"}} {
+		if a := actions[i]; a.Action != want.action || a.Result != want.result || a.Source != "api:admin" {
+			t.Errorf("action %d = %+v, want %s %s by api:admin", i+1, a, want.action, want.result)
+		}
+	}
+	eventually(t, "the audit records", func() bool {
+		n := 0
+		for _, r := range b.auditRecords(t) {
+			if strings.HasPrefix(r.Type, "action") && r.Source == "api:admin" {
+				n++
+			}
+		}
+		return n == 3
+	})
+}
+
+func TestAPIManualRelayInDryRun(t *testing.T) {
+	b := newTestBackend(t, func(cfg *config.Config) { cfg.DryRun = true })
+	b.do(t, http.MethodPost, "/hold", testAdminToken, `{"duration":"1h"}`, nil)
+	b.cycle()
+
+	if code := b.do(t, http.MethodPost, "/relay/off", testAdminToken, "", nil); code != http.StatusOK {
+		t.Fatalf("POST /relay/off = %d", code)
+	}
+	if !b.plug.On() || len(b.plug.Commands()) != 0 {
+		t.Errorf("the dry run sent %v", b.plug.Commands())
+	}
+	var actions []controller.ActionRecord
+	eventually(t, "the action", func() bool {
+		b.do(t, http.MethodGet, "/actions", testAdminToken, "", &actions)
+		return len(actions) == 1
+	})
+	if actions[0].Result != "dry_run" {
+		t.Errorf("action = %+v, want a dry run", actions[0])
+	}
+}
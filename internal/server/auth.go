@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"gome-assistant/internal/config"
+)
+
+// routeAccess classifies routes of the internal listener for authorization
+type routeAccess int
+
+const (
+	accessProbe routeAccess = iota // Scraping and health checks
+	accessRead                     // Read-only API
+	accessWrite                    // Mutating API
+)
+
+// apiToken is a labeled bearer token of the internal listener
+type apiToken struct {
+	label    string
+	token    []byte
+	readOnly bool
+}
+
+// principalKey stores the label of the authenticated token in the request context
+type principalKey struct{}
+
+// parseAPITokens parses API_TOKENS ("label:token[:read],...") and the unlabeled API_TOKEN
+func parseAPITokens(cfg *config.Config) ([]apiToken, error) {
+	var tokens []apiToken
+	if cfg.APIToken != "" {
+		tokens = append(tokens, apiToken{label: "default", token: []byte(cfg.APIToken)})
+	}
+
+	labels := map[string]bool{}
+	for _, entry := range strings.Split(cfg.APITokens, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			// Don't echo the entry, it contains a token
+			return nil, fmt.Errorf("API_TOKENS entries must be label:token or label:token:read")
+		}
+		t := apiToken{label: parts[0], token: []byte(parts[1])}
+		if len(parts) == 3 {
+			if parts[2] != "read" {
+				return nil, fmt.Errorf("invalid scope %q of API token %s (expected read)", parts[2], t.label)
+			}
+			t.readOnly = true
+		}
+		if labels[t.label] {
+			return nil, fmt.Errorf("duplicate API token label %s", t.label)
+		}
+		labels[t.label] = true
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+// authenticate returns the token matching the request's bearer token
+func (s *Server) authenticate(r *http.Request) (*apiToken, bool) {
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || presented == "" {
+		return nil, false
+	}
+	var match *apiToken
+	// Compare against every token so the timing doesn't reveal which one matched
+	for i := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(presented), s.tokens[i].token) == 1 {
+			match = &s.tokens[i]
+		}
+	}
+	return match, match != nil
+}
+
+// authorize wraps a handler with the authentication required by its access class
+func (s *Server) authorize(access routeAccess, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		public := (access == accessProbe && !s.cfg.APIAuthProbes) ||
+			(access == accessRead && (s.cfg.APIReadPublic || len(s.tokens) == 0))
+		if public {
+			next(w, r)
+			return
+		}
+
+		if len(s.tokens) == 0 {
+			writeError(w, http.StatusForbidden, "control API disabled, set API_TOKEN or API_TOKENS to enable it")
+			return
+		}
+		token, ok := s.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gome-assistant"`)
+			writeError(w, http.StatusUnauthorized, "missing or invalid API token")
+			return
+		}
+		if access == accessWrite && token.readOnly {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("API token %s is read-only", token.label))
+			return
+		}
+		if access == accessWrite {
+			slog.Info("API request", "method", r.Method, "path", r.URL.Path, "token", token.label)
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, token.label)))
+	}
+}
+
+// apiSource attributes actions of a request to the API and the label of its token
+func apiSource(r *http.Request) string {
+	if label, ok := r.Context().Value(principalKey{}).(string); ok && label != "default" {
+		return SourceAPI + ":" + label
+	}
+	return SourceAPI
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// corsMaxAge lets browsers cache preflight responses for an hour
+const corsMaxAge = "3600"
+
+// corsPolicy allows browsers on other origins to call the HTTP API
+type corsPolicy struct {
+	origins     []string // Exact origins, "*" or patterns like https://*.example.com
+	credentials bool
+}
+
+// parseCORSOrigins parses the comma-separated CORS_ALLOWED_ORIGINS
+func parseCORSOrigins(s string) ([]string, error) {
+	var origins []string
+	for _, origin := range strings.Split(s, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		if origin != "*" && !strings.Contains(origin, "://") {
+			return nil, fmt.Errorf("CORS origin %q must include the scheme, e.g. https://dash.example.com", origin)
+		}
+		if strings.Count(origin, "*") > 1 {
+			return nil, fmt.Errorf("CORS origin %q may contain only one wildcard", origin)
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
+}
+
+// allowed reports whether the origin matches the allow-list
+func (p *corsPolicy) allowed(origin string) bool {
+	for _, pattern := range p.origins {
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(pattern, "*"); ok &&
+			len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap adds CORS headers for allowed origins and answers preflight requests
+func (p *corsPolicy) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed := p.allowed(origin)
+		if allowed {
+			// Echo the origin rather than "*", which browsers reject for credentialed requests
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if p.credentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Preflight
+		if !allowed {
+			writeError(w, http.StatusForbidden, "origin not allowed")
+			return
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+// newCORSServer returns the handler of a server allowing the origins
+func newCORSServer(t *testing.T, origins string, credentials bool) http.Handler {
+	t.Helper()
+	cfg := &config.Config{APIToken: testAdminToken, CORSAllowedOrigins: origins, CORSAllowCredentials: credentials}
+	s, err := New(cfg, &controller.State{Clock: clock.Real{}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.srv.Handler
+}
+
+// preflight sends the browser's OPTIONS request for a POST with an Authorization header
+func preflight(h http.Handler, path, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodOptions, path, nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	req.Header.Set("Access-Control-Request-Headers", "authorization,content-type")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := newCORSServer(t, "https://dash.example.com, https://*.home.arpa", false)
+	tests := []struct {
+		origin string
+		allow  bool
+	}{
+		{"https://dash.example.com", true},
+		{"https://grafana.home.arpa", true},
+		{"https://evil.example.com", false},
+		{"http://dash.example.com", false},
+		{"https://.home.arpa", false},
+		{"https://home.arpa.evil.com", false},
+	}
+	for _, tt := range tests {
+		rec := preflight(h, "/hold", tt.origin)
+		got := rec.Header().Get("Access-Control-Allow-Origin")
+		if tt.allow {
+			if rec.Code != http.StatusNoContent || got != tt.origin {
+				t.Errorf("%s: preflight = %d, Allow-Origin %q, want 204 echoing the origin", tt.origin, rec.Code, got)
+			}
+			if headers := rec.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(headers, "Authorization") {
+				t.Errorf("%s: Allow-Headers = %q, want Authorization", tt.origin, headers)
+			}
+			if methods := rec.Header().Get("Access-Control-Allow-Methods"); methods != "GET, POST, DELETE" {
+				t.Errorf("%s: Allow-Methods = %q", tt.origin, methods)
+			}
+			if age := rec.Header().Get("Access-Control-Max-Age"); age != corsMaxAge {
+				t.Errorf("%s: Max-Age = %q", tt.origin, age)
+			}
+		} else if rec.Code != http.StatusForbidden || got != "" {
+			t.Errorf("%s: preflight = %d, Allow-Origin %q, want 403 without CORS headers", tt.origin, rec.Code, got)
+		}
+		if creds := rec.Header().Get("Access-Control-Allow-Credentials"); creds != "" {
+			t.Errorf("%s: Allow-Credentials = %q without enabling it", tt.origin, creds)
+		}
+		if vary := rec.Header().Values("Vary"); len(vary) == 0 || vary[0] != "Origin" {
+			t.Errorf("%s: Vary = %v, want Origin", tt.origin, vary)
+		}
+	}
+}
+
+func TestCORSRequests(t *testing.T) {
+	h := newCORSServer(t, "https://dash.example.com", true)
+	get := func(origin, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/status", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("https://dash.example.com", testAdminToken)
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "https://dash.example.com" || rec.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("allowed origin = %d %v", rec.Code, rec.Header())
+	}
+	// CORS is no authorization: the token is still required
+	if rec := get("https://dash.example.com", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("allowed origin without a token = %d, want 401", rec.Code)
+	}
+	// The browser enforces the policy, the server still answers
+	rec = get("https://evil.example.com", testAdminToken)
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "" || rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("disallowed origin = %d %v, want no CORS headers", rec.Code, rec.Header())
+	}
+	// An OPTIONS request that is no preflight reaches the API
+	req := httptest.NewRequest(http.MethodOptions, "/status", nil)
+	req.Header.Set("Origin", "https://dash.example.com")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("OPTIONS without a request method = %d, want 405 from the API", rec.Code)
+	}
+}
+
+func TestCORSDisabledByDefault(t *testing.T) {
+	h := newCORSServer(t, "", false)
+	rec := preflight(h, "/hold", "https://dash.example.com")
+	for key := range rec.Header() {
+		if strings.HasPrefix(key, "Access-Control-") || key == "Vary" {
+			t.Errorf("%s set without CORS_ALLOWED_ORIGINS", key)
+		}
+	}
+	if rec.Code == http.StatusNoContent {
+		t.Error("the preflight succeeded without CORS_ALLOWED_ORIGINS")
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	rec := preflight(newCORSServer(t, "*", false), "/status", "https://anything.example")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "https://anything.example" {
+		t.Errorf("wildcard preflight = %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestCORSConfig(t *testing.T) {
+	tests := []struct {
+		origins     string
+		credentials bool
+		err         string
+	}{
+		{"https://a.example, https://b.example/", false, ""},
+		{"dash.example.com", false, "must include the scheme"},
+		{"https://*.*.example.com", false, "only one wildcard"},
+		{"*", true, "can't be combined with the * origin"},
+	}
+	for _, tt := range tests {
+		cfg := &config.Config{CORSAllowedOrigins: tt.origins, CORSAllowCredentials: tt.credentials}
+		_, err := New(cfg, &controller.State{}, nil)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%q: error = %v, want %q", tt.origins, err, tt.err)
+		}
+	}
+	origins, _ := parseCORSOrigins("https://a.example, ,https://b.example/")
+	if strings.Join(origins, " ") != "https://a.example https://b.example" {
+		t.Errorf("origins = %q", origins)
+	}
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// dashboardHTML is the single-page dashboard served at /
+//
+//go:embed dashboard/index.html
+var dashboardHTML []byte
+
+// handleDashboard serves the dashboard. The page itself holds no data, so it is public;
+// its API calls authenticate with the token entered on the page.
+func (s *Server) handleDashboard(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(dashboardHTML)
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+// newDevicesServer returns a server for the DEVICES entries x1c and voron, on the Shellys bambu-plug and
+// voron-plug
+func newDevicesServer(t *testing.T) *Server {
+	t.Helper()
+	clk := clock.NewFake(time.Date(2026, 3, 1, 20, 11, 0, 0, time.UTC))
+	global := config.Config{
+		APIToken:                 testAdminToken,
+		AlertmanagerToken:        testAlertmanagerToken,
+		AlertmanagerPauseAlerts:  "VictoriaMetricsDegraded",
+		AlertmanagerPauseTimeout: 6 * time.Hour,
+		StandbyDuration:          15 * time.Minute,
+	}
+	devices := []config.Device{{Name: "x1c", Config: global}, {Name: "voron", Config: global}}
+	states := []*controller.State{
+		{Clock: clk, DeviceName: "bambu-plug"},
+		{Clock: clk, DeviceName: "voron-plug"},
+	}
+	s, err := New(&devices[0].Config, states[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetDevices(devices, states)
+	return s
+}
+
+// serve sends a request to the server with the admin token and returns the response
+func serve(s *Server, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// paused returns whether each device is paused by an alert
+func paused(s *Server) map[string]bool {
+	got := map[string]bool{}
+	for _, d := range s.devices {
+		got[d.name] = controller.GetStatus(d.cfg, d.state).AlertPause != nil
+	}
+	return got
+}
+
+// held returns whether each device is held
+func held(s *Server) map[string]bool {
+	got := map[string]bool{}
+	for _, d := range s.devices {
+		got[d.name] = controller.GetStatus(d.cfg, d.state).HoldUntil != nil
+	}
+	return got
+}
+
+func TestDevicesAlertmanager(t *testing.T) {
+	firing, err := os.ReadFile("testdata/alertmanager_firing.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := os.ReadFile("testdata/alertmanager_resolved.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(s *Server, target string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(string(body)))
+		req.Header.Set("Authorization", "Bearer "+testAlertmanagerToken)
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Without a device the alert pauses every one
+	s := newDevicesServer(t)
+	rec := post(s, "/alertmanager", firing)
+	if want := `{"active_pauses":1,"devices":{"voron":1,"x1c":1}}`; rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != want {
+		t.Errorf("firing: %d %s, want %s", rec.Code, rec.Body, want)
+	}
+	if got := paused(s); !got["x1c"] || !got["voron"] {
+		t.Errorf("paused = %v, want both", got)
+	}
+	post(s, "/alertmanager", resolved)
+	if got := paused(s); got["x1c"] || got["voron"] {
+		t.Errorf("paused after resolving = %v, want neither", got)
+	}
+
+	// The receiver of a single device names it
+	s = newDevicesServer(t)
+	rec = post(s, "/alertmanager?device=voron", firing)
+	if want := `{"active_pauses":1,"devices":{"voron":1}}`; rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != want {
+		t.Errorf("firing for voron: %d %s, want %s", rec.Code, rec.Body, want)
+	}
+	if got := paused(s); got["x1c"] || !got["voron"] {
+		t.Errorf("paused = %v, want only voron", got)
+	}
+	if rec := post(s, "/alertmanager?device=prusa", firing); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown device: %d %s, want 404", rec.Code, rec.Body)
+	}
+}
+
+func TestDevicesHold(t *testing.T) {
+	s := newDevicesServer(t)
+	if rec := serve(s, http.MethodPost, "/hold", `{"duration": "2h"}`); rec.Code != http.StatusOK {
+		t.Fatalf("hold: %d %s", rec.Code, rec.Body)
+	}
+	if got := held(s); !got["x1c"] || !got["voron"] {
+		t.Errorf("held = %v, want both", got)
+	}
+	if rec := serve(s, http.MethodDelete, "/hold?device=x1c", ""); rec.Code != http.StatusOK {
+		t.Fatalf("clear x1c: %d %s", rec.Code, rec.Body)
+	}
+	if got := held(s); got["x1c"] || !got["voron"] {
+		t.Errorf("held = %v, want only voron", got)
+	}
+	serve(s, http.MethodDelete, "/hold", "")
+
+	// The response is the status of the device held
+	rec := serve(s, http.MethodPost, "/hold", `{"duration": "1h", "device": "voron-plug"}`)
+	var status controller.Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || rec.Code != http.StatusOK || status.HoldUntil == nil {
+		t.Fatalf("hold voron: %d %s", rec.Code, rec.Body)
+	}
+	if got := held(s); got["x1c"] || !got["voron"] {
+		t.Errorf("held = %v, want only voron", got)
+	}
+	if rec := serve(s, http.MethodPost, "/hold", `{"duration": "1h", "device": "prusa"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown device: %d %s, want 404", rec.Code, rec.Body)
+	}
+	if rec := serve(s, http.MethodDelete, "/hold?device=prusa", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("clearing an unknown device: %d %s, want 404", rec.Code, rec.Body)
+	}
+}
+
+func TestDevicesTrigger(t *testing.T) {
+	tests := []struct {
+		body     string
+		code     int
+		finished string // Device whose print finished
+	}{
+		{"", http.StatusOK, "x1c"},
+		{`{"device": "x1c"}`, http.StatusOK, "x1c"},
+		{`{"device": "voron", "job": "benchy"}`, http.StatusOK, "voron"},
+		// The Shelly device name keeps working as it did with a single device
+		{`{"device": "voron-plug"}`, http.StatusOK, "voron"},
+		{`{"device": "prusa"}`, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		s := newDevicesServer(t)
+		rec := serve(s, http.MethodPost, "/trigger/print-finished", tt.body)
+		if rec.Code != tt.code {
+			t.Errorf("%q: %d %s, want %d", tt.body, rec.Code, rec.Body, tt.code)
+		}
+		for _, d := range s.devices {
+			if finished := d.state.PrintFinishedAt != nil; finished != (d.name == tt.finished) {
+				t.Errorf("%q: print finished on %s %v", tt.body, d.name, finished)
+			}
+		}
+	}
+}
+
+func TestDevicesQuery(t *testing.T) {
+	s := newDevicesServer(t)
+	// Only voron has an auto-off pending in its veto window
+	since := s.devices[1].state.Clock.Now()
+	s.devices[1].state.PendingOffSince = &since
+
+	for _, tt := range []struct {
+		target string
+		device string // Shelly name in the status answered, empty for none
+		code   int
+	}{
+		{"/status", "bambu-plug", http.StatusOK},
+		{"/status?device=voron", "voron-plug", http.StatusOK},
+		{"/status?device=voron-plug", "voron-plug", http.StatusOK},
+		{"/status?device=prusa", "", http.StatusNotFound},
+		{"/countdown?device=prusa", "", http.StatusNotFound},
+		{"/probe?device=prusa", "", http.StatusNotFound},
+	} {
+		rec := serve(s, http.MethodGet, tt.target, "")
+		var status controller.Status
+		_ = json.Unmarshal(rec.Body.Bytes(), &status)
+		if rec.Code != tt.code || status.Device != tt.device {
+			t.Errorf("GET %s = %d %s, want %d for %q", tt.target, rec.Code, rec.Body, tt.code, tt.device)
+		}
+	}
+
+	// The veto goes to the device named, the first one has nothing to veto
+	if rec := serve(s, http.MethodPost, "/veto", ""); rec.Code != http.StatusConflict {
+		t.Errorf("veto of the first device: %d %s, want 409", rec.Code, rec.Body)
+	}
+	if rec := serve(s, http.MethodPost, "/veto?device=voron", ""); rec.Code != http.StatusOK || s.devices[1].state.PendingOffSince != nil {
+		t.Errorf("veto of voron: %d %s, pending since %v", rec.Code, rec.Body, s.devices[1].state.PendingOffSince)
+	}
+	for _, target := range []string{"/veto?device=prusa", "/relay/off?device=prusa"} {
+		if rec := serve(s, http.MethodPost, target, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("POST %s = %d %s, want 404", target, rec.Code, rec.Body)
+		}
+	}
+	// Without a reading voron has no Shelly IP to switch yet
+	if rec := serve(s, http.MethodPost, "/relay/off?device=voron", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST /relay/off?device=voron = %d %s, want 503", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+
+	"gome-assistant/internal/controller"
+	"gome-assistant/internal/metrics"
+)
+
+// probeOutcomes are the values of the gome_probe_outcome enum
+var probeOutcomes = []string{controller.OutcomeSkip, controller.OutcomeStandby, controller.OutcomeTurnOff}
+
+// handleProbe answers what the controller would decide right now in the Prometheus text format, for the
+// first device or the one named by ?device=x1c. It never acts on the result. Failures are reported by
+// gome_probe_success like a blackbox probe.
+func (s *Server) handleProbe(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.queryDevice(w, r)
+	if !ok {
+		return
+	}
+	ev, cached, err := controller.ProbeEvaluation(r.Context(), d.cfg, d.state)
+
+	var b bytes.Buffer
+	instance := fmt.Sprintf("instance_name=%q", d.cfg.InstanceName())
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s{%s} %g\n", name, help, name, name, instance, value)
+	}
+	gauge("gome_probe_success", "Whether the evaluation succeeded", boolValue(err == nil))
+	if err == nil {
+		gauge("gome_probe_cached", "Whether the evaluation of the last cycle was reused", boolValue(cached))
+		gauge("gome_probe_evaluation_timestamp_seconds", "When the evaluation ran", float64(ev.Time.Unix()))
+
+		b.WriteString("# HELP gome_probe_outcome Outcome of the evaluation\n# TYPE gome_probe_outcome gauge\n")
+		for _, outcome := range probeOutcomes {
+			fmt.Fprintf(&b, "gome_probe_outcome{%s,outcome=%q} %g\n", instance, outcome, boolValue(outcome == ev.Outcome))
+		}
+		gauge("gome_probe_watts", "Current power draw", ev.Watts)
+		gauge("gome_probe_standby_seconds", "Duration of the current standby streak", ev.StandbyDuration.Seconds())
+		gauge("gome_probe_gates_passed", "Bitmap of the passed gates, in evaluation order", float64(ev.Gates))
+
+		b.WriteString("# HELP gome_probe_gate_passed Whether the gate passed\n# TYPE gome_probe_gate_passed gauge\n")
+		for i, name := range controller.GateNames {
+			fmt.Fprintf(&b, "gome_probe_gate_passed{%s,gate=%q} %g\n", instance, name, boolValue(ev.Gates&(1<<i) != 0))
+		}
+	} else {
+		slog.Error("Probe evaluation failed", "error", err)
+	}
+
+	remaining := math.NaN()
+	if countdown := controller.GetCountdown(d.cfg, d.state); countdown.SecondsRemaining != nil {
+		remaining = float64(*countdown.SecondsRemaining)
+	}
+	gauge("gome_auto_off_seconds_remaining", "Seconds until the projected auto-off, NaN if none is projected", remaining)
+
+	fmt.Fprintf(&b, "# HELP gome_cycles_skipped_total Checks dropped because a longer check cycle was still running\n# TYPE gome_cycles_skipped_total counter\ngome_cycles_skipped_total{%s} %d\n", instance, controller.GetStatus(d.cfg, d.state).SkippedCycles)
+
+	if price, ok := d.state.Prices.At(d.state.Clock.Now()); ok {
+		gauge("gome_energy_price", "Current electricity price per kWh", price)
+	}
+
+	if breaker, ok := d.state.Metrics.(*metrics.Breaker); ok {
+		status := breaker.Status()
+		b.WriteString("# HELP gome_metrics_breaker_state State of the circuit breaker around the metrics backend\n# TYPE gome_metrics_breaker_state gauge\n")
+		for _, state := range metrics.BreakerStates {
+			fmt.Fprintf(&b, "gome_metrics_breaker_state{%s,state=%q} %g\n", instance, state, boolValue(state == status.State))
+		}
+		gauge("gome_metrics_breaker_consecutive_failures", "Consecutive failed metric queries", float64(status.ConsecutiveFailures))
+	}
+
+	if len(d.state.Stores) > 0 {
+		var usage []controller.MemoryUsage
+		for _, store := range d.state.Stores {
+			usage = append(usage, store.Usage())
+		}
+		series := func(name, help, kind string, value func(controller.MemoryUsage) int) {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+			for _, u := range usage {
+				fmt.Fprintf(&b, "%s{%s,store=%q} %d\n", name, instance, u.Store, value(u))
+			}
+		}
+		series("gome_memory_store_entries", "Entries kept by the in-memory store", "gauge", func(u controller.MemoryUsage) int { return u.Entries })
+		series("gome_memory_store_budget", "Most entries the in-memory store keeps", "gauge", func(u controller.MemoryUsage) int { return u.Budget })
+		series("gome_memory_store_evicted_total", "Oldest entries dropped to stay within the budget", "counter", func(u controller.MemoryUsage) int { return u.Evicted })
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(b.Bytes())
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+func TestProbeSkippedCycles(t *testing.T) {
+	// A VM answering slowly makes the cycle take longer than the check interval
+	b := newTestBackend(t, func(cfg *config.Config) { cfg.CheckInterval = time.Second })
+	b.vm.Delay(200 * time.Millisecond)
+	b.cycle()
+	b.vm.Delay(0)
+
+	var status controller.Status
+	b.do(t, http.MethodGet, "/status", testReadToken, "", &status)
+	if status.SkippedCycles < 1 {
+		t.Fatalf("status skipped cycles = %d, want the overrun counted", status.SkippedCycles)
+	}
+
+	resp, err := http.Get(b.url + "/probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+	want := fmt.Sprintf("# TYPE gome_cycles_skipped_total counter\ngome_cycles_skipped_total{instance_name=%q} %d\n", b.cfg.InstanceName(), status.SkippedCycles)
+	if !strings.Contains(string(body), want) {
+		t.Errorf("probe:\n%s\nwant %q", body, want)
+	}
+}
@@ -0,0 +1,180 @@
+// Package server is the internal HTTP listener with the control API, dashboard and webhooks
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+// Server is the internal HTTP listener for integrations
+type Server struct {
+	cfg     *config.Config
+	state   *controller.State
+	devices []device // Every device, the first is cfg and state
+	history *controller.History
+	events  *sseHub
+	tokens  []apiToken
+	mux     *http.ServeMux
+	srv     *http.Server
+	failed  chan error
+}
+
+func New(cfg *config.Config, state *controller.State, hist *controller.History) (*Server, error) {
+	tokens, err := parseAPITokens(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		cfg:     cfg,
+		state:   state,
+		devices: []device{{cfg: cfg, state: state}},
+		history: hist,
+		events:  newSSEHub(cfg, state),
+		tokens:  tokens,
+		mux:     http.NewServeMux(),
+		failed:  make(chan error, 1),
+	}
+	s.srv = &http.Server{
+		Addr:              cfg.HTTPAddr,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	origins, err := parseCORSOrigins(cfg.CORSAllowedOrigins)
+	if err != nil {
+		return nil, err
+	}
+	if len(origins) > 0 {
+		if cfg.CORSAllowCredentials && slices.Contains(origins, "*") {
+			return nil, errors.New("CORS_ALLOW_CREDENTIALS can't be combined with the * origin")
+		}
+		policy := &corsPolicy{origins: origins, credentials: cfg.CORSAllowCredentials}
+		s.srv.Handler = policy.wrap(s.mux)
+	}
+	// Event streams never go idle, end them when shutting down
+	s.srv.RegisterOnShutdown(s.events.close)
+
+	s.registerAPI()
+	s.mux.HandleFunc("GET /{$}", s.handleDashboard)
+	s.mux.HandleFunc("GET /probe", s.authorize(accessProbe, s.handleProbe))
+
+	if cfg.AlertmanagerToken != "" {
+		s.mux.HandleFunc("POST /alertmanager", s.handleAlertmanager)
+	}
+
+	return s, nil
+}
+
+// device is a controlled device with its name in DEVICES, empty without it
+type device struct {
+	name  string
+	cfg   *config.Config
+	state *controller.State
+}
+
+// SetDevices hands the listener every device of DEVICES, the first being the one it was created for.
+// Alertmanager pauses and holds then act on all of them, and requests can pick one by its name.
+func (s *Server) SetDevices(devices []config.Device, states []*controller.State) {
+	s.devices = make([]device, len(devices))
+	for i := range devices {
+		s.devices[i] = device{name: devices[i].Name, cfg: &devices[i].Config, state: states[i]}
+	}
+}
+
+// device returns the device a request names, by its name in DEVICES or the Shelly device name of its
+// power series, and the first device for an empty name
+func (s *Server) device(name string) (device, bool) {
+	if name == "" {
+		return s.devices[0], true
+	}
+	for _, d := range s.devices {
+		if d.name == name {
+			return d, true
+		}
+	}
+	for _, d := range s.devices {
+		if d.state.Device() == name {
+			return d, true
+		}
+	}
+	return device{}, false
+}
+
+// targets returns the device a request names, or every device for an empty name, answering the request
+// itself for an unknown one
+func (s *Server) targets(w http.ResponseWriter, name string) ([]device, bool) {
+	if name == "" {
+		return s.devices, true
+	}
+	d, ok := s.device(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown device "+name)
+		return nil, false
+	}
+	return []device{d}, true
+}
+
+// queryDevice returns the device the device query parameter names, or the first device without it,
+// answering the request itself for an unknown one
+func (s *Server) queryDevice(w http.ResponseWriter, r *http.Request) (device, bool) {
+	name := r.URL.Query().Get("device")
+	d, ok := s.device(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown device "+name)
+	}
+	return d, ok
+}
+
+// Start listens and serves in the background. A failing listener is fatal as configured integrations
+// would silently stop working: Start returns the error of listening, Failed delivers a later one.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.cfg.HTTPAddr)
+	if err != nil {
+		return err
+	}
+	slog.Info("HTTP listener started", "addr", s.cfg.HTTPAddr)
+	go func() {
+		if err := s.srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.failed <- err
+		}
+	}()
+	return nil
+}
+
+// Failed delivers the error of a listener that stopped serving
+func (s *Server) Failed() <-chan error {
+	return s.failed
+}
+
+// Shutdown waits a few seconds for in-flight requests
+func (s *Server) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.srv.Shutdown(ctx); err != nil {
+		slog.Error("Shutting down the HTTP listener failed", "error", err)
+	}
+}
+
+// apiError is the JSON body of error responses
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, apiError{Error: msg})
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+// sseClientBuffer is the number of messages a client may lag behind before it is disconnected
+const sseClientBuffer = 32
+
+// sseHeartbeat keeps idle connections open through proxies
+var sseHeartbeat = 15 * time.Second
+
+// sseMessage is one server-sent event
+type sseMessage struct {
+	event string
+	data  []byte
+}
+
+// sseHub fans events of the bus out to the connected /events clients
+type sseHub struct {
+	cfg   *config.Config
+	state *controller.State
+
+	mu      sync.Mutex
+	clients map[chan sseMessage]struct{}
+	closed  bool
+}
+
+func newSSEHub(cfg *config.Config, state *controller.State) *sseHub {
+	return &sseHub{cfg: cfg, state: state, clients: map[chan sseMessage]struct{}{}}
+}
+
+// Handle is the event bus subscriber of the event stream
+func (h *sseHub) Handle(be controller.BusEvent) error {
+	switch e := be.(type) {
+	case controller.CycleCompleted, controller.ControlApplied:
+		return h.broadcast("status", controller.GetStatus(h.cfg, h.state))
+	case controller.DecisionMade:
+		return h.broadcast("decision", controller.NewDecisionRecord(e))
+	}
+	if record, ok := controller.NewActionRecord(be); ok {
+		return h.broadcast("action", record)
+	}
+	return nil
+}
+
+// Handle is the event bus subscriber feeding the event streams
+func (s *Server) Handle(be controller.BusEvent) error {
+	return s.events.Handle(be)
+}
+
+// broadcast queues the event for every client. A client whose queue is full is disconnected
+// rather than waited for; EventSource clients reconnect on their own.
+func (h *sseHub) broadcast(event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg := sseMessage{event: event, data: data}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		select {
+		case ch <- msg:
+		default:
+			slog.Warn("Event stream client not keeping up, disconnecting it")
+			delete(h.clients, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// subscribe registers a client; ok is false once the hub is closed
+func (h *sseHub) subscribe() (chan sseMessage, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, false
+	}
+	ch := make(chan sseMessage, sseClientBuffer)
+	h.clients[ch] = struct{}{}
+	return ch, true
+}
+
+func (h *sseHub) unsubscribe(ch chan sseMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[ch]; ok {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// close ends all streams so the listener can shut down
+func (h *sseHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.clients {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// handleEvents streams status, decision and action events until the client disconnects
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	ch, ok := s.events.subscribe()
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	defer s.events.unsubscribe(ch)
+
+	// Streams outlive the listener's write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Start with the current status so clients don't wait for the next cycle
+	if data, err := json.Marshal(controller.GetStatus(s.cfg, s.state)); err == nil {
+		writeSSE(w, sseMessage{event: "status", data: data})
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := writeSSE(w, msg); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w http.ResponseWriter, msg sseMessage) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.event, msg.data)
+	return err
+}
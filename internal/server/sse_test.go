@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+// sseEvent is an event received on the stream, or a comment with an empty event
+type sseEvent struct {
+	event   string
+	data    string
+	comment string
+}
+
+// sseClient collects the events of a /events stream like an EventSource
+type sseClient struct {
+	events chan sseEvent
+	cancel context.CancelFunc
+	done   chan struct{} // Closed when the stream ends
+}
+
+// connectSSE opens the event stream of the backend; disconnected when the test ends
+func connectSSE(t *testing.T, b *testBackend) *sseClient {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testReadToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET /events = %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	c := &sseClient{events: make(chan sseEvent, 100), cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		defer func() { _ = resp.Body.Close() }()
+		var e sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				c.events <- e
+				e = sseEvent{}
+			case strings.HasPrefix(line, ":"):
+				e.comment = strings.TrimSpace(line[1:])
+			case strings.HasPrefix(line, "event: "):
+				e.event = line[len("event: "):]
+			case strings.HasPrefix(line, "data: "):
+				e.data = line[len("data: "):]
+			}
+		}
+	}()
+	t.Cleanup(cancel)
+	return c
+}
+
+// next returns the next event, skipping heartbeats
+func (c *sseClient) next(t *testing.T) sseEvent {
+	t.Helper()
+	for {
+		select {
+		case e := <-c.events:
+			if e.event != "" {
+				return e
+			}
+		case <-c.done:
+			t.Fatal("the stream ended")
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+		}
+	}
+}
+
+// until returns the events up to and including the first one named event
+func (c *sseClient) until(t *testing.T, event string) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	for {
+		e := c.next(t)
+		events = append(events, e)
+		if e.event == event {
+			return events
+		}
+	}
+}
+
+func TestSSEStreamsCycles(t *testing.T) {
+	b := newTestBackend(t, func(cfg *config.Config) { cfg.StandbyDuration = 2 * time.Hour })
+	client := connectSSE(t, b)
+
+	// The current status comes first, before any cycle ran
+	var status controller.Status
+	if e := client.next(t); e.event != "status" || json.Unmarshal([]byte(e.data), &status) != nil || status.LastCycle != nil {
+		t.Fatalf("first event = %+v, want the status before the first cycle", e)
+	}
+
+	for i := range 3 {
+		b.cycle()
+		events := client.until(t, "status")
+		if len(events) != 2 || events[0].event != "decision" {
+			t.Fatalf("cycle %d: events = %+v, want a decision and the status", i+1, events)
+		}
+		var decision controller.DecisionRecord
+		if err := json.Unmarshal([]byte(events[0].data), &decision); err != nil || decision.Outcome != controller.OutcomeStandby || decision.Watts != 8 {
+			t.Errorf("cycle %d: decision = %s (%v), want standby at 8 W", i+1, events[0].data, err)
+		}
+		if err := json.Unmarshal([]byte(events[1].data), &status); err != nil || status.LastCycle == nil {
+			t.Errorf("cycle %d: status = %s (%v), want the completed cycle", i+1, events[1].data, err)
+		}
+	}
+
+	b.do(t, http.MethodPost, "/hold", testAdminToken, `{"duration":"1h"}`, nil)
+	if e := client.next(t); e.event != "status" || json.Unmarshal([]byte(e.data), &status) != nil || status.HoldUntil == nil {
+		t.Errorf("event after the hold = %+v, want the status with the hold", e)
+	}
+	b.do(t, http.MethodDelete, "/hold", testAdminToken, "", nil)
+	client.until(t, "status")
+
+	b.do(t, http.MethodPost, "/relay/off", testAdminToken, "", nil)
+	var action controller.ActionRecord
+	if e := client.next(t); e.event != "action" || json.Unmarshal([]byte(e.data), &action) != nil || action.Action != controller.ActionOff || action.Source != "api:admin" {
+		t.Errorf("event after the relay command = %+v, want the action", e)
+	}
+}
+
+func TestSSEHeartbeat(t *testing.T) {
+	heartbeat := sseHeartbeat
+	sseHeartbeat = 10 * time.Millisecond
+	t.Cleanup(func() { sseHeartbeat = heartbeat })
+
+	b := newTestBackend(t)
+	client := connectSSE(t, b)
+	client.next(t)
+	select {
+	case e := <-client.events:
+		if e.comment != "ping" || e.event != "" {
+			t.Errorf("idle stream sent %+v, want a ping comment", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no heartbeat on the idle stream")
+	}
+}
+
+func TestSSESlowClientIsDisconnected(t *testing.T) {
+	b := newTestBackend(t)
+	slow, ok := b.server.events.subscribe()
+	if !ok {
+		t.Fatal("subscribe failed")
+	}
+	client := connectSSE(t, b)
+	client.next(t)
+
+	// The slow client never reads; broadcasting must neither block nor hold back the others
+	start := time.Now()
+	for range sseClientBuffer + 1 {
+		if err := b.server.events.Handle(controller.ControlApplied{Command: "hold"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("broadcasting took %s", elapsed)
+	}
+	if n := len(slow); n != sseClientBuffer {
+		t.Errorf("slow client queued %d events, want %d before disconnecting", n, sseClientBuffer)
+	}
+	for range sseClientBuffer {
+		<-slow
+	}
+	if _, open := <-slow; open {
+		t.Error("the slow client is still connected")
+	}
+	for range sseClientBuffer + 1 {
+		if e := client.next(t); e.event != "status" {
+			t.Fatalf("event = %+v, want status", e)
+		}
+	}
+}
+
+func TestSSEClientDisconnects(t *testing.T) {
+	b := newTestBackend(t)
+	client := connectSSE(t, b)
+	client.next(t)
+
+	client.cancel()
+	<-client.done
+	eventually(t, "the client to unsubscribe", func() bool {
+		b.server.events.mu.Lock()
+		defer b.server.events.mu.Unlock()
+		return len(b.server.events.clients) == 0
+	})
+	// Broadcasting to nobody is fine
+	if err := b.server.events.Handle(controller.CycleCompleted{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSSEShutdownEndsStreams(t *testing.T) {
+	b := newTestBackend(t)
+	client := connectSSE(t, b)
+	client.next(t)
+
+	b.server.events.close()
+	select {
+	case <-client.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream is still open after the shutdown")
+	}
+	var resp apiError
+	if code := b.do(t, http.MethodGet, "/events", testReadToken, "", &resp); code != http.StatusServiceUnavailable {
+		t.Errorf("GET /events after the shutdown = %d %+v, want 503", code, resp)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"gome-assistant/internal/controller"
+)
+
+// triggerRequest is the optional body of the trigger routes
+type triggerRequest struct {
+	Device string `json:"device"` // Name in DEVICES or Shelly device name, the first device if empty
+	Job    string `json:"job"`    // Title of the print job, for logs and the audit log
+}
+
+// decodeTrigger parses and validates the body of a trigger and returns the device it names, answering
+// the request itself on failure. An empty body triggers the first device.
+func (s *Server) decodeTrigger(w http.ResponseWriter, r *http.Request) (triggerRequest, device, bool) {
+	var req triggerRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return req, device{}, false
+	}
+	if len(req.Job) > 200 {
+		writeError(w, http.StatusBadRequest, "job must be at most 200 characters")
+		return req, device{}, false
+	}
+	d, ok := s.device(req.Device)
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown device "+req.Device)
+		return req, device{}, false
+	}
+	return req, d, true
+}
+
+// handlePrintQueued switches the printer on for a job sent by a slicer or Bambu Handy, like a job
+// queued in Bambu Cloud
+func (s *Server) handlePrintQueued(w http.ResponseWriter, r *http.Request) {
+	req, d, ok := s.decodeTrigger(w, r)
+	if !ok {
+		return
+	}
+	if err := controller.PowerOnForQueuedJob(d.cfg, d.state, req.Job, apiSource(r)); err != nil {
+		writeError(w, switchErrorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, controller.GetStatus(d.cfg, d.state))
+}
+
+// handlePrintFinished starts the post-print cooldown without waiting for the printer state
+func (s *Server) handlePrintFinished(w http.ResponseWriter, r *http.Request) {
+	req, d, ok := s.decodeTrigger(w, r)
+	if !ok {
+		return
+	}
+	controller.MarkPrintFinished(d.cfg, d.state, req.Job, apiSource(r))
+	writeJSON(w, http.StatusOK, controller.GetStatus(d.cfg, d.state))
+}
@@ -0,0 +1,47 @@
+package shelly
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gome-assistant/internal/config"
+)
+
+// listenIPv6 starts a server on the IPv6 loopback, skipping the test where there is none
+func listenIPv6(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	s := httptest.NewUnstartedServer(handler)
+	s.Listener = l
+	s.Start()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestRelayOverIPv6(t *testing.T) {
+	useClient(t)
+	var paths []string
+	s := listenIPv6(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.String())
+		_, _ = w.Write([]byte(`{"ison":false}`))
+	}))
+	// The address label of an IPv6 device, the port only for the test server
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	address := "[::1]:" + port
+
+	cfg := &config.Config{}
+	if err := SetRelayOff(cfg, address, Gen1); err != nil {
+		t.Fatal(err)
+	}
+	if on, err := RelayOn(cfg, address, Gen1); err != nil || on {
+		t.Fatalf("RelayOn = %v, %v", on, err)
+	}
+	if len(paths) < 2 || paths[0] != "/relay/0?turn=off" || paths[len(paths)-1] != "/relay/0" {
+		t.Errorf("requests = %v", paths)
+	}
+}
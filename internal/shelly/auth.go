@@ -0,0 +1,119 @@
+package shelly
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// gen2User is the only user of the Gen2 login
+const gen2User = "admin"
+
+// ErrAuth is returned when the device rejects the request for missing or wrong credentials
+var ErrAuth = errors.New("shelly login failed")
+
+// do sends the request built by newRequest. A 401 is retried once with SHELLY_USER and
+// SHELLY_PASSWORD, as basic auth for Gen1 devices or digest auth for Gen2 devices, whichever the
+// challenge asks for.
+func do(client *http.Client, user, password string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	_ = resp.Body.Close()
+	if password == "" {
+		return nil, fmt.Errorf("%w: the device requires a login, set SHELLY_PASSWORD", ErrAuth)
+	}
+
+	req, err = newRequest()
+	if err != nil {
+		return nil, err
+	}
+	if scheme, params, _ := strings.Cut(challenge, " "); strings.EqualFold(scheme, "Digest") {
+		if user == "" {
+			user = gen2User
+		}
+		authorization, err := digestAuthorization(parseChallenge(params), user, password, req.Method, req.URL.RequestURI())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrAuth, err)
+		}
+		req.Header.Set("Authorization", authorization)
+	} else {
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err = client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	_ = resp.Body.Close()
+	return nil, fmt.Errorf("%w: the device rejected SHELLY_USER %q and SHELLY_PASSWORD", ErrAuth, user)
+}
+
+// parseChallenge reads the comma-separated, possibly quoted parameters of a digest challenge
+func parseChallenge(s string) map[string]string {
+	params := map[string]string{}
+	for s != "" {
+		var key, value string
+		key, s, _ = strings.Cut(strings.TrimLeft(s, " ,"), "=")
+		if rest, ok := strings.CutPrefix(s, `"`); ok {
+			value, s, _ = strings.Cut(rest, `"`)
+		} else {
+			value, s, _ = strings.Cut(s, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return params
+}
+
+// digestAuthorization answers a digest challenge as in RFC 7616 with qop=auth, which Gen2 devices
+// send with SHA-256
+func digestAuthorization(challenge map[string]string, user, password, method, uri string) (string, error) {
+	var newHash func() hash.Hash
+	algorithm := challenge["algorithm"]
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	if qop := challenge["qop"]; qop != "" && !strings.Contains(qop, "auth") {
+		return "", fmt.Errorf("unsupported digest qop %q", qop)
+	}
+	h := func(parts ...string) string {
+		sum := newHash()
+		sum.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	cnonce, nc := hex.EncodeToString(nonce), "00000001"
+	realm := challenge["realm"]
+	response := h(h(user, realm, password), challenge["nonce"], nc, cnonce, "auth", h(method, uri))
+
+	authorization := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s", qop=auth, nc=%s, cnonce="%s"`,
+		user, realm, challenge["nonce"], uri, response, nc, cnonce)
+	if algorithm != "" {
+		authorization += ", algorithm=" + algorithm
+	}
+	if opaque := challenge["opaque"]; opaque != "" {
+		authorization += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return authorization, nil
+}
@@ -0,0 +1,92 @@
+package shelly
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/outbound"
+)
+
+// ErrCloudAuth is returned when the Shelly Cloud rejects SHELLY_CLOUD_KEY
+var ErrCloudAuth = errors.New("the Shelly Cloud rejected SHELLY_CLOUD_KEY")
+
+// ErrDeviceOffline is returned when the Shelly Cloud has no connection to the device
+var ErrDeviceOffline = errors.New("the device is offline in the Shelly Cloud")
+
+// cloudResponse is the envelope of the Shelly Cloud API
+type cloudResponse struct {
+	IsOK   bool              `json:"isok"`
+	Errors map[string]string `json:"errors"`
+}
+
+// CloudSetRelay switches the relay of the device via the device/relay/control endpoint of the Shelly
+// Cloud. The cloud only forwards the command, so the relay state is not read back.
+func CloudSetRelay(cfg *config.Config, deviceID string, on bool) error {
+	if cfg.DryRun {
+		slog.Info("[DRY RUN] Would switch the relay via the Shelly Cloud", "action", onOff(on), "relay", cfg.ShellyRelayChannel, "cloud_id", deviceID)
+		return nil
+	}
+
+	form := url.Values{
+		"id":       {deviceID},
+		"auth_key": {cfg.ShellyCloudKey},
+		"channel":  {strconv.Itoa(cfg.ShellyRelayChannel)},
+		"turn":     {onOff(on)},
+	}
+	endpoint := strings.TrimSuffix(cfg.ShellyCloudServer, "/") + "/device/relay/control"
+	resp, err := outbound.Client(10*time.Second, nil).PostForm(endpoint, form)
+	if err != nil {
+		return fmt.Errorf("shelly cloud request failed: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return ErrCloudAuth
+	}
+	var result cloudResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("shelly cloud request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	if result.IsOK {
+		return nil
+	}
+	return cloudError(result.Errors)
+}
+
+// cloudError maps the error keys of the Shelly Cloud, like wrong_auth_key or device_offline, to
+// ErrCloudAuth and ErrDeviceOffline
+func cloudError(errs map[string]string) error {
+	keys := make([]string, 0, len(errs))
+	for key := range errs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	details := make([]string, len(keys))
+	for i, key := range keys {
+		details[i] = key + ": " + errs[key]
+	}
+	detail := strings.Join(details, ", ")
+
+	for _, key := range keys {
+		switch {
+		case strings.Contains(key, "auth"):
+			return fmt.Errorf("%w (%s)", ErrCloudAuth, detail)
+		case strings.Contains(key, "offline"), strings.Contains(key, "not_connected"), strings.Contains(key, "not_online"):
+			return fmt.Errorf("%w (%s)", ErrDeviceOffline, detail)
+		}
+	}
+	return fmt.Errorf("shelly cloud rejected the command: %s", detail)
+}
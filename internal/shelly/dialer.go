@@ -0,0 +1,138 @@
+package shelly
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+)
+
+// Resolver looks up the addresses of a host name like net.Resolver
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Dialer connects to Shelly devices by host name without depending on DNS at the moment of a
+// relay command: static overrides bypass the resolver, and with a TTL a successful resolution is
+// reused until it expires or a connection to its addresses fails.
+type Dialer struct {
+	Hosts    map[string]string // Addresses by lower-case host name
+	TTL      time.Duration     // 0 resolves every connection
+	Resolver Resolver
+	Dial     func(ctx context.Context, network, address string) (net.Conn, error)
+	Clock    clock.Clock
+
+	mu    sync.Mutex
+	cache map[string]resolution
+}
+
+// resolution is a cached successful lookup
+type resolution struct {
+	addrs []string
+	at    time.Time
+}
+
+// NewDialer returns the dialer of the configured host overrides and DNS cache
+func NewDialer(cfg *config.Config) *Dialer {
+	return &Dialer{
+		Hosts:    cfg.ShellyHostOverrides(),
+		TTL:      cfg.ShellyDNSCacheTTL,
+		Resolver: net.DefaultResolver,
+		Dial:     (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+		Clock:    clock.Real{},
+	}
+}
+
+// DialContext connects to address like net.Dialer.DialContext
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.Dial(ctx, network, address)
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip, ok := d.Hosts[name]; ok {
+		return d.Dial(ctx, network, net.JoinHostPort(ip, port))
+	}
+	if d.TTL <= 0 {
+		return d.Dial(ctx, network, address)
+	}
+
+	if addrs, ok := d.cached(name); ok {
+		conn, err := d.dialAny(ctx, network, addrs, port)
+		if err == nil {
+			return conn, nil
+		}
+		// The device may have moved, resolve afresh
+		d.forget(name)
+		slog.Warn("Forgetting the cached addresses after a failed connection", "host", host, "error", err)
+	}
+	addrs, err := d.Resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.dialAny(ctx, network, addrs, port)
+	if err != nil {
+		return nil, err
+	}
+	d.store(name, addrs)
+	return conn, nil
+}
+
+// dialAny connects to the first reachable address, returning the error of the last one otherwise
+func (d *Dialer) dialAny(ctx context.Context, network string, addrs []string, port string) (net.Conn, error) {
+	var lastErr error = &net.AddrError{Err: "no addresses"}
+	for _, ip := range addrs {
+		conn, err := d.Dial(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (d *Dialer) cached(name string) ([]string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r, ok := d.cache[name]
+	if !ok || d.Clock.Now().Sub(r.at) >= d.TTL {
+		return nil, false
+	}
+	return r.addrs, true
+}
+
+func (d *Dialer) store(name string, addrs []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cache == nil {
+		d.cache = map[string]resolution{}
+	}
+	d.cache[name] = resolution{addrs: addrs, at: d.Clock.Now()}
+}
+
+func (d *Dialer) forget(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.cache, name)
+}
+
+// Unreachable reports whether err means the device could not be connected to, rather than an answer
+// of the device
+func Unreachable(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
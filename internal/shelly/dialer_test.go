@@ -0,0 +1,253 @@
+package shelly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+)
+
+// fakeResolver answers lookups from its addresses, or fails while down
+type fakeResolver struct {
+	mu      sync.Mutex
+	addrs   map[string][]string
+	down    bool
+	lookups []string
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups = append(r.lookups, host)
+	if r.down {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// fakeNetwork connects to every address but the unreachable ones and records the attempts
+type fakeNetwork struct {
+	mu          sync.Mutex
+	unreachable map[string]bool // By IP
+	dialed      []string
+}
+
+func (n *fakeNetwork) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dialed = append(n.dialed, address)
+	host, _, _ := net.SplitHostPort(address)
+	if n.unreachable[host] {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connect: no route to host")}
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+// testDialer returns a dialer with a fake resolver, network and clock
+func testDialer(ttl time.Duration, hosts map[string]string) (*Dialer, *fakeResolver, *fakeNetwork, *clock.Fake) {
+	resolver := &fakeResolver{addrs: map[string][]string{"bambu-plug.lan": {"192.168.1.42"}}}
+	network := &fakeNetwork{unreachable: map[string]bool{}}
+	clk := clock.NewFake(time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC))
+	return &Dialer{Hosts: hosts, TTL: ttl, Resolver: resolver, Dial: network.dial, Clock: clk}, resolver, network, clk
+}
+
+// connect dials address with d and reports the error, closing the connection
+func connect(d *Dialer, address string) error {
+	conn, err := d.DialContext(context.Background(), "tcp", address)
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
+// expectDials checks the addresses dialed and the names looked up since the last call
+func expectDials(t *testing.T, step string, resolver *fakeResolver, network *fakeNetwork, dialed []string, lookups int) {
+	t.Helper()
+	network.mu.Lock()
+	resolver.mu.Lock()
+	defer network.mu.Unlock()
+	defer resolver.mu.Unlock()
+	if !slices.Equal(network.dialed, dialed) || len(resolver.lookups) != lookups {
+		t.Errorf("%s: dialed %v after %d lookups, want %v after %d", step, network.dialed, len(resolver.lookups), dialed, lookups)
+	}
+	network.dialed, resolver.lookups = nil, nil
+}
+
+func TestDialerBypassesTheResolver(t *testing.T) {
+	d, resolver, network, _ := testDialer(time.Minute, map[string]string{"bambu-plug.lan": "192.168.1.50", "shelly-v6.lan": "fd00::5054"})
+	resolver.down = true
+	tests := []struct {
+		address string
+		dialed  string
+	}{
+		{"192.168.1.42:80", "192.168.1.42:80"},
+		{"[fd00::5054]:80", "[fd00::5054]:80"},
+		{"bambu-plug.lan:80", "192.168.1.50:80"},
+		// Host names are matched case-insensitively, also fully qualified
+		{"Bambu-Plug.LAN:8080", "192.168.1.50:8080"},
+		{"bambu-plug.lan.:80", "192.168.1.50:80"},
+		{"shelly-v6.lan:80", "[fd00::5054]:80"},
+	}
+	for _, tt := range tests {
+		if err := connect(d, tt.address); err != nil {
+			t.Errorf("%s: %v", tt.address, err)
+		}
+		expectDials(t, tt.address, resolver, network, []string{tt.dialed}, 0)
+	}
+	if err := connect(d, "other-plug.lan:80"); err == nil {
+		t.Error("name without override connected while DNS is down")
+	}
+}
+
+func TestDialerWithoutCache(t *testing.T) {
+	d, resolver, network, _ := testDialer(0, nil)
+	// Without a TTL the name is left to the dial function, which resolves it every time
+	for range 2 {
+		if err := connect(d, "bambu-plug.lan:80"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectDials(t, "no cache", resolver, network, []string{"bambu-plug.lan:80", "bambu-plug.lan:80"}, 0)
+}
+
+func TestDialerCache(t *testing.T) {
+	d, resolver, network, clk := testDialer(10*time.Minute, nil)
+
+	if err := connect(d, "bambu-plug.lan:80"); err != nil {
+		t.Fatal(err)
+	}
+	expectDials(t, "first connection", resolver, network, []string{"192.168.1.42:80"}, 1)
+
+	// A DNS blip within the TTL doesn't matter
+	resolver.down = true
+	clk.Advance(9 * time.Minute)
+	if err := connect(d, "bambu-plug.lan:80"); err != nil {
+		t.Fatalf("resolver down within the TTL: %v", err)
+	}
+	expectDials(t, "resolver down", resolver, network, []string{"192.168.1.42:80"}, 0)
+
+	// Once expired the resolver is asked again
+	clk.Advance(time.Minute)
+	err := connect(d, "bambu-plug.lan:80")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		t.Fatalf("after the TTL: %v, want the resolver error", err)
+	}
+	expectDials(t, "expired", resolver, network, nil, 1)
+
+	resolver.down = false
+	resolver.addrs["bambu-plug.lan"] = []string{"192.168.1.43"}
+	if err := connect(d, "bambu-plug.lan:80"); err != nil {
+		t.Fatal(err)
+	}
+	expectDials(t, "resolved again", resolver, network, []string{"192.168.1.43:80"}, 1)
+	if err := connect(d, "bambu-plug.lan:80"); err != nil {
+		t.Fatal(err)
+	}
+	expectDials(t, "cached again", resolver, network, []string{"192.168.1.43:80"}, 0)
+}
+
+func TestDialerForgetsOnFailedConnection(t *testing.T) {
+	d, resolver, network, _ := testDialer(10*time.Minute, nil)
+	if err := connect(d, "bambu-plug.lan:80"); err != nil {
+		t.Fatal(err)
+	}
+	expectDials(t, "cached", resolver, network, []string{"192.168.1.42:80"}, 1)
+
+	// The plug got a new lease: the cached address fails, the same request resolves afresh
+	network.unreachable["192.168.1.42"] = true
+	resolver.addrs["bambu-plug.lan"] = []string{"192.168.1.77"}
+	if err := connect(d, "bambu-plug.lan:80"); err != nil {
+		t.Fatalf("after the move: %v", err)
+	}
+	expectDials(t, "moved", resolver, network, []string{"192.168.1.42:80", "192.168.1.77:80"}, 1)
+	if err := connect(d, "bambu-plug.lan:80"); err != nil {
+		t.Fatal(err)
+	}
+	expectDials(t, "new address cached", resolver, network, []string{"192.168.1.77:80"}, 0)
+
+	// With the resolver down as well the request fails, and the dead address isn't tried again
+	network.unreachable["192.168.1.77"] = true
+	resolver.down = true
+	if err := connect(d, "bambu-plug.lan:80"); err == nil {
+		t.Fatal("connected to an unreachable address")
+	}
+	expectDials(t, "unreachable and DNS down", resolver, network, []string{"192.168.1.77:80"}, 1)
+	connect(d, "bambu-plug.lan:80")
+	expectDials(t, "forgotten", resolver, network, nil, 1)
+}
+
+func TestDialerCachesOnlyConnectedResolutions(t *testing.T) {
+	d, resolver, network, _ := testDialer(10*time.Minute, nil)
+	resolver.addrs["bambu-plug.lan"] = []string{"fd00::5054", "192.168.1.42"}
+	network.unreachable["192.168.1.42"] = true
+	network.unreachable["fd00::5054"] = true
+
+	err := connect(d, "bambu-plug.lan:80")
+	if !Unreachable(err) {
+		t.Fatalf("error = %v, want unreachable", err)
+	}
+	expectDials(t, "all unreachable", resolver, network, []string{"[fd00::5054]:80", "192.168.1.42:80"}, 1)
+
+	// A failed resolution isn't cached, the next request looks the name up again
+	delete(network.unreachable, "192.168.1.42")
+	if err := connect(d, "bambu-plug.lan:80"); err != nil {
+		t.Fatal(err)
+	}
+	expectDials(t, "second address", resolver, network, []string{"[fd00::5054]:80", "192.168.1.42:80"}, 1)
+}
+
+func TestUnreachable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{fmt.Errorf("relay: %w", &net.OpError{Op: "dial", Err: errors.New("no route to host")}), true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset")}, false},
+		{&net.DNSError{Err: "i/o timeout", IsTimeout: true}, true},
+		{errors.New("shelly returned status 500"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := Unreachable(tt.err); got != tt.want {
+			t.Errorf("Unreachable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestHostOverrideEndToEnd(t *testing.T) {
+	useClient(t)
+	var hosts []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		_, _ = w.Write([]byte(`{"gen":2}`))
+	}))
+	t.Cleanup(s.Close)
+	ip, port, _ := net.SplitHostPort(strings.TrimPrefix(s.URL, "http://"))
+
+	// The name doesn't resolve, only the override knows it
+	cfg := &config.Config{ShellyHosts: "bambu-plug.invalid=" + ip}
+	if gen, err := DetectGen(cfg, "bambu-plug.invalid:"+port); err != nil || gen != Gen2 {
+		t.Fatalf("DetectGen = %d, %v", gen, err)
+	}
+	if len(hosts) != 1 || hosts[0] != "bambu-plug.invalid:"+port {
+		t.Errorf("hosts = %v, want the name in the Host header", hosts)
+	}
+}
@@ -0,0 +1,198 @@
+package shelly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"gome-assistant/internal/deviceaddr"
+)
+
+// mdnsGroup is the IPv4 multicast address of mDNS
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsServices are browsed for Shelly devices: Gen2 devices announce _shelly._tcp, all of them _http._tcp
+var mdnsServices = []string{"_shelly._tcp.local.", "_http._tcp.local."}
+
+// Discovered is a Shelly device found via mDNS
+type Discovered struct {
+	Instance string // Service instance name, like shellyplug-s-c8c9a3
+	Address  string // URL host of the device, with the port unless it is 80
+}
+
+// mdnsRecords collects the records of the mDNS answers by lower-case owner name
+type mdnsRecords struct {
+	instances []string // Service instances in the order they were answered
+	targets   map[string]dnsmessage.SRVResource
+	addresses map[string]netip.Addr // IPv4, or IPv6 that isn't link-local, of the target hosts
+}
+
+// Discover browses mDNS for the services of Shelly devices and returns the first one whose instance
+// name matches pattern. It sends one-shot queries, which responders answer directly, and listens for
+// the answers until timeout.
+func Discover(ctx context.Context, pattern *regexp.Regexp, timeout time.Duration) (Discovered, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return Discovered{}, fmt.Errorf("opening the mDNS socket: %w", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+
+	if err := sendQuery(conn, dnsmessage.TypePTR, mdnsServices...); err != nil {
+		return Discovered{}, err
+	}
+
+	records := mdnsRecords{targets: map[string]dnsmessage.SRVResource{}, addresses: map[string]netip.Addr{}}
+	asked := map[string]bool{}
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return Discovered{}, records.missing(pattern)
+			}
+			return Discovered{}, fmt.Errorf("reading mDNS answers: %w", err)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Response {
+			continue
+		}
+		records.add(msg)
+
+		for _, instance := range records.instances {
+			name := instanceName(instance)
+			if !pattern.MatchString(name) {
+				continue
+			}
+			srv, ok := records.targets[instance]
+			if !ok {
+				continue
+			}
+			target := strings.ToLower(srv.Target.String())
+			addr, ok := records.addresses[target]
+			if !ok {
+				// Responders usually add the address, ask for it once otherwise
+				if !asked[target] {
+					asked[target] = true
+					if err := sendQuery(conn, dnsmessage.TypeA, srv.Target.String()); err != nil {
+						return Discovered{}, err
+					}
+				}
+				continue
+			}
+			host := deviceaddr.HostOf(addr)
+			if srv.Port != 80 {
+				host = net.JoinHostPort(addr.String(), strconv.Itoa(int(srv.Port)))
+			}
+			return Discovered{Instance: name, Address: host}, nil
+		}
+	}
+}
+
+// sendQuery sends a one-shot mDNS query for the names
+func sendQuery(conn *net.UDPConn, qtype dnsmessage.Type, names ...string) error {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := b.StartQuestions(); err != nil {
+		return err
+	}
+	for _, name := range names {
+		n, err := dnsmessage.NewName(name)
+		if err != nil {
+			return fmt.Errorf("invalid mDNS name %q: %w", name, err)
+		}
+		if err := b.Question(dnsmessage.Question{Name: n, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+			return err
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteToUDP(msg, mdnsGroup); err != nil {
+		return fmt.Errorf("sending the mDNS query: %w", err)
+	}
+	return nil
+}
+
+func (r *mdnsRecords) add(msg dnsmessage.Message) {
+	resources := append(append(msg.Answers, msg.Authorities...), msg.Additionals...)
+	for _, res := range resources {
+		owner := strings.ToLower(res.Header.Name.String())
+		switch body := res.Body.(type) {
+		case *dnsmessage.PTRResource:
+			instance := strings.ToLower(body.PTR.String())
+			if isService(owner) && !r.known(instance) {
+				r.instances = append(r.instances, instance)
+			}
+		case *dnsmessage.SRVResource:
+			r.targets[owner] = *body
+		case *dnsmessage.AResource:
+			r.addresses[owner] = netip.AddrFrom4(body.A)
+		case *dnsmessage.AAAAResource:
+			addr := netip.AddrFrom16(body.AAAA)
+			if _, ok := r.addresses[owner]; !ok && !addr.IsLinkLocalUnicast() {
+				r.addresses[owner] = addr
+			}
+		}
+	}
+}
+
+func (r *mdnsRecords) known(instance string) bool {
+	for _, i := range r.instances {
+		if i == instance {
+			return true
+		}
+	}
+	return false
+}
+
+// missing explains why no device was discovered
+func (r *mdnsRecords) missing(pattern *regexp.Regexp) error {
+	for _, instance := range r.instances {
+		if name := instanceName(instance); pattern.MatchString(name) {
+			return fmt.Errorf("%s answered via mDNS without an address", name)
+		}
+	}
+	if len(r.instances) == 0 {
+		return errors.New("no device answered via mDNS")
+	}
+	names := make([]string, len(r.instances))
+	for i, instance := range r.instances {
+		names[i] = instanceName(instance)
+	}
+	return fmt.Errorf("none of the devices answering via mDNS matches %q: %s", pattern, strings.Join(names, ", "))
+}
+
+func isService(name string) bool {
+	for _, service := range mdnsServices {
+		if name == service {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceName is the first label of a service instance like shellyplug-s-c8c9a3._http._tcp.local.
+func instanceName(instance string) string {
+	for _, service := range mdnsServices {
+		if name, ok := strings.CutSuffix(instance, "."+service); ok {
+			return name
+		}
+	}
+	return instance
+}
@@ -0,0 +1,249 @@
+// Package shelly switches the relay of a Shelly plug
+package shelly
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/deviceaddr"
+	"gome-assistant/internal/outbound"
+)
+
+// Device generations, which have different APIs
+const (
+	GenUnknown = 0 // Not detected, e.g. in a dry run without a reachable device
+	Gen1       = 1 // HTTP API like /relay/0?turn=off
+	Gen2       = 2 // RPC API like /rpc/Switch.Set, also of the Plus, Pro and Gen3 devices
+)
+
+var (
+	clientOnce sync.Once
+	client     *http.Client
+)
+
+// httpClient returns the client of requests to the Shelly, shared so the DNS cache of its dialer lasts
+func httpClient(cfg *config.Config) *http.Client {
+	clientOnce.Do(func() {
+		client = outbound.DialClient(5*time.Second, cfg.ShellyHeaderValues(), NewDialer(cfg).DialContext)
+	})
+	return client
+}
+
+// apiName names the API of a generation for logs
+func apiName(gen int) string {
+	switch gen {
+	case Gen1:
+		return "the Gen1 API /relay"
+	case Gen2:
+		return "the Gen2 RPC Switch.Set"
+	}
+	return "an undetected API"
+}
+
+// DetectGen asks the device for its generation via /shelly, which Gen2 devices answer with a gen field
+func DetectGen(cfg *config.Config, shellyIP string) (int, error) {
+	var info struct {
+		Gen int `json:"gen"`
+	}
+	if err := getJSON(cfg, shellyIP, "/shelly", "", &info); err != nil {
+		return GenUnknown, fmt.Errorf("detecting the shelly generation: %w", err)
+	}
+	if info.Gen >= Gen2 {
+		return Gen2, nil
+	}
+	return Gen1, nil
+}
+
+// SetRelayOn turns on the shelly relay
+func SetRelayOn(cfg *config.Config, shellyIP string, gen int) error {
+	return setRelay(cfg, shellyIP, gen, true)
+}
+
+// SetRelayOff turns off the shelly relay
+func SetRelayOff(cfg *config.Config, shellyIP string, gen int) error {
+	return setRelay(cfg, shellyIP, gen, false)
+}
+
+// verifyRetryDelay is how long a relay that didn't switch gets before the command is repeated
+const verifyRetryDelay = time.Second
+
+// setRelay sends the relay command and reads the relay state back, repeating the command up to
+// RELAY_VERIFY_RETRIES times while the relay didn't switch, as devices on flaky Wi-Fi occasionally
+// accept the command without switching. A dry run neither sends nor verifies.
+func setRelay(cfg *config.Config, shellyIP string, gen int, on bool) error {
+	if cfg.DryRun {
+		slog.Info("[DRY RUN] Would switch the relay", "action", onOff(on), "relay", cfg.ShellyRelayChannel, "ip", shellyIP, "api", apiName(gen))
+		return nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := sendRelay(cfg, shellyIP, gen, on); err != nil {
+			return err
+		}
+		isOn, err := RelayOn(cfg, shellyIP, gen)
+		if err != nil {
+			return fmt.Errorf("verifying the relay: %w", err)
+		}
+		if isOn == on {
+			return nil
+		}
+		if attempt >= cfg.RelayVerifyRetries {
+			return fmt.Errorf("relay %d is still %s after %d attempts to turn it %s", cfg.ShellyRelayChannel, onOff(isOn), attempt+1, onOff(on))
+		}
+		slog.Warn("Relay did not switch, retrying", "relay", cfg.ShellyRelayChannel, "ip", shellyIP, "action", onOff(on), "state", onOff(isOn), "retry", attempt+1, "retries", cfg.RelayVerifyRetries)
+		time.Sleep(verifyRetryDelay)
+	}
+}
+
+func sendRelay(cfg *config.Config, shellyIP string, gen int, on bool) error {
+	switch gen {
+	case Gen1:
+		// Shelly Gen1 API endpoint to switch the relay
+		return getJSON(cfg, shellyIP, fmt.Sprintf("/relay/%d", cfg.ShellyRelayChannel), "turn="+onOff(on), nil)
+	case Gen2:
+		var set struct {
+			WasOn *bool `json:"was_on"`
+		}
+		if err := postJSON(cfg, shellyIP, "/rpc/Switch.Set", map[string]any{"id": cfg.ShellyRelayChannel, "on": on}, &set); err != nil {
+			return err
+		}
+		if set.WasOn == nil {
+			return fmt.Errorf("shelly Switch.Set response has no was_on")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown shelly generation %d", gen)
+}
+
+// RelayOn reads whether the relay is on, from /relay of Gen1 or Switch.GetStatus of Gen2 devices
+func RelayOn(cfg *config.Config, shellyIP string, gen int) (bool, error) {
+	var output *bool
+	switch gen {
+	case Gen1:
+		var relay struct {
+			IsOn *bool `json:"ison"`
+		}
+		if err := getJSON(cfg, shellyIP, fmt.Sprintf("/relay/%d", cfg.ShellyRelayChannel), "", &relay); err != nil {
+			return false, err
+		}
+		output = relay.IsOn
+	case Gen2:
+		status, err := switchStatus(cfg, shellyIP)
+		if err != nil {
+			return false, err
+		}
+		output = status.Output
+	default:
+		return false, fmt.Errorf("unknown shelly generation %d", gen)
+	}
+	if output == nil {
+		return false, fmt.Errorf("shelly response has no relay state")
+	}
+	return *output, nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// switchState is the part of the Gen2 Switch.GetStatus response used here
+type switchState struct {
+	Output      *bool `json:"output"`
+	Temperature *struct {
+		Celsius *float64 `json:"tC"`
+	} `json:"temperature"`
+}
+
+func switchStatus(cfg *config.Config, shellyIP string) (switchState, error) {
+	var status switchState
+	err := getJSON(cfg, shellyIP, "/rpc/Switch.GetStatus", fmt.Sprintf("id=%d", cfg.ShellyRelayChannel), &status)
+	return status, err
+}
+
+// Temperature reads the internal temperature in °C from the status API of the generation, nil if the
+// device doesn't report one
+func Temperature(cfg *config.Config, shellyIP string, gen int) (*float64, error) {
+	switch gen {
+	case Gen1:
+		var status struct {
+			Temperature *float64 `json:"temperature"`
+		}
+		if err := getJSON(cfg, shellyIP, "/status", "", &status); err != nil {
+			return nil, err
+		}
+		return status.Temperature, nil
+	case Gen2:
+		status, err := switchStatus(cfg, shellyIP)
+		if err != nil || status.Temperature == nil {
+			return nil, err
+		}
+		return status.Temperature.Celsius, nil
+	}
+	return nil, fmt.Errorf("unknown shelly generation %d", gen)
+}
+
+// getJSON requests a device API path and decodes the response into v, unless v is nil
+func getJSON(cfg *config.Config, shellyIP, path, query string, v any) error {
+	apiURL, err := deviceaddr.URL(shellyIP, path, query)
+	if err != nil {
+		return err
+	}
+	resp, err := do(httpClient(cfg), cfg.ShellyUser, cfg.Secret("SHELLY_PASSWORD"), func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, apiURL, nil)
+	})
+	if err != nil {
+		return err
+	}
+	return decode(resp, path, v)
+}
+
+// postJSON posts body as JSON to a device RPC path and decodes the response into v
+func postJSON(cfg *config.Config, shellyIP, path string, body, v any) error {
+	apiURL, err := deviceaddr.URL(shellyIP, path, "")
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := do(httpClient(cfg), cfg.ShellyUser, cfg.Secret("SHELLY_PASSWORD"), func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, apiURL, bytes.NewReader(payload))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		return req, err
+	})
+	if err != nil {
+		return err
+	}
+	return decode(resp, path, v)
+}
+
+func decode(resp *http.Response, path string, v any) error {
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("shelly request %s failed with status %d: %s", path, resp.StatusCode, string(body))
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding shelly response of %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package shelly
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/version"
+)
+
+// useClient makes the next request create the shared client from its configuration, and again after
+// the test
+func useClient(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		clientOnce = sync.Once{}
+		client = nil
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// headerPlug is a Gen2 plug recording the headers of the requests by path
+type headerPlug struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	headers map[string]http.Header
+}
+
+func newHeaderPlug(t *testing.T) *headerPlug {
+	t.Helper()
+	p := &headerPlug{headers: map[string]http.Header{}}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.headers[r.URL.Path] = r.Header.Clone()
+		p.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/shelly":
+			_, _ = w.Write([]byte(`{"gen":2}`))
+		case "/rpc/Switch.Set":
+			_, _ = w.Write([]byte(`{"was_on":true}`))
+		case "/rpc/Switch.GetStatus":
+			_, _ = w.Write([]byte(`{"output":false}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestShellyHeaders(t *testing.T) {
+	useClient(t)
+	plug := newHeaderPlug(t)
+	cfg := &config.Config{ShellyHeaders: "X-Org: workshop; X-Api-Key: s3cret"}
+	address := strings.TrimPrefix(plug.URL, "http://")
+
+	if gen, err := DetectGen(cfg, address); err != nil || gen != Gen2 {
+		t.Fatalf("DetectGen = %d, %v", gen, err)
+	}
+	if err := SetRelayOff(cfg, address, Gen2); err != nil {
+		t.Fatal(err)
+	}
+	if on, err := RelayOn(cfg, address, Gen2); err != nil || on {
+		t.Fatalf("RelayOn = %v, %v", on, err)
+	}
+
+	plug.mu.Lock()
+	defer plug.mu.Unlock()
+	for _, path := range []string{"/shelly", "/rpc/Switch.Set", "/rpc/Switch.GetStatus"} {
+		h, ok := plug.headers[path]
+		if !ok {
+			t.Errorf("%s not requested", path)
+			continue
+		}
+		if h.Get("User-Agent") != version.UserAgent() || h.Get("X-Org") != "workshop" || h.Get("X-Api-Key") != "s3cret" {
+			t.Errorf("%s: headers %v", path, h)
+		}
+	}
+	if got := plug.headers["/rpc/Switch.Set"].Get("Content-Type"); got != "application/json" {
+		t.Errorf("Switch.Set content type = %q, the configured headers replaced it", got)
+	}
+}
+
+func TestShellyWithoutHeaders(t *testing.T) {
+	useClient(t)
+	plug := newHeaderPlug(t)
+	if _, err := DetectGen(&config.Config{}, strings.TrimPrefix(plug.URL, "http://")); err != nil {
+		t.Fatal(err)
+	}
+	plug.mu.Lock()
+	defer plug.mu.Unlock()
+	if h := plug.headers["/shelly"]; h.Get("User-Agent") != version.UserAgent() || h.Get("X-Org") != "" {
+		t.Errorf("headers = %v, want only the user agent", h)
+	}
+}
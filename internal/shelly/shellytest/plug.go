@@ -0,0 +1,157 @@
+// Package shellytest provides a fake Shelly plug for tests, speaking the Gen1 HTTP API or the Gen2 RPC API
+package shellytest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Command is a relay command received by the plug
+type Command struct {
+	Time time.Time
+	On   bool
+}
+
+// Plug is a fake Shelly plug with one relay channel
+type Plug struct {
+	*httptest.Server
+	gen int
+
+	mu          sync.Mutex
+	on          bool
+	temperature *float64
+	stuck       bool // Accepts commands without switching
+	status      int  // Status of every request, 0 to answer them
+	commands    []Command
+}
+
+// NewPlug starts a fake plug of the generation, 1 or 2, with the relay on; closed when the test ends
+func NewPlug(t testing.TB, gen int) *Plug {
+	t.Helper()
+	p := &Plug{gen: gen, on: true}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serve))
+	t.Cleanup(p.Close)
+	return p
+}
+
+// Address returns the host and port of the plug, as found in the address label
+func (p *Plug) Address() string {
+	return strings.TrimPrefix(p.URL, "http://")
+}
+
+// On reports whether the relay is on
+func (p *Plug) On() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.on
+}
+
+// SetOn switches the relay like a button press on the plug
+func (p *Plug) SetOn(on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.on = on
+}
+
+// SetTemperature sets the internal temperature reported in °C
+func (p *Plug) SetTemperature(celsius float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.temperature = &celsius
+}
+
+// SetStuck makes the plug accept commands without switching the relay
+func (p *Plug) SetStuck(stuck bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stuck = stuck
+}
+
+// Fail answers every request with status, or serves them again with status 0
+func (p *Plug) Fail(status int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = status
+}
+
+// Commands returns the relay commands received so far
+func (p *Plug) Commands() []Command {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Command(nil), p.commands...)
+}
+
+func (p *Plug) serve(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status != 0 {
+		http.Error(w, http.StatusText(p.status), p.status)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/shelly":
+		info := map[string]any{"type": "SHPLG-S", "mac": "A4CF12F45D11"}
+		if p.gen >= 2 {
+			info = map[string]any{"id": "shellyplusplugs-a8032ab1c2d3", "model": "SNPL-00112EU", "gen": p.gen}
+		}
+		writeJSON(w, info)
+	case p.gen >= 2 && r.URL.Path == "/rpc/Switch.Set" && r.Method == http.MethodPost:
+		var req struct {
+			ID int   `json:"id"`
+			On *bool `json:"on"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID != 0 || req.On == nil {
+			http.Error(w, `{"code":-103,"message":"Invalid argument"}`, http.StatusBadRequest)
+			return
+		}
+		wasOn := p.on
+		p.switchLocked(*req.On)
+		writeJSON(w, map[string]any{"was_on": wasOn})
+	case p.gen >= 2 && r.URL.Path == "/rpc/Switch.GetStatus":
+		if r.URL.Query().Get("id") != "0" {
+			http.Error(w, `{"code":-105,"message":"Argument 'id', value 1 not found!"}`, http.StatusNotFound)
+			return
+		}
+		status := map[string]any{"id": 0, "source": "http", "output": p.on}
+		if p.temperature != nil {
+			status["temperature"] = map[string]any{"tC": *p.temperature, "tF": *p.temperature*9/5 + 32}
+		}
+		writeJSON(w, status)
+	case p.gen == 1 && r.URL.Path == "/relay/0":
+		if turn := r.URL.Query().Get("turn"); turn != "" {
+			if turn != "on" && turn != "off" {
+				http.Error(w, "Bad turn!", http.StatusBadRequest)
+				return
+			}
+			p.switchLocked(turn == "on")
+		}
+		writeJSON(w, map[string]any{"ison": p.on, "has_timer": false, "source": "http"})
+	case p.gen == 1 && r.URL.Path == "/status":
+		status := map[string]any{"relays": []any{map[string]any{"ison": p.on}}}
+		if p.temperature != nil {
+			status["temperature"] = *p.temperature
+		}
+		writeJSON(w, status)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// switchLocked records a relay command. The caller holds p.mu.
+func (p *Plug) switchLocked(on bool) {
+	p.commands = append(p.commands, Command{Time: time.Now(), On: on})
+	if !p.stuck {
+		p.on = on
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
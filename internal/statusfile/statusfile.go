@@ -0,0 +1,68 @@
+// Package statusfile writes the current status to a JSON file after every cycle
+package statusfile
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"gome-assistant/internal/atomicfile"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+)
+
+// statusFileSchemaVersion is bumped on incompatible changes of the status file
+const statusFileSchemaVersion = 1
+
+// File is the content of STATUS_FILE
+type File struct {
+	SchemaVersion int                        `json:"schema_version"`
+	Decision      *controller.DecisionRecord `json:"decision,omitempty"` // Of the last cycle, if it got that far
+	controller.Status
+}
+
+// Writer rewrites the status file after every cycle
+type Writer struct {
+	cfg   *config.Config
+	state *controller.State
+	path  string
+
+	// Touched only by the bus subscriber goroutine
+	decision *controller.DecisionRecord
+	failing  bool
+}
+
+func New(cfg *config.Config, state *controller.State) *Writer {
+	return &Writer{cfg: cfg, state: state, path: cfg.StatusFile}
+}
+
+// Handle is the event bus subscriber of the status file
+func (w *Writer) Handle(be controller.BusEvent) error {
+	switch e := be.(type) {
+	case controller.DecisionMade:
+		record := controller.NewDecisionRecord(e)
+		w.decision = &record
+	case controller.CycleCompleted:
+		content := File{SchemaVersion: statusFileSchemaVersion, Decision: w.decision, Status: controller.GetStatus(w.cfg, w.state)}
+		w.decision = nil
+		err := w.write(content)
+		// Only report the first failure until writing works again
+		if err != nil && w.failing {
+			return nil
+		}
+		if err == nil && w.failing {
+			slog.Info("Writing the status file recovered", "path", w.path)
+		}
+		w.failing = err != nil
+		return err
+	}
+	return nil
+}
+
+// write replaces the file atomically so readers never see a partial write
+func (w *Writer) write(content File) error {
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(w.path, append(data, '\n'))
+}
@@ -0,0 +1,167 @@
+package statusfile
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+	"gome-assistant/internal/metrics"
+	"gome-assistant/internal/metrics/metricstest"
+	"gome-assistant/internal/printer"
+	"gome-assistant/internal/relay"
+	"gome-assistant/internal/shelly/shellytest"
+)
+
+// newCycleState wires a controller against fake VictoriaMetrics and Shelly backends, writing the status file
+func newCycleState(t *testing.T, watts float64) (*config.Config, *controller.State, *metricstest.VM) {
+	t.Helper()
+	plug := shellytest.NewPlug(t, 2)
+	now := time.Now().Truncate(time.Second)
+	vm := metricstest.NewVM(t,
+		metricstest.Series{Labels: metricstest.ShellyWatts("bambu-plug", plug.Address()), Samples: metricstest.Constant(now.Add(-10*time.Minute), now, time.Minute, watts)},
+		metricstest.Series{Labels: metricstest.GcodeState("x1c"), Samples: metricstest.Constant(now.Add(-10*time.Minute), now, time.Minute, 0)},
+	)
+	cfg := &config.Config{
+		VictoriaMetricsURL:   vm.URL,
+		ShellyDevicePattern:  ".*[Bb]ambu.*",
+		ShellyNameLabel:      "device_name",
+		ShellyAddressLabel:   "ip_address",
+		CheckInterval:        time.Minute,
+		MinWatts:             7,
+		MaxWatts:             9,
+		StandbyDuration:      15 * time.Minute,
+		BootGracePeriod:      20 * time.Minute,
+		OffCooldown:          10 * time.Minute,
+		QueryConcurrency:     4,
+		QueryTimeout:         10 * time.Second,
+		MaxRangePoints:       2000,
+		HeartbeatMode:        config.HeartbeatOff,
+		PreActionHookFailure: config.PreActionAllow,
+		PrinterSource:        config.PrinterSourceBambu,
+		RelayType:            config.RelayShelly,
+		StatusFile:           filepath.Join(t.TempDir(), "status.json"),
+	}
+
+	client := metrics.NewHTTPClient(cfg)
+	source, err := printer.New(cfg, client, clock.Real{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugRelay, err := relay.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := controller.NewBus()
+	t.Cleanup(bus.Close)
+	state := &controller.State{Bus: bus, Metrics: client, Printer: source, Relay: plugRelay, Clock: clock.Real{}}
+	bus.Subscribe("status file", controller.DefaultBusBuffer, New(cfg, state).Handle)
+	return cfg, state, vm
+}
+
+// readFile waits until the status file describes a cycle after since
+func readFile(t *testing.T, path string, since time.Time) File {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var f File
+		data, err := os.ReadFile(path)
+		if err == nil {
+			if err := json.Unmarshal(data, &f); err != nil {
+				t.Fatalf("status file %s: %v", data, err)
+			}
+			if f.LastCycle != nil && !f.LastCycle.Before(since) {
+				return f
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the status file was not written after %s: %v", since, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStatusFileUpdatesAcrossCycles(t *testing.T) {
+	cfg, state, vm := newCycleState(t, 8)
+
+	start := time.Now().Truncate(time.Second)
+	controller.RunCycle(context.Background(), cfg, state)
+	f := readFile(t, cfg.StatusFile, start)
+	if f.SchemaVersion != statusFileSchemaVersion {
+		t.Errorf("schema_version = %d, want %d", f.SchemaVersion, statusFileSchemaVersion)
+	}
+	if f.Device != "bambu-plug" || f.Watts == nil || *f.Watts != 8 || f.LastCycleError != "" {
+		t.Errorf("status = device %q, watts %v, error %q", f.Device, f.Watts, f.LastCycleError)
+	}
+	if f.Decision == nil || f.Decision.Outcome != controller.OutcomeStandby || f.Decision.Watts != 8 {
+		t.Errorf("decision = %+v, want standby at 8 W", f.Decision)
+	}
+	first := *f.LastCycle
+
+	// The printer starts heating
+	now := time.Now().Truncate(time.Second)
+	vm.Set(
+		metricstest.Series{Labels: metricstest.ShellyWatts("bambu-plug", state.ShellyIP), Samples: metricstest.Constant(now.Add(-10*time.Minute), now, time.Minute, 350)},
+		metricstest.Series{Labels: metricstest.GcodeState("x1c"), Samples: metricstest.Constant(now.Add(-10*time.Minute), now, time.Minute, 2)},
+	)
+	controller.RunCycle(context.Background(), cfg, state)
+	f = readFile(t, cfg.StatusFile, first.Add(time.Nanosecond))
+	if f.Watts == nil || *f.Watts != 350 || f.Decision == nil || f.Decision.Outcome != controller.OutcomeSkip {
+		t.Errorf("second cycle: watts %v, decision %+v, want a skip at 350 W", f.Watts, f.Decision)
+	}
+
+	// An outage fails the cycle before a decision is made
+	vm.Fail(503, "unavailable")
+	second := *f.LastCycle
+	controller.RunCycle(context.Background(), cfg, state)
+	f = readFile(t, cfg.StatusFile, second.Add(time.Nanosecond))
+	if f.LastCycleError == "" || f.Decision != nil {
+		t.Errorf("failed cycle: error %q, decision %+v, want the error without a decision", f.LastCycleError, f.Decision)
+	}
+
+	// The file stays small and no temporary files are left over
+	if info, err := os.Stat(cfg.StatusFile); err != nil || info.Size() > 16<<10 {
+		t.Errorf("status file: %v, %d bytes", err, info.Size())
+	}
+	entries, _ := os.ReadDir(filepath.Dir(cfg.StatusFile))
+	if len(entries) != 1 {
+		t.Errorf("files next to the status file: %v", entries)
+	}
+}
+
+func TestStatusFileFailuresAreSuppressed(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	cfg := &config.Config{StatusFile: filepath.Join(dir, "status.json")}
+	w := New(cfg, &controller.State{Clock: clock.Real{}})
+
+	if err := w.Handle(controller.CycleCompleted{}); err == nil {
+		t.Fatal("writing into a missing directory succeeded")
+	}
+	if err := w.Handle(controller.CycleCompleted{}); err != nil {
+		t.Errorf("repeated failure reported again: %v", err)
+	}
+
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Handle(controller.CycleCompleted{}); err != nil {
+		t.Fatalf("after the directory was created: %v", err)
+	}
+	if _, err := os.Stat(cfg.StatusFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(cfg.StatusFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Handle(controller.CycleCompleted{}); err == nil {
+		t.Error("a new failure after the recovery was not reported")
+	}
+}
@@ -0,0 +1,69 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Conditions of /healthz
+const (
+	conditionCycle   = "last_cycle"
+	conditionVMQuery = "vm_query"
+)
+
+// health is the JSON body of /healthz
+type health struct {
+	Status  string            `json:"status"`
+	Failing []failedCondition `json:"failing,omitempty"`
+}
+
+// failedCondition is a condition of /healthz that doesn't hold, with how long it hasn't
+type failedCondition struct {
+	Condition  string  `json:"condition"`
+	AgeSeconds float64 `json:"age_seconds"`
+	Detail     string  `json:"detail"`
+}
+
+// handleHealth answers 200 if a check cycle completed within twice the check interval and the most
+// recent VictoriaMetrics query succeeded, 503 otherwise. It only reads what the last cycles left behind.
+func (e *Exporter) handleHealth(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	e.mu.Lock()
+	lastCycle := e.lastCycle
+	e.mu.Unlock()
+
+	var failing []failedCondition
+	limit := 2 * e.cfg.CheckInterval
+	if lastCycle.IsZero() {
+		if age := now.Sub(e.started); age > limit {
+			failing = append(failing, failedCondition{
+				Condition:  conditionCycle,
+				AgeSeconds: age.Seconds(),
+				Detail:     fmt.Sprintf("no check cycle completed in the %s since the start, expected one within %s", age.Round(time.Second), limit),
+			})
+		}
+	} else if age := now.Sub(lastCycle); age > limit {
+		failing = append(failing, failedCondition{
+			Condition:  conditionCycle,
+			AgeSeconds: age.Seconds(),
+			Detail:     fmt.Sprintf("the last check cycle completed %s ago, expected one within %s", age.Round(time.Second), limit),
+		})
+	}
+	if stats := e.client.Stats(); stats.LastErr != nil {
+		failing = append(failing, failedCondition{
+			Condition:  conditionVMQuery,
+			AgeSeconds: now.Sub(stats.FailingSince).Seconds(),
+			Detail:     stats.LastErr.Error(),
+		})
+	}
+
+	status, body := http.StatusOK, health{Status: "ok"}
+	if len(failing) > 0 {
+		status, body = http.StatusServiceUnavailable, health{Status: "failing", Failing: failing}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
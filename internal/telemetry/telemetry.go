@@ -0,0 +1,203 @@
+// Package telemetry exports the metrics and the health of gome-assistant itself on METRICS_ADDR
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+	"gome-assistant/internal/metrics"
+)
+
+// reasonStaleMetrics is the gome_skip_reason of a device locked out by stale metrics, which skips
+// relay control without publishing a decision
+const reasonStaleMetrics = "stale_metrics"
+
+// skipReasons are the values of the gome_skip_reason enum
+var skipReasons = append(slices.Clone(controller.SkipReasons), reasonStaleMetrics)
+
+// deviceMetrics are the series of a device
+type deviceMetrics struct {
+	watts         float64
+	standby       time.Duration
+	skipReason    string         // Of the last decision, "" unless it skipped
+	relayOffs     map[string]int // By source
+	relayFailures int
+}
+
+// Exporter serves the counters and gauges collected from the event bus, and the health derived from them
+type Exporter struct {
+	cfg     *config.Config
+	client  *metrics.HTTPClient
+	srv     *http.Server
+	failed  chan error
+	started time.Time
+
+	mu        sync.Mutex
+	cycles    int
+	lastCycle time.Time
+	devices   map[string]*deviceMetrics
+}
+
+func New(cfg *config.Config, client *metrics.HTTPClient) *Exporter {
+	e := &Exporter{
+		cfg:     cfg,
+		client:  client,
+		failed:  make(chan error, 1),
+		started: time.Now(),
+		devices: map[string]*deviceMetrics{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", e.handleMetrics)
+	mux.HandleFunc("GET /healthz", e.handleHealth)
+	e.srv = &http.Server{
+		Addr:              cfg.MetricsAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return e
+}
+
+// Handle is the event bus subscriber of the exporter
+func (e *Exporter) Handle(be controller.BusEvent) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch ev := be.(type) {
+	case controller.CycleCompleted:
+		e.cycles++
+		e.lastCycle = ev.Time
+	case controller.DecisionMade:
+		d := e.device(ev.Device)
+		d.watts = ev.Watts
+		d.standby = ev.StandbyDuration
+		d.skipReason = ""
+		if ev.Outcome == controller.OutcomeSkip {
+			d.skipReason = ev.Reason
+		}
+	case controller.LockoutEngaged:
+		if ev.Reason == controller.LockoutStaleMetrics {
+			d := e.device(ev.Device)
+			d.watts = ev.Watts
+			d.skipReason = reasonStaleMetrics
+		}
+	case controller.ActionExecuted:
+		if ev.Action == controller.ActionOff {
+			e.device(ev.Device).relayOffs[ev.Source]++
+		}
+	case controller.ActionFailed:
+		e.device(ev.Device).relayFailures++
+	}
+	return nil
+}
+
+// device returns the series of a device, adding them on its first event. The caller holds e.mu.
+func (e *Exporter) device(name string) *deviceMetrics {
+	d, ok := e.devices[name]
+	if !ok {
+		d = &deviceMetrics{relayOffs: map[string]int{controller.SourceAuto: 0}}
+		e.devices[name] = d
+	}
+	return d
+}
+
+// handleMetrics writes the series in the Prometheus text format
+func (e *Exporter) handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var b bytes.Buffer
+	instance := fmt.Sprintf("instance_name=%q", e.cfg.InstanceName())
+	single := func(name, help, kind string, value float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s{%s} %g\n", name, help, name, kind, name, instance, value)
+	}
+	single("gome_cycles_total", "Completed check cycles", "counter", float64(e.cycles))
+	single("gome_vm_query_errors_total", "VictoriaMetrics queries failed by a transport error or a 5xx response", "counter", float64(e.client.Stats().Errors))
+	if !e.lastCycle.IsZero() {
+		single("gome_last_cycle_timestamp_seconds", "When the last check cycle completed", "gauge", float64(e.lastCycle.Unix()))
+	}
+
+	names := make([]string, 0, len(e.devices))
+	for name := range e.devices {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	series := func(name, help, kind string, value func(*deviceMetrics) float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, device := range names {
+			fmt.Fprintf(&b, "%s{%s,device=%q} %g\n", name, instance, device, value(e.devices[device]))
+		}
+	}
+	if len(names) > 0 {
+		b.WriteString("# HELP gome_relay_off_total Relay switched off\n# TYPE gome_relay_off_total counter\n")
+		for _, device := range names {
+			d := e.devices[device]
+			sources := make([]string, 0, len(d.relayOffs))
+			for source := range d.relayOffs {
+				sources = append(sources, source)
+			}
+			slices.Sort(sources)
+			for _, source := range sources {
+				fmt.Fprintf(&b, "gome_relay_off_total{%s,device=%q,source=%q} %d\n", instance, device, source, d.relayOffs[source])
+			}
+		}
+		series("gome_relay_failures_total", "Failed relay commands", "counter", func(d *deviceMetrics) float64 { return float64(d.relayFailures) })
+		series("gome_current_watts", "Power draw of the last check", "gauge", func(d *deviceMetrics) float64 { return d.watts })
+		series("gome_standby_seconds", "Duration of the standby streak of the last check", "gauge", func(d *deviceMetrics) float64 { return d.standby.Seconds() })
+
+		b.WriteString("# HELP gome_skip_reason Why the last check skipped relay control\n# TYPE gome_skip_reason gauge\n")
+		for _, device := range names {
+			for _, reason := range skipReasons {
+				fmt.Fprintf(&b, "gome_skip_reason{%s,device=%q,reason=%q} %g\n", instance, device, reason, boolValue(reason == e.devices[device].skipReason))
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(b.Bytes())
+}
+
+// Start listens and serves in the background like the HTTP listener: Start returns the error of
+// listening, Failed delivers a later one.
+func (e *Exporter) Start() error {
+	listener, err := net.Listen("tcp", e.cfg.MetricsAddr)
+	if err != nil {
+		return err
+	}
+	slog.Info("Metrics listener started", "addr", e.cfg.MetricsAddr)
+	go func() {
+		if err := e.srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.failed <- err
+		}
+	}()
+	return nil
+}
+
+// Failed delivers the error of a listener that stopped serving
+func (e *Exporter) Failed() <-chan error {
+	return e.failed
+}
+
+// Shutdown waits a few seconds for in-flight scrapes
+func (e *Exporter) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.srv.Shutdown(ctx); err != nil {
+		slog.Error("Shutting down the metrics listener failed", "error", err)
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
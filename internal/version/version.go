@@ -0,0 +1,58 @@
+// Package version holds the version of the build
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time with -ldflags, e.g.
+// -X gome-assistant/internal/version.Version=1.2.3 -X gome-assistant/internal/version.Commit=$(git rev-parse HEAD)
+// -X gome-assistant/internal/version.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+var (
+	Version = "dev"
+	Commit  = "" // Git commit, taken from the VCS stamp of go build if not set
+	Date    = "" // Build date, taken from the commit time of the VCS stamp if not set
+)
+
+// Info is the build information of the binary
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build information
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, Date: Date, GoVersion: runtime.Version()}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range build.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.Date == "":
+				info.Date = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// String formats the information for -version and the startup log
+func (i Info) String() string {
+	commit, date := i.Commit, i.Date
+	if commit == "" {
+		commit = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", i.Version, commit, date, i.GoVersion)
+}
+
+// UserAgent is sent with every outbound HTTP request
+func UserAgent() string {
+	return "gome-assistant/" + Version
+}
@@ -1,534 +1,495 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"net/url"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/joho/godotenv"
+	"gome-assistant/internal/audit"
+	"gome-assistant/internal/calendar"
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+	"gome-assistant/internal/homeassistant"
+	"gome-assistant/internal/leader"
+	"gome-assistant/internal/metrics"
+	"gome-assistant/internal/mqtt"
+	"gome-assistant/internal/notify"
+	"gome-assistant/internal/outbound"
+	"gome-assistant/internal/price"
+	"gome-assistant/internal/printer"
+	"gome-assistant/internal/relay"
+	"gome-assistant/internal/report"
+	"gome-assistant/internal/server"
+	"gome-assistant/internal/statusfile"
+	"gome-assistant/internal/telemetry"
+	"gome-assistant/internal/version"
 )
 
-// Config holds the configuration for the assistant
-type Config struct {
-	VictoriaMetricsURL      string
-	VictoriaMetricsUser     string
-	VictoriaMetricsPassword string
-	ShellyDevicePattern     string
-	CheckInterval           time.Duration
-	MinWatts                float64
-	MaxWatts                float64
-	StandbyDuration         time.Duration
-	BootGracePeriod         time.Duration
-	DryRun                  bool
-}
-
-// State tracks the current state of the assistant
-type State struct {
-	ShellyIP         string     // Cached Shelly device IP from metrics
-	LastRelayOffTime *time.Time // When we last turned off the relay
-}
+// Exit codes of the daemon and the subcommands
+const (
+	exitOK       = 0 // Clean shutdown
+	exitNotMet   = 1 // status: the off condition is not met, off: a print is in progress
+	exitConfig   = 2 // Invalid configuration or arguments
+	exitSelfTest = 3 // A startup check failed, like opening the audit file or the HTTP listener
+	exitRuntime  = 4 // Unrecoverable error while running
+	exitCheck    = 5 // The single check of -once failed
+)
 
-// VMQueryResult represents a VictoriaMetrics query result
-type VMQueryResult struct {
-	Status string `json:"status"`
-	Data   struct {
-		ResultType string `json:"resultType"`
-		Result     []struct {
-			Metric map[string]string `json:"metric"`
-			Value  []interface{}     `json:"value"`  // For instant queries: [timestamp, value]
-			Values [][]interface{}   `json:"values"` // For range queries: [[timestamp, value], ...]
-		} `json:"result"`
-	} `json:"data"`
+// fatal logs an error with its attributes like log.Fatalf and exits with code
+func fatal(code int, msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(code)
 }
 
 func main() {
-	// Load .env file if it exists
-	if err := godotenv.Load(); err != nil {
-		log.Printf("No .env file found or error loading it: %v", err)
+	outbound.InstallDefault()
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		runHistory(os.Args[2:])
+		return
 	}
-
-	cfg := Config{}
-
-	flag.StringVar(&cfg.VictoriaMetricsURL, "vm-url", getEnv("VM_URL", "https://vm.r4b2.de"), "VictoriaMetrics URL")
-	flag.StringVar(&cfg.VictoriaMetricsUser, "vm-user", getEnv("VM_USER", "admin"), "VictoriaMetrics basic auth user")
-	flag.StringVar(&cfg.VictoriaMetricsPassword, "vm-password", getEnv("VM_PASSWORD", ""), "VictoriaMetrics basic auth password")
-	flag.StringVar(&cfg.ShellyDevicePattern, "shelly-pattern", getEnv("SHELLY_DEVICE_PATTERN", ".*[Bb]ambu.*"), "Regex pattern to match Shelly device name")
-	flag.DurationVar(&cfg.CheckInterval, "interval", parseDuration(getEnv("CHECK_INTERVAL", "60s")), "Check interval")
-	flag.Float64Var(&cfg.MinWatts, "min-watts", parseFloat(getEnv("MIN_WATTS", "7")), "Minimum watts threshold")
-	flag.Float64Var(&cfg.MaxWatts, "max-watts", parseFloat(getEnv("MAX_WATTS", "9")), "Maximum watts threshold")
-	flag.DurationVar(&cfg.StandbyDuration, "standby-duration", parseDuration(getEnv("STANDBY_DURATION", "15m")), "Duration printer must be in standby before turning off")
-	flag.DurationVar(&cfg.BootGracePeriod, "boot-grace", parseDuration(getEnv("BOOT_GRACE_PERIOD", "20m")), "Grace period after printer is turned on before checking standby")
-	flag.BoolVar(&cfg.DryRun, "dry-run", getEnv("DRY_RUN", "false") == "true", "Dry run mode (don't actually switch relay)")
-	flag.Parse()
-
-	if cfg.VictoriaMetricsPassword == "" {
-		log.Fatal("VM_PASSWORD is required")
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		os.Exit(runStatus(os.Args[2:]))
 	}
-
-	log.Printf("Starting gome-assistant")
-	log.Printf("VictoriaMetrics URL: %s", cfg.VictoriaMetricsURL)
-	log.Printf("Shelly Device Pattern: %s", cfg.ShellyDevicePattern)
-	log.Printf("Check interval: %s", cfg.CheckInterval)
-	log.Printf("Watts threshold: %.1f - %.1f", cfg.MinWatts, cfg.MaxWatts)
-	log.Printf("Standby duration before off: %s", cfg.StandbyDuration)
-	log.Printf("Boot grace period: %s", cfg.BootGracePeriod)
-	log.Printf("Dry run: %v", cfg.DryRun)
-
-	state := &State{}
-
-	ticker := time.NewTicker(cfg.CheckInterval)
-	defer ticker.Stop()
-
-	// Run immediately on start
-	checkAndControl(&cfg, state)
-
-	for range ticker.C {
-		checkAndControl(&cfg, state)
+	if len(os.Args) > 1 && (os.Args[1] == "on" || os.Args[1] == "off") {
+		os.Exit(runSwitch(os.Args[1] == "on", os.Args[2:]))
 	}
+	os.Exit(run())
 }
 
-func checkAndControl(cfg *Config, state *State) {
-	log.Println("Checking printer and power status...")
-
-	// Get current shelly power consumption
-	watts, shellyIP, err := getShellyBambuWatts(cfg)
-	if err != nil {
-		log.Printf("Error getting shelly watts: %v", err)
-		return
+// run runs the daemon until it is stopped and returns the exit code
+func run() int {
+	cfg := config.Load()
+	if cfg.ShowVersion {
+		fmt.Println("gome-assistant " + version.Get().String())
+		return exitOK
 	}
 
-	// Cache the Shelly IP for relay control
-	if shellyIP != "" {
-		state.ShellyIP = shellyIP
+	notifiers, err := notify.BuildNotifiers(&cfg)
+	if err != nil {
+		fatal(exitConfig, "Invalid notification config", "error", err)
 	}
 
-	// Safety check: Ensure we have metrics availability
-	hasRecentMetrics, err := hasRecentShellyMetrics(cfg, cfg.CheckInterval*2)
-	if err != nil || !hasRecentMetrics {
-		log.Printf("WARNING: No recent Shelly metrics found, skipping relay control for safety")
-		return
+	templates, err := notify.LoadTemplates(cfg.NotifyTemplatesFile)
+	if err != nil {
+		fatal(exitConfig, "Invalid notification templates", "error", err)
 	}
 
-	// Safety check: If we recently turned off the relay, don't turn it off again
-	// This prevents race conditions where someone turns it back on immediately
-	if state.LastRelayOffTime != nil {
-		timeSinceLastOff := time.Since(*state.LastRelayOffTime)
-		if timeSinceLastOff < cfg.BootGracePeriod {
-			log.Printf("Relay was turned off %s ago, waiting for grace period to avoid race condition", timeSinceLastOff.Round(time.Second))
-			return
+	if cfg.RenderNotification != "" {
+		text, err := notify.RenderSample(templates, notify.EventType(cfg.RenderNotification))
+		if err != nil {
+			fatal(exitConfig, "Rendering notification failed", "error", err)
 		}
+		fmt.Println(text)
+		return exitOK
 	}
 
-	// Check if printer was recently turned on (relay went from off to on)
-	// Look back BootGracePeriod + 1 minute to see power transitions
-	powerOnRecently, err := wasPowerTurnedOnRecently(cfg, cfg.BootGracePeriod)
-	if err != nil {
-		log.Printf("Error checking power transition history: %v", err)
-		return
+	if cfg.NotifyTest {
+		if err := notify.SendTest(notifiers); err != nil {
+			fatal(exitSelfTest, "Notification test failed", "error", err)
+		}
+		return exitOK
 	}
 
-	if powerOnRecently {
-		log.Printf("Printer was turned on within boot grace period (%s), skipping checks", cfg.BootGracePeriod)
-		return
+	if err := cfg.Validate(); err != nil {
+		fatal(exitConfig, "Invalid config", "error", err)
 	}
 
-	// Check if any bambu printer is currently printing or was printing recently
-	isPrinting, err := isBambuPrinting(cfg)
-	if err != nil {
-		log.Printf("Error checking bambu print status: %v", err)
-		return
+	slog.Info("Starting gome-assistant", "version", version.Get().String())
+	slog.Info("Instance name", "instance", cfg.InstanceName())
+	if cfg.ConfigFile != "" {
+		slog.Info("Config file", "path", cfg.ConfigFile)
 	}
-
-	if isPrinting {
-		log.Println("Printer is currently printing, no action taken")
-		return
+	slog.Info("Effective settings", "settings", cfg.Effective())
+	slog.Info("VictoriaMetrics", "url", cfg.VictoriaMetricsURL)
+	if headers := cfg.VMHeaderValues(); len(headers) > 0 {
+		slog.Info("VictoriaMetrics headers", "headers", config.RedactHeaders(headers))
 	}
-
-	// Check if printer was printing recently (within last 15 minutes for safety)
-	wasPrintingRecently, err := wasPrintingRecently(cfg, 15*time.Minute)
-	if err != nil {
-		log.Printf("Error checking recent print history: %v", err)
-		return
+	if headers := cfg.ShellyHeaderValues(); len(headers) > 0 {
+		slog.Info("Shelly headers", "headers", config.RedactHeaders(headers))
 	}
-
-	if wasPrintingRecently {
-		log.Println("Printer was printing recently, waiting before checking standby")
-		return
+	if cfg.ShellyPassword != "" {
+		slog.Info("Shelly login enabled")
 	}
-
-	// If power is already at 0, printer/relay is already off
-	if watts == 0 {
-		log.Println("Printer is off (0W), no action needed")
-		return
+	if cfg.ShellyIP != "" {
+		slog.Info("Shelly IP set, ignoring the address labels", "ip", cfg.ShellyIP)
 	}
-
-	log.Printf("Printer idle, current power consumption: %.2f watts", watts)
-
-	// Check if power has been in standby range for the required duration
-	inStandbyRange := watts >= cfg.MinWatts && watts <= cfg.MaxWatts
-	if !inStandbyRange {
-		log.Printf("Power consumption (%.2f W) is outside standby range (%.1f-%.1f W)", watts, cfg.MinWatts, cfg.MaxWatts)
-		return
+	if cfg.ShellyMDNS {
+		slog.Info("Shelly mDNS discovery enabled")
 	}
-
-	// Query metrics to see how long power has been in standby range
-	standbyDuration, err := getStandbyDuration(cfg, cfg.MinWatts, cfg.MaxWatts, cfg.StandbyDuration)
-	if err != nil {
-		log.Printf("Error checking standby duration: %v", err)
-		return
-	}
-
-	if standbyDuration >= cfg.StandbyDuration {
-		log.Printf("Printer has been in standby for %s (threshold: %s), turning off relay", standbyDuration.Round(time.Second), cfg.StandbyDuration)
-		if state.ShellyIP == "" {
-			log.Printf("Error: No Shelly IP available")
-		} else if err := setShellyRelayOff(cfg, state.ShellyIP); err != nil {
-			log.Printf("Error turning off relay: %v", err)
+	if cfg.ShellyCloudEnabled() {
+		if cfg.ShellyControl == config.ShellyControlCloud {
+			slog.Info("Relay control via the Shelly Cloud", "server", cfg.ShellyCloudServer)
 		} else {
-			log.Println("Relay turned off successfully")
-			now := time.Now()
-			state.LastRelayOffTime = &now
-		}
-	} else {
-		remaining := cfg.StandbyDuration - standbyDuration
-		log.Printf("Printer in standby for %s, %.0f minutes until auto-off", standbyDuration.Round(time.Second), remaining.Minutes())
-	}
-}
-
-// isBambuPrinting checks if any bambu printer is currently printing
-// bambulab_gcode_state: 0 = idle, 1 = running, 2 = paused, 3 = completed, 4 = error
-func isBambuPrinting(cfg *Config) (bool, error) {
-	query := `bambulab_gcode_state`
-	result, err := queryVM(cfg, query)
-	if err != nil {
-		return false, err
-	}
-
-	for _, r := range result.Data.Result {
-		if len(r.Value) >= 2 {
-			valueStr, ok := r.Value[1].(string)
-			if ok && (valueStr == "1" || valueStr == "2") {
-				// 1 = running, 2 = paused (still consider paused as "printing")
-				printer := r.Metric["printer"]
-				log.Printf("Printer %s is printing/paused (state=%s)", printer, valueStr)
-				return true, nil
-			}
+			slog.Info("Relay control falls back to the Shelly Cloud", "server", cfg.ShellyCloudServer)
 		}
 	}
-
-	return false, nil
-}
-
-// getShellyBambuWatts gets the power consumption and IP of the shelly device connected to bambu
-func getShellyBambuWatts(cfg *Config) (float64, string, error) {
-	// Query for shelly device matching the configured pattern
-	query := fmt.Sprintf(`shelly_watts{device_name=~"%s"}`, cfg.ShellyDevicePattern)
-	result, err := queryVM(cfg, query)
-	if err != nil {
-		return 0, "", err
-	}
-
-	if len(result.Data.Result) == 0 {
-		return 0, "", fmt.Errorf("no shelly device matching pattern '%s' found", cfg.ShellyDevicePattern)
+	if cfg.ShellyHosts != "" {
+		slog.Info("Shelly host overrides", "hosts", cfg.ShellyHosts)
 	}
-
-	// Get the first matching device's power consumption and IP
-	device := result.Data.Result[0]
-	ipAddress := device.Metric["ip_address"]
-
-	if len(device.Value) >= 2 {
-		valueStr, ok := device.Value[1].(string)
-		if ok {
-			var watts float64
-			_, _ = fmt.Sscanf(valueStr, "%f", &watts)
-			if ipAddress != "" {
-				log.Printf("Found Shelly device at %s", ipAddress)
-			}
-			return watts, ipAddress, nil
-		}
+	if cfg.ShellyDNSCacheTTL > 0 {
+		slog.Info("Shelly DNS cache enabled", "ttl", cfg.ShellyDNSCacheTTL)
 	}
-
-	return 0, "", fmt.Errorf("could not parse power value")
-}
-
-// hasRecentShellyMetrics checks if shelly metrics have been updated recently
-func hasRecentShellyMetrics(cfg *Config, within time.Duration) (bool, error) {
-	query := fmt.Sprintf(`shelly_watts{device_name=~"%s"}`, cfg.ShellyDevicePattern)
-	result, err := queryVM(cfg, query)
-	if err != nil {
-		return false, err
+	if cfg.ShellyDevices != "" {
+		slog.Info("Shelly devices", "devices", cfg.ShellyDevices)
+	} else {
+		slog.Info("Shelly device pattern", "pattern", cfg.ShellyDevicePattern)
 	}
-
-	if len(result.Data.Result) == 0 {
-		return false, nil
+	slog.Info("Shelly relay channel", "channel", cfg.ShellyRelayChannel)
+	if cfg.ShellyChannelLabel != "" {
+		slog.Info("Shelly power filtered by the channel label", "label", cfg.ShellyChannelLabel, "channel", cfg.ShellyRelayChannel)
 	}
-
-	// Check if timestamp is recent
-	if len(result.Data.Result[0].Value) >= 2 {
-		timestampFloat, ok := result.Data.Result[0].Value[0].(float64)
-		if ok {
-			metricTime := time.Unix(int64(timestampFloat), 0)
-			age := time.Since(metricTime)
-			return age <= within, nil
+	if cfg.Once {
+		slog.Info("Single-shot mode: running one check, then exiting")
+	} else {
+		slog.Info("Check interval", "interval", cfg.CheckInterval)
+		if cfg.RetryDelay > 0 && cfg.RetryMax > 0 {
+			slog.Info("Retry after failed checks", "retry_delay", cfg.RetryDelay, "retries", cfg.RetryMax)
 		}
 	}
+	slog.Info("Standby detection", "min_watts", cfg.MinWatts, "max_watts", cfg.MaxWatts, "standby_duration", cfg.StandbyDuration)
+	slog.Info("Auto-off gates", "boot_grace", cfg.BootGracePeriod, "off_cooldown", cfg.OffCooldown, "veto_window", cfg.VetoWindow)
+	slog.Info("Dry run", "enabled", cfg.DryRun)
+	slog.Info("Heartbeat", "mode", cfg.HeartbeatMode)
 
-	return false, nil
-}
-
-// wasPowerTurnedOnRecently checks if power went from 0 to >0 within the lookback period
-func wasPowerTurnedOnRecently(cfg *Config, lookback time.Duration) (bool, error) {
-	// Query for power transitions using range query
-	query := fmt.Sprintf(`shelly_watts{device_name=~"%s"}`, cfg.ShellyDevicePattern)
-
-	// Use range query to look back
-	queryURL := fmt.Sprintf("%s/api/v1/query_range?query=%s&start=%d&end=%d&step=60s",
-		cfg.VictoriaMetricsURL,
-		url.QueryEscape(query),
-		time.Now().Add(-lookback-1*time.Minute).Unix(),
-		time.Now().Unix())
-
-	req, err := http.NewRequest("GET", queryURL, nil)
-	if err != nil {
-		return false, err
+	for _, n := range notifiers {
+		slog.Info("Notifications enabled", "notifier", n.Name())
 	}
-	req.SetBasicAuth(cfg.VictoriaMetricsUser, cfg.VictoriaMetricsPassword)
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	policy, err := notify.NewPolicy(&cfg)
 	if err != nil {
-		return false, err
+		fatal(exitConfig, "Invalid notification config", "error", err)
 	}
-	defer func() {
-		_ = resp.Body.Close()
-	}()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return false, fmt.Errorf("VM range query failed with status %d: %s", resp.StatusCode, string(body))
-	}
+	bus := controller.NewBus()
+	bus.Subscribe("notifications", controller.DefaultBusBuffer, notify.NewSink(&cfg, notifiers, policy, templates).Handle)
 
-	var result VMQueryResult
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return false, err
+	clk := clock.Real{}
+	httpClient := metrics.NewHTTPClient(&cfg)
+	var metricsClient metrics.Client = httpClient
+	if cfg.BreakerThreshold > 0 {
+		metricsClient = metrics.NewBreaker(metricsClient, cfg.BreakerThreshold, cfg.BreakerCooldown, clk)
+		slog.Info("Metrics circuit breaker enabled", "threshold", cfg.BreakerThreshold, "cooldown", cfg.BreakerCooldown)
 	}
-
-	if len(result.Data.Result) == 0 {
-		return false, nil
+	devices, err := cfg.DeviceList()
+	if err != nil {
+		fatal(exitConfig, "Invalid device config", "error", err)
+	}
+	states := make([]*controller.State, len(devices))
+	// The devices share one limit of QUERY_CONCURRENCY, so more devices don't mean more load on VictoriaMetrics
+	queries := controller.NewQueryLimit(cfg.QueryConcurrency)
+	// One heartbeat per interval for all devices, so their results don't take turns at HEARTBEAT_URL
+	heartbeat := controller.NewHeartbeat(&cfg)
+	for i := range devices {
+		states[i], err = newDeviceState(&devices[i], bus, metricsClient, queries, clk)
+		if err != nil {
+			fatal(exitConfig, "Invalid device config", "error", err)
+		}
+		states[i].Heartbeat = heartbeat
+		if tester, ok := states[i].Relay.(relay.SelfTester); ok {
+			if err := tester.SelfTest(); err != nil {
+				fatal(exitSelfTest, "Relay self-test failed", "relay", states[i].Relay.Name(), "error", err)
+			}
+		}
 	}
-
-	// Check for power transition from ~0 to >10W (indicating relay turned on)
-	// This would indicate printer was powered on
-	values := result.Data.Result[0].Values // Use Values for range query
-	if len(values) > 2 {
-		// Look for a transition from low to high power
-		var previousLow bool
-		for _, pair := range values {
-			if len(pair) >= 2 {
-				if valueStr, ok := pair[1].(string); ok {
-					var watts float64
-					_, _ = fmt.Sscanf(valueStr, "%f", &watts)
-
-					if watts < 5 {
-						previousLow = true
-					} else if previousLow && watts > 10 {
-						// Found transition from off/low to on
-						return true, nil
+	if cfg.MQTTBroker != "" {
+		var onSwitch mqtt.SwitchHandler
+		if cfg.HADiscovery {
+			onSwitch = func(device string, on bool) error {
+				for i, st := range states {
+					if st.Device() == device {
+						return controller.RequestSwitch(&devices[i].Config, st, on, "home assistant")
 					}
 				}
+				return fmt.Errorf("unknown device %q", device)
 			}
 		}
-	}
-
-	return false, nil
-}
-
-// wasPrintingRecently checks if the printer was printing within the lookback period
-func wasPrintingRecently(cfg *Config, lookback time.Duration) (bool, error) {
-	// Query for recent gcode_state values
-	query := `max_over_time(bambulab_gcode_state[` + lookback.String() + `])`
-	result, err := queryVM(cfg, query)
-	if err != nil {
-		return false, err
-	}
-
-	for _, r := range result.Data.Result {
-		if len(r.Value) >= 2 {
-			if valueStr, ok := r.Value[1].(string); ok {
-				// If max state in the period was 1 or 2 (running/paused), it was printing
-				if valueStr == "1" || valueStr == "2" {
-					return true, nil
-				}
+		publisher, err := mqtt.NewPublisher(&cfg, onSwitch)
+		if err != nil {
+			fatal(exitConfig, "Invalid MQTT config", "error", err)
+		}
+		// Closed after the bus so queued events are still published
+		defer publisher.Close()
+		bus.Subscribe("mqtt", controller.DefaultBusBuffer, publisher.Handle)
+		slog.Info("MQTT publishing enabled", "broker", cfg.MQTTBroker, "base_topic", cfg.MQTTBaseTopic)
+	}
+	if cfg.HAToken != "" {
+		bus.Subscribe("home assistant", controller.DefaultBusBuffer, homeassistant.NewReporter(&cfg).Handle)
+		slog.Info("Home Assistant state reporting enabled", "url", cfg.HAURL)
+	}
+	if cfg.AuditFile != "" {
+		auditLog, err := audit.New(cfg.AuditFile, cfg.InstanceName())
+		if err != nil {
+			fatal(exitSelfTest, "Error opening audit file", "error", err)
+		}
+		defer auditLog.Close()
+		bus.Subscribe("audit", controller.DefaultBusBuffer, auditLog.Handle)
+		slog.Info("Audit log", "path", cfg.AuditFile)
+		bus.Subscribe("monthly report", controller.DefaultBusBuffer, report.New(&cfg, bus).Handle)
+	}
+	for i, dev := range devices {
+		if dev.Config.StatusFile != "" {
+			bus.Subscribe("status file", controller.DefaultBusBuffer, statusfile.New(&devices[i].Config, states[i]).Handle)
+			slog.Info("Status file", "path", dev.Config.StatusFile)
+		}
+		if dev.Config.StateFile != "" {
+			if err := controller.LoadState(&devices[i].Config, states[i]); err != nil {
+				slog.Error("Reading the state file failed, starting afresh", "path", dev.Config.StateFile, "error", err)
 			}
+			slog.Info("State file", "path", dev.Config.StateFile)
 		}
 	}
-
-	return false, nil
-}
-
-// getStandbyDuration calculates how long power has been continuously in standby range
-func getStandbyDuration(cfg *Config, minWatts, maxWatts float64, maxDuration time.Duration) (time.Duration, error) {
-	// Query power values over the max duration + buffer
-	lookback := maxDuration + 5*time.Minute
-	query := fmt.Sprintf(`shelly_watts{device_name=~"%s"}`, cfg.ShellyDevicePattern)
-
-	queryURL := fmt.Sprintf("%s/api/v1/query_range?query=%s&start=%d&end=%d&step=60s",
-		cfg.VictoriaMetricsURL,
-		url.QueryEscape(query),
-		time.Now().Add(-lookback).Unix(),
-		time.Now().Unix())
-
-	req, err := http.NewRequest("GET", queryURL, nil)
-	if err != nil {
-		return 0, err
+	hist := controller.NewHistory(&cfg)
+	for _, st := range states {
+		st.Stores = []controller.MemoryStore{hist.Decisions, hist.Actions, policy}
 	}
-	req.SetBasicAuth(cfg.VictoriaMetricsUser, cfg.VictoriaMetricsPassword)
+	bus.Subscribe("history", controller.DefaultBusBuffer, hist.Handle)
+	defer bus.Close()
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return 0, err
-	}
-	defer func() {
-		_ = resp.Body.Close()
-	}()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return 0, fmt.Errorf("VM range query failed with status %d: %s", resp.StatusCode, string(body))
+	if cfg.TelegramCommands && !cfg.Once {
+		bot, err := notify.NewTelegramBot(&devices[0].Config, states[0])
+		if err != nil {
+			fatal(exitConfig, "Invalid Telegram command config", "error", err)
+		}
+		bot.SetDevices(devices, states)
+		go bot.Run(ctx)
 	}
 
-	var result VMQueryResult
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return 0, err
+	if cfg.ICalURL != "" {
+		holds, err := calendar.New(&cfg)
+		if err != nil {
+			fatal(exitConfig, "Invalid calendar config", "error", err)
+		}
+		for _, st := range states {
+			st.Calendar = holds
+		}
+		if cfg.Once {
+			holds.Update()
+		} else {
+			go holds.Run(ctx)
+		}
+		slog.Info("Calendar holds enabled", "pattern", cfg.ICalHoldPattern)
 	}
 
-	if len(result.Data.Result) == 0 {
-		return 0, nil
+	if cfg.PriceSource != config.PriceSourceOff {
+		prices, err := price.New(&cfg)
+		if err != nil {
+			fatal(exitConfig, "Invalid price source config", "error", err)
+		}
+		for _, st := range states {
+			st.Prices = prices
+		}
+		if cfg.Once {
+			prices.Update(ctx)
+		} else {
+			go prices.Run(ctx)
+		}
+		slog.Info("Electricity prices enabled", "source", prices.Name())
 	}
 
-	// Find the continuous period where power was in standby range
-	// Work backwards from most recent
-	values := result.Data.Result[0].Values // Use Values for range query
-	if len(values) > 0 {
-		var standbyStart *time.Time
-
-		// Iterate from newest to oldest
-		for i := len(values) - 1; i >= 0; i-- {
-			pair := values[i]
-			if len(pair) >= 2 {
-				timestampFloat, _ := pair[0].(float64)
-				valueStr, _ := pair[1].(string)
-
-				var watts float64
-				_, _ = fmt.Sscanf(valueStr, "%f", &watts)
-
-				if watts > minWatts && watts < maxWatts {
-					// Still in standby range
-					t := time.Unix(int64(timestampFloat), 0)
-					standbyStart = &t
-				} else {
-					// Left standby range, stop
-					break
-				}
-			}
+	if cfg.LeaderElection != config.LeaderOff {
+		elector, err := leader.New(&cfg, clk, func(identity string, isLeader bool) {
+			bus.Publish(controller.LeadershipChanged{Time: clk.Now(), Identity: identity, Leader: isLeader})
+		})
+		if err != nil {
+			fatal(exitConfig, "Invalid leader election config", "error", err)
 		}
-
-		if standbyStart != nil {
-			return time.Since(*standbyStart), nil
+		for _, st := range states {
+			st.Leader = elector
+		}
+		elector.Renew(ctx)
+		go elector.Run(ctx)
+		defer elector.Release()
+		slog.Info("Leader election enabled", "identity", elector.Identity(), "leader", elector.IsLeader())
+	}
+
+	if cfg.BambuQueuePowerOn && !cfg.Once {
+		// Every printer gets its own queue, devices sharing a serial leave its jobs to the first of them
+		polled := map[string]bool{}
+		for i := range devices {
+			dev, state := &devices[i].Config, states[i]
+			if polled[dev.BambuSerial] {
+				continue
+			}
+			polled[dev.BambuSerial] = true
+			queue := printer.NewBambuQueue(dev, func(job printer.QueuedJob) error {
+				err := controller.PowerOnForQueuedJob(dev, state, job.Title, controller.SourceQueue)
+				// Followers leave the job to the leader
+				if errors.Is(err, controller.ErrNotLeader) {
+					return nil
+				}
+				return err
+			})
+			go queue.Run(ctx)
+			slog.Info("Powering on for jobs queued in Bambu Cloud", "device", devices[i].Name, "serial", dev.BambuSerial)
 		}
 	}
 
-	return 0, nil
+	// Stay nil without the listeners, never failing
+	var listenerFailed, metricsFailed <-chan error
+	if cfg.HTTPAddr != "" && !cfg.Once {
+		srv, err := server.New(&devices[0].Config, states[0], hist)
+		if err != nil {
+			fatal(exitConfig, "Invalid HTTP listener config", "error", err)
+		}
+		srv.SetDevices(devices, states)
+		bus.Subscribe("event stream", controller.DefaultBusBuffer, srv.Handle)
+		if err := srv.Start(); err != nil {
+			fatal(exitSelfTest, "HTTP listener failed", "error", err)
+		}
+		defer srv.Shutdown()
+		listenerFailed = srv.Failed()
+	}
+	if cfg.MetricsAddr != "" && !cfg.Once {
+		exporter := telemetry.New(&cfg, httpClient)
+		bus.Subscribe("metrics", controller.DefaultBusBuffer, exporter.Handle)
+		if err := exporter.Start(); err != nil {
+			fatal(exitSelfTest, "Metrics listener failed", "error", err)
+		}
+		defer exporter.Shutdown()
+		metricsFailed = exporter.Failed()
+	}
+
+	if cfg.Once {
+		code := runOnce(ctx, devices, states)
+		heartbeat.Publish(clk.Now())
+		return code
+	}
+
+	// Every device runs its own cycles, so a slow or failing one doesn't hold up the others
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	if cfg.HeartbeatMode != config.HeartbeatOff {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			heartbeat.Run(ctx, clk)
+		}()
+	}
+	for i := range devices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runCycles(ctx, &devices[i].Config, states[i], clk)
+		}()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	code := waitForShutdown(ctx, &cfg, devices, hup, listenerFailed, metricsFailed)
+	// Running cycles finish before the bus and the listener are closed
+	cancel()
+	wg.Wait()
+	return code
 }
 
-// queryVM queries VictoriaMetrics with the given PromQL query
-func queryVM(cfg *Config, query string) (*VMQueryResult, error) {
-	queryURL := fmt.Sprintf("%s/api/v1/query?query=%s", cfg.VictoriaMetricsURL, url.QueryEscape(query))
-
-	req, err := http.NewRequest("GET", queryURL, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.SetBasicAuth(cfg.VictoriaMetricsUser, cfg.VictoriaMetricsPassword)
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		_ = resp.Body.Close()
-	}()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("VM query failed with status %d: %s", resp.StatusCode, string(body))
-	}
-
-	var result VMQueryResult
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
-	}
-
-	if result.Status != "success" {
-		return nil, fmt.Errorf("VM query returned status: %s", result.Status)
+// waitForShutdown waits until the daemon is stopped or a listener fails and returns the exit code. A
+// SIGHUP reads the _FILE secrets again and swaps the rotated ones into the running clients.
+func waitForShutdown(ctx context.Context, cfg *config.Config, devices []config.Device, hup <-chan os.Signal, listenerFailed, metricsFailed <-chan error) int {
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Shutting down")
+			return exitOK
+		case err := <-listenerFailed:
+			slog.Error("HTTP listener failed, shutting down", "error", err)
+			return exitRuntime
+		case err := <-metricsFailed:
+			slog.Error("Metrics listener failed, shutting down", "error", err)
+			return exitRuntime
+		case <-hup:
+			applied, pending, err := cfg.ReloadSecrets(devices)
+			if err != nil {
+				slog.Error("Reading the secret files failed, keeping the loaded secrets", "error", err)
+				continue
+			}
+			if len(applied) > 0 {
+				slog.Info("Secrets reloaded", "settings", strings.Join(applied, ", "))
+			}
+			if len(pending) > 0 {
+				slog.Warn("Secret files changed, restart to apply them", "settings", strings.Join(pending, ", "))
+			}
+			if len(applied) == 0 && len(pending) == 0 {
+				slog.Info("Secret files unchanged")
+			}
+		}
 	}
-
-	return &result, nil
 }
 
-// setShellyRelayOff turns off the shelly relay
-func setShellyRelayOff(cfg *Config, shellyIP string) error {
-	if cfg.DryRun {
-		log.Printf("[DRY RUN] Would turn off relay at %s", shellyIP)
-		return nil
-	}
-
-	// Shelly Gen1 API endpoint to turn off relay
-	relayURL := fmt.Sprintf("http://%s/relay/0?turn=off", shellyIP)
-
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get(relayURL)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		_ = resp.Body.Close()
-	}()
+// runCycles runs the check cycles of a device until ctx is done
+func runCycles(ctx context.Context, cfg *config.Config, state *controller.State, clk clock.Clock) {
+	// Run immediately on start, every cycle decides when the next one runs
+	next := runCycle(ctx, cfg, state)
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("shelly relay command failed with status %d: %s", resp.StatusCode, string(body))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(next):
+			next = runCycle(ctx, cfg, state)
+		}
 	}
+}
 
-	return nil
+// runCycle runs a check cycle of a device, cancelled after CYCLE_TIMEOUT, and returns the delay until the next
+func runCycle(ctx context.Context, cfg *config.Config, state *controller.State) time.Duration {
+	ctx, cancel := context.WithTimeout(ctx, cfg.CycleTimeout)
+	defer cancel()
+	return controller.RunCycle(ctx, cfg, state)
 }
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// runOnce runs a single check of every device and returns exitCheck if any failed
+func runOnce(ctx context.Context, devices []config.Device, states []*controller.State) int {
+	code := exitOK
+	for i := range devices {
+		dctx, cancel := context.WithTimeout(ctx, devices[i].Config.CycleTimeout)
+		err := controller.RunOnce(dctx, &devices[i].Config, states[i])
+		cancel()
+		if err != nil {
+			code = exitCheck
+		}
 	}
-	return defaultValue
+	return code
 }
 
-func parseDuration(s string) time.Duration {
-	d, err := time.ParseDuration(s)
+// newDeviceState creates the state of a device with its printer state source and the shared query limit.
+// The devices of DEVICES log with their name as the device attribute.
+func newDeviceState(dev *config.Device, bus *controller.Bus, c metrics.Client, queries controller.QueryLimit, clk clock.Clock) (*controller.State, error) {
+	source, err := printer.New(&dev.Config, c, clk)
 	if err != nil {
-		return 60 * time.Second
+		return nil, err
 	}
-	return d
-}
-
-func parseFloat(s string) float64 {
-	var f float64
-	_, _ = fmt.Sscanf(s, "%f", &f)
-	return f
+	plug, err := relay.New(&dev.Config)
+	if err != nil {
+		return nil, err
+	}
+	state := &controller.State{Bus: bus, Metrics: c, Queries: queries, Printer: source, Relay: plug, Clock: clk}
+	logger := slog.Default()
+	if dev.Name != "" {
+		logger = logger.With("device", dev.Name)
+		state.Log = logger
+		logger.Info("Device", "pattern", dev.Config.ShellyDevicePattern, "min_watts", dev.Config.MinWatts, "max_watts", dev.Config.MaxWatts,
+			"standby_duration", dev.Config.StandbyDuration, "channel", dev.Config.ShellyRelayChannel)
+	}
+	logger.Info("Printer state source", "source", source.Name())
+	logger.Info("Relay control", "relay", plug.Name())
+	if dev.Config.AutoOn {
+		if dev.Config.AutoOnQuery != "" {
+			logger.Info("Auto power-on when the query turns non-zero", "query", dev.Config.AutoOnQuery)
+		} else {
+			logger.Info("Auto power-on when the printer state source reports a print", "source", source.Name())
+		}
+	}
+	return state, nil
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gome-assistant/internal/calendar"
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+	"gome-assistant/internal/metrics"
+	"gome-assistant/internal/price"
+	"gome-assistant/internal/printer"
+	"gome-assistant/internal/version"
+)
+
+// statusJSON is a device of status -json
+type statusJSON struct {
+	Build                   version.Info `json:"build"`
+	Name                    string       `json:"name,omitempty"`
+	Device                  string       `json:"device"`
+	Watts                   float64      `json:"watts"`
+	MetricAgeSeconds        float64      `json:"metric_age_seconds"`
+	Stale                   bool         `json:"stale"`
+	Printing                bool         `json:"printing"`
+	PrintedRecently         bool         `json:"printed_recently"`
+	PowerOnRecently         bool         `json:"power_on_recently"`
+	StandbySeconds          float64      `json:"standby_seconds"`
+	StandbyThresholdSeconds float64      `json:"standby_threshold_seconds"`
+	Outcome                 string       `json:"outcome"`
+	Reason                  string       `json:"reason,omitempty"`
+	Detail                  string       `json:"detail"`
+	GatesPassed             []string     `json:"gates_passed"`
+	OffConditionMet         bool         `json:"off_condition_met"`
+}
+
+// runStatus is the status subcommand, printing the inputs of the gates and the decision they lead to
+// without switching the relay. It exits 0 if the off condition is met for any device.
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print a JSON line per device instead of a table")
+	cfg := config.LoadFlags(fs, args)
+	if err := cfg.Validate(); err != nil {
+		fatal(exitConfig, "Invalid config", "error", err)
+	}
+
+	devices, err := cfg.DeviceList()
+	if err != nil {
+		fatal(exitConfig, "Invalid device config", "error", err)
+	}
+	ctx := context.Background()
+	clk := clock.Real{}
+	client := metrics.NewHTTPClient(&cfg)
+	var holds *calendar.Holds
+	if cfg.ICalURL != "" {
+		if holds, err = calendar.New(&cfg); err != nil {
+			fatal(exitConfig, "Invalid calendar config", "error", err)
+		}
+		holds.Update()
+	}
+	var prices *price.Prices
+	if cfg.PriceSource != config.PriceSourceOff {
+		if prices, err = price.New(&cfg); err != nil {
+			fatal(exitConfig, "Invalid price source config", "error", err)
+		}
+		prices.Update(ctx)
+	}
+
+	code := exitNotMet
+	for i := range devices {
+		dev := &devices[i]
+		source, err := printer.New(&dev.Config, client, clk)
+		if err != nil {
+			fatal(exitConfig, "Invalid device config", "error", err)
+		}
+		state := &controller.State{Metrics: client, Printer: source, Clock: clk, Calendar: holds, Prices: prices}
+		if dev.Config.StateFile != "" {
+			if err := controller.LoadState(&dev.Config, state); err != nil {
+				slog.Error("Reading the state file failed", "path", dev.Config.StateFile, "error", err)
+			}
+		}
+
+		status, err := controller.Inspect(ctx, &dev.Config, state)
+		if err != nil {
+			if len(devices) > 1 {
+				fatal(exitCheck, "Status failed", "device", dev.Name, "error", err)
+			}
+			fatal(exitCheck, "Status failed", "error", err)
+		}
+		if *asJSON {
+			err = printStatusJSON(dev.Name, status)
+		} else {
+			if i > 0 {
+				fmt.Println()
+			}
+			err = printStatus(dev.Name, status)
+		}
+		if err != nil {
+			fatal(exitRuntime, "Printing status failed", "error", err)
+		}
+		if status.OffConditionMet() {
+			code = exitOK
+		}
+	}
+	return code
+}
+
+// printStatus prints a device as a table of inputs
+func printStatus(name string, s *controller.Inspection) error {
+	in := s.Inputs
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "Version\t%s\n", version.Get())
+	if name != "" {
+		_, _ = fmt.Fprintf(tw, "Name\t%s\n", name)
+	}
+	age := s.MetricAge.Round(time.Second).String()
+	if s.Stale {
+		age += " (stale)"
+	}
+	_, _ = fmt.Fprintf(tw, "Device\t%s\n", s.Device)
+	_, _ = fmt.Fprintf(tw, "Power\t%.2f W (standby range %.1f - %.1f W)\n", s.Watts, in.MinWatts, in.MaxWatts)
+	_, _ = fmt.Fprintf(tw, "Metric age\t%s\n", age)
+	_, _ = fmt.Fprintf(tw, "Printing\t%s\n", yesNo(in.Printing))
+	_, _ = fmt.Fprintf(tw, "Printed recently\t%s\n", yesNo(in.PrintedRecently))
+	_, _ = fmt.Fprintf(tw, "Power-on transition\t%s (within %s)\n", yesNo(in.PowerOnRecently), in.BootGracePeriod)
+	_, _ = fmt.Fprintf(tw, "Standby duration\t%s (threshold %s)\n", in.StandbyDuration.Round(time.Second), in.StandbyThreshold)
+	_, _ = fmt.Fprintf(tw, "Outcome\t%s\n", s.Decision.Outcome)
+	if s.Decision.Reason != "" {
+		_, _ = fmt.Fprintf(tw, "Reason\t%s\n", s.Decision.Reason)
+	}
+	_, _ = fmt.Fprintf(tw, "Detail\t%s\n", s.Decision.Detail)
+	_, _ = fmt.Fprintf(tw, "Gates passed\t%s\n", strings.Join(gatesPassed(s.Decision.Gates), ", "))
+	_, _ = fmt.Fprintf(tw, "Off condition met\t%s\n", yesNo(s.OffConditionMet()))
+	return tw.Flush()
+}
+
+func printStatusJSON(name string, s *controller.Inspection) error {
+	in := s.Inputs
+	return json.NewEncoder(os.Stdout).Encode(statusJSON{
+		Build:                   version.Get(),
+		Name:                    name,
+		Device:                  s.Device,
+		Watts:                   s.Watts,
+		MetricAgeSeconds:        s.MetricAge.Seconds(),
+		Stale:                   s.Stale,
+		Printing:                in.Printing,
+		PrintedRecently:         in.PrintedRecently,
+		PowerOnRecently:         in.PowerOnRecently,
+		StandbySeconds:          in.StandbyDuration.Seconds(),
+		StandbyThresholdSeconds: in.StandbyThreshold.Seconds(),
+		Outcome:                 s.Decision.Outcome,
+		Reason:                  s.Decision.Reason,
+		Detail:                  s.Decision.Detail,
+		GatesPassed:             gatesPassed(s.Decision.Gates),
+		OffConditionMet:         s.OffConditionMet(),
+	})
+}
+
+// gatesPassed names the gates set in the bitmap of a decision
+func gatesPassed(gates uint) []string {
+	names := []string{}
+	for i, name := range controller.GateNames {
+		if gates&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+
+	"gome-assistant/internal/clock"
+	"gome-assistant/internal/config"
+	"gome-assistant/internal/controller"
+	"gome-assistant/internal/metrics"
+	"gome-assistant/internal/printer"
+	"gome-assistant/internal/relay"
+)
+
+// runSwitch is the on and off subcommand, switching the relay by hand with the device resolution and
+// the credentials of the daemon
+func runSwitch(on bool, args []string) int {
+	name := "on"
+	if !on {
+		name = "off"
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	device := fs.String("device", "", "Name of the DEVICES entry to switch, required with more than one")
+	force := false
+	if !on {
+		fs.BoolVar(&force, "force", false, "Switch off even while a print is in progress")
+	}
+	cfg := config.LoadFlags(fs, args)
+	if err := cfg.Validate(); err != nil {
+		fatal(exitConfig, "Invalid config", "error", err)
+	}
+
+	dev := selectDevice(&cfg, *device)
+	clk := clock.Real{}
+	client := metrics.NewHTTPClient(&cfg)
+	source, err := printer.New(&dev.Config, client, clk)
+	if err != nil {
+		fatal(exitConfig, "Invalid device config", "error", err)
+	}
+	plug, err := relay.New(&dev.Config)
+	if err != nil {
+		fatal(exitConfig, "Invalid device config", "error", err)
+	}
+	state := &controller.State{Metrics: client, Printer: source, Relay: plug, Clock: clk}
+	if dev.Config.StateFile != "" {
+		if err := controller.LoadState(&dev.Config, state); err != nil {
+			slog.Error("Reading the state file failed", "path", dev.Config.StateFile, "error", err)
+		}
+	}
+
+	err = controller.ManualSwitch(context.Background(), &dev.Config, state, on, force)
+	switch {
+	case errors.Is(err, controller.ErrPrinting):
+		slog.Warn("Not switching off, pass -force to switch off anyway", "error", err)
+		return exitNotMet
+	case err != nil:
+		slog.Error("Switching failed", "action", name, "error", err)
+		return exitCheck
+	}
+	return exitOK
+}
+
+// selectDevice returns the entry of DEVICES called name, or the only device if name is empty
+func selectDevice(cfg *config.Config, name string) *config.Device {
+	devices, err := cfg.DeviceList()
+	if err != nil {
+		fatal(exitConfig, "Invalid device config", "error", err)
+	}
+	if name == "" {
+		if len(devices) > 1 {
+			fatal(exitConfig, "DEVICES lists more than one device, choose one with -device", "devices", len(devices))
+		}
+		return &devices[0]
+	}
+	for i := range devices {
+		if devices[i].Name == name {
+			return &devices[i]
+		}
+	}
+	fatal(exitConfig, "DEVICES has no such device", "device", name)
+	return nil
+}